@@ -0,0 +1,96 @@
+// Package clock holds the timing primitives the pulse server is built on:
+// precise waits, monotonic milliseconds, NTP timestamps and the Scheduler
+// that places beats on a drift-free grid, all reading the time from a
+// Clock: the system's, one Disciplined against an external reference, or a
+// Fake that a test moves by hand.
+package clock
+
+import (
+	"context"
+	"time"
+)
+
+// SpinWindow is how long before a deadline precise waits stop sleeping and
+// spin: sleeps overshoot by up to a scheduler tick, spinning does not.
+const SpinWindow = 2 * time.Millisecond
+
+// Clock is where timing code reads the time and waits.
+type Clock interface {
+	Now() time.Time
+	// SleepUntil waits until t, reporting false if ctx was done or wake
+	// closed first.
+	SleepUntil(ctx context.Context, t time.Time, wake <-chan struct{}) bool
+}
+
+// Real is the system clock, with the precise waits of SleepUntilOr.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) SleepUntil(ctx context.Context, t time.Time, wake <-chan struct{}) bool {
+	return SleepUntilOr(ctx, t, wake)
+}
+
+// SleepUntil waits until t, sleeping in shrinking segments and spinning the
+// last SpinWindow. It reports false if ctx was done first.
+func SleepUntil(ctx context.Context, t time.Time) bool {
+	return SleepUntilOr(ctx, t, nil)
+}
+
+// SleepUntilOr is SleepUntil that also gives up, reporting false, once wake
+// is closed.
+func SleepUntilOr(ctx context.Context, t time.Time, wake <-chan struct{}) bool {
+	for {
+		d := time.Until(t)
+		if d <= SpinWindow {
+			break
+		}
+		// Sleep at most half the remaining time per segment so an
+		// oversleep never costs more than a fraction of the wait.
+		seg := d - SpinWindow
+		if d > 8*SpinWindow {
+			seg = d / 2
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-wake:
+			return false
+		case <-time.After(seg):
+		}
+	}
+	for time.Now().Before(t) {
+	}
+	return ctx.Err() == nil
+}
+
+// Start anchors MonoMS. It carries Go's monotonic clock reading, so
+// durations measured from it are unaffected by wall clock steps. A process
+// taking over from another moves it back to the old process's start.
+var Start = time.Now()
+
+// MonoMS returns monotonic milliseconds between Start and t, which must
+// itself carry a monotonic reading (any time.Now() derived value).
+func MonoMS(t time.Time) int64 {
+	return t.Sub(Start).Milliseconds()
+}
+
+// ntpEpochOffset is the number of seconds from 1900 to 1970.
+const ntpEpochOffset = 2208988800
+
+// NTPTime is t as a 64-bit NTP timestamp: seconds since 1900 and a binary
+// fraction.
+func NTPTime(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return secs<<32 | frac
+}
+
+// FromNTPTime is the time of the 64-bit NTP timestamp ts, in era 0.
+func FromNTPTime(ts uint64) time.Time {
+	secs := int64(ts>>32) - ntpEpochOffset
+	nsec := int64((ts & 0xffffffff) * uint64(time.Second) >> 32)
+	return time.Unix(secs, nsec)
+}
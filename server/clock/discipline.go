@@ -0,0 +1,110 @@
+package clock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// StepThreshold is how far off a correction must find a Disciplined clock
+// before it steps instead of slewing, as ntpd does.
+const StepThreshold = 128 * time.Millisecond
+
+// SlewRate is how fast a Disciplined clock slews: 500 µs per second, so
+// periods stretch or shrink by at most 0.05% while it does.
+const SlewRate = 500e-6
+
+// Disciplined is the system clock moved by an offset measured against an
+// external reference such as an NTP server or a PPS device, so that Now
+// tells true UTC however the host's clock is kept. Corrections below
+// StepThreshold are slewed in at SlewRate, so the beats they move never
+// jump; larger ones, and the first, step. Waits take the offset off again
+// and wait on the monotonic clock.
+type Disciplined struct {
+	mu sync.Mutex
+	// The offset is base as of since, moving toward target at SlewRate.
+	base, target time.Duration
+	since        time.Time
+	stepped      bool
+}
+
+// NewDisciplined returns a clock with no offset until Correct is called.
+func NewDisciplined() *Disciplined {
+	return &Disciplined{since: time.Now()}
+}
+
+// Now is the disciplined time.
+func (d *Disciplined) Now() time.Time {
+	return d.At(time.Now())
+}
+
+// At is the disciplined time when the system clock read local. A nil d
+// leaves local as it is.
+func (d *Disciplined) At(local time.Time) time.Time {
+	if d == nil {
+		return local
+	}
+	return local.Add(d.offsetAt(local))
+}
+
+// Offset is what is added to the system clock now.
+func (d *Disciplined) Offset() time.Duration {
+	return d.offsetAt(time.Now())
+}
+
+// Slewing is how much of the last correction is still to be slewed in.
+func (d *Disciplined) Slewing() time.Duration {
+	now := time.Now()
+	d.mu.Lock()
+	target := d.target
+	d.mu.Unlock()
+	return target - d.offsetAt(now)
+}
+
+func (d *Disciplined) offsetAt(local time.Time) time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	gap := d.target - d.base
+	most := time.Duration(float64(local.Sub(d.since)) * SlewRate)
+	switch {
+	case most < 0:
+		return d.base
+	case gap > most:
+		return d.base + most
+	case gap < -most:
+		return d.base - most
+	}
+	return d.target
+}
+
+// Correct sets the offset to add to the system clock, slewing or stepping
+// to it, and reports whether it stepped.
+func (d *Disciplined) Correct(offset time.Duration) bool {
+	now := time.Now()
+	cur := d.offsetAt(now)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	step := !d.stepped || (offset-cur).Abs() >= StepThreshold
+	d.base, d.target, d.since, d.stepped = cur, offset, now, true
+	if step {
+		d.base = offset
+	}
+	return step
+}
+
+// SleepUntil waits until the disciplined time is t.
+func (d *Disciplined) SleepUntil(ctx context.Context, t time.Time, wake <-chan struct{}) bool {
+	for {
+		now := time.Now()
+		left := t.Sub(d.At(now))
+		if left <= 0 {
+			return ctx.Err() == nil
+		}
+		// The offset may slew meanwhile, so wake as early as slewing
+		// could make t come and check again.
+		left -= time.Duration(float64(left) * SlewRate)
+		if !SleepUntilOr(ctx, now.Add(left), wake) {
+			return false
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package clock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Fake is a Clock that stands still until Advance or Set moves it, so
+// timing logic can be driven deterministically: a test waits for the code
+// under test to sleep (BlockUntil), moves the clock past the deadline, and
+// looks at what happened. Its times carry no monotonic reading.
+type Fake struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	sleeper []*fakeSleeper
+}
+
+type fakeSleeper struct {
+	until time.Time
+	done  chan struct{}
+}
+
+// NewFake returns a Fake reading start.
+func NewFake(start time.Time) *Fake {
+	f := &Fake{now: start.Round(0)}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Advance moves the clock d ahead, waking the sleepers whose time has come.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	t := f.now.Add(d)
+	f.mu.Unlock()
+	f.Set(t)
+}
+
+// Set moves the clock to t, waking the sleepers whose time has come. Going
+// back wakes nobody.
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = t.Round(0)
+	kept := f.sleeper[:0]
+	for _, s := range f.sleeper {
+		if f.now.Before(s.until) {
+			kept = append(kept, s)
+		} else {
+			close(s.done)
+		}
+	}
+	f.sleeper = kept
+}
+
+// SleepUntil waits until the clock has been moved to t or past it, without
+// spinning.
+func (f *Fake) SleepUntil(ctx context.Context, t time.Time, wake <-chan struct{}) bool {
+	f.mu.Lock()
+	if !f.now.Before(t) {
+		f.mu.Unlock()
+		return ctx.Err() == nil
+	}
+	s := &fakeSleeper{until: t, done: make(chan struct{})}
+	f.sleeper = append(f.sleeper, s)
+	f.cond.Broadcast()
+	f.mu.Unlock()
+	select {
+	case <-s.done:
+		return ctx.Err() == nil
+	case <-ctx.Done():
+	case <-wake:
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, o := range f.sleeper {
+		if o == s {
+			f.sleeper = append(f.sleeper[:i], f.sleeper[i+1:]...)
+			break
+		}
+	}
+	return false
+}
+
+// BlockUntil waits until n goroutines sleep on the clock.
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.sleeper) < n {
+		f.cond.Wait()
+	}
+}
+
+// Next is the earliest time a sleeper waits for, false with none asleep.
+func (f *Fake) Next() (time.Time, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.sleeper) == 0 {
+		return time.Time{}, false
+	}
+	next := f.sleeper[0].until
+	for _, s := range f.sleeper[1:] {
+		if s.until.Before(next) {
+			next = s.until
+		}
+	}
+	return next, true
+}
@@ -0,0 +1,76 @@
+package clock
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// phcSamples is how many readings of a PTP hardware clock ReadOffset takes
+// the tightest of.
+const phcSamples = 5
+
+// PHC is a PTP hardware clock, /dev/ptpN: the clock on a network card that
+// ptp4l keeps to the venue's grandmaster, read directly rather than
+// through the system clock phc2sys would otherwise keep to it. PTP counts
+// TAI, so UTCOffset, the leap seconds TAI is ahead, is taken off; it is 0
+// for a clock kept on UTC.
+type PHC struct {
+	f         *os.File
+	id        uintptr
+	UTCOffset time.Duration
+}
+
+// OpenPHC opens the PTP hardware clock at path and reads it once.
+func OpenPHC(path string, utcOffset time.Duration) (*PHC, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// A dynamic POSIX clock's id is its descriptor, inverted and tagged
+	// CLOCKFD (3); see FD_TO_CLOCKID in the kernel's posix-timers.h.
+	p := &PHC{f: f, id: uintptr(int(^int32(f.Fd())<<3 | 3)), UTCOffset: utcOffset}
+	if _, err := p.read(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return p, nil
+}
+
+func (p *PHC) read() (time.Time, error) {
+	var ts syscall.Timespec
+	if _, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, p.id, uintptr(unsafe.Pointer(&ts)), 0); errno != 0 {
+		return time.Time{}, errno
+	}
+	return time.Unix(ts.Unix()), nil
+}
+
+// ReadOffset reads the hardware clock between two readings of the system
+// clock, phcSamples times, and takes the offset from the readings closest
+// together, against their midpoint.
+func (p *PHC) ReadOffset() (time.Duration, error) {
+	var (
+		best   time.Duration
+		window time.Duration = -1
+	)
+	for range phcSamples {
+		before := time.Now()
+		t, err := p.read()
+		after := time.Now()
+		if err != nil {
+			return 0, err
+		}
+		if w := after.Sub(before); window < 0 || w < window {
+			window = w
+			best = t.Sub(before.Add(w/2).Round(0)) - p.UTCOffset
+		}
+	}
+	return best, nil
+}
+
+// Close closes the device.
+func (p *PHC) Close() error {
+	return p.f.Close()
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package clock
+
+import (
+	"errors"
+	"time"
+)
+
+// PHC is a PTP hardware clock; they are only read on Linux.
+type PHC struct {
+	UTCOffset time.Duration
+}
+
+// OpenPHC fails: PTP hardware clocks are only read on Linux.
+func OpenPHC(path string, utcOffset time.Duration) (*PHC, error) {
+	return nil, errors.New("PTP hardware clocks are only read on Linux")
+}
+
+func (p *PHC) ReadOffset() (time.Duration, error) {
+	return 0, errors.New("PTP hardware clocks are only read on Linux")
+}
+
+// Close does nothing.
+func (p *PHC) Close() error { return nil }
@@ -0,0 +1,83 @@
+package clock
+
+import "time"
+
+// Scheduler places beats on a fixed grid, epoch + slot·period, so
+// scheduling error never accumulates. The grid runs on the monotonic clock:
+// an NTP step or a manual clock change never shifts when beats fall or how
+// far apart they are. Slots missed entirely (a stalled process) are skipped
+// rather than bunched up.
+//
+// A Scheduler is not safe for concurrent use; one goroutine, such as a
+// channel's pulse loop, owns it.
+type Scheduler struct {
+	clock  Clock
+	epoch  time.Time
+	slot   int64
+	period time.Duration
+}
+
+// NewScheduler returns a Scheduler on the system clock whose first beat is
+// now, so new clients can start predicting without waiting a full period.
+// A period of zero or less is a second.
+func NewScheduler(period time.Duration) *Scheduler {
+	return NewSchedulerOn(Real, period)
+}
+
+// NewSchedulerOn is NewScheduler reading the time from c.
+func NewSchedulerOn(c Clock, period time.Duration) *Scheduler {
+	if period <= 0 {
+		period = time.Second
+	}
+	return &Scheduler{clock: c, epoch: c.Now(), period: period}
+}
+
+// Next is when the next beat falls.
+func (s *Scheduler) Next() time.Time {
+	return s.epoch.Add(time.Duration(s.slot) * s.period)
+}
+
+// Period is the time between beats.
+func (s *Scheduler) Period() time.Duration {
+	return s.period
+}
+
+// Epoch is the grid's anchor, the beat it was last restarted at.
+func (s *Scheduler) Epoch() time.Time {
+	return s.epoch
+}
+
+// Restart starts a fresh grid with its next beat at at and period between
+// beats.
+func (s *Scheduler) Restart(at time.Time, period time.Duration) {
+	s.epoch, s.slot, s.period = at, 0, period
+}
+
+// Resume carries on with a grid that had a beat at at, a time with only a
+// wall clock reading such as one handed over by another process, and
+// returns how many beats after at its next beat still ahead is. From there
+// on the grid runs on the monotonic clock again.
+func (s *Scheduler) Resume(at time.Time) int64 {
+	s.epoch = s.epoch.Add(-s.epoch.Round(0).Sub(at))
+	s.slot = int64(s.clock.Now().Sub(s.epoch)/s.period) + 1
+	return s.slot
+}
+
+// Advance moves on to the beat after Next, skipping any already past, and
+// returns how many it skipped.
+func (s *Scheduler) Advance() int64 {
+	s.slot++
+	return s.Skip()
+}
+
+// Skip moves Next past beats that have gone by, e.g. while paused, and
+// returns how many it skipped.
+func (s *Scheduler) Skip() int64 {
+	behind := int64(s.clock.Now().Sub(s.epoch) / s.period)
+	if behind < s.slot {
+		return 0
+	}
+	skipped := behind + 1 - s.slot
+	s.slot = behind + 1
+	return skipped
+}
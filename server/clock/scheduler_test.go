@@ -0,0 +1,101 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var start = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestSchedulerGrid(t *testing.T) {
+	f := NewFake(start)
+	s := NewSchedulerOn(f, 100*time.Millisecond)
+	if got := s.Next(); !got.Equal(start) {
+		t.Fatalf("first beat at %v, want now (%v)", got, start)
+	}
+	// Beats stay on the grid however late each one is handled.
+	for k := 1; k <= 5; k++ {
+		f.Advance(130 * time.Millisecond / 5)
+		if n := s.Advance(); n != 0 {
+			t.Fatalf("beat %d: skipped %d, want 0", k, n)
+		}
+		if want := start.Add(time.Duration(k) * 100 * time.Millisecond); !s.Next().Equal(want) {
+			t.Fatalf("beat %d at %v, want %v", k, s.Next(), want)
+		}
+	}
+}
+
+func TestSchedulerAdvanceSkipsMissedBeats(t *testing.T) {
+	f := NewFake(start)
+	s := NewSchedulerOn(f, 100*time.Millisecond)
+	// The beat at 0 is handled, then the process stalls until 350ms: the
+	// beats at 100, 200 and 300ms are gone by.
+	f.Set(start.Add(350 * time.Millisecond))
+	if n := s.Advance(); n != 3 {
+		t.Fatalf("skipped %d, want 3", n)
+	}
+	if want := start.Add(400 * time.Millisecond); !s.Next().Equal(want) {
+		t.Fatalf("next beat at %v, want %v", s.Next(), want)
+	}
+	// Exactly on a beat, that beat is gone by too.
+	f.Set(start.Add(500 * time.Millisecond))
+	if n := s.Advance(); n != 1 {
+		t.Fatalf("skipped %d, want 1", n)
+	}
+	if want := start.Add(600 * time.Millisecond); !s.Next().Equal(want) {
+		t.Fatalf("next beat at %v, want %v", s.Next(), want)
+	}
+}
+
+func TestSchedulerSkip(t *testing.T) {
+	f := NewFake(start)
+	s := NewSchedulerOn(f, time.Second)
+	if n := s.Skip(); n != 1 {
+		t.Fatalf("skipped %d at the first beat, want 1", n)
+	}
+	f.Advance(500 * time.Millisecond)
+	if n := s.Skip(); n != 0 {
+		t.Fatalf("skipped %d with the next beat ahead, want 0", n)
+	}
+	f.Advance(2 * time.Second) // paused until 2.5s
+	if n := s.Skip(); n != 2 {
+		t.Fatalf("skipped %d, want 2", n)
+	}
+	if want := start.Add(3 * time.Second); !s.Next().Equal(want) {
+		t.Fatalf("next beat at %v, want %v", s.Next(), want)
+	}
+}
+
+func TestSchedulerRestart(t *testing.T) {
+	f := NewFake(start)
+	s := NewSchedulerOn(f, 100*time.Millisecond)
+	s.Advance()
+	at := start.Add(130 * time.Millisecond)
+	s.Restart(at, 250*time.Millisecond)
+	if !s.Next().Equal(at) || !s.Epoch().Equal(at) || s.Period() != 250*time.Millisecond {
+		t.Fatalf("after restart: next %v, epoch %v, period %v", s.Next(), s.Epoch(), s.Period())
+	}
+	f.Set(at)
+	s.Advance()
+	if want := at.Add(250 * time.Millisecond); !s.Next().Equal(want) {
+		t.Fatalf("next beat at %v, want %v", s.Next(), want)
+	}
+}
+
+func TestSchedulerResume(t *testing.T) {
+	f := NewFake(start.Add(10 * time.Second))
+	s := NewSchedulerOn(f, time.Second)
+	// The old process had a beat at 7.5s; 8.5 and 9.5 have gone by, so
+	// the grid carries on at 10.5, three beats on.
+	if n := s.Resume(start.Add(7500 * time.Millisecond)); n != 3 {
+		t.Fatalf("resumed %d beats on, want 3", n)
+	}
+	if want := start.Add(10500 * time.Millisecond); !s.Next().Equal(want) {
+		t.Fatalf("next beat at %v, want %v", s.Next(), want)
+	}
+	f.Set(s.Next())
+	s.Advance()
+	if want := start.Add(11500 * time.Millisecond); !s.Next().Equal(want) {
+		t.Fatalf("next beat at %v, want %v", s.Next(), want)
+	}
+}
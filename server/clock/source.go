@@ -0,0 +1,29 @@
+package clock
+
+import "time"
+
+// Source is a time scale kept against the system clock, which is what the
+// waits run on: the system clock itself, a Disciplined clock, whether an
+// external reference or an operator corrects it, or a PTP hardware clock.
+// A clock domain keeps its beats on whole periods of its Source's time.
+type Source interface {
+	// ReadOffset is what is added to the system clock's time now to tell
+	// the source's. Reading a device can fail where the system clock
+	// cannot.
+	ReadOffset() (time.Duration, error)
+}
+
+// System is the system clock as a Source.
+var System Source = systemSource{}
+
+type systemSource struct{}
+
+func (systemSource) ReadOffset() (time.Duration, error) { return 0, nil }
+
+// ReadOffset is Offset as a Source; a nil d is the system clock.
+func (d *Disciplined) ReadOffset() (time.Duration, error) {
+	if d == nil {
+		return 0, nil
+	}
+	return d.Offset(), nil
+}
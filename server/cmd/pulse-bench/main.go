@@ -0,0 +1,485 @@
+// Command pulse-bench load-tests a pulse server: it connects simulated
+// WebSocket clients, measures how late each pulse reaches each of them and
+// how evenly, and prints a report.
+//
+//	pulse-bench -url ws://pulse.local:8080/ws -clients 2000 -duration 30s
+//	pulse-bench -url ws://pulse.local:8080/ws -clients 20000 -step 1000
+//
+// Latency is from a pulse's scheduled slot, now_ms less drift_ms, to its
+// arrival, in the server's clock as a sync_req burst on connect measures
+// it; jitter is how much it changes from one pulse to the next on a
+// client. A pulse's broadcast time is its latency at the slowest client.
+// With -step the clients connect in stages of that many, each measured for
+// -duration, and the run stops at the first stage whose p99 broadcast time
+// exceeds the period: about as many subscribers as the server, and the
+// host running pulse-bench, can take.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"pulse/ws"
+)
+
+// syncBurst is how many sync_req a client sends on connect; the one with
+// the shortest round trip sets its clock offset.
+const syncBurst = 5
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("pulse-bench: ")
+	target := flag.String("url", "ws://localhost:8080/ws", "WebSocket URL of the server under test")
+	clients := flag.Int("clients", 100, "number of clients to connect")
+	step := flag.Int("step", 0, "connect clients in stages of this many, stopping once broadcast time exceeds the period; 0 connects them all at once")
+	duration := flag.Duration("duration", 30*time.Second, "how long to measure each stage")
+	settle := flag.Duration("settle", 2*time.Second, "wait after connecting before measuring")
+	dialers := flag.Int("dial-concurrency", 50, "connections being set up at once")
+	token := flag.String("token", "", "bearer token sent with the upgrade request")
+	asJSON := flag.Bool("json", false, "print reports as JSON lines")
+	flag.Parse()
+	if *clients < 1 || *step < 0 || *dialers < 1 || *duration <= 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	u, err := url.Parse(*target)
+	if err != nil {
+		log.Fatalf("-url: %v", err)
+	}
+	q := u.Query()
+	q.Set("precision", "us")
+	u.RawQuery = q.Encode()
+	header := http.Header{}
+	if *token != "" {
+		header.Set("Authorization", "Bearer "+*token)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	b := &bench{url: u.String(), header: header, seqs: make(map[uint64]*pulseStat)}
+	stages := []int{*clients}
+	if *step > 0 {
+		stages = nil
+		for n := *step; n < *clients+*step; n += *step {
+			stages = append(stages, min(n, *clients))
+		}
+	}
+	if !*asJSON {
+		printHeader()
+	}
+	var last *report
+	for _, n := range stages {
+		b.connect(ctx, n, *dialers)
+		if !sleep(ctx, *settle) {
+			break
+		}
+		b.reset()
+		if !sleep(ctx, *duration) {
+			break
+		}
+		r := b.report(*duration)
+		if *asJSON {
+			_ = json.NewEncoder(os.Stdout).Encode(r)
+		} else {
+			r.print()
+		}
+		if r.Connected == 0 {
+			log.Fatalf("no client connected: %v", b.firstErr())
+		}
+		if *step > 0 && r.over() {
+			if !*asJSON {
+				if last != nil {
+					fmt.Printf("capacity: about %d clients; at %d the p99 broadcast time of %.1fms exceeded the %.1fms period\n", last.Connected, r.Connected, r.Broadcast.P99, r.PeriodMS)
+				} else {
+					fmt.Printf("capacity: under %d clients; the p99 broadcast time of %.1fms exceeded the %.1fms period\n", r.Connected, r.Broadcast.P99, r.PeriodMS)
+				}
+			}
+			break
+		}
+		last = &r
+	}
+	b.close()
+}
+
+// sleep waits for d, reporting false if ctx was done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// bench is the clients of a run and what they measured in the current
+// stage.
+type bench struct {
+	url    string
+	header http.Header
+
+	clients []*client
+	failed  atomic.Int64
+	errMu   sync.Mutex
+	err     error
+
+	// period is the channel's, in microseconds, from the first hello.
+	period atomic.Int64
+
+	mu sync.Mutex
+	// seqs are the pulses seen in the stage.
+	seqs map[uint64]*pulseStat
+}
+
+// pulseStat is how one pulse went out to the clients.
+type pulseStat struct {
+	slowest time.Duration
+}
+
+// connect adds clients until there are n, dialers at a time.
+func (b *bench) connect(ctx context.Context, n, dialers int) {
+	sem := make(chan struct{}, dialers)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i := len(b.clients); i < n && ctx.Err() == nil; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			c, err := b.dial(ctx)
+			if err != nil {
+				b.fail(err)
+				return
+			}
+			mu.Lock()
+			b.clients = append(b.clients, c)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+}
+
+func (b *bench) fail(err error) {
+	b.failed.Add(1)
+	b.errMu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.errMu.Unlock()
+}
+
+func (b *bench) firstErr() error {
+	b.errMu.Lock()
+	defer b.errMu.Unlock()
+	return b.err
+}
+
+// reset starts a stage: every client's samples and the pulses seen so far
+// are forgotten.
+func (b *bench) reset() {
+	for _, c := range b.clients {
+		c.reset()
+	}
+	b.mu.Lock()
+	clear(b.seqs)
+	b.mu.Unlock()
+}
+
+// delivered records that a client got pulse seq latency after its slot.
+func (b *bench) delivered(seq uint64, latency time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p := b.seqs[seq]
+	if p == nil {
+		p = &pulseStat{}
+		b.seqs[seq] = p
+	}
+	p.slowest = max(p.slowest, latency)
+}
+
+// close closes every client, waiting a moment for the server to answer
+// their close frames.
+func (b *bench) close() {
+	for _, c := range b.clients {
+		c.closed.Store(true)
+		_ = c.write(ws.OpClose, ws.ClosePayload(ws.CloseNormal, ""))
+	}
+	grace := time.After(time.Second)
+	for _, c := range b.clients {
+		select {
+		case <-c.done:
+		case <-grace:
+		}
+		_ = c.conn.Close()
+	}
+}
+
+// client is one simulated subscriber.
+type client struct {
+	b    *bench
+	conn net.Conn
+
+	writeMu sync.Mutex
+	closed  atomic.Bool
+	// done is closed once the connection is.
+	done chan struct{}
+
+	mu sync.Mutex
+	// offset is the server's clock minus the local one; rtt is the round
+	// trip it was measured with, 0 until one was.
+	offset, rtt time.Duration
+	prev        time.Duration // latency of the previous pulse
+	prevSeq     uint64
+	seen        bool
+	latency     []time.Duration
+	jitter      []time.Duration
+	missed      int
+	dropped     bool
+}
+
+// dial connects a client and starts reading its pulses.
+func (b *bench) dial(ctx context.Context) (*client, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	conn, br, resp, err := ws.Dial(dialCtx, b.url, b.header, "pulse.v2+json")
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	if p := resp.Header.Get("Sec-WebSocket-Protocol"); p != "pulse.v2+json" {
+		_ = conn.Close()
+		return nil, fmt.Errorf("server chose subprotocol %q", p)
+	}
+	c := &client{b: b, conn: conn, done: make(chan struct{})}
+	go c.read(br)
+	go c.sync()
+	return c, nil
+}
+
+func (c *client) write(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := c.conn.Write(ws.AppendMaskedFrame(nil, opcode, payload))
+	return err
+}
+
+// sync sends the sync_req burst.
+func (c *client) sync() {
+	for i := range syncBurst {
+		req, _ := json.Marshal(map[string]any{"type": "sync_req", "id": i, "t1": unixMS(time.Now())})
+		if c.write(ws.OpText, req) != nil {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// read handles frames until the connection fails.
+func (c *client) read(br *bufio.Reader) {
+	defer close(c.done)
+	for {
+		f, err := ws.ReadFrameLimit(br, false, 0, 1<<20)
+		if err != nil {
+			if !c.closed.Load() {
+				c.mu.Lock()
+				c.dropped = true
+				c.mu.Unlock()
+				c.b.fail(err)
+			}
+			return
+		}
+		at := time.Now()
+		switch f.Opcode {
+		case ws.OpPing:
+			_ = c.write(ws.OpPong, f.Payload)
+		case ws.OpClose:
+			if !c.closed.Load() {
+				c.mu.Lock()
+				c.dropped = true
+				c.mu.Unlock()
+				c.b.fail(errors.New("server closed the connection"))
+			}
+			_ = c.conn.Close()
+			return
+		case ws.OpText:
+			c.handle(f.Payload, at)
+		}
+	}
+}
+
+func (c *client) handle(payload []byte, at time.Time) {
+	var m struct {
+		Type     string  `json:"type"`
+		Seq      uint64  `json:"seq"`
+		PeriodUS int64   `json:"period_us"`
+		NowMS    float64 `json:"now_ms"`
+		NowUS    int64   `json:"now_us"`
+		DriftMS  float64 `json:"drift_ms"`
+		T1       float64 `json:"t1"`
+		T2       float64 `json:"t2"`
+		T3       float64 `json:"t3"`
+	}
+	if json.Unmarshal(payload, &m) != nil {
+		return
+	}
+	switch m.Type {
+	case "hello":
+		if m.PeriodUS > 0 {
+			c.b.period.CompareAndSwap(0, m.PeriodUS)
+		}
+	case "sync_resp":
+		t4 := unixMS(at)
+		rtt := fromMS((t4 - m.T1) - (m.T3 - m.T2))
+		c.mu.Lock()
+		if c.rtt == 0 || rtt < c.rtt {
+			c.offset, c.rtt = fromMS(((m.T2-m.T1)+(m.T3-t4))/2), max(rtt, 1)
+		}
+		c.mu.Unlock()
+	case "pulse":
+		now := m.NowMS * 1000
+		if m.NowUS != 0 {
+			now = float64(m.NowUS)
+		}
+		slot := time.UnixMicro(int64(now)).Add(-fromMS(m.DriftMS))
+		c.mu.Lock()
+		if c.rtt == 0 {
+			c.mu.Unlock()
+			return
+		}
+		latency := at.Add(c.offset).Sub(slot)
+		if c.seen {
+			c.jitter = append(c.jitter, (latency - c.prev).Abs())
+			if m.Seq > c.prevSeq+1 {
+				c.missed += int(m.Seq - c.prevSeq - 1)
+			}
+		}
+		c.latency = append(c.latency, latency)
+		c.prev, c.prevSeq, c.seen = latency, m.Seq, true
+		c.mu.Unlock()
+		c.b.delivered(m.Seq, latency)
+	}
+}
+
+func (c *client) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.latency, c.jitter, c.missed, c.seen = c.latency[:0], c.jitter[:0], 0, false
+}
+
+// report is one stage's measurements; times are in milliseconds.
+type report struct {
+	Clients   int `json:"clients"`
+	Connected int `json:"connected"`
+	// Failed counts connections that could not be set up or were lost,
+	// over the whole run.
+	Failed   int     `json:"failed"`
+	Seconds  float64 `json:"seconds"`
+	PeriodMS float64 `json:"period_ms"`
+	Pulses   int     `json:"pulses"`
+	// Missed counts pulses clients did not get, by gaps in seq.
+	Missed    int         `json:"missed"`
+	Latency   percentiles `json:"latency_ms"`
+	Jitter    percentiles `json:"jitter_ms"`
+	ClientP99 percentiles `json:"client_p99_latency_ms"`
+	Broadcast percentiles `json:"broadcast_ms"`
+	// OverPeriod counts pulses whose broadcast time exceeded the period.
+	OverPeriod int `json:"over_period"`
+}
+
+type percentiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// over reports whether the stage's broadcasts no longer fit in the period.
+func (r report) over() bool {
+	return r.PeriodMS > 0 && r.Broadcast.P99 > r.PeriodMS
+}
+
+func (b *bench) report(d time.Duration) report {
+	r := report{Clients: len(b.clients), Failed: int(b.failed.Load()), Seconds: d.Seconds(), PeriodMS: float64(b.period.Load()) / 1000}
+	var latency, jitter, clientP99, broadcast []time.Duration
+	for _, c := range b.clients {
+		c.mu.Lock()
+		if !c.dropped {
+			r.Connected++
+		}
+		r.Missed += c.missed
+		latency = append(latency, c.latency...)
+		jitter = append(jitter, c.jitter...)
+		if len(c.latency) > 0 {
+			sorted := slices.Clone(c.latency)
+			slices.Sort(sorted)
+			clientP99 = append(clientP99, pct(sorted, 0.99))
+		}
+		c.mu.Unlock()
+	}
+	b.mu.Lock()
+	r.Pulses = len(b.seqs)
+	for _, p := range b.seqs {
+		broadcast = append(broadcast, p.slowest)
+		if r.PeriodMS > 0 && ms(p.slowest) > r.PeriodMS {
+			r.OverPeriod++
+		}
+	}
+	b.mu.Unlock()
+	r.Latency, r.Jitter, r.ClientP99, r.Broadcast = summarize(latency), summarize(jitter), summarize(clientP99), summarize(broadcast)
+	return r
+}
+
+func printHeader() {
+	fmt.Printf("%8s %9s %6s %6s %6s %21s %14s %14s %21s %5s\n",
+		"clients", "connected", "failed", "pulses", "missed", "latency p50/p99/max", "jitter p50/p99", "client p99 max", "broadcast p50/p99/max", "over")
+}
+
+func (r report) print() {
+	fmt.Printf("%8d %9d %6d %6d %6d %21s %14s %14s %21s %5d\n",
+		r.Clients, r.Connected, r.Failed, r.Pulses, r.Missed,
+		fmt.Sprintf("%.1f/%.1f/%.1f", r.Latency.P50, r.Latency.P99, r.Latency.Max),
+		fmt.Sprintf("%.2f/%.2f", r.Jitter.P50, r.Jitter.P99),
+		fmt.Sprintf("%.1f", r.ClientP99.Max),
+		fmt.Sprintf("%.1f/%.1f/%.1f", r.Broadcast.P50, r.Broadcast.P99, r.Broadcast.Max),
+		r.OverPeriod)
+}
+
+func summarize(ds []time.Duration) percentiles {
+	if len(ds) == 0 {
+		return percentiles{}
+	}
+	slices.Sort(ds)
+	return percentiles{P50: ms(pct(ds, 0.5)), P90: ms(pct(ds, 0.9)), P99: ms(pct(ds, 0.99)), Max: ms(ds[len(ds)-1])}
+}
+
+// pct is the q-quantile of sorted ds.
+func pct(ds []time.Duration, q float64) time.Duration {
+	return ds[int(math.Ceil(q*float64(len(ds))))-1]
+}
+
+func ms(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Millisecond)*1000) / 1000
+}
+
+func unixMS(t time.Time) float64 {
+	return float64(t.UnixMicro()) / 1000
+}
+
+func fromMS(v float64) time.Duration {
+	return time.Duration(v * float64(time.Millisecond))
+}
@@ -0,0 +1,88 @@
+// Command pulse-conformance runs the protocol conformance suite against a
+// pulse server and exits non-zero if any check fails.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"pulse/conformance"
+)
+
+func main() {
+	url := flag.String("url", "ws://localhost:8080/ws", "WebSocket URL of the server under test")
+	protocol := flag.String("protocol", "pulse.v2+json", "subprotocol to offer; empty tests the legacy v1 stream")
+	pulses := flag.Int("pulses", 5, "number of pulses to observe")
+	tolerance := flag.Duration("tolerance", 50*time.Millisecond, "allowed timing deviation")
+	timeout := flag.Duration("timeout", 5*time.Second, "handshake and read timeout")
+	checkTimeout := flag.Duration("check-timeout", 0, "time limit of each check (default: the read timeout for each pulse a check may wait for)")
+	token := flag.String("token", "", "bearer token sent with the upgrade request")
+	adminToken := flag.String("admin-token", "", "controller or admin token for the tempo-change check, which retunes the channel and restores its period; skipped without one")
+	adminURL := flag.String("admin-url", "", "base URL of the admin API (default: the server's host over http or https)")
+	asJSON := flag.Bool("json", false, "print results as JSON")
+	list := flag.Bool("list", false, "list checks and exit")
+	flag.Parse()
+
+	if *list {
+		for _, c := range conformance.Checks {
+			fmt.Printf("%-16s %s\n", c.Name, c.Desc)
+		}
+		return
+	}
+
+	header := http.Header{}
+	if *token != "" {
+		header.Set("Authorization", "Bearer "+*token)
+	}
+	results, err := conformance.Run(conformance.Options{
+		URL:          *url,
+		Protocol:     *protocol,
+		Header:       header,
+		Pulses:       *pulses,
+		Tolerance:    *tolerance,
+		Timeout:      *timeout,
+		CheckTimeout: *checkTimeout,
+
+		AdminToken: *adminToken,
+		AdminURL:   *adminURL,
+	}, conformance.Checks)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := 0
+	for _, r := range results {
+		if !r.Passed {
+			failed++
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(results)
+	} else {
+		for _, r := range results {
+			status := "PASS"
+			switch {
+			case r.Skipped:
+				status = "SKIP"
+			case !r.Passed:
+				status = "FAIL"
+			}
+			if r.Detail != "" {
+				fmt.Printf("%s %-16s %s\n", status, r.Name, r.Detail)
+			} else {
+				fmt.Printf("%s %s\n", status, r.Name)
+			}
+		}
+		fmt.Printf("%d/%d checks passed\n", len(results)-failed, len(results))
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
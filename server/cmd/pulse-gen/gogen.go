@@ -0,0 +1,453 @@
+package main
+
+import (
+	"fmt"
+	"go/format"
+	"strings"
+)
+
+const goHeader = "// Code generated by pulse-gen from schema.json; DO NOT EDIT.\n"
+
+// conv converts expr of type from to type to.
+func conv(to, from, expr string) string {
+	if to == from {
+		return expr
+	}
+	return to + "(" + expr + ")"
+}
+
+// binaryGo returns the Go types a binary value is read as, and whether
+// it is signed.
+func binaryGo(typ string) (unsigned string, signed bool) {
+	w := binaryWidth[typ] * 8
+	if w == 8 {
+		return "uint8", false
+	}
+	return fmt.Sprintf("uint%d", w), typ[0] == 'i'
+}
+
+// present is the Go condition for f, read by expr, being set.
+func present(f *field, expr string) string {
+	switch f.Go.Type {
+	case "bool":
+		return expr
+	case "string":
+		return expr + ` != ""`
+	}
+	return expr + " != 0"
+}
+
+func genHub(s *spec) ([]byte, error) {
+	var w writer
+	w.p(goHeader)
+	w.p("package hub\n")
+	w.p("import (\n\"encoding/binary\"\n\"encoding/json\"\n\"fmt\"\n)\n")
+
+	w.p("// PulseMessage is a pulse as sent to clients; see schema.json.")
+	w.p("type PulseMessage struct {")
+	for _, f := range s.Fields {
+		if f.Go == nil {
+			continue
+		}
+		if f.Description != "" {
+			w.p("%s", comment("//", sentence(f.Description)))
+		}
+		tag := f.Name
+		if !f.Required && !f.Go.Always {
+			tag += ",omitempty"
+		}
+		w.p("%s %s `json:%q`", f.Go.Field, f.Go.Type, tag)
+	}
+	w.p("\npulseContext\n}\n")
+
+	// Binary layout.
+	w.p("// Binary pulse layout (pulse.v2+binary), all integers big-endian:")
+	w.p("//")
+	w.p("//\t0   u8   message type (binPulse)")
+	w.p("//\t1   u8   flags")
+	for _, f := range s.fixed() {
+		w.p("//\t%-3d %-4s %s", *f.Binary.Offset, f.Binary.Type, f.Name)
+	}
+	var flagOnly []*field
+	for _, g := range s.flagGroups() {
+		for _, f := range g {
+			if f.Binary.Type == "" {
+				flagOnly = append(flagOnly, f)
+				continue
+			}
+			what := f.Name
+			if f.Binary.Scale != 0 {
+				what += fmt.Sprintf(" × %g", f.Binary.Scale)
+			}
+			w.p("//\t..  %-4s %-18s if flags&binFlag%s", f.Binary.Type, what, g[0].goName())
+		}
+	}
+	w.p("//\t..  u16  n, n bytes JSON    if flags&binFlagExtra: object of the other fields")
+	for _, f := range flagOnly {
+		w.p("//\n// flags&binFlag%s carries no payload; it is %s.", f.goName(), f.Name)
+	}
+	w.p("const (")
+	w.p("binPulse = %#02x", s.Binary.Type)
+	w.p("binPulseSize = %d\n", s.Binary.Size)
+	flagConsts := map[int]string{s.Binary.Extra.Flag: "binFlagExtra"}
+	for _, g := range s.flagGroups() {
+		flagConsts[g[0].Binary.Flag] = "binFlag" + g[0].goName()
+	}
+	for bit := 1; bit <= 0x80; bit <<= 1 {
+		if name, ok := flagConsts[bit]; ok {
+			w.p("%s = %#02x", name, bit)
+		}
+	}
+	w.p(")\n")
+
+	w.p("// Tags of pulse.v2+tagged fields; see codec_tagged.go.")
+	w.p("const (")
+	w.p("taggedPulse = %#02x\n", s.Tagged.Type)
+	extra := false
+	for _, f := range s.tagged() {
+		if !extra && f.Tag.Tag > s.Tagged.Extra {
+			w.p("tagExtra = %d // JSON object of the other fields", s.Tagged.Extra)
+			extra = true
+		}
+		note := f.Tag.Type
+		if f.Tag.Scale != 0 {
+			note += fmt.Sprintf(", %s × %g", f.Name, f.Tag.Scale)
+		}
+		w.p("tag%s = %d // %s", f.goName(), f.Tag.Tag, note)
+	}
+	if !extra {
+		w.p("tagExtra = %d // JSON object of the other fields", s.Tagged.Extra)
+	}
+	w.p(")\n")
+
+	genBinaryEncoder(&w, s)
+	genTaggedEncoder(&w, s)
+	return format.Source(w.Bytes())
+}
+
+func genBinaryEncoder(w *writer, s *spec) {
+	optional := 0
+	for _, g := range s.flagGroups() {
+		for _, f := range g {
+			optional += binaryWidth[f.Binary.Type]
+		}
+	}
+	w.p("func encodeBinaryPulse(msg PulseMessage) ([]byte, error) {")
+	w.p(`var extra []byte
+	if len(msg.Extra) > 0 {
+		var err error
+		if extra, err = encodeExtra(msg.Extra); err != nil {
+			return nil, err
+		}
+		if len(extra) > 0xffff {
+			return nil, fmt.Errorf("enrichment fields too large for binary pulse: %%d bytes", len(extra))
+		}
+	}
+`)
+	w.p("b := make([]byte, binPulseSize, binPulseSize+%d+2+len(extra))", optional)
+	w.p("b[0] = binPulse")
+	for _, f := range s.fixed() {
+		u, signed := binaryGo(f.Binary.Type)
+		v := "msg." + f.Go.Field
+		if signed {
+			v = conv("int"+u[4:], f.Go.Type, v)
+		}
+		if u == "uint8" {
+			w.p("b[%d] = %s", *f.Binary.Offset, conv(u, f.Go.Type, v))
+			continue
+		}
+		w.p("binary.BigEndian.Put%s(b[%d:], %s)", title(u), *f.Binary.Offset, conv(u, f.Go.Type, v))
+	}
+	var flagOnly []*field
+	for _, g := range s.flagGroups() {
+		if g[0].Binary.Type == "" {
+			flagOnly = append(flagOnly, g[0])
+			continue
+		}
+		f := g[0]
+		if f.Binary.Scale != 0 {
+			u, _ := binaryGo(f.Binary.Type)
+			w.p("if v := int%s(msg.%s * %g); v != 0 {", u[4:], f.Go.Field, f.Binary.Scale)
+			w.p("b[1] |= binFlag%s", f.goName())
+			w.p("b = %s", appendBinary(f.Binary.Type, "int"+u[4:], "v"))
+			w.p("}")
+			continue
+		}
+		var conds []string
+		for _, f := range g {
+			conds = append(conds, present(f, "msg."+f.Go.Field))
+		}
+		w.p("if %s {", strings.Join(conds, " || "))
+		w.p("b[1] |= binFlag%s", f.goName())
+		for _, f := range g {
+			w.p("b = %s", appendBinary(f.Binary.Type, f.Go.Type, "msg."+f.Go.Field))
+		}
+		w.p("}")
+	}
+	for _, f := range flagOnly {
+		w.p("if msg.%s {\nb[1] |= binFlag%s\n}", f.Go.Field, f.goName())
+	}
+	w.p(`if extra != nil {
+		b[1] |= binFlagExtra
+		b = binary.BigEndian.AppendUint16(b, uint16(len(extra)))
+		b = append(b, extra...)
+	}
+	return b, nil
+}
+`)
+}
+
+// title capitalizes a Go type name for encoding/binary: uint16 is Uint16.
+func title(typ string) string {
+	return strings.ToUpper(typ[:1]) + typ[1:]
+}
+
+// appendBinary appends expr, of Go type from, as typ.
+func appendBinary(typ, from, expr string) string {
+	u, signed := binaryGo(typ)
+	if signed {
+		expr = conv("int"+u[4:], from, expr)
+		from = "int" + u[4:]
+	}
+	if u == "uint8" {
+		return fmt.Sprintf("append(b, %s)", conv(u, from, expr))
+	}
+	return fmt.Sprintf("binary.BigEndian.Append%s(b, %s)", title(u), conv(u, from, expr))
+}
+
+// taggedValue is the Go expression encoding expr, of Go type from, as a
+// tagged value of type typ.
+func taggedValue(typ, from, expr string) string {
+	switch typ {
+	case "u":
+		return fmt.Sprintf("binary.AppendUvarint(nil, %s)", conv("uint64", from, expr))
+	case "s":
+		return fmt.Sprintf("binary.AppendVarint(nil, %s)", conv("int64", from, expr))
+	}
+	return "nil"
+}
+
+func genTaggedEncoder(w *writer, s *spec) {
+	w.p("func encodeTaggedPulse(msg PulseMessage) ([]byte, error) {")
+	w.p("b := make([]byte, 1, 64)")
+	w.p("b[0] = taggedPulse")
+	for _, f := range s.tagged() {
+		if f.Go == nil {
+			continue
+		}
+		t := f.Tag
+		switch {
+		case t.Scale != 0:
+			w.p("if v := int64(msg.%s * %g); v != 0 {", f.Go.Field, t.Scale)
+			w.p("b = appendTagged(b, tag%s, binary.AppendVarint(nil, v))\n}", f.goName())
+		case f.Required:
+			w.p("b = appendTagged(b, tag%s, %s)", f.goName(), taggedValue(t.Type, f.Go.Type, "msg."+f.Go.Field))
+		default:
+			w.p("if %s {", present(f, "msg."+f.Go.Field))
+			w.p("b = appendTagged(b, tag%s, %s)\n}", f.goName(), taggedValue(t.Type, f.Go.Type, "msg."+f.Go.Field))
+		}
+	}
+	w.p("return appendTaggedExtra(b, msg.Extra)\n}\n")
+
+	w.p("// taggedExtra encodes enrichment fields that have their own tag; it")
+	w.p("// reports false for values of an unexpected type, which then go into")
+	w.p("// tagExtra with the rest.")
+	w.p("var taggedExtra = map[string]func(b []byte, raw json.RawMessage) ([]byte, bool){")
+	for _, f := range s.tagged() {
+		if f.Go != nil {
+			continue
+		}
+		helper := map[string]string{"u": "taggedUint", "f64": "taggedFloat", "flag": "taggedFlag", "hex32": "taggedHash"}[f.Tag.Type]
+		w.p("%q: %s(tag%s),", f.Name, helper, f.goName())
+	}
+	w.p("}")
+}
+
+func genConformance(s *spec) ([]byte, error) {
+	var w writer
+	w.p(goHeader)
+	w.p("package conformance\n")
+	w.p("import (\n\"encoding/binary\"\n\"encoding/json\"\n\"fmt\"\n)\n")
+
+	w.p("// pulseFields holds a decoded pulse; required fields are nil when")
+	w.p("// missing.")
+	w.p("type pulseFields struct {")
+	for _, f := range s.Fields {
+		if f.Go == nil {
+			continue
+		}
+		typ := f.Go.Type
+		if f.Required && f.Go.Field != "Type" {
+			typ = "*" + typ
+		}
+		w.p("%s %s `json:%q`", f.Go.Field, typ, f.Name)
+	}
+	w.p("}\n")
+
+	genBinaryDecoder(&w, s)
+	genTaggedDecoder(&w, s)
+	return format.Source(w.Bytes())
+}
+
+// readBinary is the Go expression reading typ from buf at off, converted
+// to the field's Go type.
+func readBinary(f *field, buf string, off int) string {
+	u, signed := binaryGo(f.Binary.Type)
+	v := fmt.Sprintf("%s[%d]", buf, off)
+	if u != "uint8" {
+		v = fmt.Sprintf("binary.BigEndian.%s(%s[%d:])", title(u), buf, off)
+	}
+	from := u
+	if signed {
+		from = "int" + u[4:]
+		v = from + "(" + v + ")"
+	}
+	if f.Binary.Scale != 0 {
+		return fmt.Sprintf("float64(%s) / %g", v, f.Binary.Scale)
+	}
+	return conv(f.Go.Type, from, v)
+}
+
+func genBinaryDecoder(w *writer, s *spec) {
+	w.p("// decodeBinaryPulse decodes the pulse.v2+binary layout.")
+	w.p("func decodeBinaryPulse(b []byte) (pulseFields, error) {")
+	w.p("var m pulseFields")
+	w.p("if len(b) < %d {\nreturn m, fmt.Errorf(\"binary pulse of %%d bytes, want at least %d\", len(b))\n}", s.Binary.Size, s.Binary.Size)
+	w.p("if b[0] != %#02x {\nreturn m, fmt.Errorf(\"binary message type %%#x, want pulse (%#02x)\", b[0])\n}", s.Binary.Type, s.Binary.Type)
+	w.p("m.Type = \"pulse\"")
+	w.p("flags := b[1]")
+	for _, f := range s.fixed() {
+		v := strings.ToLower(f.Go.Field[:1]) + f.Go.Field[1:]
+		w.p("%s := %s", v, readBinary(f, "b", *f.Binary.Offset))
+		w.p("m.%s = &%s", f.Go.Field, v)
+	}
+	w.p("rest := b[%d:]", s.Binary.Size)
+	for _, g := range s.flagGroups() {
+		w.p("if flags&%#02x != 0 {", g[0].Binary.Flag)
+		if g[0].Binary.Type == "" {
+			w.p("m.%s = true\n}", g[0].Go.Field)
+			continue
+		}
+		size := 0
+		for _, f := range g {
+			size += binaryWidth[f.Binary.Type]
+		}
+		w.p("if len(rest) < %d {\nreturn m, fmt.Errorf(\"binary pulse truncated in %s\")\n}", size, g[0].Name)
+		off := 0
+		for _, f := range g {
+			w.p("m.%s = %s", f.Go.Field, readBinary(f, "rest", off))
+			off += binaryWidth[f.Binary.Type]
+		}
+		w.p("rest = rest[%d:]\n}", size)
+	}
+	w.p(`if flags&%#02x != 0 {
+		if len(rest) < 2 || len(rest)-2 < int(binary.BigEndian.Uint16(rest)) {
+			return m, fmt.Errorf("binary pulse truncated in extra fields")
+		}
+		n := int(binary.BigEndian.Uint16(rest))
+		var extra map[string]any
+		if err := json.Unmarshal(rest[2:2+n], &extra); err != nil {
+			return m, fmt.Errorf("binary pulse extra fields: %%w", err)
+		}
+		rest = rest[2+n:]
+	}
+	if len(rest) != 0 {
+		return m, fmt.Errorf("binary pulse has %%d trailing bytes", len(rest))
+	}
+	return m, nil
+}
+`, s.Binary.Extra.Flag)
+}
+
+func genTaggedDecoder(w *writer, s *spec) {
+	w.p("// decodeTaggedPulse decodes the pulse.v2+tagged layout. Unknown tags")
+	w.p("// are skipped, as clients must; known ones are checked for their")
+	w.p("// encoding.")
+	w.p("func decodeTaggedPulse(b []byte) (pulseFields, error) {")
+	w.p("var m pulseFields")
+	w.p("if len(b) == 0 || b[0] != %#02x {\nreturn m, fmt.Errorf(\"tagged message does not start with the pulse type (%#02x)\")\n}", s.Tagged.Type, s.Tagged.Type)
+	w.p(`m.Type = "pulse"
+	seen := make(map[uint64]bool)
+	for rest := b[1:]; len(rest) > 0; {
+		tag, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return m, fmt.Errorf("tagged pulse: bad tag")
+		}
+		rest = rest[n:]
+		size, n := binary.Uvarint(rest)
+		if n <= 0 || uint64(len(rest)-n) < size {
+			return m, fmt.Errorf("tagged pulse truncated in tag %%d", tag)
+		}
+		v := rest[n : n+int(size)]
+		rest = rest[n+int(size):]
+		if seen[tag] {
+			return m, fmt.Errorf("tagged pulse repeats tag %%d", tag)
+		}
+		seen[tag] = true
+
+		var err error
+		switch tag {`)
+	for _, f := range s.tagged() {
+		w.p("case %d: // %s", f.Tag.Tag, f.Name)
+		t := f.Tag
+		switch t.Type {
+		case "u", "s":
+			fn, from := "taggedUvarint", "uint64"
+			if t.Type == "s" {
+				fn, from = "taggedVarint", "int64"
+			}
+			if f.Go == nil {
+				w.p("_, err = %s(tag, v)", fn)
+				break
+			}
+			w.p("var x %s\nif x, err = %s(tag, v); err != nil {\nbreak\n}", from, fn)
+			val := conv(f.Go.Type, from, "x")
+			if t.Scale != 0 {
+				val = fmt.Sprintf("float64(x) / %g", t.Scale)
+			}
+			if f.Required {
+				w.p("y := %s\nm.%s = &y", val, f.Go.Field)
+			} else {
+				w.p("m.%s = %s", f.Go.Field, val)
+			}
+		case "flag":
+			w.p("if len(v) != 0 {\nerr = fmt.Errorf(\"tagged pulse: flag tag %%d has a value\", tag)\n}")
+			if f.Go != nil {
+				w.p("m.%s = true", f.Go.Field)
+			}
+		case "f64", "hex32":
+			size := map[string]int{"f64": 8, "hex32": 32}[t.Type]
+			w.p("if len(v) != %d {\nerr = fmt.Errorf(\"tagged pulse: %s is %%d bytes, want %d\", len(v))\n}", size, f.Name, size)
+		}
+	}
+	w.p(`case %d: // extra fields
+			var extra map[string]any
+			if e := json.Unmarshal(v, &extra); e != nil {
+				err = fmt.Errorf("tagged pulse extra fields: %%w", e)
+			}
+		}
+		if err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
+
+// taggedUvarint decodes a value that must be exactly one uvarint.
+func taggedUvarint(tag uint64, v []byte) (uint64, error) {
+	x, n := binary.Uvarint(v)
+	if n != len(v) {
+		return 0, fmt.Errorf("tagged pulse: tag %%d is not a single varint", tag)
+	}
+	return x, nil
+}
+
+// taggedVarint decodes a value that must be exactly one zigzag varint.
+func taggedVarint(tag uint64, v []byte) (int64, error) {
+	x, n := binary.Varint(v)
+	if n != len(v) {
+		return 0, fmt.Errorf("tagged pulse: tag %%d is not a single varint", tag)
+	}
+	return x, nil
+}`, s.Tagged.Extra)
+}
@@ -0,0 +1,86 @@
+// Command pulse-gen generates the pulse codecs from the protocol spec: the
+// pulse definition in hub/schema.json, the same document GET /api/schema
+// serves. Besides JSON Schema, each pulse property may carry
+//
+//	x-go      {"field": "Seq", "type": "uint64"}: a field of hub.PulseMessage;
+//	          "always": true keeps it in JSON when zero
+//	x-binary  {"offset": 2, "type": "u64"} in the fixed part of the
+//	          pulse.v2+binary layout, or {"flag": 1, "type": "i32"} after it
+//	          when the flag is set; optional fields follow in property order
+//	x-tag     {"tag": 1, "type": "u"}: its pulse.v2+tagged field
+//
+// and the pulse definition itself the message type byte, fixed size and
+// extra-fields flag or tag of both layouts. "scale" multiplies a number
+// into an integer on the wire. From that it writes PulseMessage and the
+// encoders in hub, the decoders in conformance and a TypeScript reference
+// decoder, so the served schema, the Go types and the binary layouts cannot
+// drift apart. Run it with go generate ./hub; -check only reports stale
+// files, for CI.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("pulse-gen: ")
+	schema := flag.String("schema", "schema.json", "protocol spec")
+	goOut := flag.String("go", "", "write PulseMessage and the encoders to this file")
+	confOut := flag.String("conformance", "", "write the conformance decoders to this file")
+	tsOut := flag.String("ts", "", "write the TypeScript decoders to this file")
+	check := flag.Bool("check", false, "only report files that are not up to date")
+	flag.Parse()
+
+	data, err := os.ReadFile(*schema)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s, err := parseSpec(data)
+	if err != nil {
+		log.Fatalf("%s: %v", *schema, err)
+	}
+	outputs := []struct {
+		path string
+		gen  func(*spec) ([]byte, error)
+	}{
+		{*goOut, genHub},
+		{*confOut, genConformance},
+		{*tsOut, genTS},
+	}
+	stale := false
+	for _, o := range outputs {
+		if o.path == "" {
+			continue
+		}
+		out, err := o.gen(s)
+		if err != nil {
+			log.Fatalf("%s: %v", o.path, err)
+		}
+		if *check {
+			if cur, err := os.ReadFile(o.path); err != nil || !bytes.Equal(cur, out) {
+				fmt.Fprintf(os.Stderr, "%s is not up to date; run go generate ./hub\n", o.path)
+				stale = true
+			}
+			continue
+		}
+		if err := os.WriteFile(o.path, out, 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if stale {
+		os.Exit(1)
+	}
+}
+
+// writer collects generated source.
+type writer struct{ bytes.Buffer }
+
+func (w *writer) p(format string, args ...any) {
+	fmt.Fprintf(w, format, args...)
+	w.WriteByte('\n')
+}
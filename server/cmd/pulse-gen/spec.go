@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"slices"
+	"strings"
+)
+
+// spec is the pulse definition with its codec annotations.
+type spec struct {
+	Binary struct {
+		Type  int `json:"type"`
+		Size  int `json:"size"`
+		Extra struct {
+			Flag int `json:"flag"`
+		} `json:"extra"`
+	}
+	Tagged struct {
+		Type  int `json:"type"`
+		Extra int `json:"extra"`
+	}
+	Fields []*field
+}
+
+type field struct {
+	Name        string // as in JSON
+	Description string
+	Required    bool
+	Go          *struct {
+		Field  string `json:"field"`
+		Type   string `json:"type"`
+		Always bool   `json:"always"`
+	}
+	Binary *struct {
+		Offset *int    `json:"offset"`
+		Flag   int     `json:"flag"`
+		Type   string  `json:"type"`
+		Scale  float64 `json:"scale"`
+	}
+	Tag *struct {
+		Tag   int     `json:"tag"`
+		Type  string  `json:"type"`
+		Scale float64 `json:"scale"`
+	}
+}
+
+// binaryWidth is the size of each pulse.v2+binary value type.
+var binaryWidth = map[string]int{"u8": 1, "u16": 2, "u32": 4, "u64": 8, "i32": 4, "i64": 8}
+
+var goTypes = []string{"string", "bool", "int", "int64", "uint64", "float64"}
+
+// taggedTypes are the pulse.v2+tagged value types; extraTagged those a
+// field without x-go can have, decoded from its JSON value.
+var (
+	taggedTypes = []string{"u", "s", "f64", "flag", "hex32"}
+	extraTagged = []string{"u", "f64", "flag", "hex32"}
+)
+
+func parseSpec(data []byte) (*spec, error) {
+	var doc struct {
+		Defs map[string]json.RawMessage `json:"$defs"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	raw, ok := doc.Defs["pulse"]
+	if !ok {
+		return nil, errors.New("no pulse definition in $defs")
+	}
+	var def struct {
+		Required   []string        `json:"required"`
+		Binary     json.RawMessage `json:"x-binary"`
+		Tag        json.RawMessage `json:"x-tag"`
+		Properties json.RawMessage `json:"properties"`
+	}
+	if err := json.Unmarshal(raw, &def); err != nil {
+		return nil, err
+	}
+	s := &spec{}
+	if err := json.Unmarshal(def.Binary, &s.Binary); err != nil {
+		return nil, fmt.Errorf("pulse x-binary: %w", err)
+	}
+	if err := json.Unmarshal(def.Tag, &s.Tagged); err != nil {
+		return nil, fmt.Errorf("pulse x-tag: %w", err)
+	}
+	// Property order is the order of optional binary fields, so walk the
+	// object rather than decoding it into a map.
+	dec := json.NewDecoder(bytes.NewReader(def.Properties))
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		f := &field{Name: tok.(string), Required: slices.Contains(def.Required, tok.(string))}
+		var p struct {
+			Description string          `json:"description"`
+			Go          json.RawMessage `json:"x-go"`
+			Binary      json.RawMessage `json:"x-binary"`
+			Tag         json.RawMessage `json:"x-tag"`
+		}
+		if err := dec.Decode(&p); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name, err)
+		}
+		f.Description = p.Description
+		for _, a := range []struct {
+			raw json.RawMessage
+			v   any
+		}{{p.Go, &f.Go}, {p.Binary, &f.Binary}, {p.Tag, &f.Tag}} {
+			if a.raw != nil {
+				if err := json.Unmarshal(a.raw, a.v); err != nil {
+					return nil, fmt.Errorf("%s: %w", f.Name, err)
+				}
+			}
+		}
+		s.Fields = append(s.Fields, f)
+	}
+	return s, s.validate()
+}
+
+// validate checks the annotations make codecs that can be generated and
+// decoded unambiguously.
+func (s *spec) validate() error {
+	var errs []error
+	bad := func(f *field, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", f.Name, fmt.Sprintf(format, args...)))
+	}
+	if s.Binary.Size <= 2 || bits.OnesCount(uint(s.Binary.Extra.Flag)) != 1 {
+		errs = append(errs, errors.New("pulse x-binary needs a size and a single-bit extra flag"))
+	}
+	if s.Tagged.Extra <= 0 {
+		errs = append(errs, errors.New("pulse x-tag needs an extra tag"))
+	}
+	fixed := make([]bool, s.Binary.Size)
+	tags := map[int]string{s.Tagged.Extra: "extra fields"}
+	flags := map[int]string{s.Binary.Extra.Flag: "extra fields"}
+	lastFlag := 0
+	for _, f := range s.Fields {
+		if f.Go != nil {
+			if !slices.Contains(goTypes, f.Go.Type) {
+				bad(f, "x-go type %q, want one of %s", f.Go.Type, strings.Join(goTypes, ", "))
+			}
+			if f.Go.Field == "" {
+				bad(f, "x-go without a field name")
+			}
+		}
+		if b := f.Binary; b != nil {
+			switch {
+			case f.Go == nil:
+				bad(f, "x-binary without x-go; other fields travel in the extra JSON")
+			case b.Offset != nil:
+				w := binaryWidth[b.Type]
+				if w == 0 || *b.Offset < 2 || *b.Offset+w > s.Binary.Size {
+					bad(f, "x-binary offset %d, type %q outside the fixed part", *b.Offset, b.Type)
+					break
+				}
+				for i := *b.Offset; i < *b.Offset+w; i++ {
+					if fixed[i] {
+						bad(f, "x-binary overlaps another field")
+					}
+					fixed[i] = true
+				}
+			case bits.OnesCount(uint(b.Flag)) != 1 || b.Flag > 0x80:
+				bad(f, "x-binary flag %#x is not a single bit of the flags byte", b.Flag)
+			case b.Type == "":
+				if f.Go.Type != "bool" {
+					bad(f, "x-binary without a type must be a bool")
+				}
+				fallthrough
+			default:
+				if b.Type != "" && binaryWidth[b.Type] == 0 {
+					bad(f, "x-binary type %q", b.Type)
+				}
+				if other, ok := flags[b.Flag]; ok && (b.Flag != lastFlag || b.Type == "" || b.Scale != 0) {
+					bad(f, "x-binary flag %#x is taken by %s; only adjacent, unscaled fields may share a flag", b.Flag, other)
+				}
+				flags[b.Flag], lastFlag = f.Name, b.Flag
+			}
+			if b.Scale != 0 && (f.Go == nil || f.Go.Type != "float64" || !strings.HasPrefix(b.Type, "i")) {
+				bad(f, "x-binary scale needs a float64 field and a signed type")
+			}
+		}
+		if t := f.Tag; t != nil {
+			if other, ok := tags[t.Tag]; ok || t.Tag <= 0 {
+				bad(f, "x-tag %d is taken by %s", t.Tag, other)
+			}
+			tags[t.Tag] = f.Name
+			switch {
+			case !slices.Contains(taggedTypes, t.Type):
+				bad(f, "x-tag type %q, want one of %s", t.Type, strings.Join(taggedTypes, ", "))
+			case f.Go == nil && !slices.Contains(extraTagged, t.Type):
+				bad(f, "x-tag type %q needs x-go; fields without it may be %s", t.Type, strings.Join(extraTagged, ", "))
+			case f.Go != nil && t.Type != "u" && t.Type != "s" && t.Type != "flag":
+				bad(f, "x-tag type %q is for fields without x-go", t.Type)
+			case t.Scale != 0 && (f.Go == nil || f.Go.Type != "float64" || t.Type != "s"):
+				bad(f, "x-tag scale needs a float64 field and type s")
+			}
+		}
+		if f.Go != nil && f.Go.Field != "Type" && (f.Binary == nil || f.Tag == nil) {
+			bad(f, "x-go field without x-binary and x-tag")
+		}
+		if f.Required && f.Go != nil && f.Go.Field != "Type" && (f.Binary == nil || f.Binary.Offset == nil) {
+			bad(f, "required, so it belongs in the fixed part of the binary layout")
+		}
+	}
+	for i := 2; i < len(fixed); i++ {
+		if !fixed[i] {
+			errs = append(errs, fmt.Errorf("byte %d of the fixed binary layout is unused", i))
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// wire returns the fields with x-go other than the message type.
+func (s *spec) wire() []*field {
+	var out []*field
+	for _, f := range s.Fields {
+		if f.Go != nil && f.Go.Field != "Type" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// fixed returns the fields in the fixed part of the binary layout, by
+// offset.
+func (s *spec) fixed() []*field {
+	var out []*field
+	for _, f := range s.wire() {
+		if f.Binary.Offset != nil {
+			out = append(out, f)
+		}
+	}
+	slices.SortFunc(out, func(a, b *field) int { return *a.Binary.Offset - *b.Binary.Offset })
+	return out
+}
+
+// flagGroups returns the optional binary fields in layout order, those
+// sharing a flag together.
+func (s *spec) flagGroups() [][]*field {
+	var out [][]*field
+	for _, f := range s.wire() {
+		if f.Binary.Offset != nil {
+			continue
+		}
+		if n := len(out); n > 0 && out[n-1][0].Binary.Flag == f.Binary.Flag {
+			out[n-1] = append(out[n-1], f)
+			continue
+		}
+		out = append(out, []*field{f})
+	}
+	return out
+}
+
+// tagged returns the fields with a tag, by tag.
+func (s *spec) tagged() []*field {
+	var out []*field
+	for _, f := range s.Fields {
+		if f.Tag != nil {
+			out = append(out, f)
+		}
+	}
+	slices.SortFunc(out, func(a, b *field) int { return a.Tag.Tag - b.Tag.Tag })
+	return out
+}
+
+// constName turns a JSON name into a Go identifier suffix: period_ms is
+// PeriodMS.
+func constName(name string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(name, "_") {
+		switch part {
+		case "ms", "us", "bpm", "id":
+			b.WriteString(strings.ToUpper(part))
+		default:
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return b.String()
+}
+
+// goName is the name f's constants are derived from.
+func (f *field) goName() string {
+	if f.Go != nil {
+		return f.Go.Field
+	}
+	return constName(f.Name)
+}
+
+// comment wraps text into Go or TypeScript line comments.
+func comment(prefix, text string) string {
+	var lines []string
+	line := prefix
+	for _, word := range strings.Fields(text) {
+		if len(line)+1+len(word) > 76 && line != prefix {
+			lines = append(lines, line)
+			line = prefix
+		}
+		line += " " + word
+	}
+	return strings.Join(append(lines, line), "\n")
+}
+
+// sentence capitalizes a schema description, unless it starts with an
+// identifier like send_ahead, and ends it with a period.
+func sentence(s string) string {
+	if s == "" {
+		return ""
+	}
+	if first, _, _ := strings.Cut(s, " "); !strings.Contains(first, "_") {
+		s = strings.ToUpper(s[:1]) + s[1:]
+	}
+	return s + "."
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// tsBinaryRead is the DataView getter of each binary type; 64-bit values
+// are read as two halves, exact up to 2^53.
+var tsBinaryRead = map[string]string{
+	"u8":  "view.getUint8(%s)",
+	"u16": "view.getUint16(%s)",
+	"u32": "view.getUint32(%s)",
+	"i32": "view.getInt32(%s)",
+	"u64": "u64(view, %s)",
+	"i64": "i64(view, %s)",
+}
+
+func genTS(s *spec) ([]byte, error) {
+	var w writer
+	w.p("// Code generated by pulse-gen from server/hub/schema.json; DO NOT EDIT.")
+	w.p(`
+/**
+ * Reference decoders for the binary pulse subprotocols, generated from the
+ * same spec the server serves at /api/schema. Each returns the pulse as its
+ * pulse.v2+json message would be, and throws on a malformed frame. Integers
+ * are exact up to 2^53.
+ */
+
+export const BINARY_PROTOCOL = "pulse.v2+binary";
+export const TAGGED_PROTOCOL = "pulse.v2+tagged";
+
+/** A decoded pulse; fields beyond the required ones depend on the server. */
+export interface DecodedPulse {
+  type: "pulse";`)
+	for _, f := range s.fixed() {
+		w.p("  %s: number;", f.Name)
+	}
+	w.p(`  [field: string]: unknown;
+}
+
+function u64(view: DataView, at: number): number {
+  return view.getUint32(at) * 2 ** 32 + view.getUint32(at + 4);
+}
+
+function i64(view: DataView, at: number): number {
+  return view.getInt32(at) * 2 ** 32 + view.getUint32(at + 4);
+}
+
+function utf8(bytes: Uint8Array): string {
+  return new TextDecoder().decode(bytes);
+}
+`)
+
+	// Binary.
+	w.p("/** Decodes a pulse.v2+binary frame. */")
+	w.p("export function decodeBinaryPulse(data: ArrayBuffer): DecodedPulse {")
+	w.p("  const view = new DataView(data);")
+	w.p("  if (view.byteLength < %d) {", s.Binary.Size)
+	w.p("    throw new Error(`binary pulse of ${view.byteLength} bytes, want at least %d`);\n  }", s.Binary.Size)
+	w.p("  if (view.getUint8(0) !== %#02x) {", s.Binary.Type)
+	w.p("    throw new Error(\"binary message is not a pulse\");\n  }")
+	w.p("  const flags = view.getUint8(1);")
+	w.p("  const m: DecodedPulse = {")
+	w.p("    type: \"pulse\",")
+	for _, f := range s.fixed() {
+		w.p("    %s: %s,", f.Name, fmt.Sprintf(tsBinaryRead[f.Binary.Type], fmt.Sprint(*f.Binary.Offset)))
+	}
+	w.p("  };")
+	w.p("  let at = %d;", s.Binary.Size)
+	w.p(`  const need = (n: number, what: string): void => {
+    if (at + n > view.byteLength) {
+      throw new Error(` + "`binary pulse truncated in ${what}`" + `);
+    }
+  };`)
+	for _, g := range s.flagGroups() {
+		w.p("  if (flags & %#02x) {", g[0].Binary.Flag)
+		if g[0].Binary.Type == "" {
+			w.p("    m.%s = true;\n  }", g[0].Name)
+			continue
+		}
+		size := 0
+		for _, f := range g {
+			size += binaryWidth[f.Binary.Type]
+		}
+		w.p("    need(%d, %q);", size, g[0].Name)
+		off := 0
+		for _, f := range g {
+			at := "at"
+			if off > 0 {
+				at = fmt.Sprintf("at + %d", off)
+			}
+			v := fmt.Sprintf(tsBinaryRead[f.Binary.Type], at)
+			if f.Binary.Scale != 0 {
+				v += fmt.Sprintf(" / %g", f.Binary.Scale)
+			}
+			w.p("    m.%s = %s;", f.Name, v)
+			off += binaryWidth[f.Binary.Type]
+		}
+		w.p("    at += %d;\n  }", size)
+	}
+	w.p(`  if (flags & %#02x) {
+    need(2, "extra fields");
+    const n = view.getUint16(at);
+    at += 2;
+    need(n, "extra fields");
+    Object.assign(m, JSON.parse(utf8(new Uint8Array(data, at, n))));
+    at += n;
+  }
+  if (at !== view.byteLength) {
+    throw new Error(`+"`binary pulse has ${view.byteLength - at} trailing bytes`"+`);
+  }
+  return m;
+}
+`, s.Binary.Extra.Flag)
+
+	// Tagged.
+	w.p(`/**
+ * Decodes a pulse.v2+tagged frame. Tags it does not know are skipped by
+ * their length, so newer servers can add fields.
+ */
+export function decodeTaggedPulse(data: ArrayBuffer): DecodedPulse {
+  const bytes = new Uint8Array(data);
+  if (bytes[0] !== %#02x) {
+    throw new Error("tagged message is not a pulse");
+  }
+  let at = 1;
+  const uvarint = (end: number): number => {
+    let v = 0;
+    for (let shift = 0; at < end && shift < 64; shift += 7) {
+      const b = bytes[at++] ?? 0;
+      v += (b & 0x7f) * 2 ** shift;
+      if (b < 0x80) {
+        return v;
+      }
+    }
+    throw new Error("tagged pulse: bad varint");
+  };
+  const m: Record<string, unknown> = { type: "pulse" };
+  while (at < bytes.length) {
+    const tag = uvarint(bytes.length);
+    const size = uvarint(bytes.length);
+    const end = at + size;
+    if (end > bytes.length) {
+      throw new Error(`+"`tagged pulse truncated in tag ${tag}`"+`);
+    }
+    const value = (): number => {
+      const v = uvarint(end);
+      if (at !== end) {
+        throw new Error(`+"`tagged pulse: tag ${tag} is not a single varint`"+`);
+      }
+      return v;
+    };
+    const signed = (): number => {
+      const v = value();
+      return v %% 2 === 1 ? -(v + 1) / 2 : v / 2;
+    };
+    const need = (n: number, what: string): void => {
+      if (size !== n) {
+        throw new Error(`+"`tagged pulse: ${what} is ${size} bytes, want ${n}`"+`);
+      }
+    };
+    const v = bytes.subarray(at, end);
+    switch (tag) {`, s.Tagged.Type)
+	for _, f := range s.tagged() {
+		t := f.Tag
+		w.p("      case %d:", t.Tag)
+		switch t.Type {
+		case "u":
+			w.p("        m.%s = value();", f.Name)
+		case "s":
+			v := "signed()"
+			if t.Scale != 0 {
+				v += fmt.Sprintf(" / %g", t.Scale)
+			}
+			w.p("        m.%s = %s;", f.Name, v)
+		case "flag":
+			w.p("        m.%s = true;", f.Name)
+		case "f64":
+			w.p("        need(8, %q);", f.Name)
+			w.p("        m.%s = new DataView(data, at, 8).getFloat64(0);", f.Name)
+		case "hex32":
+			w.p("        need(32, %q);", f.Name)
+			w.p("        m.%s = Array.from(v, (b) => b.toString(16).padStart(2, \"0\")).join(\"\");", f.Name)
+		}
+		w.p("        break;")
+	}
+	var required []string
+	for _, f := range s.fixed() {
+		required = append(required, fmt.Sprintf("m.%s === undefined", f.Name))
+	}
+	w.p(`      case %d:
+        Object.assign(m, JSON.parse(utf8(v)));
+        break;
+    }
+    at = end;
+  }
+  if (%s) {
+    throw new Error("tagged pulse is missing required fields");
+  }
+  return m as DecodedPulse;
+}`, s.Tagged.Extra, strings.Join(required, " || "))
+	return w.Bytes(), nil
+}
@@ -0,0 +1,9 @@
+// Command pulse-server runs the pulse server; see README for its
+// configuration.
+package main
+
+import "pulse/hub"
+
+func main() {
+	hub.Main()
+}
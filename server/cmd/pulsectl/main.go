@@ -0,0 +1,317 @@
+// Command pulsectl watches and controls a pulse server:
+//
+//	pulsectl watch [-n 20]            print pulses with their jitter
+//	pulsectl verify rec.jsonl         check a recording's hash chain
+//	pulsectl stats                    print /api/status
+//	pulsectl period -ms 500           retune a channel (or -bpm 120)
+//	pulsectl pause | resume | reset   drive a channel's transport
+//	pulsectl announce -text "…"       announce maintenance to clients
+//	pulsectl history [-from ms] [-raw] export pulse history as JSONL
+//	pulsectl beat -epoch ms -seq n    when a logged beat stamp fell
+//	pulsectl validate-config pulse.toml check a server config and print it
+//
+// Admin commands need -token or PULSE_ADMIN_TOKEN; watch passes it on to
+// servers that want client credentials.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"pulse/hub"
+	"pulse/pulseclient"
+)
+
+func main() {
+	log.SetFlags(0)
+	server := flag.String("server", "http://localhost:8080", "base URL of the server")
+	token := flag.String("token", os.Getenv("PULSE_ADMIN_TOKEN"), "admin bearer token")
+	channel := flag.String("channel", "", "channel; empty is the default channel")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: pulsectl [flags] watch|verify|stats|period|pause|resume|reset|announce|history|beat|validate-config [command flags]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	base := strings.TrimSuffix(*server, "/")
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+	switch cmd {
+	case "watch":
+		watch(base, *channel, *token, args)
+	case "verify":
+		verify(args)
+	case "history":
+		history(base, *token, args)
+	case "beat":
+		fs := flag.NewFlagSet("beat", flag.ExitOnError)
+		epoch := fs.Float64("epoch", 0, "the stamp's epoch_ms")
+		seq := fs.Uint64("seq", 0, "the stamp's seq")
+		phase := fs.Float64("phase", 0, "the stamp's phase")
+		_ = fs.Parse(args)
+		q := url.Values{"channel": {*channel}, "epoch_ms": {fmt.Sprint(*epoch)}, "seq": {fmt.Sprint(*seq)}, "phase": {fmt.Sprint(*phase)}}
+		call(http.MethodGet, base+"/api/beat?"+q.Encode(), *token, nil)
+	case "validate-config":
+		validateConfig(args)
+	case "stats":
+		call(http.MethodGet, base+"/api/status", "", nil)
+	case "period":
+		fs := flag.NewFlagSet("period", flag.ExitOnError)
+		ms := fs.Int64("ms", 0, "new period in milliseconds")
+		bpm := fs.Float64("bpm", 0, "new tempo, instead of -ms")
+		_ = fs.Parse(args)
+		if (*ms > 0) == (*bpm > 0) {
+			log.Fatal("period: give -ms or -bpm")
+		}
+		call(http.MethodPost, base+"/admin/period", *token, map[string]any{"channel": *channel, "period_ms": *ms, "bpm": *bpm})
+	case "pause", "resume", "reset":
+		call(http.MethodPost, base+"/admin/transport", *token, map[string]any{"channel": *channel, "action": cmd})
+	case "announce":
+		fs := flag.NewFlagSet("announce", flag.ExitOnError)
+		text := fs.String("text", "", "announcement text")
+		severity := fs.String("severity", "info", "info, warning or critical")
+		start := fs.String("start", "", "downtime start, RFC 3339")
+		end := fs.String("end", "", "downtime end, RFC 3339")
+		_ = fs.Parse(args)
+		body := map[string]any{"text": *text, "severity": *severity}
+		if *channel != "" {
+			body["channels"] = []string{*channel}
+		}
+		if *start != "" || *end != "" {
+			from, err1 := time.Parse(time.RFC3339, *start)
+			to, err2 := time.Parse(time.RFC3339, *end)
+			if err1 != nil || err2 != nil {
+				log.Fatal("announce: -start and -end must both be RFC 3339 times")
+			}
+			body["downtime"] = map[string]int64{"start_ms": from.UnixMilli(), "end_ms": to.UnixMilli()}
+		}
+		call(http.MethodPost, base+"/admin/announcements", *token, body)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// history fetches the server's pulse history in the compact delta format
+// and prints it as JSONL, or with -raw writes it as received.
+func history(base, token string, args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	from := fs.Int64("from", 0, "first pulse time, Unix milliseconds")
+	to := fs.Int64("to", 0, "end time, Unix milliseconds; 0 is now")
+	raw := fs.Bool("raw", false, "write the delta format as received")
+	_ = fs.Parse(args)
+	q := url.Values{"format": {"delta"}, "from": {fmt.Sprint(*from)}}
+	if *to > 0 {
+		q.Set("to", fmt.Sprint(*to))
+	}
+	req, err := http.NewRequest(http.MethodGet, base+"/api/history?"+q.Encode(), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		out, _ := io.ReadAll(resp.Body)
+		log.Fatalf("%s: %s", resp.Status, bytes.TrimSpace(out))
+	}
+	if *raw {
+		if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	enc := json.NewEncoder(out)
+	dec := pulseclient.NewHistoryDecoder(resp.Body)
+	for {
+		rec, err := dec.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			out.Flush()
+			log.Fatal(err)
+		}
+		_ = enc.Encode(rec)
+	}
+}
+
+// validateConfig checks the config file in args, with any pulse-server
+// flags after it, as the server would at startup, and prints the
+// effective configuration. Like the server, it also reads PULSE_*
+// variables from the environment.
+func validateConfig(args []string) {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		args = append([]string{"-config", args[0]}, args[1:]...)
+	}
+	if err := hub.CheckConfig(args, os.Stdout); err != nil {
+		log.Fatalf("validate-config: %v", err)
+	}
+}
+
+// call sends body, if any, as JSON and prints the answer.
+func call(method, url, token string, body any) {
+	var rd io.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, url, rd)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	out, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		log.Fatalf("%s: %s", resp.Status, bytes.TrimSpace(out))
+	}
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, out, "", "  ") == nil {
+		out = pretty.Bytes()
+	}
+	fmt.Println(string(bytes.TrimSpace(out)))
+}
+
+// watch prints every pulse with its inter-arrival time, how far that is
+// from period_ms (jitter), and how far local time is from now_ms when it
+// arrives (one-way delay plus clock offset), then a summary.
+func watch(base, channel, token string, args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	n := fs.Int("n", 0, "stop after n pulses; 0 runs until interrupted")
+	record := fs.String("record", "", "also append every pulse, as received, to this file for verify")
+	_ = fs.Parse(args)
+	var rec *os.File
+	if *record != "" {
+		var err error
+		if rec, err = os.OpenFile(*record, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644); err != nil {
+			log.Fatal(err)
+		}
+		defer rec.Close()
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	u.Path += "/ws"
+	if channel != "" {
+		u.Path += "/" + url.PathEscape(channel)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	opts := pulseclient.Options{URL: u.String()}
+	if token != "" {
+		opts.Header = http.Header{"Authorization": {"Bearer " + token}}
+	}
+	c := pulseclient.New(opts)
+	go c.Run(ctx)
+
+	fmt.Printf("watching %s\n", u)
+	var last time.Time
+	var pulses, count int
+	var sum, worst float64
+loop:
+	for *n == 0 || pulses < *n {
+		var p pulseclient.Pulse
+		select {
+		case <-ctx.Done():
+			break loop
+		case a := <-c.Announcements():
+			if a.Withdrawn {
+				fmt.Printf("announcement %s withdrawn\n", a.ID)
+			} else {
+				fmt.Printf("announcement %s [%s]: %s\n", a.ID, a.Severity, a.Text)
+			}
+			continue
+		case p = <-c.Pulses():
+		}
+		pulses++
+		if rec != nil {
+			if _, err := rec.Write(append(p.Raw, '\n')); err != nil {
+				log.Fatal(err)
+			}
+		}
+		line := fmt.Sprintf("seq=%-6d period=%-7s local-now_ms=%+.1fms", p.Seq, p.Period, ms(p.Received.Sub(p.Now)))
+		if !last.IsZero() {
+			interval := p.Received.Sub(last)
+			jitter := ms(interval - p.Period)
+			line += fmt.Sprintf(" interval=%.1fms jitter=%+.1fms", ms(interval), jitter)
+			sum += math.Abs(jitter)
+			worst = max(worst, math.Abs(jitter))
+			count++
+		}
+		fmt.Println(line)
+		last = p.Received
+	}
+	if count > 0 {
+		fmt.Printf("%d intervals: mean |jitter| %.2fms, max %.2fms\n", count, sum/float64(count), worst)
+	}
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// verify checks the hash chain of a recording made with watch -record, or
+// any file of pulse messages one per line; - or no file reads stdin.
+func verify(args []string) {
+	in := os.Stdin
+	if len(args) > 0 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	var v pulseclient.ChainVerifier
+	sc := bufio.NewScanner(in)
+	sc.Buffer(nil, 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		if err := v.Check(sc.Bytes()); err != nil {
+			log.Fatalf("line %d: %v (%d pulses verified before it)", line, err, v.Checked)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%d pulses verified, chain intact\n", v.Checked)
+}
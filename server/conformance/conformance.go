@@ -0,0 +1,612 @@
+// Package conformance verifies that a server speaks the pulse protocol
+// correctly. It only talks to the server over the network, so it can be
+// pointed at this implementation, a fork, or a third-party server.
+package conformance
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Options configures a conformance run.
+type Options struct {
+	URL string
+	// Protocol is offered via Sec-WebSocket-Protocol. Empty tests the
+	// legacy v1 stream, which has no hello.
+	Protocol string
+	// Header is sent with the upgrade request (e.g. auth tokens).
+	Header http.Header
+	// Pulses is how many pulses to observe for the stream checks.
+	Pulses int
+	// Tolerance is the allowed deviation of pulse timing from period_ms.
+	Tolerance time.Duration
+	// Timeout bounds the handshake and each individual read.
+	Timeout time.Duration
+	// CheckTimeout bounds each check, however many other messages keep
+	// arriving; by default Timeout for each pulse a check may wait for.
+	CheckTimeout time.Duration
+	// AdminToken is a controller or admin token for POST /admin/period;
+	// without one the tempo-change check is skipped.
+	AdminToken string
+	// AdminURL is the base URL of the admin API; by default URL's host
+	// over http or https.
+	AdminURL string
+}
+
+func (o *Options) defaults() {
+	if o.Pulses <= 0 {
+		o.Pulses = 5
+	}
+	if o.Tolerance <= 0 {
+		o.Tolerance = 50 * time.Millisecond
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 5 * time.Second
+	}
+	if o.CheckTimeout <= 0 {
+		o.CheckTimeout = time.Duration(o.Pulses+5) * o.Timeout
+	}
+}
+
+// relayProtocol wraps every message of every channel in an envelope, for
+// relay nodes rather than clients; it is not covered by the checks.
+const relayProtocol = "pulse.relay.v1+json"
+
+// Result is the outcome of a single check.
+type Result struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// Check is one conformance rule. Checks run in order against a shared
+// session; a check may read further messages from it.
+type Check struct {
+	Name string
+	Desc string
+	Run  func(*Session) error
+}
+
+// errSkip marks a check as not applicable, e.g. because an earlier check it
+// depends on failed.
+var errSkip = errors.New("skipped")
+
+// Session is the state shared by the checks of one run.
+type Session struct {
+	opts    Options
+	conn    *conn
+	pending *frame
+	// deadline ends the running check.
+	deadline time.Time
+	Hello    map[string]any
+	Pulses   []Pulse
+	// Resyncs are the resync messages seen among the pulses.
+	Resyncs []Resync
+}
+
+// Pulse is a decoded pulse message with its local arrival time.
+type Pulse struct {
+	Seq      uint64
+	PeriodMS int64
+	NowMS    int64
+	NextMS   int64
+	OffsetMS int64
+	// AtMS is the beat of a send-ahead pulse; 0 if the pulse is sent on
+	// its beat.
+	AtMS int64
+	// DriftMS is how late the server says it sent the pulse.
+	DriftMS       float64
+	PeriodChanged bool
+	Arrived       time.Time
+	// stale is set on a pulse whose next_ms had gone by when it was sent:
+	// the server fell behind and must follow it with a resync.
+	stale bool
+}
+
+// beat is when p's beat fell, in the server's clock without the offset:
+// now_ms is when it was sent, drift_ms after it was due.
+func (p Pulse) beat() int64 {
+	if p.AtMS != 0 {
+		return p.AtMS - p.OffsetMS
+	}
+	return p.NowMS - int64(math.Round(p.DriftMS))
+}
+
+// Resync is a decoded resync message: the server skipped pulses.
+type Resync struct {
+	Skipped  int64  `json:"skipped"`
+	Seq      uint64 `json:"seq"`
+	NowMS    int64  `json:"now_ms"`
+	NextMS   int64  `json:"next_ms"`
+	PeriodMS int64  `json:"period_ms"`
+	// Before is how many pulses had been seen when it arrived.
+	Before int `json:"-"`
+}
+
+// Checks is the default suite, in execution order.
+var Checks = []Check{
+	{Name: "handshake", Desc: "upgrade returns 101 with a valid Sec-WebSocket-Accept", Run: checkHandshake},
+	{Name: "subprotocol", Desc: "server selects the offered subprotocol, or none in legacy mode", Run: checkSubprotocol},
+	{Name: "hello", Desc: "first message is a hello with request_id and period_ms (none in legacy mode)", Run: checkHello},
+	{Name: "pulse-fields", Desc: "pulses carry type, seq, period_ms, now_ms and next_ms", Run: checkPulseFields},
+	{Name: "seq-continuity", Desc: "seq increases by exactly one per pulse", Run: checkSeq},
+	{Name: "timing", Desc: "pulses arrive when the previous pulse said and next_ms predicts the next now_ms, across period changes", Run: checkTiming},
+	{Name: "resync", Desc: "resync messages announce the skipped pulses and the next pulse's seq and next_ms", Run: checkResync},
+	{Name: "sync", Desc: "sync_req is answered with a sync_resp echoing id and t1, with t2 <= t3 (none in legacy mode)", Run: checkSync},
+	{Name: "tempo-change", Desc: "after POST /admin/period the next pulse carries the new period_ms and period_changed, and the grid follows (needs a token)", Run: checkTempoChange},
+	{Name: "close", Desc: "server answers a client close frame with a close frame", Run: checkClose},
+}
+
+// Run connects to opts.URL and executes checks in order.
+func Run(opts Options, checks []Check) ([]Result, error) {
+	opts.defaults()
+	if opts.Protocol == relayProtocol {
+		return nil, fmt.Errorf("%s is for relay nodes and is not covered; test a client subprotocol", relayProtocol)
+	}
+	header := opts.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if opts.Protocol != "" {
+		header.Set("Sec-WebSocket-Protocol", opts.Protocol)
+	}
+	c, err := dial(opts.URL, header, opts.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	defer c.close()
+
+	s := &Session{opts: opts, conn: c}
+	results := make([]Result, 0, len(checks))
+	for _, chk := range checks {
+		s.deadline = time.Now().Add(opts.CheckTimeout)
+		err := chk.Run(s)
+		res := Result{Name: chk.Name, Passed: err == nil}
+		switch {
+		case errors.Is(err, errSkip):
+			res.Passed, res.Skipped = true, true
+			res.Detail = strings.TrimPrefix(err.Error(), errSkip.Error()+": ")
+		case err != nil:
+			res.Detail = err.Error()
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+func skip(reason string) error {
+	return fmt.Errorf("%w: %s", errSkip, reason)
+}
+
+// next reads the next data message, transparently answering pings. It
+// fails once the check's deadline has passed, so a stream of messages a
+// check skips cannot keep it running.
+func (s *Session) next() (frame, error) {
+	if f := s.pending; f != nil {
+		s.pending = nil
+		return *f, nil
+	}
+	for {
+		wait := min(s.opts.Timeout, time.Until(s.deadline))
+		if wait <= 0 {
+			return frame{}, fmt.Errorf("check ran past its %s deadline", s.opts.CheckTimeout)
+		}
+		f, err := s.conn.readFrame(wait)
+		if err != nil {
+			if !time.Now().Before(s.deadline) {
+				return f, fmt.Errorf("check ran past its %s deadline", s.opts.CheckTimeout)
+			}
+			return f, err
+		}
+		switch f.op {
+		case opPing:
+			_ = s.conn.writeFrame(opPong, f.payload)
+		case opPong:
+		default:
+			return f, nil
+		}
+	}
+}
+
+func checkHandshake(s *Session) error {
+	resp := s.conn.resp
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("status %d, want 101", resp.StatusCode)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		return fmt.Errorf("Upgrade header %q", resp.Header.Get("Upgrade"))
+	}
+	if got, want := resp.Header.Get("Sec-WebSocket-Accept"), expectedAccept(s.conn.key); got != want {
+		return fmt.Errorf("Sec-WebSocket-Accept %q, want %q", got, want)
+	}
+	return nil
+}
+
+func checkSubprotocol(s *Session) error {
+	if s.conn.resp.StatusCode != http.StatusSwitchingProtocols {
+		return skip("no connection")
+	}
+	if got := s.conn.resp.Header.Get("Sec-WebSocket-Protocol"); got != s.opts.Protocol {
+		return fmt.Errorf("Sec-WebSocket-Protocol %q, want %q", got, s.opts.Protocol)
+	}
+	return nil
+}
+
+func checkHello(s *Session) error {
+	if s.conn.resp.StatusCode != http.StatusSwitchingProtocols {
+		return skip("no connection")
+	}
+	f, err := s.next()
+	if err != nil {
+		return err
+	}
+	if s.opts.Protocol == "" {
+		var m map[string]any
+		if f.op == opText && json.Unmarshal(f.payload, &m) == nil && m["type"] == "hello" {
+			return fmt.Errorf("legacy clients must not receive a hello")
+		}
+		s.pending = &f
+		return nil
+	}
+	if f.op != opText {
+		return fmt.Errorf("first message has opcode %d, want text", f.op)
+	}
+	if err := json.Unmarshal(f.payload, &s.Hello); err != nil {
+		return fmt.Errorf("decode hello: %w", err)
+	}
+	if s.Hello["type"] != "hello" {
+		return fmt.Errorf("first message type %v, want hello", s.Hello["type"])
+	}
+	if id, _ := s.Hello["request_id"].(string); id == "" {
+		return fmt.Errorf("hello has no request_id")
+	}
+	if p, _ := s.Hello["period_ms"].(float64); p <= 0 {
+		return fmt.Errorf("hello period_ms %v must be positive", s.Hello["period_ms"])
+	}
+	return nil
+}
+
+func checkPulseFields(s *Session) error {
+	if s.conn.resp.StatusCode != http.StatusSwitchingProtocols {
+		return skip("no connection")
+	}
+	for len(s.Pulses) < s.opts.Pulses || s.Pulses[len(s.Pulses)-1].stale {
+		if _, err := s.nextPulse(); err != nil {
+			return fmt.Errorf("after %d pulses: %w", len(s.Pulses), err)
+		}
+	}
+	for i, p := range s.Pulses {
+		if p.stale && !s.resyncAfter(i) {
+			return fmt.Errorf("seq %d: next_ms %d not after now_ms %d, and no resync followed", p.Seq, p.NextMS, p.NowMS)
+		}
+	}
+	return nil
+}
+
+// resyncAfter reports whether a resync came right after the i-th pulse.
+func (s *Session) resyncAfter(i int) bool {
+	for _, r := range s.Resyncs {
+		if r.Before == i+1 {
+			return true
+		}
+	}
+	return false
+}
+
+// nextPulse reads messages until the next pulse, checks its required
+// fields and adds it to s.Pulses. Resyncs on the way are kept, other
+// messages skipped.
+func (s *Session) nextPulse() (Pulse, error) {
+	for {
+		f, err := s.next()
+		if err != nil {
+			return Pulse{}, err
+		}
+		var m pulseFields
+		switch f.op {
+		case opText:
+			if err := json.Unmarshal(f.payload, &m); err != nil {
+				return Pulse{}, fmt.Errorf("decode message: %w", err)
+			}
+			if m.Type == "resync" {
+				r := Resync{Before: len(s.Pulses)}
+				if err := json.Unmarshal(f.payload, &r); err != nil {
+					return Pulse{}, fmt.Errorf("decode resync: %w", err)
+				}
+				s.Resyncs = append(s.Resyncs, r)
+			}
+		case opBinary:
+			decode := decodeBinaryPulse
+			if s.opts.Protocol == "pulse.v2+tagged" {
+				decode = decodeTaggedPulse
+			}
+			var err error
+			if m, err = decode(f.payload); err != nil {
+				return Pulse{}, err
+			}
+		default:
+			continue
+		}
+		if m.Type != "pulse" {
+			continue
+		}
+		if m.Seq == nil || m.PeriodMS == nil || m.NowMS == nil || m.NextMS == nil {
+			return Pulse{}, fmt.Errorf("pulse missing required fields: %s", f.payload)
+		}
+		if *m.PeriodMS <= 0 {
+			return Pulse{}, fmt.Errorf("seq %d: period_ms %d must be positive", *m.Seq, *m.PeriodMS)
+		}
+		p := Pulse{
+			Seq:           *m.Seq,
+			PeriodMS:      *m.PeriodMS,
+			NowMS:         *m.NowMS,
+			NextMS:        *m.NextMS,
+			OffsetMS:      m.OffsetMS,
+			AtMS:          m.AtMS,
+			DriftMS:       m.DriftMS,
+			PeriodChanged: m.PeriodChanged,
+			Arrived:       f.at,
+			stale:         *m.NextMS-m.OffsetMS <= *m.NowMS,
+		}
+		s.Pulses = append(s.Pulses, p)
+		return p, nil
+	}
+}
+
+func checkSeq(s *Session) error {
+	if len(s.Pulses) < 2 {
+		return skip("not enough pulses")
+	}
+	for i := 1; i < len(s.Pulses); i++ {
+		if prev, cur := s.Pulses[i-1].Seq, s.Pulses[i].Seq; cur != prev+1 {
+			return fmt.Errorf("seq %d followed by %d", prev, cur)
+		}
+	}
+	return nil
+}
+
+func checkTiming(s *Session) error {
+	if len(s.Pulses) < 2 {
+		return skip("not enough pulses")
+	}
+	for i := 1; i < len(s.Pulses); i++ {
+		if err := s.checkGap(s.Pulses[i-1], s.Pulses[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkGap checks that cur came when prev said: its beat at prev's
+// next_ms, and it arrived that long after prev, give or take how much
+// later than the other the server says it sent each. Each pulse's next_ms
+// announces its own interval, so this holds across period changes and
+// ramps too. A resync between the two moves the anchor, so cur is
+// checked against the resync instead.
+func (s *Session) checkGap(prev, cur Pulse) error {
+	tol := s.opts.Tolerance
+	// next_ms includes any output latency offset; now_ms does not. A
+	// send-ahead pulse's beat is at_ms, not when it was sent.
+	field := "now_ms"
+	if cur.AtMS != 0 {
+		field = "at_ms"
+	}
+	for _, r := range s.Resyncs {
+		if r.Seq == cur.Seq && r.Before > 0 && s.Pulses[r.Before-1].Seq == prev.Seq {
+			if d := time.Duration(cur.beat()-(r.NextMS-cur.OffsetMS)) * time.Millisecond; absDur(d) > tol {
+				return fmt.Errorf("seq %d %s is %s away from the resync's next_ms", cur.Seq, field, d)
+			}
+			return nil
+		}
+	}
+	want := time.Duration(prev.NextMS-prev.OffsetMS-prev.beat())*time.Millisecond +
+		time.Duration((cur.DriftMS-prev.DriftMS)*float64(time.Millisecond))
+	if d := cur.Arrived.Sub(prev.Arrived); absDur(d-want) > tol {
+		return fmt.Errorf("seq %d arrived %s after seq %d, want %s", cur.Seq, d, prev.Seq, want)
+	}
+	if d := time.Duration(cur.beat()-(prev.NextMS-prev.OffsetMS)) * time.Millisecond; absDur(d) > tol {
+		return fmt.Errorf("seq %d %s is %s away from the previous next_ms", cur.Seq, field, d)
+	}
+	return nil
+}
+
+func checkResync(s *Session) error {
+	if len(s.Resyncs) == 0 {
+		return skip("no resync seen; the server did not fall behind")
+	}
+	for _, r := range s.Resyncs {
+		if r.Skipped < 1 {
+			return fmt.Errorf("resync for seq %d: skipped %d must be at least 1", r.Seq, r.Skipped)
+		}
+		if r.PeriodMS <= 0 {
+			return fmt.Errorf("resync for seq %d: period_ms %d must be positive", r.Seq, r.PeriodMS)
+		}
+		// Seq carries on by one across a skip: the resync names the pulse
+		// after the one it follows.
+		if r.Before > 0 {
+			if prev := s.Pulses[r.Before-1]; r.Seq != prev.Seq+1 {
+				return fmt.Errorf("resync after seq %d names seq %d, want %d", prev.Seq, r.Seq, prev.Seq+1)
+			}
+			if prev := s.Pulses[r.Before-1]; r.NextMS-prev.OffsetMS < r.NowMS {
+				return fmt.Errorf("resync for seq %d: next_ms %d before now_ms %d", r.Seq, r.NextMS, r.NowMS)
+			}
+		}
+		if r.Before < len(s.Pulses) {
+			if next := s.Pulses[r.Before]; next.Seq != r.Seq {
+				return fmt.Errorf("resync named seq %d, but seq %d followed", r.Seq, next.Seq)
+			}
+		}
+	}
+	return nil
+}
+
+func checkSync(s *Session) error {
+	if s.conn.resp.StatusCode != http.StatusSwitchingProtocols {
+		return skip("no connection")
+	}
+	if s.opts.Protocol == "" {
+		return skip("legacy clients cannot sync")
+	}
+	t1 := float64(time.Now().UnixMicro()) / 1000
+	req, _ := json.Marshal(map[string]any{"type": "sync_req", "id": "conformance", "t1": t1})
+	if err := s.conn.writeFrame(opText, req); err != nil {
+		return fmt.Errorf("send sync_req: %w", err)
+	}
+	sent := time.Now()
+	for {
+		f, err := s.next()
+		if err != nil {
+			return fmt.Errorf("no sync_resp: %w", err)
+		}
+		var m struct {
+			Type string   `json:"type"`
+			ID   string   `json:"id"`
+			T1   *float64 `json:"t1"`
+			T2   *float64 `json:"t2"`
+			T3   *float64 `json:"t3"`
+		}
+		if f.op != opText || json.Unmarshal(f.payload, &m) != nil || m.Type != "sync_resp" {
+			continue
+		}
+		rtt := time.Since(sent)
+		switch {
+		case m.T1 == nil || m.T2 == nil || m.T3 == nil:
+			return fmt.Errorf("sync_resp missing t1, t2 or t3: %s", f.payload)
+		case m.ID != "conformance":
+			return fmt.Errorf("sync_resp id %q, want the sync_req's", m.ID)
+		case *m.T1 != t1:
+			return fmt.Errorf("sync_resp t1 %v, want %v echoed", *m.T1, t1)
+		case *m.T2 <= 0 || *m.T3 < *m.T2:
+			return fmt.Errorf("sync_resp t2 %v, t3 %v: want 0 < t2 <= t3", *m.T2, *m.T3)
+		}
+		// The server cannot have taken longer to answer than the round
+		// trip.
+		if held := time.Duration((*m.T3 - *m.T2) * float64(time.Millisecond)); held > rtt+s.opts.Tolerance {
+			return fmt.Errorf("sync_resp held for %s, longer than the %s round trip", held, rtt)
+		}
+		return nil
+	}
+}
+
+func checkTempoChange(s *Session) error {
+	if s.opts.AdminToken == "" {
+		return skip("no admin token")
+	}
+	if s.opts.Protocol == "" {
+		return skip("legacy pulses carry no period_changed")
+	}
+	// Earlier checks may have read past pulses, so start from a fresh
+	// one.
+	prev, err := s.nextPulse()
+	if err != nil {
+		return err
+	}
+	channel, _ := s.Hello["channel"].(string)
+	old := prev.PeriodMS
+	period := max(old*3/4, 5)
+	if err := s.setPeriod(channel, period); err != nil {
+		return err
+	}
+	defer func() { _ = s.setPeriod(channel, old) }()
+
+	// The pulse already announced still comes when promised; the first
+	// with the new period says so, and the next comes a new period on.
+	for n := 0; ; n++ {
+		cur, err := s.nextPulse()
+		if err != nil {
+			return fmt.Errorf("waiting for the new period: %w", err)
+		}
+		if err := s.checkGap(prev, cur); err != nil {
+			return err
+		}
+		prev = cur
+		if cur.PeriodMS == period {
+			if !cur.PeriodChanged {
+				return fmt.Errorf("seq %d has the new period_ms %d but no period_changed", cur.Seq, period)
+			}
+			break
+		}
+		if cur.PeriodChanged {
+			return fmt.Errorf("seq %d has period_changed but period_ms %d, want %d", cur.Seq, cur.PeriodMS, period)
+		}
+		if n >= 3 {
+			return fmt.Errorf("no pulse with the new period_ms %d after %d pulses", period, n+1)
+		}
+	}
+	cur, err := s.nextPulse()
+	if err != nil {
+		return fmt.Errorf("after the period change: %w", err)
+	}
+	if cur.PeriodChanged {
+		return fmt.Errorf("seq %d still has period_changed", cur.Seq)
+	}
+	return s.checkGap(prev, cur)
+}
+
+// setPeriod sets channel's period through POST /admin/period.
+func (s *Session) setPeriod(channel string, periodMS int64) error {
+	base := s.opts.AdminURL
+	if base == "" {
+		u, err := url.Parse(s.opts.URL)
+		if err != nil {
+			return err
+		}
+		scheme := "http"
+		if u.Scheme == "wss" {
+			scheme = "https"
+		}
+		base = scheme + "://" + u.Host
+	}
+	body, _ := json.Marshal(map[string]any{"period_ms": periodMS, "channel": channel})
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(base, "/")+"/admin/period", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.opts.AdminToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := (&http.Client{Timeout: s.opts.Timeout}).Do(req)
+	if err != nil {
+		return fmt.Errorf("POST /admin/period: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("POST /admin/period: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func checkClose(s *Session) error {
+	payload := binary.BigEndian.AppendUint16(nil, 1000)
+	if err := s.conn.writeFrame(opClose, payload); err != nil {
+		return fmt.Errorf("send close: %w", err)
+	}
+	deadline := time.Now().Add(s.opts.Timeout)
+	for time.Now().Before(deadline) {
+		f, err := s.conn.readFrame(time.Until(deadline))
+		if err != nil {
+			return fmt.Errorf("no close frame in reply: %w", err)
+		}
+		if f.op == opClose {
+			return nil
+		}
+	}
+	return fmt.Errorf("no close frame within %s", s.opts.Timeout)
+}
+
+func absDur(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,311 @@
+// Code generated by pulse-gen from schema.json; DO NOT EDIT.
+
+package conformance
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// pulseFields holds a decoded pulse; required fields are nil when
+// missing.
+type pulseFields struct {
+	Type          string  `json:"type"`
+	Seq           *uint64 `json:"seq"`
+	PeriodMS      *int64  `json:"period_ms"`
+	NowMS         *int64  `json:"now_ms"`
+	NextMS        *int64  `json:"next_ms"`
+	OffsetMS      int64   `json:"offset_ms"`
+	DriftMS       float64 `json:"drift_ms"`
+	MonoMS        int64   `json:"mono_ms"`
+	PeriodChanged bool    `json:"period_changed"`
+	AtMS          int64   `json:"at_ms"`
+	RampTargetMS  int64   `json:"ramp_target_ms"`
+	RampPulses    int     `json:"ramp_pulses"`
+	PeriodUS      int64   `json:"period_us"`
+	NowUS         int64   `json:"now_us"`
+	NextUS        int64   `json:"next_us"`
+	AtUS          int64   `json:"at_us"`
+}
+
+// decodeBinaryPulse decodes the pulse.v2+binary layout.
+func decodeBinaryPulse(b []byte) (pulseFields, error) {
+	var m pulseFields
+	if len(b) < 30 {
+		return m, fmt.Errorf("binary pulse of %d bytes, want at least 30", len(b))
+	}
+	if b[0] != 0x01 {
+		return m, fmt.Errorf("binary message type %#x, want pulse (0x01)", b[0])
+	}
+	m.Type = "pulse"
+	flags := b[1]
+	seq := binary.BigEndian.Uint64(b[2:])
+	m.Seq = &seq
+	periodMS := int64(binary.BigEndian.Uint32(b[10:]))
+	m.PeriodMS = &periodMS
+	nowMS := int64(binary.BigEndian.Uint64(b[14:]))
+	m.NowMS = &nowMS
+	nextMS := int64(binary.BigEndian.Uint64(b[22:]))
+	m.NextMS = &nextMS
+	rest := b[30:]
+	if flags&0x01 != 0 {
+		if len(rest) < 4 {
+			return m, fmt.Errorf("binary pulse truncated in offset_ms")
+		}
+		m.OffsetMS = int64(int32(binary.BigEndian.Uint32(rest[0:])))
+		rest = rest[4:]
+	}
+	if flags&0x04 != 0 {
+		if len(rest) < 4 {
+			return m, fmt.Errorf("binary pulse truncated in drift_ms")
+		}
+		m.DriftMS = float64(int32(binary.BigEndian.Uint32(rest[0:]))) / 1000
+		rest = rest[4:]
+	}
+	if flags&0x08 != 0 {
+		if len(rest) < 8 {
+			return m, fmt.Errorf("binary pulse truncated in mono_ms")
+		}
+		m.MonoMS = int64(binary.BigEndian.Uint64(rest[0:]))
+		rest = rest[8:]
+	}
+	if flags&0x10 != 0 {
+		m.PeriodChanged = true
+	}
+	if flags&0x20 != 0 {
+		if len(rest) < 8 {
+			return m, fmt.Errorf("binary pulse truncated in at_ms")
+		}
+		m.AtMS = int64(binary.BigEndian.Uint64(rest[0:]))
+		rest = rest[8:]
+	}
+	if flags&0x40 != 0 {
+		if len(rest) < 6 {
+			return m, fmt.Errorf("binary pulse truncated in ramp_target_ms")
+		}
+		m.RampTargetMS = int64(binary.BigEndian.Uint32(rest[0:]))
+		m.RampPulses = int(binary.BigEndian.Uint16(rest[4:]))
+		rest = rest[6:]
+	}
+	if flags&0x80 != 0 {
+		if len(rest) < 32 {
+			return m, fmt.Errorf("binary pulse truncated in period_us")
+		}
+		m.PeriodUS = int64(binary.BigEndian.Uint64(rest[0:]))
+		m.NowUS = int64(binary.BigEndian.Uint64(rest[8:]))
+		m.NextUS = int64(binary.BigEndian.Uint64(rest[16:]))
+		m.AtUS = int64(binary.BigEndian.Uint64(rest[24:]))
+		rest = rest[32:]
+	}
+	if flags&0x02 != 0 {
+		if len(rest) < 2 || len(rest)-2 < int(binary.BigEndian.Uint16(rest)) {
+			return m, fmt.Errorf("binary pulse truncated in extra fields")
+		}
+		n := int(binary.BigEndian.Uint16(rest))
+		var extra map[string]any
+		if err := json.Unmarshal(rest[2:2+n], &extra); err != nil {
+			return m, fmt.Errorf("binary pulse extra fields: %w", err)
+		}
+		rest = rest[2+n:]
+	}
+	if len(rest) != 0 {
+		return m, fmt.Errorf("binary pulse has %d trailing bytes", len(rest))
+	}
+	return m, nil
+}
+
+// decodeTaggedPulse decodes the pulse.v2+tagged layout. Unknown tags
+// are skipped, as clients must; known ones are checked for their
+// encoding.
+func decodeTaggedPulse(b []byte) (pulseFields, error) {
+	var m pulseFields
+	if len(b) == 0 || b[0] != 0x01 {
+		return m, fmt.Errorf("tagged message does not start with the pulse type (0x01)")
+	}
+	m.Type = "pulse"
+	seen := make(map[uint64]bool)
+	for rest := b[1:]; len(rest) > 0; {
+		tag, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return m, fmt.Errorf("tagged pulse: bad tag")
+		}
+		rest = rest[n:]
+		size, n := binary.Uvarint(rest)
+		if n <= 0 || uint64(len(rest)-n) < size {
+			return m, fmt.Errorf("tagged pulse truncated in tag %d", tag)
+		}
+		v := rest[n : n+int(size)]
+		rest = rest[n+int(size):]
+		if seen[tag] {
+			return m, fmt.Errorf("tagged pulse repeats tag %d", tag)
+		}
+		seen[tag] = true
+
+		var err error
+		switch tag {
+		case 1: // seq
+			var x uint64
+			if x, err = taggedUvarint(tag, v); err != nil {
+				break
+			}
+			y := x
+			m.Seq = &y
+		case 2: // period_ms
+			var x uint64
+			if x, err = taggedUvarint(tag, v); err != nil {
+				break
+			}
+			y := int64(x)
+			m.PeriodMS = &y
+		case 3: // now_ms
+			var x int64
+			if x, err = taggedVarint(tag, v); err != nil {
+				break
+			}
+			y := x
+			m.NowMS = &y
+		case 4: // next_ms
+			var x int64
+			if x, err = taggedVarint(tag, v); err != nil {
+				break
+			}
+			y := x
+			m.NextMS = &y
+		case 5: // offset_ms
+			var x int64
+			if x, err = taggedVarint(tag, v); err != nil {
+				break
+			}
+			m.OffsetMS = x
+		case 6: // drift_ms
+			var x int64
+			if x, err = taggedVarint(tag, v); err != nil {
+				break
+			}
+			m.DriftMS = float64(x) / 1000
+		case 7: // mono_ms
+			var x int64
+			if x, err = taggedVarint(tag, v); err != nil {
+				break
+			}
+			m.MonoMS = x
+		case 8: // period_changed
+			if len(v) != 0 {
+				err = fmt.Errorf("tagged pulse: flag tag %d has a value", tag)
+			}
+			m.PeriodChanged = true
+		case 9: // at_ms
+			var x int64
+			if x, err = taggedVarint(tag, v); err != nil {
+				break
+			}
+			m.AtMS = x
+		case 10: // ramp_target_ms
+			var x uint64
+			if x, err = taggedUvarint(tag, v); err != nil {
+				break
+			}
+			m.RampTargetMS = int64(x)
+		case 11: // ramp_pulses
+			var x uint64
+			if x, err = taggedUvarint(tag, v); err != nil {
+				break
+			}
+			m.RampPulses = int(x)
+		case 13: // bpm
+			if len(v) != 8 {
+				err = fmt.Errorf("tagged pulse: bpm is %d bytes, want 8", len(v))
+			}
+		case 14: // bar
+			_, err = taggedUvarint(tag, v)
+		case 15: // beat
+			_, err = taggedUvarint(tag, v)
+		case 16: // is_downbeat
+			if len(v) != 0 {
+				err = fmt.Errorf("tagged pulse: flag tag %d has a value", tag)
+			}
+		case 17: // hash
+			if len(v) != 32 {
+				err = fmt.Errorf("tagged pulse: hash is %d bytes, want 32", len(v))
+			}
+		case 18: // prev_hash
+			if len(v) != 32 {
+				err = fmt.Errorf("tagged pulse: prev_hash is %d bytes, want 32", len(v))
+			}
+		case 19: // rate
+			_, err = taggedUvarint(tag, v)
+		case 20: // phase
+			if len(v) != 8 {
+				err = fmt.Errorf("tagged pulse: phase is %d bytes, want 8", len(v))
+			}
+		case 21: // epoch_ms
+			if len(v) != 8 {
+				err = fmt.Errorf("tagged pulse: epoch_ms is %d bytes, want 8", len(v))
+			}
+		case 22: // period_us
+			var x uint64
+			if x, err = taggedUvarint(tag, v); err != nil {
+				break
+			}
+			m.PeriodUS = int64(x)
+		case 23: // now_us
+			var x int64
+			if x, err = taggedVarint(tag, v); err != nil {
+				break
+			}
+			m.NowUS = x
+		case 24: // next_us
+			var x int64
+			if x, err = taggedVarint(tag, v); err != nil {
+				break
+			}
+			m.NextUS = x
+		case 25: // at_us
+			var x int64
+			if x, err = taggedVarint(tag, v); err != nil {
+				break
+			}
+			m.AtUS = x
+		case 26: // last_delay_ms
+			if len(v) != 8 {
+				err = fmt.Errorf("tagged pulse: last_delay_ms is %d bytes, want 8", len(v))
+			}
+		case 27: // step
+			_, err = taggedUvarint(tag, v)
+		case 28: // steps
+			_, err = taggedUvarint(tag, v)
+		case 29: // swing_ms
+			if len(v) != 8 {
+				err = fmt.Errorf("tagged pulse: swing_ms is %d bytes, want 8", len(v))
+			}
+		case 12: // extra fields
+			var extra map[string]any
+			if e := json.Unmarshal(v, &extra); e != nil {
+				err = fmt.Errorf("tagged pulse extra fields: %w", e)
+			}
+		}
+		if err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
+
+// taggedUvarint decodes a value that must be exactly one uvarint.
+func taggedUvarint(tag uint64, v []byte) (uint64, error) {
+	x, n := binary.Uvarint(v)
+	if n != len(v) {
+		return 0, fmt.Errorf("tagged pulse: tag %d is not a single varint", tag)
+	}
+	return x, nil
+}
+
+// taggedVarint decodes a value that must be exactly one zigzag varint.
+func taggedVarint(tag uint64, v []byte) (int64, error) {
+	x, n := binary.Varint(v)
+	if n != len(v) {
+		return 0, fmt.Errorf("tagged pulse: tag %d is not a single varint", tag)
+	}
+	return x, nil
+}
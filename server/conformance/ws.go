@@ -0,0 +1,177 @@
+package conformance
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opText   = 0x1
+	opBinary = 0x2
+	opClose  = 0x8
+	opPing   = 0x9
+	opPong   = 0xA
+)
+
+// frame is a single frame received from the server.
+type frame struct {
+	op      byte
+	payload []byte
+	at      time.Time
+}
+
+// conn is a minimal client-side WebSocket connection. It is deliberately
+// independent of the server code so it can validate other implementations.
+type conn struct {
+	nc   net.Conn
+	r    *bufio.Reader
+	resp *http.Response
+	key  string
+}
+
+func dial(rawURL string, header http.Header, timeout time.Duration) (*conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host += ":443"
+		} else {
+			host += ":80"
+		}
+	}
+
+	d := &net.Dialer{Timeout: timeout}
+	var nc net.Conn
+	switch u.Scheme {
+	case "ws":
+		nc, err = d.Dial("tcp", host)
+	case "wss":
+		nc, err = tls.DialWithDialer(d, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [16]byte
+	_, _ = rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req, err := http.NewRequest(http.MethodGet, (&url.URL{Scheme: "http", Host: u.Host, Path: u.Path, RawQuery: u.RawQuery}).String(), nil)
+	if err != nil {
+		_ = nc.Close()
+		return nil, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+
+	_ = nc.SetDeadline(time.Now().Add(timeout))
+	if err := req.Write(nc); err != nil {
+		_ = nc.Close()
+		return nil, fmt.Errorf("write handshake: %w", err)
+	}
+	r := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		_ = nc.Close()
+		return nil, fmt.Errorf("read handshake: %w", err)
+	}
+	_ = nc.SetDeadline(time.Time{})
+
+	return &conn{nc: nc, r: r, resp: resp, key: key}, nil
+}
+
+func expectedAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (c *conn) readFrame(timeout time.Duration) (frame, error) {
+	_ = c.nc.SetReadDeadline(time.Now().Add(timeout))
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return frame{}, err
+	}
+	at := time.Now()
+	if hdr[0]&0x80 == 0 {
+		return frame{}, fmt.Errorf("fragmented server frames are not expected")
+	}
+	if hdr[0]&0x70 != 0 {
+		return frame{}, fmt.Errorf("reserved bits set without a negotiated extension")
+	}
+	if hdr[1]&0x80 != 0 {
+		return frame{}, fmt.Errorf("server frames must not be masked")
+	}
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return frame{}, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return frame{}, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > 1<<20 {
+		return frame{}, fmt.Errorf("frame of %d bytes is implausibly large", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return frame{}, err
+	}
+	return frame{op: hdr[0] & 0x0f, payload: payload, at: at}, nil
+}
+
+// writeFrame sends a masked client frame, as RFC 6455 requires.
+func (c *conn) writeFrame(op byte, payload []byte) error {
+	buf := []byte{0x80 | op}
+	n := len(payload)
+	switch {
+	case n < 126:
+		buf = append(buf, 0x80|byte(n))
+	case n <= 65535:
+		buf = append(buf, 0x80|126, byte(n>>8), byte(n))
+	default:
+		buf = append(buf, 0x80|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	var mask [4]byte
+	_, _ = rand.Read(mask[:])
+	buf = append(buf, mask[:]...)
+	for i, b := range payload {
+		buf = append(buf, b^mask[i%4])
+	}
+	_ = c.nc.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	_, err := c.nc.Write(buf)
+	return err
+}
+
+func (c *conn) close() error {
+	return c.nc.Close()
+}
@@ -0,0 +1,75 @@
+// Package golden exposes a versioned corpus of encoded pulse protocol
+// messages together with their expected decoded values. Client
+// implementations in other languages can read the corpus files directly
+// (golden/v*/corpus.json) and verify their decoders byte-for-byte; Go code
+// can load them through this package.
+//
+// Each corpus version is frozen once released. New message types or codecs
+// are added as new cases, and incompatible changes get a new version
+// directory.
+package golden
+
+import (
+	"bytes"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+//go:embed v*/corpus.json
+var files embed.FS
+
+// Latest is the newest corpus version.
+const Latest = 1
+
+// Corpus is one versioned set of cases.
+type Corpus struct {
+	Version int    `json:"version"`
+	Cases   []Case `json:"cases"`
+}
+
+// Case is a single golden message.
+type Case struct {
+	Name  string `json:"name"`
+	Codec string `json:"codec"`
+	Type  string `json:"type"`
+	// Encoded holds the exact bytes on the wire for text codecs.
+	Encoded string `json:"encoded,omitempty"`
+	// EncodedHex holds the exact bytes on the wire for binary codecs.
+	EncodedHex string `json:"encoded_hex,omitempty"`
+	// Decoded is the expected value of every field after decoding.
+	Decoded json.RawMessage `json:"decoded"`
+}
+
+// Load returns the corpus for the given version.
+func Load(version int) (*Corpus, error) {
+	data, err := files.ReadFile(fmt.Sprintf("v%d/corpus.json", version))
+	if err != nil {
+		return nil, fmt.Errorf("golden corpus v%d: %w", version, err)
+	}
+	var c Corpus
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("golden corpus v%d: %w", version, err)
+	}
+	return &c, nil
+}
+
+// Bytes returns the exact wire bytes of the case.
+func (c Case) Bytes() ([]byte, error) {
+	if c.EncodedHex != "" {
+		return hex.DecodeString(c.EncodedHex)
+	}
+	return []byte(c.Encoded), nil
+}
+
+// Fields decodes the expected values, keeping numbers exact.
+func (c Case) Fields() (map[string]any, error) {
+	var m map[string]any
+	dec := json.NewDecoder(bytes.NewReader(c.Decoded))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("case %s: %w", c.Name, err)
+	}
+	return m, nil
+}
@@ -0,0 +1,116 @@
+package hub
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Ack summaries let clients compare their own sync with the room's. Clients
+// may ack pulses with how far from the beat they landed,
+// {"type":"ack","seq":42,"offset_ms":3.1}; with PULSE_ACK_SUMMARY_MS set,
+// each channel's clients are sent the spread of the latest ack of every
+// client of the channel over that interval:
+// {"type":"ack_summary","channel":"default","clients":38,"p50_ms":1.2,"p95_ms":7.9,…}.
+// Summaries carry no client identities and are not sent for fewer than
+// ackMinClients clients, so no one's offset can be read off them.
+
+const ackMinClients = 3
+
+// maxAckOffset discards acks claiming to be further off than this; they
+// are bogus or from a client that lost sync entirely.
+const maxAckOffset = time.Minute
+
+// ackMessage is a client's report of where it landed a pulse: offset_ms is
+// its beat minus the pulse's, positive when late.
+type ackMessage struct {
+	Type     string  `json:"type"`
+	Seq      uint64  `json:"seq"`
+	OffsetMS float64 `json:"offset_ms"`
+}
+
+// ackSummaryMessage is the spread of one channel's acks over WindowMS.
+type ackSummaryMessage struct {
+	Type     string  `json:"type"`
+	Channel  string  `json:"channel"`
+	WindowMS int64   `json:"window_ms"`
+	Clients  int     `json:"clients"`
+	P50MS    float64 `json:"p50_ms"`
+	P95MS    float64 `json:"p95_ms"`
+	// AbsP95MS is the 95th percentile of how far off clients were either
+	// way.
+	AbsP95MS float64 `json:"abs_p95_ms"`
+}
+
+// ackSummaries collects the latest ack offset of each client per channel
+// until the next summary.
+type ackSummaries struct {
+	interval time.Duration
+
+	mu     sync.Mutex
+	latest map[string]map[*Conn]float64
+}
+
+func newAckSummaries(interval time.Duration) *ackSummaries {
+	return &ackSummaries{interval: interval, latest: make(map[string]map[*Conn]float64)}
+}
+
+// observe records m from c.
+func (a *ackSummaries) observe(c *Conn, m ackMessage) {
+	if math.IsNaN(m.OffsetMS) || math.Abs(m.OffsetMS) > float64(maxAckOffset.Milliseconds()) {
+		return
+	}
+	channel := c.Channel()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	byConn := a.latest[channel]
+	if byConn == nil {
+		byConn = make(map[*Conn]float64)
+		a.latest[channel] = byConn
+	}
+	byConn[c] = m.OffsetMS
+}
+
+// take returns the summaries of the acks since the last call and starts
+// collecting afresh.
+func (a *ackSummaries) take() []ackSummaryMessage {
+	a.mu.Lock()
+	latest := a.latest
+	a.latest = make(map[string]map[*Conn]float64)
+	a.mu.Unlock()
+	var out []ackSummaryMessage
+	for channel, byConn := range latest {
+		if len(byConn) < ackMinClients {
+			continue
+		}
+		offsets := make([]float64, 0, len(byConn))
+		abs := make([]float64, 0, len(byConn))
+		for _, o := range byConn {
+			offsets = append(offsets, o)
+			abs = append(abs, math.Abs(o))
+		}
+		slices.Sort(offsets)
+		slices.Sort(abs)
+		out = append(out, ackSummaryMessage{
+			Type:     "ack_summary",
+			Channel:  channel,
+			WindowMS: a.interval.Milliseconds(),
+			Clients:  len(byConn),
+			P50MS:    offsets[(len(offsets)-1)/2],
+			P95MS:    offsets[int(0.95*float64(len(offsets)-1))],
+			AbsP95MS: abs[int(0.95*float64(len(abs)-1))],
+		})
+	}
+	return out
+}
+
+// runAckSummaries sends each channel's clients its ack summary every
+// interval.
+func (h *Hub) runAckSummaries() {
+	for range time.Tick(h.acks.interval) {
+		for _, m := range h.acks.take() {
+			h.BroadcastIf(m, func(c *Conn) bool { return c.proto != protoRelay && c.Channel() == m.Channel })
+		}
+	}
+}
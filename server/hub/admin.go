@@ -0,0 +1,684 @@
+package hub
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxOffset bounds the output latency offset; anything larger is almost
+// certainly a unit mistake rather than a real downstream delay.
+const maxOffset = time.Minute
+
+type offsetBody struct {
+	OffsetMS int64 `json:"offset_ms"`
+}
+
+// periodBody retunes a channel; Channel defaults to the default channel.
+// BPM may be given instead of PeriodMS.
+type periodBody struct {
+	Channel  string  `json:"channel,omitempty"`
+	PeriodMS int64   `json:"period_ms"`
+	BPM      float64 `json:"bpm,omitempty"`
+}
+
+// rampBody ramps a channel's period to PeriodMS, or BPM, over Pulses
+// pulses; Channel defaults to the default channel.
+type rampBody struct {
+	Channel  string  `json:"channel,omitempty"`
+	PeriodMS int64   `json:"period_ms"`
+	BPM      float64 `json:"bpm,omitempty"`
+	Pulses   int     `json:"pulses"`
+}
+
+// tapBody sets a channel's period from tap times, Unix or any other
+// milliseconds; Channel defaults to the default channel.
+type tapBody struct {
+	Channel string  `json:"channel,omitempty"`
+	TapsMS  []int64 `json:"taps_ms"`
+}
+
+// transportBody pauses, resumes or resets a channel; Channel defaults to
+// the default channel.
+type transportBody struct {
+	Action  string `json:"action"`
+	Channel string `json:"channel,omitempty"`
+}
+
+// rotateBody gives a signing key a new secret, keeping the old one valid
+// for GraceMS; the secret itself never goes into the audit log. Role
+// defaults to admin.
+type rotateBody struct {
+	KeyID   string `json:"key_id"`
+	Role    string `json:"role,omitempty"`
+	GraceMS int64  `json:"grace_ms,omitempty"`
+}
+
+type rotateResult struct {
+	KeyID  string `json:"key_id"`
+	Secret string `json:"secret"`
+}
+
+type traceBody struct {
+	RequestID string `json:"request_id"`
+	Enabled   bool   `json:"enabled"`
+}
+
+// Errors of retune besides an invalid period.
+var (
+	errNoChannel = errors.New("no such channel")
+	errDriven    = errors.New("period set elsewhere")
+)
+
+// retune sets the period of the channel body names, as POST /admin/period
+// and the gRPC SetPeriod do, and returns body with the channel and period
+// filled in.
+func (h *Hub) retune(body periodBody) (periodBody, error) {
+	if body.Channel == "" {
+		body.Channel = defaultChannel
+	}
+	ch := h.channel(body.Channel)
+	if ch == nil {
+		return body, errNoChannel
+	}
+	if by := h.drivenBy(ch); by != "" {
+		return body, fmt.Errorf("%w: the %s channel's period is set by the %s", errDriven, ch.name, by)
+	}
+	if body.BPM <= 0 && !validPeriodMS(body.PeriodMS) {
+		return body, fmt.Errorf("period_ms must be in [%d, %d]", minChannelPeriod.Milliseconds(), maxChannelPeriod.Milliseconds())
+	}
+	d := time.Duration(body.PeriodMS) * time.Millisecond
+	if body.BPM > 0 {
+		d = bpmPeriod(body.BPM)
+		body.PeriodMS = d.Milliseconds()
+	}
+	if d < minChannelPeriod || d > maxChannelPeriod {
+		return body, fmt.Errorf("period_ms must be in [%d, %d]", minChannelPeriod.Milliseconds(), maxChannelPeriod.Milliseconds())
+	}
+	ch.setPeriod(d)
+	slog.Info("admin: period set", "channel", ch.name, "period", d)
+	return body, nil
+}
+
+// validPeriodMS reports whether a period in milliseconds is within
+// [minChannelPeriod, maxChannelPeriod]; check before converting it, which
+// could overflow.
+func validPeriodMS(ms int64) bool {
+	return ms >= minChannelPeriod.Milliseconds() && ms <= maxChannelPeriod.Milliseconds()
+}
+
+// validOffsetMS reports whether an offset in milliseconds is within
+// maxOffset; check before converting it, which could overflow.
+func validOffsetMS(ms int64) bool {
+	return ms >= -maxOffset.Milliseconds() && ms <= maxOffset.Milliseconds()
+}
+
+// registerAdmin mounts the /admin endpoints on mux. The admin API is only
+// enabled when a token or signing key is configured; requests must present
+// a token as a bearer token or be signed (see signing.go), and each
+// endpoint needs a role (see roles.go): observers may read, controllers
+// also change tempo and transport, and admins also act on clients and keys.
+func registerAdmin(mux *http.ServeMux, h *Hub, store Store, audit *auditLog, rounds *rounds, pace *pacer, maint *maintenance, auth *adminAuth, lagThreshold time.Duration) {
+	if !auth.enabled() {
+		return
+	}
+
+	mux.HandleFunc("GET /admin/offset", requireRole(auth, roleObserver, func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, offsetBody{OffsetMS: h.offset().Milliseconds()})
+	}))
+	mux.HandleFunc("POST /admin/offset", requireRole(auth, roleController, func(w http.ResponseWriter, r *http.Request) {
+		var body offsetBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !validOffsetMS(body.OffsetMS) {
+			http.Error(w, "offset_ms out of range", http.StatusBadRequest)
+			return
+		}
+		h.setOffset(time.Duration(body.OffsetMS) * time.Millisecond)
+		if err := saveState(store, serverState{OffsetMS: body.OffsetMS}); err != nil {
+			slog.Error("admin: save state", "err", err)
+		}
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "offset", Params: body})
+		writeJSON(w, http.StatusOK, body)
+	}))
+
+	mux.HandleFunc("POST /admin/period", requireRole(auth, roleController, func(w http.ResponseWriter, r *http.Request) {
+		var body periodBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, err := h.retune(body)
+		switch {
+		case errors.Is(err, errNoChannel):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, errDriven):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "period", Params: body})
+		writeJSON(w, http.StatusOK, body)
+	}))
+
+	mux.HandleFunc("POST /admin/ramp", requireRole(auth, roleController, func(w http.ResponseWriter, r *http.Request) {
+		var body rampBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.Channel == "" {
+			body.Channel = defaultChannel
+		}
+		ch := h.channel(body.Channel)
+		if ch == nil {
+			http.Error(w, "no such channel", http.StatusNotFound)
+			return
+		}
+		if by := h.drivenBy(ch); by != "" {
+			http.Error(w, fmt.Sprintf("the %s channel's period is set by the %s", ch.name, by), http.StatusConflict)
+			return
+		}
+		d, err := rampTarget(body.PeriodMS, body.BPM)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body.PeriodMS = d.Milliseconds()
+		if err := ch.startRamp(d, body.Pulses); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		slog.Info("admin: ramping period", "channel", ch.name, "from", ch.Period(), "to", d, "pulses", body.Pulses)
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "ramp", Params: body})
+		writeJSON(w, http.StatusOK, body)
+	}))
+
+	mux.HandleFunc("POST /admin/tap", requireRole(auth, roleController, func(w http.ResponseWriter, r *http.Request) {
+		var body tapBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.Channel == "" {
+			body.Channel = defaultChannel
+		}
+		ch := h.channel(body.Channel)
+		if ch == nil {
+			http.Error(w, "no such channel", http.StatusNotFound)
+			return
+		}
+		if by := h.drivenBy(ch); by != "" {
+			http.Error(w, fmt.Sprintf("the %s channel's period is set by the %s", ch.name, by), http.StatusConflict)
+			return
+		}
+		d, err := tapPeriod(body.TapsMS)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if d < minChannelPeriod || d > maxChannelPeriod {
+			http.Error(w, fmt.Sprintf("tapped period %s is outside [%s, %s]", d, minChannelPeriod, maxChannelPeriod), http.StatusBadRequest)
+			return
+		}
+		ch.setPeriod(d)
+		slog.Info("admin: period tapped", "channel", ch.name, "period", d)
+		res := periodBody{Channel: ch.name, PeriodMS: d.Milliseconds(), BPM: periodBPM(d)}
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "tap", Params: body})
+		writeJSON(w, http.StatusOK, res)
+	}))
+
+	mux.HandleFunc("POST /admin/transport", requireRole(auth, roleController, func(w http.ResponseWriter, r *http.Request) {
+		var body transportBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.Channel == "" {
+			body.Channel = defaultChannel
+		}
+		id := requestIDFrom(r.Context())
+		if err := h.controlTransport(body.Channel, body.Action, id); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		audit.record(auditEntry{RequestID: id, Action: "transport." + body.Action, Params: body})
+		writeJSON(w, http.StatusOK, body)
+	}))
+
+	config := &configAPI{h: h, store: store, audit: audit}
+	mux.HandleFunc("GET /api/config", requireRole(auth, roleObserver, config.get))
+	mux.HandleFunc("PUT /api/config", requireRole(auth, roleController, config.put))
+
+	mux.HandleFunc("GET /admin/clients", requireRole(auth, roleObserver, func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseClientQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, listClients(h.clients(lagThreshold), q))
+	}))
+
+	mux.HandleFunc("GET /admin/latency", requireRole(auth, roleObserver, latencyHandler(h, lagThreshold)))
+
+	mux.HandleFunc("GET /admin/bandwidth", requireRole(auth, roleObserver, func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, h.bandwidth())
+	}))
+
+	mux.HandleFunc("POST /admin/trace", requireRole(auth, roleController, func(w http.ResponseWriter, r *http.Request) {
+		var body traceBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		c := h.find(body.RequestID)
+		if c == nil {
+			http.Error(w, "no such connection", http.StatusNotFound)
+			return
+		}
+		c.trace.Store(body.Enabled)
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "trace", Params: body, Clients: []string{c.id}})
+		writeJSON(w, http.StatusOK, body)
+	}))
+
+	mux.HandleFunc("POST /admin/clients/bulk", requireRole(auth, roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		var body bulkBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := body.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f, err := parseClientFilter(body.Filter)
+		if err != nil {
+			http.Error(w, "invalid filter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		ids := h.bulk(body, f, lagThreshold)
+		audit.record(auditEntry{
+			RequestID: requestIDFrom(r.Context()),
+			Action:    "bulk." + body.Action,
+			Filter:    body.Filter,
+			Params:    bulkParams{OffsetMS: body.OffsetMS, URL: body.URL},
+			Clients:   ids,
+		})
+		writeJSON(w, http.StatusOK, bulkResult{Action: body.Action, Matched: len(ids), Clients: ids})
+	}))
+
+	mux.HandleFunc("POST /admin/round", requireRole(auth, roleController, func(w http.ResponseWriter, r *http.Request) {
+		var body roundBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		st, err := rounds.begin(body.Round, time.Duration(body.LengthMS)*time.Millisecond)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "round.start", Params: body})
+		writeJSON(w, http.StatusOK, st)
+	}))
+	mux.HandleFunc("DELETE /admin/round", requireRole(auth, roleController, func(w http.ResponseWriter, r *http.Request) {
+		st, ok := rounds.cancel()
+		if !ok {
+			http.Error(w, "no round running", http.StatusNotFound)
+			return
+		}
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "round.cancel", Params: roundBody{Round: st.Round, LengthMS: st.LengthMS}})
+		writeJSON(w, http.StatusOK, st)
+	}))
+
+	mux.HandleFunc("POST /admin/pace", requireRole(auth, roleController, func(w http.ResponseWriter, r *http.Request) {
+		var body paceProgram
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		st, err := pace.begin(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "pace.start", Params: body})
+		writeJSON(w, http.StatusOK, st)
+	}))
+	mux.HandleFunc("DELETE /admin/pace", requireRole(auth, roleController, func(w http.ResponseWriter, r *http.Request) {
+		if !pace.cancel() {
+			http.Error(w, "no pace program running", http.StatusNotFound)
+			return
+		}
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "pace.cancel"})
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	mux.HandleFunc("POST /admin/announcements", requireRole(auth, roleController, func(w http.ResponseWriter, r *http.Request) {
+		var body announcementBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		msg, err := h.notices.post(body, h.clock.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		slog.Info("admin: announcement", "id", msg.ID, "severity", msg.Severity, "text", msg.Text)
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "announce", Params: body})
+		writeJSON(w, http.StatusOK, msg)
+	}))
+	mux.HandleFunc("DELETE /admin/announcements/{id}", requireRole(auth, roleController, func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if !h.notices.withdraw(id, h.clock.Now()) {
+			http.Error(w, "no such announcement", http.StatusNotFound)
+			return
+		}
+		slog.Info("admin: announcement withdrawn", "id", id)
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "announce.withdraw", Params: announcementWithdrawn{Type: "announcement_withdrawn", ID: id}})
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	mux.HandleFunc("GET /admin/cues", requireRole(auth, roleObserver, h.cues.handler()))
+	mux.HandleFunc("POST /admin/cues", requireRole(auth, roleController, func(w http.ResponseWriter, r *http.Request) {
+		var body cueBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		msg, err := h.cues.prepare(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "cue.prepare", Params: body})
+		writeJSON(w, http.StatusOK, msg)
+	}))
+	mux.HandleFunc("DELETE /admin/cues/{id}", requireRole(auth, roleController, func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if !h.cues.cancel(id) {
+			http.Error(w, "no such cue pending", http.StatusNotFound)
+			return
+		}
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "cue.cancel", Params: cueBody{ID: id}})
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("GET /admin/schedule", requireRole(auth, roleObserver, h.schedule.handler()))
+	mux.HandleFunc("POST /admin/schedule", requireRole(auth, roleController, func(w http.ResponseWriter, r *http.Request) {
+		var body scheduleBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		st, err := h.schedule.add(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "cue.schedule", Params: body})
+		writeJSON(w, http.StatusOK, st)
+	}))
+	mux.HandleFunc("DELETE /admin/schedule/{id}", requireRole(auth, roleController, func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if !h.schedule.cancel(id) {
+			http.Error(w, "no such cue scheduled", http.StatusNotFound)
+			return
+		}
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "cue.unschedule", Params: scheduleBody{ID: id}})
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("POST /admin/preview", requireRole(auth, roleObserver, previewHandler(h)))
+	mux.HandleFunc("GET /admin/machines", requireRole(auth, roleObserver, h.machines.handler()))
+	mux.HandleFunc("PUT /admin/machines/{name}", requireRole(auth, roleController, func(w http.ResponseWriter, r *http.Request) {
+		var body machineBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		st, err := h.machines.start(r.PathValue("name"), body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "machine.start", Params: body})
+		writeJSON(w, http.StatusOK, st)
+	}))
+	mux.HandleFunc("POST /admin/machines/{name}/goto", requireRole(auth, roleController, func(w http.ResponseWriter, r *http.Request) {
+		var body gotoBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		st, err := h.machines.jumpTo(r.PathValue("name"), body.State)
+		switch {
+		case errors.Is(err, errNoMachine):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "machine.goto", Params: body})
+		writeJSON(w, http.StatusOK, st)
+	}))
+	mux.HandleFunc("DELETE /admin/machines/{name}", requireRole(auth, roleController, func(w http.ResponseWriter, r *http.Request) {
+		if !h.machines.stop(r.PathValue("name")) {
+			http.Error(w, "no such machine running", http.StatusNotFound)
+			return
+		}
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "machine.stop", Params: map[string]string{"name": r.PathValue("name")}})
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("GET /admin/capabilities", requireRole(auth, roleObserver, func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, h.capabilityBreakdown())
+	}))
+	mux.HandleFunc("POST /admin/capabilities/check", requireRole(auth, roleObserver, func(w http.ResponseWriter, r *http.Request) {
+		var body compatBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		rep, err := h.checkCompat(body)
+		switch {
+		case errors.Is(err, errNoChannel):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, rep)
+	}))
+
+	mux.HandleFunc("POST /admin/domains/{domain}/offset", requireRole(auth, roleController, func(w http.ResponseWriter, r *http.Request) {
+		var body domainOffsetBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		body.Domain = r.PathValue("domain")
+		body, err := h.setDomainOffset(body)
+		switch {
+		case errors.Is(err, errNotManual):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, errNoDomain):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "domain.offset", Params: body})
+		writeJSON(w, http.StatusOK, body)
+	}))
+
+	mux.HandleFunc("POST /admin/channels/{channel}/retire", requireRole(auth, roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		var body retireBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		body.Channel = r.PathValue("channel")
+		msg, err := h.retire(body)
+		switch {
+		case errors.Is(err, errNoChannel):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, errDriven), errors.Is(err, errRetiring):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "channel.retire", Params: body})
+		writeJSON(w, http.StatusOK, msg)
+	}))
+
+	mux.HandleFunc("GET /admin/snapshot", requireRole(auth, roleAdmin, snapshotHandler(h)))
+
+	mux.HandleFunc("POST /admin/maintenance", requireRole(auth, roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		var body maintenanceBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		st, err := maint.schedule(body, h.clock.Now())
+		if errors.Is(err, errMaintenanceScheduled) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		slog.Info("admin: maintenance scheduled", "start", time.UnixMilli(st.StartMS).UTC(), "end", time.UnixMilli(st.EndMS).UTC(),
+			"drain_ms", st.DrainMS, "exit", st.Exit)
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "maintenance.schedule", Params: body})
+		writeJSON(w, http.StatusOK, st)
+	}))
+	mux.HandleFunc("DELETE /admin/maintenance", requireRole(auth, roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		st, ok := maint.cancelWindow(h.clock.Now())
+		if !ok {
+			http.Error(w, "no maintenance window to cancel", http.StatusNotFound)
+			return
+		}
+		slog.Info("admin: maintenance cancelled")
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "maintenance.cancel", Params: maintenanceBody{StartMS: st.StartMS, EndMS: st.EndMS}})
+		writeJSON(w, http.StatusOK, st)
+	}))
+
+	mux.HandleFunc("GET /admin/secrets", requireRole(auth, roleAdmin, func(w http.ResponseWriter, _ *http.Request) {
+		if auth.vault == nil {
+			http.Error(w, "no master key configured", http.StatusConflict)
+			return
+		}
+		writeJSON(w, http.StatusOK, auth.vault.list())
+	}))
+	mux.HandleFunc("POST /admin/secrets/rotate", requireRole(auth, roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		var body rotateBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if auth.vault == nil {
+			http.Error(w, "no master key configured", http.StatusConflict)
+			return
+		}
+		if body.GraceMS < 0 || body.GraceMS > maxRotationGrace.Milliseconds() {
+			http.Error(w, fmt.Sprintf("grace_ms must be in [0, %d]", maxRotationGrace.Milliseconds()), http.StatusBadRequest)
+			return
+		}
+		keyRole := roleAdmin
+		if body.Role != "" {
+			var err error
+			if keyRole, err = parseRole(body.Role); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		secret, err := auth.vault.rotate(body.KeyID, keyRole, time.Duration(body.GraceMS)*time.Millisecond, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		slog.Info("admin: rotated signing key", "key_id", body.KeyID, "role", keyRole, "grace_ms", body.GraceMS)
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "secrets.rotate", Params: body})
+		writeJSON(w, http.StatusOK, rotateResult{KeyID: body.KeyID, Secret: secret})
+	}))
+	mux.HandleFunc("DELETE /admin/secrets/{id}", requireRole(auth, roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if auth.vault == nil {
+			http.Error(w, "no master key configured", http.StatusConflict)
+			return
+		}
+		id := r.PathValue("id")
+		ok, err := auth.vault.revoke(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		slog.Info("admin: revoked signing key", "key_id", id)
+		audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "secrets.revoke", Params: rotateBody{KeyID: id}})
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	mux.HandleFunc("GET /admin/audit", requireRole(auth, roleObserver, func(w http.ResponseWriter, r *http.Request) {
+		limit := 0
+		if s := r.URL.Query().Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		writeJSON(w, http.StatusOK, audit.recent(limit))
+	}))
+}
+
+// requireRole answers 401 to requests without valid credentials and 403 to
+// those whose role is below need.
+func requireRole(auth *adminAuth, need role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got, err := auth.allow(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if got < need {
+			http.Error(w, fmt.Sprintf("%s role required, credentials are %s", need, got), http.StatusForbidden)
+			return
+		}
+		withIdempotency(auth.idempotency, next).ServeHTTP(w, r)
+	}
+}
+
+// hasToken reports whether r carries token as its bearer token.
+func hasToken(r *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,37 @@
+package hub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetuneRange(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		periodMS int64
+		ok       bool
+	}{
+		{"valid", 250, true},
+		{"fastest", minChannelPeriod.Milliseconds(), true},
+		{"too fast", minChannelPeriod.Milliseconds() - 1, false},
+		{"too slow", maxChannelPeriod.Milliseconds() + 1, false},
+		{"negative", -1000, false},
+		// Multiplied by a million, this wraps around to about 99ms.
+		{"overflow", 18446744073809, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := New(time.Second)
+			_, err := h.retune(periodBody{PeriodMS: tc.periodMS})
+			if ok := err == nil; ok != tc.ok {
+				t.Fatalf("retune(%d): err %v, want ok %t", tc.periodMS, err, tc.ok)
+			}
+			want := time.Second
+			if tc.ok {
+				want = time.Duration(tc.periodMS) * time.Millisecond
+			}
+			if got := h.channel(defaultChannel).Period(); got != want {
+				t.Fatalf("period %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxFanoutYield bounds how long a handshake waits for a running pulse
+// fan-out, so a fast channel cannot starve connection setup completely.
+const maxFanoutYield = 50 * time.Millisecond
+
+var (
+	errGateFull = errors.New("handshake queue full")
+	errDraining = errors.New("draining for maintenance")
+)
+
+type gateConfig struct {
+	Rate        float64       // handshakes started per second; 0 is unlimited
+	Concurrency int           // handshakes in progress at once
+	MaxWait     time.Duration // longest a handshake may queue before 503
+	Warmup      time.Duration // minimum warming up period after start
+}
+
+func gateConfigFromEnv() gateConfig {
+	return gateConfig{
+		Rate:        float64(envInt("PULSE_HANDSHAKE_RATE", 500)),
+		Concurrency: max(envInt("PULSE_HANDSHAKE_CONCURRENCY", 64), 1),
+		MaxWait:     envMS("PULSE_HANDSHAKE_QUEUE_MS", 10*time.Second),
+		Warmup:      envMS("PULSE_WARMUP_MS", 3*time.Second),
+	}
+}
+
+// handshakeGate paces connection setup. After a restart every client
+// reconnects at once; upgrading them all as fast as they arrive starves the
+// pulse loop of CPU and makes the very first pulses late for everyone.
+// Handshakes are admitted at cfg.Rate (with one second of burst), at most
+// cfg.Concurrency at a time, never while a pulse is being fanned out, and
+// are turned away with 503 and a jittered Retry-After once the queue would
+// take longer than cfg.MaxWait.
+type handshakeGate struct {
+	h     *Hub
+	cfg   gateConfig
+	slots chan struct{}
+	start time.Time
+
+	mu   sync.Mutex
+	next time.Time // when the next handshake may start under the rate
+
+	queued   atomic.Int64
+	inFlight atomic.Int64
+	warm     atomic.Bool
+	// selfTest, when set, holds readiness until it has passed; see
+	// loadcheck.go.
+	selfTest *loadSelfTest
+	// drainUntil, when non-zero, is the Unix millisecond until which new
+	// connections are turned away for maintenance.
+	drainUntil atomic.Int64
+}
+
+func newHandshakeGate(h *Hub, cfg gateConfig) *handshakeGate {
+	return &handshakeGate{
+		h:     h,
+		cfg:   cfg,
+		slots: make(chan struct{}, cfg.Concurrency),
+		start: time.Now(),
+	}
+}
+
+// acquire waits for the handshake's turn. The returned func must be called
+// once the connection has joined the hub or failed to.
+func (g *handshakeGate) acquire(ctx context.Context) (release func(), err error) {
+	if g.drainUntil.Load() != 0 {
+		return nil, errDraining
+	}
+	deadline := time.Now().Add(g.cfg.MaxWait)
+	at, ok := g.reserve(deadline)
+	if !ok {
+		return nil, errGateFull
+	}
+	g.queued.Add(1)
+	defer g.queued.Add(-1)
+
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+	}
+	timer.Reset(time.Until(deadline))
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return nil, errGateFull
+	case g.slots <- struct{}{}:
+	}
+	// Let a running fan-out finish first: the pulse is due now, the
+	// handshake can wait a few milliseconds.
+	for yield := time.Now().Add(maxFanoutYield); g.h.fanouts.Load() > 0 && time.Now().Before(yield); {
+		time.Sleep(time.Millisecond)
+	}
+	g.inFlight.Add(1)
+	return func() {
+		g.inFlight.Add(-1)
+		<-g.slots
+	}, nil
+}
+
+// reserve books the next start time under the rate limit, or reports false
+// if that is after deadline.
+func (g *handshakeGate) reserve(deadline time.Time) (time.Time, bool) {
+	now := time.Now()
+	if g.cfg.Rate <= 0 {
+		return now, true
+	}
+	interval := time.Duration(float64(time.Second) / g.cfg.Rate)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// Unused capacity accrues for at most one second of burst.
+	if earliest := now.Add(-time.Second); g.next.Before(earliest) {
+		g.next = earliest
+	}
+	at := g.next
+	if at.After(deadline) {
+		return time.Time{}, false
+	}
+	g.next = g.next.Add(interval)
+	if at.Before(now) {
+		at = now
+	}
+	return at, true
+}
+
+// reject answers a handshake turned away by the gate.
+func (g *handshakeGate) reject(w http.ResponseWriter, err error) {
+	if until := g.drainUntil.Load(); errors.Is(err, errDraining) && until != 0 {
+		// Come back once maintenance is over, spread over a few seconds.
+		wait := max(time.Until(time.UnixMilli(until)), 0)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1+rand.Intn(10)))
+		http.Error(w, "down for maintenance, retry later", http.StatusServiceUnavailable)
+		return
+	}
+	if !errors.Is(err, errGateFull) {
+		return // the client went away while queued
+	}
+	// Spread the retries so the next wave does not arrive all at once.
+	w.Header().Set("Retry-After", strconv.Itoa(1+rand.Intn(10)))
+	http.Error(w, "server busy, retry later", http.StatusServiceUnavailable)
+}
+
+// readyStatus is served by GET /readyz.
+type readyStatus struct {
+	Ready    bool                `json:"ready"`
+	State    string              `json:"state"` // warming_up, self_testing, self_test_failed, ready or draining
+	Queued   int64               `json:"queued"`
+	InFlight int64               `json:"in_flight"`
+	SelfTest *loadSelfTestResult `json:"self_test,omitempty"`
+}
+
+// ready reports whether the server has warmed up: the warmup period is
+// over and the handshake backlog has drained once. After that it stays
+// ready; later bursts are paced but do not take the instance out of
+// rotation. While draining for maintenance, or until the startup load
+// self-test has passed, it is not ready.
+func (g *handshakeGate) ready() readyStatus {
+	st := readyStatus{Queued: g.queued.Load(), InFlight: g.inFlight.Load(), State: "warming_up", SelfTest: g.selfTest.status()}
+	if !g.warm.Load() && time.Since(g.start) >= g.cfg.Warmup && st.Queued == 0 {
+		g.warm.Store(true)
+	}
+	switch {
+	case g.drainUntil.Load() != 0:
+		st.State = "draining"
+	case st.SelfTest != nil && st.SelfTest.State == "running":
+		st.State = "self_testing"
+	case st.SelfTest != nil && st.SelfTest.State == "failed":
+		st.State = "self_test_failed"
+	case g.warm.Load():
+		st.Ready, st.State = true, "ready"
+	}
+	return st
+}
+
+// readyHandler serves GET /readyz: 200 once warmed up, 503 before.
+func (g *handshakeGate) readyHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		st := g.ready()
+		code := http.StatusOK
+		if !st.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, st)
+	}
+}
@@ -0,0 +1,126 @@
+package hub
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type alertConfig struct {
+	Jitter        time.Duration // fire when jitter stays above this; 0 disables
+	Broadcast     time.Duration // fire when broadcast time stays above this; 0 disables
+	NoSubscribers bool          // fire when nobody is subscribed
+	For           time.Duration // how long a condition must hold before firing
+}
+
+func alertConfigFromEnv() alertConfig {
+	return alertConfig{
+		Jitter:        envMS("PULSE_ALERT_JITTER_MS", 0),
+		Broadcast:     envMS("PULSE_ALERT_BROADCAST_MS", 0),
+		NoSubscribers: envBool("PULSE_ALERT_NO_SUBSCRIBERS", false),
+		For:           envMS("PULSE_ALERT_FOR_MS", 5*time.Second),
+	}
+}
+
+type alertRule struct {
+	name     string
+	breached func(PulseObservation) bool
+
+	pendingSince time.Time
+	firingSince  time.Time
+}
+
+// activeAlert is the /api/status view of a firing rule.
+type activeAlert struct {
+	Name  string    `json:"name"`
+	Since time.Time `json:"since"`
+}
+
+type alertEvent struct {
+	Event string    `json:"event"`
+	Alert string    `json:"alert"`
+	Seq   uint64    `json:"seq"`
+	At    time.Time `json:"at"`
+}
+
+// alerter evaluates alert rules against every emitted pulse. A rule fires
+// once its condition has held continuously for cfg.For and resolves as soon
+// as the condition clears.
+type alerter struct {
+	mu      sync.Mutex
+	rules   []*alertRule
+	sustain time.Duration
+	hooks   *webhooks
+}
+
+// newAlerter evaluates the rules in cfg and posts their events to hooks.
+func newAlerter(cfg alertConfig, hooks *webhooks) *alerter {
+	a := &alerter{sustain: cfg.For, hooks: hooks}
+	if cfg.Jitter > 0 {
+		a.rules = append(a.rules, &alertRule{
+			name:     "jitter",
+			breached: func(o PulseObservation) bool { return o.Jitter > cfg.Jitter },
+		})
+	}
+	if cfg.Broadcast > 0 {
+		a.rules = append(a.rules, &alertRule{
+			name:     "broadcast_latency",
+			breached: func(o PulseObservation) bool { return o.Broadcast > cfg.Broadcast },
+		})
+	}
+	if cfg.NoSubscribers {
+		a.rules = append(a.rules, &alertRule{
+			name:     "no_subscribers",
+			breached: func(o PulseObservation) bool { return o.Subscribers == 0 },
+		})
+	}
+	return a
+}
+
+func (a *alerter) observe(o PulseObservation) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, r := range a.rules {
+		if !r.breached(o) {
+			r.pendingSince = time.Time{}
+			if !r.firingSince.IsZero() {
+				r.firingSince = time.Time{}
+				a.notify(alertEvent{Event: "alert.resolved", Alert: r.name, Seq: o.Seq, At: o.At})
+			}
+			continue
+		}
+		if r.pendingSince.IsZero() {
+			r.pendingSince = o.At
+		}
+		if r.firingSince.IsZero() && o.At.Sub(r.pendingSince) >= a.sustain {
+			r.firingSince = o.At
+			a.notify(alertEvent{Event: "alert.firing", Alert: r.name, Seq: o.Seq, At: o.At})
+		}
+	}
+}
+
+func (a *alerter) active() []activeAlert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	out := []activeAlert{}
+	for _, r := range a.rules {
+		if !r.firingSince.IsZero() {
+			out = append(out, activeAlert{Name: r.name, Since: r.firingSince})
+		}
+	}
+	return out
+}
+
+// notify logs the event and posts it to the webhooks.
+func (a *alerter) notify(ev alertEvent) {
+	slog.Warn(ev.Event, "alert", ev.Alert, "seq", ev.Seq)
+	a.post(ev.Event, ev)
+}
+
+// post sends v, the JSON of event, to the webhooks that want it, without
+// blocking the caller.
+func (a *alerter) post(event string, v any) {
+	a.hooks.send(event, v)
+}
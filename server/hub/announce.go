@@ -0,0 +1,176 @@
+package hub
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Announcement limits: text is for a banner, not a release note, and an
+// announcement without a downtime window is kept for at most a week.
+const (
+	maxAnnouncementText    = 500
+	defaultAnnouncementTTL = time.Hour
+	maxAnnouncementTTL     = 7 * 24 * time.Hour
+)
+
+// announcementBody is POST /admin/announcements:
+// {"text":"Maintenance tonight","severity":"warning","downtime":{"start_ms":…,"end_ms":…}}.
+// Channels limits it to some channels, all by default. It is kept until
+// the downtime ends or, without one, for TTLMS.
+type announcementBody struct {
+	Text     string          `json:"text"`
+	Severity string          `json:"severity,omitempty"`
+	Channels []string        `json:"channels,omitempty"`
+	Downtime *downtimeWindow `json:"downtime,omitempty"`
+	TTLMS    int64           `json:"ttl_ms,omitempty"`
+}
+
+// downtimeWindow is a scheduled outage, server time in Unix milliseconds.
+type downtimeWindow struct {
+	StartMS int64 `json:"start_ms"`
+	EndMS   int64 `json:"end_ms"`
+}
+
+// announcementMessage is broadcast to the channels an announcement is for
+// and sent after the hello to clients that connect while it is current.
+type announcementMessage struct {
+	Type      string          `json:"type"`
+	ID        string          `json:"id"`
+	Text      string          `json:"text"`
+	Severity  string          `json:"severity"`
+	Channels  []string        `json:"channels,omitempty"`
+	Downtime  *downtimeWindow `json:"downtime,omitempty"`
+	SentMS    int64           `json:"sent_ms"`
+	ExpiresMS int64           `json:"expires_ms"`
+}
+
+// announcementWithdrawn tells clients to stop showing an announcement.
+type announcementWithdrawn struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+var announcementSeverities = []string{"info", "warning", "critical"}
+
+// announcements keeps the announcements that have not expired, in the
+// order they were made.
+type announcements struct {
+	h *Hub
+
+	mu     sync.Mutex
+	active []announcementMessage
+}
+
+// post validates body, broadcasts it and keeps it for clients yet to
+// connect.
+func (a *announcements) post(body announcementBody, now time.Time) (announcementMessage, error) {
+	msg := announcementMessage{
+		Type:     "announcement",
+		ID:       newRequestID()[:12],
+		Text:     body.Text,
+		Severity: body.Severity,
+		Channels: body.Channels,
+		Downtime: body.Downtime,
+		SentMS:   now.UnixMilli(),
+	}
+	if msg.Text == "" || utf8.RuneCountInString(msg.Text) > maxAnnouncementText {
+		return msg, fmt.Errorf("text must be 1 to %d characters", maxAnnouncementText)
+	}
+	if msg.Severity == "" {
+		msg.Severity = "info"
+	}
+	if !slices.Contains(announcementSeverities, msg.Severity) {
+		return msg, fmt.Errorf("severity must be info, warning or critical")
+	}
+	for _, name := range msg.Channels {
+		if a.h.channel(name) == nil {
+			return msg, fmt.Errorf("unknown channel %q", name)
+		}
+	}
+	if body.TTLMS < 0 || body.TTLMS > maxAnnouncementTTL.Milliseconds() {
+		return msg, fmt.Errorf("ttl_ms must be in [0, %d]", maxAnnouncementTTL.Milliseconds())
+	}
+	ttl := time.Duration(body.TTLMS) * time.Millisecond
+	switch {
+	case msg.Downtime != nil:
+		if msg.Downtime.EndMS <= msg.Downtime.StartMS || msg.Downtime.EndMS <= msg.SentMS {
+			return msg, fmt.Errorf("downtime must end after it starts and in the future")
+		}
+		msg.ExpiresMS = msg.Downtime.EndMS
+	case ttl == 0:
+		msg.ExpiresMS = now.Add(defaultAnnouncementTTL).UnixMilli()
+	default:
+		msg.ExpiresMS = now.Add(ttl).UnixMilli()
+	}
+
+	a.mu.Lock()
+	a.prune(now)
+	a.active = append(a.active, msg)
+	a.mu.Unlock()
+	a.h.BroadcastIf(msg, msg.reaches)
+	return msg, nil
+}
+
+// withdraw removes announcement id and tells its clients, reporting
+// whether it was current.
+func (a *announcements) withdraw(id string, now time.Time) bool {
+	a.mu.Lock()
+	a.prune(now)
+	i := slices.IndexFunc(a.active, func(m announcementMessage) bool { return m.ID == id })
+	if i < 0 {
+		a.mu.Unlock()
+		return false
+	}
+	msg := a.active[i]
+	a.active = slices.Delete(a.active, i, i+1)
+	a.mu.Unlock()
+	a.h.BroadcastIf(announcementWithdrawn{Type: "announcement_withdrawn", ID: id}, msg.reaches)
+	return true
+}
+
+// current returns the announcements c should see at now.
+func (a *announcements) current(c *Conn, now time.Time) []announcementMessage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.prune(now)
+	var out []announcementMessage
+	for _, m := range a.active {
+		if m.reaches(c) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// prune drops expired announcements; the caller holds a.mu.
+func (a *announcements) prune(now time.Time) {
+	a.active = slices.DeleteFunc(a.active, func(m announcementMessage) bool {
+		return m.ExpiresMS <= now.UnixMilli()
+	})
+}
+
+// reaches reports whether c is on one of m's channels.
+func (m announcementMessage) reaches(c *Conn) bool {
+	return len(m.Channels) == 0 || slices.ContainsFunc(m.Channels, c.receives)
+}
+
+// handler serves GET /api/announcements, optionally for one ?channel=.
+func (a *announcements) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		channel := r.URL.Query().Get("channel")
+		a.mu.Lock()
+		a.prune(a.h.clock.Now())
+		out := make([]announcementMessage, 0, len(a.active))
+		for _, m := range a.active {
+			if channel == "" || len(m.Channels) == 0 || slices.Contains(m.Channels, channel) {
+				out = append(out, m)
+			}
+		}
+		a.mu.Unlock()
+		writeJSON(w, http.StatusOK, out)
+	}
+}
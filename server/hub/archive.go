@@ -0,0 +1,161 @@
+package hub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rotator is implemented by stores whose streams can be cut into closed
+// segments for archival.
+type rotator interface {
+	// Rotate closes the current segment of stream; new records go to a
+	// fresh one.
+	Rotate(stream string) error
+	// Segments lists the files of closed segments of stream, oldest first.
+	Segments(stream string) ([]string, error)
+}
+
+type archiveConfig struct {
+	URL       string        // s3://bucket/prefix or gs://bucket/prefix; empty disables
+	Endpoint  string        // overrides the object storage endpoint
+	Every     time.Duration // how often streams are rotated and uploaded
+	Retention time.Duration // archived objects older than this are deleted; 0 keeps them
+}
+
+func archiveConfigFromEnv() archiveConfig {
+	cfg := archiveConfig{
+		URL:      strings.TrimSpace(os.Getenv("PULSE_ARCHIVE_URL")),
+		Endpoint: strings.TrimSpace(os.Getenv("PULSE_ARCHIVE_ENDPOINT")),
+		Every:    envMS("PULSE_ARCHIVE_INTERVAL_MS", time.Hour),
+	}
+	if raw := strings.TrimSpace(os.Getenv("PULSE_ARCHIVE_RETENTION_DAYS")); raw != "" {
+		days, err := strconv.Atoi(raw)
+		if err != nil || days < 0 {
+			slog.Warn("invalid PULSE_ARCHIVE_RETENTION_DAYS, keeping archives forever", "value", raw)
+		} else {
+			cfg.Retention = time.Duration(days) * 24 * time.Hour
+		}
+	}
+	return cfg
+}
+
+// archiver periodically rotates the history and audit streams, uploads the
+// closed segments gzipped to object storage, removes them locally once
+// uploaded and expires old archives.
+type archiver struct {
+	cfg     archiveConfig
+	client  *s3Client
+	store   rotator
+	streams []string
+}
+
+func startArchiver(cfg archiveConfig, store Store) error {
+	if cfg.URL == "" {
+		return nil
+	}
+	rot, ok := store.(rotator)
+	if !ok {
+		return fmt.Errorf("archival needs a file: store")
+	}
+	if cfg.Every <= 0 {
+		return fmt.Errorf("archive interval must be positive")
+	}
+	client, err := newS3Client(cfg.URL, cfg.Endpoint)
+	if err != nil {
+		return err
+	}
+	a := &archiver{cfg: cfg, client: client, store: rot, streams: []string{streamHistory, streamAudit}}
+	go func() {
+		t := time.NewTicker(cfg.Every)
+		defer t.Stop()
+		for now := range t.C {
+			a.run(now)
+		}
+	}()
+	slog.Info("archiving", "streams", a.streams, "url", cfg.URL, "every", cfg.Every)
+	return nil
+}
+
+func (a *archiver) run(now time.Time) {
+	for _, stream := range a.streams {
+		if err := a.store.Rotate(stream); err != nil {
+			slog.Error("archive: rotate", "stream", stream, "err", err)
+		}
+		segs, err := a.store.Segments(stream)
+		if err != nil {
+			slog.Error("archive", "stream", stream, "err", err)
+			continue
+		}
+		for _, seg := range segs {
+			// Failed uploads stay on disk and are retried next round.
+			if err := a.upload(stream, seg); err != nil {
+				slog.Error("archive: upload", "segment", seg, "err", err)
+				continue
+			}
+			if err := os.Remove(seg); err != nil {
+				slog.Error("archive", "err", err)
+			}
+		}
+	}
+	if a.cfg.Retention > 0 {
+		a.expire(now.Add(-a.cfg.Retention))
+	}
+}
+
+func (a *archiver) upload(stream, seg string) error {
+	raw, err := os.ReadFile(seg)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(seg, ".seg") {
+		// Compressed and indexed already; gzip would only hide the index.
+		key := a.client.objectKey(path.Join(stream, filepath.Base(seg)))
+		if err := a.client.put(key, raw, "application/octet-stream"); err != nil {
+			return err
+		}
+		slog.Info("archive: uploaded", "key", key, "bytes", len(raw))
+		return nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(raw); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	key := a.client.objectKey(path.Join(stream, filepath.Base(seg)+".gz"))
+	if err := a.client.put(key, buf.Bytes(), "application/gzip"); err != nil {
+		return err
+	}
+	slog.Info("archive: uploaded", "key", key, "bytes", buf.Len())
+	return nil
+}
+
+func (a *archiver) expire(before time.Time) {
+	for _, stream := range a.streams {
+		objs, err := a.client.list(a.client.objectKey(stream + "/"))
+		if err != nil {
+			slog.Error("archive: list", "stream", stream, "err", err)
+			continue
+		}
+		for _, o := range objs {
+			if !o.LastModified.Before(before) {
+				continue
+			}
+			if err := a.client.delete(o.Key); err != nil {
+				slog.Error("archive: expire", "key", o.Key, "err", err)
+				continue
+			}
+			slog.Info("archive: expired", "key", o.Key)
+		}
+	}
+}
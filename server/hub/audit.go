@@ -0,0 +1,79 @@
+package hub
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// auditCapacity is how many admin actions are kept in memory.
+const auditCapacity = 1000
+
+// auditEntry records one state-changing admin action.
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Action    string    `json:"action"`
+	Filter    string    `json:"filter,omitempty"`
+	Params    any       `json:"params,omitempty"`
+	Clients   []string  `json:"clients,omitempty"`
+}
+
+// auditLog keeps the most recent admin actions in memory, appends each one
+// to the store and mirrors it to the server log.
+type auditLog struct {
+	store   Store
+	mu      sync.Mutex
+	entries []auditEntry
+}
+
+// newAuditLog creates an audit log backed by store, preloaded with the most
+// recent entries already in it.
+func newAuditLog(store Store) *auditLog {
+	a := &auditLog{store: store}
+	recs, err := store.Tail(streamAudit, auditCapacity)
+	if err != nil {
+		slog.Error("audit: load", "err", err)
+	}
+	for _, rec := range recs {
+		var e auditEntry
+		if err := json.Unmarshal(rec, &e); err == nil {
+			a.entries = append(a.entries, e)
+		}
+	}
+	return a
+}
+
+func (a *auditLog) record(e auditEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	params, _ := json.Marshal(e.Params)
+	slog.Info("audit", "action", e.Action, "request_id", e.RequestID, "filter", e.Filter,
+		"params", string(params), "clients", len(e.Clients))
+	if rec, err := json.Marshal(e); err == nil {
+		if err := a.store.Append(streamAudit, rec); err != nil {
+			slog.Error("audit: store", "err", err)
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.entries) == auditCapacity {
+		copy(a.entries, a.entries[1:])
+		a.entries = a.entries[:auditCapacity-1]
+	}
+	a.entries = append(a.entries, e)
+}
+
+// recent returns up to limit entries, oldest first.
+func (a *auditLog) recent(limit int) []auditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	start := 0
+	if limit > 0 && len(a.entries) > limit {
+		start = len(a.entries) - limit
+	}
+	return append([]auditEntry{}, a.entries[start:]...)
+}
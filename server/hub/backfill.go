@@ -0,0 +1,151 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Every channel keeps its most recent pulses, as JSON clients get them, so a
+// client that reconnects or notices a gap in seq can fetch what it missed
+// and re-anchor on the latest pulse at once: GET /api/pulses?since_seq=N, or
+// {"type":"backfill","since_seq":N} on the socket.
+
+const defaultBackfill = 256
+
+// backfillSize is how many pulses each channel keeps, set by
+// PULSE_BACKFILL; 0 keeps none.
+var backfillSize = defaultBackfill
+
+// pulseRing holds a channel's latest pulses, oldest first from start.
+type pulseRing struct {
+	mu     sync.Mutex
+	pulses []recentPulse
+	start  int
+	// latest is the last pulse added, kept even when backfill is off, and
+	// changed is closed when the next one is, for long polls.
+	latest  *recentPulse
+	changed chan struct{}
+}
+
+// recentPulse is a kept pulse as millisecond clients get it, and as those
+// with microsecond precision do.
+type recentPulse struct {
+	seq    uint64
+	data   json.RawMessage
+	micros json.RawMessage
+}
+
+// encoded is p as a client gets it that wants micros or not.
+func (p recentPulse) encoded(micros bool) json.RawMessage {
+	if micros {
+		return p.micros
+	}
+	return p.data
+}
+
+// add keeps msg, replacing the oldest pulse once the ring is full.
+func (r *pulseRing) add(msg PulseMessage) {
+	data, err := json.Marshal(msg.withoutMicros())
+	if err != nil {
+		return
+	}
+	micros := data
+	if msg.PeriodUS != 0 {
+		if micros, err = json.Marshal(msg); err != nil {
+			return
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := recentPulse{seq: msg.Seq, data: data, micros: micros}
+	r.latest = &p
+	if r.changed != nil {
+		close(r.changed)
+		r.changed = nil
+	}
+	if backfillSize <= 0 {
+		return
+	}
+	if len(r.pulses) < backfillSize {
+		r.pulses = append(r.pulses, p)
+		return
+	}
+	r.pulses[r.start] = p
+	r.start = (r.start + 1) % len(r.pulses)
+}
+
+// backfillMessage answers a backfill request with the pulses after
+// SinceSeq still kept, oldest first. Complete is false when pulses after
+// SinceSeq have already been discarded, so the client knows its gap is
+// not entirely filled; OldestSeq is the oldest pulse kept.
+type backfillMessage struct {
+	Type      string            `json:"type"`
+	Channel   string            `json:"channel"`
+	SinceSeq  uint64            `json:"since_seq"`
+	OldestSeq *uint64           `json:"oldest_seq,omitempty"`
+	Complete  bool              `json:"complete"`
+	Pulses    []json.RawMessage `json:"pulses"`
+}
+
+// since returns the channel's kept pulses after seq, with the microsecond
+// fields if micros is set.
+func (r *pulseRing) since(channel string, seq uint64, micros bool) backfillMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sinceLocked(channel, seq, micros)
+}
+
+func (r *pulseRing) sinceLocked(channel string, seq uint64, micros bool) backfillMessage {
+	m := backfillMessage{Type: "backfill", Channel: channel, SinceSeq: seq, Complete: true, Pulses: []json.RawMessage{}}
+	for i := range r.pulses {
+		p := r.pulses[(r.start+i)%len(r.pulses)]
+		if i == 0 {
+			oldest := p.seq
+			m.OldestSeq = &oldest
+			m.Complete = p.seq <= seq+1
+		}
+		if p.seq > seq {
+			m.Pulses = append(m.Pulses, p.encoded(micros))
+		}
+	}
+	return m
+}
+
+// backfillRequest asks for a channel's pulses after SinceSeq:
+// {"type":"backfill","since_seq":41}. The reply is a backfillMessage for
+// the client's channel.
+type backfillRequest struct {
+	Type     string `json:"type"`
+	SinceSeq uint64 `json:"since_seq"`
+}
+
+// backfillHandler serves GET /api/pulses?since_seq=N&channel=NAME&precision=P;
+// the channel defaults to default.
+func backfillHandler(h *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		name := q.Get("channel")
+		if name == "" {
+			name = defaultChannel
+		}
+		ch := h.channel(name)
+		if ch == nil {
+			http.Error(w, fmt.Sprintf("unknown channel %q", name), http.StatusNotFound)
+			return
+		}
+		since, err := strconv.ParseUint(q.Get("since_seq"), 10, 64)
+		if err != nil {
+			http.Error(w, "since_seq must be a seq", http.StatusBadRequest)
+			return
+		}
+		micros, err := parsePrecision(q.Get("precision"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, ch.recent.since(ch.name, since, micros))
+	}
+}
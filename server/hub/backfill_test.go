@@ -0,0 +1,24 @@
+package hub
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRingKeepsMicrosForThoseWhoAsk(t *testing.T) {
+	var r pulseRing
+	r.add(PulseMessage{Type: "pulse", Seq: 1, PeriodMS: 468, NowMS: 1739700021000, NextMS: 1739700021469, PeriodUS: 468750, NowUS: 1739700021000312, NextUS: 1739700021469062})
+	for _, micros := range []bool{false, true} {
+		m := r.since(defaultChannel, 0, micros)
+		if len(m.Pulses) != 1 {
+			t.Fatalf("micros %t: %d pulses, want 1", micros, len(m.Pulses))
+		}
+		if got := strings.Contains(string(m.Pulses[0]), `"period_us"`); got != micros {
+			t.Errorf("micros %t: pulse %s", micros, m.Pulses[0])
+		}
+		p, _ := r.poll(defaultChannel, 0, micros)
+		if got := strings.Contains(string(p.Pulses[0]), `"next_us"`); got != micros {
+			t.Errorf("poll micros %t: pulse %s", micros, p.Pulses[0])
+		}
+	}
+}
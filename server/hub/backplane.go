@@ -0,0 +1,374 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clustering over Redis pub/sub. With PULSE_BACKPLANE set, the publisher
+// (PULSE_BACKPLANE_ROLE=publisher) runs the pulse loops as usual and
+// publishes every pulse and transport change; edges run no loops of their
+// own and fan out what they receive to their clients. Pulses keep the
+// publisher's seq, timestamps and extra fields, so clients on any edge see
+// the same stream. Anything that publishes backplaneMessages can take the
+// publisher's place.
+//
+// Replicas (PULSE_BACKPLANE_ROLE=replica) elect the publisher among
+// themselves: whoever holds the leader lease in Redis runs the pulse loops
+// and publishes, the rest relay like edges. A replica that takes over
+// resumes every channel's grid and seq from the latest pulse it relayed, or
+// from the state the leader saves with every renewal if that is newer, so
+// seq keeps increasing across a failover.
+
+// Backplane roles, set by PULSE_BACKPLANE_ROLE.
+const (
+	backplanePublisher = "publisher"
+	backplaneEdge      = "edge"
+	backplaneReplica   = "replica"
+)
+
+const (
+	// backplaneTopic is the Redis pub/sub channel.
+	backplaneTopic = redisPrefix + "backplane"
+	// backplaneBuffer is how many messages wait to be published before
+	// new ones are dropped; fan-out never waits for Redis.
+	backplaneBuffer = 256
+	backplaneRetry  = time.Second
+
+	// leaderKey holds the id of the replica that leads, for leaderTTL
+	// unless renewed; the leader renews it every leaderRenew and saves its
+	// channels' state under leaderStateKey.
+	leaderKey      = redisPrefix + "leader"
+	leaderStateKey = "leader:state"
+	leaderTTL      = 3 * time.Second
+	leaderRenew    = time.Second
+)
+
+// backplaneMessage is a pulse, transport change, resync or count-in of one
+// channel.
+type backplaneMessage struct {
+	Channel string `json:"channel"`
+	// ScheduledUnixNano is when the pulse was due to go out, and LeadNS how
+	// long before its beat; edges measure their jitter against it.
+	ScheduledUnixNano int64             `json:"scheduled_unix_nano,omitempty"`
+	LeadNS            int64             `json:"lead_ns,omitempty"`
+	Pulse             *PulseMessage     `json:"pulse,omitempty"`
+	Transport         *transportMessage `json:"transport,omitempty"`
+	Resync            *resyncMessage    `json:"resync,omitempty"`
+	Preroll           *prerollMessage   `json:"preroll,omitempty"`
+}
+
+type backplane struct {
+	edge, replica bool
+	// redis publishes and holds the lease; sub is the subscription's own
+	// connection.
+	redis, sub *redisStore
+	out        chan []byte
+	// id names this instance in the leader lease.
+	id      string
+	leading atomic.Bool
+
+	mu sync.Mutex
+	// unknown are channels edges got messages for but do not have, each
+	// logged once.
+	unknown map[string]bool
+	// warnedAt rate-limits warnings about publishing.
+	warnedAt time.Time
+}
+
+func startBackplane(raw, role string) (*backplane, error) {
+	b := &backplane{unknown: make(map[string]bool)}
+	switch role {
+	case backplanePublisher:
+	case backplaneEdge:
+		b.edge = true
+	case backplaneReplica:
+		b.replica = true
+		host, _ := os.Hostname()
+		b.id = fmt.Sprintf("%s/%d/%s", host, os.Getpid(), newRequestID())
+	default:
+		return nil, fmt.Errorf("PULSE_BACKPLANE_ROLE must be %s, %s or %s", backplanePublisher, backplaneEdge, backplaneReplica)
+	}
+	var err error
+	if !b.edge {
+		if b.redis, err = openRedisStore(raw); err != nil {
+			return nil, err
+		}
+		b.out = make(chan []byte, backplaneBuffer)
+		go b.publishLoop()
+	}
+	if b.edge || b.replica {
+		if b.sub, err = openRedisStore(raw); err != nil {
+			return nil, err
+		}
+	}
+	slog.Info("backplane", "role", role, "id", b.id)
+	return b, nil
+}
+
+// isEdge reports whether pulses come from the backplane rather than this
+// hub's own pulse loops.
+func (b *backplane) isEdge() bool {
+	return b != nil && b.edge
+}
+
+// isReplica reports whether this hub takes part in leader election.
+func (b *backplane) isReplica() bool {
+	return b != nil && b.replica
+}
+
+// following reports whether this hub relays pulses from the backplane
+// right now: always on an edge, and on a replica that does not lead.
+func (b *backplane) following() bool {
+	return b.isEdge() || (b.isReplica() && !b.leading.Load())
+}
+
+// publishPulse publishes msg, due to go out at scheduled; it does nothing
+// except on a publisher.
+func (b *backplane) publishPulse(msg PulseMessage, scheduled time.Time) {
+	if b == nil || b.edge {
+		return
+	}
+	b.publish(backplaneMessage{
+		Channel:           msg.Channel,
+		ScheduledUnixNano: scheduled.UnixNano(),
+		LeadNS:            int64(msg.Lead),
+		Pulse:             &msg,
+	})
+}
+
+func (b *backplane) publishTransport(msg transportMessage) {
+	if b == nil || b.edge {
+		return
+	}
+	b.publish(backplaneMessage{Channel: msg.Channel, Transport: &msg})
+}
+
+func (b *backplane) publishResync(msg resyncMessage) {
+	if b == nil || b.edge {
+		return
+	}
+	b.publish(backplaneMessage{Channel: msg.Channel, Resync: &msg})
+}
+
+func (b *backplane) publishPreroll(msg prerollMessage) {
+	if b == nil || b.edge {
+		return
+	}
+	b.publish(backplaneMessage{Channel: msg.Channel, Preroll: &msg})
+}
+
+func (b *backplane) publish(m backplaneMessage) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		slog.Error("backplane: encode", "err", err)
+		return
+	}
+	select {
+	case b.out <- data:
+	default:
+		b.warn("backplane: publish queue full, message dropped", nil)
+	}
+}
+
+func (b *backplane) publishLoop() {
+	for data := range b.out {
+		if err := b.redis.publish(backplaneTopic, data); err != nil {
+			b.warn("backplane: publish", err)
+		}
+	}
+}
+
+func (b *backplane) warn(msg string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now := time.Now(); now.Sub(b.warnedAt) >= 10*time.Second {
+		b.warnedAt = now
+		slog.Warn(msg, "err", err)
+	}
+}
+
+// follow relays what the backplane carries to h's clients until ctx is
+// done, resubscribing after errors.
+func (b *backplane) follow(ctx context.Context, h *Hub) {
+	go func() {
+		<-ctx.Done()
+		_ = b.sub.Close()
+	}()
+	for ctx.Err() == nil {
+		err := b.sub.subscribe(backplaneTopic, func(data []byte) { b.deliver(h, data) })
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("backplane: subscription lost; resubscribing", "err", err, "in", backplaneRetry)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backplaneRetry):
+		}
+	}
+}
+
+// deliver fans out one backplane message on an edge or a replica that
+// does not lead. A replica also ignores pulses no newer than the latest it
+// has, e.g. its own still arriving after it stepped down.
+func (b *backplane) deliver(h *Hub, data []byte) {
+	if !b.following() {
+		return
+	}
+	var m backplaneMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		b.warn("backplane: invalid message", err)
+		return
+	}
+	ch := h.channel(m.Channel)
+	if ch == nil {
+		b.mu.Lock()
+		if !b.unknown[m.Channel] {
+			b.unknown[m.Channel] = true
+			slog.Warn("backplane: channel not configured here; ignoring it", "channel", m.Channel)
+		}
+		b.mu.Unlock()
+		return
+	}
+	if a := ch.last.Load(); m.Pulse != nil && b.replica && a != nil && m.Pulse.Seq <= a.seq {
+		return
+	}
+	h.relay(ch, m)
+}
+
+// relay fans out m, a pulse, transport change, resync or count-in of ch that was generated
+// elsewhere: by the backplane's publisher or in a recording. The channel
+// takes on the period and transport state it announces.
+func (h *Hub) relay(ch *pulseChannel, m backplaneMessage) {
+	switch {
+	case m.Pulse != nil:
+		msg := *m.Pulse
+		scheduled := time.Unix(0, m.ScheduledUnixNano)
+		msg.Channel, msg.Lead, msg.relayed = ch.name, time.Duration(m.LeadNS), true
+		msg.Beat = scheduled.Add(msg.Lead)
+		period := msg.period()
+		if period > 0 && period != ch.Period() {
+			ch.setPeriod(period)
+		}
+		var observe func(PulseObservation)
+		if ch.name == defaultChannel {
+			observe = h.observe
+		}
+		h.emit(msg, scheduled, 0, observe)
+		ch.last.Store(&channelAnchor{seq: msg.Seq, at: msg.Beat.Add(-pulseSwing(msg)), period: period})
+	case m.Transport != nil:
+		action := transportResume
+		if m.Transport.State == "paused" {
+			action = transportPause
+		}
+		_ = ch.transport.control(action, m.Transport.By)
+		h.relayTransport(ch, *m.Transport)
+	case m.Resync != nil:
+		h.relayResync(ch, *m.Resync)
+	case m.Preroll != nil:
+		h.relayPreroll(ch, *m.Preroll)
+	}
+}
+
+// campaign contends for the leader lease until ctx is done. While it holds
+// the lease this hub runs the pulse loops and saves its state with every
+// renewal; when it cannot renew, it stops them at once, before another
+// replica can take over, and relays again.
+func (b *backplane) campaign(ctx context.Context, h *Hub) {
+	var stop context.CancelFunc
+	stepDown := func(reason string, err error) {
+		stop()
+		stop = nil
+		b.leading.Store(false)
+		slog.Warn("backplane: no longer leading; relaying", "reason", reason, "err", err)
+	}
+	// Listen for a leader before contending, so a replica joining a running
+	// cluster starts from its pulses.
+	t := time.NewTimer(leaderTTL)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if stop != nil {
+				stop()
+				_ = b.redis.releaseLease(leaderKey, b.id)
+			}
+			return
+		case <-t.C:
+		}
+		t.Reset(leaderRenew)
+		if stop == nil {
+			ok, err := b.redis.acquireLease(leaderKey, b.id, leaderTTL)
+			if err != nil {
+				b.warn("backplane: leader election", err)
+			}
+			if !ok {
+				continue
+			}
+			b.leading.Store(true)
+			b.takeOver(h)
+			var lctx context.Context
+			lctx, stop = context.WithCancel(ctx)
+			slog.Info("backplane: leading; pulsing", "id", b.id)
+			h.startPulseLoops(lctx)
+			continue
+		}
+		ok, err := b.redis.renewLease(leaderKey, b.id, leaderTTL)
+		switch {
+		case err != nil:
+			stepDown("renewal failed", err)
+		case !ok:
+			stepDown("lease lost", nil)
+		default:
+			b.saveState(h)
+		}
+	}
+}
+
+// takeOver sets every channel to resume from the latest pulse known, relayed
+// or saved by the previous leader, before this hub starts pulsing.
+func (b *backplane) takeOver(h *Hub) {
+	saved := make(map[string]handoffChannel)
+	if data, err := b.redis.Get(leaderStateKey); err == nil {
+		var st handoffState
+		if err := json.Unmarshal(data, &st); err != nil {
+			slog.Warn("backplane: invalid leader state", "err", err)
+		}
+		for _, hc := range st.Channels {
+			saved[hc.Name] = hc
+		}
+	} else if !errors.Is(err, errNotFound) {
+		slog.Warn("backplane: load leader state", "err", err)
+	}
+	for _, ch := range h.channels {
+		a := ch.last.Load()
+		if hc, ok := saved[ch.name]; ok && hc.AtUnixNano != 0 && (a == nil || hc.Seq > a.seq) {
+			period := time.Duration(hc.PeriodMS) * time.Millisecond
+			if period < minChannelPeriod {
+				continue
+			}
+			ch.setPeriod(period)
+			a = &channelAnchor{seq: hc.Seq, at: time.Unix(0, hc.AtUnixNano), period: period}
+			ch.chain.resume(hc.Hash)
+		}
+		ch.resume = a
+	}
+}
+
+// saveState stores this leader's channels for whoever takes over next.
+func (b *backplane) saveState(h *Hub) {
+	data, err := json.Marshal(h.handoffState())
+	if err == nil {
+		err = b.redis.Put(leaderStateKey, data)
+	}
+	if err != nil {
+		b.warn("backplane: save leader state", err)
+	}
+}
@@ -0,0 +1,233 @@
+package hub
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"pulse/ws"
+)
+
+const (
+	defaultTenant = "default"
+	tenantHeader  = "X-Pulse-Tenant"
+
+	// maxDecimation caps how aggressively an over-quota tenant is thinned.
+	maxDecimation = 64
+	// quotaWindow is how often tenant rates are evaluated against quotas.
+	quotaWindow = time.Second
+)
+
+// tenantUsage tracks bytes sent to one tenant's connections and, when the
+// tenant has a quota, the decimation divisor currently applied to it.
+type tenantUsage struct {
+	name  string
+	quota uint64 // bytes per second; 0 means unlimited
+
+	bytes    atomic.Uint64
+	divisor  atomic.Uint64
+	lastSeen uint64 // bytes at the start of the current window
+	// usageCounters count the rest of the tenant's usage; see usage.go.
+	usageCounters
+}
+
+// admit reports whether the pulse with the given seq should be delivered to
+// this tenant under its current decimation.
+func (u *tenantUsage) admit(seq uint64) bool {
+	d := u.divisor.Load()
+	return d <= 1 || seq%d == 0
+}
+
+// accounting aggregates bytes sent per tenant and enforces quotas by
+// decimating pulses for tenants that exceed them.
+type accounting struct {
+	mu          sync.Mutex
+	tenants     map[string]*tenantUsage
+	quotas      map[string]uint64
+	windowStart time.Time
+	// ledger rolls usage up into months; nil without a store.
+	ledger *usageLedger
+}
+
+func newAccounting(quotas map[string]uint64) *accounting {
+	return &accounting{
+		tenants: make(map[string]*tenantUsage),
+		quotas:  quotas,
+	}
+}
+
+// usage returns the usage record for tenant, creating it on first use.
+func (a *accounting) usage(tenant string) *tenantUsage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u, ok := a.tenants[tenant]
+	if !ok {
+		u = &tenantUsage{name: tenant, quota: a.quotas[tenant]}
+		u.divisor.Store(1)
+		a.tenants[tenant] = u
+	}
+	return u
+}
+
+// lookup returns the usage record for tenant, nil if it has none.
+func (a *accounting) lookup(tenant string) *tenantUsage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.tenants[tenant]
+}
+
+// evaluate compares each tenant's rate over the last window to its quota,
+// doubling decimation while over quota and halving it again once usage
+// drops well below.
+func (a *accounting) evaluate(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.windowStart.IsZero() {
+		a.windowStart = now
+		return
+	}
+	elapsed := now.Sub(a.windowStart)
+	if elapsed < quotaWindow {
+		return
+	}
+	a.windowStart = now
+
+	for _, u := range a.tenants {
+		total := u.bytes.Load()
+		rate := uint64(float64(total-u.lastSeen) / elapsed.Seconds())
+		u.lastSeen = total
+		if u.quota == 0 {
+			continue
+		}
+		d := u.divisor.Load()
+		switch {
+		case rate > u.quota && d < maxDecimation:
+			u.divisor.Store(d * 2)
+		case rate < u.quota/2 && d > 1:
+			u.divisor.Store(d / 2)
+		}
+	}
+}
+
+// total returns bytes sent to all tenants.
+func (a *accounting) total() uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var sum uint64
+	for _, u := range a.tenants {
+		sum += u.bytes.Load()
+	}
+	return sum
+}
+
+type tenantReport struct {
+	Tenant     string `json:"tenant"`
+	BytesSent  uint64 `json:"bytes_sent"`
+	QuotaBPS   uint64 `json:"quota_bps,omitempty"`
+	Decimation uint64 `json:"decimation"`
+}
+
+type connReport struct {
+	RequestID string `json:"request_id"`
+	Tenant    string `json:"tenant"`
+	BytesSent uint64 `json:"bytes_sent"`
+}
+
+type bandwidthReport struct {
+	BytesSent   uint64            `json:"bytes_sent"`
+	Channels    map[string]uint64 `json:"channels"`
+	Tenants     []tenantReport    `json:"tenants"`
+	Connections []connReport      `json:"connections"`
+}
+
+func (h *Hub) bandwidth() bandwidthReport {
+	rep := bandwidthReport{
+		Tenants:     []tenantReport{},
+		Connections: []connReport{},
+	}
+
+	h.acct.mu.Lock()
+	for _, u := range h.acct.tenants {
+		b := u.bytes.Load()
+		rep.BytesSent += b
+		rep.Tenants = append(rep.Tenants, tenantReport{
+			Tenant:     u.name,
+			BytesSent:  b,
+			QuotaBPS:   u.quota,
+			Decimation: u.divisor.Load(),
+		})
+	}
+	h.acct.mu.Unlock()
+	sort.Slice(rep.Tenants, func(i, j int) bool { return rep.Tenants[i].Tenant < rep.Tenants[j].Tenant })
+	rep.Channels = make(map[string]uint64, len(h.channels))
+	for name, ch := range h.channels {
+		rep.Channels[name] = ch.bytes.Load()
+	}
+
+	h.mu.RLock()
+	for c := range h.conns {
+		if c.internal {
+			continue
+		}
+		rep.Connections = append(rep.Connections, connReport{
+			RequestID: c.id,
+			Tenant:    c.usage.name,
+			BytesSent: c.bytesSent.Load(),
+		})
+	}
+	h.mu.RUnlock()
+	sort.Slice(rep.Connections, func(i, j int) bool { return rep.Connections[i].RequestID < rep.Connections[j].RequestID })
+	return rep
+}
+
+// tenantFromRequest reads the tenant from the X-Pulse-Tenant header or the
+// tenant query parameter, falling back to the default tenant.
+func tenantFromRequest(r *http.Request) string {
+	t := r.Header.Get(tenantHeader)
+	if t == "" {
+		t = r.URL.Query().Get("tenant")
+	}
+	if !validName(t) {
+		return defaultTenant
+	}
+	return t
+}
+
+// validName accepts short identifiers made of letters, digits, '.', '_'
+// and '-'.
+func validName(s string) bool {
+	if s == "" || len(s) > 64 {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// parseQuotas parses "tenant=bytesPerSecond" pairs separated by commas.
+func parseQuotas(raw string) (map[string]uint64, error) {
+	quotas := make(map[string]uint64)
+	for _, pair := range ws.SplitHeaderList(raw) {
+		name, val, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !validName(name) {
+			return nil, fmt.Errorf("invalid quota %q", pair)
+		}
+		bps, err := strconv.ParseUint(strings.TrimSpace(val), 10, 64)
+		if err != nil || bps == 0 {
+			return nil, fmt.Errorf("invalid quota %q", pair)
+		}
+		quotas[name] = bps
+	}
+	return quotas, nil
+}
@@ -0,0 +1,190 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Beat log correlation. Clients stamp their log entries with where on the
+// beat grid they happened: the channel, its timeline's epoch (as
+// pulse-epoch-ms in sinkmeta.go defines it), the seq of the beat and the
+// phase through it (see pulseclient's Stamp). The server writes a record
+// to the store's timelines stream whenever a channel's timeline starts,
+// and GET /api/beat resolves such a stamp back to wall-clock time, after
+// the fact and across restarts of a persistent store, so "what beat did
+// this error happen on" has an answer in either direction.
+
+const streamTimelines = "timelines"
+
+// maxTimelines is how many timeline records GET /api/beat searches, newest
+// first.
+const maxTimelines = 4096
+
+// beatEpochTolerance is how far a stamp's epoch may be from its timeline's:
+// clients compute it from whole-millisecond next_ms.
+const beatEpochTolerance = 2.0
+
+// timelineRecord is the start of a channel's timeline: its epoch, the
+// first seq on it, when that beat fell on the straight grid (Unix
+// milliseconds, offset applied as in next_ms) and the period from there.
+type timelineRecord struct {
+	Channel  string  `json:"channel"`
+	EpochMS  float64 `json:"epoch_ms"`
+	FirstSeq uint64  `json:"first_seq"`
+	FirstMS  float64 `json:"first_ms"`
+	PeriodMS float64 `json:"period_ms"`
+}
+
+// at is when beat seq of the timeline falls, and phase through it.
+func (r timelineRecord) at(seq uint64, phase float64) float64 {
+	return r.FirstMS + (float64(int64(seq-r.FirstSeq))+phase)*r.PeriodMS
+}
+
+// timelineLog writes a record whenever a channel's epoch changes.
+type timelineLog struct {
+	out *appender
+
+	mu sync.Mutex
+	// epochs is each channel's current epoch, to the millisecond.
+	epochs map[string]int64
+}
+
+func newTimelineLog(out *appender) *timelineLog {
+	return &timelineLog{out: out, epochs: make(map[string]int64)}
+}
+
+// pulseEpoch is when msg's timeline began, in Unix milliseconds: its
+// epoch_ms on a channel with a tempo, else when seq 0 fell on the straight
+// grid had the period always been this one; 0 if the pulse does not tell.
+func pulseEpoch(msg PulseMessage) float64 {
+	var epoch float64
+	if raw, ok := msg.Extra["epoch_ms"]; ok {
+		_ = json.Unmarshal(raw, &epoch)
+	} else if !msg.Beat.IsZero() {
+		period := time.Duration(msg.PeriodMS) * time.Millisecond
+		epoch = float64(msg.Beat.Add(-pulseSwing(msg)-time.Duration(msg.Seq)*period).UnixMicro())/1000 + float64(msg.OffsetMS)
+	}
+	return epoch
+}
+
+// pulse records msg's timeline if it started with msg.
+func (l *timelineLog) pulse(msg PulseMessage) {
+	if l == nil {
+		return
+	}
+	epoch := pulseEpoch(msg)
+	if epoch == 0 {
+		return
+	}
+	key := int64(math.Round(epoch))
+	l.mu.Lock()
+	prev, ok := l.epochs[msg.Channel]
+	l.epochs[msg.Channel] = key
+	l.mu.Unlock()
+	if ok && prev == key {
+		return
+	}
+	rec := timelineRecord{Channel: msg.Channel, EpochMS: epoch, FirstSeq: msg.Seq, PeriodMS: float64(msg.PeriodMS)}
+	if msg.PeriodUS != 0 {
+		rec.PeriodMS = float64(msg.PeriodUS) / 1000
+	}
+	if msg.Beat.IsZero() {
+		// Relayed: the beat is next_ms a period early.
+		rec.FirstMS = float64(msg.NextMS) - rec.PeriodMS
+	} else {
+		rec.FirstMS = float64(msg.Beat.Add(-pulseSwing(msg)).UnixMicro())/1000 + float64(msg.OffsetMS)
+	}
+	b, _ := json.Marshal(rec)
+	l.out.append(streamTimelines, b)
+}
+
+// beatResponse answers GET /api/beat: when beat Seq of the timeline that
+// began at EpochMS fell, and Phase through it, as AtMS. Predicted is set
+// for a beat still to come on the current timeline.
+type beatResponse struct {
+	Channel   string  `json:"channel"`
+	EpochMS   float64 `json:"epoch_ms"`
+	Seq       uint64  `json:"seq"`
+	Phase     float64 `json:"phase,omitempty"`
+	AtMS      float64 `json:"at_ms"`
+	PeriodMS  float64 `json:"period_ms"`
+	FirstSeq  uint64  `json:"first_seq"`
+	Predicted bool    `json:"predicted,omitempty"`
+}
+
+// beatHandler serves GET /api/beat?channel=C&epoch_ms=E&seq=N&phase=P,
+// channel defaulting to the default channel and phase to 0.
+func beatHandler(h *Hub, store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		channel := q.Get("channel")
+		if channel == "" {
+			channel = defaultChannel
+		}
+		epoch, err1 := strconv.ParseFloat(q.Get("epoch_ms"), 64)
+		seq, err2 := strconv.ParseUint(q.Get("seq"), 10, 64)
+		var phase float64
+		var err3 error
+		if raw := q.Get("phase"); raw != "" {
+			phase, err3 = strconv.ParseFloat(raw, 64)
+		}
+		switch {
+		case err1 != nil || math.IsNaN(epoch) || math.IsInf(epoch, 0):
+			http.Error(w, "epoch_ms must be Unix milliseconds", http.StatusBadRequest)
+			return
+		case err2 != nil:
+			http.Error(w, "seq must be a pulse's seq", http.StatusBadRequest)
+			return
+		case err3 != nil || phase < 0 || phase >= 1:
+			http.Error(w, "phase must be in [0, 1)", http.StatusBadRequest)
+			return
+		}
+		recs, err := store.Tail(streamTimelines, maxTimelines)
+		if err != nil {
+			slog.Error("beat: read timelines", "err", err)
+			http.Error(w, "timelines unavailable", http.StatusInternalServerError)
+			return
+		}
+		var tl []timelineRecord
+		for _, raw := range recs {
+			var rec timelineRecord
+			if json.Unmarshal(raw, &rec) == nil && rec.Channel == channel {
+				tl = append(tl, rec)
+			}
+		}
+		// The nearest epoch wins, the latest of equals; the timeline
+		// after it bounds it if seq went on counting.
+		best := -1
+		for i, rec := range tl {
+			if d := math.Abs(rec.EpochMS - epoch); d <= beatEpochTolerance && seq >= rec.FirstSeq && (best < 0 || d <= math.Abs(tl[best].EpochMS-epoch)) {
+				best = i
+			}
+		}
+		if best < 0 {
+			http.Error(w, fmt.Sprintf("no timeline of channel %q began at %.3f with seq %d on it", channel, epoch, seq), http.StatusNotFound)
+			return
+		}
+		rec := tl[best]
+		if best+1 < len(tl) {
+			if next := tl[best+1]; next.FirstSeq > rec.FirstSeq && seq >= next.FirstSeq {
+				http.Error(w, fmt.Sprintf("that timeline of channel %q ended before seq %d, at seq %d", channel, seq, next.FirstSeq-1), http.StatusNotFound)
+				return
+			}
+		}
+		resp := beatResponse{Channel: channel, EpochMS: rec.EpochMS, Seq: seq, Phase: phase, AtMS: rec.at(seq, phase), PeriodMS: rec.PeriodMS, FirstSeq: rec.FirstSeq}
+		if best == len(tl)-1 {
+			if ch := h.channel(channel); ch != nil {
+				if a := ch.last.Load(); a != nil && seq > a.seq {
+					resp.Predicted = true
+				}
+			}
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
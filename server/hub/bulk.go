@@ -0,0 +1,114 @@
+package hub
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"pulse/ws"
+)
+
+// Bulk admin actions.
+const (
+	bulkKick     = "kick"
+	bulkOffset   = "offset"
+	bulkRedirect = "redirect"
+)
+
+// bulkBody is the request body of POST /admin/clients/bulk.
+type bulkBody struct {
+	Action string `json:"action"`
+	Filter string `json:"filter"`
+	// OffsetMS is the per-client offset for the offset action; omitting it
+	// clears the override so the clients follow the global offset again.
+	OffsetMS *int64 `json:"offset_ms,omitempty"`
+	// URL is where redirected clients should reconnect.
+	URL string `json:"url,omitempty"`
+}
+
+// bulkParams is the action-specific part of a bulkBody, as audited.
+type bulkParams struct {
+	OffsetMS *int64 `json:"offset_ms,omitempty"`
+	URL      string `json:"url,omitempty"`
+}
+
+type bulkResult struct {
+	Action  string   `json:"action"`
+	Matched int      `json:"matched"`
+	Clients []string `json:"clients"`
+}
+
+// redirectMessage asks a client to reconnect to another server. It is sent
+// right before the connection is closed with 1001 (going away).
+type redirectMessage struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+func (b bulkBody) validate() error {
+	switch b.Action {
+	case bulkKick:
+	case bulkOffset:
+		if b.OffsetMS != nil && !validOffsetMS(*b.OffsetMS) {
+			return fmt.Errorf("offset_ms out of range")
+		}
+	case bulkRedirect:
+		if b.URL == "" {
+			return fmt.Errorf("redirect needs a url")
+		}
+	default:
+		return fmt.Errorf("action must be kick, offset or redirect")
+	}
+	return nil
+}
+
+// bulk applies body to every client matching f. Matching and the state
+// change happen under the hub lock, so the action covers exactly the clients
+// that matched at one instant; clients that connect meanwhile are not
+// affected. Kicked and redirected clients are detached from the hub under the
+// lock and notified after it is released.
+func (h *Hub) bulk(body bulkBody, f clientFilter, lagThreshold time.Duration) []string {
+	now := time.Now()
+	var matched []*Conn
+
+	h.mu.Lock()
+	for c := range h.conns {
+		if c.internal || !f.match(c.info(lagThreshold), now) {
+			continue
+		}
+		matched = append(matched, c)
+		switch body.Action {
+		case bulkOffset:
+			if body.OffsetMS == nil {
+				c.hasOffset.Store(false)
+			} else {
+				c.offsetMS.Store(*body.OffsetMS)
+				c.hasOffset.Store(true)
+			}
+		case bulkKick, bulkRedirect:
+			delete(h.conns, c)
+		}
+	}
+	h.mu.Unlock()
+
+	ids := make([]string, 0, len(matched))
+	for _, c := range matched {
+		ids = append(ids, c.id)
+		switch body.Action {
+		case bulkKick:
+			c.setCause(causeServer)
+			_ = c.writeClose(ws.ClosePolicyViolation, "disconnected by admin")
+			_ = c.Close()
+		case bulkRedirect:
+			if c.proto != protoLegacy {
+				if err := c.WriteJSON(redirectMessage{Type: "redirect", URL: body.URL}); err != nil {
+					slog.Warn("redirect", "request_id", c.id, "err", err)
+				}
+			}
+			c.setCause(causeServer)
+			_ = c.writeClose(ws.CloseGoingAway, "redirect")
+			_ = c.Close()
+		}
+	}
+	return ids
+}
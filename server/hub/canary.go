@@ -0,0 +1,183 @@
+package hub
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// canaryWindow is the number of recent samples kept for percentiles.
+const canaryWindow = 256
+
+// canarySubscriber is an in-process loopback subscriber. It sits in the hub
+// like any other connection and measures the time from a pulse's scheduled
+// emission to the moment its encoded frame arrives, so the number covers
+// scheduling, encoding and fan-out rather than the scheduler alone.
+type canarySubscriber struct {
+	mu        sync.Mutex
+	scheduled map[uint64]time.Time
+	arrived   map[uint64]time.Time
+	samples   []time.Duration
+	last      time.Duration
+	received  uint64
+	missed    uint64
+}
+
+type canaryStatus struct {
+	LatencyMS float64 `json:"latency_ms"`
+	P50MS     float64 `json:"p50_ms"`
+	P99MS     float64 `json:"p99_ms"`
+	MaxMS     float64 `json:"max_ms"`
+	Received  uint64  `json:"received"`
+	Missed    uint64  `json:"missed"`
+}
+
+func startCanary(h *Hub) *canarySubscriber {
+	server, client := net.Pipe()
+	c := &canarySubscriber{
+		scheduled: make(map[uint64]time.Time),
+		arrived:   make(map[uint64]time.Time),
+	}
+	h.add(&Conn{conn: server, proto: protoJSON, internal: true})
+
+	go func() {
+		defer client.Close()
+		r := bufio.NewReader(client)
+		for {
+			payload, err := readServerFrame(r)
+			if err != nil {
+				if err != io.EOF && err != io.ErrClosedPipe {
+					slog.Warn("canary", "err", err)
+				}
+				return
+			}
+			at := time.Now()
+			var msg PulseMessage
+			if err := json.Unmarshal(payload, &msg); err != nil || msg.Type != "pulse" {
+				continue
+			}
+			c.arrive(msg.Seq, at)
+		}
+	}()
+	return c
+}
+
+// observe is called by the pulse loop once a broadcast has finished. The
+// canary may see the frame before or after that, so whichever side comes
+// second completes the sample.
+func (c *canarySubscriber) observe(o PulseObservation) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if at, ok := c.arrived[o.Seq]; ok {
+		delete(c.arrived, o.Seq)
+		c.addSample(at.Sub(o.Scheduled))
+	} else {
+		c.scheduled[o.Seq] = o.Scheduled
+	}
+
+	// Anything still waiting from before the previous pulse was lost.
+	for seq := range c.scheduled {
+		if seq+1 < o.Seq {
+			delete(c.scheduled, seq)
+			c.missed++
+		}
+	}
+	for seq := range c.arrived {
+		if seq+1 < o.Seq {
+			delete(c.arrived, seq)
+		}
+	}
+}
+
+func (c *canarySubscriber) arrive(seq uint64, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if scheduled, ok := c.scheduled[seq]; ok {
+		delete(c.scheduled, seq)
+		c.addSample(at.Sub(scheduled))
+		return
+	}
+	c.arrived[seq] = at
+}
+
+func (c *canarySubscriber) addSample(d time.Duration) {
+	c.last = d
+	c.received++
+	if len(c.samples) == canaryWindow {
+		copy(c.samples, c.samples[1:])
+		c.samples = c.samples[:canaryWindow-1]
+	}
+	c.samples = append(c.samples, d)
+}
+
+func (c *canarySubscriber) status() *canaryStatus {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st := &canaryStatus{
+		LatencyMS: msFloat(c.last),
+		Received:  c.received,
+		Missed:    c.missed,
+	}
+	if len(c.samples) > 0 {
+		sorted := append([]time.Duration(nil), c.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		st.P50MS = msFloat(percentile(sorted, 0.50))
+		st.P99MS = msFloat(percentile(sorted, 0.99))
+		st.MaxMS = msFloat(sorted[len(sorted)-1])
+	}
+	return st
+}
+
+// percentile expects sorted input.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	idx := int(p * float64(len(sorted)-1))
+	return sorted[idx]
+}
+
+// readServerFrame reads one unmasked, unfragmented frame as written by
+// Conn and returns its payload.
+func readServerFrame(r *bufio.Reader) ([]byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[1]&0x80 != 0 {
+		return nil, fmt.Errorf("unexpected masked server frame")
+	}
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
@@ -0,0 +1,252 @@
+package hub
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"pulse/ws"
+)
+
+// Client capabilities. Clients say what they are and what they understand,
+// on connecting with the X-Pulse-Client and X-Pulse-Capabilities headers
+// (or the client and caps query parameters, for browsers), or at any time
+// over a WebSocket:
+//
+//	{"type":"capabilities","client":"pulse-js/2.1.0","caps":["send_ahead","hash_chain"]}
+//
+// A capability is an experimental feature's name, or any other token a
+// client and its operators agree on. GET /admin/capabilities breaks the
+// connected clients down by codec, client and capability, and POST
+// /admin/capabilities/check works out whom turning an experimental feature
+// on or off would break before PULSE_FEATURES is changed: turning it on, every client that did
+// not announce it; turning it off, every client that did. When those are
+// PULSE_COMPAT_WARN_PERCENT or more of the clients it would reach, the
+// check is logged as a warning and posted to the alert webhook as a
+// feature.incompatible event.
+const (
+	maxCaps       = 32
+	maxClientName = 64
+	// defaultCompatWarnPercent is PULSE_COMPAT_WARN_PERCENT's default.
+	defaultCompatWarnPercent = 5
+	// unannounced stands for clients that sent no client name.
+	unannounced = "unknown"
+)
+
+// clientCaps is what a client announced.
+type clientCaps struct {
+	client string
+	// caps is sorted and without duplicates.
+	caps []string
+}
+
+// capabilitiesMessage is a client's announcement, replacing any earlier.
+type capabilitiesMessage struct {
+	Type   string   `json:"type"`
+	Client string   `json:"client,omitempty"`
+	Caps   []string `json:"caps"`
+}
+
+// parseCaps validates an announcement.
+func parseCaps(client string, caps []string) (*clientCaps, error) {
+	client = strings.TrimSpace(client)
+	switch {
+	case len(client) > maxClientName:
+		return nil, fmt.Errorf("client must be at most %d bytes", maxClientName)
+	case len(caps) > maxCaps:
+		return nil, fmt.Errorf("give at most %d caps", maxCaps)
+	}
+	out := &clientCaps{client: client, caps: make([]string, 0, len(caps))}
+	for _, c := range caps {
+		c = strings.TrimSpace(c)
+		if !validName(c) {
+			return nil, fmt.Errorf("cap %q must be 1 to 64 letters, digits, '.', '_' or '-'", c)
+		}
+		out.caps = append(out.caps, c)
+	}
+	sort.Strings(out.caps)
+	out.caps = compactStrings(out.caps)
+	return out, nil
+}
+
+// capsFromRequest takes the announcement of an upgrade or subscription
+// request; nil if it has none or an invalid one, which is logged.
+func capsFromRequest(r *http.Request) *clientCaps {
+	client := r.Header.Get("X-Pulse-Client")
+	if client == "" {
+		client = r.URL.Query().Get("client")
+	}
+	raw := r.Header.Get("X-Pulse-Capabilities")
+	if raw == "" {
+		raw = r.URL.Query().Get("caps")
+	}
+	if client == "" && raw == "" {
+		return nil
+	}
+	caps, err := parseCaps(client, ws.SplitHeaderList(raw))
+	if err != nil {
+		slog.Debug("ignoring client capabilities", "request_id", requestIDFrom(r.Context()), "err", err)
+		return nil
+	}
+	return caps
+}
+
+// has reports whether the client announced cap.
+func (cc *clientCaps) has(cap string) bool {
+	if cc == nil {
+		return false
+	}
+	i := sort.SearchStrings(cc.caps, cap)
+	return i < len(cc.caps) && cc.caps[i] == cap
+}
+
+// capabilityBreakdown is GET /admin/capabilities: how many connected
+// clients use each codec (see connCodec), run each client and announced each
+// capability, and how many announced none.
+type capabilityBreakdown struct {
+	Clients      int            `json:"clients"`
+	Codecs       map[string]int `json:"codecs"`
+	ClientNames  map[string]int `json:"client_names"`
+	Capabilities map[string]int `json:"capabilities"`
+	Unannounced  int            `json:"unannounced"`
+}
+
+// clientConns returns the connected clients, internal subscribers left
+// out.
+func (h *Hub) clientConns() []*Conn {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	out := make([]*Conn, 0, len(h.conns))
+	for c := range h.conns {
+		if !c.internal {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func (h *Hub) capabilityBreakdown() capabilityBreakdown {
+	b := capabilityBreakdown{Codecs: map[string]int{}, ClientNames: map[string]int{}, Capabilities: map[string]int{}}
+	for _, c := range h.clientConns() {
+		b.Clients++
+		b.Codecs[connCodec(c)]++
+		cc := c.caps.Load()
+		if cc == nil {
+			b.Unannounced++
+			b.ClientNames[unannounced]++
+			continue
+		}
+		name := cc.client
+		if name == "" {
+			name = unannounced
+		}
+		b.ClientNames[name]++
+		for _, cap := range cc.caps {
+			b.Capabilities[cap]++
+		}
+	}
+	return b
+}
+
+// compatWarner posts the checks that would break too many clients.
+type compatWarner struct {
+	percent float64
+	alerts  *alerter
+}
+
+// compatWarnerFromEnv reads PULSE_COMPAT_WARN_PERCENT; alerts sends the
+// events on.
+func compatWarnerFromEnv(alerts *alerter) *compatWarner {
+	return &compatWarner{percent: float64(envInt("PULSE_COMPAT_WARN_PERCENT", defaultCompatWarnPercent)), alerts: alerts}
+}
+
+// compatBody is POST /admin/capabilities/check:
+// {"feature":"send_ahead","channel":"song","enable":true}. Channel
+// defaults to every channel and Enable to true.
+type compatBody struct {
+	Feature string `json:"feature"`
+	Channel string `json:"channel,omitempty"`
+	Enable  *bool  `json:"enable,omitempty"`
+}
+
+// compatReport is what a feature toggle would do to the connected clients
+// it reaches: Ready ones are fine, Unaware ones announced capabilities but
+// not this one, Unknown ones announced nothing, and Relying ones announced
+// a feature that would be turned off. Percent of them would break; Warn is
+// set when that reaches ThresholdPercent.
+type compatReport struct {
+	Event            string    `json:"event,omitempty"`
+	Feature          string    `json:"feature"`
+	Channel          string    `json:"channel,omitempty"`
+	Enable           bool      `json:"enable"`
+	Clients          int       `json:"clients"`
+	Ready            int       `json:"ready"`
+	Unaware          int       `json:"unaware,omitempty"`
+	Unknown          int       `json:"unknown,omitempty"`
+	Relying          int       `json:"relying,omitempty"`
+	Percent          float64   `json:"percent"`
+	ThresholdPercent float64   `json:"threshold_percent"`
+	Warn             bool      `json:"warn"`
+	At               time.Time `json:"at"`
+}
+
+// checkCompat works out what body's toggle would do and warns if it would
+// break too many clients.
+func (h *Hub) checkCompat(body compatBody) (compatReport, error) {
+	r := compatReport{Feature: body.Feature, Channel: body.Channel, Enable: body.Enable == nil || *body.Enable, ThresholdPercent: defaultCompatWarnPercent, At: time.Now()}
+	if h.compat != nil {
+		r.ThresholdPercent = h.compat.percent
+	}
+	if _, ok := experimentalFeatures[body.Feature]; !ok {
+		return r, fmt.Errorf("unknown feature %q (want one of %s)", body.Feature, strings.Join(featureNames(), ", "))
+	}
+	if body.Channel != "" && h.channel(body.Channel) == nil {
+		return r, fmt.Errorf("%w: %q", errNoChannel, body.Channel)
+	}
+	for _, c := range h.clientConns() {
+		if body.Channel != "" && !c.receives(body.Channel) {
+			continue
+		}
+		r.Clients++
+		cc := c.caps.Load()
+		switch {
+		case !r.Enable && cc.has(body.Feature):
+			r.Relying++
+		case !r.Enable, cc.has(body.Feature):
+			r.Ready++
+		case cc == nil:
+			r.Unknown++
+		default:
+			r.Unaware++
+		}
+	}
+	if r.Clients > 0 {
+		r.Percent = math.Round(float64(r.Clients-r.Ready)*1000/float64(r.Clients)) / 10
+	}
+	if r.Clients > r.Ready && r.Percent >= r.ThresholdPercent {
+		r.Warn = true
+		slog.Warn("feature toggle would break clients", "feature", r.Feature, "channel", r.Channel, "enable", r.Enable,
+			"clients", r.Clients, "unaware", r.Unaware, "unknown", r.Unknown, "relying", r.Relying, "percent", r.Percent)
+		if h.compat != nil {
+			ev := r
+			ev.Event = "feature.incompatible"
+			h.compat.alerts.post(ev.Event, ev)
+		}
+	}
+	return r, nil
+}
+
+// compactStrings drops adjacent duplicates from sorted s.
+func compactStrings(s []string) []string {
+	out := s[:0]
+	for i, v := range s {
+		if i == 0 || v != s[i-1] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,420 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"pulse/ws"
+)
+
+const (
+	// minChannelPeriod bounds how fast a channel may pulse; below this the
+	// fan-out of one pulse would run into the next.
+	minChannelPeriod = 5 * time.Millisecond
+	// maxChannelPeriod bounds a period set at runtime; clients would wait
+	// longer than that for the pulse announcing the next change.
+	maxChannelPeriod = time.Hour
+)
+
+// pulseChannel is one named pulse stream with its own period. Each channel
+// runs its own pulse loop and seq; a client receives one channel, chosen
+// by the upgrade path (/ws/{channel}) or a subscribe message, except relay
+// connections, which receive all of them.
+type pulseChannel struct {
+	name string
+	// period may be changed at runtime via POST /admin/period.
+	period atomic.Int64
+	// ramp is a pending tempo ramp, taken over by the pulse loop; see
+	// ramp.go.
+	ramp atomic.Pointer[tempoRamp]
+	// align is a pending move of the grid onto external beats, taken over
+	// by the pulse loop; see link.go.
+	align atomic.Pointer[gridAlign]
+
+	// bytes counts everything written to the channel's clients.
+	bytes atomic.Uint64
+
+	// transport pauses and resumes the channel; see transport.go.
+	transport transport
+
+	// features are the experimental features on for the channel, fixed at
+	// startup; see features.go.
+	features map[string]bool
+	// tempo, if set, makes the channel's pulses beats in bars; see
+	// tempo.go.
+	tempo *tempo
+	// pattern, if set, moves the channel's pulses off the straight grid
+	// in a repeating sequence of steps, fixed at startup; see pattern.go.
+	pattern *pulsePattern
+	// preroll is how many counts lead into the channel's pulses whenever
+	// they start, fixed at startup; see preroll.go.
+	preroll int
+
+	// last is the most recent pulse, handed to a new process on upgrade;
+	// resume is the one handed over from the old process, if any.
+	last   atomic.Pointer[channelAnchor]
+	resume *channelAnchor
+
+	// chain links the channel's pulses when hash_chain is on.
+	chain hashChain
+
+	// recent are the latest pulses, for backfill; see backfill.go.
+	recent pulseRing
+
+	// simulcast are the slower rates the channel is offered at, by rate,
+	// fixed at startup; see simulcast.go.
+	simulcast []*simulcastView
+
+	// retiring is the channel's announced end, and retired is set once it
+	// has come; see retire.go.
+	retiring atomic.Pointer[retirement]
+	retired  atomic.Bool
+	// ended is the end message once the channel's pulses have stopped for
+	// good; see end.go.
+	ended atomic.Pointer[endMessage]
+
+	// domain is the clock domain the channel is bound to, fixed at startup;
+	// nil for a free channel. See clockdomain.go.
+	domain *clockDomain
+}
+
+// channelAnchor pins a channel's grid: pulse seq was scheduled at at, and
+// the next is due one period later.
+type channelAnchor struct {
+	seq    uint64
+	at     time.Time
+	period time.Duration
+}
+
+func newPulseChannel(name string, period time.Duration) *pulseChannel {
+	ch := &pulseChannel{name: name, features: make(map[string]bool)}
+	ch.period.Store(int64(period))
+	return ch
+}
+
+// Period is the channel's current period.
+func (ch *pulseChannel) Period() time.Duration {
+	return time.Duration(ch.period.Load())
+}
+
+// setPeriod retunes the channel. The pulse already announced by next_ms
+// still goes out on time; it carries the new period and period_changed, and
+// the pulses after it follow the new period.
+func (ch *pulseChannel) setPeriod(period time.Duration) {
+	ch.period.Store(int64(period))
+}
+
+// parseChannels returns the default channel at period plus those named in
+// raw, comma-separated "name=period_ms" entries such as
+// "seconds=1000,tick=20". A period may also be a tempo ending in "bpm",
+// e.g. "song=128bpm" or "waltz=3/4@90bpm"; see tempo.go.
+func parseChannels(raw string, period time.Duration) (map[string]*pulseChannel, error) {
+	chans := map[string]*pulseChannel{
+		defaultChannel: newPulseChannel(defaultChannel, period),
+	}
+	for _, entry := range ws.SplitHeaderList(raw) {
+		name, ms, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !validName(name) {
+			return nil, fmt.Errorf("invalid channel %q", entry)
+		}
+		if _, dup := chans[name]; dup {
+			return nil, fmt.Errorf("channel %q defined twice", name)
+		}
+		if strings.HasSuffix(strings.TrimSpace(ms), "bpm") {
+			p, t, err := parseBPM(ms)
+			if err != nil {
+				return nil, fmt.Errorf("channel %q: %w", name, err)
+			}
+			chans[name] = newPulseChannel(name, p)
+			chans[name].tempo = t
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(ms), 10, 64)
+		p := time.Duration(n) * time.Millisecond
+		if err != nil || p < minChannelPeriod {
+			return nil, fmt.Errorf("channel %q: period must be at least %dms", name, minChannelPeriod.Milliseconds())
+		}
+		chans[name] = newPulseChannel(name, p)
+	}
+	return chans, nil
+}
+
+// channel returns the channel called name, or nil if there is none or it
+// has been retired.
+func (h *Hub) channel(name string) *pulseChannel {
+	if ch := h.channels[name]; ch != nil && !ch.retired.Load() {
+		return ch
+	}
+	return nil
+}
+
+// drivenBy names what drives ch's pulses when it is not this hub's own
+// pulse loop, whose period and transport are then not for admins to
+// change: the tick source for the default channel, a replay, or on a
+// backplane edge or a replica that does not lead, the backplane. It
+// returns "" otherwise.
+func (h *Hub) drivenBy(ch *pulseChannel) string {
+	switch {
+	case h.replay != nil:
+		return "replay"
+	case h.backplane.following():
+		return "backplane"
+	case h.upstream != nil:
+		return "upstream"
+	case tickSource != nil && ch.name == defaultChannel:
+		return "tick source"
+	}
+	return ""
+}
+
+// channelNames lists every channel not retired, sorted.
+func (h *Hub) channelNames() []string {
+	names := make([]string, 0, len(h.channels))
+	for name, ch := range h.channels {
+		if !ch.retired.Load() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// channelName is the channel c receives; connections that never chose one
+// (internal subscribers) are on the default channel.
+func (c *Conn) Channel() string {
+	if ch := c.ch.Load(); ch != nil {
+		return ch.name
+	}
+	return defaultChannel
+}
+
+// receives reports whether c gets the pulses of channel.
+func (c *Conn) receives(channel string) bool {
+	if c.proto == protoRelay || c.Channel() == channel {
+		return true
+	}
+	if also := c.also.Load(); also != nil {
+		_, ok := (*also)[channel]
+		return ok
+	}
+	return false
+}
+
+// rateFor is the simulcast rate c receives channel at, at least 1.
+func (c *Conn) rateFor(channel string) uint64 {
+	if also := c.also.Load(); also != nil && channel != c.Channel() {
+		if rate, ok := (*also)[channel]; ok {
+			return max(rate, 1)
+		}
+	}
+	return max(c.rate.Load(), 1)
+}
+
+// pulseProto is the subprotocol whose encoding c's pulses are sent in.
+func (c *Conn) pulseProto() string {
+	if f := c.format.Load(); f != nil {
+		return *f
+	}
+	return c.proto
+}
+
+// Subscriptions. A client moves to another channel with
+//
+//	{"type":"subscribe","channel":"tick"}
+//
+// and the server answers with a fresh hello carrying the channel's period;
+// pulses of the new channel follow, and those of any other channel stop.
+// With "add":true the channel is received as well instead, so one socket
+// carries several; each of their pulses then holds its "channel". The
+// channels stay the client's until
+//
+//	{"type":"unsubscribe","channel":"tick"}
+//
+// removes one; the channel the hello names is replaced by the first of the
+// rest, and the last one cannot be removed. {"type":"set_format",
+// "format":"binary"} switches the encoding of the pulses (json, binary or
+// tagged) without reconnecting. add, unsubscribe and set_format are
+// answered with a subscriptions message listing what the client receives
+// now, and any request that fails with one carrying its error.
+
+// subscribeMessage asks for a channel. Rate picks one of the channel's
+// simulcast rates; zero means every pulse.
+type subscribeMessage struct {
+	Type    string `json:"type"`
+	Channel string `json:"channel"`
+	Rate    uint64 `json:"rate,omitempty"`
+	Add     bool   `json:"add,omitempty"`
+}
+
+type unsubscribeMessage struct {
+	Type    string `json:"type"`
+	Channel string `json:"channel"`
+}
+
+type setFormatMessage struct {
+	Type   string `json:"type"`
+	Format string `json:"format"`
+}
+
+// subscriptionsMessage tells a client what it receives.
+type subscriptionsMessage struct {
+	Type     string         `json:"type"`
+	Format   string         `json:"format"`
+	Channels []subscription `json:"channels"`
+	// Every is the divisor set with decimate; see decimate.go.
+	Every uint64 `json:"every,omitempty"`
+	// Precision is "us" once set with set_precision; see precision.go.
+	Precision string `json:"precision,omitempty"`
+	// Error is why the request it answers failed; nothing changed.
+	Error string `json:"error,omitempty"`
+}
+
+type subscription struct {
+	Channel  string `json:"channel"`
+	PeriodMS int64  `json:"period_ms"`
+	Rate     uint64 `json:"rate,omitempty"`
+	Paused   bool   `json:"paused,omitempty"`
+	// FinalSeq is the channel's last pulse when it is being retired.
+	FinalSeq uint64 `json:"final_seq,omitempty"`
+}
+
+// pulseFormats maps set_format's formats to the subprotocols encoding
+// pulses that way.
+var pulseFormats = map[string]string{"json": protoJSON, "binary": protoBinary, "tagged": protoTagged}
+
+// subscribe moves c to the channel called name, at rate, or with add
+// receives it as well.
+func (h *Hub) subscribe(c *Conn, name string, rate uint64, add bool) error {
+	ch := h.channel(name)
+	if ch == nil {
+		return fmt.Errorf("unknown channel %q", name)
+	}
+	if c.proto == protoRelay {
+		return fmt.Errorf("relay connections receive every channel")
+	}
+	rate = max(rate, 1)
+	if !ch.offers(rate) {
+		return fmt.Errorf("channel %q has no rate %d", name, rate)
+	}
+	if add && name != c.Channel() {
+		also := map[string]uint64{name: rate}
+		if old := c.also.Load(); old != nil {
+			maps.Copy(also, *old)
+			also[name] = rate
+		}
+		c.also.Store(&also)
+		return c.WriteJSON(h.subscriptions(c, ""))
+	}
+	c.ch.Store(ch)
+	c.rate.Store(rate)
+	if add {
+		return c.WriteJSON(h.subscriptions(c, ""))
+	}
+	c.also.Store(nil)
+	return h.greet(c)
+}
+
+// unsubscribe stops c receiving the channel called name.
+func (h *Hub) unsubscribe(c *Conn, name string) error {
+	old := c.also.Load()
+	if old == nil || len(*old) == 0 {
+		if name == c.Channel() {
+			return fmt.Errorf("channel %q is the connection's last", name)
+		}
+		return fmt.Errorf("not subscribed to %q", name)
+	}
+	also := maps.Clone(*old)
+	if name == c.Channel() {
+		// The first of the rest takes its place.
+		next := sortedKeys(also)[0]
+		c.ch.Store(h.channel(next))
+		c.rate.Store(also[next])
+		delete(also, next)
+	} else if _, ok := also[name]; !ok {
+		return fmt.Errorf("not subscribed to %q", name)
+	} else {
+		delete(also, name)
+	}
+	if len(also) == 0 {
+		c.also.Store(nil)
+	} else {
+		c.also.Store(&also)
+	}
+	return c.WriteJSON(h.subscriptions(c, ""))
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelPulse adds the pulse's channel to m, for a connection receiving
+// several.
+func labelPulse(m PulseMessage) PulseMessage {
+	extra := make(map[string]json.RawMessage, len(m.Extra)+1)
+	maps.Copy(extra, m.Extra)
+	extra["channel"], _ = json.Marshal(m.Channel)
+	m.Extra = extra
+	return m
+}
+
+// setFormat switches the encoding of c's pulses to format.
+func (h *Hub) setFormat(c *Conn, format string) error {
+	proto, ok := pulseFormats[format]
+	switch {
+	case !ok:
+		return fmt.Errorf("unknown format %q, want json, binary or tagged", format)
+	case c.proto == protoRelay:
+		return fmt.Errorf("relay connections receive relay envelopes")
+	case c.sse && proto != protoJSON:
+		return fmt.Errorf("Server-Sent Events carry text only")
+	}
+	c.format.Store(&proto)
+	return c.WriteJSON(h.subscriptions(c, ""))
+}
+
+// subscriptions describes what c receives, answering a request that
+// failed with errMsg if it is set.
+func (h *Hub) subscriptions(c *Conn, errMsg string) subscriptionsMessage {
+	m := subscriptionsMessage{Type: "subscriptions", Error: errMsg}
+	if every := c.every.Load(); every > 1 {
+		m.Every = every
+	}
+	m.Precision = c.precision()
+	for name, f := range pulseFormats {
+		if f == c.pulseProto() {
+			m.Format = name
+		}
+	}
+	names := []string{c.Channel()}
+	if also := c.also.Load(); also != nil {
+		names = append(names, sortedKeys(*also)...)
+	}
+	for _, name := range names {
+		ch := h.channel(name)
+		if ch == nil {
+			continue
+		}
+		s := subscription{Channel: name, PeriodMS: ch.Period().Milliseconds(), Paused: ch.transport.isPaused()}
+		if r := ch.retiring.Load(); r != nil {
+			s.FinalSeq = r.finalSeq
+		}
+		if rate := c.rateFor(name); rate > 1 {
+			s.Rate = rate
+			s.PeriodMS *= int64(rate)
+		}
+		m.Channels = append(m.Channels, s)
+	}
+	return m
+}
@@ -0,0 +1,262 @@
+package hub
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"pulse/ws"
+)
+
+// jwtLeeway is how far exp and nbf may be off, for clock skew between the
+// token issuer and us.
+const jwtLeeway = 30 * time.Second
+
+// clientAuth checks the credentials of WebSocket and SSE subscribers, so
+// the broadcast endpoints need not be open to the internet. A client
+// presents a static token or a JWT, as a bearer token or, for browsers,
+// which cannot set headers on a WebSocket, the access_token query
+// parameter. Admin API credentials are accepted as well. With nothing
+// configured every client is let in anonymously.
+type clientAuth struct {
+	// tokens maps static tokens to the subject they stand for.
+	tokens map[string]string
+	jwt    *jwtVerifier
+}
+
+// jwtVerifier checks JWTs signed with an HMAC secret (HS256) or the
+// private half of an RSA (RS256) or P-256 (ES256) public key.
+type jwtVerifier struct {
+	secret   []byte
+	key      crypto.PublicKey
+	issuer   string
+	audience string
+}
+
+// loadClientAuth reads PULSE_CLIENT_TOKENS ("subject=token" entries),
+// PULSE_JWT_SECRET or PULSE_JWT_PUBLIC_KEY_FILE, PULSE_JWT_ISSUER and
+// PULSE_JWT_AUDIENCE.
+func loadClientAuth() (*clientAuth, error) {
+	a := &clientAuth{}
+	for _, entry := range ws.SplitHeaderList(os.Getenv("PULSE_CLIENT_TOKENS")) {
+		subject, token, ok := strings.Cut(entry, "=")
+		subject, token = strings.TrimSpace(subject), strings.TrimSpace(token)
+		if !ok || subject == "" || token == "" {
+			return nil, fmt.Errorf("PULSE_CLIENT_TOKENS: want subject=token, got %q", entry)
+		}
+		if a.tokens == nil {
+			a.tokens = make(map[string]string)
+		}
+		a.tokens[token] = subject
+	}
+	secret := os.Getenv("PULSE_JWT_SECRET")
+	keyFile := strings.TrimSpace(os.Getenv("PULSE_JWT_PUBLIC_KEY_FILE"))
+	if secret != "" && keyFile != "" {
+		return nil, errors.New("set PULSE_JWT_SECRET or PULSE_JWT_PUBLIC_KEY_FILE, not both")
+	}
+	if secret == "" && keyFile == "" {
+		return a, nil
+	}
+	a.jwt = &jwtVerifier{
+		secret:   []byte(secret),
+		issuer:   strings.TrimSpace(os.Getenv("PULSE_JWT_ISSUER")),
+		audience: strings.TrimSpace(os.Getenv("PULSE_JWT_AUDIENCE")),
+	}
+	if keyFile != "" {
+		key, err := readPublicKey(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("PULSE_JWT_PUBLIC_KEY_FILE: %w", err)
+		}
+		a.jwt.key = key
+	}
+	return a, nil
+}
+
+// readPublicKey reads a PEM "PUBLIC KEY" holding an RSA or P-256 key.
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return k, nil
+	case *ecdsa.PublicKey:
+		if k.Curve.Params().Name == "P-256" {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported key type %T; want RSA or P-256", key)
+}
+
+// enabled reports whether clients must authenticate.
+func (a *clientAuth) enabled() bool {
+	return a != nil && (len(a.tokens) > 0 || a.jwt != nil)
+}
+
+// authenticate returns the subject r authenticates as; empty, with a nil
+// error, when no credentials are required.
+func (a *clientAuth) authenticate(r *http.Request, admin *adminAuth) (string, error) {
+	if !a.enabled() {
+		return "", nil
+	}
+	if rl, err := admin.allow(r); err == nil {
+		return "admin:" + rl.String(), nil
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("access_token")
+	}
+	if token == "" {
+		return "", errors.New("no credentials")
+	}
+	for t, subject := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return subject, nil
+		}
+	}
+	if a.jwt != nil && strings.Count(token, ".") == 2 {
+		return a.jwt.verify(token, time.Now())
+	}
+	return "", errors.New("invalid token")
+}
+
+// verify checks a compact JWT and returns its sub claim.
+func (v *jwtVerifier) verify(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", fmt.Errorf("jwt header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("jwt signature: invalid encoding")
+	}
+	if err := v.checkSignature(header.Alg, parts[0]+"."+parts[1], sig); err != nil {
+		return "", err
+	}
+	var claims struct {
+		Sub string          `json:"sub"`
+		Iss string          `json:"iss"`
+		Aud json.RawMessage `json:"aud"`
+		Exp *float64        `json:"exp"`
+		Nbf *float64        `json:"nbf"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("jwt claims: %w", err)
+	}
+	if claims.Exp == nil {
+		return "", errors.New("jwt has no exp")
+	}
+	if exp := time.Unix(int64(*claims.Exp), 0); now.After(exp.Add(jwtLeeway)) {
+		return "", errors.New("jwt expired")
+	}
+	if claims.Nbf != nil && now.Add(jwtLeeway).Before(time.Unix(int64(*claims.Nbf), 0)) {
+		return "", errors.New("jwt not yet valid")
+	}
+	if v.issuer != "" && claims.Iss != v.issuer {
+		return "", fmt.Errorf("jwt issuer %q not accepted", claims.Iss)
+	}
+	if v.audience != "" && !jwtAudience(claims.Aud, v.audience) {
+		return "", errors.New("jwt is for another audience")
+	}
+	if claims.Sub == "" {
+		return "", errors.New("jwt has no sub")
+	}
+	return claims.Sub, nil
+}
+
+// checkSignature verifies sig over signed with the configured key, which
+// fixes the algorithm; a token's alg must match it, so an RSA public key
+// can never be used as an HMAC secret.
+func (v *jwtVerifier) checkSignature(alg, signed string, sig []byte) error {
+	sum := sha256.Sum256([]byte(signed))
+	switch key := v.key.(type) {
+	case nil:
+		if alg != "HS256" {
+			return fmt.Errorf("jwt alg %q, want HS256", alg)
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return errors.New("jwt signature does not match")
+		}
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return fmt.Errorf("jwt alg %q, want RS256", alg)
+		}
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) != nil {
+			return errors.New("jwt signature does not match")
+		}
+	case *ecdsa.PublicKey:
+		if alg != "ES256" {
+			return fmt.Errorf("jwt alg %q, want ES256", alg)
+		}
+		if len(sig) != 64 {
+			return errors.New("jwt signature does not match")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(key, sum[:], r, s) {
+			return errors.New("jwt signature does not match")
+		}
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("invalid encoding")
+	}
+	return json.Unmarshal(b, v)
+}
+
+// jwtAudience reports whether aud, a string or an array of them, names
+// want.
+func jwtAudience(aud json.RawMessage, want string) bool {
+	var one string
+	if json.Unmarshal(aud, &one) == nil {
+		return one == want
+	}
+	var many []string
+	if json.Unmarshal(aud, &many) != nil {
+		return false
+	}
+	for _, a := range many {
+		if a == want {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectUnauthenticated answers a subscriber without valid credentials.
+func rejectUnauthenticated(w http.ResponseWriter, r *http.Request, err error) {
+	connLog.log(churnLevel(), "connection rejected", "request_id", requestIDFrom(r.Context()), "remote", r.RemoteAddr, "err", err)
+	w.Header().Set("WWW-Authenticate", `Bearer realm="pulse", error="invalid_token"`)
+	http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+}
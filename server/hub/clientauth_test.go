@@ -0,0 +1,142 @@
+package hub
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signJWT returns a compact JWT of claims with alg in its header, signed
+// by sign.
+func signJWT(t *testing.T, alg string, claims map[string]any, sign func(signed string) []byte) string {
+	t.Helper()
+	enc := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(map[string]string{"alg": alg, "typ": "JWT"}) + "." + enc(claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(signed))
+}
+
+func hs256(secret []byte) func(string) []byte {
+	return func(signed string) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		return mac.Sum(nil)
+	}
+}
+
+func rs256(t *testing.T, key *rsa.PrivateKey) func(string) []byte {
+	return func(signed string) []byte {
+		sum := sha256.Sum256([]byte(signed))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+}
+
+func es256(t *testing.T, key *ecdsa.PrivateKey) func(string) []byte {
+	return func(signed string) []byte {
+		sum := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+}
+
+func TestJWTVerify(t *testing.T) {
+	now := time.Unix(1739700000, 0)
+	secret := []byte("s3cret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherEC, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hsVerifier := &jwtVerifier{secret: secret}
+	rsVerifier := &jwtVerifier{key: &rsaKey.PublicKey}
+	esVerifier := &jwtVerifier{key: &ecKey.PublicKey}
+	scoped := &jwtVerifier{secret: secret, issuer: "https://id.example", audience: "pulse"}
+
+	claims := func(extra map[string]any) map[string]any {
+		c := map[string]any{"sub": "alice", "exp": now.Add(time.Hour).Unix()}
+		for k, v := range extra {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+	tampered := func(token string) string {
+		parts := strings.Split(token, ".")
+		parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"mallory","exp":9999999999}`))
+		return strings.Join(parts, ".")
+	}
+
+	for _, tc := range []struct {
+		name     string
+		verifier *jwtVerifier
+		token    string
+		err      string
+	}{
+		{"hs256", hsVerifier, signJWT(t, "HS256", claims(nil), hs256(secret)), ""},
+		{"rs256", rsVerifier, signJWT(t, "RS256", claims(nil), rs256(t, rsaKey)), ""},
+		{"es256", esVerifier, signJWT(t, "ES256", claims(nil), es256(t, ecKey)), ""},
+		{"alg none", hsVerifier, signJWT(t, "none", claims(nil), func(string) []byte { return nil }), `alg "none"`},
+		{"alg none with a key", rsVerifier, signJWT(t, "none", claims(nil), func(string) []byte { return nil }), `alg "none"`},
+		{"rs256 for an hmac secret", hsVerifier, signJWT(t, "RS256", claims(nil), rs256(t, rsaKey)), `alg "RS256"`},
+		// The classic confusion: the RSA public key used as an HMAC secret.
+		{"hs256 for a public key", rsVerifier, signJWT(t, "HS256", claims(nil), hs256(rsaKey.PublicKey.N.Bytes())), `alg "HS256"`},
+		{"es256 for an rsa key", rsVerifier, signJWT(t, "ES256", claims(nil), es256(t, ecKey)), `alg "ES256"`},
+		{"wrong secret", hsVerifier, signJWT(t, "HS256", claims(nil), hs256([]byte("guess"))), "signature does not match"},
+		{"wrong ec key", esVerifier, signJWT(t, "ES256", claims(nil), es256(t, otherEC)), "signature does not match"},
+		{"tampered claims", hsVerifier, tampered(signJWT(t, "HS256", claims(nil), hs256(secret))), "signature does not match"},
+		{"tampered rs256 claims", rsVerifier, tampered(signJWT(t, "RS256", claims(nil), rs256(t, rsaKey))), "signature does not match"},
+		{"bad signature encoding", hsVerifier, signJWT(t, "HS256", claims(nil), hs256(secret)) + "!", "invalid encoding"},
+		{"no exp", hsVerifier, signJWT(t, "HS256", claims(map[string]any{"exp": nil}), hs256(secret)), "no exp"},
+		{"expired", hsVerifier, signJWT(t, "HS256", claims(map[string]any{"exp": now.Add(-time.Minute).Unix()}), hs256(secret)), "expired"},
+		{"expired within leeway", hsVerifier, signJWT(t, "HS256", claims(map[string]any{"exp": now.Add(-jwtLeeway / 2).Unix()}), hs256(secret)), ""},
+		{"not yet valid", hsVerifier, signJWT(t, "HS256", claims(map[string]any{"nbf": now.Add(time.Minute).Unix()}), hs256(secret)), "not yet valid"},
+		{"not yet valid within leeway", hsVerifier, signJWT(t, "HS256", claims(map[string]any{"nbf": now.Add(jwtLeeway / 2).Unix()}), hs256(secret)), ""},
+		{"no sub", hsVerifier, signJWT(t, "HS256", claims(map[string]any{"sub": nil}), hs256(secret)), "no sub"},
+		{"issuer and audience", scoped, signJWT(t, "HS256", claims(map[string]any{"iss": "https://id.example", "aud": []string{"other", "pulse"}}), hs256(secret)), ""},
+		{"wrong issuer", scoped, signJWT(t, "HS256", claims(map[string]any{"iss": "https://evil.example", "aud": "pulse"}), hs256(secret)), "issuer"},
+		{"wrong audience", scoped, signJWT(t, "HS256", claims(map[string]any{"iss": "https://id.example", "aud": "other"}), hs256(secret)), "audience"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sub, err := tc.verifier.verify(tc.token, now)
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatalf("verify: %v", err)
+			case tc.err == "" && sub != "alice":
+				t.Fatalf("sub %q, want alice", sub)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Fatalf("verify: sub %q, err %v; want an error with %q", sub, err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package hub
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultClientPage = 50
+	maxClientPage     = 500
+)
+
+// clientInfo is the admin view of one connection.
+type clientInfo struct {
+	RequestID      string    `json:"request_id"`
+	Remote         string    `json:"remote"`
+	Channel        string    `json:"channel"`
+	Rate           uint64    `json:"rate,omitempty"`
+	Proto          string    `json:"proto"`
+	Tenant         string    `json:"tenant"`
+	ConnectedAt    time.Time `json:"connected_at"`
+	BytesSent      uint64    `json:"bytes_sent"`
+	WriteLatencyMS float64   `json:"write_latency_ms"`
+	Lagging        bool      `json:"lagging"`
+	// Queued is how many frames wait in the client's write queue, and
+	// DroppedPulses how many were dropped from it when it was full and
+	// ExpiredPulses how many expired in it.
+	Queued        int    `json:"queued"`
+	DroppedPulses uint64 `json:"dropped_pulses"`
+	ExpiredPulses uint64 `json:"expired_pulses"`
+	// RTT is measured from keepalive pings; nil until the first pong.
+	RTT     *rttSnapshot `json:"rtt,omitempty"`
+	Tracing bool         `json:"tracing"`
+	// OffsetMS is set when the client has its own output offset.
+	OffsetMS *int64 `json:"offset_ms,omitempty"`
+	// SyncScore is the score of the client's last self-test, if it ran one.
+	SyncScore *int64 `json:"sync_score,omitempty"`
+	// Identity holds the fields taken from PULSE_IDENTITY_HEADERS.
+	Identity map[string]string `json:"identity,omitempty"`
+	// Subject is who the client authenticated as, if clients must.
+	Subject string `json:"subject,omitempty"`
+	// Client and Caps are what the client announced about itself; see
+	// capabilities.go.
+	Client string   `json:"client,omitempty"`
+	Caps   []string `json:"caps,omitempty"`
+
+	writeLatency time.Duration
+}
+
+type clientPage struct {
+	Clients    []clientInfo `json:"clients"`
+	Total      int          `json:"total"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// clientQuery is a parsed GET /admin/clients request.
+type clientQuery struct {
+	sortBy   string // "connected", "latency" or "rtt"
+	desc     bool
+	limit    int
+	after    *clientCursor
+	channel  string
+	tenant   string
+	ipPrefix string
+	lagging  bool
+}
+
+// clientCursor identifies the last client of a page by its sort key and
+// request ID, so pages stay stable while clients come and go.
+type clientCursor struct {
+	Key int64  `json:"k"`
+	ID  string `json:"id"`
+}
+
+func (c clientCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (*clientCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var c clientCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &c, nil
+}
+
+func parseClientQuery(r *http.Request) (clientQuery, error) {
+	q := r.URL.Query()
+	cq := clientQuery{
+		sortBy:   "connected",
+		limit:    defaultClientPage,
+		channel:  q.Get("channel"),
+		tenant:   q.Get("tenant"),
+		ipPrefix: q.Get("ip"),
+		lagging:  q.Get("lagging") == "true",
+	}
+	if s := q.Get("sort"); s != "" {
+		cq.desc = strings.HasPrefix(s, "-")
+		cq.sortBy = strings.TrimPrefix(s, "-")
+		if cq.sortBy != "connected" && cq.sortBy != "latency" && cq.sortBy != "rtt" {
+			return cq, fmt.Errorf("sort must be connected, latency or rtt")
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return cq, fmt.Errorf("invalid limit")
+		}
+		cq.limit = min(n, maxClientPage)
+	}
+	if s := q.Get("cursor"); s != "" {
+		c, err := decodeCursor(s)
+		if err != nil {
+			return cq, err
+		}
+		cq.after = c
+	}
+	return cq, nil
+}
+
+func (q clientQuery) key(c clientInfo) int64 {
+	switch q.sortBy {
+	case "latency":
+		return int64(c.writeLatency)
+	case "rtt":
+		// Clients without a measurement sort before every measured one.
+		if c.RTT == nil {
+			return -1
+		}
+		return int64(c.RTT.SmoothMS * 1e3)
+	}
+	return c.ConnectedAt.UnixNano()
+}
+
+// less orders by sort key, then request ID, honouring desc for both.
+func (q clientQuery) less(ka int64, ida string, kb int64, idb string) bool {
+	if ka != kb {
+		return (ka < kb) != q.desc
+	}
+	if ida == idb {
+		return false
+	}
+	return (ida < idb) != q.desc
+}
+
+func (q clientQuery) match(c clientInfo) bool {
+	if q.channel != "" && c.Channel != q.channel {
+		return false
+	}
+	if q.tenant != "" && c.Tenant != q.tenant {
+		return false
+	}
+	if q.ipPrefix != "" && !strings.HasPrefix(remoteIP(c.Remote), q.ipPrefix) {
+		return false
+	}
+	if q.lagging && !c.Lagging {
+		return false
+	}
+	return true
+}
+
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func (c *Conn) info(lagThreshold time.Duration) clientInfo {
+	lat := time.Duration(c.lastWrite.Load())
+	ci := clientInfo{
+		RequestID:      c.id,
+		Remote:         c.remote,
+		Channel:        c.Channel(),
+		Rate:           c.rate.Load(),
+		Proto:          c.proto,
+		Tenant:         c.tenant,
+		ConnectedAt:    c.connectedAt,
+		BytesSent:      c.bytesSent.Load(),
+		WriteLatencyMS: msFloat(lat),
+		Lagging:        lat > lagThreshold,
+		Queued:         c.queued(),
+		Tracing:        c.trace.Load(),
+		Identity:       c.identity,
+		Subject:        c.subject,
+		RTT:            c.rtt.snapshot(),
+		writeLatency:   lat,
+	}
+	if q := c.queue.Load(); q != nil {
+		ci.DroppedPulses = q.dropped.Load()
+		ci.ExpiredPulses = q.expired.Load()
+	}
+	if c.hasOffset.Load() {
+		o := c.offsetMS.Load()
+		ci.OffsetMS = &o
+	}
+	if c.hasSyncScore.Load() {
+		s := c.syncScore.Load()
+		ci.SyncScore = &s
+	}
+	if cc := c.caps.Load(); cc != nil {
+		ci.Client, ci.Caps = cc.client, cc.caps
+	}
+	return ci
+}
+
+// clients returns a snapshot of all client connections.
+func (h *Hub) clients(lagThreshold time.Duration) []clientInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	out := make([]clientInfo, 0, len(h.conns))
+	for c := range h.conns {
+		if !c.internal {
+			out = append(out, c.info(lagThreshold))
+		}
+	}
+	return out
+}
+
+func listClients(all []clientInfo, q clientQuery) clientPage {
+	matched := all[:0:0]
+	for _, c := range all {
+		if q.match(c) {
+			matched = append(matched, c)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return q.less(q.key(matched[i]), matched[i].RequestID, q.key(matched[j]), matched[j].RequestID)
+	})
+
+	start := 0
+	if q.after != nil {
+		start = sort.Search(len(matched), func(i int) bool {
+			return q.less(q.after.Key, q.after.ID, q.key(matched[i]), matched[i].RequestID)
+		})
+	}
+	end := min(start+q.limit, len(matched))
+
+	page := clientPage{Clients: matched[start:end], Total: len(matched)}
+	if end < len(matched) {
+		last := matched[end-1]
+		page.NextCursor = clientCursor{Key: q.key(last), ID: last.RequestID}.encode()
+	}
+	return page
+}
@@ -0,0 +1,404 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"pulse/clock"
+	"pulse/ws"
+)
+
+// Clock domains. PULSE_CLOCK_DOMAINS names independent timing worlds, each
+// disciplined by its own source, and PULSE_CHANNEL_DOMAINS binds channels
+// to them, so one server can keep a show on a Link session, the house
+// clocks on wall time and a stage on a console's MIDI clock at once:
+//
+//	PULSE_CLOCK_DOMAINS=show=link@127.0.0.1:17000,house=ntp,stage=midi@/dev/snd/midiC1D0
+//	PULSE_CHANNEL_DOMAINS=song:show,clocks:house,cues:stage
+//
+// The sources:
+//
+//   - free: the server's own clock; channels keep the grid they started on.
+//   - ntp: the host's wall clock, as NTP disciplines it: pulses fall on
+//     whole multiples of the period since the Unix epoch, so servers on
+//     NTP-synchronized hosts pulse together, and pulse beat numbers, which
+//     count periods since the epoch, agree.
+//   - ptp@/dev/ptpN: as ntp, on the time of a PTP hardware clock that
+//     ptp4l keeps to the venue's grandmaster, less PULSE_PTP_UTC_OFFSET_S
+//     from TAI, so servers in one PTP network pulse together to within the
+//     network's precision, whatever keeps their system clocks.
+//   - manual: as ntp, on the server's clock plus an offset an operator
+//     sets with POST /admin/domains/{domain}/offset, slewed in as a time
+//     source's corrections are.
+//   - link@host[:port]: an Ableton Link session through Carabiner, followed
+//     as PULSE_LINK follows it (see link.go).
+//   - midi@device: MIDI clock read from a raw MIDI device; a pulse is a
+//     quarter note, and start puts beat 0 on the next clock tick.
+//
+// Channels not bound to a domain are free. A domain's channels are moved
+// onto its source's beats as link.go moves the default channel, and a
+// source that goes away leaves them running on where it left them. The
+// pulse loops keep waiting on the server's clock, and pulses keep its
+// time in now_ms and next_ms; only where the beats fall follows the
+// source.
+const (
+	domainFree   = "free"
+	domainNTP    = "ntp"
+	domainPTP    = "ptp"
+	domainManual = "manual"
+	domainLink   = "link"
+	domainMIDI   = "midi"
+
+	// domainCheck is how often an ntp, ptp or manual domain checks its
+	// channels against its time.
+	domainCheck = time.Second
+	// domainTimeout is how long a domain counts as locked after its source
+	// was last heard from.
+	domainTimeout = 5 * time.Second
+	// midiWindow is how many clock ticks the MIDI tempo is measured over:
+	// four quarter notes, smoothing the jitter of single ticks.
+	midiWindow = 4 * 24
+	// midiTolerance is how far a channel's grid may be off MIDI clock
+	// before it is aligned again; MIDI clock is coarser than Link.
+	midiTolerance = 2 * time.Millisecond
+	// ptpUTCOffset is how many leap seconds TAI, which PTP counts, has
+	// been ahead of UTC since 2017.
+	ptpUTCOffset = 37
+	// maxDomainOffset is the furthest an operator may set a manual domain
+	// from the server's clock.
+	maxDomainOffset = 24 * time.Hour
+)
+
+// clockDomain is a named timing world and the channels bound to it.
+type clockDomain struct {
+	name   string
+	source string
+	// arg is the Carabiner address, MIDI or PTP device.
+	arg   string
+	chans []*pulseChannel
+
+	// src is the time an ntp, ptp or manual domain keeps its channels on;
+	// manual is src for a manual domain.
+	src    clock.Source
+	manual *clock.Disciplined
+	// offset is how far src was ahead of the server's clock when last
+	// read, in nanoseconds.
+	offset atomic.Int64
+
+	// synced is when the source last disciplined the domain, in Unix
+	// nanoseconds.
+	synced atomic.Int64
+	// fit relates the domain's time to the server's clock; see
+	// crossdomain.go.
+	fit domainFit
+}
+
+// domainStatus reports a domain in GET /status. State is free, locked
+// while the source is being heard from, or unlocked; OffsetMS is how far a
+// ptp or manual domain's time is ahead of the server's clock.
+type domainStatus struct {
+	Name     string   `json:"name"`
+	Source   string   `json:"source"`
+	State    string   `json:"state"`
+	SyncedMS int64    `json:"synced_ms,omitempty"`
+	OffsetMS float64  `json:"offset_ms,omitempty"`
+	Channels []string `json:"channels"`
+}
+
+// applyClockDomains parses PULSE_CLOCK_DOMAINS and PULSE_CHANNEL_DOMAINS
+// and binds chans to the domains, sorted by name.
+func applyClockDomains(domainsRaw, bindRaw string, chans map[string]*pulseChannel) ([]*clockDomain, error) {
+	byName := make(map[string]*clockDomain)
+	for _, entry := range ws.SplitHeaderList(domainsRaw) {
+		name, spec, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !validName(name) {
+			return nil, fmt.Errorf("invalid entry %q, want name=source", entry)
+		}
+		if byName[name] != nil {
+			return nil, fmt.Errorf("domain %q given twice", name)
+		}
+		source, arg, _ := strings.Cut(strings.TrimSpace(spec), "@")
+		switch {
+		case source != domainFree && source != domainNTP && source != domainPTP && source != domainManual && source != domainLink && source != domainMIDI:
+			return nil, fmt.Errorf("domain %q: unknown source %q, want free, ntp, ptp@device, manual, link@host[:port] or midi@device", name, source)
+		case (source == domainPTP || source == domainLink || source == domainMIDI) && arg == "":
+			return nil, fmt.Errorf("domain %q: %s needs an address, as %s@...", name, source, source)
+		case (source == domainFree || source == domainNTP || source == domainManual) && arg != "":
+			return nil, fmt.Errorf("domain %q: %s takes no address", name, source)
+		}
+		byName[name] = &clockDomain{name: name, source: source, arg: arg}
+	}
+	for _, entry := range ws.SplitHeaderList(bindRaw) {
+		name, domain, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry %q, want channel:domain", entry)
+		}
+		ch := chans[strings.TrimSpace(name)]
+		d := byName[strings.TrimSpace(domain)]
+		switch {
+		case ch == nil:
+			return nil, fmt.Errorf("unknown channel %q", name)
+		case d == nil:
+			return nil, fmt.Errorf("channel %q: unknown domain %q", ch.name, domain)
+		case ch.domain != nil:
+			return nil, fmt.Errorf("channel %q is bound to domain %q already", ch.name, ch.domain.name)
+		}
+		ch.domain = d
+		d.chans = append(d.chans, ch)
+	}
+	domains := make([]*clockDomain, 0, len(byName))
+	for _, d := range byName {
+		sort.Slice(d.chans, func(i, j int) bool { return d.chans[i].name < d.chans[j].name })
+		domains = append(domains, d)
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i].name < domains[j].name })
+	return domains, nil
+}
+
+// startClockDomains starts disciplining h's domains, refusing channels
+// whose pulses come from elsewhere.
+func (h *Hub) startClockDomains() error {
+	for _, d := range h.domains {
+		if d.source == domainFree {
+			continue
+		}
+		for _, ch := range d.chans {
+			if by := h.drivenBy(ch); by != "" {
+				return fmt.Errorf("domain %q: the %s channel is driven by the %s", d.name, ch.name, by)
+			}
+		}
+		switch d.source {
+		case domainNTP:
+			d.src = h.utc
+			go d.runEpoch(h.utc)
+		case domainPTP:
+			phc, err := clock.OpenPHC(d.arg, time.Duration(envInt("PULSE_PTP_UTC_OFFSET_S", ptpUTCOffset))*time.Second)
+			if err != nil {
+				return fmt.Errorf("domain %q: %w", d.name, err)
+			}
+			d.src = phc
+			go d.runEpoch(h.utc)
+		case domainManual:
+			// On the server's clock until an operator says otherwise.
+			offset, _ := h.utc.ReadOffset()
+			d.manual = clock.NewDisciplined()
+			d.manual.Correct(offset)
+			d.src = d.manual
+			go d.runEpoch(h.utc)
+		case domainLink:
+			quantum := 4
+			if len(d.chans) > 0 && d.chans[0].tempo != nil {
+				quantum = d.chans[0].tempo.beatsPerBar
+			}
+			link, err := startLink(d.arg, linkFollow, float64(quantum), d.chans, d, h.utc)
+			if err != nil {
+				return fmt.Errorf("domain %q: %w", d.name, err)
+			}
+			RegisterEnricher("link:"+d.name, link.enrich)
+		case domainMIDI:
+			go d.runMIDI(h.utc)
+		}
+		slog.Info("clock domain", "domain", d.name, "source", d.source, "channels", len(d.chans))
+	}
+	return nil
+}
+
+// heard records that the source disciplined the domain at now, when the
+// domain's time was v.
+func (d *clockDomain) heard(now time.Time, v float64) {
+	if d != nil {
+		d.synced.Store(now.UnixNano())
+		d.fit.add(now, v)
+	}
+}
+
+// spec is the domain's source as configured.
+func (d *clockDomain) spec() string {
+	if d.arg != "" {
+		return d.source + "@" + d.arg
+	}
+	return d.source
+}
+
+func (d *clockDomain) status(now time.Time) domainStatus {
+	st := domainStatus{Name: d.name, Source: d.spec(), State: domainFree, Channels: make([]string, 0, len(d.chans))}
+	for _, ch := range d.chans {
+		st.Channels = append(st.Channels, ch.name)
+	}
+	if d.source == domainFree {
+		return st
+	}
+	if d.source == domainPTP || d.source == domainManual {
+		st.OffsetMS = roundMS(time.Duration(d.offset.Load()))
+	}
+	st.State = "unlocked"
+	if ns := d.synced.Load(); ns != 0 {
+		synced := time.Unix(0, ns)
+		st.SyncedMS = synced.UnixMilli()
+		// An operator's offset holds until they change it.
+		if now.Sub(synced) < domainTimeout || d.source == domainManual {
+			st.State = "locked"
+		}
+	}
+	return st
+}
+
+// runEpoch keeps the domain's channels on whole multiples of their period
+// since the Unix epoch of the domain's time, src, placing the beats on the
+// server's clock, utc if it is disciplined.
+func (d *clockDomain) runEpoch(utc *clock.Disciplined) {
+	t := time.NewTicker(domainCheck)
+	defer t.Stop()
+	failed := false
+	for ; ; <-t.C {
+		local := time.Now()
+		offset, err := d.src.ReadOffset()
+		if err != nil {
+			if !failed {
+				slog.Warn("clock domain: reading its time", "domain", d.name, "source", d.spec(), "err", err)
+			}
+			failed = true
+			continue
+		}
+		failed = false
+		now := utc.At(local)
+		d.offset.Store(int64(local.Add(offset).Sub(now)))
+		if d.source == domainManual && d.synced.Load() == 0 {
+			// Aligned once an operator has set the offset.
+			continue
+		}
+		unix := local.Add(offset).UnixNano()
+		for _, ch := range d.chans {
+			if ch.ramp.Load() != nil {
+				// Aligned again once the ramp is over.
+				continue
+			}
+			period := ch.Period()
+			beat := unix/int64(period) + 1
+			at := now.Add(time.Duration(beat*int64(period) - unix))
+			alignTo(ch, gridAlign{at: at, period: period, beat: beat}, linkTolerance, 0)
+		}
+		d.heard(now, float64(unix)/1e9)
+	}
+}
+
+// errNoDomain and errNotManual are what setting a domain's offset fails
+// with when there is no such domain, or it is not one an operator
+// disciplines.
+var (
+	errNoDomain  = errors.New("no such clock domain")
+	errNotManual = errors.New("not a manual clock domain")
+)
+
+// domainOffsetBody is POST /admin/domains/{domain}/offset: how far the
+// manual domain's time is to be ahead of the server's clock, and whether
+// getting there stepped it rather than slewed.
+type domainOffsetBody struct {
+	Domain   string  `json:"domain"`
+	OffsetMS float64 `json:"offset_ms"`
+	Stepped  bool    `json:"stepped"`
+}
+
+// setDomainOffset disciplines a manual domain by hand: its time becomes the
+// server's clock plus body's offset, slewed in unless StepThreshold or more
+// away. Its channels are aligned to it from the next check on.
+func (h *Hub) setDomainOffset(body domainOffsetBody) (domainOffsetBody, error) {
+	var d *clockDomain
+	for _, o := range h.domains {
+		if o.name == body.Domain {
+			d = o
+		}
+	}
+	switch {
+	case d == nil:
+		return body, fmt.Errorf("%w: %q", errNoDomain, body.Domain)
+	case d.manual == nil:
+		return body, fmt.Errorf("domain %q: %w", d.name, errNotManual)
+	case math.IsNaN(body.OffsetMS) || math.Abs(body.OffsetMS) > float64(maxDomainOffset/time.Millisecond):
+		return body, fmt.Errorf("offset_ms must be within ±%s", maxDomainOffset)
+	}
+	server, _ := h.utc.ReadOffset()
+	offset := time.Duration(body.OffsetMS * float64(time.Millisecond))
+	body.Stepped = d.manual.Correct(server + offset)
+	d.synced.Store(time.Now().UnixNano())
+	slog.Info("clock domain: offset set", "domain", d.name, "offset", offset, "stepped", body.Stepped)
+	return body, nil
+}
+
+// runMIDI reads MIDI clock from the domain's device, reopening it when it
+// goes away.
+func (d *clockDomain) runMIDI(utc *clock.Disciplined) {
+	for {
+		if err := d.midiSession(utc); err != nil {
+			slog.Warn("clock domain: MIDI clock", "domain", d.name, "err", err, "retry_in", linkRetry)
+		}
+		time.Sleep(linkRetry)
+	}
+}
+
+// midiSession follows MIDI clock until the device fails. Tempo is
+// measured over the latest midiWindow ticks, and the channels are aligned
+// on every quarter note while the clock runs.
+func (d *clockDomain) midiSession(utc *clock.Disciplined) error {
+	f, err := os.Open(d.arg)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	slog.Info("clock domain: reading MIDI clock", "domain", d.name, "device", d.arg)
+
+	var (
+		ticks []time.Time
+		// count is the ticks since start; the first one after start is
+		// tick 0, the downbeat.
+		count   int64 = -1
+		running       = true
+	)
+	buf := make([]byte, 256)
+	for {
+		n, err := f.Read(buf)
+		now := utc.At(time.Now())
+		for _, b := range buf[:n] {
+			switch b {
+			case midiStart:
+				count, ticks, running = -1, ticks[:0], true
+				d.fit.reset()
+			case midiContinue:
+				running = true
+			case midiStop:
+				running = false
+			case midiClockTick:
+				// Clock keeps coming while stopped, and keeps the tempo
+				// known.
+				if ticks = append(ticks, now); len(ticks) > midiWindow+1 {
+					ticks = ticks[1:]
+				}
+				if !running {
+					continue
+				}
+				if count++; count%24 != 0 || len(ticks) < 25 {
+					continue
+				}
+				period := ticks[len(ticks)-1].Sub(ticks[0]) * 24 / time.Duration(len(ticks)-1)
+				if period <= 0 {
+					continue
+				}
+				for _, ch := range d.chans {
+					alignTo(ch, gridAlign{at: now, period: period, beat: count / 24}, midiTolerance, period/1000)
+				}
+				d.heard(now, float64(count)/24)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package hub
+
+import (
+	"encoding/json"
+	"time"
+
+	"pulse/clock"
+)
+
+// syncRequest is sent by a client to measure its clock offset and round
+// trip: {"type":"sync_req","id":7,"t1":1739700000000.125}. t1 is the
+// client's send time in its own clock; id is optional and echoed back.
+type syncRequest struct {
+	Type string          `json:"type"`
+	ID   json.RawMessage `json:"id,omitempty"`
+	T1   json.RawMessage `json:"t1"`
+}
+
+// syncResponse answers a sync_req, as in SNTP: t1 is echoed unchanged, t2
+// is when the request arrived and t3 when the response left, both server
+// time in fractional Unix milliseconds. With t4 the client's receive time,
+// offset = ((t2-t1)+(t3-t4))/2 and rtt = (t4-t1)-(t3-t2).
+type syncResponse struct {
+	Type string          `json:"type"`
+	ID   json.RawMessage `json:"id,omitempty"`
+	T1   json.RawMessage `json:"t1"`
+	T2   float64         `json:"t2"`
+	T3   float64         `json:"t3"`
+}
+
+// answerSync replies to a sync_req from c, in utc's time if the server's
+// clock is disciplined. It reports false for a request
+// without a numeric t1, which is ignored.
+func answerSync(c *Conn, payload []byte, utc *clock.Disciplined) bool {
+	// The frame's arrival, not when the handler got to it, is t2.
+	t2 := utc.At(time.Unix(0, c.lastRead.Load()))
+	var req syncRequest
+	if json.Unmarshal(payload, &req) != nil {
+		return false
+	}
+	var t1 float64
+	if json.Unmarshal(req.T1, &t1) != nil {
+		return false
+	}
+	_ = c.WriteJSON(syncResponse{
+		Type: "sync_resp",
+		ID:   req.ID,
+		T1:   req.T1,
+		T2:   unixMSFloat(t2),
+		T3:   unixMSFloat(utc.At(time.Now())),
+	})
+	return true
+}
+
+// unixMSFloat returns t as Unix milliseconds with microsecond precision.
+func unixMSFloat(t time.Time) float64 {
+	return float64(t.UnixMicro()) / 1000
+}
@@ -0,0 +1,38 @@
+package hub
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// pulse.v2+binary is a fixed layout: the message type, a flags byte, the
+// required fields at fixed offsets, then optional fields in a fixed order,
+// each present when its flag is set, and a length-prefixed JSON object of
+// any other fields. The layout is specified by the x-binary annotations in
+// schema.json and generated into pulse_gen.go, where it is also drawn. It is
+// frozen; new fields go into pulse.v2+tagged.
+//
+// Other messages (hello, warning, redirect) stay JSON text frames.
+
+// encodeExtra encodes enrichment fields as one JSON object in key order.
+func encodeExtra(extra map[string]json.RawMessage) ([]byte, error) {
+	keys := make([]string, 0, len(extra))
+	for k := range extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b := []byte{'{'}
+	for i, k := range keys {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		kb, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, kb...)
+		b = append(b, ':')
+		b = append(b, extra[k]...)
+	}
+	return append(b, '}'), nil
+}
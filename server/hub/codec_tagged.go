@@ -0,0 +1,114 @@
+package hub
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"sort"
+)
+
+// Tagged pulse layout (pulse.v2+tagged): the message type (taggedPulse), then
+// fields, each a uvarint tag, a uvarint length and that many bytes of
+// value. Decoders skip tags they do not know by their length, so fields
+// can be added without breaking deployed clients; fields are never
+// renumbered or given another encoding. Values are
+//
+//	u     uvarint
+//	s     zigzag varint (as encoding/binary's PutVarint)
+//	f64   8-byte IEEE 754 double, big-endian
+//	flag  empty; present means true
+//	hex32 32 bytes, a hex string in JSON
+//
+// seq, period_ms, now_ms and next_ms are always sent; the rest only when
+// set. Fields without a tag of their own travel in one JSON object under
+// tagExtra. Tags and value types are the x-tag annotations in schema.json,
+// generated into pulse_gen.go. Other messages stay JSON text frames, as with
+// pulse.v2+binary.
+
+// taggedUint and the helpers below encode an enrichment field with its own
+// tag from its JSON value; see taggedExtra.
+func taggedUint(tag uint64) func([]byte, json.RawMessage) ([]byte, bool) {
+	return func(b []byte, raw json.RawMessage) ([]byte, bool) {
+		var v uint64
+		if json.Unmarshal(raw, &v) != nil {
+			return b, false
+		}
+		return appendTagged(b, tag, binary.AppendUvarint(nil, v)), true
+	}
+}
+
+func taggedHash(tag uint64) func([]byte, json.RawMessage) ([]byte, bool) {
+	return func(b []byte, raw json.RawMessage) ([]byte, bool) {
+		var s string
+		if json.Unmarshal(raw, &s) != nil {
+			return b, false
+		}
+		sum, err := hex.DecodeString(s)
+		if err != nil || len(sum) != 32 {
+			return b, false
+		}
+		return appendTagged(b, tag, sum), true
+	}
+}
+
+func taggedFloat(tag uint64) func([]byte, json.RawMessage) ([]byte, bool) {
+	return func(b []byte, raw json.RawMessage) ([]byte, bool) {
+		var v float64
+		if json.Unmarshal(raw, &v) != nil {
+			return b, false
+		}
+		return appendTagged(b, tag, binary.BigEndian.AppendUint64(nil, math.Float64bits(v))), true
+	}
+}
+
+func taggedFlag(tag uint64) func([]byte, json.RawMessage) ([]byte, bool) {
+	return func(b []byte, raw json.RawMessage) ([]byte, bool) {
+		var v bool
+		if json.Unmarshal(raw, &v) != nil {
+			return b, false
+		}
+		if v {
+			b = appendTagged(b, tag, nil)
+		}
+		return b, true
+	}
+}
+
+// appendTagged appends one field.
+func appendTagged(b []byte, tag uint64, value []byte) []byte {
+	b = binary.AppendUvarint(b, tag)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// appendTaggedExtra appends enrichment fields, in key order: those with a
+// tag of their own as that, the rest as one JSON object under tagExtra.
+func appendTaggedExtra(b []byte, extra map[string]json.RawMessage) ([]byte, error) {
+	keys := make([]string, 0, len(extra))
+	for k := range extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var rest map[string]json.RawMessage
+	for _, k := range keys {
+		if enc := taggedExtra[k]; enc != nil {
+			var ok bool
+			if b, ok = enc(b, extra[k]); ok {
+				continue
+			}
+		}
+		if rest == nil {
+			rest = make(map[string]json.RawMessage)
+		}
+		rest[k] = extra[k]
+	}
+	if rest != nil {
+		enc, err := encodeExtra(rest)
+		if err != nil {
+			return nil, err
+		}
+		b = appendTagged(b, tagExtra, enc)
+	}
+	return b, nil
+}
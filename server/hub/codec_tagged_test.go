@@ -0,0 +1,197 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+
+	"pulse/golden"
+)
+
+// taggedField is one field of a tagged pulse.
+type taggedField struct {
+	tag   uint64
+	value []byte
+}
+
+// splitTagged splits a tagged pulse into its fields the way a decoder
+// walks them, failing on a field cut short.
+func splitTagged(b []byte) ([]taggedField, error) {
+	if len(b) == 0 || b[0] != taggedPulse {
+		return nil, fmt.Errorf("not a tagged pulse")
+	}
+	var fields []taggedField
+	for b = b[1:]; len(b) > 0; {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("truncated tag")
+		}
+		b = b[n:]
+		size, n := binary.Uvarint(b)
+		if n <= 0 || size > uint64(len(b)-n) {
+			return nil, fmt.Errorf("truncated field %d", tag)
+		}
+		b = b[n:]
+		fields = append(fields, taggedField{tag, b[:size]})
+		b = b[size:]
+	}
+	return fields, nil
+}
+
+// TestTaggedPulseGolden checks encodeTaggedPulse against the corpus's
+// tagged cases. Fields with tags the encoder does not know, which the
+// corpus has for decoders to skip, are dropped from the expected bytes.
+func TestTaggedPulseGolden(t *testing.T) {
+	corpus, err := golden.Load(golden.Latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, c := range corpus.Cases {
+		if c.Codec != "tagged" {
+			continue
+		}
+		n++
+		var msg PulseMessage
+		if err := json.Unmarshal(c.Decoded, &msg); err != nil {
+			t.Fatalf("case %s: %v", c.Name, err)
+		}
+		raw, err := c.Bytes()
+		if err != nil {
+			t.Fatalf("case %s: %v", c.Name, err)
+		}
+		fields, err := splitTagged(raw)
+		if err != nil {
+			t.Fatalf("case %s: %v", c.Name, err)
+		}
+		want := []byte{taggedPulse}
+		for _, f := range fields {
+			if f.tag <= tagSwingMS {
+				want = appendTagged(want, f.tag, f.value)
+			}
+		}
+		got, err := encodeTaggedPulse(msg)
+		if err != nil {
+			t.Fatalf("case %s: %v", c.Name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("case %s: encoded %x, want %x", c.Name, got, want)
+		}
+	}
+	if n == 0 {
+		t.Fatal("no tagged cases in the corpus")
+	}
+}
+
+func TestTaggedPulseFields(t *testing.T) {
+	hash := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	msg := PulseMessage{
+		Type: "pulse", Seq: 300, PeriodMS: 500, NowMS: 1739700000000, NextMS: 1739700000490,
+		OffsetMS: -15, MonoMS: 123456, PeriodChanged: true, RampTargetMS: 400, RampPulses: 8,
+		NowUS: -1,
+	}
+	msg.Extra = map[string]json.RawMessage{
+		"bpm":         json.RawMessage(`120.5`),
+		"bar":         json.RawMessage(`3`),
+		"is_downbeat": json.RawMessage(`false`),
+		"hash":        json.RawMessage(`"` + hash + `"`),
+		// Values of the wrong type go into the JSON object, with
+		// the fields that have no tag.
+		"beat":      json.RawMessage(`"one"`),
+		"prev_hash": json.RawMessage(`"abc"`),
+		"zone":      json.RawMessage(`"north"`),
+	}
+	b, err := encodeTaggedPulse(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := splitTagged(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[uint64][]byte)
+	for _, f := range fields {
+		if _, dup := got[f.tag]; dup {
+			t.Fatalf("tag %d sent twice", f.tag)
+		}
+		got[f.tag] = f.value
+	}
+	uvarint := func(tag uint64) uint64 {
+		v, n := binary.Uvarint(got[tag])
+		if n != len(got[tag]) {
+			t.Fatalf("tag %d: %x is not one uvarint", tag, got[tag])
+		}
+		return v
+	}
+	varint := func(tag uint64) int64 {
+		v, n := binary.Varint(got[tag])
+		if n != len(got[tag]) {
+			t.Fatalf("tag %d: %x is not one varint", tag, got[tag])
+		}
+		return v
+	}
+	for _, tc := range []struct {
+		name      string
+		got, want any
+	}{
+		{"seq", uvarint(tagSeq), uint64(300)},
+		{"period_ms", uvarint(tagPeriodMS), uint64(500)},
+		{"now_ms", varint(tagNowMS), int64(1739700000000)},
+		{"next_ms", varint(tagNextMS), int64(1739700000490)},
+		{"offset_ms", varint(tagOffsetMS), int64(-15)},
+		{"mono_ms", varint(tagMonoMS), int64(123456)},
+		{"ramp_target_ms", uvarint(tagRampTargetMS), uint64(400)},
+		{"ramp_pulses", uvarint(tagRampPulses), uint64(8)},
+		{"now_us", varint(tagNowUS), int64(-1)},
+		{"bar", uvarint(tagBar), uint64(3)},
+		{"bpm", math.Float64frombits(binary.BigEndian.Uint64(got[tagBPM])), 120.5},
+		{"hash", fmt.Sprintf("%x", got[tagHash]), hash},
+		{"period_changed", len(got[tagPeriodChanged]), 0},
+		{"extra", string(got[tagExtra]), `{"beat":"one","prev_hash":"abc","zone":"north"}`},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s: %v, want %v", tc.name, tc.got, tc.want)
+		}
+	}
+	if _, ok := got[tagPeriodChanged]; !ok {
+		t.Error("period_changed flag missing")
+	}
+	// Unset fields and false flags are left out.
+	for _, tag := range []uint64{tagDriftMS, tagAtMS, tagPeriodUS, tagNextUS, tagAtUS, tagIsDownbeat, tagBeat, tagPrevHash} {
+		if v, ok := got[tag]; ok {
+			t.Errorf("tag %d sent as %x", tag, v)
+		}
+	}
+}
+
+// TestTaggedPulseTruncated checks that a pulse cut inside a field is
+// detectable from the lengths alone.
+func TestTaggedPulseTruncated(t *testing.T) {
+	msg := PulseMessage{Type: "pulse", Seq: 7, PeriodMS: 1000, NowMS: 1739700007000, NextMS: 1739700008000}
+	msg.Extra = map[string]json.RawMessage{"bpm": json.RawMessage(`60`), "zone": json.RawMessage(`"north"`)}
+	b, err := encodeTaggedPulse(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err := splitTagged(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ends := map[int]bool{1: true}
+	end := 1
+	for _, f := range fields {
+		end = len(appendTagged(b[:end:end], f.tag, f.value))
+		ends[end] = true
+	}
+	if end != len(b) {
+		t.Fatalf("fields cover %d of %d bytes", end, len(b))
+	}
+	for n := 1; n < len(b); n++ {
+		if _, err := splitTagged(b[:n]); (err == nil) != ends[n] {
+			t.Errorf("cut at %d of %d bytes: err %v", n, len(b), err)
+		}
+	}
+}
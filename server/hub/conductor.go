@@ -0,0 +1,250 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Conductors. A WebSocket client that presented controller or admin
+// credentials on the upgrade can take a channel's baton with
+// {"type":"conduct","channel":"song"} and become its conductor: the one
+// connection that changes the channel's tempo and transport over its
+// socket, with tempo_control and transport_control, while it holds the
+// baton. Other clients' controls for the channel are refused meanwhile;
+// the admin API still applies, as the operator's override. An admin-role
+// client can take the baton from a controller with "take": true. The
+// conductor gives the baton back with "release": true, or by leaving.
+// Every client of the channel hears who conducts from conductor messages
+// and what changed from tempo and transport messages; a refused control
+// is answered with control_error.
+
+// conductMessage claims or releases a channel's baton; Channel defaults to
+// the client's own.
+type conductMessage struct {
+	Type    string `json:"type"`
+	Channel string `json:"channel,omitempty"`
+	Release bool   `json:"release,omitempty"`
+	Take    bool   `json:"take,omitempty"`
+}
+
+// conductorMessage tells a channel's clients who conducts it: the request
+// ID of the conductor's connection, none once the baton is released.
+type conductorMessage struct {
+	Type      string `json:"type"`
+	Channel   string `json:"channel"`
+	Conductor string `json:"conductor,omitempty"`
+	SinceMS   int64  `json:"since_ms,omitempty"`
+}
+
+// tempoControlMessage is a conductor's tempo change: to PeriodMS or BPM,
+// ramped over Pulses pulses if given, or to the tempo tapped at TapsMS.
+type tempoControlMessage struct {
+	Type     string  `json:"type"`
+	Channel  string  `json:"channel,omitempty"`
+	PeriodMS int64   `json:"period_ms,omitempty"`
+	BPM      float64 `json:"bpm,omitempty"`
+	Pulses   int     `json:"pulses,omitempty"`
+	TapsMS   []int64 `json:"taps_ms,omitempty"`
+}
+
+// tempoMessage announces a conductor's tempo change to the channel's
+// clients; Pulses is set for a ramp, which the pulses then carry out.
+type tempoMessage struct {
+	Type     string  `json:"type"`
+	Channel  string  `json:"channel"`
+	PeriodMS int64   `json:"period_ms"`
+	BPM      float64 `json:"bpm"`
+	Pulses   int     `json:"pulses,omitempty"`
+	By       string  `json:"by"`
+}
+
+// controlErrorMessage answers a conduct, tempo_control, transport_control
+// or media_control that was refused; nothing changed.
+type controlErrorMessage struct {
+	Type    string `json:"type"`
+	Request string `json:"request"`
+	Channel string `json:"channel,omitempty"`
+	Error   string `json:"error"`
+}
+
+// errControlRole refuses controls to clients without controller or admin
+// credentials.
+var errControlRole = errors.New("controls need controller or admin credentials")
+
+type baton struct {
+	c     *Conn
+	since time.Time
+}
+
+// conductors holds the batons, by channel.
+type conductors struct {
+	h *Hub
+
+	mu     sync.Mutex
+	batons map[string]baton
+}
+
+// conduct hands channel's baton to c, or takes it back, and tells the
+// channel.
+func (k *conductors) conduct(c *Conn, m conductMessage) error {
+	ch := k.h.channel(m.Channel)
+	switch {
+	case ch == nil:
+		return fmt.Errorf("unknown channel %q", m.Channel)
+	case c.role < roleController:
+		return fmt.Errorf("conducting needs controller or admin credentials")
+	case c.proto == protoRelay || c.proto == protoLegacy:
+		return fmt.Errorf("this connection cannot conduct")
+	}
+	k.mu.Lock()
+	cur, held := k.batons[ch.name]
+	switch {
+	case m.Release && (!held || cur.c != c):
+		k.mu.Unlock()
+		return fmt.Errorf("not the %s channel's conductor", ch.name)
+	case m.Release:
+		delete(k.batons, ch.name)
+	case held && cur.c == c:
+		k.mu.Unlock()
+		return nil
+	case held && !(m.Take && c.role == roleAdmin && cur.c.role < roleAdmin):
+		k.mu.Unlock()
+		return fmt.Errorf("the %s channel is conducted by %s", ch.name, cur.c.id)
+	default:
+		k.batons[ch.name] = baton{c: c, since: time.Now()}
+	}
+	k.mu.Unlock()
+	if m.Release {
+		slog.Info("conductor released", "channel", ch.name, "request_id", c.id)
+	} else {
+		slog.Info("conductor", "channel", ch.name, "request_id", c.id)
+	}
+	k.announce(ch.name)
+	return nil
+}
+
+// allows reports whether c may control channel: it conducts it, or
+// nobody does and its role lets it.
+func (k *conductors) allows(c *Conn, channel string) error {
+	k.mu.Lock()
+	cur, held := k.batons[channel]
+	k.mu.Unlock()
+	switch {
+	case held && cur.c != c:
+		return fmt.Errorf("the %s channel is conducted by %s", channel, cur.c.id)
+	case c.role < roleController:
+		return errControlRole
+	}
+	return nil
+}
+
+// left takes back the batons of c, which has disconnected.
+func (k *conductors) left(c *Conn) {
+	k.mu.Lock()
+	var freed []string
+	for name, b := range k.batons {
+		if b.c == c {
+			delete(k.batons, name)
+			freed = append(freed, name)
+		}
+	}
+	k.mu.Unlock()
+	for _, name := range freed {
+		slog.Info("conductor left", "channel", name, "request_id", c.id)
+		k.announce(name)
+	}
+}
+
+// message is the conductor message for channel.
+func (k *conductors) message(channel string) (conductorMessage, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	msg := conductorMessage{Type: "conductor", Channel: channel}
+	b, held := k.batons[channel]
+	if held {
+		msg.Conductor, msg.SinceMS = b.c.id, b.since.UnixMilli()
+	}
+	return msg, held
+}
+
+func (k *conductors) announce(channel string) {
+	msg, _ := k.message(channel)
+	k.h.BroadcastIf(msg, func(c *Conn) bool { return c.receives(channel) })
+}
+
+// current returns the conductor messages for c's channels that have a
+// conductor, for clients that connect after the baton changed hands.
+func (k *conductors) current(c *Conn) []conductorMessage {
+	var out []conductorMessage
+	for _, name := range k.h.channelNames() {
+		if !c.receives(name) {
+			continue
+		}
+		if msg, held := k.message(name); held {
+			out = append(out, msg)
+		}
+	}
+	return out
+}
+
+// tempoControl applies a conductor's tempo change and announces it.
+func (h *Hub) tempoControl(c *Conn, m tempoControlMessage) (tempoMessage, error) {
+	msg := tempoMessage{Type: "tempo", Channel: m.Channel, By: c.id}
+	if err := h.conductors.allows(c, m.Channel); err != nil {
+		return msg, err
+	}
+	ch := h.channel(m.Channel)
+	if ch == nil {
+		return msg, fmt.Errorf("unknown channel %q", m.Channel)
+	}
+	var d time.Duration
+	switch {
+	case len(m.TapsMS) > 0:
+		if m.PeriodMS != 0 || m.BPM != 0 || m.Pulses != 0 {
+			return msg, fmt.Errorf("give taps_ms or a tempo, not both")
+		}
+		if by := h.drivenBy(ch); by != "" {
+			return msg, fmt.Errorf("%w: the %s channel's period is set by the %s", errDriven, ch.name, by)
+		}
+		var err error
+		if d, err = tapPeriod(m.TapsMS); err != nil {
+			return msg, err
+		}
+		if d < minChannelPeriod || d > maxChannelPeriod {
+			return msg, fmt.Errorf("tapped period %s is outside [%s, %s]", d, minChannelPeriod, maxChannelPeriod)
+		}
+		ch.setPeriod(d)
+	case m.Pulses > 0:
+		if by := h.drivenBy(ch); by != "" {
+			return msg, fmt.Errorf("%w: the %s channel's period is set by the %s", errDriven, ch.name, by)
+		}
+		var err error
+		if d, err = rampTarget(m.PeriodMS, m.BPM); err != nil {
+			return msg, err
+		}
+		if err := ch.startRamp(d, m.Pulses); err != nil {
+			return msg, err
+		}
+		msg.Pulses = m.Pulses
+	default:
+		if _, err := h.retune(periodBody{Channel: ch.name, PeriodMS: m.PeriodMS, BPM: m.BPM}); err != nil {
+			return msg, err
+		}
+		d = ch.Period()
+	}
+	msg.PeriodMS, msg.BPM = d.Milliseconds(), periodBPM(d)
+	slog.Info("tempo control", "channel", ch.name, "period_ms", msg.PeriodMS, "pulses", msg.Pulses, "request_id", c.id)
+	h.BroadcastIf(msg, func(c *Conn) bool { return c.receives(ch.name) })
+	return msg, nil
+}
+
+// refuseControl logs a refused control and tells c why.
+func (h *Hub) refuseControl(c *Conn, request, channel string, err error) {
+	slog.Warn(request, "request_id", c.id, "channel", channel, "err", err)
+	if werr := c.WriteJSON(controlErrorMessage{Type: "control_error", Request: request, Channel: channel, Error: err.Error()}); werr != nil {
+		slog.Debug(request, "request_id", c.id, "err", werr)
+	}
+}
@@ -0,0 +1,172 @@
+package hub
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxConfigBody bounds PUT /api/config bodies.
+const maxConfigBody = 1 << 20
+
+//go:embed config.schema.json
+var configSchemaJSON []byte
+
+var configSchema = func() *jsonSchema {
+	var s jsonSchema
+	if err := json.Unmarshal(configSchemaJSON, &s); err != nil {
+		panic("config.schema.json: " + err.Error())
+	}
+	return &s
+}()
+
+// runtimeConfig is the mutable subset of configuration served and accepted
+// by /api/config; see config.schema.json. In a PUT, nil fields and channels
+// left out keep their value.
+type runtimeConfig struct {
+	OffsetMS *int64                   `json:"offset_ms,omitempty"`
+	LogBurst *int                     `json:"log_burst,omitempty"`
+	Channels map[string]channelConfig `json:"channels,omitempty"`
+}
+
+type channelConfig struct {
+	PeriodMS int64 `json:"period_ms"`
+}
+
+// configResult answers a PUT: the configuration after the change, or the
+// one it would have led to for a dry run.
+type configResult struct {
+	DryRun bool          `json:"dry_run"`
+	Config runtimeConfig `json:"config"`
+}
+
+// configAPI serves /api/config. Changes are validated as a whole, against
+// the schema and the running server, before any of them is applied, and
+// are applied one PUT at a time.
+type configAPI struct {
+	h     *Hub
+	store Store
+	audit *auditLog
+
+	mu sync.Mutex
+}
+
+// current reads the live configuration.
+func (a *configAPI) current() runtimeConfig {
+	offset := a.h.offset().Milliseconds()
+	burst := connLog.limit()
+	cfg := runtimeConfig{OffsetMS: &offset, LogBurst: &burst, Channels: make(map[string]channelConfig)}
+	for _, name := range a.h.channelNames() {
+		cfg.Channels[name] = channelConfig{PeriodMS: a.h.channel(name).Period().Milliseconds()}
+	}
+	return cfg
+}
+
+// check validates a change against the running server, beyond what the
+// schema can express.
+func (a *configAPI) check(change runtimeConfig) []schemaError {
+	var errs []schemaError
+	for name := range change.Channels {
+		path := "/channels/" + pointerEscaper.Replace(name)
+		ch := a.h.channel(name)
+		if ch == nil {
+			errs = append(errs, schemaError{Path: path, Message: "no such channel"})
+		} else if by := a.h.drivenBy(ch); by != "" {
+			errs = append(errs, schemaError{Path: path, Message: "period is set by the " + by})
+		}
+	}
+	return errs
+}
+
+// merge returns cfg with change applied.
+func merge(cfg, change runtimeConfig) runtimeConfig {
+	if change.OffsetMS != nil {
+		cfg.OffsetMS = change.OffsetMS
+	}
+	if change.LogBurst != nil {
+		cfg.LogBurst = change.LogBurst
+	}
+	for name, ch := range change.Channels {
+		cfg.Channels[name] = ch
+	}
+	return cfg
+}
+
+// apply makes a validated change live.
+func (a *configAPI) apply(change runtimeConfig) {
+	if change.OffsetMS != nil {
+		a.h.setOffset(time.Duration(*change.OffsetMS) * time.Millisecond)
+		if err := saveState(a.store, serverState{OffsetMS: *change.OffsetMS}); err != nil {
+			slog.Error("config: save state", "err", err)
+		}
+	}
+	if change.LogBurst != nil {
+		connLog.setLimit(*change.LogBurst)
+	}
+	for name, cc := range change.Channels {
+		ch := a.h.channel(name)
+		if d := time.Duration(cc.PeriodMS) * time.Millisecond; d != ch.Period() {
+			ch.setPeriod(d)
+			slog.Info("config: period set", "channel", name, "period", d)
+		}
+	}
+}
+
+func (a *configAPI) get(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, a.current())
+}
+
+// put validates and applies a change; with ?dry_run=true it only reports
+// what the configuration would become. Invalid changes are answered with
+// 400 and every problem found, as {"errors":[{"path":…,"message":…}]}.
+func (a *configAPI) put(w http.ResponseWriter, r *http.Request) {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxConfigBody))
+	if err != nil {
+		http.Error(w, "read body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errs := configSchema.validate(doc); len(errs) > 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"errors": errs})
+		return
+	}
+	var change runtimeConfig
+	if err := json.Unmarshal(body, &change); err != nil {
+		http.Error(w, fmt.Sprintf("invalid body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if errs := a.check(change); len(errs) > 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"errors": errs})
+		return
+	}
+	res := configResult{DryRun: dryRun, Config: merge(a.current(), change)}
+	if !dryRun {
+		a.apply(change)
+		a.audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "config", Params: change})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func configSchemaHandler() http.HandlerFunc {
+	tag := etagOf(configSchemaJSON)
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeCached(w, r, "application/schema+json", configSchemaJSON, tag)
+	}
+}
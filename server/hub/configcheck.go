@@ -0,0 +1,211 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// CheckConfig resolves the settings from args (pulse-server's flags),
+// the environment and the config file as Main would, checks them for
+// consistency and prints the effective configuration to stdout, without
+// opening a store or a listener. pulsectl validate-config calls it.
+func CheckConfig(args []string, stdout io.Writer) error {
+	_, err := loadSettings(append([]string{"-check"}, args...), stdout)
+	return err
+}
+
+// checkSettings checks the settings loadSettings exported against each
+// other: what setting.validate cannot see on its own, such as admission
+// rules naming channels that do not exist or a send-ahead lead longer
+// than a period. It reads files the settings name, like TLS certificates
+// and JWT keys, but opens no store and no listener.
+func checkSettings() error {
+	var errs []error
+	fail := func(name string, err error) { errs = append(errs, fmt.Errorf("%s: %w", name, err)) }
+
+	period := time.Second
+	if raw := strings.TrimSpace(os.Getenv("PULSE_PERIOD_MS")); raw == "0" {
+		fail("PULSE_PERIOD_MS", errors.New("must be positive"))
+	} else {
+		period = parsePeriodMS()
+	}
+	if beatPeriod, beats, err := defaultTempo(); err != nil {
+		fail("PULSE_BPM", err)
+	} else if beats != nil {
+		period = beatPeriod
+	}
+	channels, err := parseChannels(os.Getenv("PULSE_CHANNELS"), period)
+	if err != nil {
+		// Everything below is about channels; parseChannels was checked
+		// with the settings and reported there.
+		return errors.Join(append(errs, fmt.Errorf("PULSE_CHANNELS: %w", err))...)
+	}
+	if err := applyFeatures(os.Getenv("PULSE_FEATURES"), channels); err != nil {
+		fail("PULSE_FEATURES", err)
+	}
+	if err := applySimulcast(os.Getenv("PULSE_SIMULCAST"), channels); err != nil {
+		fail("PULSE_SIMULCAST", err)
+	}
+	if err := applyPatterns(os.Getenv("PULSE_PATTERNS"), channels); err != nil {
+		fail("PULSE_PATTERNS", err)
+	}
+	if err := applyPrerolls(os.Getenv("PULSE_PREROLL"), channels); err != nil {
+		fail("PULSE_PREROLL", err)
+	}
+	domains, err := applyClockDomains(os.Getenv("PULSE_CLOCK_DOMAINS"), os.Getenv("PULSE_CHANNEL_DOMAINS"), channels)
+	if err != nil {
+		fail("PULSE_CLOCK_DOMAINS", err)
+	}
+	if _, err := parseAdmissionPolicy(os.Getenv("PULSE_ADMISSION_RULES"), channels); err != nil {
+		fail("PULSE_ADMISSION_RULES", err)
+	}
+
+	// Periods: leads and widths measured against a pulse must fit in the
+	// shortest period.
+	shortest := period
+	for _, ch := range channels {
+		shortest = min(shortest, ch.Period())
+	}
+	if lead := envMS("PULSE_SEND_AHEAD_MS", sendAheadLead); lead >= shortest {
+		fail("PULSE_SEND_AHEAD_MS", fmt.Errorf("%s is not shorter than the shortest period, %s", lead, shortest))
+	}
+	if width := envMS("PULSE_TRIGGER_WIDTH_MS", time.Millisecond); os.Getenv("PULSE_TRIGGER") != "" && width >= shortest {
+		fail("PULSE_TRIGGER_WIDTH_MS", fmt.Errorf("%s is not shorter than the shortest period, %s", width, shortest))
+	}
+
+	// Limits that can never be reached, or that contradict each other.
+	if total := envInt("PULSE_MAX_CLIENTS", 0); total > 0 {
+		for _, name := range []string{"PULSE_MAX_CLIENTS_V4", "PULSE_MAX_CLIENTS_V6"} {
+			if n := envInt(name, 0); n > total {
+				fail(name, fmt.Errorf("%d is over PULSE_MAX_CLIENTS, %d", n, total))
+			}
+		}
+	}
+	if os.Getenv("PULSE_IP_UPGRADE_BURST") != "" && envInt("PULSE_IP_UPGRADE_RATE", 0) == 0 {
+		fail("PULSE_IP_UPGRADE_BURST", errors.New("has no effect without PULSE_IP_UPGRADE_RATE"))
+	}
+	if drop, warn := envMS("PULSE_DROP_LAG_MS", 0), envMS("PULSE_LAGGING_MS", 50*time.Millisecond); drop > 0 && drop < warn {
+		fail("PULSE_DROP_LAG_MS", fmt.Errorf("%s drops clients before PULSE_LAGGING_MS, %s, warns them", drop, warn))
+	}
+	limits, queue := httpLimitsFromEnv(), envMS("PULSE_HANDSHAKE_QUEUE_MS", 10*time.Second)
+	for _, t := range []struct {
+		name string
+		d    time.Duration
+	}{{"PULSE_HTTP_READ_TIMEOUT_MS", limits.read}, {"PULSE_HTTP_WRITE_TIMEOUT_MS", limits.write}} {
+		if t.d > 0 && t.d <= max(queue, maxPollTimeout) {
+			fail(t.name, fmt.Errorf("%s does not leave time for long polls (up to %s) or queued handshakes (up to %s) to be answered", t.d, maxPollTimeout, queue))
+		}
+	}
+	if os.Getenv("PULSE_UNIX_SOCKET_MODE") != "" && !strings.Contains(os.Getenv("PULSE_ADDR"), unixPrefix) {
+		fail("PULSE_UNIX_SOCKET_MODE", errors.New("has no effect without a unix:// address in PULSE_ADDR"))
+	}
+	if specs, err := parseListenAddrs(os.Getenv("PULSE_ADDR")); err == nil && os.Getenv("PULSE_TLS_CERT") == "" {
+		if slices.ContainsFunc(specs, func(s listenSpec) bool { return s.opts.plain }) {
+			fail("PULSE_ADDR", errors.New("tls=off has no effect without PULSE_TLS_CERT"))
+		}
+	}
+	if os.Getenv("PULSE_WEBHOOKS") == "" && os.Getenv("PULSE_ALERT_WEBHOOK") == "" {
+		for _, name := range []string{"PULSE_WEBHOOK_SECRET", "PULSE_WEBHOOK_RETRIES", "PULSE_WEBHOOK_CLIENTS"} {
+			if os.Getenv(name) != "" {
+				fail(name, errors.New("has no effect without PULSE_WEBHOOKS or PULSE_ALERT_WEBHOOK"))
+			}
+		}
+	}
+	if os.Getenv("PULSE_PONG_TIMEOUT_MS") != "" && envMS("PULSE_PING_INTERVAL_MS", 15*time.Second) == 0 {
+		fail("PULSE_PONG_TIMEOUT_MS", errors.New("has no effect with PULSE_PING_INTERVAL_MS=0"))
+	}
+
+	// Access control: one token per role, and credentials that load.
+	roles := make(map[string]string)
+	for _, name := range []string{"PULSE_ADMIN_TOKEN", "PULSE_CONTROLLER_TOKEN", "PULSE_OBSERVER_TOKEN"} {
+		token := strings.TrimSpace(os.Getenv(name))
+		if token == "" {
+			continue
+		}
+		if other, dup := roles[token]; dup {
+			fail(name, fmt.Errorf("is the same token as %s", other))
+		}
+		roles[token] = name
+	}
+	if _, err := parseSigningKeys(os.Getenv("PULSE_ADMIN_SIGNING_KEYS")); err != nil {
+		fail("PULSE_ADMIN_SIGNING_KEYS", err)
+	}
+	if _, _, err := masterKeysFromEnv(); err != nil {
+		fail("PULSE_MASTER_KEY", err)
+	}
+	if _, err := loadClientAuth(); err != nil {
+		fail("client auth", err)
+	}
+	if _, err := tlsConfigFromEnv(); err != nil {
+		fail("PULSE_TLS_CERT", err)
+	}
+
+	// Sources and sinks that exclude each other.
+	if os.Getenv("PULSE_BACKPLANE_ROLE") != "" && os.Getenv("PULSE_BACKPLANE") == "" {
+		fail("PULSE_BACKPLANE_ROLE", errors.New("has no effect without PULSE_BACKPLANE"))
+	}
+	if replay := os.Getenv("PULSE_REPLAY"); replay != "" {
+		if os.Getenv("PULSE_BACKPLANE") != "" {
+			fail("PULSE_REPLAY", errors.New("a replay cannot take part in a backplane"))
+		}
+		if replay == os.Getenv("PULSE_RECORD") {
+			fail("PULSE_RECORD", errors.New("cannot record to the file being replayed"))
+		}
+	}
+	if os.Getenv("PULSE_UPSTREAM") != "" {
+		if os.Getenv("PULSE_BACKPLANE") != "" {
+			fail("PULSE_UPSTREAM", errors.New("a relay cannot take part in a backplane"))
+		}
+		if os.Getenv("PULSE_REPLAY") != "" {
+			fail("PULSE_UPSTREAM", errors.New("a relay cannot replay a recording"))
+		}
+		if _, err := newUpstream(os.Getenv("PULSE_UPSTREAM"), ""); err != nil {
+			fail("PULSE_UPSTREAM", err)
+		}
+	} else if os.Getenv("PULSE_UPSTREAM_TOKEN") != "" {
+		fail("PULSE_UPSTREAM_TOKEN", errors.New("has no effect without PULSE_UPSTREAM"))
+	}
+	if raw := os.Getenv("PULSE_TIME_SOURCE"); raw != "" {
+		if os.Getenv("PULSE_UPSTREAM") != "" {
+			fail("PULSE_TIME_SOURCE", errors.New("a relay keeps the upstream's time"))
+		}
+		if _, err := parseTimeSource(raw, envMS("PULSE_TIME_POLL_MS", 64*time.Second)); err != nil {
+			fail("PULSE_TIME_SOURCE", err)
+		}
+	} else if os.Getenv("PULSE_TIME_POLL_MS") != "" {
+		fail("PULSE_TIME_POLL_MS", errors.New("has no effect without PULSE_TIME_SOURCE"))
+	}
+	if os.Getenv("PULSE_LINK") != "" && os.Getenv("PULSE_REPLAY") != "" {
+		fail("PULSE_LINK", errors.New("the default channel is driven by the replay"))
+	}
+	ptp := false
+	for _, d := range domains {
+		ptp = ptp || d.source == domainPTP
+	}
+	if !ptp && os.Getenv("PULSE_PTP_UTC_OFFSET_S") != "" {
+		fail("PULSE_PTP_UTC_OFFSET_S", errors.New("has no effect without a ptp clock domain"))
+	}
+	for _, d := range domains {
+		if d.source == domainFree || len(d.chans) == 0 {
+			continue
+		}
+		if os.Getenv("PULSE_REPLAY") != "" {
+			fail("PULSE_CLOCK_DOMAINS", fmt.Errorf("domain %q: its channels are driven by the replay", d.name))
+		}
+		if os.Getenv("PULSE_LINK") != "" && channels[defaultChannel].domain == d {
+			fail("PULSE_LINK", fmt.Errorf("the default channel is in clock domain %q", d.name))
+		}
+	}
+	if spec := strings.TrimSpace(os.Getenv("PULSE_STORE")); envBool("PULSE_PERSIST_TIMELINE", false) && (spec == "" || spec == "memory") {
+		fail("PULSE_PERSIST_TIMELINE", errors.New("has no effect with an in-memory PULSE_STORE"))
+	}
+	if spec := strings.TrimSpace(os.Getenv("PULSE_STORE")); os.Getenv("PULSE_HISTORY_CODEC") != "" && !strings.HasPrefix(spec, "file:") {
+		fail("PULSE_HISTORY_CODEC", errors.New("history segments need a file: PULSE_STORE"))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,276 @@
+package hub
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"pulse/ws"
+)
+
+// writeTimeout bounds a single frame write; a client that cannot take a
+// frame within it is dropped. PULSE_WRITE_TIMEOUT_MS sets it.
+var writeTimeout = defaultWriteTimeout
+
+const defaultWriteTimeout = 2 * time.Second
+
+// Conn is a client connection. Its methods are safe for concurrent use.
+type Conn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	mu   sync.Mutex
+
+	// id is the request ID of the upgrade request, used to correlate logs.
+	id          string
+	remote      string
+	connectedAt time.Time
+	// ch is the channel the client receives; see channels.go. rate is the
+	// simulcast rate it receives it at, 0 or 1 for every pulse; see
+	// simulcast.go.
+	ch   atomic.Pointer[pulseChannel]
+	rate atomic.Uint64
+	// every is the client's decimation divisor, 0 or 1 for every pulse;
+	// see decimate.go.
+	every atomic.Uint64
+	// micros is set for a client that asked for microsecond timestamps;
+	// see precision.go.
+	micros atomic.Bool
+	// also holds the channels the client added to ch with subscribe's
+	// add, each with its rate; nil if none. The map is replaced, never
+	// changed.
+	also atomic.Pointer[map[string]uint64]
+
+	// lastWrite is how long the most recent frame took from being queued
+	// to written, in nanoseconds; slow consumers show up here first.
+	lastWrite atomic.Int64
+	// queue feeds the connection's writer once it is in the hub; see
+	// writequeue.go.
+	queue atomic.Pointer[writeQueue]
+
+	// proto is the negotiated subprotocol; protoLegacy for v1 clients.
+	proto string
+	// format, once the client sent set_format, is the subprotocol whose
+	// pulse encoding it wants instead of proto's.
+	format atomic.Pointer[string]
+	// exts are the negotiated WebSocket extensions.
+	exts []ws.Extension
+
+	// clientID is the client's own ?client_id=, if it gave one.
+	clientID string
+	// caps is what the client announced about itself; nil if nothing.
+	// See capabilities.go.
+	caps atomic.Pointer[clientCaps]
+
+	// tenant groups connections for bandwidth accounting and quotas.
+	tenant    string
+	usage     *tenantUsage
+	bytesSent atomic.Uint64
+	// series is the metrics series the connection is counted under; nil
+	// for internal subscribers.
+	series *metricSeries
+
+	// trace enables verbose per-frame logging for this connection only.
+	trace atomic.Bool
+
+	// offsetMS replaces the hub's output offset for this client while
+	// hasOffset is set.
+	offsetMS  atomic.Int64
+	hasOffset atomic.Bool
+
+	// warnedAt is when the client was last warned about lagging, in Unix
+	// nanoseconds; 0 if never.
+	warnedAt atomic.Int64
+
+	// lastRead is when the last frame arrived from the client, in Unix
+	// nanoseconds; 0 if none has yet.
+	lastRead atomic.Int64
+	// rtt is measured from keepalive pings.
+	rtt rttStats
+	// syncScore is the score of the client's last self-test, while
+	// hasSyncScore is set.
+	syncScore    atomic.Int64
+	hasSyncScore atomic.Bool
+	// cause is why the connection went away, set by whoever noticed first;
+	// see storm.go.
+	cause atomic.Pointer[string]
+
+	// internal marks in-process subscribers such as the canary, which are
+	// not counted as clients.
+	internal bool
+	// identity holds the fields configured via PULSE_IDENTITY_HEADERS.
+	identity map[string]string
+	// subject is who the client authenticated as; see clientauth.go.
+	subject string
+	// sse marks Server-Sent Events subscribers: frames are written as
+	// events instead of WebSocket frames.
+	sse bool
+	// grpc marks gRPC SubscribePulses streams, which get pulses only and
+	// cannot send anything; see grpc.go.
+	grpc bool
+	// datagram marks WebTransport sessions, which get pulses only, as
+	// datagrams; see datagram.go.
+	datagram bool
+	// role is that of the admin credentials the upgrade presented, if any;
+	// controllers may send control messages.
+	role role
+}
+
+func (c *Conn) WriteJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeText(data)
+}
+
+func (c *Conn) Close() error {
+	if q := c.queue.Load(); q != nil {
+		q.close()
+	}
+	return c.conn.Close()
+}
+
+func (c *Conn) writeText(payload []byte) error {
+	return c.writeFrame(ws.OpText, payload)
+}
+
+// writeEncoded sends a frame wireFrame encoded for this kind of connection;
+// payload is only kept for trace logs. A pulse of channel is not sent once
+// it is still queued at expires, unless that is zero.
+func (c *Conn) writeEncoded(opcode byte, payload, frame []byte, channel string, expires time.Time) error {
+	if frame == nil {
+		return nil
+	}
+	return c.send(outFrame{opcode: opcode, payload: payload, frame: frame, channel: channel, expires: expires})
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	return c.send(outFrame{opcode: opcode, payload: payload})
+}
+
+// send queues f, or writes it right away while the connection has no
+// writer. A close frame waits until it and everything queued before it has
+// gone out, so the caller may close the connection after it.
+func (c *Conn) send(f outFrame) error {
+	f.queued = time.Now()
+	q := c.queue.Load()
+	if q == nil {
+		return c.writeNow(f)
+	}
+	switch {
+	case f.opcode == ws.OpClose:
+		f.done = make(chan error, 1)
+	case f.opcode == ws.OpText && f.channel == "" && len(q.policy.high) > 0:
+		f.priority = q.policy.high[messageType(f.payload)]
+	}
+	if err := q.push(f); err != nil || f.done == nil {
+		return err
+	}
+	select {
+	case err := <-f.done:
+		return err
+	case <-time.After(writeTimeout):
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// queued returns how many frames wait in the connection's write queue.
+func (c *Conn) queued() int {
+	if q := c.queue.Load(); q != nil {
+		return q.len()
+	}
+	return 0
+}
+
+// wireFrame encodes a frame as it goes on the wire: a WebSocket frame, or
+// for SSE subscribers an event (nil if the frame has none). Server frames
+// are unmasked, so the bytes are the same for every connection of a kind
+// and broadcasts encode them once.
+func wireFrame(sse bool, opcode byte, payload []byte) []byte {
+	if sse {
+		return sseEvent(opcode, payload)
+	}
+	return ws.AppendFrame(make([]byte, 0, len(payload)+10), opcode, payload)
+}
+
+// writeNow sends f, encoding it unless it comes encoded, under the
+// connection's write lock and accounts for it.
+func (c *Conn) writeNow(f outFrame) error {
+	frame := f.frame
+	if frame == nil {
+		if frame = wireFrame(c.sse, f.opcode, f.payload); frame == nil {
+			return nil
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	start := time.Now()
+	_ = c.conn.SetWriteDeadline(start.Add(writeTimeout))
+	n, err := c.conn.Write(frame)
+	c.lastWrite.Store(int64(time.Since(f.queued)))
+	c.bytesSent.Add(uint64(n))
+	if c.usage != nil {
+		c.usage.bytes.Add(uint64(n))
+	}
+	if ch := c.ch.Load(); ch != nil {
+		ch.bytes.Add(uint64(n))
+	}
+	if c.series != nil {
+		c.series.bytes.Add(uint64(n))
+	}
+	if c.trace.Load() {
+		c.traceWrite(f.payload, len(frame), start.Sub(f.queued), time.Since(start), err)
+	}
+	return err
+}
+
+// traceMaxPayload limits how much of each frame is echoed into trace logs.
+const traceMaxPayload = 256
+
+func (c *Conn) traceWrite(payload []byte, frameLen int, queueWait, write time.Duration, err error) {
+	shown := payload
+	if len(shown) > traceMaxPayload {
+		shown = shown[:traceMaxPayload]
+	}
+	slog.Info("trace", "request_id", c.id, "dir", "out", "frame_bytes", frameLen, "queue_wait", queueWait,
+		"write", write, "err", err, "payload", string(shown))
+}
+
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key, err := ws.CheckUpgrade(r)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := selectProtocol(r.Header.Get("Sec-WebSocket-Protocol"))
+	if err != nil {
+		return nil, err
+	}
+	if proto != protoLegacy {
+		w.Header().Set("Sec-WebSocket-Protocol", proto)
+	}
+	exts, extHeader := ws.NegotiateExtensions(r.Header.Get("Sec-WebSocket-Extensions"))
+	if extHeader != "" {
+		w.Header().Set("Sec-WebSocket-Extensions", extHeader)
+	}
+	conn, br, err := ws.Hijack(w, key)
+	if err != nil {
+		return nil, err
+	}
+	sockets.tune(conn)
+	return &Conn{
+		conn:        conn,
+		id:          requestIDFrom(r.Context()),
+		remote:      r.RemoteAddr,
+		connectedAt: time.Now(),
+		proto:       proto,
+		tenant:      tenantFromRequest(r),
+		exts:        exts,
+		br:          br,
+	}, nil
+}
@@ -0,0 +1,183 @@
+package hub
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// controlServer serves the admin API on a port of its own
+// (PULSE_CONTROL_ADDR), so an operator can still pause, drain or retune
+// when the data plane is saturated: its listener is not the one thousands
+// of clients are queued on, none of the client limits, handshake pacing or
+// per-IP rates apply to it, and it keeps a file descriptor in reserve to
+// accept with when the process has run out. Only the admin API, status
+// and health are served there, behind the same credentials, and at most
+// maxControlConns connections at once so it cannot become a second data
+// plane.
+type controlServer struct {
+	addr    string
+	handler http.Handler
+	tls     *tls.Config
+	limits  httpLimits
+
+	mu     sync.Mutex
+	srv    *http.Server
+	closed bool
+}
+
+// maxControlConns bounds the control port's connections, allocated up
+// front.
+const maxControlConns = 16
+
+// controlPath reports whether path is served on the control port.
+func controlPath(path string) bool {
+	switch path {
+	case "/status", "/api/status", "/api/config", "/healthz", "/readyz":
+		return true
+	}
+	return strings.HasPrefix(path, "/admin/")
+}
+
+// start listens on s.addr, retrying in the background after an upgrade
+// while the old process still holds the port, as gRPC does.
+func (s *controlServer) start() error {
+	s.srv = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !controlPath(r.URL.Path) {
+				http.NotFound(w, r)
+				return
+			}
+			s.handler.ServeHTTP(w, r)
+		}),
+		TLSConfig: s.tls,
+	}
+	s.limits.apply(s.srv, false)
+	ln, err := net.Listen("tcp", s.addr)
+	if err == nil {
+		go s.serve(ln)
+		return nil
+	}
+	if !handedOver() {
+		return err
+	}
+	go func() {
+		for deadline := time.Now().Add(handoffTimeout); time.Now().Before(deadline); {
+			time.Sleep(50 * time.Millisecond)
+			if ln, err = net.Listen("tcp", s.addr); err == nil {
+				s.serve(ln)
+				return
+			}
+		}
+		slog.Error("control", "err", err)
+	}()
+	return nil
+}
+
+func (s *controlServer) serve(ln net.Listener) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return
+	}
+	s.mu.Unlock()
+	slog.Info("control: listening", "addr", ln.Addr().String(), "tls", s.tls != nil)
+	ln = newControlListener(ln)
+	var err error
+	if s.tls != nil {
+		err = s.srv.ServeTLS(ln, "", "")
+	} else {
+		err = s.srv.Serve(ln)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("control", "err", err)
+	}
+}
+
+// close stops the control port, letting requests in progress finish. A
+// nil controlServer ignores it.
+func (s *controlServer) close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_ = s.srv.Shutdown(ctx)
+}
+
+// controlListener admits at most maxControlConns connections and accepts
+// with a reserved descriptor when the process has none left.
+type controlListener struct {
+	net.Listener
+	slots chan struct{}
+
+	mu      sync.Mutex
+	reserve *os.File
+}
+
+func newControlListener(ln net.Listener) *controlListener {
+	l := &controlListener{Listener: ln, slots: make(chan struct{}, maxControlConns)}
+	l.reserve, _ = os.Open(os.DevNull)
+	return l
+}
+
+func (l *controlListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+			// Out of descriptors: give up the reserve to take this one.
+			l.mu.Lock()
+			if l.reserve != nil {
+				l.reserve.Close()
+				l.reserve = nil
+				l.mu.Unlock()
+				slog.Warn("control: out of file descriptors, accepting with the reserve")
+				continue
+			}
+			l.mu.Unlock()
+		}
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case l.slots <- struct{}{}:
+			return &controlConn{Conn: conn, l: l}, nil
+		default:
+			conn.Close()
+		}
+	}
+}
+
+// release frees a slot and takes the reserve back if it was used.
+func (l *controlListener) release() {
+	<-l.slots
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.reserve == nil {
+		l.reserve, _ = os.Open(os.DevNull)
+	}
+}
+
+type controlConn struct {
+	net.Conn
+	l    *controlListener
+	once sync.Once
+}
+
+func (c *controlConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.l.release)
+	return err
+}
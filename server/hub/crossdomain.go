@@ -0,0 +1,197 @@
+package hub
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"pulse/clock"
+)
+
+// Relating clock domains. Each domain keeps time in its own units: a free
+// domain the server's monotonic seconds (mono_ms / 1000), an ntp domain
+// the host's wall clock in Unix seconds, and link and midi domains their
+// source's beats. Every time its source disciplines it, a domain samples
+// its time against the server's monotonic clock and fits a line through
+// the latest samples: the measured offset and rate. Composing two lines
+// relates any two domains, to = offset + rate * from, so a client bridging
+// them, e.g. recording house audio against the show's beats, can convert
+// timestamps. GET /api/domains reports the lines and the relations, and
+// with PULSE_DOMAIN_TIMES pulses carry every domain's time at their beat.
+const (
+	domainUnitSeconds = "s"
+	domainUnitBeats   = "beat"
+
+	// fitSamples is how many of a domain's latest samples its line is
+	// fitted through.
+	fitSamples = 32
+)
+
+// domainFit is a least-squares line through a domain's latest samples,
+// its time against the server's monotonic clock.
+type domainFit struct {
+	mu      sync.Mutex
+	samples []domainSample
+	// The line: the domain's time was at at ref and advances rate per
+	// second; residual is the RMS distance of the samples from it.
+	ref      time.Time
+	at       float64
+	rate     float64
+	residual float64
+}
+
+type domainSample struct {
+	t time.Time
+	v float64
+}
+
+// add records that the domain's time was v at t and fits the line again.
+func (f *domainFit) add(t time.Time, v float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.samples = append(f.samples, domainSample{t, v}); len(f.samples) > fitSamples {
+		f.samples = f.samples[1:]
+	}
+	n := float64(len(f.samples))
+	if n < 2 {
+		return
+	}
+	// Centred on the first sample, so that Unix seconds keep their
+	// precision.
+	first := f.samples[0]
+	var sx, sy, sxx, sxy float64
+	for _, s := range f.samples {
+		x, y := s.t.Sub(first.t).Seconds(), s.v-first.v
+		sx, sy, sxx, sxy = sx+x, sy+y, sxx+x*x, sxy+x*y
+	}
+	den := n*sxx - sx*sx
+	if den == 0 {
+		return
+	}
+	rate := (n*sxy - sx*sy) / den
+	base := (sy - rate*sx) / n
+	var ss float64
+	for _, s := range f.samples {
+		d := s.v - first.v - (base + rate*s.t.Sub(first.t).Seconds())
+		ss += d * d
+	}
+	last := f.samples[len(f.samples)-1]
+	f.ref, f.rate, f.residual = last.t, rate, math.Sqrt(ss/n)
+	f.at = first.v + base + rate*last.t.Sub(first.t).Seconds()
+}
+
+// reset forgets the samples after the domain's time jumped.
+func (f *domainFit) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.samples, f.ref = nil, time.Time{}
+}
+
+// unit is what the domain's time counts.
+func (d *clockDomain) unit() string {
+	if d.source == domainLink || d.source == domainMIDI {
+		return domainUnitBeats
+	}
+	return domainUnitSeconds
+}
+
+// timeAt returns the domain's time at t and its rate per server second,
+// false until its line is known.
+func (d *clockDomain) timeAt(t time.Time) (v, rate float64, ok bool) {
+	if d.source == domainFree {
+		return t.Sub(clock.Start).Seconds(), 1, true
+	}
+	d.fit.mu.Lock()
+	defer d.fit.mu.Unlock()
+	if d.fit.ref.IsZero() {
+		return 0, 0, false
+	}
+	return d.fit.at + d.fit.rate*t.Sub(d.fit.ref).Seconds(), d.fit.rate, true
+}
+
+// domainLine reports a domain's line in GET /api/domains: its Time at
+// now_ms, counting Unit, advancing Rate per second of the server's clock,
+// with the samples' RMS distance from it in Residual. An unlocked
+// domain's line is its last.
+type domainLine struct {
+	Name     string   `json:"name"`
+	Source   string   `json:"source"`
+	State    string   `json:"state"`
+	Unit     string   `json:"unit"`
+	Time     *float64 `json:"time,omitempty"`
+	Rate     *float64 `json:"rate,omitempty"`
+	Residual float64  `json:"residual,omitempty"`
+	Samples  int      `json:"samples,omitempty"`
+}
+
+// domainRelation converts From's time into To's: to = offset + rate *
+// from.
+type domainRelation struct {
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	Rate   float64 `json:"rate"`
+	Offset float64 `json:"offset"`
+}
+
+type domainsResponse struct {
+	NowMS     int64            `json:"now_ms"`
+	Domains   []domainLine     `json:"domains"`
+	Relations []domainRelation `json:"relations"`
+}
+
+// relate returns the relation from a to b at now, false until both lines
+// are known.
+func relate(a, b *clockDomain, now time.Time) (domainRelation, bool) {
+	va, ra, okA := a.timeAt(now)
+	vb, rb, okB := b.timeAt(now)
+	if !okA || !okB || ra == 0 {
+		return domainRelation{}, false
+	}
+	rate := rb / ra
+	return domainRelation{From: a.name, To: b.name, Rate: rate, Offset: vb - rate*va}, true
+}
+
+// domainsHandler serves GET /api/domains: every domain's line and the
+// relation between each pair, the earlier name first.
+func domainsHandler(h *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		now := time.Now()
+		resp := domainsResponse{NowMS: now.UnixMilli(), Domains: make([]domainLine, 0, len(h.domains)), Relations: []domainRelation{}}
+		for i, d := range h.domains {
+			st := d.status(now)
+			line := domainLine{Name: d.name, Source: st.Source, State: st.State, Unit: d.unit()}
+			if v, rate, ok := d.timeAt(now); ok {
+				line.Time, line.Rate = &v, &rate
+			}
+			d.fit.mu.Lock()
+			line.Residual, line.Samples = d.fit.residual, len(d.fit.samples)
+			d.fit.mu.Unlock()
+			resp.Domains = append(resp.Domains, line)
+			for _, o := range h.domains[i+1:] {
+				if rel, ok := relate(d, o, now); ok {
+					resp.Relations = append(resp.Relations, rel)
+				}
+			}
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// domainTimes adds domains, every domain's time at the pulse's beat, to
+// pulses, for PULSE_DOMAIN_TIMES.
+func (h *Hub) domainTimes(msg PulseMessage) map[string]any {
+	if msg.Beat.IsZero() {
+		return nil
+	}
+	times := make(map[string]float64, len(h.domains))
+	for _, d := range h.domains {
+		if v, _, ok := d.timeAt(msg.Beat); ok {
+			times[d.name] = math.Round(v*1e6) / 1e6
+		}
+	}
+	if len(times) == 0 {
+		return nil
+	}
+	return map[string]any{"domains": times}
+}
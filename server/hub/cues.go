@@ -0,0 +1,274 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// Cues are events that must happen on every client or on none, such as a
+// lighting change or the start of a show. POST /admin/cues prepares one for
+// a pulse: the server broadcasts cue_prepare to the channel, clients that
+// can act on it answer {"type":"cue_ready","id":…}, and the server decides
+// before the pulse is due. It commits as soon as every client asked is
+// ready, or when the pulse before the cue's goes out if enough of them are
+// (quorum); otherwise it aborts. Either way it broadcasts the outcome,
+// cue_commit or cue_abort, so no client acts on a cue others will miss.
+
+// maxCuePayload bounds a cue's payload; it describes the cue, it is not
+// the media.
+const maxCuePayload = 4 << 10
+
+// cueBody is POST /admin/cues:
+// {"channel":"default","seq":1200,"payload":{"scene":4},"quorum":0.9}.
+// Channel defaults to the default channel, and ID to a generated one.
+// Quorum is the share of clients that must be ready to commit at the
+// deadline, all by default.
+type cueBody struct {
+	ID      string          `json:"id,omitempty"`
+	Channel string          `json:"channel,omitempty"`
+	Seq     uint64          `json:"seq"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Quorum  float64         `json:"quorum,omitempty"`
+}
+
+// cuePrepareMessage asks a channel's clients to get ready for a cue at
+// pulse seq. The decision is made by the time pulse decide_seq goes out.
+type cuePrepareMessage struct {
+	Type      string          `json:"type"`
+	ID        string          `json:"id"`
+	Channel   string          `json:"channel"`
+	Seq       uint64          `json:"seq"`
+	DecideSeq uint64          `json:"decide_seq"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+// cueReadyMessage is a client's vote that it can carry out cue ID.
+type cueReadyMessage struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// cueOutcomeMessage is broadcast once a cue is decided: "cue_commit" to
+// carry it out at seq, "cue_abort" not to. Ready of Expected clients were
+// ready.
+type cueOutcomeMessage struct {
+	Type     string `json:"type"`
+	ID       string `json:"id"`
+	Channel  string `json:"channel"`
+	Seq      uint64 `json:"seq"`
+	Ready    int    `json:"ready"`
+	Expected int    `json:"expected"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// cueState is a pending cue in GET /admin/cues.
+type cueState struct {
+	cuePrepareMessage
+	Quorum   float64 `json:"quorum"`
+	Ready    int     `json:"ready"`
+	Expected int     `json:"expected"`
+}
+
+// pendingCue is a prepared cue awaiting its decision. voters are the
+// clients asked, true once ready; clients that leave stop counting.
+type pendingCue struct {
+	prepare cuePrepareMessage
+	quorum  float64
+	voters  map[*Conn]bool
+}
+
+// cues keeps the cues prepared and not yet decided.
+type cues struct {
+	h *Hub
+
+	mu      sync.Mutex
+	pending []*pendingCue
+}
+
+// prepare validates body and broadcasts the cue's prepare message.
+func (q *cues) prepare(body cueBody) (cuePrepareMessage, error) {
+	if body.Channel == "" {
+		body.Channel = defaultChannel
+	}
+	if body.ID == "" {
+		body.ID = newRequestID()[:12]
+	}
+	if body.Quorum == 0 {
+		body.Quorum = 1
+	}
+	ch := q.h.channel(body.Channel)
+	msg := cuePrepareMessage{Type: "cue_prepare", ID: body.ID, Channel: body.Channel, Seq: body.Seq, DecideSeq: body.Seq - 1, Payload: body.Payload}
+	switch {
+	case ch == nil:
+		return msg, fmt.Errorf("unknown channel %q", body.Channel)
+	case len(body.Payload) > maxCuePayload:
+		return msg, fmt.Errorf("payload must be at most %d bytes", maxCuePayload)
+	case body.Quorum < 0 || body.Quorum > 1:
+		return msg, fmt.Errorf("quorum must be in (0, 1]")
+	}
+	// The cue must leave a pulse to decide on.
+	if last := ch.last.Load(); last != nil && body.Seq < last.seq+2 {
+		return msg, fmt.Errorf("seq must be at least %d, two pulses from now", last.seq+2)
+	} else if last == nil && body.Seq < 1 {
+		return msg, fmt.Errorf("seq must be at least 1")
+	}
+
+	p := &pendingCue{prepare: msg, quorum: body.Quorum, voters: make(map[*Conn]bool)}
+	q.h.mu.RLock()
+	for c := range q.h.conns {
+		if c.votes(ch.name) {
+			p.voters[c] = false
+		}
+	}
+	q.h.mu.RUnlock()
+	q.mu.Lock()
+	if slices.ContainsFunc(q.pending, func(p *pendingCue) bool { return p.prepare.ID == msg.ID }) {
+		q.mu.Unlock()
+		return msg, fmt.Errorf("cue %q is already pending", msg.ID)
+	}
+	q.pending = append(q.pending, p)
+	q.mu.Unlock()
+
+	slog.Info("cue prepared", "id", msg.ID, "channel", msg.Channel, "seq", msg.Seq, "clients", len(p.voters))
+	q.h.BroadcastIf(msg, func(c *Conn) bool { return c.receives(msg.Channel) })
+	// Nobody to wait for: the cue is as ready as it will get.
+	q.ready(nil, msg.ID)
+	return msg, nil
+}
+
+// votes reports whether c is asked to be ready for the cues of channel:
+// clients of it that can answer, not SSE, gRPC or WebTransport clients
+// or relays.
+func (c *Conn) votes(channel string) bool {
+	return !c.internal && !c.sse && !c.grpc && !c.datagram && c.proto != protoLegacy && c.proto != protoRelay && c.Channel() == channel
+}
+
+// ready records c as ready for cue id and commits it once every client
+// still connected is. A nil c only checks.
+func (q *cues) ready(c *Conn, id string) {
+	q.mu.Lock()
+	i := slices.IndexFunc(q.pending, func(p *pendingCue) bool { return p.prepare.ID == id })
+	if i < 0 {
+		q.mu.Unlock()
+		return
+	}
+	p := q.pending[i]
+	if _, ok := p.voters[c]; ok {
+		p.voters[c] = true
+	}
+	ready, expected := q.count(p)
+	if ready < expected || (c != nil && !p.voters[c]) {
+		q.mu.Unlock()
+		return
+	}
+	q.pending = slices.Delete(q.pending, i, i+1)
+	q.mu.Unlock()
+	q.decide(p, ready, expected, "")
+}
+
+// pulse decides the cues of channel due after pulse seq, which has just
+// gone out.
+func (q *cues) pulse(channel string, seq uint64) {
+	q.mu.Lock()
+	var due []*pendingCue
+	q.pending = slices.DeleteFunc(q.pending, func(p *pendingCue) bool {
+		if p.prepare.Channel != channel || p.prepare.DecideSeq > seq {
+			return false
+		}
+		due = append(due, p)
+		return true
+	})
+	type tally struct{ ready, expected int }
+	counts := make([]tally, len(due))
+	for i, p := range due {
+		counts[i].ready, counts[i].expected = q.count(p)
+	}
+	q.mu.Unlock()
+	for i, p := range due {
+		reason := ""
+		if float64(counts[i].ready) < p.quorum*float64(counts[i].expected) {
+			reason = "quorum not ready"
+		}
+		if p.prepare.Seq <= seq {
+			reason = "deadline passed"
+		}
+		q.decide(p, counts[i].ready, counts[i].expected, reason)
+	}
+}
+
+// cancel aborts cue id, reporting whether it was pending.
+func (q *cues) cancel(id string) bool {
+	q.mu.Lock()
+	i := slices.IndexFunc(q.pending, func(p *pendingCue) bool { return p.prepare.ID == id })
+	if i < 0 {
+		q.mu.Unlock()
+		return false
+	}
+	p := q.pending[i]
+	q.pending = slices.Delete(q.pending, i, i+1)
+	ready, expected := q.count(p)
+	q.mu.Unlock()
+	q.decide(p, ready, expected, "cancelled")
+	return true
+}
+
+// count returns how many of p's clients still connected are ready, and how
+// many are still connected. The caller holds q.mu.
+func (q *cues) count(p *pendingCue) (ready, expected int) {
+	q.h.mu.RLock()
+	defer q.h.mu.RUnlock()
+	for c, ok := range p.voters {
+		if _, connected := q.h.conns[c]; !connected {
+			continue
+		}
+		expected++
+		if ok {
+			ready++
+		}
+	}
+	return ready, expected
+}
+
+// decide broadcasts p's outcome: a commit without a reason, else an abort.
+func (q *cues) decide(p *pendingCue, ready, expected int, reason string) {
+	msg := cueOutcomeMessage{Type: "cue_commit", ID: p.prepare.ID, Channel: p.prepare.Channel, Seq: p.prepare.Seq, Ready: ready, Expected: expected, Reason: reason}
+	if reason != "" {
+		msg.Type = "cue_abort"
+		slog.Warn("cue aborted", "id", msg.ID, "channel", msg.Channel, "seq", msg.Seq, "ready", ready, "expected", expected, "reason", reason)
+	} else {
+		slog.Info("cue committed", "id", msg.ID, "channel", msg.Channel, "seq", msg.Seq, "ready", ready, "expected", expected)
+	}
+	q.h.BroadcastIf(msg, func(c *Conn) bool { return c.receives(msg.Channel) })
+}
+
+// current returns the prepares pending for c's channel, for clients that
+// connect after them; they are told the outcome but not asked.
+func (q *cues) current(c *Conn) []cuePrepareMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var out []cuePrepareMessage
+	for _, p := range q.pending {
+		if c.receives(p.prepare.Channel) {
+			out = append(out, p.prepare)
+		}
+	}
+	return out
+}
+
+// handler serves GET /admin/cues, the pending cues.
+func (q *cues) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		q.mu.Lock()
+		out := make([]cueState, 0, len(q.pending))
+		for _, p := range q.pending {
+			ready, expected := q.count(p)
+			out = append(out, cueState{cuePrepareMessage: p.prepare, Quorum: p.quorum, Ready: ready, Expected: expected})
+		}
+		q.mu.Unlock()
+		writeJSON(w, http.StatusOK, out)
+	}
+}
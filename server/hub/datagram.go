@@ -0,0 +1,195 @@
+package hub
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Datagram delivery is for latency-sensitive browser clients on lossy
+// links, where a pulse stuck behind a lost TCP segment arrives late and
+// skews timing: over WebTransport, each pulse goes out as one unreliable
+// HTTP/3 datagram, and a lost one is simply missing, which seq shows.
+// HTTP/3 runs over QUIC, which the standard library does not implement, so
+// the stock binary serves no WebTransport; an embedder that links a QUIC
+// library registers a DatagramServer, and the rest (channels, auth, fan-out,
+// quotas) is the hub's. /ws stays the fallback for browsers without
+// WebTransport.
+
+// DatagramSession is a session that can send unreliable datagrams, such as
+// a WebTransport session; webtransport-go's *Session satisfies it. The
+// session ends when its context does.
+type DatagramSession interface {
+	SendDatagram(b []byte) error
+	Context() context.Context
+}
+
+// maxDatagram bounds the datagrams sent; QUIC guarantees at least 1200
+// bytes a packet, and a pulse that does not fit is dropped rather than
+// fragmented.
+const maxDatagram = 1200
+
+// datagramServer, when set, is started by Main to serve WebTransport.
+var datagramServer func(ctx context.Context, h *Hub, tlsConfig *tls.Config) error
+
+// RegisterDatagramServer installs a WebTransport server. Embedders call it
+// before Main, e.g. from an init func; Main runs fn once the server is
+// listening, with the server's TLS config (nil without PULSE_TLS_CERT),
+// and stops the server if fn fails. fn upgrades sessions and hands them to
+// h.ServeDatagrams:
+//
+//	func init() {
+//		hub.RegisterDatagramServer(func(ctx context.Context, h *hub.Hub, tlsConfig *tls.Config) error {
+//			mux := http.NewServeMux()
+//			s := &webtransport.Server{H3: http3.Server{Addr: ":4433", TLSConfig: tlsConfig, Handler: mux}}
+//			mux.HandleFunc("/wt/{channel}", func(w http.ResponseWriter, r *http.Request) {
+//				h.ServeDatagrams(w, r, func() (hub.DatagramSession, error) { return s.Upgrade(w, r) })
+//			})
+//			go func() { <-ctx.Done(); s.Close() }()
+//			return s.ListenAndServe()
+//		})
+//	}
+func RegisterDatagramServer(fn func(ctx context.Context, h *Hub, tlsConfig *tls.Config) error) {
+	datagramServer = fn
+}
+
+// ServeDatagrams admits a WebTransport client as /ws would: the channel is
+// the request's {channel} path value ("default" if none), and origins,
+// client credentials and client limits apply. If r is admitted, upgrade
+// accepts the session, and ServeDatagrams sends it the channel's pulses,
+// one datagram each, until the session ends. A datagram holds the channel
+// name, prefixed by its length in one byte, then the pulse as
+// pulse.v2+tagged, the format multicast datagrams have.
+func (h *Hub) ServeDatagrams(w http.ResponseWriter, r *http.Request, upgrade func() (DatagramSession, error)) {
+	if ok, wait := h.limits.allowUpgrade(r.RemoteAddr); !ok {
+		h.limits.rejectRate(w, r, wait)
+		return
+	}
+	ch := h.channel(defaultChannel)
+	if name := r.PathValue("channel"); name != "" {
+		if ch = h.channel(name); ch == nil {
+			http.Error(w, fmt.Sprintf("unknown channel %q", name), http.StatusNotFound)
+			return
+		}
+	}
+	rate, err := parseRate(r.URL.Query().Get("rate"))
+	if err == nil && !ch.offers(rate) {
+		err = fmt.Errorf("channel %q has no rate %d", ch.name, rate)
+	}
+	every, everyErr := parseEvery(r.URL.Query().Get("every"))
+	if err == nil {
+		err = everyErr
+	}
+	micros, precisionErr := parsePrecision(r.URL.Query().Get("precision"))
+	if err == nil {
+		err = precisionErr
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.origins.allow(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	subject, err := h.subscribers.authenticate(r, h.auth)
+	if err != nil {
+		rejectUnauthenticated(w, r, err)
+		return
+	}
+	leave, ok := h.limits.acquire()
+	if !ok {
+		h.limits.rejectFull(w, r)
+		return
+	}
+	defer leave()
+	session, err := upgrade()
+	if err != nil {
+		connLog.log(slog.LevelWarn, "webtransport upgrade failed", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+
+	server, client := net.Pipe()
+	c := &Conn{
+		conn:        server,
+		id:          requestIDFrom(r.Context()),
+		remote:      r.RemoteAddr,
+		connectedAt: time.Now(),
+		proto:       protoJSON,
+		tenant:      tenantFromRequest(r),
+		subject:     subject,
+		datagram:    true,
+	}
+	if c.id == "" {
+		c.id = newRequestID()
+	}
+	c.ch.Store(ch)
+	c.rate.Store(rate)
+	c.every.Store(every)
+	c.micros.Store(micros)
+
+	// Forward the pulses the hub writes into the pipe; reading also keeps
+	// keepalive from evicting a session that cannot answer pings.
+	ended := make(chan error, 1)
+	go func() {
+		defer client.Close()
+		br := bufio.NewReader(client)
+		for {
+			payload, err := readServerFrame(br)
+			if err != nil {
+				ended <- err
+				return
+			}
+			c.lastRead.Store(time.Now().UnixNano())
+			var msg PulseMessage
+			if json.Unmarshal(payload, &msg) != nil || msg.Type != "pulse" {
+				continue
+			}
+			msg.Channel = c.Channel()
+			b, err := encodePulseDatagram(msg)
+			if err != nil || len(b) > maxDatagram {
+				connLog.log(slog.LevelWarn, "webtransport: pulse does not fit a datagram", "seq", msg.Seq, "channel", msg.Channel, "err", err)
+				continue
+			}
+			// A datagram the session cannot take is lost, like one the
+			// network loses; only a closed session ends the stream.
+			if err := session.SendDatagram(b); err != nil && session.Context().Err() != nil {
+				ended <- err
+				return
+			}
+		}
+	}()
+	h.add(c)
+	connLog.log(churnLevel(), "client connected", "request_id", c.id, "remote", c.remote, "subject", c.subject, "proto", "webtransport", "tenant", c.tenant, "channel", c.Channel(), "clients", h.Count())
+
+	select {
+	case <-session.Context().Done():
+		c.setCause(causeClientClose)
+		h.remove(c)
+		<-ended
+	case <-ended:
+		h.remove(c)
+	}
+	connLog.log(churnLevel(), "client disconnected", "request_id", c.id, "remote", c.remote, "clients", h.Count())
+}
+
+// encodePulseDatagram encodes msg as a multicast or WebTransport datagram.
+func encodePulseDatagram(msg PulseMessage) ([]byte, error) {
+	if len(msg.Channel) > 255 {
+		return nil, fmt.Errorf("channel name too long")
+	}
+	data, err := encodeTaggedPulse(msg)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, 1+len(msg.Channel)+len(data))
+	b = append(b, byte(len(msg.Channel)))
+	b = append(b, msg.Channel...)
+	return append(b, data...), nil
+}
@@ -0,0 +1,54 @@
+package hub
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Decimation is for low-power clients (e-ink displays, microcontrollers on
+// WiFi) that want the timing anchor but not every pulse: a client that
+// connects with ?every=N, or sends {"type":"decimate","every":N}, gets only
+// the pulses whose seq is a multiple of N, on every channel it receives.
+// Unlike a simulcast rate it needs nothing configured and the pulses are
+// not changed: period_ms and next_ms are still the channel's, and seq tells
+// the client how many it skipped, so it can interpolate the beats in
+// between. {"type":"decimate","every":1} gets every pulse again.
+
+// maxEvery bounds a client's divisor.
+const maxEvery = 3600
+
+// decimateMessage sets the connection's divisor.
+type decimateMessage struct {
+	Type  string `json:"type"`
+	Every uint64 `json:"every"`
+}
+
+// parseEvery parses a client's divisor; empty means every pulse.
+func parseEvery(s string) (uint64, error) {
+	if s == "" {
+		return 1, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n == 0 || n > maxEvery {
+		return 0, fmt.Errorf("every must be a whole number of pulses from 1 to %d", maxEvery)
+	}
+	return n, nil
+}
+
+// admits reports whether c gets the pulse numbered seq under its divisor.
+func (c *Conn) admits(seq uint64) bool {
+	every := c.every.Load()
+	return every <= 1 || seq%every == 0
+}
+
+// decimate sets c's divisor to every.
+func (h *Hub) decimate(c *Conn, every uint64) error {
+	if every == 0 || every > maxEvery {
+		return fmt.Errorf("every must be a whole number of pulses from 1 to %d", maxEvery)
+	}
+	if c.proto == protoRelay {
+		return fmt.Errorf("relay connections receive every pulse")
+	}
+	c.every.Store(every)
+	return c.WriteJSON(h.subscriptions(c, ""))
+}
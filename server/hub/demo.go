@@ -0,0 +1,21 @@
+package hub
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// demoHTML is a browser client served at / so a deployment can be checked
+// without writing a client: it flashes on every pulse and shows drift,
+// jitter, latency and the clock offset it measured.
+//
+//go:embed demo.html
+var demoHTML []byte
+
+func demoHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		_, _ = w.Write(demoHTML)
+	}
+}
@@ -0,0 +1,68 @@
+package hub
+
+import (
+	"log/slog"
+	"time"
+
+	"pulse/ws"
+)
+
+// diagnosticsWait is how long a new client has to answer the ping that
+// measures its handshake RTT before its diagnostics go out without one.
+const diagnosticsWait = 2 * time.Second
+
+// diagnosticsMessage tells a new client how its connection was set up, so
+// its logs carry what a support ticket needs:
+// {"type":"diagnostics","codec":"pulse.v2+json","handshake_rtt_ms":23.4,…}.
+type diagnosticsMessage struct {
+	Type      string `json:"type"`
+	RequestID string `json:"request_id"`
+	// Codec is the negotiated subprotocol and Extensions the negotiated
+	// WebSocket extensions.
+	Codec      string   `json:"codec"`
+	Extensions []string `json:"extensions,omitempty"`
+	// HandshakeRTTMS is the round trip of a ping sent right after the
+	// hello; absent if the client did not answer within diagnosticsWait.
+	HandshakeRTTMS *float64 `json:"handshake_rtt_ms,omitempty"`
+	// Tier is the client's role, "subscriber" without admin credentials,
+	// and Tenant what its bandwidth is accounted to.
+	Tier   string `json:"tier"`
+	Tenant string `json:"tenant,omitempty"`
+	// QueueSize is how many frames the client's write queue holds, and
+	// KeepaliveMS how often it is pinged; absent with keepalive off.
+	QueueSize   int   `json:"queue_size"`
+	KeepaliveMS int64 `json:"keepalive_ms,omitempty"`
+}
+
+// diagnose pings c, a new WebSocket client in the hub, and sends it its
+// diagnostics once the pong is in or diagnosticsWait has passed.
+func (h *Hub) diagnose(c *Conn) {
+	if err := c.writeFrame(ws.OpPing, pingPayload(time.Now())); err != nil {
+		return
+	}
+	select {
+	case <-c.rtt.firstSample():
+	case <-time.After(diagnosticsWait):
+	}
+	m := diagnosticsMessage{
+		Type:        "diagnostics",
+		RequestID:   c.id,
+		Codec:       c.proto,
+		Tier:        "subscriber",
+		Tenant:      c.tenant,
+		QueueSize:   h.queue.size,
+		KeepaliveMS: h.pingInterval.Milliseconds(),
+	}
+	for _, e := range c.exts {
+		m.Extensions = append(m.Extensions, e.Name())
+	}
+	if c.role > roleNone {
+		m.Tier = c.role.String()
+	}
+	if s := c.rtt.snapshot(); s != nil {
+		m.HandshakeRTTMS = &s.LastMS
+	}
+	if err := c.WriteJSON(m); err != nil {
+		slog.Debug("diagnostics", "request_id", c.id, "err", err)
+	}
+}
@@ -0,0 +1,66 @@
+package hub
+
+import "log/slog"
+
+// End of stream. When a channel's pulses stop for good, rather than
+// pausing, the server tells the channel's clients
+//
+//	{"type":"end","channel":"song","final_seq":95,"reason":"retired","successor":"default"}
+//
+// so they stop predicting beats after final_seq instead of waiting for a
+// pulse that never comes and reconnecting. reason says why: "retired" when
+// an admin retired the channel (see retire.go), unless they gave a reason
+// of their own such as "song_over", and "replay_finished" when the
+// recording being replayed ran out (see recording.go). successor, if set,
+// is the channel the client is being moved to. A client that connects to
+// a channel that has ended gets end right after its hello.
+
+// End reasons set by the server.
+const (
+	endRetired        = "retired"
+	endReplayFinished = "replay_finished"
+)
+
+// endMessage tells a channel's clients that pulse final_seq was its last.
+type endMessage struct {
+	Type      string `json:"type"`
+	Channel   string `json:"channel"`
+	FinalSeq  uint64 `json:"final_seq"`
+	Reason    string `json:"reason"`
+	Successor string `json:"successor,omitempty"`
+}
+
+// endChannel records that ch has ended with msg and tells its clients.
+func (h *Hub) endChannel(ch *pulseChannel, msg endMessage) {
+	msg.Type, msg.Channel = "end", ch.name
+	ch.ended.Store(&msg)
+	slog.Info("channel ended", "channel", ch.name, "final_seq", msg.FinalSeq, "reason", msg.Reason)
+	h.tellChannel(ch, msg)
+}
+
+// relayEnd takes in the end of ch an upstream announced. A channel the
+// upstream retired is retired here too, moving its clients on.
+func (h *Hub) relayEnd(ch *pulseChannel, msg endMessage) {
+	if ch.ended.Load() != nil {
+		return
+	}
+	if h.channel(msg.Successor) == nil {
+		msg.Successor = ""
+	}
+	if ch.retiring.Load() != nil {
+		h.finishRetirement(ch, &retirement{finalSeq: msg.FinalSeq, successor: msg.Successor, reason: msg.Reason})
+		return
+	}
+	h.endChannel(ch, msg)
+}
+
+// endReplay ends every channel the replay pulsed, once the recording has
+// run out.
+func (h *Hub) endReplay() {
+	for _, name := range h.channelNames() {
+		ch := h.channel(name)
+		if a := ch.last.Load(); a != nil {
+			h.endChannel(ch, endMessage{FinalSeq: a.seq, Reason: endReplayFinished})
+		}
+	}
+}
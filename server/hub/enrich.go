@@ -0,0 +1,121 @@
+package hub
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+)
+
+// Enricher computes extra fields for an outgoing pulse, e.g. the
+// current game tick or lighting scene. It runs once per broadcast on the
+// pulse loop, so it must be fast; the result is merged into the pulse for
+// every client that gets extension fields.
+type Enricher func(msg PulseMessage) map[string]any
+
+type namedEnricher struct {
+	name string
+	fn   Enricher
+}
+
+var (
+	enrichersMu sync.RWMutex
+	enrichers   []namedEnricher
+)
+
+// RegisterEnricher adds an enricher. Embedders call it before Start, e.g.
+// from an init func; enrichers run in registration order and later ones win
+// on key conflicts.
+func RegisterEnricher(name string, fn Enricher) {
+	enrichersMu.Lock()
+	defer enrichersMu.Unlock()
+	enrichers = append(enrichers, namedEnricher{name, fn})
+}
+
+// enrich runs all enrichers for msg and encodes their fields once. A
+// panicking enricher or an unencodable value is logged and skipped rather
+// than costing every client the pulse.
+func enrich(msg PulseMessage) map[string]json.RawMessage {
+	enrichersMu.RLock()
+	defer enrichersMu.RUnlock()
+	var extra map[string]json.RawMessage
+	for _, e := range enrichers {
+		fields := runEnricher(e, msg)
+		for k, v := range fields {
+			if reservedPulseField(k) {
+				continue
+			}
+			b, err := json.Marshal(v)
+			if err != nil {
+				slog.Error("enricher field", "enricher", e.name, "field", k, "err", err)
+				continue
+			}
+			if extra == nil {
+				extra = make(map[string]json.RawMessage, len(fields))
+			}
+			extra[k] = b
+		}
+	}
+	return extra
+}
+
+func runEnricher(e namedEnricher, msg PulseMessage) (fields map[string]any) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("enricher panicked", "enricher", e.name, "panic", r)
+			fields = nil
+		}
+	}()
+	return e.fn(msg)
+}
+
+// reservedPulseField reports whether k is a core pulse field, which
+// enrichers may not override.
+func reservedPulseField(k string) bool {
+	switch k {
+	case "type", "seq", "period_ms", "now_ms", "next_ms", "offset_ms", "drift_ms", "mono_ms", "period_changed", "at_ms", "ramp_target_ms", "ramp_pulses", "period_us", "now_us", "next_us", "at_us", "last_delay_ms":
+		return true
+	}
+	return false
+}
+
+// MarshalJSON encodes the core fields followed by any enrichment fields in
+// key order.
+func (m PulseMessage) MarshalJSON() ([]byte, error) {
+	type core PulseMessage
+	b, err := json.Marshal(core(m))
+	if err != nil || len(m.Extra) == 0 {
+		return b, err
+	}
+	extra, err := encodeExtra(m.Extra)
+	if err != nil {
+		return nil, err
+	}
+	// Splice {"core":...} and {"extra":...} into one object.
+	out := append(b[:len(b)-1:len(b)-1], ',')
+	return append(out, extra[1:]...), nil
+}
+
+// UnmarshalJSON decodes the core fields and collects the others into
+// Extra, so pulses relayed over the backplane keep their enrichment fields.
+func (m *PulseMessage) UnmarshalJSON(data []byte) error {
+	type core PulseMessage
+	var c core
+	if err := json.Unmarshal(data, &c); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for k, v := range fields {
+		if reservedPulseField(k) {
+			continue
+		}
+		if c.Extra == nil {
+			c.Extra = make(map[string]json.RawMessage, len(fields))
+		}
+		c.Extra[k] = v
+	}
+	*m = PulseMessage(c)
+	return nil
+}
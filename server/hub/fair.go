@@ -0,0 +1,100 @@
+package hub
+
+import (
+	"sort"
+	"time"
+)
+
+// fairMax and fairTolerance tune the fair_delivery feature; Main sets them
+// from PULSE_FAIR_MAX_MS and PULSE_FAIR_TOLERANCE_MS.
+var (
+	fairMax       = 150 * time.Millisecond
+	fairTolerance = time.Millisecond
+)
+
+// fairPlan holds back a pulse's writes per client so that it arrives at
+// all of a channel's clients at about the same time, for quiz and trading
+// games where being on a faster network must not pay. A client's one-way
+// latency is taken as half its smoothed keepalive RTT; everyone is delayed
+// to the slowest client's latency, up to fairMax. Clients slower than that,
+// and those without an RTT sample yet, get the pulse straight away.
+type fairPlan struct {
+	start  time.Time
+	target time.Duration
+	delay  map[*Conn]time.Duration
+	oneWay map[*Conn]time.Duration
+
+	// earliest and latest bound the estimated arrival of the pulse at the
+	// equalized clients.
+	earliest, latest time.Time
+	excluded         int
+}
+
+// planFair plans the delivery of a pulse of ch to conns, which it sorts so
+// that writes go out in delay order. No client is held back by more than
+// half a period, so a pulse never runs into the next.
+func planFair(conns []*Conn, ch *pulseChannel, start time.Time) *fairPlan {
+	p := &fairPlan{
+		start:  start,
+		delay:  make(map[*Conn]time.Duration),
+		oneWay: make(map[*Conn]time.Duration),
+	}
+	limit := min(fairMax, ch.Period()/2)
+	for _, c := range conns {
+		if c.internal || !c.receives(ch.name) {
+			continue
+		}
+		rtt, ok := c.rtt.smoothed()
+		if !ok || rtt/2 > limit {
+			p.excluded++
+			continue
+		}
+		p.oneWay[c] = rtt / 2
+		p.target = max(p.target, rtt/2)
+	}
+	for c, ow := range p.oneWay {
+		if d := p.target - ow; d >= fairTolerance {
+			p.delay[c] = d
+		}
+	}
+	sort.SliceStable(conns, func(i, j int) bool { return p.delay[conns[i]] < p.delay[conns[j]] })
+	return p
+}
+
+// wait sleeps until c's write is due.
+func (p *fairPlan) wait(c *Conn) {
+	if d := time.Until(p.start.Add(p.delay[c])); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// written records that the write to c completed at t.
+func (p *fairPlan) written(c *Conn, t time.Time) {
+	ow, ok := p.oneWay[c]
+	if !ok {
+		return
+	}
+	at := t.Add(ow)
+	if p.earliest.IsZero() || at.Before(p.earliest) {
+		p.earliest = at
+	}
+	if at.After(p.latest) {
+		p.latest = at
+	}
+}
+
+// report sums up how well the pulse was equalized.
+func (p *fairPlan) report() fairReport {
+	return fairReport{
+		clients:  len(p.oneWay),
+		excluded: p.excluded,
+		target:   p.target,
+		spread:   p.latest.Sub(p.earliest),
+	}
+}
+
+// fairReport is what pulseMetrics keeps of a fair_delivery broadcast.
+type fairReport struct {
+	clients, excluded int
+	target, spread    time.Duration
+}
@@ -0,0 +1,177 @@
+package hub
+
+import (
+	"log/slog"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// A pulse's fan-out only encodes it and queues it for each client's writer
+// (see writequeue.go), but with thousands of clients even that takes longer
+// than a short period allows when done one client after another. So the
+// clients are split into shards, queued for in parallel, and a broadcast
+// takes as long as its slowest shard. Each shard encodes the frames it
+// needs itself rather than share them under a lock.
+
+// fanoutWorkers is the most shards a broadcast is split into; Main sets it
+// from PULSE_FANOUT_WORKERS. 1 queues for all clients in turn.
+var fanoutWorkers = runtime.GOMAXPROCS(0)
+
+// fanoutShardMin is the fewest clients worth a shard of their own: below
+// it, starting a goroutine costs more than it saves.
+const fanoutShardMin = 256
+
+// fanoutShards is how many shards a broadcast to n clients is split into.
+func fanoutShards(n int) int {
+	return max(min(fanoutWorkers, (n+fanoutShardMin-1)/fanoutShardMin), 1)
+}
+
+// encodeKey tells apart the frames of one pulse: each distinct frame is
+// encoded once and its bytes are written to every connection that gets it.
+type encodeKey struct {
+	proto    string
+	offsetMS int64
+	sse      bool
+	rate     uint64
+	micros   bool
+	// labelled frames name their channel, for connections that receive
+	// several.
+	labelled bool
+}
+
+type encodedPulse struct{ payload, frame []byte }
+
+// fanout is one pulse's broadcast, shared by its shards.
+type fanout struct {
+	h      *Hub
+	msg    PulseMessage
+	start  time.Time
+	budget time.Duration
+	// views are the channel's simulcast pulses by rate; fair holds writes
+	// back with fair_delivery, which only runs in one shard.
+	views map[uint64]PulseMessage
+	fair  *fairPlan
+}
+
+// shardResult is what a shard reports of its clients.
+type shardResult struct {
+	late   []string
+	failed int
+	// done is when the shard had queued the pulse for all its clients.
+	done time.Time
+	// ok is false if the pulse could not be encoded.
+	ok bool
+}
+
+// run queues the pulse for conns, split into shards, and returns the late
+// clients and the number dropped, as broadcastPulse does, with how many
+// shards there were and how long until the slowest had finished.
+func (f *fanout) run(conns []*Conn) (late []string, failed, shards int, slowest time.Duration) {
+	begin := time.Now()
+	shards = fanoutShards(len(conns))
+	if f.fair != nil {
+		// Holding writes back is waiting, not work, and must follow the
+		// plan's order.
+		shards = 1
+	}
+	results := make([]shardResult, shards)
+	if shards == 1 {
+		results[0] = f.shard(conns)
+	} else {
+		var wg sync.WaitGroup
+		for i := range results {
+			lo, hi := i*len(conns)/shards, (i+1)*len(conns)/shards
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results[i] = f.shard(conns[lo:hi])
+			}()
+		}
+		wg.Wait()
+	}
+	for _, r := range results {
+		if !r.ok {
+			return nil, 0, shards, 0
+		}
+		late = append(late, r.late...)
+		failed += r.failed
+		slowest = max(slowest, r.done.Sub(begin))
+	}
+	return late, failed, shards, slowest
+}
+
+// shard queues the pulse for conns in turn.
+func (f *fanout) shard(conns []*Conn) shardResult {
+	msg := f.msg
+	var r shardResult
+	encoded := make(map[encodeKey]encodedPulse, len(supportedProtocols)+1)
+	for _, c := range conns {
+		if !c.receives(msg.Channel) || !c.usage.admit(msg.Seq) || !c.admits(msg.Seq) {
+			continue
+		}
+		m, rate := msg, c.rateFor(msg.Channel)
+		if rate > 1 {
+			v, ok := f.views[rate]
+			if !ok {
+				continue
+			}
+			m = v
+		}
+		if c.hasOffset.Load() {
+			o := c.offsetMS.Load()
+			m.NextMS += o - msg.OffsetMS
+			if m.NextUS != 0 {
+				m.NextUS += (o - msg.OffsetMS) * 1000
+			}
+			m.OffsetMS = o
+		}
+		micros := c.wantsMicros()
+		if !micros {
+			m = m.withoutMicros()
+		}
+		proto, labelled := c.pulseProto(), c.also.Load() != nil
+		key := encodeKey{proto, m.OffsetMS, c.sse, rate, micros, labelled}
+		op := pulseOpcode(proto)
+		e, ok := encoded[key]
+		if !ok {
+			if labelled {
+				m = labelPulse(m)
+			}
+			data, err := encodePulse(proto, m)
+			if err != nil {
+				slog.Error("marshal pulse", "err", err)
+				return r
+			}
+			e = encodedPulse{data, wireFrame(c.sse, op, data)}
+			encoded[key] = e
+		}
+		if f.fair != nil {
+			f.fair.wait(c)
+		}
+		// A pulse left queued for a whole period is stale; see
+		// writequeue.go.
+		var expires time.Time
+		if m.PeriodMS > 0 {
+			expires = f.start.Add(time.Duration(m.PeriodMS) * time.Millisecond)
+		}
+		backlog := c.queued()
+		err := c.writeEncoded(op, e.payload, e.frame, msg.Channel, expires)
+		if f.fair != nil && err == nil {
+			f.fair.written(c, time.Now())
+		}
+		if err == nil && !c.internal {
+			c.usage.pulses.Add(1)
+		}
+		if err != nil {
+			f.h.writeFailed(c, err)
+			r.failed++
+		}
+		// A client with frames still queued gets this one late too.
+		if f.budget > 0 && !c.internal && (backlog > 0 || time.Since(f.start) > f.budget) {
+			r.late = append(r.late, c.id)
+		}
+	}
+	r.done, r.ok = time.Now(), true
+	return r
+}
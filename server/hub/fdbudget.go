@@ -0,0 +1,144 @@
+package hub
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Every client holds a file descriptor, and a process that runs out of
+// them fails somewhere it cannot answer: in accept, or halfway through a
+// handshake with EMFILE. fdBudget reads the process's descriptor limit at
+// start and keeps PULSE_FD_RESERVE of them for listeners, the store, logs,
+// outgoing connections and connections still waiting for a request. Unless
+// PULSE_MAX_CLIENTS says otherwise, the rest is how many clients may
+// connect, and an upgrade is turned away with 503 like any over the limit
+// once the descriptors actually open come within the reserve, whatever
+// else took them.
+
+// fdCountInterval is how long a count of the open descriptors is used for;
+// upgrades in between add their clients to it.
+const fdCountInterval = time.Second
+
+type fdBudget struct {
+	// limit is the soft RLIMIT_NOFILE, 0 if it could not be read; reserve
+	// the descriptors clients may not take.
+	limit, reserve int
+
+	mu      sync.Mutex
+	counted time.Time
+	// open is the descriptors open when counted, -1 if they cannot be
+	// counted here, and clients the clients connected then.
+	open, clients int64
+
+	refused atomic.Uint64
+}
+
+// fdBudgetFromEnv reads the limit and PULSE_FD_RESERVE, by default a
+// quarter of the limit up to 256.
+func fdBudgetFromEnv() *fdBudget {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil || rl.Cur > 1<<30 {
+		// Unknown, or as good as unlimited.
+		return &fdBudget{}
+	}
+	limit := int(rl.Cur)
+	return &fdBudget{limit: limit, reserve: envInt("PULSE_FD_RESERVE", min(256, limit/4))}
+}
+
+// maxClients is the client limit the budget allows, leaving pending
+// connections, PULSE_MAX_PENDING_CONNS, to the reserve as well; 0 if the
+// limit is unknown.
+func (f *fdBudget) maxClients(pending int) int {
+	if f.limit == 0 {
+		return 0
+	}
+	return max(f.limit-f.reserve-max(pending, 0), 1)
+}
+
+// countFDs counts the process's open descriptors; false where it cannot.
+func countFDs() (int, bool) {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		f, err := os.Open(dir)
+		if err != nil {
+			continue
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err == nil {
+			// Less the descriptor that listed them.
+			return len(names) - 1, true
+		}
+	}
+	return 0, false
+}
+
+// estimate is the descriptors open now, going by the latest count and the
+// clients that came and went since; false if they cannot be counted.
+func (f *fdBudget) estimate(clients int64) (int64, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if now := time.Now(); now.Sub(f.counted) >= fdCountInterval {
+		f.open, f.clients, f.counted = -1, clients, now
+		if n, ok := countFDs(); ok {
+			f.open = int64(n)
+		}
+	}
+	if f.open < 0 {
+		return 0, false
+	}
+	return f.open + clients - f.clients, true
+}
+
+// exhausted reports whether another client would eat into the reserve,
+// with clients connected; a nil budget never is.
+func (f *fdBudget) exhausted(clients int64) bool {
+	if f == nil || f.limit == 0 {
+		return false
+	}
+	open, ok := f.estimate(clients)
+	if !ok || open < int64(f.limit-f.reserve) {
+		return false
+	}
+	f.refused.Add(1)
+	return true
+}
+
+// log reports the budget at start.
+func (f *fdBudget) log(maxClients int) {
+	if f.limit == 0 {
+		slog.Info("file descriptor limit unknown; PULSE_MAX_CLIENTS is the only client limit")
+		return
+	}
+	slog.Info("file descriptor budget", "limit", f.limit, "reserve", f.reserve, "max_clients", maxClients)
+	if maxClients == 0 || maxClients > f.limit-f.reserve {
+		slog.Warn("PULSE_MAX_CLIENTS allows more clients than there are file descriptors for; upgrades are turned away as they run out", "max_clients", maxClients, "fds_for_clients", f.limit-f.reserve)
+	}
+}
+
+// write appends the descriptor metrics to b; nothing if f is nil or the
+// limit unknown.
+func (f *fdBudget) write(b *strings.Builder, clients int64) {
+	if f == nil || f.limit == 0 {
+		return
+	}
+	b.WriteString("# HELP pulse_fds_max File descriptors the process may open.\n")
+	b.WriteString("# TYPE pulse_fds_max gauge\n")
+	fmt.Fprintf(b, "pulse_fds_max %d\n", f.limit)
+	b.WriteString("# HELP pulse_fds_reserve File descriptors kept from clients, PULSE_FD_RESERVE.\n")
+	b.WriteString("# TYPE pulse_fds_reserve gauge\n")
+	fmt.Fprintf(b, "pulse_fds_reserve %d\n", f.reserve)
+	if open, ok := f.estimate(clients); ok {
+		b.WriteString("# HELP pulse_fds_open File descriptors open, going by a count at most a second old.\n")
+		b.WriteString("# TYPE pulse_fds_open gauge\n")
+		fmt.Fprintf(b, "pulse_fds_open %d\n", open)
+	}
+	b.WriteString("# HELP pulse_fds_refused_total Upgrades turned away because file descriptors were running out.\n")
+	b.WriteString("# TYPE pulse_fds_refused_total counter\n")
+	fmt.Fprintf(b, "pulse_fds_refused_total %d\n", f.refused.Load())
+}
@@ -0,0 +1,113 @@
+package hub
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"pulse/ws"
+)
+
+// Experimental protocol features. They are off unless PULSE_FEATURES turns
+// them on, for the whole deployment or per channel, and a client learns
+// which are on for its channel from the features list in its hello.
+const (
+	// featureSendAhead sends each pulse sendAheadLead before its beat,
+	// with the beat itself as at_ms, so clients can schedule it exactly
+	// despite network jitter up to the lead.
+	featureSendAhead = "send_ahead"
+	// featureHashChain links each pulse to the one before it by hash; see
+	// hashchain.go.
+	featureHashChain = "hash_chain"
+	// featureFairDelivery holds pulses back per client so that they
+	// arrive everywhere at once; see fair.go.
+	featureFairDelivery = "fair_delivery"
+)
+
+// experimentalFeatures describes every feature PULSE_FEATURES accepts.
+var experimentalFeatures = map[string]string{
+	featureSendAhead:    "pulses are sent ahead of their beat and carry the beat as at_ms",
+	featureHashChain:    "pulses carry hash and prev_hash, chaining them for later verification",
+	featureFairDelivery: "pulses are held back per client by measured latency so that they arrive at all clients together",
+}
+
+// sendAheadLead is how far ahead send_ahead pulses go out, at most half a
+// period; Main sets it from PULSE_SEND_AHEAD_MS.
+var sendAheadLead = 50 * time.Millisecond
+
+// featureNames lists the experimental features, sorted.
+func featureNames() []string {
+	names := make([]string, 0, len(experimentalFeatures))
+	for name := range experimentalFeatures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyFeatures enables the features in raw, comma-separated entries that
+// are either a feature, on for every channel, or "channel:feature", e.g.
+// "send_ahead" or "tick:send_ahead".
+func applyFeatures(raw string, chans map[string]*pulseChannel) error {
+	for _, entry := range ws.SplitHeaderList(raw) {
+		name, feature, perChannel := strings.Cut(entry, ":")
+		if !perChannel {
+			name, feature = "", name
+		}
+		feature = strings.TrimSpace(feature)
+		if _, ok := experimentalFeatures[feature]; !ok {
+			return fmt.Errorf("unknown feature %q (want one of %s)", feature, strings.Join(featureNames(), ", "))
+		}
+		if !perChannel {
+			for _, ch := range chans {
+				ch.features[feature] = true
+			}
+			continue
+		}
+		ch := chans[strings.TrimSpace(name)]
+		if ch == nil {
+			return fmt.Errorf("feature %q: unknown channel %q", feature, name)
+		}
+		ch.features[feature] = true
+	}
+	return nil
+}
+
+// feature reports whether the experimental feature is on for ch.
+func (ch *pulseChannel) feature(name string) bool {
+	return ch.features[name]
+}
+
+// featureList lists the features on for ch, sorted; nil if none.
+func (ch *pulseChannel) featureList() []string {
+	var names []string
+	for name := range ch.features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// commonFeatures lists the features on for every channel, sorted.
+func (h *Hub) commonFeatures() []string {
+	var names []string
+	for _, name := range h.channel(defaultChannel).featureList() {
+		all := true
+		for _, ch := range h.channels {
+			all = all && ch.feature(name)
+		}
+		if all {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// lead is how far ahead of its beat a pulse of ch at period is sent.
+func (ch *pulseChannel) lead(period time.Duration) time.Duration {
+	if !ch.feature(featureSendAhead) {
+		return 0
+	}
+	return min(sendAheadLead, period/2)
+}
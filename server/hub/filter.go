@@ -0,0 +1,195 @@
+package hub
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clientFilter is a parsed filter expression such as
+//
+//	channel == "default" && latency_ms > 200
+//	identity.device == "cam-07"
+//
+// Clauses are joined with && and all must hold. An empty expression
+// matches every client.
+type clientFilter []filterClause
+
+type filterClause struct {
+	field   string
+	op      string
+	numeric bool
+	str     string
+	num     float64
+	// prefix is set when an ip is compared with a CIDR prefix, e.g.
+	// ip == 10.0.0.0/8; == then means inside it.
+	prefix netip.Prefix
+}
+
+// filterFields maps each field to whether it compares numerically.
+var filterFields = map[string]bool{
+	"request_id": false,
+	"channel":    false,
+	"tenant":     false,
+	"proto":      false,
+	"ip":         false,
+	"lagging":    false,
+	"latency_ms": true,
+	"rtt_ms":     true,
+	"age_s":      true,
+}
+
+var filterOps = []string{"==", "!=", ">=", "<=", ">", "<"}
+
+func parseClientFilter(expr string) (clientFilter, error) {
+	return parseFilter(expr, filterFields)
+}
+
+// parseFilter parses &&-joined clauses over fields, which maps each field
+// to whether it compares numerically; identity.* and the other prefixes
+// name string fields.
+func parseFilter(expr string, fields map[string]bool, prefixes ...string) ([]filterClause, error) {
+	var f []filterClause
+	if strings.TrimSpace(expr) == "" {
+		return f, nil
+	}
+	for _, raw := range strings.Split(expr, "&&") {
+		cl, err := parseFilterClause(strings.TrimSpace(raw), fields, append(prefixes, "identity.")...)
+		if err != nil {
+			return nil, err
+		}
+		f = append(f, cl)
+	}
+	return f, nil
+}
+
+// parseFilterClause splits s at its first operator, so a quoted value may
+// hold one, e.g. identity.note != "a==b".
+func parseFilterClause(s string, fields map[string]bool, prefixes ...string) (filterClause, error) {
+	for i := range s {
+		op := ""
+		for _, o := range filterOps {
+			if strings.HasPrefix(s[i:], o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			continue
+		}
+		field, value := s[:i], s[i+len(op):]
+		cl := filterClause{field: strings.TrimSpace(field), op: op}
+		numeric, known := fields[cl.field]
+		for _, p := range prefixes {
+			if key, ok := strings.CutPrefix(cl.field, p); ok && validName(key) {
+				known = true
+			}
+		}
+		if !known {
+			return cl, fmt.Errorf("unknown filter field %q", cl.field)
+		}
+		cl.numeric = numeric
+		value = strings.TrimSpace(value)
+		if numeric {
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return cl, fmt.Errorf("%s needs a number, got %q", cl.field, value)
+			}
+			cl.num = n
+			return cl, nil
+		}
+		if op != "==" && op != "!=" {
+			return cl, fmt.Errorf("%s only supports == and !=", cl.field)
+		}
+		if value == "" {
+			return cl, fmt.Errorf("empty value for %s", cl.field)
+		}
+		// Quoting is optional but needed to match an empty string, e.g.
+		// proto == "" for legacy clients.
+		if uq, err := strconv.Unquote(value); err == nil {
+			value = uq
+		}
+		cl.str = value
+		if cl.field == "ip" && strings.Contains(value, "/") {
+			p, err := netip.ParsePrefix(value)
+			if err != nil {
+				return cl, fmt.Errorf("ip: %v", err)
+			}
+			cl.prefix = p.Masked()
+		}
+		return cl, nil
+	}
+	return filterClause{}, fmt.Errorf("invalid filter clause %q", s)
+}
+
+func (f clientFilter) match(c clientInfo, now time.Time) bool {
+	for _, cl := range f {
+		if !cl.match(c, now) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cl filterClause) match(c clientInfo, now time.Time) bool {
+	var s string
+	var n float64
+	switch cl.field {
+	case "request_id":
+		s = c.RequestID
+	case "channel":
+		s = c.Channel
+	case "tenant":
+		s = c.Tenant
+	case "proto":
+		s = c.Proto
+	case "ip":
+		s = remoteIP(c.Remote)
+	case "lagging":
+		s = strconv.FormatBool(c.Lagging)
+	case "latency_ms":
+		n = c.WriteLatencyMS
+	case "rtt_ms":
+		if c.RTT != nil {
+			n = c.RTT.SmoothMS
+		}
+	case "age_s":
+		n = now.Sub(c.ConnectedAt).Seconds()
+	default:
+		s = c.Identity[strings.TrimPrefix(cl.field, "identity.")]
+	}
+	return cl.compare(s, n)
+}
+
+// compare applies the clause to the field's value, s for string fields and
+// n for numeric ones.
+func (cl filterClause) compare(s string, n float64) bool {
+	if cl.prefix.IsValid() {
+		addr, err := netip.ParseAddr(s)
+		in := err == nil && cl.prefix.Contains(addr.Unmap())
+		return in == (cl.op == "==")
+	}
+	switch cl.op {
+	case "==":
+		if cl.numeric {
+			return n == cl.num
+		}
+		return s == cl.str
+	case "!=":
+		if cl.numeric {
+			return n != cl.num
+		}
+		return s != cl.str
+	case ">":
+		return n > cl.num
+	case ">=":
+		return n >= cl.num
+	case "<":
+		return n < cl.num
+	case "<=":
+		return n <= cl.num
+	}
+	return false
+}
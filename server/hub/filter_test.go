@@ -0,0 +1,120 @@
+package hub
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientFilterMatch(t *testing.T) {
+	now := time.Unix(1739700000, 0)
+	c := clientInfo{
+		RequestID:      "req-1",
+		Remote:         "10.1.2.3:5000",
+		Channel:        "stage",
+		Proto:          "",
+		Tenant:         "acme",
+		ConnectedAt:    now.Add(-90 * time.Second),
+		WriteLatencyMS: 250,
+		Lagging:        true,
+		RTT:            &rttSnapshot{SmoothMS: 40},
+		Identity:       map[string]string{"device": "cam-07", "note": "a==b"},
+	}
+	for _, tc := range []struct {
+		expr  string
+		match bool
+	}{
+		{"", true},
+		{`channel == "stage"`, true},
+		{"channel == stage", true},
+		{"channel != stage", false},
+		{`channel == "stage" && latency_ms > 200`, true},
+		{`channel == "stage" && latency_ms > 250`, false},
+		{"latency_ms >= 250", true},
+		{"latency_ms <= 249.5", false},
+		{"rtt_ms < 50", true},
+		{"age_s > 60 && age_s < 120", true},
+		{"lagging == true", true},
+		{`proto == ""`, true},
+		{"tenant != acme", false},
+		{"identity.device == cam-07", true},
+		{`identity.note == "a==b"`, true},
+		{`identity.note != "a==b"`, false},
+		{"identity.missing == x", false},
+		{"identity.missing != x", true},
+		{"ip == 10.1.2.3", true},
+		{"ip == 10.0.0.0/8", true},
+		{"ip != 10.0.0.0/8", false},
+		{"ip == 192.168.0.0/16", false},
+		{"request_id == req-1", true},
+	} {
+		f, err := parseClientFilter(tc.expr)
+		if err != nil {
+			t.Errorf("parse %q: %v", tc.expr, err)
+			continue
+		}
+		if got := f.match(c, now); got != tc.match {
+			t.Errorf("%q matched %t, want %t", tc.expr, got, tc.match)
+		}
+	}
+}
+
+func TestClientFilterMatchIPv6(t *testing.T) {
+	for _, tc := range []struct {
+		remote string
+		expr   string
+		match  bool
+	}{
+		{"[2001:db8::1]:5000", "ip == 2001:db8::/32", true},
+		{"[2001:db8::1]:5000", "ip == 10.0.0.0/8", false},
+		// IPv4-mapped addresses match IPv4 prefixes.
+		{"[::ffff:10.0.0.1]:5000", "ip == 10.0.0.0/8", true},
+		{"unix", "ip != 10.0.0.0/8", true},
+	} {
+		f, err := parseClientFilter(tc.expr)
+		if err != nil {
+			t.Fatalf("parse %q: %v", tc.expr, err)
+		}
+		if got := f.match(clientInfo{Remote: tc.remote}, time.Now()); got != tc.match {
+			t.Errorf("%s: %q matched %t, want %t", tc.remote, tc.expr, got, tc.match)
+		}
+	}
+}
+
+func TestClientFilterInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		expr string
+		err  string
+	}{
+		{"channel", "invalid filter clause"},
+		{"channel = stage", "invalid filter clause"},
+		{"colour == red", "unknown filter field"},
+		{"identity. == x", "unknown filter field"},
+		{"identity.a/b == x", "unknown filter field"},
+		{"latency_ms > fast", "needs a number"},
+		{"latency_ms >", "needs a number"},
+		{"channel > stage", "only supports == and !="},
+		{"channel ==", "empty value"},
+		{"ip == 10.0.0.0/33", "ip:"},
+		{"channel == a &&", "invalid filter clause"},
+		{"&& channel == a", "invalid filter clause"},
+	} {
+		_, err := parseClientFilter(tc.expr)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("parse %q: err %v, want %q", tc.expr, err, tc.err)
+		}
+	}
+}
+
+func TestFilterPrefixes(t *testing.T) {
+	fields := map[string]bool{"path": false}
+	if _, err := parseFilter(`header.user-agent == "curl"`, fields, "header."); err != nil {
+		t.Fatalf("header field: %v", err)
+	}
+	if _, err := parseFilter(`identity.device == cam`, fields, "header."); err != nil {
+		t.Fatalf("identity field: %v", err)
+	}
+	if _, err := parseFilter(`header.x == y`, fields); err == nil {
+		t.Fatal("header field accepted without the prefix")
+	}
+}
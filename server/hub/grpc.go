@@ -0,0 +1,499 @@
+package hub
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// grpcServer serves the gRPC API in pulse.proto on its own port
+// (PULSE_GRPC_ADDR), for backend services that want pulses without
+// WebSocket framing. gRPC is HTTP/2 POSTs of length-prefixed protobuf
+// messages with the status in trailers; the few messages it needs are
+// encoded here, so the server keeps its lack of dependencies. A
+// SubscribePulses stream joins the hub like any other client, through an
+// in-process pipe, so fan-out, quotas and lag handling apply unchanged.
+type grpcServer struct {
+	addr   string
+	h      *Hub
+	status func() statusResponse
+	audit  *auditLog
+	tls    *tls.Config
+	limits httpLimits
+
+	mu     sync.Mutex
+	srv    *http.Server
+	closed bool
+}
+
+// gRPC status codes, from grpc/codes.
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// maxGRPCMessage bounds request messages; none of ours is anywhere near.
+const maxGRPCMessage = 64 << 10
+
+// grpcError is an RPC failure with its status code.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+func grpcErrorf(code int, format string, args ...any) error {
+	return &grpcError{code, fmt.Sprintf(format, args...)}
+}
+
+// start listens on s.addr. After an upgrade the old process may still hold
+// the port, so it is retried in the background for a while, as SNTP does.
+func (s *grpcServer) start() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /pulse.v1.PulseService/SubscribePulses", s.subscribe)
+	mux.HandleFunc("POST /pulse.v1.PulseService/GetStatus", s.unary(s.getStatus))
+	mux.HandleFunc("POST /pulse.v1.PulseService/SetPeriod", s.unary(s.setPeriod))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeGRPCStatus(w, grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path))
+	})
+	srv := &http.Server{Handler: withRequestID(mux)}
+	s.limits.apply(srv, true)
+	if s.tls != nil {
+		srv.TLSConfig = s.tls.Clone()
+		srv.TLSConfig.NextProtos = []string{"h2"}
+	} else if err := enableH2C(srv); err != nil {
+		return err
+	}
+	s.srv = srv
+
+	ln, err := net.Listen("tcp", s.addr)
+	if err == nil {
+		go s.serve(ln)
+		return nil
+	}
+	if !handedOver() {
+		return err
+	}
+	go func() {
+		for deadline := time.Now().Add(handoffTimeout); time.Now().Before(deadline); {
+			time.Sleep(50 * time.Millisecond)
+			if ln, err = net.Listen("tcp", s.addr); err == nil {
+				s.serve(ln)
+				return
+			}
+		}
+		slog.Error("grpc", "err", err)
+	}()
+	return nil
+}
+
+func (s *grpcServer) serve(ln net.Listener) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return
+	}
+	s.mu.Unlock()
+	slog.Info("grpc: listening", "addr", ln.Addr().String(), "tls", s.tls != nil)
+	var err error
+	if s.tls != nil {
+		err = s.srv.ServeTLS(ln, "", "")
+	} else {
+		err = s.srv.Serve(ln)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("grpc", "err", err)
+	}
+}
+
+// close stops accepting RPCs. Subscriptions end as their hub connections
+// are closed, with UNAVAILABLE. A nil grpcServer ignores it.
+func (s *grpcServer) close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_ = s.srv.Shutdown(ctx)
+}
+
+// subscribe serves SubscribePulses.
+func (s *grpcServer) subscribe(w http.ResponseWriter, r *http.Request) {
+	h := s.h
+	req, err := readGRPCRequest(r)
+	if err != nil {
+		writeGRPCStatus(w, err)
+		return
+	}
+	var name, precision string
+	var rate uint64
+	err = decodeProto(req, func(field int, v protoValue) {
+		switch field {
+		case 1:
+			name = v.str()
+		case 2:
+			rate = v.n
+		case 3:
+			precision = v.str()
+		}
+	})
+	if err != nil {
+		writeGRPCStatus(w, grpcErrorf(grpcInvalidArgument, "invalid SubscribeRequest: %v", err))
+		return
+	}
+	micros, err := parsePrecision(precision)
+	if err != nil {
+		writeGRPCStatus(w, grpcErrorf(grpcInvalidArgument, "%v", err))
+		return
+	}
+	if name == "" {
+		name = defaultChannel
+	}
+	ch := h.channel(name)
+	if ch == nil {
+		writeGRPCStatus(w, grpcErrorf(grpcNotFound, "unknown channel %q", name))
+		return
+	}
+	rate = max(rate, 1)
+	if !ch.offers(rate) {
+		writeGRPCStatus(w, grpcErrorf(grpcInvalidArgument, "channel %q has no rate %d", ch.name, rate))
+		return
+	}
+	subject, err := h.subscribers.authenticate(r, h.auth)
+	if err != nil {
+		writeGRPCStatus(w, grpcErrorf(grpcUnauthenticated, "unauthorized: %v", err))
+		return
+	}
+	leave, ok := h.limits.acquire()
+	if !ok {
+		writeGRPCStatus(w, grpcErrorf(grpcResourceExhausted, "too many clients"))
+		return
+	}
+	defer leave()
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	server, client := net.Pipe()
+	c := &Conn{
+		conn:        server,
+		id:          requestIDFrom(r.Context()),
+		remote:      r.RemoteAddr,
+		connectedAt: time.Now(),
+		proto:       protoJSON,
+		tenant:      tenantFromRequest(r),
+		subject:     subject,
+		grpc:        true,
+	}
+	c.ch.Store(ch)
+	c.rate.Store(rate)
+	c.micros.Store(micros)
+
+	// Forward the pulses the hub writes into the pipe; reading also keeps
+	// keepalive from evicting a stream that cannot answer pings.
+	ended := make(chan error, 1)
+	go func() {
+		defer client.Close()
+		br := bufio.NewReader(client)
+		var frame []byte
+		for {
+			payload, err := readServerFrame(br)
+			if err != nil {
+				ended <- err
+				return
+			}
+			c.lastRead.Store(time.Now().UnixNano())
+			var msg PulseMessage
+			if json.Unmarshal(payload, &msg) != nil || msg.Type != "pulse" {
+				continue
+			}
+			msg.Channel = c.Channel()
+			frame = appendGRPCFrame(frame[:0], encodeProtoPulse(msg))
+			if _, err := w.Write(frame); err != nil {
+				ended <- err
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				ended <- err
+				return
+			}
+		}
+	}()
+	h.add(c)
+	connLog.log(churnLevel(), "client connected", "request_id", c.id, "remote", c.remote, "subject", c.subject, "proto", "grpc", "tenant", c.tenant, "channel", c.Channel(), "clients", h.Count())
+
+	select {
+	case <-r.Context().Done():
+		c.setCause(causeClientClose)
+		h.remove(c)
+		<-ended
+	case <-ended:
+		h.remove(c)
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(grpcUnavailable))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "stream closed by the server")
+	}
+	connLog.log(churnLevel(), "client disconnected", "request_id", c.id, "remote", c.remote, "clients", h.Count())
+}
+
+// unary serves an RPC taking and returning one message.
+func (s *grpcServer) unary(fn func(r *http.Request, req []byte) ([]byte, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, err := readGRPCRequest(r)
+		if err == nil {
+			var resp []byte
+			if resp, err = fn(r, req); err == nil {
+				w.Header().Set("Content-Type", "application/grpc")
+				w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write(appendGRPCFrame(nil, resp))
+				w.Header().Set("Grpc-Status", strconv.Itoa(grpcOK))
+				w.Header().Set("Grpc-Message", "")
+				return
+			}
+		}
+		writeGRPCStatus(w, err)
+	}
+}
+
+// getStatus serves GetStatus.
+func (s *grpcServer) getStatus(_ *http.Request, _ []byte) ([]byte, error) {
+	st := s.status()
+	var b []byte
+	b = appendProtoVarint(b, 1, st.Seq)
+	b = appendProtoVarint(b, 2, uint64(st.PeriodMS))
+	b = appendProtoBool(b, 3, st.Paused)
+	b = appendProtoVarint(b, 4, uint64(st.Subscribers))
+	b = appendProtoDouble(b, 5, st.JitterMS)
+	b = appendProtoDouble(b, 6, st.BroadcastMS)
+	b = appendProtoVarint(b, 7, st.BytesSent)
+	b = appendProtoBool(b, 8, st.Alerting)
+	return b, nil
+}
+
+// setPeriod serves SetPeriod, for controllers.
+func (s *grpcServer) setPeriod(r *http.Request, req []byte) ([]byte, error) {
+	got, err := s.h.auth.allow(r)
+	if err != nil {
+		return nil, grpcErrorf(grpcUnauthenticated, "%v", err)
+	}
+	if got < roleController {
+		return nil, grpcErrorf(grpcPermissionDenied, "%s role required, credentials are %s", roleController, got)
+	}
+	var body periodBody
+	err = decodeProto(req, func(field int, v protoValue) {
+		switch field {
+		case 1:
+			body.Channel = v.str()
+		case 2:
+			body.PeriodMS = int64(v.n)
+		case 3:
+			body.BPM = math.Float64frombits(v.n)
+		}
+	})
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "invalid SetPeriodRequest: %v", err)
+	}
+	body, err = s.h.retune(body)
+	switch {
+	case errors.Is(err, errNoChannel):
+		return nil, grpcErrorf(grpcNotFound, "%v", err)
+	case errors.Is(err, errDriven):
+		return nil, grpcErrorf(grpcFailedPrecondition, "%v", err)
+	case err != nil:
+		return nil, grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	s.audit.record(auditEntry{RequestID: requestIDFrom(r.Context()), Action: "period", Params: body})
+	var b []byte
+	b = appendProtoString(b, 1, body.Channel)
+	return appendProtoVarint(b, 2, uint64(body.PeriodMS)), nil
+}
+
+// readGRPCRequest returns the single message of a gRPC request.
+func readGRPCRequest(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		return nil, grpcErrorf(grpcInvalidArgument, "content type must be application/grpc")
+	}
+	var hdr [5]byte
+	if _, err := io.ReadFull(r.Body, hdr[:]); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "read request: %v", err)
+	}
+	if hdr[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxGRPCMessage {
+		return nil, grpcErrorf(grpcResourceExhausted, "request message over %d bytes", maxGRPCMessage)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r.Body, msg); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "read request: %v", err)
+	}
+	return msg, nil
+}
+
+// writeGRPCStatus ends an RPC that sent nothing with err's status, as a
+// trailers-only response.
+func writeGRPCStatus(w http.ResponseWriter, err error) {
+	code := grpcInternal
+	var ge *grpcError
+	if errors.As(err, &ge) {
+		code = ge.code
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", err.Error())
+	w.WriteHeader(http.StatusOK)
+}
+
+// appendGRPCFrame appends msg as an uncompressed gRPC message.
+func appendGRPCFrame(b, msg []byte) []byte {
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// encodeProtoPulse encodes msg as a pulse.v1.Pulse.
+func encodeProtoPulse(msg PulseMessage) []byte {
+	var b []byte
+	b = appendProtoVarint(b, 1, msg.Seq)
+	b = appendProtoVarint(b, 2, uint64(msg.PeriodMS))
+	b = appendProtoVarint(b, 3, uint64(msg.NowMS))
+	b = appendProtoVarint(b, 4, uint64(msg.NextMS))
+	b = appendProtoVarint(b, 5, uint64(msg.MonoMS))
+	b = appendProtoDouble(b, 6, msg.DriftMS)
+	b = appendProtoVarint(b, 7, uint64(msg.OffsetMS))
+	b = appendProtoBool(b, 8, msg.PeriodChanged)
+	b = appendProtoString(b, 9, msg.Channel)
+	b = appendProtoVarint(b, 10, uint64(msg.AtMS))
+	b = appendProtoVarint(b, 11, uint64(msg.RampTargetMS))
+	b = appendProtoVarint(b, 12, uint64(msg.RampPulses))
+	if len(msg.Extra) > 0 {
+		if extra, err := encodeExtra(msg.Extra); err == nil {
+			b = appendProtoString(b, 13, string(extra))
+		}
+	}
+	b = appendProtoVarint(b, 14, uint64(msg.PeriodUS))
+	b = appendProtoVarint(b, 15, uint64(msg.NowUS))
+	b = appendProtoVarint(b, 16, uint64(msg.NextUS))
+	return appendProtoVarint(b, 17, uint64(msg.AtUS))
+}
+
+// Protobuf wire types used here.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// appendProtoVarint appends a varint field, skipping the zero value as
+// proto3 does.
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|protoVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoBool(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendProtoVarint(b, field, 1)
+}
+
+func appendProtoDouble(b []byte, field int, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|protoFixed64)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
+
+func appendProtoString(b []byte, field int, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|protoBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// protoValue is a decoded field: n holds varints and fixed-size values,
+// bytes length-delimited ones.
+type protoValue struct {
+	n     uint64
+	bytes []byte
+}
+
+func (v protoValue) str() string { return string(v.bytes) }
+
+// decodeProto calls fn with every field of the protobuf message b.
+func decodeProto(b []byte, fn func(field int, v protoValue)) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("bad field key")
+		}
+		b = b[n:]
+		var v protoValue
+		switch key & 7 {
+		case protoVarint:
+			if v.n, n = binary.Uvarint(b); n <= 0 {
+				return errors.New("bad varint")
+			}
+			b = b[n:]
+		case protoFixed64:
+			if len(b) < 8 {
+				return errors.New("truncated fixed64")
+			}
+			v.n, b = binary.LittleEndian.Uint64(b), b[8:]
+		case protoFixed32:
+			if len(b) < 4 {
+				return errors.New("truncated fixed32")
+			}
+			v.n, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case protoBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return errors.New("bad length")
+			}
+			v.bytes, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return fmt.Errorf("unsupported wire type %d", key&7)
+		}
+		fn(int(key>>3), v)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build go1.24
+
+package hub
+
+import "net/http"
+
+// enableH2C lets srv serve HTTP/2 without TLS, as gRPC clients expect of a
+// plaintext port.
+func enableH2C(srv *http.Server) error {
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetUnencryptedHTTP2(true)
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !go1.24
+
+package hub
+
+import (
+	"errors"
+	"net/http"
+)
+
+// enableH2C would let srv serve HTTP/2 without TLS; net/http only can from
+// Go 1.24 on.
+func enableH2C(*http.Server) error {
+	return errors.New("gRPC without TLS needs a server built with Go 1.24 or later; configure TLS instead")
+}
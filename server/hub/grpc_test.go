@@ -0,0 +1,56 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"pulse/golden"
+)
+
+// TestProtoPulseGolden checks encodeProtoPulse against the corpus's
+// protobuf cases, which other gRPC clients check their decoders against.
+func TestProtoPulseGolden(t *testing.T) {
+	corpus, err := golden.Load(golden.Latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, c := range corpus.Cases {
+		if c.Codec != "protobuf" {
+			continue
+		}
+		n++
+		// Fields the JSON pulse lacks land in Extra.
+		var msg PulseMessage
+		if err := json.Unmarshal(c.Decoded, &msg); err != nil {
+			t.Fatalf("case %s: %v", c.Name, err)
+		}
+		if raw, ok := msg.Extra["channel"]; ok {
+			delete(msg.Extra, "channel")
+			if err := json.Unmarshal(raw, &msg.Channel); err != nil {
+				t.Fatalf("case %s: %v", c.Name, err)
+			}
+		}
+		if raw, ok := msg.Extra["extra_json"]; ok {
+			delete(msg.Extra, "extra_json")
+			var extra string
+			if err := json.Unmarshal(raw, &extra); err != nil {
+				t.Fatalf("case %s: %v", c.Name, err)
+			}
+			if err := json.Unmarshal([]byte(extra), &msg.Extra); err != nil {
+				t.Fatalf("case %s: %v", c.Name, err)
+			}
+		}
+		want, err := c.Bytes()
+		if err != nil {
+			t.Fatalf("case %s: %v", c.Name, err)
+		}
+		if got := encodeProtoPulse(msg); !bytes.Equal(got, want) {
+			t.Errorf("case %s: encoded %x, want %x", c.Name, got, want)
+		}
+	}
+	if n == 0 {
+		t.Fatal("no protobuf cases in the corpus")
+	}
+}
@@ -0,0 +1,287 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"pulse/clock"
+	"pulse/ws"
+)
+
+// Zero-downtime upgrades: on SIGUSR2 the running process starts the binary
+// at its own path again (typically just replaced by a new release) and
+// passes it, as inherited file descriptors, the listening socket and a pipe
+// carrying every channel's period and latest pulse. The new process
+// continues each channel's grid and seq where the old one is, accepts on
+// the same socket, and reports ready; the old process then stops
+// accepting, closes its clients gradually so they reconnect to the new
+// one, and exits. Until a client is closed it keeps getting pulses from
+// the old process, in step with the new one: seq, the pulse grid and
+// mono_ms carry on across the swap.
+const (
+	handoffEnv = "PULSE_HANDOFF"
+	// handoffListenersEnv is the number of listeners passed, when more
+	// than one.
+	handoffListenersEnv = "PULSE_HANDOFF_LISTENERS"
+	// handoffListenerOptsEnv is what each listener serves, comma-separated
+	// in the order they are passed.
+	handoffListenerOptsEnv = "PULSE_HANDOFF_LISTENER_OPTS"
+
+	// Descriptors in the new process, after stdin, stdout and stderr. A
+	// second and further listener follow the ready pipe.
+	handoffListenerFD      = 3
+	handoffStateFD         = 4
+	handoffReadyFD         = 5
+	handoffMoreListenersFD = 6
+
+	// handoffTimeout is how long the new process has to start serving
+	// before the upgrade is abandoned.
+	handoffTimeout = 15 * time.Second
+)
+
+// handoffState is what the old process passes to the new one.
+type handoffState struct {
+	OffsetMS int64            `json:"offset_ms"`
+	Channels []handoffChannel `json:"channels"`
+	// UptimeNS is how long the server had been up (since the first
+	// process of the chain) at CapturedUnixNano, so mono_ms carries on.
+	UptimeNS         int64 `json:"uptime_ns"`
+	CapturedUnixNano int64 `json:"captured_unix_nano"`
+}
+
+type handoffChannel struct {
+	Name     string `json:"name"`
+	PeriodMS int64  `json:"period_ms"`
+	// Seq was scheduled at AtUnixNano; absent before the first pulse.
+	Seq        uint64 `json:"seq"`
+	AtUnixNano int64  `json:"at_unix_nano,omitempty"`
+	Paused     bool   `json:"paused,omitempty"`
+	// BarSeq is the seq bars count from on a channel with a tempo.
+	BarSeq uint64 `json:"bar_seq,omitempty"`
+	// Hash is the head of the channel's hash chain, if it has one.
+	Hash string `json:"hash,omitempty"`
+}
+
+// handedOver reports whether this process was started by an upgrade.
+func handedOver() bool {
+	return os.Getenv(handoffEnv) == "1"
+}
+
+// inheritListeners returns the listeners passed by the old process, each
+// serving what it served there.
+func inheritListeners() ([]listener, error) {
+	n, err := strconv.Atoi(os.Getenv(handoffListenersEnv))
+	if err != nil || n < 1 {
+		n = 1
+	}
+	serves := ws.SplitHeaderList(os.Getenv(handoffListenerOptsEnv))
+	var lns []listener
+	for i := range n {
+		fd := uintptr(handoffListenerFD)
+		if i > 0 {
+			fd = uintptr(handoffMoreListenersFD + i - 1)
+		}
+		f := os.NewFile(fd, "listener")
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherit listener %d: %w", i, err)
+		}
+		opts := defaultListenOpts
+		if i < len(serves) {
+			if opts, err = parseListenOpts(serves[i]); err != nil {
+				return nil, fmt.Errorf("inherit listener %d: %w", i, err)
+			}
+		}
+		lns = append(lns, listener{ln, opts})
+	}
+	return lns, nil
+}
+
+// readHandoff reads the state passed by the old process.
+func readHandoff() (handoffState, error) {
+	var st handoffState
+	f := os.NewFile(handoffStateFD, "handoff state")
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&st); err != nil {
+		return st, fmt.Errorf("read handoff state: %w", err)
+	}
+	return st, nil
+}
+
+// handoffReady tells the old process this one is serving. It does nothing
+// outside an upgrade.
+func handoffReady() {
+	if !handedOver() {
+		return
+	}
+	f := os.NewFile(handoffReadyFD, "handoff ready")
+	defer f.Close()
+	if _, err := f.Write([]byte("ready\n")); err != nil {
+		slog.Error("handoff: report ready", "err", err)
+	}
+}
+
+// handoffState captures the offset, uptime and every channel's period and
+// latest pulse.
+func (h *Hub) handoffState() handoffState {
+	now := time.Now()
+	st := handoffState{
+		OffsetMS:         h.offset().Milliseconds(),
+		UptimeNS:         int64(now.Sub(clock.Start)),
+		CapturedUnixNano: now.UnixNano(),
+	}
+	for _, name := range h.channelNames() {
+		ch := h.channel(name)
+		hc := handoffChannel{Name: name, PeriodMS: ch.Period().Milliseconds(), Paused: ch.transport.isPaused(), Hash: ch.chain.head()}
+		if ch.tempo != nil {
+			hc.BarSeq = ch.tempo.barSeq.Load()
+		}
+		if a := ch.last.Load(); a != nil {
+			hc.Seq, hc.AtUnixNano = a.seq, a.at.UnixNano()
+			hc.PeriodMS = a.period.Milliseconds()
+		}
+		st.Channels = append(st.Channels, hc)
+	}
+	return st
+}
+
+// resume applies state from the old process before the pulse loops start.
+// Channels the new configuration no longer has are dropped; new ones start
+// fresh.
+func (h *Hub) resume(st handoffState) {
+	if st.UptimeNS > 0 {
+		now := time.Now()
+		clock.Start = now.Add(-time.Duration(st.UptimeNS) - now.Round(0).Sub(time.Unix(0, st.CapturedUnixNano)))
+	}
+	h.setOffset(time.Duration(st.OffsetMS) * time.Millisecond)
+	for _, hc := range st.Channels {
+		ch := h.channel(hc.Name)
+		if ch == nil {
+			slog.Warn("handoff: channel no longer configured", "channel", hc.Name)
+			continue
+		}
+		period := time.Duration(hc.PeriodMS) * time.Millisecond
+		if period < minChannelPeriod {
+			continue
+		}
+		ch.setPeriod(period)
+		ch.tempo.restartBars(hc.BarSeq)
+		if hc.Paused {
+			_ = ch.transport.control(transportPause, "")
+		}
+		if hc.AtUnixNano != 0 {
+			ch.resume = &channelAnchor{seq: hc.Seq, at: time.Unix(0, hc.AtUnixNano), period: period}
+			ch.chain.resume(hc.Hash)
+		}
+	}
+}
+
+// handOff starts the new process on lns and waits until it is serving. On
+// error the new process has been stopped and this one carries on.
+func handOff(lns []listener, h *Hub) error {
+	var files []*os.File
+	var serves []string
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, ln := range lns {
+		fl, ok := ln.Listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("listener %T cannot be passed on", ln)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		serves = append(serves, ln.opts.String())
+	}
+	stateR, stateW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer stateR.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		stateW.Close()
+		return err
+	}
+	defer readyR.Close()
+
+	bin, err := os.Executable()
+	if err != nil {
+		stateW.Close()
+		readyW.Close()
+		return err
+	}
+	cmd := exec.Command(bin, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	env := withoutEnv(withoutEnv(withoutEnv(os.Environ(), handoffEnv), handoffListenersEnv), handoffListenerOptsEnv)
+	for _, name := range exported {
+		env = withoutEnv(env, name)
+	}
+	cmd.Env = append(env, handoffEnv+"=1", handoffListenersEnv+"="+strconv.Itoa(len(files)), handoffListenerOptsEnv+"="+strings.Join(serves, ","))
+	cmd.ExtraFiles = append([]*os.File{files[0], stateR, readyW}, files[1:]...)
+	err = cmd.Start()
+	readyW.Close() // the child holds its own copy
+	if err != nil {
+		stateW.Close()
+		return fmt.Errorf("start %s: %w", bin, err)
+	}
+	slog.Info("handoff: started", "bin", bin, "pid", cmd.Process.Pid)
+
+	// Capture state as late as possible; the new process picks up the
+	// grid from the latest pulse.
+	err = json.NewEncoder(stateW).Encode(h.handoffState())
+	stateW.Close()
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("send handoff state: %w", err)
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		line, err := io.ReadAll(io.LimitReader(readyR, 64))
+		if err == nil && !strings.HasPrefix(string(line), "ready") {
+			err = errors.New("new process exited before it was ready")
+		}
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(handoffTimeout):
+		err = fmt.Errorf("new process not ready after %s", handoffTimeout)
+	}
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return err
+	}
+	// The new process outlives this one; reap it only if that changes.
+	go func() { _ = cmd.Wait() }()
+	return nil
+}
+
+// withoutEnv drops name from env.
+func withoutEnv(env []string, name string) []string {
+	out := env[:0:0]
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, name+"=") {
+			out = append(out, kv)
+		}
+	}
+	return out
+}
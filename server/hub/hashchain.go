@@ -0,0 +1,73 @@
+package hub
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// chainGenesis is the prev_hash of a chain's first pulse.
+var chainGenesis = strings.Repeat("0", 64)
+
+// hashChain links a channel's pulses for the hash_chain feature. Each
+// pulse carries the hash of the one before it as prev_hash and its own as
+// hash, so a recording can be checked for dropped, reordered or edited
+// pulses without trusting whoever kept it.
+type hashChain struct {
+	mu   sync.Mutex
+	last string
+}
+
+// chainHash is the hex SHA-256 of prev and the fields every client of a
+// channel gets alike; next_ms and offset_ms are left out because clients
+// may have their own output offset.
+func chainHash(prev string, seq uint64, periodMS, nowMS, monoMS int64) string {
+	b := make([]byte, 0, len(prev)+4*21)
+	b = append(b, prev...)
+	for _, v := range []int64{periodMS, nowMS, monoMS} {
+		b = append(b, '\n')
+		b = strconv.AppendInt(b, v, 10)
+	}
+	b = append(b, '\n')
+	b = strconv.AppendUint(b, seq, 10)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// link adds hash and prev_hash to msg and makes it the chain's head.
+func (c *hashChain) link(msg *PulseMessage) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev := c.last
+	if prev == "" {
+		prev = chainGenesis
+	}
+	c.last = chainHash(prev, msg.Seq, msg.PeriodMS, msg.NowMS, msg.MonoMS)
+
+	// Extra may be shared with the caller; copy before adding to it.
+	extra := make(map[string]json.RawMessage, len(msg.Extra)+2)
+	for k, v := range msg.Extra {
+		extra[k] = v
+	}
+	extra["prev_hash"], _ = json.Marshal(prev)
+	extra["hash"], _ = json.Marshal(c.last)
+	msg.Extra = extra
+	return c.last
+}
+
+// head is the hash of the latest pulse; empty before the first.
+func (c *hashChain) head() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+// resume continues the chain from head, handed over by the old process.
+func (c *hashChain) resume(head string) {
+	c.mu.Lock()
+	c.last = head
+	c.mu.Unlock()
+}
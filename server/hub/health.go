@@ -0,0 +1,120 @@
+package hub
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// pulseHealth backs /healthz with the state of the default channel's pulse
+// loop, so a liveness probe can tell a wedged scheduler from a live one.
+// The loop is unhealthy, and /healthz answers 503, when no pulse has gone
+// out for a period plus late since one was due: the loop has stopped or
+// is stuck. It is degraded, still 200, when one of the last slow pulses
+// went out more than late after its schedule, or when the last slow
+// broadcasts each took longer than the period. Nothing is due while the
+// channel is paused, or while its pulses come from the backplane or a
+// replay rather than this process.
+type pulseHealth struct {
+	late time.Duration
+	slow int
+
+	mu      sync.Mutex
+	started time.Time
+	last    PulseObservation
+	// sinceLate counts pulses since one was late; slowRun counts the
+	// broadcasts in a row that took longer than the period.
+	sinceLate int
+	slowRun   int
+}
+
+// healthResponse is the /healthz body.
+type healthResponse struct {
+	OK    bool   `json:"ok"`
+	State string `json:"state"` // ok, degraded or unhealthy
+	// Reasons explains a state other than ok.
+	Reasons         []string `json:"reasons,omitempty"`
+	Seq             uint64   `json:"seq"`
+	LastPulseAgoMS  int64    `json:"last_pulse_ago_ms"`
+	SlowBroadcasts  int      `json:"slow_broadcasts,omitempty"`
+	PulsesSinceLate *int     `json:"pulses_since_late,omitempty"`
+}
+
+// pulseHealthFromEnv reads the thresholds: PULSE_HEALTH_LATE_MS, how late
+// a pulse may be (default 1s), and PULSE_HEALTH_SLOW_PULSES, how many
+// pulses a degradation is remembered or must last (default 10).
+func pulseHealthFromEnv() *pulseHealth {
+	return &pulseHealth{
+		late:      envMS("PULSE_HEALTH_LATE_MS", time.Second),
+		slow:      max(envInt("PULSE_HEALTH_SLOW_PULSES", 10), 1),
+		started:   time.Now(),
+		sinceLate: -1,
+	}
+}
+
+// observe records a pulse of the default channel.
+func (p *pulseHealth) observe(o PulseObservation) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.last = o
+	switch {
+	case o.Jitter > p.late:
+		p.sinceLate = 0
+	case p.sinceLate >= 0:
+		p.sinceLate++
+	}
+	if o.Period > 0 && o.Broadcast > o.Period {
+		p.slowRun++
+	} else {
+		p.slowRun = 0
+	}
+}
+
+// check returns the loop's health as of now.
+func (p *pulseHealth) check(h *Hub) healthResponse {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	ch := h.channel(defaultChannel)
+	last, period := p.started, ch.Period()
+	if !p.last.At.IsZero() {
+		last = p.last.At
+	}
+	if p.last.Period > 0 {
+		period = p.last.Period
+	}
+	r := healthResponse{OK: true, State: "ok", Seq: p.last.Seq, LastPulseAgoMS: now.Sub(last).Milliseconds()}
+	if p.sinceLate >= 0 && p.sinceLate < p.slow {
+		n := p.sinceLate
+		r.PulsesSinceLate = &n
+		r.Reasons = append(r.Reasons, fmt.Sprintf("a pulse within the last %d missed its schedule by more than %d ms", p.slow, p.late.Milliseconds()))
+	}
+	if p.slowRun >= p.slow {
+		r.SlowBroadcasts = p.slowRun
+		r.Reasons = append(r.Reasons, fmt.Sprintf("the last %d broadcasts each took longer than the %d ms period", p.slowRun, period.Milliseconds()))
+	}
+	if len(r.Reasons) > 0 {
+		r.State = "degraded"
+	}
+	due := !ch.transport.isPaused() && !h.backplane.following() && h.replay == nil
+	if due && now.Sub(last) > period+p.late {
+		r.OK, r.State = false, "unhealthy"
+		r.Reasons = append([]string{fmt.Sprintf("no pulse for %d ms; the pulse loop has stopped or is stuck", r.LastPulseAgoMS)}, r.Reasons...)
+	}
+	return r
+}
+
+// handler serves /healthz: 200 while the pulse loop is ok or degraded,
+// 503 when it is unhealthy.
+func (p *pulseHealth) handler(h *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		r := p.check(h)
+		status := http.StatusOK
+		if !r.OK {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, status, r)
+	}
+}
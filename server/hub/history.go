@@ -0,0 +1,154 @@
+package hub
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+const streamHistory = "history"
+
+// historyRecord is one pulse as written to the history stream.
+type historyRecord struct {
+	Seq         uint64  `json:"seq"`
+	AtMS        int64   `json:"at_ms"`
+	JitterMS    float64 `json:"jitter_ms"`
+	BroadcastMS float64 `json:"broadcast_ms"`
+	Subscribers int     `json:"subscribers"`
+	Hash        string  `json:"hash,omitempty"`
+}
+
+// historyRecorder appends every pulse observation to the history stream.
+type historyRecorder struct {
+	out *appender
+}
+
+func startHistory(out *appender) *historyRecorder {
+	return &historyRecorder{out: out}
+}
+
+func (r *historyRecorder) observe(o PulseObservation) {
+	if r == nil {
+		return
+	}
+	b, _ := json.Marshal(historyRecord{
+		Seq:         o.Seq,
+		AtMS:        o.At.UnixMilli(),
+		JitterMS:    msFloat(o.Jitter),
+		BroadcastMS: msFloat(o.Broadcast),
+		Subscribers: o.Subscribers,
+		Hash:        o.Hash,
+	})
+	r.out.append(streamHistory, b)
+}
+
+// The delta history format is for exporting long sessions, where JSONL
+// spends a hundred bytes on each pulse: after the magic historyDeltaMagic
+// and the first pulse's at_ms as a uvarint, each pulse is five varints,
+// usually seven bytes in all:
+//
+//	seq - previous seq                      zigzag varint
+//	at_ms - previous at_ms                  zigzag varint
+//	jitter in microseconds                  zigzag varint
+//	broadcast time in microseconds          uvarint
+//	subscribers - previous subscribers      zigzag varint
+//
+// The previous pulse of the first is seq 0 at the base at_ms with no
+// subscribers. Hashes are left out; export JSONL to verify a chain.
+const historyDeltaMagic = "PHD1"
+
+// appendHistoryDelta appends rec, following prev, in the delta format.
+func appendHistoryDelta(b []byte, prev, rec historyRecord) []byte {
+	b = binary.AppendVarint(b, int64(rec.Seq-prev.Seq))
+	b = binary.AppendVarint(b, rec.AtMS-prev.AtMS)
+	b = binary.AppendVarint(b, int64(math.Round(rec.JitterMS*1000)))
+	b = binary.AppendUvarint(b, uint64(max(math.Round(rec.BroadcastMS*1000), 0)))
+	return binary.AppendVarint(b, int64(rec.Subscribers-prev.Subscribers))
+}
+
+// historyHandler serves GET /api/history?from=<ms>&to=<ms>&format=F: the
+// recorded pulses between from and to (default all kept), oldest first,
+// as JSONL (format=jsonl, the default) or in the delta format
+// (format=delta).
+func historyHandler(store Store, history bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !history {
+			http.Error(w, "pulse history is off (PULSE_HISTORY)", http.StatusNotFound)
+			return
+		}
+		q := r.URL.Query()
+		from, to := int64(math.MinInt64), int64(math.MaxInt64)
+		for name, v := range map[string]*int64{"from": &from, "to": &to} {
+			if raw := q.Get(name); raw != "" {
+				ms, err := strconv.ParseInt(raw, 10, 64)
+				if err != nil {
+					http.Error(w, name+" must be Unix milliseconds", http.StatusBadRequest)
+					return
+				}
+				*v = ms
+			}
+		}
+		format := q.Get("format")
+		if format == "" {
+			format = "jsonl"
+		}
+		if format != "jsonl" && format != "delta" {
+			http.Error(w, fmt.Sprintf("unknown format %q, want jsonl or delta", format), http.StatusBadRequest)
+			return
+		}
+		var recs [][]byte
+		err := eachHistory(store, from, to, func(rec []byte) {
+			recs = append(recs, bytes.Clone(rec))
+		})
+		if err != nil {
+			slog.Error("history: read", "err", err)
+			http.Error(w, "history unavailable", http.StatusInternalServerError)
+			return
+		}
+
+		bw := bufio.NewWriter(w)
+		defer bw.Flush()
+		if format == "jsonl" {
+			w.Header().Set("Content-Type", "application/jsonl")
+			for _, raw := range recs {
+				var rec historyRecord
+				if json.Unmarshal(raw, &rec) == nil && rec.AtMS >= from && rec.AtMS < to {
+					bw.Write(raw)
+					bw.WriteByte('\n')
+				}
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		var prev historyRecord
+		var b []byte
+		started := false
+		for _, raw := range recs {
+			var rec historyRecord
+			if json.Unmarshal(raw, &rec) != nil || rec.AtMS < from || rec.AtMS >= to {
+				continue
+			}
+			if !started {
+				b = binary.AppendUvarint(append(b, historyDeltaMagic...), uint64(rec.AtMS))
+				prev = historyRecord{AtMS: rec.AtMS}
+				started = true
+			}
+			b = appendHistoryDelta(b, prev, rec)
+			prev = rec
+			if len(b) > 32<<10 {
+				bw.Write(b)
+				b = b[:0]
+			}
+		}
+		if !started {
+			b = binary.AppendUvarint(append(b, historyDeltaMagic...), 0)
+		}
+		bw.Write(b)
+	}
+}
@@ -0,0 +1,128 @@
+package hub
+
+import (
+	"log/slog"
+	"maps"
+	"time"
+)
+
+// Event hooks let an embedder attach its own logic to the hub, e.g.
+// presence tracking, billing or messages of its own, without forking it.
+// Hooks are registered before Start and run in registration order on the
+// hub's goroutines: OnPulse on the channel's pulse loop after the pulse
+// went out, the others on the client's. They must be quick, handing slow
+// work to a goroutine of their own. A panicking hook is logged and
+// skipped, as enrichers are. Internal subscribers, such as the canary,
+// trigger none.
+type hooks struct {
+	connect    []func(*Conn)
+	disconnect []func(*Conn, string)
+	pulse      []func(PulseMessage, PulseObservation)
+	message    []func(*Conn, string, []byte)
+}
+
+// OnConnect calls fn for every client once it has been greeted and joined
+// its channel, so fn may write to it. Call it before Start.
+func (h *Hub) OnConnect(fn func(c *Conn)) {
+	h.hooks.connect = append(h.hooks.connect, fn)
+}
+
+// OnDisconnect calls fn for every client that has gone, with the cause:
+// client_close, reset, timeout, slow, protocol_error or unknown. Call it
+// before Start.
+func (h *Hub) OnDisconnect(fn func(c *Conn, cause string)) {
+	h.hooks.disconnect = append(h.hooks.disconnect, fn)
+}
+
+// OnPulse calls fn for every pulse emitted, on every channel, with how
+// its broadcast went. Call it before Start.
+func (h *Hub) OnPulse(fn func(msg PulseMessage, o PulseObservation)) {
+	h.hooks.pulse = append(h.hooks.pulse, fn)
+}
+
+// OnMessage calls fn for every JSON message a client sends whose type the
+// hub does not handle itself, with that type and the whole message, so
+// embedders can define messages of their own. Call it before Start.
+func (h *Hub) OnMessage(fn func(c *Conn, msgType string, payload []byte)) {
+	h.hooks.message = append(h.hooks.message, fn)
+}
+
+// runHook calls fn, logging rather than passing on a panic.
+func runHook(event string, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("hook panicked", "event", event, "panic", r)
+		}
+	}()
+	fn()
+}
+
+func (k *hooks) connected(c *Conn) {
+	for _, fn := range k.connect {
+		runHook("connect", func() { fn(c) })
+	}
+}
+
+func (k *hooks) disconnected(c *Conn) {
+	if len(k.disconnect) == 0 {
+		return
+	}
+	cause := c.disconnectCause()
+	for _, fn := range k.disconnect {
+		runHook("disconnect", func() { fn(c, cause) })
+	}
+}
+
+func (k *hooks) pulsed(msg PulseMessage, o PulseObservation) {
+	for _, fn := range k.pulse {
+		runHook("pulse", func() { fn(msg, o) })
+	}
+}
+
+func (k *hooks) received(c *Conn, msgType string, payload []byte) {
+	for _, fn := range k.message {
+		runHook("message", func() { fn(c, msgType, payload) })
+	}
+}
+
+// ConnInfo describes a client connection to hooks.
+type ConnInfo struct {
+	// ID is the request ID of the upgrade, as in the logs.
+	ID     string
+	Remote string
+	// ClientID is the ?client_id= the client gave, if any.
+	ClientID string
+	// Subject is who the client authenticated as, if clients must, and
+	// Identity the fields taken from PULSE_IDENTITY_HEADERS.
+	Subject  string
+	Identity map[string]string
+	Tenant   string
+	// Codec is how the client is served, as in the codec metric label:
+	// v1, json, binary, tagged, relay, sse, grpc or webtransport.
+	Codec string
+	// Channels maps the channels the client receives to the rate, every
+	// how many pulses, it receives them at; Channel is its primary one.
+	Channel     string
+	Channels    map[string]uint64
+	ConnectedAt time.Time
+}
+
+// Info describes c as it is now.
+func (c *Conn) Info() ConnInfo {
+	info := ConnInfo{
+		ID:          c.id,
+		Remote:      c.remote,
+		ClientID:    c.clientID,
+		Subject:     c.subject,
+		Identity:    maps.Clone(c.identity),
+		Tenant:      c.tenant,
+		Codec:       connCodec(c),
+		Channel:     c.Channel(),
+		Channels:    map[string]uint64{c.Channel(): max(c.rate.Load(), 1)},
+		ConnectedAt: c.connectedAt,
+	}
+	if also := c.also.Load(); also != nil {
+		maps.Copy(info.Channels, *also)
+	}
+	return info
+}
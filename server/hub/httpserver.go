@@ -0,0 +1,157 @@
+package hub
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpLimits bounds what a client may hold of an HTTP server before its
+// request is handled, so that a slow-loris client trickling headers in,
+// or one that connects and says nothing, gives up its connection instead
+// of keeping a file descriptor and a goroutine for ever. WebSocket and SSE
+// connections leave the limits behind once they are taken over.
+type httpLimits struct {
+	// readHeader is how long a client has to send its request headers,
+	// the whole of an upgrade request. read and write bound the request
+	// with its body and the response, from the start and from the end
+	// of the headers; 0 for no bound. A request still being handled
+	// when read is up has its context cancelled, so both must outlast
+	// long polls and queued handshakes.
+	readHeader, read, write time.Duration
+	// idle is how long a keep-alive connection waits for its next request.
+	idle time.Duration
+	// maxHeaderBytes bounds the request line and headers.
+	maxHeaderBytes int
+}
+
+// Defaults for the PULSE_HTTP_* settings.
+const (
+	defaultReadHeaderTimeout = 5 * time.Second
+	defaultIdleTimeout       = 30 * time.Second
+	defaultMaxHeaderBytes    = 64 << 10
+)
+
+// httpLimitsFromEnv reads the PULSE_HTTP_* settings.
+func httpLimitsFromEnv() httpLimits {
+	return httpLimits{
+		readHeader:     envMS("PULSE_HTTP_READ_HEADER_TIMEOUT_MS", defaultReadHeaderTimeout),
+		read:           envMS("PULSE_HTTP_READ_TIMEOUT_MS", 0),
+		write:          envMS("PULSE_HTTP_WRITE_TIMEOUT_MS", 0),
+		idle:           envMS("PULSE_HTTP_IDLE_TIMEOUT_MS", defaultIdleTimeout),
+		maxHeaderBytes: envInt("PULSE_HTTP_MAX_HEADER_BYTES", defaultMaxHeaderBytes),
+	}
+}
+
+// apply sets the limits on srv. Servers of long-lived streams that are
+// not taken over, like gRPC's, get the header limits only.
+func (l httpLimits) apply(srv *http.Server, streams bool) {
+	srv.ReadHeaderTimeout = l.readHeader
+	srv.MaxHeaderBytes = l.maxHeaderBytes
+	srv.IdleTimeout = l.idle
+	if !streams {
+		srv.ReadTimeout = l.read
+		srv.WriteTimeout = l.write
+	}
+}
+
+// httpConnStates follows the main server's connections through net/http's
+// states, as its ConnState hook, so that the metrics show how many are
+// waiting for a request, being served or idle, and how many were closed
+// before sending anything: port probes, failed TLS handshakes and
+// clients that connect and wait out the header timeout. A slow-loris
+// client that has sent a byte counts as active, as net/http sees it.
+//
+// With a max, it also caps the connections that are open but not taken
+// over, PULSE_MAX_PENDING_CONNS: a flood of half-open connections would
+// otherwise use up file descriptors before PULSE_MAX_CLIENTS and the
+// handshake limits, which only apply to a whole upgrade request, see
+// them. A connection over the cap is closed as soon as it is accepted,
+// without an answer, as there is no request yet to answer. Keep-alive
+// connections and long polls count against it too.
+type httpConnStates struct {
+	max int
+
+	mu     sync.Mutex
+	states map[net.Conn]http.ConnState
+	// open counts the tracked connections by state.
+	open     map[http.ConnState]int
+	hijacked uint64
+	silent   uint64
+	refused  uint64
+	// full is set while connections are being refused, so that it is
+	// logged once per flood.
+	full bool
+}
+
+// newHTTPConnStates tracks connections, capping those not taken over at
+// max; 0 is no cap.
+func newHTTPConnStates(max int) *httpConnStates {
+	return &httpConnStates{
+		max:    max,
+		states: make(map[net.Conn]http.ConnState),
+		open:   make(map[http.ConnState]int),
+	}
+}
+
+// track is the ConnState hook.
+func (s *httpConnStates) track(c net.Conn, state http.ConnState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state == http.StateNew && s.max > 0 {
+		if len(s.states) >= s.max {
+			// Untracked, its close is not counted as silent.
+			c.Close()
+			s.refused++
+			if !s.full {
+				s.full = true
+				slog.Warn("too many connections waiting for a request; refusing new ones", "max", s.max)
+			}
+			return
+		}
+		s.full = false
+	}
+	if prev, ok := s.states[c]; ok {
+		s.open[prev]--
+		if prev == http.StateNew && state == http.StateClosed {
+			s.silent++
+		}
+	}
+	switch state {
+	case http.StateHijacked:
+		s.hijacked++
+		delete(s.states, c)
+	case http.StateClosed:
+		delete(s.states, c)
+	default:
+		s.states[c] = state
+		s.open[state]++
+	}
+}
+
+// write appends the connection state metrics to b; nothing if s is nil.
+func (s *httpConnStates) write(b *strings.Builder) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b.WriteString("# HELP pulse_http_connections HTTP connections not taken over by a client, by state: new ones have sent nothing yet.\n")
+	b.WriteString("# TYPE pulse_http_connections gauge\n")
+	for _, state := range []http.ConnState{http.StateNew, http.StateActive, http.StateIdle} {
+		fmt.Fprintf(b, "pulse_http_connections{state=%q} %d\n", state, s.open[state])
+	}
+	b.WriteString("# HELP pulse_http_connections_hijacked_total HTTP connections taken over by WebSocket and SSE clients.\n")
+	b.WriteString("# TYPE pulse_http_connections_hijacked_total counter\n")
+	fmt.Fprintf(b, "pulse_http_connections_hijacked_total %d\n", s.hijacked)
+	b.WriteString("# HELP pulse_http_connections_silent_total HTTP connections closed before they sent anything.\n")
+	b.WriteString("# TYPE pulse_http_connections_silent_total counter\n")
+	fmt.Fprintf(b, "pulse_http_connections_silent_total %d\n", s.silent)
+	b.WriteString("# HELP pulse_http_connections_refused_total HTTP connections closed on accept because PULSE_MAX_PENDING_CONNS were open.\n")
+	b.WriteString("# TYPE pulse_http_connections_refused_total counter\n")
+	fmt.Fprintf(b, "pulse_http_connections_refused_total %d\n", s.refused)
+}
@@ -0,0 +1,831 @@
+// Package hub is the pulse server: it schedules pulses, fans them out to
+// WebSocket and SSE clients and serves the admin and status APIs. Main runs
+// it as configured by the environment; embedders use New, Start and the
+// Hub's ServeHTTP instead.
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"pulse/clock"
+	"pulse/ws"
+)
+
+// Hub fans pulses out to every connected client. Create one with New,
+// start its pulses with Start and mount it as an http.Handler; Close says
+// goodbye to its clients.
+type Hub struct {
+	mu       sync.RWMutex
+	conns    map[*Conn]struct{}
+	internal int
+	acct     *accounting
+	lag      lagPolicy
+	// queue sizes every connection's write queue; see writequeue.go.
+	queue queuePolicy
+
+	// offsetMS is added to next_ms of every outgoing pulse, e.g. to
+	// compensate for a known downstream processing delay.
+	offsetMS atomic.Int64
+
+	// window is the sampling window length; 0 when windows are off.
+	window time.Duration
+	// pingInterval is how often keepalive pings go out; 0 when off.
+	pingInterval time.Duration
+	// jitter spreads clients' herd jitter over [0, jitterMax); see
+	// jitter.go.
+	jitterMax time.Duration
+	jitter    JitterFunc
+	// clock times the pulse loops: clock.Real unless SetClock replaced it.
+	clock clock.Clock
+	// utc is the clock disciplined by PULSE_TIME_SOURCE, also set as
+	// clock, and timeSource what disciplines it; nil when there is none.
+	// See timesource.go.
+	utc        *clock.Disciplined
+	timeSource *timeSource
+	// identity says which request headers identify a connection.
+	identity identityConfig
+	// origins are the browser origins allowed to connect; see origin.go.
+	origins originPolicy
+	// metrics counts connections by the labels operators chose, and
+	// pulseMetrics pulses per channel.
+	metrics      *connMetrics
+	pulseMetrics *pulseMetrics
+	// httpConns follows the main server's connections until they are
+	// taken over; nil when the hub is not served by Main. See
+	// httpserver.go.
+	httpConns *httpConnStates
+	// fds is the file descriptor budget; nil when the hub is not served
+	// by Main. See fdbudget.go.
+	fds *fdBudget
+	// storms watches disconnects for mass events; nil when disabled.
+	storms *stormDetector
+	// compat warns of feature toggles that would break connected
+	// clients; see capabilities.go. nil only logs them.
+	compat *compatWarner
+	// channels are the named pulse streams, fixed at startup.
+	channels map[string]*pulseChannel
+	// fanouts is the number of pulse broadcasts in progress; handshakes
+	// wait for them (see admission.go).
+	fanouts atomic.Int32
+	// midi sends MIDI clock for the default channel; nil when disabled.
+	midi *midiClock
+	// multicast sends every pulse to a UDP multicast group; nil when
+	// disabled. See multicast.go.
+	multicast *multicastSender
+	// mqtt publishes every pulse to an MQTT broker; nil when disabled.
+	// See mqtt.go.
+	mqtt *mqttPublisher
+	// webhooks posts lifecycle and threshold events; nil when none are
+	// configured. See webhooks.go.
+	webhooks *webhooks
+	// hooks are the embedder's callbacks; see hooks.go.
+	hooks hooks
+
+	// gate, families and limits admit new connections; see admission.go,
+	// listeners.go and limits.go.
+	gate     *handshakeGate
+	families *familyLimits
+	limits   *clientLimits
+	// admission accepts, rejects or routes connections by rule; see
+	// policy.go.
+	admission admissionPolicy
+	// strict rejects frames with reserved bits or opcodes; see wsread.go.
+	strict bool
+	// maxMessage bounds the messages clients send, in bytes.
+	maxMessage int
+	// auth gives connections presenting admin credentials on the upgrade
+	// their role; controllers may send transport_control. nil admits none.
+	auth *adminAuth
+	// subscribers checks the credentials of /ws and /sse clients; nil
+	// lets everyone in. See clientauth.go.
+	subscribers *clientAuth
+	// notices holds the current maintenance announcements; see announce.go.
+	notices *announcements
+	// cues are the two-phase cues awaiting a decision; see cues.go.
+	cues *cues
+	// schedule keeps the one-shot cues scheduled ahead; see schedule.go.
+	schedule *cueSchedule
+	// conductors hold the channels' batons; see conductor.go.
+	conductors *conductors
+	// machines run the channels' show sequences; see machine.go.
+	machines *machines
+	// acks collects client acks for ack summaries; nil when off. See
+	// acks.go.
+	acks *ackSummaries
+	// lock and media are the lockstep and media clocks; nil when disabled.
+	lock  *lockstep
+	media *mediaClock
+	// domains are the clock domains, sorted by name; see clockdomain.go.
+	domains []*clockDomain
+	// timelines records where channels' timelines start; see beatlog.go.
+	timelines *timelineLog
+	// observe is told how every pulse of the default channel went out.
+	observe func(PulseObservation)
+	// tickBudget is the fan-out budget for driven ticks; see tick.go.
+	tickBudget time.Duration
+	// backplane shares pulses with other instances over Redis; nil when
+	// clustering is off. See backplane.go.
+	backplane *backplane
+	// upstream is the server relay mode follows; nil otherwise. See
+	// upstream.go.
+	upstream *upstream
+	// recorder writes emitted pulses to a recording, and replay sends a
+	// recording instead of running the pulse loops; nil when off. See
+	// recording.go.
+	recorder *recorder
+	replay   *replayer
+}
+
+// New returns a hub pulsing its default channel every period, with the
+// defaults PULSE_* variables leave unset. Change the configuration before
+// calling Start.
+func New(period time.Duration) *Hub {
+	h := newHub(newAccounting(nil))
+	h.channels, _ = parseChannels("", period)
+	h.gate = newHandshakeGate(h, gateConfig{Rate: 500, Concurrency: 64, MaxWait: 10 * time.Second})
+	h.families = &familyLimits{}
+	h.limits = &clientLimits{}
+	h.strict = true
+	h.maxMessage = defaultMaxMessage
+	h.lag = lagPolicy{warn: 50 * time.Millisecond, warnEvery: 5 * time.Second}
+	h.queue = queuePolicy{size: defaultWriteQueue, high: priorityTypes(defaultHighPriority)}
+	return h
+}
+
+// Start runs the pulse loops until ctx is done: the default channel from
+// the registered tick source, if any, and every other channel on its own
+// scheduler. A backplane edge runs none and relays the backplane's pulses
+// instead, and a relay its upstream's; a replica relays them until it is
+// elected to lead. A replay sends its recording instead.
+func (h *Hub) Start(ctx context.Context) {
+	switch {
+	case h.replay != nil:
+		go h.replay.run(ctx, h)
+	case h.upstream != nil:
+		slog.Info("pulses are relayed from the upstream", "url", redactURL(h.upstream.url))
+		go h.upstream.follow(ctx, h)
+	case h.backplane.isEdge():
+		slog.Info("pulses are relayed from the backplane")
+		go h.backplane.follow(ctx, h)
+	case h.backplane.isReplica():
+		slog.Info("pulses are relayed from the backplane until this replica leads")
+		go h.backplane.follow(ctx, h)
+		go h.backplane.campaign(ctx, h)
+	default:
+		h.startPulseLoops(ctx)
+	}
+}
+
+// startPulseLoops starts every channel's pulse loop, or the tick source's
+// for the default channel, until ctx is done.
+func (h *Hub) startPulseLoops(ctx context.Context) {
+	def := h.channel(defaultChannel)
+	if tickSource != nil {
+		slog.Info("pulses are driven by an external tick source")
+		go tickSource(newTickDriver(h, def.Period(), h.tickBudget, h.observe))
+	} else {
+		go startPulseLoop(ctx, h, def, h.observe)
+	}
+	// Other channels only fan out; status, alerts, history, the trigger and
+	// MIDI clock follow the default channel.
+	for _, ch := range h.channels {
+		if ch.name != defaultChannel {
+			go startPulseLoop(ctx, h, ch, nil)
+		}
+	}
+}
+
+// Close sends every client a going-away close frame and waits up to
+// timeout for them to go.
+func (h *Hub) Close(timeout time.Duration) {
+	h.closeAll(ws.CloseGoingAway, "server shutting down", timeout)
+}
+
+func newHub(acct *accounting) *Hub {
+	h := &Hub{
+		conns:        make(map[*Conn]struct{}),
+		acct:         acct,
+		metrics:      newConnMetrics(nil),
+		pulseMetrics: newPulseMetrics(),
+		clock:        clock.Real,
+	}
+	h.notices = &announcements{h: h}
+	h.cues = &cues{h: h}
+	h.schedule = &cueSchedule{h: h}
+	h.conductors = &conductors{h: h, batons: make(map[string]baton)}
+	h.machines = &machines{h: h, byName: make(map[string]*stateMachine)}
+	return h
+}
+
+func (h *Hub) add(c *Conn) {
+	if c.internal {
+		c.usage = &tenantUsage{name: "internal"}
+		c.usage.divisor.Store(1)
+	} else {
+		c.usage = h.acct.usage(c.tenant)
+		h.metrics.connected(c)
+	}
+
+	if c.queue.Load() == nil {
+		q := newWriteQueue(h.queue, h.pulseMetrics.dropped, h.pulseMetrics.expired)
+		c.queue.Store(q)
+		go h.writeLoop(c, q)
+	}
+
+	h.mu.Lock()
+	_, known := h.conns[c]
+	if !known {
+		if c.internal {
+			h.internal++
+		} else {
+			c.usage.connected()
+		}
+	}
+	h.conns[c] = struct{}{}
+	n := len(h.conns) - h.internal
+	h.mu.Unlock()
+	if !known && !c.internal {
+		h.webhooks.connection(c, true, n)
+		h.hooks.connected(c)
+	}
+}
+
+func (h *Hub) remove(c *Conn) {
+	// After h.mu is released: giving back a baton tells the channel.
+	defer h.conductors.left(c)
+	h.mu.Lock()
+	_, ok := h.conns[c]
+	delete(h.conns, c)
+	if ok {
+		if c.internal {
+			h.internal--
+		} else {
+			c.series.conns.Add(-1)
+			c.usage.conns.Add(-1)
+			h.acct.ledger.disconnected(c, time.Now())
+			h.storms.disconnect(c.disconnectCause(), c.remote, len(h.conns)-h.internal, time.Now())
+		}
+	}
+	n := len(h.conns) - h.internal
+	_ = c.Close()
+	h.mu.Unlock()
+	if ok && !c.internal {
+		h.webhooks.connection(c, false, n)
+		h.hooks.disconnected(c)
+	}
+}
+
+// Count returns the number of connected clients, excluding internal
+// subscribers.
+func (h *Hub) Count() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.conns) - h.internal
+}
+
+// find returns the client connection with the given request ID.
+func (h *Hub) find(id string) *Conn {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for c := range h.conns {
+		if !c.internal && c.id == id {
+			return c
+		}
+	}
+	return nil
+}
+
+func (h *Hub) setOffset(d time.Duration) {
+	h.offsetMS.Store(d.Milliseconds())
+}
+
+func (h *Hub) offset() time.Duration {
+	return time.Duration(h.offsetMS.Load()) * time.Millisecond
+}
+
+// broadcastPulse queues msg for every connection, in shards run in
+// parallel (see fanout.go), encoding it once per negotiated protocol,
+// output offset and simulcast rate. With a non-zero budget it returns the
+// clients whose frame was not queued within budget of the start of the
+// fan-out or had to wait behind others, and how many clients were dropped.
+func (h *Hub) broadcastPulse(msg PulseMessage, budget time.Duration) (late []string, failed int) {
+	h.fanouts.Add(1)
+	defer h.fanouts.Add(-1)
+	start := time.Now()
+	h.mu.RLock()
+	conns := make([]*Conn, 0, len(h.conns))
+	for c := range h.conns {
+		conns = append(conns, c)
+	}
+	h.mu.RUnlock()
+	var (
+		fair  *fairPlan
+		views map[uint64]PulseMessage
+	)
+	if ch := h.channel(msg.Channel); ch != nil {
+		if ch.feature(featureFairDelivery) {
+			fair = planFair(conns, ch, start)
+		}
+		views = ch.simulcastPulses(msg)
+	}
+
+	f := &fanout{h: h, msg: msg, start: start, budget: budget, views: views, fair: fair}
+	late, failed, shards, slowest := f.run(conns)
+	h.pulseMetrics.observeFanout(msg.Channel, shards, slowest)
+	h.acct.evaluate(time.Now())
+	if fair != nil {
+		h.pulseMetrics.observeFair(msg.Channel, fair.report())
+	}
+	return late, failed
+}
+
+// Broadcast sends a JSON event (media change, round end, …) to every
+// non-legacy client. Legacy clients only ever get pulses.
+func (h *Hub) Broadcast(v any) {
+	h.BroadcastIf(v, nil)
+}
+
+// BroadcastIf is Broadcast limited to the clients want
+// accepts; nil accepts all.
+func (h *Hub) BroadcastIf(v any, want func(*Conn) bool) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("marshal message", "err", err)
+		return
+	}
+	h.mu.RLock()
+	conns := make([]*Conn, 0, len(h.conns))
+	for c := range h.conns {
+		if !c.internal && c.proto != protoLegacy && (want == nil || want(c)) {
+			conns = append(conns, c)
+		}
+	}
+	h.mu.RUnlock()
+	frames := map[bool][]byte{}
+	for _, c := range conns {
+		frame, ok := frames[c.sse]
+		if !ok {
+			frame = wireFrame(c.sse, ws.OpText, data)
+			frames[c.sse] = frame
+		}
+		if err := c.writeEncoded(ws.OpText, data, frame, "", time.Time{}); err != nil {
+			h.writeFailed(c, err)
+		}
+	}
+}
+
+// ServeHTTP upgrades a WebSocket request and keeps the client subscribed
+// until it leaves. Mounted on a pattern with a {channel} wildcard it
+// subscribes to that channel; otherwise to the default one.
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if requestIDFrom(r.Context()) == "" {
+		// Mounted on an embedder's mux rather than behind Main's.
+		withRequestID(h).ServeHTTP(w, r)
+		return
+	}
+	if ok, wait := h.limits.allowUpgrade(r.RemoteAddr); !ok {
+		h.limits.rejectRate(w, r, wait)
+		return
+	}
+	ch := h.channel(defaultChannel)
+	if name := r.PathValue("channel"); name != "" {
+		if ch = h.channel(name); ch == nil {
+			http.Error(w, fmt.Sprintf("unknown channel %q", name), http.StatusNotFound)
+			return
+		}
+	}
+	rate, err := parseRate(r.URL.Query().Get("rate"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	every, err := parseEvery(r.URL.Query().Get("every"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	micros, err := parsePrecision(r.URL.Query().Get("precision"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.origins.allow(r) {
+		connLog.log(churnLevel(), "connection rejected", "request_id", requestIDFrom(r.Context()), "remote", r.RemoteAddr, "origin", r.Header.Get("Origin"))
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	subject, err := h.subscribers.authenticate(r, h.auth)
+	if err != nil {
+		rejectUnauthenticated(w, r, err)
+		return
+	}
+	ident, err := h.identity.fromRequest(r)
+	if err != nil {
+		connLog.log(churnLevel(), "connection rejected", "request_id", requestIDFrom(r.Context()), "remote", r.RemoteAddr, "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rule := h.admission.decide(admissionRequest{
+		ip:       remoteIP(r.RemoteAddr),
+		tenant:   tenantFromRequest(r),
+		channel:  ch.name,
+		header:   r.Header,
+		identity: ident,
+		clients:  h.Count(),
+	}); rule != nil {
+		switch rule.action {
+		case "reject":
+			connLog.log(churnLevel(), "connection rejected", "request_id", requestIDFrom(r.Context()), "remote", r.RemoteAddr, "rule", rule.text)
+			http.Error(w, "connection rejected by admission policy", http.StatusForbidden)
+			return
+		case "route":
+			ch = h.channel(rule.channel)
+		}
+	}
+	if !ch.offers(rate) {
+		http.Error(w, fmt.Sprintf("channel %q has no rate %d", ch.name, rate), http.StatusBadRequest)
+		return
+	}
+	leaveAll, ok := h.limits.acquire()
+	if !ok {
+		h.limits.rejectFull(w, r)
+		return
+	}
+	leaveFamily, ok := h.families.acquire(r.RemoteAddr)
+	if !ok {
+		leaveAll()
+		h.families.reject(w)
+		return
+	}
+	leave := func() { leaveFamily(); leaveAll() }
+	joined := false
+	defer func() {
+		if !joined {
+			leave()
+		}
+	}()
+	release, err := h.gate.acquire(r.Context())
+	if err != nil {
+		h.gate.reject(w, err)
+		return
+	}
+	defer release()
+	c, err := upgradeWebSocket(w, r)
+	if err != nil {
+		connLog.log(slog.LevelWarn, "upgrade failed", "request_id", requestIDFrom(r.Context()), "remote", r.RemoteAddr, "err", err)
+		// Advertise what we speak so clients can retry with a
+		// supported subprotocol, like Sec-WebSocket-Version in RFC
+		// 6455 section 4.4.
+		w.Header().Set("Sec-WebSocket-Protocol", strings.Join(supportedProtocols, ", "))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.identity = ident
+	c.subject = subject
+	c.clientID = r.URL.Query().Get("client_id")
+	c.caps.Store(capsFromRequest(r))
+	c.role, _ = h.auth.allow(r)
+	c.ch.Store(ch)
+	if c.proto != protoRelay {
+		c.rate.Store(rate)
+		c.every.Store(every)
+		c.micros.Store(micros)
+	}
+	if c.proto != protoLegacy {
+		if err := h.greet(c); err != nil {
+			_ = c.Close()
+			return
+		}
+	}
+	h.add(c)
+	joined = true
+	if c.proto != protoLegacy {
+		go h.diagnose(c)
+	}
+	connLog.log(churnLevel(), "client connected", "request_id", c.id, "remote", c.remote, "subject", c.subject, "proto", c.proto, "tenant", c.tenant, "channel", c.Channel(), "clients", h.Count())
+
+	go func(conn *Conn) {
+		defer func() {
+			leave()
+			h.remove(conn)
+			connLog.log(churnLevel(), "client disconnected", "request_id", conn.id, "remote", conn.remote, "clients", h.Count())
+		}()
+		conn.readLoop(h.strict, h.maxMessage, h.handleMessage)
+	}(c)
+}
+
+// handleMessage handles a message from c. Clients only send text messages (channel subscription, clock sync,
+// self-tests, lockstep input, media control) for now; binary messages are accepted and ignored.
+func (h *Hub) handleMessage(c *Conn, opcode byte, payload []byte) {
+	if opcode != ws.OpText || c.proto == protoLegacy {
+		return
+	}
+	var head struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(payload, &head) != nil {
+		return
+	}
+	switch {
+	case head.Type == "subscribe":
+		var m subscribeMessage
+		if json.Unmarshal(payload, &m) != nil {
+			return
+		}
+		if err := h.subscribe(c, m.Channel, m.Rate, m.Add); err != nil {
+			h.refuseSubscription(c, "subscribe", err)
+			return
+		}
+		slog.Log(context.Background(), churnLevel(), "client subscribed", "request_id", c.id, "channel", m.Channel, "rate", c.rateFor(m.Channel), "add", m.Add)
+	case head.Type == "unsubscribe":
+		var m unsubscribeMessage
+		if json.Unmarshal(payload, &m) != nil {
+			return
+		}
+		if err := h.unsubscribe(c, m.Channel); err != nil {
+			h.refuseSubscription(c, "unsubscribe", err)
+			return
+		}
+		slog.Log(context.Background(), churnLevel(), "client unsubscribed", "request_id", c.id, "channel", m.Channel)
+	case head.Type == "decimate":
+		var m decimateMessage
+		if json.Unmarshal(payload, &m) != nil {
+			return
+		}
+		if err := h.decimate(c, m.Every); err != nil {
+			h.refuseSubscription(c, "decimate", err)
+			return
+		}
+		slog.Debug("client decimated", "request_id", c.id, "every", m.Every)
+	case head.Type == "set_format":
+		var m setFormatMessage
+		if json.Unmarshal(payload, &m) != nil {
+			return
+		}
+		if err := h.setFormat(c, m.Format); err != nil {
+			h.refuseSubscription(c, "set_format", err)
+			return
+		}
+		slog.Debug("client set format", "request_id", c.id, "format", m.Format)
+	case head.Type == "set_precision":
+		var m setPrecisionMessage
+		if json.Unmarshal(payload, &m) != nil {
+			return
+		}
+		if err := h.setPrecision(c, m.Precision); err != nil {
+			h.refuseSubscription(c, "set_precision", err)
+			return
+		}
+		slog.Debug("client set precision", "request_id", c.id, "precision", m.Precision)
+	case head.Type == "capabilities":
+		var m capabilitiesMessage
+		if json.Unmarshal(payload, &m) != nil {
+			return
+		}
+		caps, err := parseCaps(m.Client, m.Caps)
+		if err != nil {
+			slog.Debug("ignoring client capabilities", "request_id", c.id, "err", err)
+			return
+		}
+		c.caps.Store(caps)
+		slog.Debug("client announced capabilities", "request_id", c.id, "client", caps.client, "caps", caps.caps)
+	case head.Type == "transport_control":
+		var m transportControlMessage
+		if json.Unmarshal(payload, &m) != nil {
+			return
+		}
+		if m.Channel == "" {
+			m.Channel = c.Channel()
+		}
+		err := h.conductors.allows(c, m.Channel)
+		if err == nil {
+			err = h.controlTransport(m.Channel, m.Action, c.id)
+		}
+		if err != nil {
+			h.refuseControl(c, "transport_control", m.Channel, err)
+			return
+		}
+		slog.Info("transport control", "action", m.Action, "request_id", c.id, "channel", m.Channel)
+	case head.Type == "conduct":
+		var m conductMessage
+		if json.Unmarshal(payload, &m) != nil {
+			return
+		}
+		if m.Channel == "" {
+			m.Channel = c.Channel()
+		}
+		if err := h.conductors.conduct(c, m); err != nil {
+			h.refuseControl(c, "conduct", m.Channel, err)
+		}
+	case head.Type == "tempo_control":
+		var m tempoControlMessage
+		if json.Unmarshal(payload, &m) != nil {
+			return
+		}
+		if m.Channel == "" {
+			m.Channel = c.Channel()
+		}
+		if _, err := h.tempoControl(c, m); err != nil {
+			h.refuseControl(c, "tempo_control", m.Channel, err)
+		}
+	case head.Type == "backfill":
+		var m backfillRequest
+		if json.Unmarshal(payload, &m) != nil || c.proto == protoRelay {
+			return
+		}
+		ch := h.channel(c.Channel())
+		if err := c.WriteJSON(ch.recent.since(ch.name, m.SinceSeq, c.wantsMicros())); err != nil {
+			slog.Debug("backfill", "request_id", c.id, "err", err)
+		}
+	case head.Type == "ack" && h.acks != nil:
+		var m ackMessage
+		if json.Unmarshal(payload, &m) == nil {
+			h.acks.observe(c, m)
+		}
+	case head.Type == "cue_ready":
+		var m cueReadyMessage
+		if json.Unmarshal(payload, &m) == nil {
+			h.cues.ready(c, m.ID)
+		}
+	case head.Type == "sync_req":
+		if !answerSync(c, payload, h.utc) {
+			slog.Debug("ignoring sync_req without a numeric t1", "request_id", c.id)
+		}
+	case head.Type == "selftest":
+		if err := answerSelfTest(c, payload); err != nil {
+			slog.Warn("selftest", "request_id", c.id, "err", err)
+		}
+	case head.Type == "input" && h.lock != nil:
+		var m inputMessage
+		if json.Unmarshal(payload, &m) == nil {
+			h.lock.submit(c, m)
+		}
+	case head.Type == "media_control" && h.media != nil:
+		var m mediaControlMessage
+		if json.Unmarshal(payload, &m) != nil {
+			return
+		}
+		if c.role < roleController {
+			h.refuseControl(c, "media_control", "", errControlRole)
+			return
+		}
+		st, err := h.media.control(m, h.clock.Now())
+		if err != nil {
+			h.refuseControl(c, "media_control", "", err)
+			return
+		}
+		slog.Info("media control", "action", m.Action, "request_id", c.id, "position_ms", st.PositionMS, "rate", st.Rate)
+		h.Broadcast(mediaMessage{Type: "media", mediaState: st, By: c.id})
+	default:
+		h.hooks.received(c, head.Type, payload)
+	}
+}
+
+// refuseSubscription logs a failed subscription request and tells c why,
+// along with what it still receives.
+func (h *Hub) refuseSubscription(c *Conn, request string, err error) {
+	slog.Warn(request, "request_id", c.id, "err", err)
+	if werr := c.WriteJSON(h.subscriptions(c, err.Error())); werr != nil {
+		slog.Debug(request, "request_id", c.id, "err", werr)
+	}
+}
+
+// helloMessage is sent once to every client right after the upgrade.
+type helloMessage struct {
+	Type      string `json:"type"`
+	RequestID string `json:"request_id"`
+	PeriodMS  int64  `json:"period_ms"`
+	NowMS     int64  `json:"now_ms"`
+	// Channel is the channel the client receives; period_ms is its period.
+	Channel string `json:"channel,omitempty"`
+	// Channels lists the channels a relay connection will receive.
+	Channels []string `json:"channels,omitempty"`
+	// Paused is set while the channel's transport is paused.
+	Paused bool `json:"paused,omitempty"`
+	// Features lists the experimental features on for the channel (for
+	// relay connections: on for every channel).
+	Features []string `json:"features,omitempty"`
+	// Tempo is the channel's tempo, if it has one; see tempo.go.
+	Tempo *tempoInfo `json:"tempo,omitempty"`
+	// Pattern lists the lengths of the steps of the channel's pattern in
+	// periods, if it has one and the client gets every step; see
+	// pattern.go.
+	Pattern []float64 `json:"pattern,omitempty"`
+	// Rate is the simulcast rate the client receives, when not every
+	// pulse, and Rates those the channel is offered at; see simulcast.go.
+	Rate  uint64   `json:"rate,omitempty"`
+	Rates []uint64 `json:"rates,omitempty"`
+	// JitterMS is the client's herd jitter; see jitter.go.
+	JitterMS *int64 `json:"jitter_ms,omitempty"`
+	// Every is the client's decimation divisor, when not every pulse; see
+	// decimate.go.
+	Every uint64 `json:"every,omitempty"`
+	// Domain is the clock domain the channel is bound to; see
+	// clockdomain.go.
+	Domain string `json:"domain,omitempty"`
+	// Precision is "us" for a client that asked for microseconds, and
+	// PeriodUS then the exact period; see precision.go.
+	Precision string `json:"precision,omitempty"`
+	PeriodUS  int64  `json:"period_us,omitempty"`
+}
+
+func (h *Hub) newHello(c *Conn) helloMessage {
+	ch := h.channel(c.Channel())
+	hello := helloMessage{
+		Type:      "hello",
+		RequestID: c.id,
+		PeriodMS:  ch.Period().Milliseconds(),
+		NowMS:     h.clock.Now().UnixMilli(),
+		JitterMS:  h.herdJitter(c),
+	}
+	if c.proto == protoRelay {
+		hello.Channels = h.channelNames()
+		hello.Features = h.commonFeatures()
+	} else {
+		hello.Channel = ch.name
+		hello.Paused = ch.transport.isPaused()
+		hello.Features = ch.featureList()
+		hello.Tempo = ch.tempo.info(ch.Period())
+		hello.Rates = ch.rates()
+		if rate := c.rate.Load(); rate > 1 {
+			hello.Rate = rate
+			hello.PeriodMS *= int64(rate)
+		} else {
+			hello.Pattern = ch.pattern.info()
+		}
+		if every := c.every.Load(); every > 1 {
+			hello.Every = every
+		}
+		if ch.domain != nil {
+			hello.Domain = ch.domain.name
+		}
+		if hello.Precision = c.precision(); hello.Precision != "" {
+			hello.PeriodUS = ch.Period().Microseconds() * int64(max(c.rate.Load(), 1))
+		}
+	}
+	return hello
+}
+
+// greet sends a new non-legacy client its hello and, with sampling windows
+// on, the window in progress so it need not wait for the next one, and
+// the announcements and cue prepares current for its channel.
+func (h *Hub) greet(c *Conn) error {
+	if err := c.WriteJSON(h.newHello(c)); err != nil {
+		return err
+	}
+	now := h.clock.Now()
+	if h.window > 0 {
+		if err := c.WriteJSON(windowAt(now, h.window)); err != nil {
+			return err
+		}
+	}
+	for _, m := range h.notices.current(c, now) {
+		if err := c.WriteJSON(m); err != nil {
+			return err
+		}
+	}
+	for _, m := range h.cues.current(c) {
+		if err := c.WriteJSON(m); err != nil {
+			return err
+		}
+	}
+	for _, m := range h.schedule.current(c, now) {
+		if err := c.WriteJSON(m); err != nil {
+			return err
+		}
+	}
+	for _, m := range h.conductors.current(c) {
+		if err := c.WriteJSON(m); err != nil {
+			return err
+		}
+	}
+	for _, m := range h.machines.current(c) {
+		if err := c.WriteJSON(m); err != nil {
+			return err
+		}
+	}
+	if c.proto == protoRelay {
+		for _, name := range h.channelNames() {
+			if m := h.channel(name).ending(); m != nil {
+				if err := c.WriteJSON(relayEnvelope{Type: "relay", Channel: name, Message: m}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if ch := c.ch.Load(); ch != nil {
+		if m := ch.ending(); m != nil {
+			return c.WriteJSON(m)
+		}
+	}
+	return nil
+}
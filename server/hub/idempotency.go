@@ -0,0 +1,204 @@
+package hub
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Automation that retries a control request on a timeout cannot tell
+// whether the first attempt took effect. Mutating requests to the admin API
+// may carry an Idempotency-Key header: the first request with a key is
+// served and its response kept for the idempotency window; a retry with
+// the same key and credentials, checked as for any request, gets the kept
+// response, marked
+// Idempotent-Replayed: true, without being applied again. A retry with a
+// different method, path or body is refused with 422, and one arriving while
+// the first is still being served with 409.
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	replayedHeader    = "Idempotent-Replayed"
+)
+
+// maxIdempotencyKeys bounds the responses kept; past it the oldest go
+// first, as they would at the end of the window.
+const maxIdempotencyKeys = 10000
+
+// maxIdempotencyBody bounds the request bodies read to compare retries,
+// and the responses kept.
+const maxIdempotencyBody = 1 << 20
+
+// idempotentResponse is a response kept for retries; done is set once the
+// first request has been served.
+type idempotentResponse struct {
+	fingerprint [sha256.Size]byte
+	at          time.Time
+	done        bool
+
+	status int
+	header http.Header
+	body   []byte
+}
+
+// idempotency keeps the responses to requests with an Idempotency-Key by
+// credentials and key.
+type idempotency struct {
+	window time.Duration
+
+	mu    sync.Mutex
+	kept  map[string]*idempotentResponse
+	order []string // keys, oldest first
+}
+
+func newIdempotency(window time.Duration) *idempotency {
+	return &idempotency{window: window, kept: make(map[string]*idempotentResponse)}
+}
+
+// withIdempotency deduplicates retried mutating requests to next, once
+// their credentials have been checked; see above. A nil idempotency or a
+// zero window passes every request through.
+func withIdempotency(d *idempotency, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if d == nil || d.window <= 0 || key == "" || !mutates(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validRequestID(key) {
+			http.Error(w, idempotencyHeader+" must be 1 to 128 printable characters", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotencyBody+1))
+		if err != nil || len(body) > maxIdempotencyBody {
+			http.Error(w, "request body too large to deduplicate", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		h := sha256.New()
+		h.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+		h.Write(body)
+		var fp [sha256.Size]byte
+		h.Sum(fp[:0])
+		scoped := credentialScope(r) + "\x00" + key
+
+		kept, fresh := d.claim(scoped, fp, time.Now())
+		switch {
+		case !fresh && kept.fingerprint != fp:
+			http.Error(w, idempotencyHeader+" was already used for a different request", http.StatusUnprocessableEntity)
+			return
+		case !fresh && !kept.done:
+			http.Error(w, "a request with this "+idempotencyHeader+" is still in progress", http.StatusConflict)
+			return
+		case !fresh:
+			for k, v := range kept.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set(replayedHeader, "true")
+			w.WriteHeader(kept.status)
+			_, _ = w.Write(kept.body)
+			return
+		}
+		rec := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		d.finish(scoped, rec)
+	})
+}
+
+// mutates reports whether r may change state.
+func mutates(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// credentialScope identifies who sent r, so one caller's key never
+// replays another's response: the signing key ID of a signed request, or
+// a hash of its Authorization header.
+func credentialScope(r *http.Request) string {
+	if id := r.Header.Get(signatureKeyHeader); id != "" {
+		return "key:" + id
+	}
+	sum := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+	return string(sum[:])
+}
+
+// claim returns the response kept for key and false, or reserves key for
+// a new request with fingerprint fp and returns true.
+func (d *idempotency) claim(key string, fp [sha256.Size]byte, now time.Time) (*idempotentResponse, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.prune(now)
+	if kept, ok := d.kept[key]; ok {
+		return kept, false
+	}
+	d.kept[key] = &idempotentResponse{fingerprint: fp, at: now}
+	d.order = append(d.order, key)
+	for len(d.order) > maxIdempotencyKeys {
+		delete(d.kept, d.order[0])
+		d.order = d.order[1:]
+	}
+	return nil, true
+}
+
+// finish keeps rec's response for key. Responses a retry could change,
+// rate limits and server errors, are forgotten so the retry is served
+// afresh.
+func (d *idempotency) finish(key string, rec *recordingWriter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	kept, ok := d.kept[key]
+	if !ok {
+		return
+	}
+	switch {
+	case rec.status == http.StatusTooManyRequests, rec.status >= 500, rec.overflow:
+		delete(d.kept, key)
+		return
+	}
+	kept.status, kept.header, kept.body, kept.done = rec.status, rec.Header().Clone(), rec.body.Bytes(), true
+	// The request ID belongs to the first attempt; the retry has its own.
+	kept.header.Del(requestIDHeader)
+}
+
+// prune forgets responses older than the window; the caller holds d.mu.
+func (d *idempotency) prune(now time.Time) {
+	n := 0
+	for _, key := range d.order {
+		kept, ok := d.kept[key]
+		if ok && now.Sub(kept.at) < d.window {
+			break
+		}
+		delete(d.kept, key)
+		n++
+	}
+	d.order = d.order[n:]
+}
+
+// recordingWriter passes a response through and keeps a copy of it.
+type recordingWriter struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.body.Len()+len(b) > maxIdempotencyBody {
+		w.overflow = true
+	} else {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,93 @@
+package hub
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"pulse/ws"
+)
+
+// identityRules validate identity header values by rule name.
+var identityRules = map[string]func(string) bool{
+	"name": validName,
+	"ip":   func(s string) bool { return net.ParseIP(s) != nil },
+	"uuid": validUUID,
+	"text": func(s string) bool {
+		return s != "" && len(s) <= 256 && strings.IndexFunc(s, func(r rune) bool { return !unicode.IsPrint(r) }) < 0
+	},
+}
+
+// identityField copies one request header into connection identity.
+type identityField struct {
+	name, header, rule string
+}
+
+// identityConfig lists the identity fields taken from upgrade requests.
+type identityConfig []identityField
+
+// parseIdentityHeaders parses comma-separated "field=Header[:rule]"
+// entries, e.g. "device=X-Device-Id,edge_ip=CF-Connecting-IP:ip". The rule
+// defaults to name.
+func parseIdentityHeaders(raw string) (identityConfig, error) {
+	var cfg identityConfig
+	for _, entry := range ws.SplitHeaderList(raw) {
+		name, header, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !validName(name) {
+			return nil, fmt.Errorf("invalid identity header %q", entry)
+		}
+		header, rule, _ := strings.Cut(strings.TrimSpace(header), ":")
+		if rule == "" {
+			rule = "name"
+		}
+		if _, ok := identityRules[rule]; !ok || header == "" {
+			return nil, fmt.Errorf("invalid identity header %q (rules: name, ip, uuid, text)", entry)
+		}
+		cfg = append(cfg, identityField{name: name, header: http.CanonicalHeaderKey(header), rule: rule})
+	}
+	return cfg, nil
+}
+
+// fromRequest returns the identity carried by r. Missing headers are
+// skipped; a present header that fails its rule rejects the request, so a
+// misconfigured device is caught at connect time rather than mislabeled.
+func (cfg identityConfig) fromRequest(r *http.Request) (map[string]string, error) {
+	var id map[string]string
+	for _, f := range cfg {
+		v := strings.TrimSpace(r.Header.Get(f.header))
+		if v == "" {
+			continue
+		}
+		if !identityRules[f.rule](v) {
+			return nil, fmt.Errorf("invalid %s header: not a valid %s", f.header, f.rule)
+		}
+		if id == nil {
+			id = make(map[string]string, len(cfg))
+		}
+		id[f.name] = v
+	}
+	return id, nil
+}
+
+// validUUID accepts the canonical 8-4-4-4-12 hex form.
+func validUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, r := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if r != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+				return false
+			}
+		}
+	}
+	return true
+}
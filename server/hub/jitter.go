@@ -0,0 +1,50 @@
+package hub
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+// Herd jitter spreads clients that act on the same pulse, e.g. workers
+// refreshing a cache every minute, so they do not all hit a downstream
+// system at next_ms. With PULSE_HERD_JITTER_MS set, every hello carries a
+// jitter_ms in [0, PULSE_HERD_JITTER_MS) for the client to add to each
+// next_ms it acts on. It is derived from the client's ?client_id= (its
+// request ID without one), so a worker that reconnects keeps its slot.
+
+// JitterFunc returns a client's herd jitter, in [0, max).
+type JitterFunc func(clientID string, max time.Duration) time.Duration
+
+// hashJitter is the default JitterFunc: an FNV-1a hash of the client ID,
+// spread evenly over [0, max).
+func hashJitter(clientID string, max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	f := fnv.New64a()
+	f.Write([]byte(clientID))
+	return time.Duration(f.Sum64() % uint64(max))
+}
+
+// SetHerdJitter gives every client a herd jitter of up to max, chosen by fn,
+// or by a hash of its client ID if fn is nil; max 0 turns jitter off. Call
+// it before Start.
+func (h *Hub) SetHerdJitter(max time.Duration, fn JitterFunc) {
+	if fn == nil {
+		fn = hashJitter
+	}
+	h.jitterMax, h.jitter = max, fn
+}
+
+// herdJitter returns c's herd jitter in milliseconds; nil with jitter off.
+func (h *Hub) herdJitter(c *Conn) *int64 {
+	if h.jitterMax <= 0 || h.jitter == nil {
+		return nil
+	}
+	id := c.clientID
+	if id == "" {
+		id = c.id
+	}
+	ms := min(max(h.jitter(id, h.jitterMax), 0), h.jitterMax-1).Milliseconds()
+	return &ms
+}
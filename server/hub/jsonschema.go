@@ -0,0 +1,128 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// jsonSchema is the subset of JSON Schema the config API needs: type,
+// properties, additionalProperties, required, minimum and maximum.
+// Keywords it does not know are ignored, so schemas must stay within it.
+type jsonSchema struct {
+	Type       string                 `json:"type"`
+	Properties map[string]*jsonSchema `json:"properties"`
+	Required   []string               `json:"required"`
+	Minimum    *float64               `json:"minimum"`
+	Maximum    *float64               `json:"maximum"`
+
+	// additionalProperties is either false or a schema.
+	Additional   *jsonSchema `json:"-"`
+	NoAdditional bool        `json:"-"`
+}
+
+func (s *jsonSchema) UnmarshalJSON(b []byte) error {
+	type plain jsonSchema
+	var aux struct {
+		*plain
+		Additional json.RawMessage `json:"additionalProperties"`
+	}
+	aux.plain = (*plain)(s)
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	switch strings.TrimSpace(string(aux.Additional)) {
+	case "", "true":
+	case "false":
+		s.NoAdditional = true
+	default:
+		s.Additional = new(jsonSchema)
+		return json.Unmarshal(aux.Additional, s.Additional)
+	}
+	return nil
+}
+
+// schemaError is one validation failure; Path is a JSON Pointer into the
+// document.
+type schemaError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// validate checks doc against s. doc must have been decoded with
+// json.Decoder.UseNumber so integers can be told from other numbers.
+func (s *jsonSchema) validate(doc any) []schemaError {
+	var errs []schemaError
+	s.check(doc, "", &errs)
+	return errs
+}
+
+func (s *jsonSchema) check(v any, path string, errs *[]schemaError) {
+	fail := func(format string, args ...any) {
+		*errs = append(*errs, schemaError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	if s.Type != "" && jsonType(v, s.Type) != s.Type {
+		fail("must be of type %s", s.Type)
+		return
+	}
+	if n, ok := v.(json.Number); ok {
+		f, _ := n.Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			fail("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			fail("must be at most %v", *s.Maximum)
+		}
+	}
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return
+	}
+	for _, name := range s.Required {
+		if _, ok := obj[name]; !ok {
+			fail("missing required property %q", name)
+		}
+	}
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sub := path + "/" + pointerEscaper.Replace(name)
+		switch {
+		case s.Properties[name] != nil:
+			s.Properties[name].check(obj[name], sub, errs)
+		case s.NoAdditional:
+			*errs = append(*errs, schemaError{Path: sub, Message: "unknown property"})
+		case s.Additional != nil:
+			s.Additional.check(obj[name], sub, errs)
+		}
+	}
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// jsonType names the JSON Schema type of v, reporting integral numbers as
+// "integer" when want is integer.
+func jsonType(v any, want string) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := v.Int64(); err == nil && want == "integer" {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,51 @@
+package hub
+
+import (
+	"time"
+
+	"pulse/ws"
+)
+
+// keepalive pings every client each interval and evicts those that have not
+// sent anything (a pong or any other frame) for interval+timeout. Without it
+// peers that vanish silently (NAT timeouts, sleeping laptops) linger until a
+// pulse write happens to fail.
+func (h *Hub) keepalive(interval, timeout time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		h.mu.RLock()
+		conns := make([]*Conn, 0, len(h.conns))
+		for c := range h.conns {
+			if !c.internal {
+				conns = append(conns, c)
+			}
+		}
+		h.mu.RUnlock()
+
+		for _, c := range conns {
+			// SSE subscribers cannot answer; their ping is just a comment
+			// that keeps the stream alive.
+			if c.sse {
+				if err := c.writeFrame(ws.OpPing, nil); err != nil {
+					c.setCause(netCause(err))
+					h.remove(c)
+				}
+				continue
+			}
+			seen := c.lastRead.Load()
+			if seen == 0 {
+				seen = c.connectedAt.UnixNano()
+			}
+			if silent := now.Sub(time.Unix(0, seen)); silent > interval+timeout {
+				connLog.log(churnLevel(), "client unresponsive", "request_id", c.id, "remote", c.remote, "silent", silent.Round(time.Millisecond))
+				c.setCause(causeTimeout)
+				h.remove(c)
+				continue
+			}
+			if err := c.writeFrame(ws.OpPing, pingPayload(time.Now())); err != nil {
+				c.setCause(netCause(err))
+				h.remove(c)
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package hub
+
+import (
+	"log/slog"
+	"time"
+
+	"pulse/ws"
+)
+
+// lagPolicy decides what happens to clients whose writes are slow. A client
+// is lagging once a frame takes longer than warn from being queued to
+// written; it is then sent a
+// warning so it can shed load voluntarily, and is only dropped if a later
+// write takes longer than drop.
+type lagPolicy struct {
+	warn time.Duration
+	// drop is the hard limit; 0 leaves dropping to the write deadline.
+	drop time.Duration
+	// warnEvery rate-limits warnings to the same client.
+	warnEvery time.Duration
+}
+
+// warningMessage tells a client it is falling behind.
+type warningMessage struct {
+	Type   string  `json:"type"`
+	Reason string  `json:"reason"`
+	LagMS  float64 `json:"lag_ms"`
+	// LimitMS is the lag at which the server drops the connection.
+	LimitMS int64 `json:"limit_ms"`
+}
+
+// checkLag applies the lag policy after c's writer sent it a pulse and
+// reports whether the client should stay connected. Legacy clients cannot
+// be warned, so for them the soft limit only shows up in the admin API.
+func (h *Hub) checkLag(c *Conn, now time.Time) bool {
+	p := h.lag
+	lag := time.Duration(c.lastWrite.Load())
+	if c.internal || p.warn <= 0 || lag <= p.warn {
+		return true
+	}
+
+	warned := c.warnedAt.Load()
+	if p.drop > 0 && lag > p.drop && (warned != 0 || c.proto == protoLegacy) {
+		connLog.log(slog.LevelWarn, "dropping lagging client", "request_id", c.id, "remote", c.remote, "lag", lag, "limit", p.drop)
+		c.setCause(causeSlow)
+		// This runs on c's writer, so the close frame cannot wait in the
+		// queue behind it.
+		_ = c.writeNow(outFrame{opcode: ws.OpClose, payload: ws.ClosePayload(ws.ClosePolicyViolation, "client too slow"), queued: time.Now()})
+		return false
+	}
+
+	if c.proto == protoLegacy || (warned != 0 && now.Sub(time.Unix(0, warned)) < p.warnEvery) {
+		return true
+	}
+	c.warnedAt.Store(now.UnixNano())
+	limit := p.drop
+	if limit <= 0 {
+		limit = writeTimeout
+	}
+	connLog.log(slog.LevelWarn, "lagging client", "request_id", c.id, "remote", c.remote, "lag", lag)
+	if err := c.WriteJSON(warningMessage{
+		Type:    "warning",
+		Reason:  "lagging",
+		LagMS:   msFloat(lag),
+		LimitMS: limit.Milliseconds(),
+	}); err != nil {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+package hub
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ipBucketIdle is how long an address's bucket is kept after its last
+// upgrade; by then it has refilled completely anyway.
+const ipBucketIdle = time.Minute
+
+// clientLimits protects the server's file descriptors, and with them
+// everyone's pulse timing, from a single misbehaving client or scanner: it
+// caps connected WebSocket and SSE clients in total, and rate-limits
+// connection attempts per remote IP with a token bucket. Zero values are
+// no limit. Clients are also turned away when fds runs low; see
+// fdbudget.go.
+type clientLimits struct {
+	max int64
+	n   atomic.Int64
+	fds *fdBudget
+
+	rate  float64 // upgrades per second and IP
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*ipBucket
+	lastSweep time.Time
+}
+
+type ipBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// clientLimitsFromEnv reads the limits; PULSE_MAX_CLIENTS defaults to what
+// fds leaves for clients, with pending connections capped at pending.
+func clientLimitsFromEnv(fds *fdBudget, pending int) *clientLimits {
+	rate := float64(envInt("PULSE_IP_UPGRADE_RATE", 0))
+	return &clientLimits{
+		max:   int64(envInt("PULSE_MAX_CLIENTS", fds.maxClients(pending))),
+		fds:   fds,
+		rate:  rate,
+		burst: float64(max(envInt("PULSE_IP_UPGRADE_BURST", int(2*rate)), 1)),
+	}
+}
+
+// allowUpgrade takes a token from the bucket of remote's IP. It reports
+// false, with how long until the next token, when the bucket is empty.
+func (l *clientLimits) allowUpgrade(remote string) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+	now := time.Now()
+	ip := remoteIP(remote)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*ipBucket)
+	}
+	if now.Sub(l.lastSweep) >= ipBucketIdle {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) >= ipBucketIdle {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	b := l.buckets[ip]
+	if b == nil {
+		b = &ipBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*l.rate, l.burst)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// rejectRate answers an upgrade over its IP's rate.
+func (l *clientLimits) rejectRate(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	connLog.log(churnLevel(), "connection rejected", "request_id", requestIDFrom(r.Context()), "remote", r.RemoteAddr, "err", "upgrade rate exceeded")
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+	http.Error(w, "too many connection attempts, retry later", http.StatusTooManyRequests)
+}
+
+// acquire counts a client against the total limit. It reports false when
+// the server is full or out of file descriptors; otherwise the returned func must be called once the
+// client is gone.
+func (l *clientLimits) acquire() (release func(), ok bool) {
+	if v := l.n.Add(1); (l.max > 0 && v > l.max) || l.fds.exhausted(v-1) {
+		l.n.Add(-1)
+		return nil, false
+	}
+	return func() { l.n.Add(-1) }, true
+}
+
+// rejectFull turns a client away because the server is full.
+func (l *clientLimits) rejectFull(w http.ResponseWriter, r *http.Request) {
+	connLog.log(churnLevel(), "connection rejected", "request_id", requestIDFrom(r.Context()), "remote", r.RemoteAddr, "err", "too many clients")
+	w.Header().Set("Retry-After", "5")
+	http.Error(w, "too many clients", http.StatusServiceUnavailable)
+}
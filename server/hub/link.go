@@ -0,0 +1,259 @@
+package hub
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pulse/clock"
+)
+
+// Ableton Link, through Carabiner (https://github.com/Deep-Symmetry/carabiner),
+// which runs a Link peer on the same host and speaks a small text protocol
+// on TCP port 17000. Link itself needs its C++ library; the bridge keeps
+// the server free of it. Following, the default channel takes the session's
+// tempo and puts its pulses on the session's beats; leading, the session
+// takes the channel's tempo. Either way pulses carry link_beat and
+// link_phase. A link clock domain follows a session the same way.
+const (
+	linkFollow = "follow"
+	linkLead   = "lead"
+
+	linkRetry = 2 * time.Second
+	// linkTolerance is how far the grid may be off the session's beats
+	// before it is aligned again.
+	linkTolerance = time.Millisecond
+	// Link's tempo range.
+	linkMinBPM = 20
+	linkMaxBPM = 999
+)
+
+// gridAlign asks a channel's pulse loop to move its grid onto beats period
+// apart, one of which, numbered beat, falls at at.
+type gridAlign struct {
+	at     time.Time
+	period time.Duration
+	beat   int64
+}
+
+// restartBars lines the bars of a channel with a tempo up with the beat
+// numbers, so downbeats fall on whole multiples of the bar: the pulse seq
+// is beat.
+func (a *gridAlign) restartBars(ch *pulseChannel, seq uint64, beat int64) {
+	if ch.tempo == nil {
+		return
+	}
+	bpb := int64(ch.tempo.beatsPerBar)
+	if m := uint64((beat%bpb + bpb) % bpb); seq >= m {
+		ch.tempo.restartBars(seq - m)
+	}
+}
+
+// linkBridge keeps channels and a Link session in step: the default
+// channel for PULSE_LINK, or a clock domain's channels (see
+// clockdomain.go). Leading, the session takes the first channel's tempo.
+type linkBridge struct {
+	addr    string
+	mode    string
+	quantum float64
+	chans   []*pulseChannel
+	// domain is the clock domain the bridge disciplines, if any.
+	domain *clockDomain
+	// utc is the server's disciplined clock, if any, which statuses are
+	// timed by.
+	utc *clock.Disciplined
+
+	mu sync.Mutex
+	// The latest status: the session was at beat at at, at bpm.
+	bpm   float64
+	beat  float64
+	at    time.Time
+	peers int
+	conn  net.Conn
+}
+
+// startLink connects to Carabiner at addr and keeps reconnecting. quantum
+// is the length of a Link bar in beats, for link_phase; d is the clock
+// domain of chans, or nil.
+func startLink(addr, mode string, quantum float64, chans []*pulseChannel, d *clockDomain, utc *clock.Disciplined) (*linkBridge, error) {
+	if mode != linkFollow && mode != linkLead {
+		return nil, fmt.Errorf("mode %q must be follow or lead", mode)
+	}
+	if quantum <= 0 {
+		return nil, fmt.Errorf("quantum must be positive")
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "17000")
+	}
+	l := &linkBridge{addr: addr, mode: mode, quantum: quantum, chans: chans, domain: d, utc: utc}
+	go l.run()
+	return l, nil
+}
+
+func (l *linkBridge) run() {
+	for {
+		if err := l.session(); err != nil {
+			slog.Warn("link", "err", err, "retry_in", linkRetry)
+		}
+		time.Sleep(linkRetry)
+	}
+}
+
+// session talks to Carabiner until the connection breaks.
+func (l *linkBridge) session() error {
+	conn, err := net.DialTimeout("tcp", l.addr, linkRetry)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	l.mu.Lock()
+	l.conn = conn
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.conn, l.bpm = nil, 0
+		l.mu.Unlock()
+	}()
+	slog.Info("link: connected to Carabiner", "addr", l.addr, "mode", l.mode)
+	if l.domain != nil {
+		// The session may have moved on meanwhile.
+		l.domain.fit.reset()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	// Carabiner reports the session when it changes; ask now and then as
+	// well, to lead the session after a period change.
+	go func() {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			l.send("status")
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+
+	sc := bufio.NewScanner(conn)
+	sc.Split(splitCarabiner)
+	for sc.Scan() {
+		name, fields := parseCarabiner(sc.Text())
+		if name == "status" {
+			l.status(fields, l.utc.At(time.Now()))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("Carabiner closed the connection")
+}
+
+func (l *linkBridge) send(cmd string) {
+	l.mu.Lock()
+	conn := l.conn
+	l.mu.Unlock()
+	if conn != nil {
+		_, _ = conn.Write([]byte(cmd + "\n"))
+	}
+}
+
+// status takes in a status message received at now, e.g.
+// status { :peers 1 :bpm 120.000000 :start 73743731220 :beat 597.737 }.
+func (l *linkBridge) status(fields map[string]string, now time.Time) {
+	bpm, err1 := strconv.ParseFloat(fields["bpm"], 64)
+	beat, err2 := strconv.ParseFloat(fields["beat"], 64)
+	peers, _ := strconv.Atoi(fields["peers"])
+	if err1 != nil || err2 != nil || bpm <= 0 {
+		return
+	}
+	l.mu.Lock()
+	if peers != l.peers {
+		slog.Info("link: session", "peers", peers, "bpm", bpm)
+	}
+	l.bpm, l.beat, l.at, l.peers = bpm, beat, now, peers
+	l.mu.Unlock()
+	l.domain.heard(now, beat)
+
+	if l.mode == linkLead {
+		want := math.Min(math.Max(periodBPM(l.chans[0].Period()), linkMinBPM), linkMaxBPM)
+		if math.Abs(want-bpm) >= 0.001 {
+			l.send(fmt.Sprintf("bpm %.3f", want))
+		}
+		return
+	}
+	period := bpmPeriod(bpm)
+	next := math.Ceil(beat)
+	at := now.Add(time.Duration((next - beat) * float64(period)))
+	for _, ch := range l.chans {
+		alignTo(ch, gridAlign{at: at, period: period, beat: int64(next)}, linkTolerance, 0)
+	}
+}
+
+// alignTo moves ch's grid onto a's beats unless it is already on them:
+// its period within rate of a's and its pulses within phase of a's beats.
+// Within rate, the grid keeps its period, so that a source's measuring
+// jitter does not show as period changes.
+func alignTo(ch *pulseChannel, a gridAlign, phase, rate time.Duration) {
+	if last := ch.last.Load(); last != nil && (last.period-a.period).Abs() <= rate {
+		off := a.at.Sub(last.at) % last.period
+		if off.Abs() <= phase || (last.period-off.Abs()) <= phase {
+			return
+		}
+		a.period = last.period
+	}
+	ch.align.Store(&a)
+}
+
+// enrich adds link_beat and link_phase, the session's beat and its phase
+// within the quantum at the pulse's beat, to the bridge's channels'
+// pulses while a session is known.
+func (l *linkBridge) enrich(msg PulseMessage) map[string]any {
+	if !slices.ContainsFunc(l.chans, func(ch *pulseChannel) bool { return ch.name == msg.Channel }) {
+		return nil
+	}
+	l.mu.Lock()
+	bpm, beat, at := l.bpm, l.beat, l.at
+	l.mu.Unlock()
+	if bpm == 0 || msg.Beat.IsZero() {
+		return nil
+	}
+	b := math.Round((beat+msg.Beat.Sub(at).Minutes()*bpm)*1000) / 1000
+	return map[string]any{
+		"link_beat":  b,
+		"link_phase": math.Round(math.Mod(math.Mod(b, l.quantum)+l.quantum, l.quantum)*1000) / 1000,
+	}
+}
+
+// splitCarabiner splits Carabiner's output into messages, each ending with
+// a closing brace.
+func splitCarabiner(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := strings.IndexByte(string(data), '}'); i >= 0 {
+		return i + 1, []byte(strings.TrimSpace(string(data[:i+1]))), nil
+	}
+	if atEOF && len(strings.TrimSpace(string(data))) > 0 {
+		return len(data), nil, fmt.Errorf("incomplete Carabiner message %q", data)
+	}
+	return 0, nil, nil
+}
+
+// parseCarabiner parses a message such as "status { :peers 1 :bpm 120 }"
+// into its name and fields.
+func parseCarabiner(msg string) (string, map[string]string) {
+	name, body, _ := strings.Cut(msg, "{")
+	fields := make(map[string]string)
+	tokens := strings.Fields(strings.TrimSuffix(strings.TrimSpace(body), "}"))
+	for i := 0; i+1 < len(tokens); i += 2 {
+		fields[strings.TrimPrefix(tokens[i], ":")] = tokens[i+1]
+	}
+	return strings.TrimSpace(name), fields
+}
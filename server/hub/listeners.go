@@ -0,0 +1,430 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"pulse/ws"
+)
+
+// listenSpec is one socket the server listens on.
+type listenSpec struct {
+	network string // tcp (dual-stack), tcp4, tcp6 (IPv6 only) or unix
+	addr    string
+	opts    listenOpts
+}
+
+// listenOpts is what a listener serves: the endpoint groups in serve, over
+// plain HTTP even when TLS is configured if plain is set.
+type listenOpts struct {
+	serve endpoints
+	plain bool
+}
+
+var defaultListenOpts = listenOpts{serve: endpointsAll}
+
+// endpoints is a set of endpoint groups. /healthz and /readyz are in
+// every one.
+type endpoints uint8
+
+const (
+	// endpointsClients is /ws, /sse, /poll, /api/pulses and the demo page.
+	endpointsClients endpoints = 1 << iota
+	// endpointsAPI is the rest of /api/…, /status and /metrics.
+	endpointsAPI
+	// endpointsAdmin is /admin/… and /api/config.
+	endpointsAdmin
+
+	endpointsAll = endpointsClients | endpointsAPI | endpointsAdmin
+)
+
+var endpointNames = map[string]endpoints{
+	"clients": endpointsClients,
+	"api":     endpointsAPI,
+	"admin":   endpointsAdmin,
+	"all":     endpointsAll,
+}
+
+func (e endpoints) String() string {
+	if e == endpointsAll {
+		return "all"
+	}
+	var names []string
+	for _, name := range []string{"clients", "api", "admin"} {
+		if e&endpointNames[name] != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "+")
+}
+
+// endpointGroup is the group path belongs to, or 0 for /healthz and
+// /readyz.
+func endpointGroup(path string) endpoints {
+	switch {
+	case path == "/healthz" || path == "/readyz":
+		return 0
+	case strings.HasPrefix(path, "/admin/") || path == "/api/config":
+		return endpointsAdmin
+	case path == "/" || path == "/ws" || path == "/sse" || path == "/poll" || path == "/api/pulses",
+		strings.HasPrefix(path, "/ws/") || strings.HasPrefix(path, "/sse/"):
+		return endpointsClients
+	}
+	return endpointsAPI
+}
+
+// only serves the requests for e with next and answers the rest with 404,
+// as if they did not exist.
+func (e endpoints) only(next http.Handler) http.Handler {
+	if e == endpointsAll {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if g := endpointGroup(r.URL.Path); g != 0 && e&g == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseListenOpts parses the ;-separated parameters of a PULSE_ADDR
+// entry: serve=GROUP+GROUP… (clients, api, admin or all) and tls=off.
+func parseListenOpts(raw string) (listenOpts, error) {
+	opts := defaultListenOpts
+	for _, param := range strings.Split(raw, ";") {
+		if param = strings.TrimSpace(param); param == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(param, "=")
+		switch strings.TrimSpace(key) {
+		case "serve":
+			opts.serve = 0
+			for _, name := range strings.Split(value, "+") {
+				e, ok := endpointNames[strings.TrimSpace(name)]
+				if !ok {
+					return opts, fmt.Errorf("unknown endpoints %q, want clients, api, admin or all", name)
+				}
+				opts.serve |= e
+			}
+		case "tls":
+			switch strings.TrimSpace(value) {
+			case "on":
+				opts.plain = false
+			case "off":
+				opts.plain = true
+			default:
+				return opts, fmt.Errorf("invalid tls=%s, want on or off", value)
+			}
+		default:
+			return opts, fmt.Errorf("unknown parameter %q, want serve or tls", key)
+		}
+	}
+	return opts, nil
+}
+
+// String formats opts as parseListenOpts parses them.
+func (o listenOpts) String() string {
+	s := "serve=" + o.serve.String()
+	if o.plain {
+		s += ";tls=off"
+	}
+	return s
+}
+
+// unixPrefix marks a PULSE_ADDR entry as a Unix domain socket's path.
+const unixPrefix = "unix://"
+
+// parseListenAddrs parses PULSE_ADDR: comma-separated host:port entries.
+// An empty host listens on every address of both families on one
+// dual-stack socket. An IPv4 or IPv6 address listens on that family only,
+// so "0.0.0.0:8080,[::]:8080" gives separate IPv4 and IPv6 sockets on the
+// same port. A host of the form %name listens on every address of the
+// network interface name, e.g. "%vlan20:8080" for a sync VLAN; IPv6
+// link-local addresses get the interface as their zone. unix:///path
+// listens on a Unix domain socket at path, for sidecars and reverse
+// proxies on the same host; unix://@name is a Linux abstract socket. Any
+// entry may go on with parameters (see parseListenOpts), e.g.
+// "127.0.0.1:8081;serve=admin+api;tls=off".
+func parseListenAddrs(raw string) ([]listenSpec, error) {
+	var specs []listenSpec
+	for _, entry := range ws.SplitHeaderList(raw) {
+		entry, params, _ := strings.Cut(entry, ";")
+		entry = strings.TrimSpace(entry)
+		opts, err := parseListenOpts(params)
+		if err != nil {
+			return nil, fmt.Errorf("listen address %q: %v", entry, err)
+		}
+		if path, ok := strings.CutPrefix(entry, unixPrefix); ok {
+			if path == "" || path == "@" {
+				return nil, fmt.Errorf("invalid listen address %q: no socket path", entry)
+			}
+			specs = append(specs, listenSpec{network: "unix", addr: path, opts: opts})
+			continue
+		}
+		host, port, err := net.SplitHostPort(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %v", entry, err)
+		}
+		switch {
+		case host == "":
+			specs = append(specs, listenSpec{network: "tcp", addr: entry, opts: opts})
+		case strings.HasPrefix(host, "%"):
+			iface, err := interfaceSpecs(host[1:], port, opts)
+			if err != nil {
+				return nil, err
+			}
+			specs = append(specs, iface...)
+		default:
+			ip, err := netip.ParseAddr(host)
+			if err != nil {
+				// A hostname; leave the family to the resolver.
+				specs = append(specs, listenSpec{network: "tcp", addr: entry, opts: opts})
+				continue
+			}
+			specs = append(specs, listenSpec{network: family(ip), addr: entry, opts: opts})
+		}
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no listen address")
+	}
+	return specs, nil
+}
+
+// interfaceSpecs lists a socket per address of the interface called name,
+// each serving as opts say.
+func interfaceSpecs(name, port string, opts listenOpts) ([]listenSpec, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %%%s: %v", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("listen on %%%s: %v", name, err)
+	}
+	var specs []listenSpec
+	for _, a := range addrs {
+		prefix, err := netip.ParsePrefix(a.String())
+		if err != nil {
+			continue
+		}
+		ip := prefix.Addr()
+		if ip.Is6() && ip.IsLinkLocalUnicast() {
+			ip = ip.WithZone(name)
+		}
+		specs = append(specs, listenSpec{network: family(ip), addr: net.JoinHostPort(ip.String(), port), opts: opts})
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("listen on %%%s: interface has no addresses", name)
+	}
+	return specs, nil
+}
+
+// family is the network that listens on ip alone.
+func family(ip netip.Addr) string {
+	if ip.Unmap().Is4() {
+		return "tcp4"
+	}
+	return "tcp6"
+}
+
+// listener is a listening socket and what it serves.
+type listener struct {
+	net.Listener
+	opts listenOpts
+}
+
+// listenAll opens every socket in specs, or after an upgrade takes over
+// the ones the old process had, or with socket activation the ones
+// systemd passed, which serve everything.
+func listenAll(specs []listenSpec) ([]listener, error) {
+	if handedOver() {
+		lns, err := inheritListeners()
+		if err == nil {
+			ownSocketFiles(lns, specs)
+		}
+		return lns, err
+	}
+	if activated, err := activatedListeners(); err != nil || len(activated) > 0 {
+		lns := make([]listener, len(activated))
+		for i, ln := range activated {
+			lns[i] = listener{ln, defaultListenOpts}
+		}
+		return lns, err
+	}
+	mode, err := unixSocketMode(os.Getenv("PULSE_UNIX_SOCKET_MODE"))
+	if err != nil {
+		return nil, err
+	}
+	var lns []listener
+	for _, s := range specs {
+		var ln net.Listener
+		if s.network == "unix" {
+			ln, err = listenUnix(s.addr, mode)
+		} else {
+			ln, err = net.Listen(s.network, s.addr)
+		}
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, listener{ln, s.opts})
+	}
+	return lns, nil
+}
+
+// shutdown shuts every server in servers down at once, as
+// http.Server.Shutdown does.
+func shutdown(ctx context.Context, servers []*http.Server) error {
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = srv.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// defaultUnixSocketMode lets the server's user and group connect.
+const defaultUnixSocketMode os.FileMode = 0o660
+
+// unixSocketMode parses PULSE_UNIX_SOCKET_MODE, an octal file mode such as
+// 0660.
+func unixSocketMode(raw string) (os.FileMode, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return defaultUnixSocketMode, nil
+	}
+	v, err := strconv.ParseUint(raw, 8, 32)
+	if err != nil || v > 0o777 {
+		return 0, fmt.Errorf("invalid socket mode %q, want octal permissions such as 0660", raw)
+	}
+	return os.FileMode(v), nil
+}
+
+// listenUnix listens on a Unix domain socket at path with mode. A socket
+// file nothing listens on any more, left by a process that did not shut
+// down, is replaced; one still in use is not. The file is removed when
+// the listener closes.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	abstract := strings.HasPrefix(path, "@")
+	if !abstract {
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if !abstract {
+		if err := os.Chmod(path, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// removeStaleSocket removes the socket file at path unless something is
+// listening on it; anything else at path is left alone.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	case fi.Mode()&os.ModeSocket == 0:
+		return fmt.Errorf("listen on %s: not a socket", path)
+	}
+	if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		c.Close()
+		return fmt.Errorf("listen on %s: another process is listening", path)
+	}
+	return os.Remove(path)
+}
+
+// ownSocketFiles has a process that took its listeners over in an upgrade
+// remove the socket files among them that PULSE_ADDR names when it shuts
+// down, as the process that created them would have; sockets systemd
+// passed stay systemd's.
+func ownSocketFiles(lns []listener, specs []listenSpec) {
+	for _, ln := range lns {
+		ul, ok := ln.Listener.(*net.UnixListener)
+		if !ok {
+			continue
+		}
+		for _, s := range specs {
+			if s.network == "unix" && s.addr == ul.Addr().String() {
+				ul.SetUnlinkOnClose(true)
+			}
+		}
+	}
+}
+
+// keepSocketFiles leaves the socket files of lns in place when they close,
+// once an upgrade passed them on to the new process.
+func keepSocketFiles(lns []listener) {
+	for _, ln := range lns {
+		if ul, ok := ln.Listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+}
+
+// familyLimits caps WebSocket clients per address family, for deployments
+// where IPv4 and IPv6 clients arrive on different networks; 0 is no limit.
+// Clients on a dual-stack socket with IPv4-mapped addresses count as IPv4.
+type familyLimits struct {
+	max4, max6 int64
+	n4, n6     atomic.Int64
+}
+
+func familyLimitsFromEnv() *familyLimits {
+	return &familyLimits{
+		max4: int64(envInt("PULSE_MAX_CLIENTS_V4", 0)),
+		max6: int64(envInt("PULSE_MAX_CLIENTS_V6", 0)),
+	}
+}
+
+// acquire counts a client from remote against its family's limit. It
+// reports false when the family is full; otherwise the returned func must
+// be called once the client is gone.
+func (l *familyLimits) acquire(remote string) (release func(), ok bool) {
+	ap, err := netip.ParseAddrPort(remote)
+	if err != nil {
+		return func() {}, true
+	}
+	n, limit := &l.n6, l.max6
+	if ap.Addr().Unmap().Is4() {
+		n, limit = &l.n4, l.max4
+	}
+	if v := n.Add(1); limit > 0 && v > limit {
+		n.Add(-1)
+		return nil, false
+	}
+	return func() { n.Add(-1) }, true
+}
+
+// reject turns a client away because its family is full.
+func (l *familyLimits) reject(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "5")
+	http.Error(w, "too many clients from this address family", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,174 @@
+package hub
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// loadSelfTest checks at startup that the host can keep time under load,
+// before /readyz reports ready: it adds that many in-process
+// subscribers to the default channel, lets the pulse loop run for
+// duration, and compares the p99 of pulse jitter and of fan-out latency
+// (a pulse's scheduled time to its frame reaching a subscriber, as the
+// canary measures it, for the slowest subscriber) with the targets. A
+// mis-sized host fails here, where it costs nothing, rather than with an
+// audience connected.
+type loadSelfTest struct {
+	subscribers int
+	duration    time.Duration
+	maxJitter   time.Duration
+	maxFanout   time.Duration
+
+	mu        sync.Mutex
+	running   bool
+	scheduled map[uint64]time.Time
+	jitter    []time.Duration
+	// arrived is the latest arrival of each pulse at any subscriber.
+	arrived map[uint64]time.Time
+	result  *loadSelfTestResult
+}
+
+// loadSelfTestResult is the outcome, in /readyz.
+type loadSelfTestResult struct {
+	State       string  `json:"state"` // running, passed or failed
+	Subscribers int     `json:"subscribers"`
+	Pulses      int     `json:"pulses"`
+	JitterP99MS float64 `json:"jitter_p99_ms"`
+	FanoutP99MS float64 `json:"fanout_p99_ms"`
+	Reason      string  `json:"reason,omitempty"`
+}
+
+// loadSelfTestFromEnv returns the self-test PULSE_LOAD_SELFTEST asks for,
+// or nil if it is 0 or unset.
+func loadSelfTestFromEnv() *loadSelfTest {
+	n := envInt("PULSE_LOAD_SELFTEST", 0)
+	if n == 0 {
+		return nil
+	}
+	return &loadSelfTest{
+		subscribers: n,
+		duration:    envMS("PULSE_LOAD_SELFTEST_MS", 3*time.Second),
+		maxJitter:   envMS("PULSE_LOAD_SELFTEST_JITTER_MS", 5*time.Millisecond),
+		maxFanout:   envMS("PULSE_LOAD_SELFTEST_FANOUT_MS", 20*time.Millisecond),
+		scheduled:   make(map[uint64]time.Time),
+		arrived:     make(map[uint64]time.Time),
+		result:      &loadSelfTestResult{State: "running", Subscribers: n},
+	}
+}
+
+// run adds the subscribers to h, waits out the test and removes them. It
+// returns once the verdict is in; the pulse loop must be running.
+func (t *loadSelfTest) run(h *Hub) {
+	t.mu.Lock()
+	t.running = true
+	t.mu.Unlock()
+	slog.Info("load self-test: starting", "subscribers", t.subscribers, "duration", t.duration)
+
+	conns := make([]*Conn, t.subscribers)
+	var wg sync.WaitGroup
+	for i := range conns {
+		server, client := net.Pipe()
+		conns[i] = &Conn{conn: server, proto: protoJSON, internal: true}
+		h.add(conns[i])
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer client.Close()
+			r := bufio.NewReader(client)
+			for {
+				payload, err := readServerFrame(r)
+				if err != nil {
+					return
+				}
+				at := time.Now()
+				var msg PulseMessage
+				if json.Unmarshal(payload, &msg) == nil && msg.Type == "pulse" {
+					t.arrive(msg.Seq, at)
+				}
+			}
+		}()
+	}
+	time.Sleep(t.duration)
+	t.mu.Lock()
+	t.running = false
+	t.mu.Unlock()
+	for _, c := range conns {
+		h.remove(c)
+	}
+	wg.Wait()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := t.result
+	var fanout []time.Duration
+	for seq, at := range t.arrived {
+		if scheduled, ok := t.scheduled[seq]; ok {
+			fanout = append(fanout, at.Sub(scheduled))
+		}
+	}
+	slices.Sort(t.jitter)
+	slices.Sort(fanout)
+	jitter, fanoutP99 := percentile(t.jitter, 0.99), percentile(fanout, 0.99)
+	r.Pulses = len(fanout)
+	r.JitterP99MS = msFloat(jitter)
+	r.FanoutP99MS = msFloat(fanoutP99)
+	switch {
+	case r.Pulses < 2:
+		r.Reason = fmt.Sprintf("only %d pulses reached the subscribers", r.Pulses)
+	case jitter > t.maxJitter:
+		r.Reason = fmt.Sprintf("jitter p99 %.2f ms is over %d ms", r.JitterP99MS, t.maxJitter.Milliseconds())
+	case fanoutP99 > t.maxFanout:
+		r.Reason = fmt.Sprintf("fan-out p99 %.2f ms is over %d ms", r.FanoutP99MS, t.maxFanout.Milliseconds())
+	}
+	t.scheduled, t.arrived, t.jitter = nil, nil, nil
+	if r.Reason != "" {
+		r.State = "failed"
+		slog.Error("load self-test failed; /readyz stays unready", "reason", r.Reason, "pulses", r.Pulses)
+		return
+	}
+	r.State = "passed"
+	slog.Info("load self-test passed", "pulses", r.Pulses, "jitter_p99_ms", r.JitterP99MS, "fanout_p99_ms", r.FanoutP99MS)
+}
+
+// observe records a pulse of the default channel while the test runs. A
+// nil loadSelfTest ignores it.
+func (t *loadSelfTest) observe(o PulseObservation) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.running {
+		return
+	}
+	t.scheduled[o.Seq] = o.Scheduled
+	t.jitter = append(t.jitter, o.Jitter.Abs())
+}
+
+func (t *loadSelfTest) arrive(seq uint64, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.running {
+		return
+	}
+	if prev, ok := t.arrived[seq]; !ok || at.After(prev) {
+		t.arrived[seq] = at
+	}
+}
+
+// status returns a copy of the outcome so far; nil if there is no test.
+func (t *loadSelfTest) status() *loadSelfTestResult {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := *t.result
+	return &r
+}
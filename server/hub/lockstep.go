@@ -0,0 +1,86 @@
+package hub
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+const (
+	// lockstepMaxAhead is how many ticks ahead a client may submit input.
+	lockstepMaxAhead = 64
+	// lockstepMaxInput bounds the encoded input of one client per tick.
+	lockstepMaxInput = 4 << 10
+)
+
+// inputMessage is sent by clients in lockstep mode:
+// {"type":"input","tick":42,"input":{...}}. tick is the seq of the pulse
+// the input is for.
+type inputMessage struct {
+	Type  string          `json:"type"`
+	Tick  uint64          `json:"tick"`
+	Input json.RawMessage `json:"input"`
+}
+
+// lockstepInput is one client's input as broadcast in a pulse's "inputs".
+type lockstepInput struct {
+	Client string          `json:"client"`
+	Input  json.RawMessage `json:"input"`
+}
+
+// lockstep collects client inputs per tick. Everything that arrives before
+// a pulse is emitted is broadcast with that pulse, sorted by client, so all
+// peers apply the same inputs in the same order; input for a tick that has
+// already gone out is rejected as late.
+type lockstep struct {
+	mu     sync.Mutex
+	next   uint64 // seq of the next pulse to be emitted
+	inputs map[uint64]map[string]json.RawMessage
+}
+
+func newLockstep() *lockstep {
+	return &lockstep{inputs: make(map[uint64]map[string]json.RawMessage)}
+}
+
+// submit records an input from c; a second input for the same tick
+// replaces the first. It reports whether the input was accepted.
+func (l *lockstep) submit(c *Conn, m inputMessage) bool {
+	if len(m.Input) == 0 || len(m.Input) > lockstepMaxInput {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if m.Tick < l.next || m.Tick >= l.next+lockstepMaxAhead {
+		return false
+	}
+	tick := l.inputs[m.Tick]
+	if tick == nil {
+		tick = make(map[string]json.RawMessage)
+		l.inputs[m.Tick] = tick
+	}
+	tick[c.id] = m.Input
+	return true
+}
+
+// enrich is registered as a pulse enricher: it closes the collection window
+// for msg.Seq and attaches the combined input set.
+func (l *lockstep) enrich(msg PulseMessage) map[string]any {
+	// Inputs are collected per tick of the default channel.
+	if msg.Channel != defaultChannel {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	set := make([]lockstepInput, 0, len(l.inputs[msg.Seq]))
+	for client, in := range l.inputs[msg.Seq] {
+		set = append(set, lockstepInput{Client: client, Input: in})
+	}
+	sort.Slice(set, func(i, j int) bool { return set[i].Client < set[j].Client })
+	for tick := range l.inputs {
+		if tick <= msg.Seq {
+			delete(l.inputs, tick)
+		}
+	}
+	l.next = msg.Seq + 1
+	return map[string]any{"inputs": set}
+}
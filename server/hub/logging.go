@@ -0,0 +1,54 @@
+package hub
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// quietChurn demotes per-client connect, disconnect and close lines to
+// debug, for servers whose clients come and go by the thousand; Main sets
+// it from PULSE_LOG_QUIET.
+var quietChurn atomic.Bool
+
+// setupLogging installs the default slog logger from PULSE_LOG_LEVEL
+// (debug, info, warn or error) and PULSE_LOG_FORMAT (text or json). Lines
+// still written through the log package go through it at info.
+func setupLogging() error {
+	var level slog.Level
+	if raw := strings.TrimSpace(os.Getenv("PULSE_LOG_LEVEL")); raw != "" {
+		if err := level.UnmarshalText([]byte(raw)); err != nil {
+			return fmt.Errorf("PULSE_LOG_LEVEL: want debug, info, warn or error")
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch format := strings.TrimSpace(os.Getenv("PULSE_LOG_FORMAT")); format {
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("PULSE_LOG_FORMAT: want text or json, not %q", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	quietChurn.Store(envBool("PULSE_LOG_QUIET", false))
+	return nil
+}
+
+// churnLevel is the level of per-client lifecycle lines.
+func churnLevel() slog.Level {
+	if quietChurn.Load() {
+		return slog.LevelDebug
+	}
+	return slog.LevelInfo
+}
+
+// fatal logs msg with err and exits, for configuration the server cannot
+// start with.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
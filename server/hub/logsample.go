@@ -0,0 +1,96 @@
+package hub
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// logLimiter rate limits high-frequency per-connection log lines. Each
+// event (e.g. "client disconnected") may log burst lines per window; the
+// rest are counted and summed up in one line when the window ends, so a
+// network blip that drops 10k clients logs a few dozen lines rather than
+// 10k.
+type logLimiter struct {
+	window time.Duration
+	burst  atomic.Int64 // 0 logs everything
+
+	mu     sync.Mutex
+	events map[string]*logBucket
+}
+
+type logBucket struct {
+	start      time.Time
+	n          int
+	suppressed int
+}
+
+func newLogLimiter(window time.Duration, burst int) *logLimiter {
+	l := &logLimiter{window: window, events: make(map[string]*logBucket)}
+	l.burst.Store(int64(burst))
+	return l
+}
+
+// limit is the number of lines per event and window; it can be changed at
+// runtime with setLimit.
+func (l *logLimiter) limit() int {
+	return int(l.burst.Load())
+}
+
+func (l *logLimiter) setLimit(burst int) {
+	l.burst.Store(int64(burst))
+}
+
+// connLog limits connection lifecycle and write error lines; Main sets its
+// limit from PULSE_LOG_BURST.
+var connLog = newLogLimiter(time.Second, 20)
+
+// log logs event, with the slog key-value pairs in args, at level unless
+// event has used up its burst for the current window. Lines below the
+// configured level neither log nor count.
+func (l *logLimiter) log(level slog.Level, event string, args ...any) {
+	if !slog.Default().Enabled(context.Background(), level) {
+		return
+	}
+	burst := l.limit()
+	if burst <= 0 {
+		slog.Log(context.Background(), level, event, args...)
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	b, ok := l.events[event]
+	if !ok {
+		b = &logBucket{start: now}
+		l.events[event] = b
+	}
+	if now.Sub(b.start) >= l.window {
+		b.start, b.n = now, 0
+	}
+	b.n++
+	allow := b.n <= burst
+	if !allow {
+		b.suppressed++
+		if b.suppressed == 1 {
+			time.AfterFunc(b.start.Add(l.window).Sub(now), func() { l.flush(event) })
+		}
+	}
+	l.mu.Unlock()
+	if allow {
+		slog.Log(context.Background(), level, event, args...)
+	}
+}
+
+// flush reports how many lines of event were suppressed.
+func (l *logLimiter) flush(event string) {
+	l.mu.Lock()
+	b := l.events[event]
+	n := b.suppressed
+	b.suppressed = 0
+	l.mu.Unlock()
+	if n > 0 {
+		slog.Info("log lines suppressed", "event", event, "suppressed", n, "limit", l.limit(), "window", l.window)
+	}
+}
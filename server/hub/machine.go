@@ -0,0 +1,329 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State machines. PUT /admin/machines/{name} runs a show sequence on a
+// channel's beats, such as intro → loop → outro, with no controller
+// attached: each state lasts a number of beats, or bars on a channel with a
+// tempo, repeats a number of times and moves on to its next state, and a
+// state without a length holds until POST /admin/machines/{name}/goto
+// moves the machine on. A machine starts, and goto takes effect, on the
+// first downbeat at least one pulse away. Every state entered, each
+// repetition included, is announced to the channel's clients one pulse
+// ahead as a machine_state message carrying its payload, the seq it starts
+// on and when that pulse is due, so clients act on the beat; a machine that
+// runs out of states announces its end with done and is removed.
+const (
+	maxMachines      = 64
+	maxMachineStates = 64
+)
+
+// errNoMachine is a goto for a machine that is not running.
+var errNoMachine = errors.New("no such machine")
+
+// machineBody is PUT /admin/machines/{name}:
+//
+//	{"channel":"song","states":[
+//	  {"name":"intro","bars":8,"next":"loop","payload":{"scene":1}},
+//	  {"name":"loop","bars":16,"repeat":4,"next":"outro"},
+//	  {"name":"outro","bars":4}]}
+//
+// Channel defaults to the default channel and Initial to the first state.
+type machineBody struct {
+	Channel string         `json:"channel,omitempty"`
+	Initial string         `json:"initial,omitempty"`
+	States  []machineState `json:"states"`
+}
+
+// machineState is a state of a machine: it lasts Beats, or Bars, Repeat
+// times (once unless given), then hands over to Next, or ends the machine
+// if Next is empty. Without a length it holds until a goto.
+type machineState struct {
+	Name    string          `json:"name"`
+	Beats   uint64          `json:"beats,omitempty"`
+	Bars    uint64          `json:"bars,omitempty"`
+	Repeat  int             `json:"repeat,omitempty"`
+	Next    string          `json:"next,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// gotoBody is POST /admin/machines/{name}/goto: {"state":"outro"}.
+type gotoBody struct {
+	State string `json:"state"`
+}
+
+// machineStateMessage announces the state a machine enters at pulse Seq,
+// due at AtMS if the period holds. Pass counts the state's repetitions
+// from 1; Done, with no State, says the machine ended.
+type machineStateMessage struct {
+	Type    string          `json:"type"`
+	Machine string          `json:"machine"`
+	Channel string          `json:"channel"`
+	State   string          `json:"state,omitempty"`
+	Prev    string          `json:"prev,omitempty"`
+	Pass    int             `json:"pass,omitempty"`
+	Seq     uint64          `json:"seq"`
+	AtMS    int64           `json:"at_ms"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Done    bool            `json:"done,omitempty"`
+}
+
+// machineStatus is a machine in GET /admin/machines. State is empty until
+// the machine's first state is announced; NextSeq is when it next moves,
+// absent while a state holds.
+type machineStatus struct {
+	Name    string `json:"name"`
+	Channel string `json:"channel"`
+	State   string `json:"state,omitempty"`
+	Pass    int    `json:"pass,omitempty"`
+	NextSeq uint64 `json:"next_seq,omitempty"`
+	Goto    string `json:"goto,omitempty"`
+}
+
+// stateMachine is a running machine; machines.mu guards its state.
+type stateMachine struct {
+	name    string
+	ch      *pulseChannel
+	initial string
+	states  map[string]machineState
+
+	// state is the current state and pass its repetition; at is the seq
+	// of the next transition, 0 while the state holds, and jump the state
+	// a goto moves to then.
+	state string
+	pass  int
+	at    uint64
+	jump  string
+	// last is the latest announcement, for clients that connect later.
+	last *machineStateMessage
+}
+
+// machines keeps the running state machines, by name.
+type machines struct {
+	h *Hub
+
+	mu     sync.Mutex
+	byName map[string]*stateMachine
+}
+
+// newStateMachine validates body as machine name, not yet started.
+func (h *Hub) newStateMachine(name string, body machineBody) (*stateMachine, error) {
+	if body.Channel == "" {
+		body.Channel = defaultChannel
+	}
+	ch := h.channel(body.Channel)
+	switch {
+	case !validName(name):
+		return nil, fmt.Errorf("name must be 1 to 64 letters, digits, '.', '_' or '-'")
+	case ch == nil:
+		return nil, fmt.Errorf("unknown channel %q", body.Channel)
+	case len(body.States) == 0 || len(body.States) > maxMachineStates:
+		return nil, fmt.Errorf("give 1 to %d states", maxMachineStates)
+	}
+	m := &stateMachine{name: name, ch: ch, initial: body.Initial, states: make(map[string]machineState, len(body.States))}
+	if m.initial == "" {
+		m.initial = body.States[0].Name
+	}
+	for _, st := range body.States {
+		switch {
+		case !validName(st.Name):
+			return nil, fmt.Errorf("state name must be 1 to 64 letters, digits, '.', '_' or '-'")
+		case m.states[st.Name].Name != "":
+			return nil, fmt.Errorf("state %q given twice", st.Name)
+		case st.Beats != 0 && st.Bars != 0:
+			return nil, fmt.Errorf("state %q: give beats or bars, not both", st.Name)
+		case st.Bars != 0 && ch.tempo == nil:
+			return nil, fmt.Errorf("state %q: bars need a channel with a tempo", st.Name)
+		case st.Repeat < 0:
+			return nil, fmt.Errorf("state %q: repeat must not be negative", st.Name)
+		case st.Repeat > 1 && st.Beats == 0 && st.Bars == 0:
+			return nil, fmt.Errorf("state %q: only a state with a length repeats", st.Name)
+		case len(st.Payload) > maxCuePayload:
+			return nil, fmt.Errorf("state %q: payload must be at most %d bytes", st.Name, maxCuePayload)
+		}
+		m.states[st.Name] = st
+	}
+	for _, st := range body.States {
+		if st.Next != "" && m.states[st.Next].Name == "" {
+			return nil, fmt.Errorf("state %q: unknown next state %q", st.Name, st.Next)
+		}
+	}
+	if m.states[m.initial].Name == "" {
+		return nil, fmt.Errorf("unknown initial state %q", m.initial)
+	}
+	return m, nil
+}
+
+// start validates body and runs it as machine name, replacing a machine of
+// that name.
+func (k *machines) start(name string, body machineBody) (machineStatus, error) {
+	m, err := k.h.newStateMachine(name, body)
+	if err != nil {
+		return machineStatus{}, err
+	}
+	ch := m.ch
+	last := ch.last.Load()
+	if last == nil {
+		return machineStatus{}, fmt.Errorf("channel %q has not pulsed yet", ch.name)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.byName[name] == nil && len(k.byName) >= maxMachines {
+		return machineStatus{}, fmt.Errorf("%d machines are running already", maxMachines)
+	}
+	m.at = m.downbeat(last.seq + 2)
+	k.byName[name] = m
+	slog.Info("state machine started", "machine", name, "channel", ch.name, "initial", m.initial, "seq", m.at)
+	return m.status(), nil
+}
+
+// jumpTo moves machine name to state on the next downbeat.
+func (k *machines) jumpTo(name, state string) (machineStatus, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	m := k.byName[name]
+	switch {
+	case m == nil:
+		return machineStatus{}, fmt.Errorf("%w: %q", errNoMachine, name)
+	case m.states[state].Name == "":
+		return machineStatus{}, fmt.Errorf("machine %q has no state %q", name, state)
+	}
+	last := m.ch.last.Load()
+	if last == nil {
+		return machineStatus{}, fmt.Errorf("channel %q has not pulsed yet", m.ch.name)
+	}
+	m.jump, m.at = state, m.downbeat(last.seq+2)
+	slog.Info("state machine goto", "machine", name, "state", state, "seq", m.at)
+	return m.status(), nil
+}
+
+// stop removes machine name and reports whether it was running. Its
+// clients hear nothing more from it.
+func (k *machines) stop(name string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.byName[name] == nil {
+		return false
+	}
+	delete(k.byName, name)
+	slog.Info("state machine stopped", "machine", name)
+	return true
+}
+
+// pulse announces the transitions of ch's machines that fall on the pulse
+// after seq, which has just gone out as scheduled.
+func (k *machines) pulse(ch *pulseChannel, seq uint64, scheduled time.Time) {
+	channel := ch.name
+	_, swing := ch.swing(seq+1, ch.Period())
+	var out []machineStateMessage
+	k.mu.Lock()
+	for name, m := range k.byName {
+		if m.ch.name != channel || m.at == 0 || m.at > seq+1 {
+			continue
+		}
+		msg := m.advance(seq+1, scheduled.Add(ch.Period()+swing))
+		if msg.Done {
+			delete(k.byName, name)
+			slog.Info("state machine done", "machine", name, "channel", channel)
+		}
+		out = append(out, msg)
+	}
+	k.mu.Unlock()
+	for _, msg := range out {
+		k.h.BroadcastIf(msg, func(c *Conn) bool { return c.receives(msg.Channel) })
+	}
+}
+
+// advance moves m into its next state at pulse seq, due at at.
+func (m *stateMachine) advance(seq uint64, at time.Time) machineStateMessage {
+	msg := machineStateMessage{Type: "machine_state", Machine: m.name, Channel: m.ch.name, Prev: m.state, Seq: seq, AtMS: at.UnixMilli()}
+	cur := m.states[m.state]
+	switch {
+	case m.jump != "":
+		m.state, m.pass, m.jump = m.jump, 1, ""
+	case m.state == "":
+		m.state, m.pass = m.initial, 1
+	case m.pass < cur.Repeat:
+		m.pass++
+	case cur.Next != "":
+		m.state, m.pass = cur.Next, 1
+	default:
+		m.state, m.pass, m.at = "", 0, 0
+		msg.Done = true
+		m.last = nil
+		return msg
+	}
+	st := m.states[m.state]
+	msg.State, msg.Pass, msg.Payload = st.Name, m.pass, st.Payload
+	m.at = 0
+	if n := st.Beats + st.Bars*uint64(m.beatsPerBar()); n > 0 {
+		m.at = seq + n
+	}
+	m.last = &msg
+	return msg
+}
+
+func (m *stateMachine) beatsPerBar() int {
+	if m.ch.tempo == nil {
+		return 1
+	}
+	return m.ch.tempo.beatsPerBar
+}
+
+// downbeat is the first seq from seq on that starts a bar, seq itself on a
+// channel without a tempo.
+func (m *stateMachine) downbeat(seq uint64) uint64 {
+	t := m.ch.tempo
+	if t == nil {
+		return seq
+	}
+	bpb := uint64(t.beatsPerBar)
+	bar := t.barSeq.Load()
+	if seq <= bar {
+		return bar
+	}
+	return seq + (bpb-(seq-bar)%bpb)%bpb
+}
+
+func (m *stateMachine) status() machineStatus {
+	return machineStatus{Name: m.name, Channel: m.ch.name, State: m.state, Pass: m.pass, NextSeq: m.at, Goto: m.jump}
+}
+
+// current returns the latest announcements of the machines on c's
+// channels, for clients that connect after them.
+func (k *machines) current(c *Conn) []machineStateMessage {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var out []machineStateMessage
+	for _, m := range k.byName {
+		if m.last != nil && c.receives(m.ch.name) {
+			out = append(out, *m.last)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Machine < out[j].Machine })
+	return out
+}
+
+// handler serves GET /admin/machines, the running machines by name.
+func (k *machines) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		k.mu.Lock()
+		out := make([]machineStatus, 0, len(k.byName))
+		for _, m := range k.byName {
+			out = append(out, m.status())
+		}
+		k.mu.Unlock()
+		sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+		writeJSON(w, http.StatusOK, out)
+	}
+}
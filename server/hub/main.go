@@ -0,0 +1,623 @@
+package hub
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"pulse/clock"
+	"pulse/ws"
+)
+
+func parsePeriodMS() time.Duration {
+	raw := strings.TrimSpace(os.Getenv("PULSE_PERIOD_MS"))
+	if raw == "" {
+		return time.Second
+	}
+	ms, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || ms <= 0 {
+		slog.Warn("invalid PULSE_PERIOD_MS, defaulting to 1000", "value", raw)
+		return time.Second
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func parseOffsetMS() time.Duration {
+	raw := strings.TrimSpace(os.Getenv("PULSE_OFFSET_MS"))
+	if raw == "" {
+		return 0
+	}
+	ms, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || !validOffsetMS(ms) {
+		slog.Warn("invalid PULSE_OFFSET_MS, defaulting to 0", "value", raw)
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// envMS reads a non-negative millisecond duration from the environment.
+func envMS(name string, def time.Duration) time.Duration {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def
+	}
+	ms, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || ms < 0 {
+		slog.Warn("invalid "+name+", using the default", "value", raw, "default", def.Milliseconds())
+		return def
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func envBool(name string, def bool) bool {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		slog.Warn("invalid "+name+", using the default", "value", raw, "default", def)
+		return def
+	}
+	return v
+}
+
+// envInt reads a non-negative integer from the environment.
+func envInt(name string, def int) int {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		slog.Warn("invalid "+name+", using the default", "value", raw, "default", def)
+		return def
+	}
+	return n
+}
+
+// Main runs the pulse server as configured by flags, the PULSE_*
+// environment variables and the config file (see README and settings.go)
+// until SIGINT or SIGTERM, handing over to a new process on SIGUSR2.
+// cmd/pulse-server does nothing but call it.
+func Main() {
+	printed, err := loadSettings(os.Args[1:], os.Stdout)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if printed {
+		return
+	}
+	if err := setupLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	addr := os.Getenv("PULSE_ADDR")
+	if strings.TrimSpace(addr) == "" {
+		addr = ":8080"
+	}
+	specs, err := parseListenAddrs(addr)
+	if err != nil {
+		fatal("PULSE_ADDR", err)
+	}
+	connLog.setLimit(envInt("PULSE_LOG_BURST", connLog.limit()))
+	period := parsePeriodMS()
+	beatPeriod, beats, err := defaultTempo()
+	if err != nil {
+		fatal("PULSE_BPM", err)
+	}
+	if beats != nil {
+		period = beatPeriod
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	quotas, err := parseQuotas(os.Getenv("PULSE_TENANT_QUOTAS"))
+	if err != nil {
+		fatal("PULSE_TENANT_QUOTAS", err)
+	}
+	store, err := openStore(os.Getenv("PULSE_STORE"))
+	if err != nil {
+		fatal("PULSE_STORE", err)
+	}
+	defer store.Close()
+
+	h := New(period)
+	h.acct = newAccounting(quotas)
+	if h.channels, err = parseChannels(os.Getenv("PULSE_CHANNELS"), period); err != nil {
+		fatal("PULSE_CHANNELS", err)
+	}
+	h.channel(defaultChannel).tempo = beats
+	if err := applyFeatures(os.Getenv("PULSE_FEATURES"), h.channels); err != nil {
+		fatal("PULSE_FEATURES", err)
+	}
+	if err := applySimulcast(os.Getenv("PULSE_SIMULCAST"), h.channels); err != nil {
+		fatal("PULSE_SIMULCAST", err)
+	}
+	if err := applyPatterns(os.Getenv("PULSE_PATTERNS"), h.channels); err != nil {
+		fatal("PULSE_PATTERNS", err)
+	}
+	if err := applyPrerolls(os.Getenv("PULSE_PREROLL"), h.channels); err != nil {
+		fatal("PULSE_PREROLL", err)
+	}
+	if h.domains, err = applyClockDomains(os.Getenv("PULSE_CLOCK_DOMAINS"), os.Getenv("PULSE_CHANNEL_DOMAINS"), h.channels); err != nil {
+		fatal("PULSE_CLOCK_DOMAINS", err)
+	}
+	sendAheadLead = envMS("PULSE_SEND_AHEAD_MS", sendAheadLead)
+	fanoutWorkers = envInt("PULSE_FANOUT_WORKERS", fanoutWorkers)
+	backfillSize = envInt("PULSE_BACKFILL", backfillSize)
+	h.SetHerdJitter(envMS("PULSE_HERD_JITTER_MS", 0), nil)
+	fairMax = envMS("PULSE_FAIR_MAX_MS", fairMax)
+	fairTolerance = envMS("PULSE_FAIR_TOLERANCE_MS", fairTolerance)
+	h.setOffset(parseOffsetMS())
+	persistTimeline := envBool("PULSE_PERSIST_TIMELINE", false)
+	if spec := strings.TrimSpace(os.Getenv("PULSE_STORE")); persistTimeline && (spec == "" || spec == "memory") {
+		slog.Warn("PULSE_PERSIST_TIMELINE has no effect with an in-memory PULSE_STORE")
+	}
+	if st, ok, err := loadState(store); err != nil {
+		slog.Error("load state", "err", err)
+	} else if ok {
+		h.setOffset(time.Duration(st.OffsetMS) * time.Millisecond)
+		slog.Info("restored output offset from store", "offset_ms", st.OffsetMS)
+	}
+	if handedOver() {
+		st, err := readHandoff()
+		if err != nil {
+			fatal("handoff", err)
+		}
+		h.resume(st)
+		slog.Info("handoff: resuming channels from the previous process", "channels", len(st.Channels))
+	} else if src := os.Getenv("PULSE_RESTORE_FROM"); src != "" {
+		st, err := loadSnapshot(src, os.Getenv("PULSE_RESTORE_TOKEN"))
+		if err != nil {
+			fatal("PULSE_RESTORE_FROM", err)
+		}
+		h.resume(st)
+		slog.Info("restored channels from snapshot", "from", src, "channels", len(st.Channels),
+			"age", time.Since(time.Unix(0, st.CapturedUnixNano)).Round(time.Millisecond))
+	} else if persistTimeline {
+		if st, ok, err := loadTimeline(store); err != nil {
+			slog.Error("load timeline", "err", err)
+		} else if ok {
+			h.resume(st)
+			slog.Info("resuming channels from the saved timeline", "channels", len(st.Channels),
+				"down", time.Since(time.Unix(0, st.CapturedUnixNano)).Round(time.Millisecond))
+		}
+	}
+	if path := os.Getenv("PULSE_REPLAY"); path != "" {
+		switch {
+		case tickSource != nil:
+			fatal("PULSE_REPLAY", errors.New("a replay cannot be driven by a tick source"))
+		case os.Getenv("PULSE_BACKPLANE") != "":
+			fatal("PULSE_REPLAY", errors.New("a replay cannot take part in a backplane"))
+		}
+		if h.replay, err = openReplay(path); err != nil {
+			fatal("PULSE_REPLAY", err)
+		}
+	}
+	if path := os.Getenv("PULSE_RECORD"); path != "" {
+		if h.recorder, err = startRecorder(path); err != nil {
+			fatal("PULSE_RECORD", err)
+		}
+	}
+	if raw := os.Getenv("PULSE_BACKPLANE"); raw != "" {
+		role := os.Getenv("PULSE_BACKPLANE_ROLE")
+		if role != backplanePublisher && tickSource != nil {
+			fatal("PULSE_BACKPLANE_ROLE", fmt.Errorf("an %s cannot be driven by a tick source", role))
+		}
+		if h.backplane, err = startBackplane(raw, role); err != nil {
+			fatal("PULSE_BACKPLANE", err)
+		}
+	}
+	if raw := os.Getenv("PULSE_UPSTREAM"); raw != "" {
+		switch {
+		case tickSource != nil:
+			fatal("PULSE_UPSTREAM", errors.New("a relay cannot be driven by a tick source"))
+		case h.replay != nil:
+			fatal("PULSE_UPSTREAM", errors.New("a relay cannot replay a recording"))
+		case h.backplane != nil:
+			fatal("PULSE_UPSTREAM", errors.New("a relay cannot take part in a backplane"))
+		}
+		if h.upstream, err = newUpstream(raw, os.Getenv("PULSE_UPSTREAM_TOKEN")); err != nil {
+			fatal("PULSE_UPSTREAM", err)
+		}
+	}
+	if raw := os.Getenv("PULSE_TIME_SOURCE"); raw != "" {
+		if h.upstream != nil {
+			fatal("PULSE_TIME_SOURCE", errors.New("a relay keeps the upstream's time"))
+		}
+		if h.timeSource, err = parseTimeSource(raw, envMS("PULSE_TIME_POLL_MS", 64*time.Second)); err != nil {
+			fatal("PULSE_TIME_SOURCE", err)
+		}
+		h.utc = clock.NewDisciplined()
+		if err := h.timeSource.start(ctx, h.utc); err != nil {
+			fatal("PULSE_TIME_SOURCE", err)
+		}
+		h.clock = h.utc
+	}
+	h.lag = lagPolicy{
+		warn:      envMS("PULSE_LAGGING_MS", 50*time.Millisecond),
+		drop:      envMS("PULSE_DROP_LAG_MS", 0),
+		warnEvery: envMS("PULSE_WARN_INTERVAL_MS", 5*time.Second),
+	}
+	evict, err := parseSlowConsumer(os.Getenv("PULSE_SLOW_CONSUMER"))
+	if err != nil {
+		fatal("PULSE_SLOW_CONSUMER", err)
+	}
+	high, err := parseHighPriority(os.Getenv("PULSE_HIGH_PRIORITY"))
+	if err != nil {
+		fatal("PULSE_HIGH_PRIORITY", err)
+	}
+	h.queue = queuePolicy{size: max(envInt("PULSE_WRITE_QUEUE", defaultWriteQueue), 1), evict: evict, high: priorityTypes(high)}
+	if writeTimeout = envMS("PULSE_WRITE_TIMEOUT_MS", defaultWriteTimeout); writeTimeout <= 0 {
+		writeTimeout = defaultWriteTimeout
+	}
+	sockets = socketTuning{
+		noDelay:    envBool("PULSE_TCP_NODELAY", true),
+		sendBuffer: envInt("PULSE_SEND_BUFFER_BYTES", 0),
+		keepAlive:  envMS("PULSE_TCP_KEEPALIVE_MS", defaultKeepAlive),
+	}
+	labels, err := parseMetricLabels(os.Getenv("PULSE_METRIC_LABELS"))
+	if err != nil {
+		fatal("PULSE_METRIC_LABELS", err)
+	}
+	h.metrics = newConnMetrics(labels)
+	if h.identity, err = parseIdentityHeaders(os.Getenv("PULSE_IDENTITY_HEADERS")); err != nil {
+		fatal("PULSE_IDENTITY_HEADERS", err)
+	}
+	if h.origins, err = parseOriginPolicy(os.Getenv("PULSE_ALLOWED_ORIGINS")); err != nil {
+		fatal("PULSE_ALLOWED_ORIGINS", err)
+	}
+	if h.window = envMS("PULSE_WINDOW_MS", 0); h.window > 0 {
+		go h.runWindows(h.window)
+	}
+	if interval := envMS("PULSE_ACK_SUMMARY_MS", 0); interval > 0 {
+		h.acks = newAckSummaries(interval)
+		go h.runAckSummaries()
+	}
+	if h.pingInterval = envMS("PULSE_PING_INTERVAL_MS", 15*time.Second); h.pingInterval > 0 {
+		go h.keepalive(h.pingInterval, envMS("PULSE_PONG_TIMEOUT_MS", 10*time.Second))
+	}
+
+	if h.webhooks, err = webhooksFromEnv(); err != nil {
+		fatal("webhooks", err)
+	}
+	alerts := newAlerter(alertConfigFromEnv(), h.webhooks)
+	h.storms = newStormDetector(stormConfigFromEnv(), alerts)
+	h.compat = compatWarnerFromEnv(alerts)
+	status := newStatusTracker(period)
+	var canary *canarySubscriber
+	if envBool("PULSE_CANARY", true) {
+		canary = startCanary(h)
+	}
+	records := newAppender(store, 1024)
+	var history *historyRecorder
+	if envBool("PULSE_HISTORY", false) {
+		history = startHistory(records)
+	}
+	series := newTimeseries(store, records)
+	h.timelines = newTimelineLog(records)
+	if envBool("PULSE_LOCKSTEP", false) {
+		h.lock = newLockstep()
+		RegisterEnricher("lockstep", h.lock.enrich)
+	}
+	rounds := newRounds(h)
+	RegisterEnricher("tempo", h.tempoEnricher)
+	RegisterEnricher("round", rounds.enrich)
+	pace := newPacer(h)
+	RegisterEnricher("pace", pace.enrich)
+	if envBool("PULSE_MEDIA_CLOCK", false) {
+		h.media = newMediaClock(h.clock.Now())
+		RegisterEnricher("media", h.media.enrich)
+	}
+	if addr := strings.TrimSpace(os.Getenv("PULSE_LINK")); addr != "" {
+		if by := h.drivenBy(h.channel(defaultChannel)); by != "" {
+			fatal("PULSE_LINK", errors.New("the default channel is driven by the "+by))
+		}
+		if d := h.channel(defaultChannel).domain; d != nil && d.source != domainFree {
+			fatal("PULSE_LINK", fmt.Errorf("the default channel is in clock domain %q", d.name))
+		}
+		mode := strings.TrimSpace(os.Getenv("PULSE_LINK_MODE"))
+		if mode == "" {
+			mode = linkFollow
+		}
+		quantum := 4
+		if t := h.channel(defaultChannel).tempo; t != nil {
+			quantum = t.beatsPerBar
+		}
+		link, err := startLink(addr, mode, float64(envInt("PULSE_LINK_QUANTUM", quantum)), []*pulseChannel{h.channel(defaultChannel)}, nil, h.utc)
+		if err != nil {
+			fatal("PULSE_LINK", err)
+		}
+		RegisterEnricher("link", link.enrich)
+	}
+	if err := h.startClockDomains(); err != nil {
+		fatal("PULSE_CLOCK_DOMAINS", err)
+	}
+	if envBool("PULSE_DOMAIN_TIMES", false) {
+		RegisterEnricher("domains", h.domainTimes)
+	}
+	if err := startArchiver(archiveConfigFromEnv(), store); err != nil {
+		fatal("PULSE_ARCHIVE_URL", err)
+	}
+	if err := startHistorySegments(store); err != nil {
+		fatal("PULSE_HISTORY_CODEC", err)
+	}
+
+	trig, err := startTrigger(os.Getenv("PULSE_TRIGGER"), envMS("PULSE_TRIGGER_WIDTH_MS", time.Millisecond))
+	if err != nil {
+		fatal("trigger", err)
+	}
+	h.midi, err = startMIDI(os.Getenv("PULSE_MIDI_OUT"), envInt("PULSE_MIDI_CLOCKS_PER_PULSE", 24))
+	if err != nil {
+		fatal("PULSE_MIDI_OUT", err)
+	}
+	oscAddress := strings.TrimSpace(os.Getenv("PULSE_OSC_ADDRESS"))
+	if oscAddress == "" {
+		oscAddress = "/pulse"
+	}
+	osc, err := startOSC(os.Getenv("PULSE_OSC_TARGETS"), oscAddress)
+	if err != nil {
+		fatal("PULSE_OSC_TARGETS", err)
+	}
+	h.multicast, err = startMulticast(os.Getenv("PULSE_MULTICAST"), strings.TrimSpace(os.Getenv("PULSE_MULTICAST_IFACE")), envInt("PULSE_MULTICAST_TTL", 1))
+	if err != nil {
+		fatal("PULSE_MULTICAST", err)
+	}
+	mqttTopic := strings.TrimSpace(os.Getenv("PULSE_MQTT_TOPIC"))
+	if mqttTopic == "" {
+		mqttTopic = "pulse/{channel}"
+	}
+	if h.mqtt, err = startMQTT(os.Getenv("PULSE_MQTT"), mqttTopic, strings.TrimSpace(os.Getenv("PULSE_MQTT_CLIENT_ID")), envInt("PULSE_MQTT_VERSION", 3)); err != nil {
+		fatal("PULSE_MQTT", err)
+	}
+	var loadTest *loadSelfTest
+	if !handedOver() {
+		loadTest = loadSelfTestFromEnv()
+	}
+	health := pulseHealthFromEnv()
+	h.observe = func(o PulseObservation) {
+		// Arm the trigger and MIDI clock for the next pulse as clients
+		// will see it, and tell OSC targets about it.
+		next := o.Scheduled.Add(o.Lead + o.Period).Add(h.offset())
+		trig.schedule(o.Seq+1, next)
+		h.midi.schedule(next, o.Period)
+		osc.send(o.Seq, o.Period, o.At, next)
+		status.record(o)
+		health.observe(o)
+		alerts.observe(o)
+		canary.observe(o)
+		history.observe(o)
+		series.observe(o)
+		loadTest.observe(o)
+	}
+	h.tickBudget = envMS("PULSE_TICK_BUDGET_MS", 0)
+	h.Start(ctx)
+	if persistTimeline {
+		go h.persistTimeline(ctx, store)
+	}
+
+	h.strict = envBool("PULSE_STRICT_FRAMES", true)
+	h.maxMessage = envInt("PULSE_MAX_MESSAGE_BYTES", defaultMaxMessage)
+	h.gate = newHandshakeGate(h, gateConfigFromEnv())
+	if loadTest != nil {
+		h.gate.selfTest = loadTest
+		go loadTest.run(h)
+	}
+	h.families = familyLimitsFromEnv()
+	pending := envInt("PULSE_MAX_PENDING_CONNS", 0)
+	h.fds = fdBudgetFromEnv()
+	h.limits = clientLimitsFromEnv(h.fds, pending)
+	h.fds.log(int(h.limits.max))
+	if h.admission, err = parseAdmissionPolicy(os.Getenv("PULSE_ADMISSION_RULES"), h.channels); err != nil {
+		fatal("PULSE_ADMISSION_RULES", err)
+	}
+	if handedOver() {
+		// Clients arrive gradually as the old process drains them.
+		h.gate.warm.Store(true)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", health.handler(h))
+	mux.HandleFunc("GET /readyz", h.gate.readyHandler())
+	mux.Handle("/ws", h)
+	mux.Handle("/ws/{channel}", h)
+	mux.HandleFunc("GET /sse", serveSSE(h, h.gate))
+	mux.HandleFunc("GET /sse/{channel}", serveSSE(h, h.gate))
+	mux.HandleFunc("GET /metrics", h.metricsHandler())
+	mux.HandleFunc("GET /api/status", status.handler(h, alerts, canary))
+	mux.HandleFunc("GET /status", status.runtimeHandler(h))
+	mux.HandleFunc("GET /api/timeseries", series.handler())
+	mux.HandleFunc("GET /api/windows", h.windowsHandler(store, history != nil))
+	mux.HandleFunc("GET /api/pulses", backfillHandler(h))
+	mux.HandleFunc("GET /poll", pollHandler(h))
+	mux.HandleFunc("GET /api/round", rounds.handler())
+	mux.HandleFunc("GET /api/pace", pace.handler())
+	maint := newMaintenance(h, envMS("PULSE_DRAIN_MS", 10*time.Second), stop)
+	mux.HandleFunc("GET /api/maintenance", maint.handler())
+	mux.HandleFunc("GET /api/announcements", h.notices.handler())
+	mux.HandleFunc("GET /api/domains", domainsHandler(h))
+	mux.HandleFunc("GET /api/version", versionHandler())
+	mux.HandleFunc("GET /api/schema", schemaHandler())
+	mux.HandleFunc("GET /api/config/schema", configSchemaHandler())
+	if envBool("PULSE_DEMO", true) {
+		mux.HandleFunc("GET /{$}", demoHandler())
+	}
+	signingKeys, err := parseSigningKeys(os.Getenv("PULSE_ADMIN_SIGNING_KEYS"))
+	if err != nil {
+		fatal("PULSE_ADMIN_SIGNING_KEYS", err)
+	}
+	masterKey, previousKey, err := masterKeysFromEnv()
+	if err != nil {
+		fatal("PULSE_MASTER_KEY", err)
+	}
+	vault, err := openVault(store, masterKey, previousKey)
+	if err != nil {
+		fatal("secrets", err)
+	}
+	h.auth = newAdminAuth(map[role]string{
+		roleAdmin:      os.Getenv("PULSE_ADMIN_TOKEN"),
+		roleController: os.Getenv("PULSE_CONTROLLER_TOKEN"),
+		roleObserver:   os.Getenv("PULSE_OBSERVER_TOKEN"),
+	}, signingKeys, vault, envMS("PULSE_ADMIN_SIGNING_SKEW_MS", 5*time.Minute))
+	h.auth.idempotency = newIdempotency(envMS("PULSE_IDEMPOTENCY_WINDOW_MS", 10*time.Minute))
+	if h.subscribers, err = loadClientAuth(); err != nil {
+		fatal("client auth", err)
+	}
+	audit := newAuditLog(store)
+	registerAdmin(mux, h, store, audit, rounds, pace, maint, h.auth, h.lag.warn)
+	mux.HandleFunc("GET /api/history", requireRole(h.auth, roleObserver, historyHandler(store, history != nil)))
+	mux.HandleFunc("GET /api/beat", requireRole(h.auth, roleObserver, beatHandler(h, store)))
+	usage := startUsageLedger(h, store, envMS("PULSE_USAGE_FLUSH_MS", time.Minute))
+	mux.HandleFunc("GET /admin/usage", requireRole(h.auth, roleObserver, usage.handler()))
+
+	tlsConfig, err := tlsConfigFromEnv()
+	if err != nil {
+		fatal("tls", err)
+	}
+	h.httpConns = newHTTPConnStates(pending)
+	handler := withRequestID(withAPIUsage(h.acct, withCompression(mux)))
+	limits := httpLimitsFromEnv()
+	lns, err := listenAll(specs)
+	if err != nil {
+		fatal("listen", err)
+	}
+	// A server per listener, serving what it is for.
+	servers := make([]*http.Server, len(lns))
+	errc := make(chan error, len(lns))
+	for i, ln := range lns {
+		srv := &http.Server{
+			Handler: ln.opts.serve.only(handler),
+			// WebSocket and SSE both hijack the connection, which HTTP/2
+			// does not allow; a non-nil TLSNextProto keeps net/http from
+			// offering it.
+			TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){},
+			ConnState:    h.httpConns.track,
+		}
+		if !ln.opts.plain {
+			srv.TLSConfig = tlsConfig
+		}
+		limits.apply(srv, false)
+		servers[i] = srv
+		go func() {
+			slog.Info("pulse server listening", "addr", ln.Addr().String(), "tls", srv.TLSConfig != nil, "serve", ln.opts.serve, "period", period)
+			if srv.TLSConfig != nil {
+				errc <- srv.ServeTLS(ln, "", "")
+			} else {
+				errc <- srv.Serve(ln)
+			}
+		}()
+	}
+	sntp := &sntpServer{addr: strings.TrimSpace(os.Getenv("PULSE_SNTP_ADDR")), utc: h.utc}
+	if sntp.addr != "" {
+		if err := sntp.start(); err != nil {
+			fatal("PULSE_SNTP_ADDR", err)
+		}
+		defer sntp.close()
+	}
+	var grpcSrv *grpcServer
+	if addr := strings.TrimSpace(os.Getenv("PULSE_GRPC_ADDR")); addr != "" {
+		grpcSrv = &grpcServer{
+			addr:   addr,
+			h:      h,
+			status: func() statusResponse { return status.response(h, alerts, canary) },
+			audit:  audit,
+			tls:    tlsConfig,
+			limits: limits,
+		}
+		if err := grpcSrv.start(); err != nil {
+			fatal("PULSE_GRPC_ADDR", err)
+		}
+		defer grpcSrv.close()
+	}
+	var control *controlServer
+	if addr := strings.TrimSpace(os.Getenv("PULSE_CONTROL_ADDR")); addr != "" {
+		if !h.auth.enabled() {
+			slog.Warn("PULSE_CONTROL_ADDR serves only the admin API, which no credentials enable")
+		}
+		control = &controlServer{addr: addr, handler: withRequestID(withAPIUsage(h.acct, mux)), tls: tlsConfig, limits: limits}
+		if err := control.start(); err != nil {
+			fatal("PULSE_CONTROL_ADDR", err)
+		}
+		defer control.close()
+	}
+	if datagramServer != nil {
+		go func() {
+			if err := datagramServer(ctx, h, tlsConfig); err != nil && ctx.Err() == nil {
+				fatal("webtransport", err)
+			}
+		}()
+	}
+	handoffReady()
+	sdReady()
+
+	upgrades := make(chan os.Signal, 1)
+	signal.Notify(upgrades, syscall.SIGUSR2)
+	handedOff := false
+	for done := false; !done; {
+		select {
+		case err := <-errc:
+			fatal("serve", err)
+		case <-ctx.Done():
+			done = true
+		case <-upgrades:
+			if err := handOff(lns, h); err != nil {
+				slog.Error("handoff failed, still serving", "err", err)
+				continue
+			}
+			// The new process accepts from now on. Keep pulsing for the
+			// clients still here while they are moved over.
+			keepSocketFiles(lns)
+			sntp.close()
+			grpcSrv.close()
+			control.close()
+			h.midi.close(false)
+			closeCtx, cancel := context.WithTimeout(ctx, time.Second)
+			if err := shutdown(closeCtx, servers); err != nil {
+				slog.Warn("handoff", "err", err)
+			}
+			cancel()
+			window := envMS("PULSE_DRAIN_MS", 10*time.Second)
+			slog.Info("handoff: new process ready, draining", "clients", h.Count(), "window", window)
+			h.drain(ctx, window, ws.CloseServiceRestart, "server restarting")
+			done, handedOff = true, true
+		}
+	}
+
+	// Stop pulses and new connections first so nothing is written after a
+	// client's close frame, then say goodbye to every client.
+	timeout := envMS("PULSE_SHUTDOWN_TIMEOUT_MS", 5*time.Second)
+	slog.Info("shutting down", "clients", h.Count())
+	if !handedOff {
+		// The new process is the service now.
+		sdNotify("STOPPING=1")
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := shutdown(shutdownCtx, servers); err != nil {
+		slog.Warn("shutdown", "err", err)
+	}
+	h.Close(timeout)
+	usage.flush(time.Now())
+	h.midi.close(true)
+	h.recorder.close()
+	h.mqtt.close()
+	if persistTimeline {
+		if err := h.saveTimeline(store); err != nil {
+			slog.Error("save timeline", "err", err)
+		}
+	}
+	slog.Info("shutdown complete")
+}
@@ -0,0 +1,187 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"pulse/ws"
+)
+
+// maintenanceBody schedules a maintenance window: POST /admin/maintenance
+// {"start_ms":…,"end_ms":…,"text":"Database upgrade","exit":true}.
+// start_ms 0 starts it now. Clients are drained over DrainMS (default
+// PULSE_DRAIN_MS) from the start; with Exit the server then shuts down,
+// otherwise it takes connections again at the end.
+type maintenanceBody struct {
+	StartMS int64  `json:"start_ms"`
+	EndMS   int64  `json:"end_ms"`
+	Text    string `json:"text,omitempty"`
+	DrainMS int64  `json:"drain_ms,omitempty"`
+	Exit    bool   `json:"exit,omitempty"`
+}
+
+// maintenanceState is served by GET /api/maintenance. State is scheduled,
+// draining, drained or exiting.
+type maintenanceState struct {
+	StartMS        int64  `json:"start_ms"`
+	EndMS          int64  `json:"end_ms"`
+	Text           string `json:"text"`
+	DrainMS        int64  `json:"drain_ms"`
+	Exit           bool   `json:"exit"`
+	State          string `json:"state"`
+	AnnouncementID string `json:"announcement_id"`
+}
+
+// maintenance runs at most one maintenance window: it announces the
+// window, turns new connections away and drains the clients at its start,
+// and either stops the server or opens up again at its end.
+type maintenance struct {
+	h *Hub
+	// drain is the default drain window; exit stops the server.
+	drain time.Duration
+	exit  func()
+
+	mu     sync.Mutex
+	win    *maintenanceState
+	cancel context.CancelFunc
+}
+
+func newMaintenance(h *Hub, drain time.Duration, exit func()) *maintenance {
+	return &maintenance{h: h, drain: drain, exit: exit}
+}
+
+// schedule validates body and starts the window's sequence.
+func (m *maintenance) schedule(body maintenanceBody, now time.Time) (maintenanceState, error) {
+	if body.StartMS == 0 {
+		body.StartMS = now.UnixMilli()
+	}
+	if body.StartMS < now.Add(-time.Minute).UnixMilli() || body.EndMS <= body.StartMS {
+		return maintenanceState{}, fmt.Errorf("the window must not start in the past and must end after it starts")
+	}
+	if body.DrainMS < 0 || body.DrainMS > body.EndMS-body.StartMS {
+		return maintenanceState{}, fmt.Errorf("drain_ms must be in [0, end_ms - start_ms]")
+	}
+	if body.DrainMS == 0 {
+		body.DrainMS = m.drain.Milliseconds()
+	}
+	if body.Text == "" {
+		body.Text = "Scheduled maintenance"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.win != nil {
+		return maintenanceState{}, errMaintenanceScheduled
+	}
+	note, err := m.h.notices.post(announcementBody{
+		Text:     body.Text,
+		Severity: "warning",
+		Downtime: &downtimeWindow{StartMS: body.StartMS, EndMS: body.EndMS},
+	}, now)
+	if err != nil {
+		return maintenanceState{}, err
+	}
+	st := &maintenanceState{
+		StartMS:        body.StartMS,
+		EndMS:          body.EndMS,
+		Text:           body.Text,
+		DrainMS:        body.DrainMS,
+		Exit:           body.Exit,
+		State:          "scheduled",
+		AnnouncementID: note.ID,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.win, m.cancel = st, cancel
+	go m.run(ctx, *st)
+	return *st, nil
+}
+
+var errMaintenanceScheduled = fmt.Errorf("a maintenance window is already scheduled")
+
+// run waits for the window and carries it out, until ctx is cancelled.
+func (m *maintenance) run(ctx context.Context, st maintenanceState) {
+	if !m.h.clock.SleepUntil(ctx, time.UnixMilli(st.StartMS), nil) {
+		return
+	}
+	m.mu.Lock()
+	if ctx.Err() != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.win.State = "draining"
+	m.h.gate.drainUntil.Store(st.EndMS)
+	m.mu.Unlock()
+	slog.Info("maintenance: draining", "clients", m.h.Count(), "drain_ms", st.DrainMS)
+	m.h.drain(ctx, time.Duration(st.DrainMS)*time.Millisecond, ws.CloseTryAgainLater, "maintenance")
+	if ctx.Err() != nil {
+		return
+	}
+	if st.Exit {
+		m.setState("exiting")
+		slog.Info("maintenance: drained, stopping the server")
+		m.exit()
+		return
+	}
+	m.setState("drained")
+	if !m.h.clock.SleepUntil(ctx, time.UnixMilli(st.EndMS), nil) {
+		return
+	}
+	m.mu.Lock()
+	if ctx.Err() != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.finish()
+	m.mu.Unlock()
+	slog.Info("maintenance: window over, accepting connections")
+}
+
+// cancelWindow calls off the window, withdrawing its announcement and accepting
+// connections again. It reports false if none was scheduled.
+func (m *maintenance) cancelWindow(now time.Time) (maintenanceState, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.win == nil || m.win.State == "exiting" {
+		return maintenanceState{}, false
+	}
+	st := *m.win
+	m.h.notices.withdraw(st.AnnouncementID, now)
+	m.finish()
+	return st, true
+}
+
+// finish ends the window; the caller holds m.mu.
+func (m *maintenance) finish() {
+	m.cancel()
+	m.win, m.cancel = nil, nil
+	m.h.gate.drainUntil.Store(0)
+}
+
+func (m *maintenance) setState(s string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.win != nil {
+		m.win.State = s
+	}
+}
+
+// handler serves GET /api/maintenance: the window, or 204 without one.
+func (m *maintenance) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		m.mu.Lock()
+		var st *maintenanceState
+		if m.win != nil {
+			cp := *m.win
+			st = &cp
+		}
+		m.mu.Unlock()
+		if st == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, http.StatusOK, st)
+	}
+}
@@ -0,0 +1,118 @@
+package hub
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxMediaRate bounds playback rate changes; players cannot follow much
+// beyond this anyway.
+const maxMediaRate = 16
+
+// maxMediaPosition bounds seeks, well past any recording or stream.
+const maxMediaPosition = 365 * 24 * time.Hour
+
+// mediaControlMessage is sent by clients to steer the media clock:
+// {"type":"media_control","action":"seek","position_ms":90000}.
+type mediaControlMessage struct {
+	Type       string  `json:"type"`
+	Action     string  `json:"action"` // play, pause, seek or rate
+	PositionMS int64   `json:"position_ms,omitempty"`
+	Rate       float64 `json:"rate,omitempty"`
+}
+
+// mediaState is the media clock at one instant: at server time at_ms the
+// media was at position_ms and advancing at rate (0 while paused). Players
+// derive the position for any later server time from it.
+type mediaState struct {
+	AtMS       int64   `json:"at_ms"`
+	PositionMS float64 `json:"position_ms"`
+	Rate       float64 `json:"rate"`
+	Paused     bool    `json:"paused"`
+}
+
+// mediaMessage announces a control change right away, so players do not
+// have to wait for the next pulse to seek.
+type mediaMessage struct {
+	Type string `json:"type"`
+	mediaState
+	By string `json:"by"` // request_id of the client that made the change
+}
+
+// mediaClock maps server time to media time for synchronized video
+// playback. It is anchored at the last control change: position advances
+// from pos at anchor by rate until the next play, pause, seek or rate
+// change.
+type mediaClock struct {
+	mu     sync.Mutex
+	anchor time.Time
+	pos    time.Duration
+	rate   float64
+	paused bool
+}
+
+// newMediaClock returns a clock paused at position 0 with rate 1 as of
+// now.
+func newMediaClock(now time.Time) *mediaClock {
+	return &mediaClock{anchor: now, rate: 1, paused: true}
+}
+
+// position returns the media position at t. The caller holds m.mu.
+func (m *mediaClock) position(t time.Time) time.Duration {
+	if m.paused {
+		return m.pos
+	}
+	return m.pos + time.Duration(float64(t.Sub(m.anchor))*m.rate)
+}
+
+// state returns the clock as seen at t, truncated to the millisecond at_ms
+// carries. The caller holds m.mu.
+func (m *mediaClock) state(t time.Time) mediaState {
+	t = t.Truncate(time.Millisecond)
+	rate := m.rate
+	if m.paused {
+		rate = 0
+	}
+	return mediaState{
+		AtMS:       t.UnixMilli(),
+		PositionMS: float64(m.position(t)) / float64(time.Millisecond),
+		Rate:       rate,
+		Paused:     m.paused,
+	}
+}
+
+// control applies a control message and returns the resulting state.
+func (m *mediaClock) control(c mediaControlMessage, now time.Time) (mediaState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Rebase on now so the change only affects media time from here on.
+	m.pos, m.anchor = m.position(now), now
+	switch c.Action {
+	case "play":
+		m.paused = false
+	case "pause":
+		m.paused = true
+	case "seek":
+		if c.PositionMS < 0 || c.PositionMS > maxMediaPosition.Milliseconds() {
+			return mediaState{}, fmt.Errorf("position_ms must be in [0, %d]", maxMediaPosition.Milliseconds())
+		}
+		m.pos = time.Duration(c.PositionMS) * time.Millisecond
+	case "rate":
+		if c.Rate <= 0 || c.Rate > maxMediaRate {
+			return mediaState{}, fmt.Errorf("rate must be in (0, %d]", maxMediaRate)
+		}
+		m.rate = c.Rate
+	default:
+		return mediaState{}, fmt.Errorf("unknown action %q", c.Action)
+	}
+	return m.state(now), nil
+}
+
+// enrich is registered as a pulse enricher: every pulse carries the media
+// clock as of its now_ms.
+func (m *mediaClock) enrich(msg PulseMessage) map[string]any {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return map[string]any{"media": m.state(time.UnixMilli(msg.NowMS))}
+}
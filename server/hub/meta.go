@@ -0,0 +1,90 @@
+package hub
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// version is set at build time with -ldflags "-X pulse/hub.version=...".
+var version = "dev"
+
+//go:embed schema.json
+var schemaJSON []byte
+
+type versionResponse struct {
+	Version   string   `json:"version"`
+	Revision  string   `json:"revision,omitempty"`
+	Go        string   `json:"go"`
+	Protocols []string `json:"protocols"`
+	// Features lists the experimental features PULSE_FEATURES can enable.
+	Features []string `json:"features"`
+}
+
+func buildVersion() versionResponse {
+	v := versionResponse{
+		Version:   version,
+		Go:        runtime.Version(),
+		Protocols: supportedProtocols,
+		Features:  featureNames(),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				v.Revision = s.Value
+			}
+		}
+	}
+	return v
+}
+
+func versionHandler() http.HandlerFunc {
+	body, _ := json.Marshal(buildVersion())
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeCached(w, r, "application/json", body, etagOf(body))
+	}
+}
+
+func schemaHandler() http.HandlerFunc {
+	tag := etagOf(schemaJSON)
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeCached(w, r, "application/schema+json", schemaJSON, tag)
+	}
+}
+
+// etagOf returns a strong ETag derived from the given bytes; gzipped
+// responses weaken it (see compress.go).
+func etagOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// writeCached writes body with the given ETag, or 304 Not Modified when the
+// request's If-None-Match already names it.
+func writeCached(w http.ResponseWriter, r *http.Request, contentType string, body []byte, etag string) {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	_, _ = w.Write(body)
+}
+
+// etagMatches uses weak comparison, as RFC 9110 requires for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,227 @@
+package hub
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"pulse/ws"
+)
+
+const (
+	// defaultLabelLimit is how many distinct values a metric label keeps
+	// when PULSE_METRIC_LABELS gives no limit of its own.
+	defaultLabelLimit = 20
+	// maxLabelLimit bounds any configured limit.
+	maxLabelLimit = 1000
+	// overflowLabel replaces label values beyond a label's limit.
+	overflowLabel = "other"
+)
+
+// metricLabels maps each connection attribute that may become a metric
+// label to how it is read from a connection.
+var metricLabels = map[string]func(*Conn) string{
+	"channel": (*Conn).Channel,
+	"codec":   connCodec,
+	"tenant":  func(c *Conn) string { return c.tenant },
+}
+
+// connCodec names how a connection is served, short enough for a label.
+func connCodec(c *Conn) string {
+	switch {
+	case c.sse:
+		return "sse"
+	case c.grpc:
+		return "grpc"
+	case c.datagram:
+		return "webtransport"
+	case c.proto == protoLegacy:
+		return "v1"
+	case c.proto == protoJSON:
+		return "json"
+	case c.proto == protoBinary:
+		return "binary"
+	case c.proto == protoTagged:
+		return "tagged"
+	case c.proto == protoRelay:
+		return "relay"
+	}
+	return c.proto
+}
+
+// metricLabel is one configured label and its distinct-value limit.
+type metricLabel struct {
+	name  string
+	limit int
+}
+
+// parseMetricLabels parses comma-separated "label[:limit]" entries, e.g.
+// "codec,tenant:50". Labels come out in a fixed order so every series
+// lists them the same way.
+func parseMetricLabels(raw string) ([]metricLabel, error) {
+	var labels []metricLabel
+	seen := make(map[string]bool)
+	for _, entry := range ws.SplitHeaderList(raw) {
+		name, limit, hasLimit := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if metricLabels[name] == nil {
+			return nil, fmt.Errorf("unknown metric label %q (want channel, codec or tenant)", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("metric label %q listed twice", name)
+		}
+		seen[name] = true
+		l := metricLabel{name: name, limit: defaultLabelLimit}
+		if hasLimit {
+			n, err := strconv.Atoi(strings.TrimSpace(limit))
+			if err != nil || n < 1 || n > maxLabelLimit {
+				return nil, fmt.Errorf("metric label %q: limit must be in [1, %d]", name, maxLabelLimit)
+			}
+			l.limit = n
+		}
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	return labels, nil
+}
+
+// metricSeries holds the connection metrics of one combination of label
+// values.
+type metricSeries struct {
+	values []string
+
+	conns  atomic.Int64
+	opened atomic.Uint64
+	bytes  atomic.Uint64
+}
+
+// connMetrics keeps per-connection metrics broken down by the configured
+// labels. Each label admits values first come, first served up to its
+// limit; later values are counted under "other", so a client that makes up
+// channel names cannot grow the number of series without bound.
+type connMetrics struct {
+	labels []metricLabel
+
+	mu       sync.Mutex
+	admitted []map[string]bool // per label
+	overflow []uint64          // per label, connections folded into "other"
+	series   map[string]*metricSeries
+}
+
+func newConnMetrics(labels []metricLabel) *connMetrics {
+	m := &connMetrics{
+		labels:   labels,
+		admitted: make([]map[string]bool, len(labels)),
+		overflow: make([]uint64, len(labels)),
+		series:   make(map[string]*metricSeries),
+	}
+	for i := range labels {
+		m.admitted[i] = make(map[string]bool)
+	}
+	return m
+}
+
+// seriesFor returns the series c is counted under, creating it on first
+// use.
+func (m *connMetrics) seriesFor(c *Conn) *metricSeries {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	values := make([]string, len(m.labels))
+	for i, l := range m.labels {
+		v := metricLabels[l.name](c)
+		if !m.admitted[i][v] {
+			if len(m.admitted[i]) >= l.limit {
+				m.overflow[i]++
+				v = overflowLabel
+			} else {
+				m.admitted[i][v] = true
+			}
+		}
+		values[i] = v
+	}
+	key := strings.Join(values, "\x00")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{values: values}
+		m.series[key] = s
+	}
+	return s
+}
+
+// connected counts a new connection.
+func (m *connMetrics) connected(c *Conn) {
+	c.series = m.seriesFor(c)
+	c.series.conns.Add(1)
+	c.series.opened.Add(1)
+}
+
+// metricsHandler serves GET /metrics in the Prometheus text format.
+func (h *Hub) metricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		var b strings.Builder
+		h.metrics.write(&b)
+		h.pulseMetrics.write(&b)
+		h.httpConns.write(&b)
+		h.fds.write(&b, h.limits.n.Load())
+		h.webhooks.write(&b)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = w.Write([]byte(b.String()))
+	}
+}
+
+// write appends the connection metrics to b.
+func (m *connMetrics) write(b *strings.Builder) {
+	m.mu.Lock()
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	series := make([]*metricSeries, len(keys))
+	for i, k := range keys {
+		series[i] = m.series[k]
+	}
+	overflow := append([]uint64(nil), m.overflow...)
+	m.mu.Unlock()
+
+	family := func(name, typ, help string, value func(*metricSeries) string) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, s := range series {
+			fmt.Fprintf(b, "%s%s %s\n", name, m.labelSet(s.values), value(s))
+		}
+	}
+	family("pulse_connections", "gauge", "Connected clients.", func(s *metricSeries) string {
+		return strconv.FormatInt(s.conns.Load(), 10)
+	})
+	family("pulse_connections_opened_total", "counter", "Connections accepted.", func(s *metricSeries) string {
+		return strconv.FormatUint(s.opened.Load(), 10)
+	})
+	family("pulse_bytes_sent_total", "counter", "Bytes written to clients.", func(s *metricSeries) string {
+		return strconv.FormatUint(s.bytes.Load(), 10)
+	})
+	if len(m.labels) > 0 {
+		b.WriteString("# HELP pulse_metric_label_overflow_total Connections counted under \"other\" because a label was at its limit.\n")
+		b.WriteString("# TYPE pulse_metric_label_overflow_total counter\n")
+		for i, l := range m.labels {
+			fmt.Fprintf(b, "pulse_metric_label_overflow_total{label=%q} %d\n", l.name, overflow[i])
+		}
+	}
+}
+
+// labelSet formats values as a Prometheus label set, empty without labels.
+func (m *connMetrics) labelSet(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = m.labels[i].name + `="` + labelEscaper.Replace(v) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
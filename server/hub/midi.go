@@ -0,0 +1,399 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MIDI real-time messages.
+const (
+	midiClockTick = 0xf8
+	midiStart     = 0xfa
+	midiContinue  = 0xfb
+	midiStop      = 0xfc
+)
+
+// midiOutput is where MIDI clock goes.
+type midiOutput interface {
+	send(msg byte) error
+	close() error
+}
+
+// midiClock sends MIDI clock for the default channel, so hardware synths
+// and DAWs follow the same pulse as WebSocket clients: clocksPerPulse
+// ticks per pulse (24 makes a pulse a quarter note), the ticks on pulses
+// falling at next_ms with the offset applied, like the trigger. Pausing the
+// channel sends stop, resuming it continue and a transport reset start.
+// It runs on its own goroutine so the pulse loop never waits on MIDI.
+type midiClock struct {
+	clocksPerPulse int
+	next           chan midiBeat
+	ctl            chan byte
+	done           chan struct{}
+	once           sync.Once
+	stop           atomic.Bool
+	closed         chan struct{}
+}
+
+// midiBeat is a pulse as clients will see it: at at, period after the
+// one before.
+type midiBeat struct {
+	at     time.Time
+	period time.Duration
+}
+
+// startMIDI opens the output named by spec, "port:<device>" for a raw MIDI
+// device such as /dev/snd/midiC1D0, or "rtp:<host>:<port>" to start an
+// RTP-MIDI (AppleMIDI) session with the host's control port. An empty
+// spec disables MIDI clock.
+func startMIDI(spec string, clocksPerPulse int) (*midiClock, error) {
+	kind, arg, _ := strings.Cut(strings.TrimSpace(spec), ":")
+	var open func() (midiOutput, error)
+	switch kind {
+	case "":
+		return nil, nil
+	case "port":
+		open = func() (midiOutput, error) { return openMIDIPort(arg) }
+	case "rtp":
+		open = func() (midiOutput, error) { return openRTPMIDI(arg) }
+	default:
+		return nil, fmt.Errorf("unknown MIDI output %q (want port:<device> or rtp:<host>:<port>)", spec)
+	}
+	if clocksPerPulse < 1 {
+		return nil, fmt.Errorf("clocks per pulse must be at least 1")
+	}
+	m := &midiClock{clocksPerPulse: clocksPerPulse, next: make(chan midiBeat, 1), ctl: make(chan byte, 4), done: make(chan struct{}), closed: make(chan struct{})}
+	out, err := open()
+	if err == nil {
+		go m.run(out)
+		return m, nil
+	}
+	if !handedOver() {
+		return nil, err
+	}
+	// After an upgrade the old process may hold a MIDI port until this
+	// one is ready.
+	go func() {
+		for deadline := time.Now().Add(handoffTimeout); time.Now().Before(deadline); {
+			time.Sleep(50 * time.Millisecond)
+			if out, err = open(); err == nil {
+				m.run(out)
+				return
+			}
+		}
+		slog.Error("midi", "err", err)
+	}()
+	return m, nil
+}
+
+// close ends MIDI clock, sending stop first unless the process is handing
+// over to a new one, and waits a moment for the output to be closed. A nil
+// midiClock ignores it.
+func (m *midiClock) close(stop bool) {
+	if m == nil {
+		return
+	}
+	m.once.Do(func() {
+		m.stop.Store(stop)
+		close(m.done)
+	})
+	select {
+	case <-m.closed:
+	case <-time.After(time.Second):
+	}
+}
+
+// schedule sets the next pulse, replacing one not yet reached. A nil
+// midiClock ignores it.
+func (m *midiClock) schedule(at time.Time, period time.Duration) {
+	if m == nil {
+		return
+	}
+	select {
+	case <-m.next:
+	default:
+	}
+	m.next <- midiBeat{at, period}
+}
+
+// transport reports a transport change of the default channel.
+func (m *midiClock) transport(paused bool, phase string) {
+	if m == nil {
+		return
+	}
+	msg := byte(midiContinue)
+	switch {
+	case paused:
+		msg = midiStop
+	case phase == "reset":
+		msg = midiStart
+	}
+	select {
+	case m.ctl <- msg:
+	default:
+	}
+}
+
+func (m *midiClock) run(out midiOutput) {
+	defer close(m.closed)
+	defer out.close()
+	var (
+		plan []time.Time
+		last time.Time
+		// start or continue goes out with the next tick.
+		pending byte = midiStart
+		timer   *time.Timer
+	)
+	if handedOver() {
+		pending = midiContinue
+	}
+	for {
+		var wait <-chan time.Time
+		if len(plan) > 0 {
+			timer = time.NewTimer(time.Until(plan[0]))
+			wait = timer.C
+		}
+		select {
+		case <-m.done:
+			if m.stop.Load() {
+				m.write(out, midiStop)
+			}
+			return
+		case b := <-m.next:
+			plan = m.ticks(b, last)
+		case msg := <-m.ctl:
+			if msg == midiStop {
+				plan, pending = nil, 0
+				m.write(out, midiStop)
+			} else {
+				pending = msg
+			}
+		case <-wait:
+			if pending != 0 {
+				m.write(out, pending)
+				pending = 0
+			}
+			m.write(out, midiClockTick)
+			last, plan = plan[0], plan[1:]
+		}
+		if timer != nil {
+			timer.Stop()
+			timer = nil
+		}
+	}
+}
+
+// ticks lists the clock ticks from the pulse before b up to b, leaving out
+// those already sent after last and any too far gone to send.
+func (m *midiClock) ticks(b midiBeat, last time.Time) []time.Time {
+	step := b.period / time.Duration(m.clocksPerPulse)
+	slack := step / 2
+	now := time.Now()
+	var plan []time.Time
+	for i := 0; i <= m.clocksPerPulse; i++ {
+		t := b.at.Add(-b.period + time.Duration(i)*step)
+		if i == m.clocksPerPulse {
+			t = b.at
+		}
+		if !t.After(last.Add(slack)) || t.Before(now.Add(-slack)) {
+			continue
+		}
+		plan = append(plan, t)
+	}
+	return plan
+}
+
+func (m *midiClock) write(out midiOutput, msg byte) {
+	if err := out.send(msg); err != nil {
+		connLog.log(slog.LevelWarn, "midi send failed", "err", err)
+	}
+}
+
+// midiPort writes to a raw MIDI device.
+type midiPort struct {
+	f *os.File
+}
+
+func openMIDIPort(device string) (*midiPort, error) {
+	if device == "" {
+		return nil, fmt.Errorf("MIDI port needs a device, e.g. port:/dev/snd/midiC1D0")
+	}
+	f, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open MIDI port: %w", err)
+	}
+	return &midiPort{f: f}, nil
+}
+
+func (p *midiPort) send(msg byte) error {
+	_, err := p.f.Write([]byte{msg})
+	return err
+}
+
+func (p *midiPort) close() error { return p.f.Close() }
+
+// AppleMIDI session protocol, which RTP-MIDI (RFC 6295) peers use to set
+// up a session on a control port and the data port after it.
+const (
+	appleMIDIVersion  = 2
+	appleMIDITimeout  = 3 * time.Second
+	appleMIDISyncEach = 10 * time.Second
+	rtpMIDIPayload    = 0x61
+)
+
+var (
+	appleMIDIInvite = [2]byte{'I', 'N'}
+	appleMIDIAccept = [2]byte{'O', 'K'}
+	appleMIDISync   = [2]byte{'C', 'K'}
+	appleMIDIBye    = [2]byte{'B', 'Y'}
+)
+
+// rtpMIDI is an RTP-MIDI session this server initiated. MIDI goes out in
+// RTP packets without a recovery journal; clock sync with the peer runs
+// every appleMIDISyncEach so it keeps the session open.
+type rtpMIDI struct {
+	control, data *net.UDPConn
+	token, ssrc   uint32
+	start         time.Time
+
+	mu  sync.Mutex
+	seq uint16
+}
+
+func openRTPMIDI(addr string) (*rtpMIDI, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("RTP-MIDI address %q: %v", addr, err)
+	}
+	ctlAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	dataAddr := &net.UDPAddr{IP: ctlAddr.IP, Port: ctlAddr.Port + 1, Zone: ctlAddr.Zone}
+	r := &rtpMIDI{token: rand.Uint32(), ssrc: rand.Uint32(), start: time.Now()}
+	if r.control, err = net.DialUDP("udp", nil, ctlAddr); err != nil {
+		return nil, err
+	}
+	if r.data, err = net.DialUDP("udp", nil, dataAddr); err != nil {
+		r.control.Close()
+		return nil, err
+	}
+	for _, c := range []*net.UDPConn{r.control, r.data} {
+		if err := r.invite(c); err != nil {
+			r.control.Close()
+			r.data.Close()
+			return nil, fmt.Errorf("RTP-MIDI session with %s: %w", addr, err)
+		}
+	}
+	slog.Info("midi: RTP-MIDI session", "peer", addr)
+	go r.syncLoop()
+	return r, nil
+}
+
+// session builds an AppleMIDI session packet.
+func (r *rtpMIDI) session(cmd [2]byte, name string) []byte {
+	b := []byte{0xff, 0xff, cmd[0], cmd[1]}
+	b = binary.BigEndian.AppendUint32(b, appleMIDIVersion)
+	b = binary.BigEndian.AppendUint32(b, r.token)
+	b = binary.BigEndian.AppendUint32(b, r.ssrc)
+	if name != "" {
+		b = append(append(b, name...), 0)
+	}
+	return b
+}
+
+// invite asks the peer on c to join the session and waits for it to
+// accept.
+func (r *rtpMIDI) invite(c *net.UDPConn) error {
+	if _, err := c.Write(r.session(appleMIDIInvite, "pulse")); err != nil {
+		return err
+	}
+	buf := make([]byte, 512)
+	_ = c.SetReadDeadline(time.Now().Add(appleMIDITimeout))
+	defer c.SetReadDeadline(time.Time{})
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return err
+		}
+		if n < 16 || buf[0] != 0xff || buf[1] != 0xff || binary.BigEndian.Uint32(buf[8:]) != r.token {
+			continue
+		}
+		switch [2]byte{buf[2], buf[3]} {
+		case appleMIDIAccept:
+			return nil
+		case [2]byte{'N', 'O'}:
+			return fmt.Errorf("invitation declined")
+		}
+	}
+}
+
+// now is the session clock, in the 100 µs units AppleMIDI uses.
+func (r *rtpMIDI) now() uint64 {
+	return uint64(time.Since(r.start) / (100 * time.Microsecond))
+}
+
+// syncLoop starts a clock sync every appleMIDISyncEach and completes the
+// exchanges the peer answers.
+func (r *rtpMIDI) syncLoop() {
+	go func() {
+		for range time.Tick(appleMIDISyncEach) {
+			r.sync(0, [3]uint64{r.now()})
+		}
+	}()
+	buf := make([]byte, 512)
+	for {
+		n, err := r.data.Read(buf)
+		if err != nil {
+			return
+		}
+		if n < 36 || !bytes.Equal(buf[:4], []byte{0xff, 0xff, 'C', 'K'}) || buf[8] != 1 {
+			continue
+		}
+		var ts [3]uint64
+		for i := range ts {
+			ts[i] = binary.BigEndian.Uint64(buf[12+8*i:])
+		}
+		ts[2] = r.now()
+		r.sync(2, ts)
+	}
+}
+
+func (r *rtpMIDI) sync(count byte, ts [3]uint64) {
+	b := []byte{0xff, 0xff, appleMIDISync[0], appleMIDISync[1]}
+	b = binary.BigEndian.AppendUint32(b, r.ssrc)
+	b = append(b, count, 0, 0, 0)
+	for _, t := range ts {
+		b = binary.BigEndian.AppendUint64(b, t)
+	}
+	_, _ = r.data.Write(b)
+}
+
+func (r *rtpMIDI) send(msg byte) error {
+	r.mu.Lock()
+	r.seq++
+	seq := r.seq
+	r.mu.Unlock()
+	b := []byte{0x80, rtpMIDIPayload}
+	b = binary.BigEndian.AppendUint16(b, seq)
+	b = binary.BigEndian.AppendUint32(b, uint32(r.now()))
+	b = binary.BigEndian.AppendUint32(b, r.ssrc)
+	b = append(b, 0x01, msg) // MIDI command section: no journal, one byte
+	_, err := r.data.Write(b)
+	return err
+}
+
+func (r *rtpMIDI) close() error {
+	_, _ = r.control.Write(r.session(appleMIDIBye, ""))
+	r.data.Close()
+	return r.control.Close()
+}
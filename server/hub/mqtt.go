@@ -0,0 +1,417 @@
+package hub
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// mqttPublisher publishes every pulse to an MQTT broker at QoS 0, for
+// devices already on MQTT (lighting controllers, embedded boards) that
+// have no WebSocket stack. The topic is a template in which {channel} is
+// the pulse's channel, and the payload the pulse as JSON, as clients get
+// it. It speaks just enough MQTT 3.1.1, or 5, to publish: CONNECT,
+// PUBLISH, PINGREQ and DISCONNECT. Under MQTT 5 every PUBLISH carries the
+// pulse's sink metadata as user properties (see sinkmeta.go) and its
+// content type. Like multicastSender it runs on its own
+// goroutine and drops what it cannot keep up with, including every pulse
+// while the broker is unreachable; a pulse delivered late is worse than
+// none, so nothing queued while disconnected is sent on reconnecting.
+type mqttPublisher struct {
+	addr     string
+	tls      *tls.Config
+	user     *url.Userinfo
+	clientID string
+	topic    string
+	// version is the protocol level: 4 for 3.1.1, or 5.
+	version byte
+	next    chan mqttPublish
+	done    chan struct{}
+	exited  chan struct{}
+}
+
+type mqttPublish struct {
+	topic   string
+	payload []byte
+	// attrs are the user properties, under MQTT 5.
+	attrs []sinkAttr
+}
+
+const (
+	// mqttBuffer is how many pulses wait to be published.
+	mqttBuffer = 64
+	// mqttKeepAlive is the keep alive the server asks the broker for; it
+	// pings that often.
+	mqttKeepAlive = 30 * time.Second
+	// mqttWriteTimeout bounds a write to the broker.
+	mqttWriteTimeout = 5 * time.Second
+	// mqttMaxBackoff caps the wait between connection attempts.
+	mqttMaxBackoff = 30 * time.Second
+)
+
+// MQTT control packet types, shifted into the first byte.
+const (
+	mqttConnect    = 1 << 4
+	mqttConnack    = 2 << 4
+	mqttPublishPkt = 3 << 4
+	mqttPingreq    = 12 << 4
+	mqttDisconnect = 14 << 4
+)
+
+// startMQTT publishes to the broker at raw, mqtt://[user:password@]host[:1883]
+// or mqtts:// for TLS (port 8883), under topic, speaking MQTT version 3
+// (3.1.1) or 5. An empty raw disables MQTT. The connection is made in the background, so a broker that is
+// down at startup does not stop the server.
+func startMQTT(raw, topic, clientID string, version int) (*mqttPublisher, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+	if version != 3 && version != 5 {
+		return nil, fmt.Errorf("version must be 3 or 5, not %d", version)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	m := &mqttPublisher{user: u.User, topic: topic, clientID: clientID, version: 4, next: make(chan mqttPublish, mqttBuffer), done: make(chan struct{}), exited: make(chan struct{})}
+	if version == 5 {
+		m.version = 5
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "mqtt", "tcp":
+		if port == "" {
+			port = "1883"
+		}
+	case "mqtts", "ssl":
+		if port == "" {
+			port = "8883"
+		}
+		m.tls = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	default:
+		return nil, fmt.Errorf("want an mqtt:// or mqtts:// URL, got %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("the URL has no host")
+	}
+	m.addr = net.JoinHostPort(u.Hostname(), port)
+	if err := validMQTTTopic(strings.ReplaceAll(topic, "{channel}", defaultChannel)); err != nil {
+		return nil, fmt.Errorf("topic %q: %w", topic, err)
+	}
+	if m.clientID == "" {
+		host, _ := os.Hostname()
+		m.clientID = fmt.Sprintf("pulse-%s-%d", host, os.Getpid())
+	}
+	if len(m.clientID) > 65535 {
+		return nil, errors.New("client ID too long")
+	}
+	slog.Info("mqtt: publishing pulses", "broker", m.addr, "topic", topic, "client_id", m.clientID, "version", version)
+	go m.run()
+	return m, nil
+}
+
+// validMQTTTopic rejects what a topic to publish to may not hold.
+func validMQTTTopic(t string) error {
+	switch {
+	case t == "":
+		return errors.New("empty")
+	case len(t) > 65535:
+		return errors.New("too long")
+	case strings.ContainsAny(t, "+#\x00"):
+		return errors.New("wildcards cannot be published to")
+	}
+	return nil
+}
+
+// send queues msg for the broker, with the attributes meta gives it under
+// MQTT 5. A nil mqttPublisher ignores it.
+func (m *mqttPublisher) send(msg PulseMessage, meta func(PulseMessage) []sinkAttr) {
+	if m == nil {
+		return
+	}
+	var attrs []sinkAttr
+	if m.version == 5 {
+		attrs = meta(msg)
+	}
+	topic := strings.ReplaceAll(m.topic, "{channel}", msg.Channel)
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error("mqtt: encode pulse", "err", err)
+		return
+	}
+	select {
+	case m.next <- mqttPublish{topic: topic, payload: payload, attrs: attrs}:
+	default:
+		connLog.log(slog.LevelWarn, "mqtt: publisher behind, pulse dropped", "seq", msg.Seq, "channel", msg.Channel)
+	}
+}
+
+// close disconnects from the broker, waiting at most mqttWriteTimeout. A
+// nil mqttPublisher ignores it.
+func (m *mqttPublisher) close() {
+	if m == nil {
+		return
+	}
+	close(m.done)
+	select {
+	case <-m.exited:
+	case <-time.After(mqttWriteTimeout):
+	}
+}
+
+// run connects to the broker, publishes until the connection fails, and
+// reconnects with exponential backoff until close.
+func (m *mqttPublisher) run() {
+	defer close(m.exited)
+	backoff := time.Second
+	for {
+		conn, err := m.connect()
+		if err != nil {
+			connLog.log(slog.LevelWarn, "mqtt: connect failed", "broker", m.addr, "err", err, "retry_in", backoff)
+			select {
+			case <-m.done:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, mqttMaxBackoff)
+			continue
+		}
+		backoff = time.Second
+		slog.Info("mqtt: connected", "broker", m.addr)
+		// Drop what was queued while disconnected; it is stale.
+		for len(m.next) > 0 {
+			<-m.next
+		}
+		err = m.publish(conn)
+		conn.Close()
+		if err == nil {
+			return
+		}
+		connLog.log(slog.LevelWarn, "mqtt: connection lost", "broker", m.addr, "err", err)
+	}
+}
+
+// connect dials the broker and completes the CONNECT handshake.
+func (m *mqttPublisher) connect() (net.Conn, error) {
+	d := net.Dialer{Timeout: mqttWriteTimeout}
+	var conn net.Conn
+	var err error
+	if m.tls != nil {
+		conn, err = tls.DialWithDialer(&d, "tcp", m.addr, m.tls)
+	} else {
+		conn, err = d.Dial("tcp", m.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Variable header: protocol name and level, flags, keep alive and,
+	// under MQTT 5, no properties. A clean session: the server subscribes
+	// to nothing.
+	body := appendMQTTString(nil, "MQTT")
+	flags := byte(0x02)
+	if m.user != nil {
+		flags |= 0x80
+		if _, ok := m.user.Password(); ok {
+			flags |= 0x40
+		}
+	}
+	body = append(body, m.version, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttKeepAlive/time.Second))
+	if m.version == 5 {
+		body = appendMQTTVarint(body, 0)
+	}
+	body = appendMQTTString(body, m.clientID)
+	if m.user != nil {
+		body = appendMQTTString(body, m.user.Username())
+		if pass, ok := m.user.Password(); ok {
+			body = appendMQTTString(body, pass)
+		}
+	}
+	conn.SetDeadline(time.Now().Add(mqttWriteTimeout))
+	if _, err := conn.Write(appendMQTTPacket(nil, mqttConnect, body)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	rd := bufio.NewReader(conn)
+	typ, ack, err := readMQTTPacket(rd)
+	if err == nil && (typ != mqttConnack || len(ack) < 2) {
+		err = fmt.Errorf("want CONNACK, got packet type %d", typ>>4)
+	}
+	if err == nil && ack[1] != 0 {
+		err = mqttConnackError(m.version, ack[1])
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// publish sends queued pulses over conn, and a ping every keep alive,
+// until close (nil) or the connection fails. It reads what the broker
+// sends, PINGRESP, to notice a broker that stopped answering; QoS 0
+// publishes get no answer, so it pings however busy the connection is.
+func (m *mqttPublisher) publish(conn net.Conn) error {
+	failed := make(chan error, 1)
+	go func() {
+		rd := bufio.NewReader(conn)
+		for {
+			conn.SetReadDeadline(time.Now().Add(mqttKeepAlive + mqttWriteTimeout))
+			if _, _, err := readMQTTPacket(rd); err != nil {
+				failed <- err
+				return
+			}
+		}
+	}()
+	ping := time.NewTicker(mqttKeepAlive)
+	defer ping.Stop()
+	write := func(b []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(mqttWriteTimeout))
+		_, err := conn.Write(b)
+		return err
+	}
+	for {
+		var err error
+		select {
+		case <-m.done:
+			write([]byte{mqttDisconnect, 0})
+			return nil
+		case err = <-failed:
+		case p := <-m.next:
+			body := appendMQTTString(nil, p.topic)
+			if m.version == 5 {
+				body = appendMQTTProperties(body, p.attrs)
+			}
+			err = write(appendMQTTPacket(nil, mqttPublishPkt, append(body, p.payload...)))
+		case <-ping.C:
+			err = write([]byte{mqttPingreq, 0})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// appendMQTTString appends s with its two-byte length.
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// appendMQTTPacket appends a packet of type typ: the fixed header, with
+// the remaining length as a variable-length integer, then body.
+func appendMQTTPacket(b []byte, typ byte, body []byte) []byte {
+	b = append(b, typ)
+	b = appendMQTTVarint(b, len(body))
+	return append(b, body...)
+}
+
+// appendMQTTVarint appends n as a variable-length integer, seven bits a
+// byte.
+func appendMQTTVarint(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		if n /= 128; n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+// MQTT 5 property identifiers.
+const (
+	mqttPropContentType  = 0x03
+	mqttPropUserProperty = 0x26
+)
+
+// appendMQTTProperties appends a PUBLISH's MQTT 5 properties: the JSON
+// content type and attrs as user properties.
+func appendMQTTProperties(b []byte, attrs []sinkAttr) []byte {
+	props := appendMQTTString([]byte{mqttPropContentType}, "application/json")
+	for _, a := range attrs {
+		props = appendMQTTString(appendMQTTString(append(props, mqttPropUserProperty), a.key), a.value)
+	}
+	b = appendMQTTVarint(b, len(props))
+	return append(b, props...)
+}
+
+// mqttMaxPacket bounds the packets read from the broker, which sends the
+// server nothing large.
+const mqttMaxPacket = 64 << 10
+
+// readMQTTPacket reads one packet, returning its type (the first byte's
+// upper nibble, in place) and body.
+func readMQTTPacket(rd *bufio.Reader) (byte, []byte, error) {
+	first, err := rd.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for {
+		c, err := rd.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(c&0x7f) << shift
+		if c&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+	}
+	if n > mqttMaxPacket {
+		return 0, nil, fmt.Errorf("packet of %d bytes", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(rd, body); err != nil {
+		return 0, nil, err
+	}
+	return first & 0xf0, body, nil
+}
+
+// mqttConnackError explains a CONNACK return code.
+func mqttConnackError(version, code byte) error {
+	if version == 5 {
+		// MQTT 5 reason codes; those a publisher meets.
+		reasons := map[byte]string{
+			0x84: "unsupported protocol version",
+			0x85: "client ID rejected",
+			0x86: "bad user name or password",
+			0x87: "not authorized",
+			0x88: "server unavailable",
+			0x89: "server busy",
+			0x8a: "banned",
+		}
+		if r, ok := reasons[code]; ok {
+			return fmt.Errorf("broker refused the connection: %s", r)
+		}
+		return fmt.Errorf("broker refused the connection: reason 0x%02x", code)
+	}
+	reasons := map[byte]string{
+		1: "unacceptable protocol version",
+		2: "client ID rejected",
+		3: "server unavailable",
+		4: "bad user name or password",
+		5: "not authorized",
+	}
+	if r, ok := reasons[code]; ok {
+		return fmt.Errorf("broker refused the connection: %s", r)
+	}
+	return fmt.Errorf("broker refused the connection: code %d", code)
+}
@@ -0,0 +1,116 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// multicastSender sends every pulse as one UDP datagram to a multicast
+// group, for LAN deployments where a datagram reaches every listener
+// sooner than a write per client over TCP. A datagram is the channel name,
+// prefixed by its length in one byte, followed by the pulse encoded as
+// pulse.v2+tagged. It runs on its own goroutine so the pulse loop never
+// waits on the network; a datagram it cannot keep up with is dropped, as
+// the network would.
+type multicastSender struct {
+	conn  *net.UDPConn
+	group *net.UDPAddr
+	next  chan []byte
+}
+
+// multicastBuffer is how many datagrams wait to be sent.
+const multicastBuffer = 64
+
+// startMulticast sends to group, host:port of a multicast address, out of
+// the interface named iface (the system's choice if empty), reaching ttl
+// router hops. An empty group disables multicast.
+func startMulticast(group, iface string, ttl int) (*multicastSender, error) {
+	group = strings.TrimSpace(group)
+	if group == "" {
+		return nil, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return nil, err
+	}
+	if !addr.IP.IsMulticast() {
+		return nil, fmt.Errorf("%s is not a multicast address", addr.IP)
+	}
+	if ttl < 1 || ttl > 255 {
+		return nil, fmt.Errorf("TTL must be in [1, 255]")
+	}
+	v4 := addr.IP.To4() != nil
+	network := "udp6"
+	if v4 {
+		network = "udp4"
+	}
+	// Unconnected, so every datagram is routed by the multicast options
+	// rather than by a route picked once at connect.
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	if iface != "" {
+		ifi, err := net.InterfaceByName(iface)
+		if err == nil {
+			err = setMulticastInterface(conn, ifi, v4)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("interface %s: %w", iface, err)
+		}
+	}
+	if err := setMulticastTTL(conn, ttl, v4); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("set TTL: %w", err)
+	}
+	m := &multicastSender{conn: conn, group: addr, next: make(chan []byte, multicastBuffer)}
+	slog.Info("multicast: sending pulses", "group", addr, "iface", iface, "ttl", ttl)
+	go m.run()
+	return m, nil
+}
+
+func setMulticastTTL(conn *net.UDPConn, ttl int, v4 bool) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if v4 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, ttl)
+		}
+	})
+	return errors.Join(err, serr)
+}
+
+// send queues msg for the group. A nil multicastSender ignores it.
+func (m *multicastSender) send(msg PulseMessage) {
+	if m == nil {
+		return
+	}
+	b, err := encodePulseDatagram(msg)
+	if err != nil {
+		slog.Error("multicast: encode pulse", "err", err)
+		return
+	}
+	select {
+	case m.next <- b:
+	default:
+		connLog.log(slog.LevelWarn, "multicast: sender behind, pulse dropped", "seq", msg.Seq, "channel", msg.Channel)
+	}
+}
+
+func (m *multicastSender) run() {
+	for b := range m.next {
+		if _, err := m.conn.WriteToUDP(b, m.group); err != nil {
+			connLog.log(slog.LevelWarn, "multicast send failed", "group", m.group, "err", err)
+		}
+	}
+}
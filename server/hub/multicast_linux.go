@@ -0,0 +1,25 @@
+package hub
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// setMulticastInterface sends conn's multicast datagrams out of ifi, by
+// index, with IP_MULTICAST_IF or IPV6_MULTICAST_IF.
+func setMulticastInterface(conn *net.UDPConn, ifi *net.Interface, v4 bool) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if v4 {
+			serr = syscall.SetsockoptIPMreqn(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, &syscall.IPMreqn{Ifindex: int32(ifi.Index)})
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, ifi.Index)
+		}
+	})
+	return errors.Join(err, serr)
+}
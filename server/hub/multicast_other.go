@@ -0,0 +1,47 @@
+//go:build !linux
+
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// setMulticastInterface sends conn's multicast datagrams out of ifi with
+// IP_MULTICAST_IF or IPV6_MULTICAST_IF. IPv6 takes the interface index;
+// outside Linux IPv4 takes one of the interface's addresses instead.
+func setMulticastInterface(conn *net.UDPConn, ifi *net.Interface, v4 bool) error {
+	var addr [4]byte
+	if v4 {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				copy(addr[:], ipnet.IP.To4())
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("no IPv4 address for the group")
+		}
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if v4 {
+			serr = syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, addr)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, ifi.Index)
+		}
+	})
+	return errors.Join(err, serr)
+}
@@ -0,0 +1,71 @@
+package hub
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"pulse/ws"
+)
+
+// originPolicy decides which browser origins may open WebSockets. Browsers
+// let any page connect to any server, so without it every website a user
+// visits could follow, and with controller credentials drive, our
+// channels. Requests without an Origin header come from other clients than
+// browsers and are always allowed, as are same-origin requests.
+type originPolicy struct {
+	// any allows every origin; only set when PULSE_ALLOWED_ORIGINS says *.
+	any bool
+	// patterns match either a whole origin ("https://*.example.com") or,
+	// without a scheme, its host and port ("example.com", "*.local:8080").
+	patterns []string
+}
+
+// parseOriginPolicy parses comma-separated origin patterns, where * in a
+// pattern matches any run of characters and a lone * allows any origin.
+func parseOriginPolicy(raw string) (originPolicy, error) {
+	var p originPolicy
+	for _, entry := range ws.SplitHeaderList(raw) {
+		entry = strings.ToLower(strings.TrimSuffix(entry, "/"))
+		if entry == "*" {
+			p.any = true
+			continue
+		}
+		if scheme, host, ok := strings.Cut(entry, "://"); ok && (scheme == "" || host == "" || strings.Contains(host, "/")) {
+			return originPolicy{}, fmt.Errorf("invalid origin %q (want scheme://host[:port] or host[:port])", entry)
+		}
+		if _, err := path.Match(entry, ""); err != nil {
+			return originPolicy{}, fmt.Errorf("invalid origin %q: %v", entry, err)
+		}
+		p.patterns = append(p.patterns, entry)
+	}
+	return p, nil
+}
+
+// allow reports whether r may be upgraded.
+func (p originPolicy) allow(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || p.any {
+		return true
+	}
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		// Includes "null", sent by sandboxed frames and file:// pages.
+		return false
+	}
+	if u.Host == strings.ToLower(r.Host) {
+		return true
+	}
+	for _, pat := range p.patterns {
+		subject := u.Host
+		if strings.Contains(pat, "://") {
+			subject = u.Scheme + "://" + u.Host
+		}
+		if ok, _ := path.Match(pat, subject); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package hub
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"pulse/clock"
+	"pulse/ws"
+)
+
+// oscSender sends every pulse of the default channel to OSC (Open Sound
+// Control 1.0) targets over UDP, for audio and visual tools that speak OSC
+// but not WebSocket. Each pulse is a bundle time-tagged with next_ms holding
+// one message, by default
+//
+//	/pulse ,hihh seq period_ms now_ms next_ms
+//
+// so receivers that honour time tags act on the next pulse exactly and the
+// rest can read next_ms. It runs on its own goroutine so the pulse loop
+// never waits on the network.
+type oscSender struct {
+	conn    net.PacketConn
+	targets []*net.UDPAddr
+	address string
+	next    chan oscPulse
+}
+
+type oscPulse struct {
+	seq      uint64
+	period   time.Duration
+	now      time.Time
+	nextTime time.Time
+}
+
+// startOSC resolves the comma-separated host:port targets and starts
+// sending to them. No targets disables OSC.
+func startOSC(targets, address string) (*oscSender, error) {
+	entries := ws.SplitHeaderList(targets)
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	if !strings.HasPrefix(address, "/") || strings.ContainsAny(address, " #*,?[]{}") {
+		return nil, fmt.Errorf("OSC address %q must start with / and contain no spaces or pattern characters", address)
+	}
+	o := &oscSender{address: address, next: make(chan oscPulse, 1)}
+	for _, t := range entries {
+		addr, err := net.ResolveUDPAddr("udp", t)
+		if err != nil {
+			return nil, fmt.Errorf("OSC target %q: %v", t, err)
+		}
+		o.targets = append(o.targets, addr)
+	}
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	o.conn = conn
+	slog.Info("osc: sending", "address", address, "targets", entries)
+	go o.run()
+	return o, nil
+}
+
+// send queues a pulse, replacing one not yet sent. A nil oscSender ignores
+// it.
+func (o *oscSender) send(seq uint64, period time.Duration, now, next time.Time) {
+	if o == nil {
+		return
+	}
+	select {
+	case <-o.next:
+	default:
+	}
+	o.next <- oscPulse{seq, period, now, next}
+}
+
+func (o *oscSender) run() {
+	for p := range o.next {
+		b := o.bundle(p)
+		for _, t := range o.targets {
+			if _, err := o.conn.WriteTo(b, t); err != nil {
+				connLog.log(slog.LevelWarn, "osc send failed", "target", t, "err", err)
+			}
+		}
+	}
+}
+
+// bundle encodes p as an OSC bundle time-tagged with its next pulse.
+func (o *oscSender) bundle(p oscPulse) []byte {
+	msg := oscString(nil, o.address)
+	msg = oscString(msg, ",hihh")
+	msg = binary.BigEndian.AppendUint64(msg, p.seq)
+	msg = binary.BigEndian.AppendUint32(msg, uint32(p.period.Milliseconds()))
+	msg = binary.BigEndian.AppendUint64(msg, uint64(p.now.UnixMilli()))
+	msg = binary.BigEndian.AppendUint64(msg, uint64(p.nextTime.UnixMilli()))
+
+	b := oscString(nil, "#bundle")
+	b = binary.BigEndian.AppendUint64(b, clock.NTPTime(p.nextTime)) // OSC time tags are NTP timestamps
+	b = binary.BigEndian.AppendUint32(b, uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// oscString appends s NUL-terminated and padded to a multiple of 4 bytes.
+func oscString(b []byte, s string) []byte {
+	b = append(b, s...)
+	return append(b, make([]byte, 4-len(s)%4)...)
+}
@@ -0,0 +1,226 @@
+package hub
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Limits on pace programs, generous for any real workout.
+const (
+	maxPaceIntervals = 100
+	maxPaceRepeat    = 100
+	maxPaceSPM       = 400
+)
+
+// paceInterval is one block of a workout: duration at a cadence in steps
+// (or strides, strokes, …) per minute. SPM 0 is rest.
+type paceInterval struct {
+	DurationMS int64   `json:"duration_ms"`
+	SPM        float64 `json:"spm"`
+	Label      string  `json:"label,omitempty"`
+}
+
+// paceProgram is an interval program, run Repeat times (once if 0):
+// POST /admin/pace {"intervals":[{"duration_ms":30000,"spm":180},
+// {"duration_ms":60000,"spm":0,"label":"rest"}],"repeat":4}.
+type paceProgram struct {
+	Intervals []paceInterval `json:"intervals"`
+	Repeat    int            `json:"repeat,omitempty"`
+}
+
+func (p paceProgram) validate() error {
+	if len(p.Intervals) == 0 || len(p.Intervals) > maxPaceIntervals {
+		return fmt.Errorf("intervals must have 1 to %d entries", maxPaceIntervals)
+	}
+	if p.Repeat < 0 || p.Repeat > maxPaceRepeat {
+		return fmt.Errorf("repeat must be in [0, %d]", maxPaceRepeat)
+	}
+	for i, iv := range p.Intervals {
+		if iv.DurationMS <= 0 || iv.DurationMS > maxRoundLength.Milliseconds() {
+			return fmt.Errorf("interval %d: duration_ms must be in (0, %d]", i, maxRoundLength.Milliseconds())
+		}
+		if iv.SPM < 0 || iv.SPM > maxPaceSPM {
+			return fmt.Errorf("interval %d: spm must be in [0, %d]", i, maxPaceSPM)
+		}
+	}
+	return nil
+}
+
+func (p paceProgram) rounds() int {
+	return max(p.Repeat, 1)
+}
+
+// paceState is where a running program is at one instant. Steps fall on
+// started_ms + k*step_ms; phase is how far into the current step that
+// instant is, from 0 to 1.
+type paceState struct {
+	Running   bool    `json:"running"`
+	Interval  int     `json:"interval"`  // index into the program's intervals
+	Round     int     `json:"round"`     // 0-based repetition of the program
+	Intervals int     `json:"intervals"` // intervals per repetition
+	Rounds    int     `json:"rounds"`
+	SPM       float64 `json:"spm"`
+	StepMS    float64 `json:"step_ms"` // 0 while resting
+	Phase     float64 `json:"phase"`
+	Label     string  `json:"label,omitempty"`
+	StartedMS int64   `json:"started_ms"` // start of the current interval
+	EndsMS    int64   `json:"ends_ms"`
+}
+
+// paceMessage is broadcast when a program moves to its next interval
+// ("pace_interval") and when it is over ("pace_end").
+type paceMessage struct {
+	Type string `json:"type"`
+	paceState
+	Cancelled bool `json:"cancelled,omitempty"`
+}
+
+// pacer runs pace-setting programs for coached workouts: every pulse while
+// one runs carries the cadence and step phase, and interval changes are
+// announced as they happen.
+type pacer struct {
+	h *Hub
+
+	mu      sync.Mutex
+	prog    paceProgram
+	start   time.Time
+	running bool
+	gen     int // bumped on every start and cancel to orphan old timers
+	timer   *time.Timer
+}
+
+func newPacer(h *Hub) *pacer {
+	return &pacer{h: h}
+}
+
+// locate returns the state of the program at t and when the interval it
+// falls in ends. ok is false once the program is over. The caller holds
+// p.mu.
+func (p *pacer) locate(t time.Time) (st paceState, end time.Time, ok bool) {
+	ivStart := p.start
+	for round := 0; round < p.prog.rounds(); round++ {
+		for i, iv := range p.prog.Intervals {
+			end = ivStart.Add(time.Duration(iv.DurationMS) * time.Millisecond)
+			if t.Before(end) {
+				st = paceState{
+					Running:   true,
+					Interval:  i,
+					Round:     round,
+					Intervals: len(p.prog.Intervals),
+					Rounds:    p.prog.rounds(),
+					SPM:       iv.SPM,
+					Label:     iv.Label,
+					StartedMS: ivStart.UnixMilli(),
+					EndsMS:    end.UnixMilli(),
+				}
+				if iv.SPM > 0 {
+					st.StepMS = 60000 / iv.SPM
+					elapsed := float64(t.Sub(ivStart)) / float64(time.Millisecond)
+					st.Phase = math.Round(math.Mod(max(elapsed, 0), st.StepMS)/st.StepMS*1e4) / 1e4
+				}
+				return st, end, true
+			}
+			ivStart = end
+		}
+	}
+	return paceState{Intervals: len(p.prog.Intervals), Rounds: p.prog.rounds()}, end, false
+}
+
+// begin starts prog now, replacing any program still running.
+func (p *pacer) begin(prog paceProgram) (paceState, error) {
+	if err := prog.validate(); err != nil {
+		return paceState{}, err
+	}
+	p.mu.Lock()
+	replaced := p.stop()
+	p.prog, p.start, p.running = prog, p.h.clock.Now(), true
+	st, end, _ := p.locate(p.start)
+	p.schedule(end)
+	p.mu.Unlock()
+
+	if replaced {
+		p.h.Broadcast(paceMessage{Type: "pace_end", Cancelled: true})
+	}
+	p.h.Broadcast(paceMessage{Type: "pace_interval", paceState: st})
+	return st, nil
+}
+
+// cancel stops the running program. It reports false if none was running.
+func (p *pacer) cancel() bool {
+	p.mu.Lock()
+	stopped := p.stop()
+	p.mu.Unlock()
+	if stopped {
+		p.h.Broadcast(paceMessage{Type: "pace_end", Cancelled: true})
+	}
+	return stopped
+}
+
+// stop halts the running program, if any. The caller holds p.mu.
+func (p *pacer) stop() bool {
+	if !p.running {
+		return false
+	}
+	p.timer.Stop()
+	p.running = false
+	p.gen++
+	return true
+}
+
+// schedule arms the timer for the interval boundary at end. The caller
+// holds p.mu.
+func (p *pacer) schedule(end time.Time) {
+	gen := p.gen
+	p.timer = time.AfterFunc(end.Sub(p.h.clock.Now()), func() { p.advance(gen) })
+}
+
+// advance announces the interval that starts at a boundary, or the end of
+// the program.
+func (p *pacer) advance(gen int) {
+	p.mu.Lock()
+	if !p.running || p.gen != gen {
+		p.mu.Unlock()
+		return
+	}
+	st, end, ok := p.locate(p.h.clock.Now())
+	msg := paceMessage{Type: "pace_interval", paceState: st}
+	if ok {
+		p.schedule(end)
+	} else {
+		p.running = false
+		msg.Type = "pace_end"
+	}
+	p.mu.Unlock()
+	p.h.Broadcast(msg)
+}
+
+// enrich is registered as a pulse enricher: pulses carry the pace as of
+// their now_ms while a program runs.
+func (p *pacer) enrich(msg PulseMessage) map[string]any {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.running {
+		return nil
+	}
+	st, _, ok := p.locate(time.UnixMilli(msg.NowMS))
+	if !ok {
+		return nil
+	}
+	return map[string]any{"pace": st}
+}
+
+// handler serves GET /api/pace.
+func (p *pacer) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		p.mu.Lock()
+		st := paceState{}
+		if p.running {
+			st, _, _ = p.locate(p.h.clock.Now())
+		}
+		p.mu.Unlock()
+		writeJSON(w, http.StatusOK, st)
+	}
+}
@@ -0,0 +1,165 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"pulse/ws"
+)
+
+// Patterns make a channel's pulses uneven, for music that does not go
+// straight: PULSE_PATTERNS gives channels a repeating sequence of steps as
+// "channel:pattern" entries, the pattern either a swing percentage, e.g.
+// "song:swing=66" for pairs of steps split 66/34, or the steps' relative
+// lengths, e.g. "clave:3-3-2" or "shuffle:2-1" for long-short. A pattern
+// spans as many periods as it has steps, so the tempo, the bars and where
+// a pattern starts stay on the straight grid, and the pattern follows the
+// period when it changes. It starts over on every downbeat of a channel
+// with a tempo.
+//
+// Each pulse goes out on its step and carries the step, counted from 0,
+// the pattern's steps and swing_ms, how far it was moved off the straight
+// grid; next_ms and at_ms are its own, while period_ms is still the
+// channel's straight period.
+
+// maxPatternSteps bounds a pattern's length.
+const maxPatternSteps = 64
+
+// pulsePattern is a channel's repeating sequence of steps.
+type pulsePattern struct {
+	// lengths are the steps' lengths in periods; they add up to as many
+	// periods as there are steps.
+	lengths []float64
+	// offsets are how far each step falls off the straight grid, in
+	// periods.
+	offsets []float64
+}
+
+// parsePattern parses "swing=P", P a percentage in (0, 100), or relative
+// step lengths separated by "-", e.g. "3-3-2".
+func parsePattern(raw string) (*pulsePattern, error) {
+	raw = strings.TrimSpace(raw)
+	var weights []float64
+	if pct, ok := strings.CutPrefix(raw, "swing="); ok {
+		p, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(pct), "%"), 64)
+		if err != nil || !(p > 0 && p < 100) {
+			return nil, fmt.Errorf("invalid swing %q: want a percentage between 0 and 100, e.g. swing=66", pct)
+		}
+		weights = []float64{p, 100 - p}
+	} else {
+		parts := strings.Split(raw, "-")
+		if len(parts) < 2 || len(parts) > maxPatternSteps {
+			return nil, fmt.Errorf("invalid pattern %q: want swing=P or 2 to %d step lengths, e.g. 2-1", raw, maxPatternSteps)
+		}
+		for _, part := range parts {
+			w, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil || !(w > 0) || math.IsInf(w, 0) {
+				return nil, fmt.Errorf("invalid pattern %q: step lengths must be positive numbers", raw)
+			}
+			weights = append(weights, w)
+		}
+	}
+	var sum float64
+	for _, w := range weights {
+		sum += w
+	}
+	p := &pulsePattern{lengths: make([]float64, len(weights)), offsets: make([]float64, len(weights))}
+	var at float64
+	for k, w := range weights {
+		p.offsets[k] = at - float64(k)
+		p.lengths[k] = w / sum * float64(len(weights))
+		at += p.lengths[k]
+	}
+	return p, nil
+}
+
+// applyPatterns sets the patterns in raw, comma-separated "channel:pattern"
+// entries, on chans. It runs after applySimulcast: a channel's slower
+// rates must span whole patterns, so their pulses are all on one step.
+func applyPatterns(raw string, chans map[string]*pulseChannel) error {
+	for _, entry := range ws.SplitHeaderList(raw) {
+		name, spec, ok := strings.Cut(entry, ":")
+		if !ok {
+			return fmt.Errorf("invalid entry %q, want channel:pattern", entry)
+		}
+		ch := chans[strings.TrimSpace(name)]
+		if ch == nil {
+			return fmt.Errorf("unknown channel %q", name)
+		}
+		if ch.pattern != nil {
+			return fmt.Errorf("channel %q: pattern given twice", ch.name)
+		}
+		p, err := parsePattern(spec)
+		if err != nil {
+			return fmt.Errorf("channel %q: %w", ch.name, err)
+		}
+		if shortest := p.shortest(ch.Period()); shortest < minChannelPeriod {
+			return fmt.Errorf("channel %q: shortest step is %s, under %s", ch.name, shortest, minChannelPeriod)
+		}
+		for _, v := range ch.simulcast {
+			if v.every%uint64(len(p.lengths)) != 0 {
+				return fmt.Errorf("channel %q: rate %d is not a multiple of the pattern's %d steps", ch.name, v.every, len(p.lengths))
+			}
+		}
+		ch.pattern = p
+	}
+	return nil
+}
+
+// shortest is p's shortest step at period.
+func (p *pulsePattern) shortest(period time.Duration) time.Duration {
+	return time.Duration(float64(period) * slices.Min(p.lengths))
+}
+
+// swing returns the step of the pattern pulse seq of ch falls on and how
+// far that moves it off the straight grid of period; 0 and 0 without a
+// pattern.
+func (ch *pulseChannel) swing(seq uint64, period time.Duration) (int, time.Duration) {
+	p := ch.pattern
+	if p == nil {
+		return 0, 0
+	}
+	var origin uint64
+	if ch.tempo != nil {
+		origin = ch.tempo.barSeq.Load()
+	}
+	step := int((seq - origin) % uint64(len(p.lengths)))
+	return step, time.Duration(p.offsets[step] * float64(period)).Round(time.Microsecond)
+}
+
+// info describes p for a hello: its steps' lengths in periods, rounded to
+// 1/1000; nil without a pattern.
+func (p *pulsePattern) info() []float64 {
+	if p == nil {
+		return nil
+	}
+	lengths := make([]float64, len(p.lengths))
+	for k, l := range p.lengths {
+		lengths[k] = math.Round(l*1000) / 1000
+	}
+	return lengths
+}
+
+// fields are what p adds to a pulse on step that it moved by swing.
+func (p *pulsePattern) fields(step int, swing time.Duration) map[string]json.RawMessage {
+	fields := make(map[string]json.RawMessage, 3)
+	fields["step"], _ = json.Marshal(step)
+	fields["steps"], _ = json.Marshal(len(p.lengths))
+	fields["swing_ms"], _ = json.Marshal(msFloat(swing))
+	return fields
+}
+
+// pulseSwing is how far msg was moved off the straight grid by a pattern,
+// as its swing_ms says; 0 if it was not.
+func pulseSwing(msg PulseMessage) time.Duration {
+	var ms float64
+	if raw, ok := msg.Extra["swing_ms"]; ok {
+		_ = json.Unmarshal(raw, &ms)
+	}
+	return time.Duration(ms * float64(time.Millisecond)).Round(time.Microsecond)
+}
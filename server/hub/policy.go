@@ -0,0 +1,117 @@
+package hub
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// admissionPolicy decides at upgrade time whether a connection is accepted,
+// rejected or moved to another channel, from PULSE_ADMISSION_RULES such as
+//
+//	reject if ip == 203.0.113.0/24; route tick if header.X-Client == game; reject if clients >= 5000 && tenant == free
+//
+// Rules are separated by ; and tried in order; the first whose condition
+// holds decides, and a connection no rule matches is accepted. A rule is
+// accept, reject or route <channel>, optionally followed by if and a filter
+// in the bulk filter syntax (see filter.go) over admissionFields,
+// header.<Name> and identity.<field>.
+type admissionPolicy []admissionRule
+
+type admissionRule struct {
+	action  string
+	channel string
+	cond    []filterClause
+	text    string
+}
+
+// admissionFields maps each field a rule can test to whether it compares
+// numerically. channel is the channel the client asked for and clients
+// the number already connected.
+var admissionFields = map[string]bool{
+	"ip":      false,
+	"tenant":  false,
+	"channel": false,
+	"clients": true,
+}
+
+// admissionRequest is what rules see of an upgrade request.
+type admissionRequest struct {
+	ip, tenant, channel string
+	header              http.Header
+	identity            map[string]string
+	clients             int
+}
+
+func parseAdmissionPolicy(raw string, channels map[string]*pulseChannel) (admissionPolicy, error) {
+	var p admissionPolicy
+	for _, text := range strings.Split(raw, ";") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		rule := admissionRule{text: text}
+		head, cond, hasCond := strings.Cut(text, " if ")
+		fields := strings.Fields(head)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("rule %q has no action", text)
+		}
+		rule.action = fields[0]
+		switch {
+		case rule.action == "route" && len(fields) == 2:
+			rule.channel = fields[1]
+			if channels[rule.channel] == nil {
+				return nil, fmt.Errorf("rule %q: unknown channel %q", text, rule.channel)
+			}
+		case (rule.action == "accept" || rule.action == "reject") && len(fields) == 1:
+		default:
+			return nil, fmt.Errorf("rule %q: want accept, reject or route <channel>", text)
+		}
+		if hasCond {
+			var err error
+			if rule.cond, err = parseFilter(cond, admissionFields, "header."); err != nil {
+				return nil, fmt.Errorf("rule %q: %v", text, err)
+			}
+			if len(rule.cond) == 0 {
+				return nil, fmt.Errorf("rule %q: empty condition", text)
+			}
+		}
+		p = append(p, rule)
+	}
+	return p, nil
+}
+
+// decide returns the first rule matching req, or nil to accept it.
+func (p admissionPolicy) decide(req admissionRequest) *admissionRule {
+	for i := range p {
+		if p[i].matches(req) {
+			return &p[i]
+		}
+	}
+	return nil
+}
+
+func (rule admissionRule) matches(req admissionRequest) bool {
+	for _, cl := range rule.cond {
+		var s string
+		var n float64
+		switch {
+		case cl.field == "ip":
+			s = req.ip
+		case cl.field == "tenant":
+			s = req.tenant
+		case cl.field == "channel":
+			s = req.channel
+		case cl.field == "clients":
+			n = float64(req.clients)
+		case strings.HasPrefix(cl.field, "header."):
+			s = req.header.Get(strings.TrimPrefix(cl.field, "header."))
+		default:
+			s = req.identity[strings.TrimPrefix(cl.field, "identity.")]
+		}
+		if !cl.compare(s, n) {
+			return false
+		}
+	}
+	return true
+}
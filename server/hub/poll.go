@@ -0,0 +1,125 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Long polling is for clients that cannot hold a connection open at all:
+// serverless functions, curl in a shell loop, old webviews. GET /poll
+// waits for the channel's next pulse and returns it, and with since_seq
+// returns every pulse after that seq still kept, at once if there are
+// any, so a client that passes the seq it last saw misses nothing between
+// polls that backfill still has.
+
+const (
+	// defaultPollTimeout is how long a poll waits for a pulse, under the
+	// idle timeouts of common proxies.
+	defaultPollTimeout = 25 * time.Second
+	maxPollTimeout     = 60 * time.Second
+)
+
+// poll returns the pulses after seq, or a channel closed once another
+// pulse has been added if seq is the latest. A seq past the latest, from
+// before a transport reset, gets the latest pulse.
+func (r *pulseRing) poll(channel string, seq uint64, micros bool) (backfillMessage, <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.latest == nil || r.latest.seq == seq {
+		if r.changed == nil {
+			r.changed = make(chan struct{})
+		}
+		return backfillMessage{}, r.changed
+	}
+	m := r.sinceLocked(channel, seq, micros)
+	if len(m.Pulses) == 0 {
+		// Backfill is off, or seq is from before a reset: the latest
+		// pulse is all there is.
+		oldest := r.latest.seq
+		m.OldestSeq, m.Complete = &oldest, oldest == seq+1
+		m.Pulses = []json.RawMessage{r.latest.encoded(micros)}
+	}
+	return m, nil
+}
+
+// latestSeq is the seq of the last pulse added, 0 before the first.
+func (r *pulseRing) latestSeq() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.latest == nil {
+		return 0
+	}
+	return r.latest.seq
+}
+
+// pollHandler serves
+// GET /poll?channel=NAME&since_seq=N&timeout_ms=T&precision=P. The answer
+// is a backfill message of the pulses after since_seq (the latest pulse if
+// since_seq is omitted), or 204 if none came within the timeout.
+// Subscriber credentials and allowed origins apply as on /ws.
+func pollHandler(h *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		name := q.Get("channel")
+		if name == "" {
+			name = defaultChannel
+		}
+		ch := h.channel(name)
+		if ch == nil {
+			http.Error(w, fmt.Sprintf("unknown channel %q", name), http.StatusNotFound)
+			return
+		}
+		since := ch.recent.latestSeq()
+		if raw := q.Get("since_seq"); raw != "" {
+			var err error
+			if since, err = strconv.ParseUint(raw, 10, 64); err != nil {
+				http.Error(w, "since_seq must be a seq", http.StatusBadRequest)
+				return
+			}
+		}
+		timeout := defaultPollTimeout
+		if raw := q.Get("timeout_ms"); raw != "" {
+			ms, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || ms < 0 || time.Duration(ms)*time.Millisecond > maxPollTimeout {
+				http.Error(w, fmt.Sprintf("timeout_ms must be in [0, %d]", maxPollTimeout.Milliseconds()), http.StatusBadRequest)
+				return
+			}
+			timeout = time.Duration(ms) * time.Millisecond
+		}
+		micros, err := parsePrecision(q.Get("precision"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !h.origins.allow(r) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		if _, err := h.subscribers.authenticate(r, h.auth); err != nil {
+			rejectUnauthenticated(w, r, err)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for {
+			m, changed := ch.recent.poll(ch.name, since, micros)
+			if changed == nil {
+				writeJSON(w, http.StatusOK, m)
+				return
+			}
+			select {
+			case <-changed:
+			case <-timer.C:
+				w.WriteHeader(http.StatusNoContent)
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package hub
+
+import (
+	"fmt"
+	"time"
+)
+
+// Microsecond precision is for clients that sync audio: a millisecond is
+// an audible flam. A client that connects with ?precision=us, or sends
+// {"type":"set_precision","precision":"us"}, gets period_us, now_us,
+// next_us and, with send_ahead, at_us in every pulse beside the
+// millisecond fields, computed from the scheduler's nanosecond times
+// rather than scaled up from the rounded ones. Others get pulses as
+// before; {"type":"set_precision","precision":"ms"} goes back to them.
+// Relay connections always get the microsecond fields, so an edge or
+// downstream server keeps the exact period. There is no nanosecond
+// variant: Unix nanoseconds do not fit a JavaScript number, and no
+// network delivers a pulse to better than a microsecond anyway.
+
+// setPrecisionMessage sets the connection's timestamp precision.
+type setPrecisionMessage struct {
+	Type      string `json:"type"`
+	Precision string `json:"precision"`
+}
+
+// precisionMicros is the precision that adds the microsecond fields.
+const precisionMicros = "us"
+
+// parsePrecision parses a client's precision, reporting whether it wants
+// microseconds; empty means milliseconds.
+func parsePrecision(s string) (bool, error) {
+	switch s {
+	case "", "ms":
+		return false, nil
+	case precisionMicros:
+		return true, nil
+	}
+	return false, fmt.Errorf("precision must be ms or us, not %q", s)
+}
+
+// setPrecision switches c's pulses to precision.
+func (h *Hub) setPrecision(c *Conn, precision string) error {
+	micros, err := parsePrecision(precision)
+	if err != nil {
+		return err
+	}
+	if c.proto == protoRelay {
+		return fmt.Errorf("relay connections always receive microseconds")
+	}
+	c.micros.Store(micros)
+	return c.WriteJSON(h.subscriptions(c, ""))
+}
+
+// wantsMicros reports whether c gets the microsecond fields.
+func (c *Conn) wantsMicros() bool {
+	return c.proto == protoRelay || c.micros.Load()
+}
+
+// precision is c's precision as hello and subscriptions name it; empty
+// for milliseconds.
+func (c *Conn) precision() string {
+	if c.micros.Load() {
+		return precisionMicros
+	}
+	return ""
+}
+
+// setMicros sets msg's microsecond fields from the times its millisecond
+// fields were taken from; at is zero unless the pulse was sent ahead.
+func (msg *PulseMessage) setMicros(now, next, at time.Time, interval time.Duration) {
+	msg.PeriodUS = interval.Microseconds()
+	msg.NowUS = now.UnixMicro()
+	msg.NextUS = next.UnixMicro()
+	if !at.IsZero() {
+		msg.AtUS = at.UnixMicro()
+	}
+}
+
+// withoutMicros is msg as a client without microsecond precision gets it.
+func (msg PulseMessage) withoutMicros() PulseMessage {
+	msg.PeriodUS, msg.NowUS, msg.NextUS, msg.AtUS = 0, 0, 0, 0
+	return msg
+}
+
+// unixTime is the time given by a field in Unix milliseconds and its
+// microsecond counterpart, exactly if that is set.
+func unixTime(ms, us int64) time.Time {
+	if us != 0 {
+		return time.UnixMicro(us)
+	}
+	return time.UnixMilli(ms)
+}
+
+// period is the interval msg announces, exactly if it has period_us.
+func (msg PulseMessage) period() time.Duration {
+	if msg.PeriodUS > 0 {
+		return time.Duration(msg.PeriodUS) * time.Microsecond
+	}
+	return time.Duration(msg.PeriodMS) * time.Millisecond
+}
@@ -0,0 +1,92 @@
+package hub
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"pulse/ws"
+)
+
+// A pre-roll counts a channel in: PULSE_PREROLL gives channels a count as
+// "channel:count" entries, e.g. "song:4", and whenever the channel's pulses
+// start, when the server starts it, on a reset and on a resume after a
+// pause, that many preroll messages go out on the grid slots before the
+// first pulse, so musicians and synced devices get a lead-in rather than
+// coming in mid-phase. Counts go down to 1, the slot before the pulse; seq
+// does not move, so the first pulse after a count-in of a fresh channel is
+// still seq 0. A channel carried on from another process after an upgrade
+// or a failover is not counted in again.
+//
+// Pre-rolls fall on the straight grid, go out as early as the channel's
+// pulses with send_ahead and are for v2 clients only, like transport
+// messages.
+
+// maxPreroll bounds a count-in.
+const maxPreroll = 16
+
+// prerollMessage is one count of a count-in: the pulse seq is due at
+// next_ms, count periods after this count falls at at_ms.
+type prerollMessage struct {
+	Type     string `json:"type"`
+	Channel  string `json:"channel"`
+	Count    int    `json:"count"`
+	Seq      uint64 `json:"seq"`
+	NowMS    int64  `json:"now_ms"`
+	AtMS     int64  `json:"at_ms"`
+	NextMS   int64  `json:"next_ms"`
+	PeriodMS int64  `json:"period_ms"`
+}
+
+// applyPrerolls sets the counts in raw, comma-separated "channel:count"
+// entries, on chans.
+func applyPrerolls(raw string, chans map[string]*pulseChannel) error {
+	for _, entry := range ws.SplitHeaderList(raw) {
+		name, count, ok := strings.Cut(entry, ":")
+		if !ok {
+			return fmt.Errorf("invalid entry %q, want channel:count", entry)
+		}
+		ch := chans[strings.TrimSpace(name)]
+		if ch == nil {
+			return fmt.Errorf("unknown channel %q", name)
+		}
+		if ch.preroll != 0 {
+			return fmt.Errorf("channel %q: count given twice", ch.name)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil || n < 1 || n > maxPreroll {
+			return fmt.Errorf("channel %q: invalid count %q, want 1 to %d", ch.name, count, maxPreroll)
+		}
+		ch.preroll = n
+	}
+	return nil
+}
+
+// announcePreroll sends count of ch's count-in, falling at beat; seq is
+// the pulse it leads into, due at next.
+func (h *Hub) announcePreroll(ch *pulseChannel, count int, seq uint64, beat, next time.Time, period time.Duration) {
+	now := h.clock.Now()
+	offset := h.offset()
+	msg := prerollMessage{
+		Type:     "preroll",
+		Channel:  ch.name,
+		Count:    count,
+		Seq:      seq,
+		NowMS:    now.UnixMilli(),
+		AtMS:     now.Add(beat.Sub(now) + offset).UnixMilli(),
+		NextMS:   now.Add(next.Sub(now) + offset).UnixMilli(),
+		PeriodMS: period.Milliseconds(),
+	}
+	slog.Debug("preroll", "channel", ch.name, "count", count, "seq", seq)
+	h.backplane.publishPreroll(msg)
+	h.relayPreroll(ch, msg)
+}
+
+// relayPreroll sends msg, a count of ch's count-in, to ch's clients and
+// records it.
+func (h *Hub) relayPreroll(ch *pulseChannel, msg prerollMessage) {
+	h.recorder.preroll(msg)
+	h.BroadcastIf(msg, func(c *Conn) bool { return c.receives(ch.name) })
+}
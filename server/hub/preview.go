@@ -0,0 +1,233 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Previews. POST /admin/preview works out a program before it goes live:
+// given a tempo map, a state machine and scheduled cues for a channel, it
+// plays them forward from the channel's latest pulse on paper and returns
+// when the next beats fall, which states they start and when the cues are
+// due, applying nothing. The beats are computed as the pulse loop computes
+// them, ramps included, from the channel's current period; a change made
+// meanwhile through the API or a clock domain makes the preview stale.
+const (
+	defaultPreviewBeats = 16
+	maxPreviewBeats     = maxRampPulses
+	maxTempoSegments    = 256
+)
+
+// previewBody is POST /admin/preview:
+//
+//	{"channel":"song","beats":64,
+//	 "tempo":[{"bpm":140,"pulses":16,"hold":32},{"bpm":120}],
+//	 "machine":{"states":[{"name":"intro","bars":8,"next":"outro"},{"name":"outro","bars":4}]},
+//	 "cues":[{"name":"drop","seq":1200}]}
+//
+// Channel defaults to the default channel, Beats to 16; the machine and
+// the cues must be for the channel.
+type previewBody struct {
+	Channel string         `json:"channel,omitempty"`
+	Beats   int            `json:"beats,omitempty"`
+	Tempo   []tempoSegment `json:"tempo,omitempty"`
+	Machine *machineBody   `json:"machine,omitempty"`
+	Cues    []scheduleBody `json:"cues,omitempty"`
+}
+
+// tempoSegment is a step of a tempo map: a change to PeriodMS or BPM, at
+// once or ramped over Pulses pulses, that holds for Hold more pulses once
+// reached before the next segment starts. The first segment starts with
+// the next pulse; the last holds for good.
+type tempoSegment struct {
+	PeriodMS int64   `json:"period_ms,omitempty"`
+	BPM      float64 `json:"bpm,omitempty"`
+	Pulses   int     `json:"pulses,omitempty"`
+	Hold     int     `json:"hold,omitempty"`
+}
+
+// previewBeat is a beat in a preview: pulse Seq falls at AtMS and the
+// next one PeriodMS later. Bar and Beat place it on a channel with a
+// tempo.
+type previewBeat struct {
+	Seq      uint64  `json:"seq"`
+	AtMS     int64   `json:"at_ms"`
+	PeriodMS float64 `json:"period_ms"`
+	BPM      float64 `json:"bpm"`
+	Bar      uint64  `json:"bar,omitempty"`
+	Beat     int     `json:"beat,omitempty"`
+}
+
+type previewResponse struct {
+	Channel string                `json:"channel"`
+	Beats   []previewBeat         `json:"beats"`
+	States  []machineStateMessage `json:"states"`
+	Cues    []cueMessage          `json:"cues"`
+}
+
+// preview plays body forward without applying it.
+func (h *Hub) preview(body previewBody) (previewResponse, error) {
+	if body.Channel == "" {
+		body.Channel = defaultChannel
+	}
+	if body.Beats == 0 {
+		body.Beats = defaultPreviewBeats
+	}
+	ch := h.channel(body.Channel)
+	switch {
+	case ch == nil:
+		return previewResponse{}, fmt.Errorf("%w: %q", errNoChannel, body.Channel)
+	case body.Beats < 1 || body.Beats > maxPreviewBeats:
+		return previewResponse{}, fmt.Errorf("beats must be in [1, %d]", maxPreviewBeats)
+	case len(body.Tempo) > maxTempoSegments:
+		return previewResponse{}, fmt.Errorf("give at most %d tempo segments", maxTempoSegments)
+	case len(body.Cues) > maxScheduledCues:
+		return previewResponse{}, fmt.Errorf("give at most %d cues", maxScheduledCues)
+	}
+	targets := make([]time.Duration, len(body.Tempo))
+	for i, seg := range body.Tempo {
+		d, err := rampTarget(seg.PeriodMS, seg.BPM)
+		switch {
+		case seg.PeriodMS != 0 && seg.BPM != 0:
+			return previewResponse{}, fmt.Errorf("tempo %d: give period_ms or bpm, not both", i)
+		case err != nil || d < minChannelPeriod || d > maxChannelPeriod:
+			return previewResponse{}, fmt.Errorf("tempo %d: period must be in [%s, %s]", i, minChannelPeriod, maxChannelPeriod)
+		case seg.Pulses < 0 || seg.Pulses > maxRampPulses:
+			return previewResponse{}, fmt.Errorf("tempo %d: pulses must be in [0, %d]", i, maxRampPulses)
+		case seg.Hold < 0:
+			return previewResponse{}, fmt.Errorf("tempo %d: hold must not be negative", i)
+		}
+		targets[i] = d
+	}
+	var m *stateMachine
+	if body.Machine != nil {
+		if body.Machine.Channel == "" {
+			body.Machine.Channel = ch.name
+		}
+		var err error
+		if m, err = h.newStateMachine("preview", *body.Machine); err != nil {
+			return previewResponse{}, fmt.Errorf("machine: %w", err)
+		}
+		if m.ch != ch {
+			return previewResponse{}, fmt.Errorf("machine: channel must be %q", ch.name)
+		}
+	}
+	cues := make([]*scheduledCue, 0, len(body.Cues))
+	for i, c := range body.Cues {
+		if c.Channel == "" {
+			c.Channel = ch.name
+		}
+		sc, cch, err := h.newScheduledCue(c)
+		switch {
+		case err != nil:
+			return previewResponse{}, fmt.Errorf("cue %d: %w", i, err)
+		case cch != ch:
+			return previewResponse{}, fmt.Errorf("cue %d: channel must be %q", i, ch.name)
+		}
+		cues = append(cues, sc)
+	}
+	last := ch.last.Load()
+	if last == nil {
+		return previewResponse{}, fmt.Errorf("channel %q has not pulsed yet", ch.name)
+	}
+	for i, sc := range cues {
+		if sc.msg.Seq != 0 && sc.msg.Seq <= last.seq {
+			return previewResponse{}, fmt.Errorf("cue %d: seq must be at least %d", i, last.seq+1)
+		}
+	}
+
+	resp := previewResponse{Channel: ch.name, Beats: make([]previewBeat, 0, body.Beats), States: []machineStateMessage{}, Cues: []cueMessage{}}
+	if m != nil {
+		m.at = m.downbeat(last.seq + 2)
+	}
+	var (
+		seq    = last.seq
+		at     = last.at
+		period = ch.Period()
+		ramp   *tempoRamp
+		next   int // the tempo segment to start next
+		hold   int // pulses before it starts
+	)
+	for range body.Beats {
+		seq++
+		at = at.Add(period)
+		// As startPulseLoop does: a change takes effect from the pulse
+		// that picks it up, giving the gap to the next one.
+		if ramp == nil {
+			switch {
+			case hold > 0:
+				hold--
+			case next < len(targets):
+				if seg := body.Tempo[next]; seg.Pulses > 0 {
+					ramp = &tempoRamp{target: targets[next], pulses: seg.Pulses, from: period}
+				} else {
+					period = targets[next]
+				}
+				hold = body.Tempo[next].Hold
+				next++
+			}
+		}
+		if ramp != nil {
+			period, _ = ramp.step()
+			if ramp.finished() {
+				ramp = nil
+			}
+		}
+		_, swing := ch.swing(seq, period)
+		b := previewBeat{Seq: seq, AtMS: at.Add(swing).UnixMilli(), PeriodMS: msFloat(period), BPM: periodBPM(period)}
+		if ch.tempo != nil {
+			b.Bar, b.Beat = ch.tempo.position(seq)
+		}
+		resp.Beats = append(resp.Beats, b)
+		if m != nil && m.at != 0 && m.at <= seq {
+			msg := m.advance(seq, at)
+			resp.States = append(resp.States, msg)
+			if msg.Done {
+				m = nil
+			}
+		}
+		for _, sc := range cues {
+			if sc.msg.Seq == seq {
+				sc.msg.AtMS = at.Add(swing).UnixMilli()
+				resp.Cues = append(resp.Cues, sc.msg)
+			}
+		}
+	}
+	// Cues past the preview, as the schedule would announce them if the
+	// last period held.
+	for _, sc := range cues {
+		if sc.msg.Seq > seq {
+			sc.msg.AtMS = at.Add(time.Duration(sc.msg.Seq-seq) * period).UnixMilli()
+		}
+		if sc.msg.Seq == 0 || sc.msg.Seq > seq {
+			resp.Cues = append(resp.Cues, sc.msg)
+		}
+	}
+	sort.SliceStable(resp.Cues, func(i, j int) bool { return resp.Cues[i].AtMS < resp.Cues[j].AtMS })
+	return resp, nil
+}
+
+// previewHandler serves POST /admin/preview.
+func previewHandler(h *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body previewBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := h.preview(body)
+		switch {
+		case errors.Is(err, errNoChannel):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
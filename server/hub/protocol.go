@@ -0,0 +1,95 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"pulse/ws"
+)
+
+// Subprotocols offered via Sec-WebSocket-Protocol. Clients that offer none
+// get the legacy v1 stream: flat pulse JSON and nothing else, exactly as the
+// first server release sent it.
+const (
+	protoLegacy = ""
+	protoJSON   = "pulse.v2+json"
+	// protoRelay is for downstream relay nodes: every message is wrapped in
+	// a relayEnvelope naming its channel, so one upstream connection can
+	// carry many channels.
+	protoRelay = "pulse.relay.v1+json"
+	// protoBinary sends pulses as compact binary frames (see
+	// codec_binary.go); all other messages stay JSON text.
+	protoBinary = "pulse.v2+binary"
+	// protoTagged sends pulses as binary frames of tagged fields (see
+	// codec_tagged.go), which can grow without breaking decoders;
+	// protoBinary's fixed layout is frozen.
+	protoTagged = "pulse.v2+tagged"
+)
+
+// defaultChannel is the channel pulsing at PULSE_PERIOD_MS, which clients
+// get unless they ask for another; see channels.go.
+const defaultChannel = "default"
+
+// supportedProtocols is in server preference order.
+var supportedProtocols = []string{protoJSON, protoBinary, protoTagged, protoRelay}
+
+// relayEnvelope carries one message for one channel on a relay connection.
+type relayEnvelope struct {
+	Type    string `json:"type"`
+	Channel string `json:"channel"`
+	Message any    `json:"msg"`
+}
+
+// legacyPulseMessage is the v1 wire format. It must never grow new fields.
+type legacyPulseMessage struct {
+	Type     string `json:"type"`
+	Seq      uint64 `json:"seq"`
+	PeriodMS int64  `json:"period_ms"`
+	NowMS    int64  `json:"now_ms"`
+	NextMS   int64  `json:"next_ms"`
+}
+
+// selectProtocol picks the subprotocol for an upgrade request. No offer
+// selects legacy mode; an offer without any supported entry is an error.
+func selectProtocol(offered string) (string, error) {
+	if strings.TrimSpace(offered) == "" {
+		return protoLegacy, nil
+	}
+	for _, want := range supportedProtocols {
+		if ws.ContainsToken(offered, want) {
+			return want, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported subprotocol %q (supported: %s)", offered, strings.Join(supportedProtocols, ", "))
+}
+
+// pulseOpcode is the frame opcode pulses are sent with on proto.
+func pulseOpcode(proto string) byte {
+	if proto == protoBinary || proto == protoTagged {
+		return ws.OpBinary
+	}
+	return ws.OpText
+}
+
+func encodePulse(proto string, msg PulseMessage) ([]byte, error) {
+	if proto == protoLegacy {
+		return json.Marshal(legacyPulseMessage{
+			Type:     msg.Type,
+			Seq:      msg.Seq,
+			PeriodMS: msg.PeriodMS,
+			NowMS:    msg.NowMS,
+			NextMS:   msg.NextMS,
+		})
+	}
+	if proto == protoRelay {
+		return json.Marshal(relayEnvelope{Type: "relay", Channel: msg.Channel, Message: msg})
+	}
+	if proto == protoBinary {
+		return encodeBinaryPulse(msg)
+	}
+	if proto == protoTagged {
+		return encodeTaggedPulse(msg)
+	}
+	return json.Marshal(msg)
+}
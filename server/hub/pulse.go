@@ -0,0 +1,316 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"time"
+
+	"pulse/clock"
+)
+
+//go:generate go run ../cmd/pulse-gen -schema schema.json -go pulse_gen.go -conformance ../conformance/pulse_gen.go -ts ../../src/pulse-codec.ts
+
+// pulseContext is what a PulseMessage carries besides its wire fields,
+// which pulse_gen.go generates from schema.json.
+type pulseContext struct {
+	// Lead is how long before its beat a send_ahead pulse goes out; see
+	// features.go.
+	Lead time.Duration `json:"-"`
+	// Beat is when the pulse's beat is scheduled, for enrichers; zero for
+	// driven ticks.
+	Beat time.Time `json:"-"`
+
+	// Channel is the channel the pulse belongs to; clients learn it from
+	// their hello, relay connections from the envelope.
+	Channel string `json:"-"`
+
+	// Extra holds fields added by enrichers; see enrich.go.
+	Extra map[string]json.RawMessage `json:"-"`
+
+	// relayed pulses came over the backplane complete with their hash and
+	// extra fields; see backplane.go.
+	relayed bool
+}
+
+// PulseObservation describes how a single pulse went out, for alerting and
+// status reporting.
+type PulseObservation struct {
+	Seq         uint64
+	Scheduled   time.Time
+	At          time.Time
+	Period      time.Duration // period the pulse announced
+	Lead        time.Duration // how long before its beat the pulse was sent
+	Jitter      time.Duration // actual emission time minus scheduled time
+	Broadcast   time.Duration // time spent queueing for all subscribers
+	Subscribers int
+	// Late lists clients whose frame missed the fan-out budget; only
+	// tracked for driven ticks.
+	Late []string
+	// Hash is the pulse's hash_chain hash; empty with the feature off.
+	Hash string
+}
+
+// emit broadcasts msg and reports how it went to observe. budget is passed
+// on to broadcastPulse. Unless msg was relayed from the backplane, it is
+// linked into the hash chain, enriched and published to the backplane first.
+func (h *Hub) emit(msg PulseMessage, scheduled time.Time, budget time.Duration, observe func(PulseObservation)) PulseObservation {
+	var hash string
+	if !msg.relayed {
+		if ch := h.channel(msg.Channel); ch != nil && ch.feature(featureHashChain) {
+			hash = ch.chain.link(&msg)
+		}
+		// Fields set by the caller, e.g. tick state, win over enrichers.
+		extra := enrich(msg)
+		for k, v := range msg.Extra {
+			if extra == nil {
+				extra = make(map[string]json.RawMessage, len(msg.Extra))
+			}
+			extra[k] = v
+		}
+		// A pulse cannot say how late it goes out until it has, so it
+		// carries the channel's previous one's delay instead, to the
+		// microsecond like drift_ms on the wire.
+		if d, ok := h.pulseMetrics.lastDelay(msg.Channel); ok {
+			if extra == nil {
+				extra = make(map[string]json.RawMessage, 1)
+			}
+			extra["last_delay_ms"], _ = json.Marshal(msFloat(d.Round(time.Microsecond)))
+		}
+		msg.Extra = extra
+		h.backplane.publishPulse(msg, scheduled)
+	} else if raw, ok := msg.Extra["hash"]; ok && json.Unmarshal(raw, &hash) == nil {
+		// A replica keeps the chain going in case it takes over.
+		if ch := h.channel(msg.Channel); ch != nil {
+			ch.chain.resume(hash)
+		}
+	}
+	if ch := h.channel(msg.Channel); ch != nil {
+		ch.recent.add(msg)
+	}
+	start := h.clock.Now()
+	h.recorder.pulse(msg, scheduled, start)
+	h.multicast.send(msg)
+	h.mqtt.send(msg, h.sinkMeta)
+	h.timelines.pulse(msg)
+	h.webhooks.pulse(h, msg)
+	late, failed := h.broadcastPulse(msg, budget)
+	h.cues.pulse(msg.Channel, msg.Seq)
+	if ch := h.channel(msg.Channel); ch != nil {
+		// Both place later pulses on the straight grid and move them as
+		// the channel's pattern does.
+		straight := scheduled.Add(-pulseSwing(msg))
+		h.schedule.pulse(ch, msg.Seq, straight)
+		h.machines.pulse(ch, msg.Seq, straight)
+	}
+	o := PulseObservation{
+		Seq:         msg.Seq,
+		Scheduled:   scheduled,
+		At:          start,
+		Period:      time.Duration(msg.PeriodMS) * time.Millisecond,
+		Lead:        msg.Lead,
+		Jitter:      start.Sub(scheduled),
+		Broadcast:   h.clock.Now().Sub(start),
+		Subscribers: h.Count(),
+		Late:        late,
+		Hash:        hash,
+	}
+	h.pulseMetrics.observe(msg.Channel, o.Jitter, o.Broadcast, failed)
+	if observe != nil {
+		observe(o)
+	}
+	h.hooks.pulsed(msg, o)
+	return o
+}
+
+// SetClock times the pulse loops with c instead of the system clock, so
+// that a test can drive them with a clock.Fake: place, skip and correct
+// pulses without waiting for them. Call it before Start.
+func (h *Hub) SetClock(c clock.Clock) {
+	h.clock = c
+}
+
+// wallStepLog is how far the wall clock must move against the monotonic
+// clock before the pulse loop logs it.
+const wallStepLog = 100 * time.Millisecond
+
+// startPulseLoop emits pulses every period until ctx is done, on a
+// clock.Scheduler grid anchored at start. Each pulse carries drift_ms, how
+// late it actually went out; seq increases by one per pulse even when the
+// grid skips missed slots, which a resync message announces. An NTP step or
+// a manual clock change moves now_ms and next_ms with the wall clock but
+// never when pulses go out.
+func startPulseLoop(ctx context.Context, h *Hub, ch *pulseChannel, observe func(PulseObservation)) {
+	grid := clock.NewSchedulerOn(h.clock, ch.Period())
+	period := grid.Period()
+	var (
+		seq  uint64
+		step time.Duration // wall clock minus monotonic elapsed, since the epoch
+	)
+	// After an upgrade or a failover, carry on with the old grid and seq;
+	// otherwise count the pulses in. preroll is how many counts are left.
+	preroll := ch.preroll
+	if a := ch.resume; a != nil && a.period == period {
+		seq = a.seq + uint64(grid.Resume(a.at))
+		preroll = 0
+	}
+	paused := false
+	var ramp *tempoRamp
+	for {
+		t := ch.transport.view()
+		if t.paused != paused || t.reset {
+			paused = t.paused
+			phase := "preserved"
+			if t.reset {
+				grid.Restart(h.clock.Now(), period)
+				phase = "reset"
+				ch.transport.takeReset()
+				ch.tempo.restartBars(seq)
+			} else {
+				grid.Skip()
+			}
+			preroll = 0
+			if !paused {
+				preroll = ch.preroll
+			}
+			_, swing := ch.swing(seq, period)
+			next := grid.Next().Add(time.Duration(preroll)*period + swing)
+			h.announceTransport(ch, paused, phase, seq, next, preroll, t.by)
+		}
+		if paused {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.changed:
+			}
+			continue
+		}
+
+		// scheduled is the pulse's slot on the straight grid, and beat
+		// where a pattern moves it to; see pattern.go. A count-in is on
+		// the straight grid.
+		scheduled := grid.Next()
+		beatStep, swing := ch.swing(seq, period)
+		if preroll > 0 {
+			swing = 0
+		}
+		beat := scheduled.Add(swing)
+		lead := ch.lead(period)
+		if !h.clock.SleepUntil(ctx, beat.Add(-lead), t.changed) {
+			if ctx.Err() != nil {
+				return
+			}
+			continue // the transport changed
+		}
+
+		if preroll > 0 {
+			_, swing = ch.swing(seq, period)
+			next := scheduled.Add(time.Duration(preroll)*period + swing)
+			h.announcePreroll(ch, preroll, seq, beat, next, period)
+			// Skipped slots use up counts, so the pulse still comes when
+			// announced.
+			preroll = max(preroll-1-int(grid.Advance()), 0)
+			continue
+		}
+
+		// A new period takes over from the pulse clients already expect:
+		// it starts a fresh grid there and says so. A ramp does that on
+		// every pulse until it reaches its target; a period change while
+		// ramping ends the ramp.
+		changed := false
+		if p := ch.Period(); p > 0 && p != period {
+			period, changed = p, true
+			grid.Restart(scheduled, period)
+			ramp = nil
+		}
+		if r := ch.ramp.Swap(nil); r != nil {
+			ramp, r.from = r, period
+		}
+		var rampLeft int
+		if ramp != nil {
+			p, left := ramp.step()
+			ch.period.CompareAndSwap(int64(period), int64(p))
+			period, changed, rampLeft = p, true, left
+			grid.Restart(scheduled, period)
+		}
+		// An alignment moves the grid onto external beats (see link.go):
+		// this pulse announces the gap to the first of them at least half a
+		// period away, and the grid carries on from there.
+		interval := period
+		if a := ch.align.Swap(nil); a != nil {
+			changed = changed || a.period != period
+			ramp, period = nil, a.period
+			ch.period.Store(int64(period))
+			k := int64(math.Ceil(float64(scheduled.Add(period/2).Sub(a.at)) / float64(period)))
+			next := a.at.Add(time.Duration(k) * period)
+			interval = next.Sub(scheduled)
+			if (interval - period).Abs() > linkTolerance {
+				changed = true
+			}
+			grid.Restart(next.Add(-period), period)
+			a.restartBars(ch, seq+1, a.beat+k)
+		}
+
+		// The next pulse is due on its own step.
+		gap := interval
+		if ch.pattern != nil {
+			_, nextSwing := ch.swing(seq+1, period)
+			gap = scheduled.Add(interval + nextSwing).Sub(beat)
+		}
+
+		now := h.clock.Now()
+		epoch := grid.Epoch()
+		if d := now.Round(0).Sub(epoch.Round(0)) - now.Sub(epoch); (d - step).Abs() >= wallStepLog {
+			slog.Warn("wall clock stepped; pulse schedule unaffected", "step", (d - step).Round(time.Millisecond))
+			step = d
+		}
+		// next_ms is a wall clock time, but the wait until it is measured
+		// on the monotonic clock.
+		offset := h.offset()
+		next := now.Add(beat.Add(gap).Sub(now) + offset)
+		msg := PulseMessage{
+			Type:     "pulse",
+			Seq:      seq,
+			PeriodMS: interval.Milliseconds(),
+			NowMS:    now.UnixMilli(),
+			NextMS:   next.UnixMilli(),
+			OffsetMS: offset.Milliseconds(),
+			DriftMS:  msFloat(now.Sub(beat.Add(-lead))),
+			MonoMS:   clock.MonoMS(now),
+
+			PeriodChanged: changed,
+			pulseContext:  pulseContext{Channel: ch.name, Beat: beat},
+		}
+		if ch.pattern != nil {
+			msg.Extra = ch.pattern.fields(beatStep, swing)
+		}
+		if ramp != nil {
+			msg.RampTargetMS, msg.RampPulses = ramp.target.Milliseconds(), rampLeft
+			if ramp.finished() {
+				ramp = nil
+			}
+		}
+		var at time.Time
+		if lead > 0 {
+			at = now.Add(beat.Sub(now) + offset)
+			msg.AtMS = at.UnixMilli()
+			msg.Lead = lead
+		}
+		msg.setMicros(now, next, at, interval)
+		h.emit(msg, beat.Add(-lead), 0, observe)
+		ch.last.Store(&channelAnchor{seq: seq, at: scheduled.Add(interval - period), period: period})
+		if r := ch.retiring.Load(); r != nil && seq >= r.finalSeq {
+			h.finishRetirement(ch, r)
+			return
+		}
+		seq++
+
+		// Slots that went by while the loop was held up are skipped, and
+		// clients told so: see resync.go.
+		if skipped := grid.Advance(); skipped > 0 {
+			_, swing := ch.swing(seq, period)
+			h.announceResync(ch, skipped, seq, grid.Next().Add(swing), period)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+// Code generated by pulse-gen from schema.json; DO NOT EDIT.
+
+package hub
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// PulseMessage is a pulse as sent to clients; see schema.json.
+type PulseMessage struct {
+	Type     string `json:"type"`
+	Seq      uint64 `json:"seq"`
+	PeriodMS int64  `json:"period_ms"`
+	// Server send time, Unix milliseconds.
+	NowMS int64 `json:"now_ms"`
+	// Expected next pulse, Unix milliseconds, offset applied.
+	NextMS int64 `json:"next_ms"`
+	// Output latency offset already applied to next_ms.
+	OffsetMS int64 `json:"offset_ms,omitempty"`
+	// How late the pulse went out versus its scheduled slot, in milliseconds.
+	DriftMS float64 `json:"drift_ms,omitempty"`
+	// Monotonic milliseconds since server start; unaffected by wall clock
+	// steps.
+	MonoMS int64 `json:"mono_ms"`
+	// First pulse after the period was changed at runtime; re-anchor on it.
+	PeriodChanged bool `json:"period_changed,omitempty"`
+	// send_ahead feature: the beat this pulse stands for, Unix milliseconds,
+	// offset applied; the pulse was sent before it.
+	AtMS int64 `json:"at_ms,omitempty"`
+	// Tempo ramp in progress: the period it ends on.
+	RampTargetMS int64 `json:"ramp_target_ms,omitempty"`
+	// Tempo ramp in progress: pulses from this one on that still have ramp
+	// periods.
+	RampPulses int `json:"ramp_pulses,omitempty"`
+	// Clients with microsecond precision: period_ms in microseconds.
+	PeriodUS int64 `json:"period_us,omitempty"`
+	// Clients with microsecond precision: now_ms in Unix microseconds.
+	NowUS int64 `json:"now_us,omitempty"`
+	// Clients with microsecond precision: next_ms in Unix microseconds.
+	NextUS int64 `json:"next_us,omitempty"`
+	// Clients with microsecond precision: at_ms in Unix microseconds; 0 in
+	// pulse.v2+binary without send_ahead.
+	AtUS int64 `json:"at_us,omitempty"`
+
+	pulseContext
+}
+
+// Binary pulse layout (pulse.v2+binary), all integers big-endian:
+//
+//	0   u8   message type (binPulse)
+//	1   u8   flags
+//	2   u64  seq
+//	10  u32  period_ms
+//	14  i64  now_ms
+//	22  i64  next_ms
+//	..  i32  offset_ms          if flags&binFlagOffsetMS
+//	..  i32  drift_ms × 1000    if flags&binFlagDriftMS
+//	..  i64  mono_ms            if flags&binFlagMonoMS
+//	..  i64  at_ms              if flags&binFlagAtMS
+//	..  u32  ramp_target_ms     if flags&binFlagRampTargetMS
+//	..  u16  ramp_pulses        if flags&binFlagRampTargetMS
+//	..  u64  period_us          if flags&binFlagPeriodUS
+//	..  i64  now_us             if flags&binFlagPeriodUS
+//	..  i64  next_us            if flags&binFlagPeriodUS
+//	..  i64  at_us              if flags&binFlagPeriodUS
+//	..  u16  n, n bytes JSON    if flags&binFlagExtra: object of the other fields
+//
+// flags&binFlagPeriodChanged carries no payload; it is period_changed.
+const (
+	binPulse     = 0x01
+	binPulseSize = 30
+
+	binFlagOffsetMS      = 0x01
+	binFlagExtra         = 0x02
+	binFlagDriftMS       = 0x04
+	binFlagMonoMS        = 0x08
+	binFlagPeriodChanged = 0x10
+	binFlagAtMS          = 0x20
+	binFlagRampTargetMS  = 0x40
+	binFlagPeriodUS      = 0x80
+)
+
+// Tags of pulse.v2+tagged fields; see codec_tagged.go.
+const (
+	taggedPulse = 0x01
+
+	tagSeq           = 1  // u
+	tagPeriodMS      = 2  // u
+	tagNowMS         = 3  // s
+	tagNextMS        = 4  // s
+	tagOffsetMS      = 5  // s
+	tagDriftMS       = 6  // s, drift_ms × 1000
+	tagMonoMS        = 7  // s
+	tagPeriodChanged = 8  // flag
+	tagAtMS          = 9  // s
+	tagRampTargetMS  = 10 // u
+	tagRampPulses    = 11 // u
+	tagExtra         = 12 // JSON object of the other fields
+	tagBPM           = 13 // f64
+	tagBar           = 14 // u
+	tagBeat          = 15 // u
+	tagIsDownbeat    = 16 // flag
+	tagHash          = 17 // hex32
+	tagPrevHash      = 18 // hex32
+	tagRate          = 19 // u
+	tagPhase         = 20 // f64
+	tagEpochMS       = 21 // f64
+	tagPeriodUS      = 22 // u
+	tagNowUS         = 23 // s
+	tagNextUS        = 24 // s
+	tagAtUS          = 25 // s
+	tagLastDelayMS   = 26 // f64
+	tagStep          = 27 // u
+	tagSteps         = 28 // u
+	tagSwingMS       = 29 // f64
+)
+
+func encodeBinaryPulse(msg PulseMessage) ([]byte, error) {
+	var extra []byte
+	if len(msg.Extra) > 0 {
+		var err error
+		if extra, err = encodeExtra(msg.Extra); err != nil {
+			return nil, err
+		}
+		if len(extra) > 0xffff {
+			return nil, fmt.Errorf("enrichment fields too large for binary pulse: %d bytes", len(extra))
+		}
+	}
+
+	b := make([]byte, binPulseSize, binPulseSize+62+2+len(extra))
+	b[0] = binPulse
+	binary.BigEndian.PutUint64(b[2:], msg.Seq)
+	binary.BigEndian.PutUint32(b[10:], uint32(msg.PeriodMS))
+	binary.BigEndian.PutUint64(b[14:], uint64(msg.NowMS))
+	binary.BigEndian.PutUint64(b[22:], uint64(msg.NextMS))
+	if msg.OffsetMS != 0 {
+		b[1] |= binFlagOffsetMS
+		b = binary.BigEndian.AppendUint32(b, uint32(int32(msg.OffsetMS)))
+	}
+	if v := int32(msg.DriftMS * 1000); v != 0 {
+		b[1] |= binFlagDriftMS
+		b = binary.BigEndian.AppendUint32(b, uint32(v))
+	}
+	if msg.MonoMS != 0 {
+		b[1] |= binFlagMonoMS
+		b = binary.BigEndian.AppendUint64(b, uint64(msg.MonoMS))
+	}
+	if msg.AtMS != 0 {
+		b[1] |= binFlagAtMS
+		b = binary.BigEndian.AppendUint64(b, uint64(msg.AtMS))
+	}
+	if msg.RampTargetMS != 0 || msg.RampPulses != 0 {
+		b[1] |= binFlagRampTargetMS
+		b = binary.BigEndian.AppendUint32(b, uint32(msg.RampTargetMS))
+		b = binary.BigEndian.AppendUint16(b, uint16(msg.RampPulses))
+	}
+	if msg.PeriodUS != 0 || msg.NowUS != 0 || msg.NextUS != 0 || msg.AtUS != 0 {
+		b[1] |= binFlagPeriodUS
+		b = binary.BigEndian.AppendUint64(b, uint64(msg.PeriodUS))
+		b = binary.BigEndian.AppendUint64(b, uint64(msg.NowUS))
+		b = binary.BigEndian.AppendUint64(b, uint64(msg.NextUS))
+		b = binary.BigEndian.AppendUint64(b, uint64(msg.AtUS))
+	}
+	if msg.PeriodChanged {
+		b[1] |= binFlagPeriodChanged
+	}
+	if extra != nil {
+		b[1] |= binFlagExtra
+		b = binary.BigEndian.AppendUint16(b, uint16(len(extra)))
+		b = append(b, extra...)
+	}
+	return b, nil
+}
+
+func encodeTaggedPulse(msg PulseMessage) ([]byte, error) {
+	b := make([]byte, 1, 64)
+	b[0] = taggedPulse
+	b = appendTagged(b, tagSeq, binary.AppendUvarint(nil, msg.Seq))
+	b = appendTagged(b, tagPeriodMS, binary.AppendUvarint(nil, uint64(msg.PeriodMS)))
+	b = appendTagged(b, tagNowMS, binary.AppendVarint(nil, msg.NowMS))
+	b = appendTagged(b, tagNextMS, binary.AppendVarint(nil, msg.NextMS))
+	if msg.OffsetMS != 0 {
+		b = appendTagged(b, tagOffsetMS, binary.AppendVarint(nil, msg.OffsetMS))
+	}
+	if v := int64(msg.DriftMS * 1000); v != 0 {
+		b = appendTagged(b, tagDriftMS, binary.AppendVarint(nil, v))
+	}
+	if msg.MonoMS != 0 {
+		b = appendTagged(b, tagMonoMS, binary.AppendVarint(nil, msg.MonoMS))
+	}
+	if msg.PeriodChanged {
+		b = appendTagged(b, tagPeriodChanged, nil)
+	}
+	if msg.AtMS != 0 {
+		b = appendTagged(b, tagAtMS, binary.AppendVarint(nil, msg.AtMS))
+	}
+	if msg.RampTargetMS != 0 {
+		b = appendTagged(b, tagRampTargetMS, binary.AppendUvarint(nil, uint64(msg.RampTargetMS)))
+	}
+	if msg.RampPulses != 0 {
+		b = appendTagged(b, tagRampPulses, binary.AppendUvarint(nil, uint64(msg.RampPulses)))
+	}
+	if msg.PeriodUS != 0 {
+		b = appendTagged(b, tagPeriodUS, binary.AppendUvarint(nil, uint64(msg.PeriodUS)))
+	}
+	if msg.NowUS != 0 {
+		b = appendTagged(b, tagNowUS, binary.AppendVarint(nil, msg.NowUS))
+	}
+	if msg.NextUS != 0 {
+		b = appendTagged(b, tagNextUS, binary.AppendVarint(nil, msg.NextUS))
+	}
+	if msg.AtUS != 0 {
+		b = appendTagged(b, tagAtUS, binary.AppendVarint(nil, msg.AtUS))
+	}
+	return appendTaggedExtra(b, msg.Extra)
+}
+
+// taggedExtra encodes enrichment fields that have their own tag; it
+// reports false for values of an unexpected type, which then go into
+// tagExtra with the rest.
+var taggedExtra = map[string]func(b []byte, raw json.RawMessage) ([]byte, bool){
+	"bpm":           taggedFloat(tagBPM),
+	"bar":           taggedUint(tagBar),
+	"beat":          taggedUint(tagBeat),
+	"is_downbeat":   taggedFlag(tagIsDownbeat),
+	"hash":          taggedHash(tagHash),
+	"prev_hash":     taggedHash(tagPrevHash),
+	"rate":          taggedUint(tagRate),
+	"phase":         taggedFloat(tagPhase),
+	"epoch_ms":      taggedFloat(tagEpochMS),
+	"last_delay_ms": taggedFloat(tagLastDelayMS),
+	"step":          taggedUint(tagStep),
+	"steps":         taggedUint(tagSteps),
+	"swing_ms":      taggedFloat(tagSwingMS),
+}
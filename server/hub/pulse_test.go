@@ -0,0 +1,93 @@
+package hub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pulse/clock"
+)
+
+// fakeLoop runs h's pulse loops on a clock.Fake, handing over every pulse.
+func fakeLoop(t *testing.T, h *Hub) (*clock.Fake, <-chan PulseMessage) {
+	t.Helper()
+	f := clock.NewFake(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	h.SetClock(f)
+	pulses := make(chan PulseMessage, 16)
+	h.OnPulse(func(msg PulseMessage, _ PulseObservation) { pulses <- msg })
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	h.Start(ctx)
+	return f, pulses
+}
+
+// nextPulse waits for the loop to send a pulse.
+func nextPulse(t *testing.T, pulses <-chan PulseMessage) PulseMessage {
+	t.Helper()
+	select {
+	case msg := <-pulses:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no pulse")
+		return PulseMessage{}
+	}
+}
+
+func TestPulseLoopDrift(t *testing.T) {
+	h := New(100 * time.Millisecond)
+	f, pulses := fakeLoop(t, h)
+	start := f.Now()
+
+	// The first pulse goes out at once, on time.
+	if msg := nextPulse(t, pulses); msg.Seq != 0 || msg.DriftMS != 0 || msg.NowMS != start.UnixMilli() {
+		t.Fatalf("first pulse: seq %d, drift_ms %g, now_ms %d", msg.Seq, msg.DriftMS, msg.NowMS)
+	}
+	// Handled 7ms late, a pulse says so; the next one is still due on
+	// the grid, not 7ms later.
+	for seq, late := range []time.Duration{7 * time.Millisecond, 0, 30 * time.Millisecond} {
+		f.BlockUntil(1)
+		slot := start.Add(time.Duration(seq+1) * 100 * time.Millisecond)
+		f.Set(slot.Add(late))
+		msg := nextPulse(t, pulses)
+		if msg.Seq != uint64(seq+1) {
+			t.Fatalf("seq %d, want %d", msg.Seq, seq+1)
+		}
+		if want := msFloat(late); msg.DriftMS != want {
+			t.Fatalf("pulse %d: drift_ms %g, want %g", msg.Seq, msg.DriftMS, want)
+		}
+		if want := slot.Add(100 * time.Millisecond).UnixMilli(); msg.NextMS != want {
+			t.Fatalf("pulse %d: next_ms %d, want %d", msg.Seq, msg.NextMS, want)
+		}
+	}
+}
+
+func TestPulseLoopSkipsAfterStall(t *testing.T) {
+	h := New(100 * time.Millisecond)
+	f, pulses := fakeLoop(t, h)
+	start := f.Now()
+	nextPulse(t, pulses)
+
+	// The process stalls from before the pulse at 100ms until 450ms: that
+	// pulse goes out late, and the slots at 200, 300 and 400ms are
+	// skipped rather than sent in a burst.
+	f.BlockUntil(1)
+	f.Set(start.Add(450 * time.Millisecond))
+	if msg := nextPulse(t, pulses); msg.Seq != 1 || msg.DriftMS != 350 {
+		t.Fatalf("late pulse: seq %d, drift_ms %g", msg.Seq, msg.DriftMS)
+	}
+	f.BlockUntil(1)
+	h.pulseMetrics.mu.Lock()
+	skipped := h.pulseMetrics.stats(defaultChannel).skipped
+	h.pulseMetrics.mu.Unlock()
+	if skipped != 3 {
+		t.Fatalf("skipped %d, want 3", skipped)
+	}
+	if next, _ := f.Next(); !next.Equal(start.Add(500 * time.Millisecond)) {
+		t.Fatalf("loop waits until %v, want 500ms", next.Sub(start))
+	}
+	// Seq carries on by one, on time again.
+	f.Set(start.Add(500 * time.Millisecond))
+	if msg := nextPulse(t, pulses); msg.Seq != 2 || msg.DriftMS != 0 {
+		t.Fatalf("after the stall: seq %d, drift_ms %g", msg.Seq, msg.DriftMS)
+	}
+}
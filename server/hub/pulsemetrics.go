@@ -0,0 +1,337 @@
+package hub
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Histogram buckets, in seconds. Drift is how late a pulse went out
+// against its slot; broadcast time is the whole fan-out.
+var (
+	driftBuckets     = []float64{0.0001, 0.0005, 0.001, 0.002, 0.005, 0.01, 0.02, 0.05, 0.1, 0.25}
+	broadcastBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 1}
+	// spreadBuckets are for how far apart a fair_delivery pulse is
+	// estimated to arrive at the equalized clients.
+	spreadBuckets = []float64{0.0005, 0.001, 0.002, 0.005, 0.01, 0.02, 0.05, 0.1}
+)
+
+// delayWindow is how many of a channel's most recent pulses its rolling
+// jitter statistics cover.
+const delayWindow = 1024
+
+// recentDelays is a ring of a channel's latest emission delays: how much
+// later than scheduled its pulses began going out.
+type recentDelays struct {
+	samples []time.Duration
+	next    int
+}
+
+func (r *recentDelays) add(d time.Duration) {
+	if len(r.samples) < delayWindow {
+		r.samples = append(r.samples, d)
+		return
+	}
+	r.samples[r.next] = d
+	r.next = (r.next + 1) % delayWindow
+}
+
+// jitterStats summarizes a channel's recent emission delays for /status
+// and /api/status.
+type jitterStats struct {
+	LastMS float64 `json:"last_ms"`
+	MinMS  float64 `json:"min_ms"`
+	P50MS  float64 `json:"p50_ms"`
+	P99MS  float64 `json:"p99_ms"`
+	MaxMS  float64 `json:"max_ms"`
+	// Pulses is how many pulses the statistics cover, up to delayWindow.
+	Pulses int `json:"pulses"`
+}
+
+// sorted returns the delays in r, in increasing order.
+func (r *recentDelays) sorted() []time.Duration {
+	sorted := append([]time.Duration(nil), r.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// histogram is a Prometheus histogram: counts per upper bound, cumulated
+// when written.
+type histogram struct {
+	bounds []float64
+	counts []uint64 // len(bounds)+1; the last is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	h.counts[sort.SearchFloat64s(h.bounds, v)]++
+	h.sum += v
+	h.count++
+}
+
+// write appends h's series for labels, e.g. `channel="default"`.
+func (h *histogram) write(b *strings.Builder, name, labels string) {
+	var cum uint64
+	for i, c := range h.counts {
+		cum += c
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(b, "%s_bucket{%s,le=%q} %d\n", name, labels, le, cum)
+	}
+	fmt.Fprintf(b, "%s_sum{%s} %g\n%s_count{%s} %d\n", name, labels, h.sum, name, labels, h.count)
+}
+
+// channelPulseStats is what pulseMetrics keeps for one channel.
+type channelPulseStats struct {
+	pulses        uint64
+	writeFailures uint64
+	// dropped counts pulses dropped from full write queues, and expired
+	// those that went stale in one.
+	dropped, expired uint64
+	// skipped is how many slots the loop skipped after falling behind.
+	skipped uint64
+	// lastFailures is the number of writes that failed in the channel's
+	// latest broadcast.
+	lastFailures int
+	drift        *histogram
+	broadcast    *histogram
+	// shards is how many shards the latest fan-out was split into, and
+	// slowestShard how long until the slowest of each fan-out finished.
+	shards       int
+	slowestShard *histogram
+	// lastDelay is the latest pulse's emission delay, and delays the
+	// recent ones'.
+	lastDelay time.Duration
+	delays    recentDelays
+	// fair is the latest fair_delivery broadcast, and spread how far apart
+	// arrivals were estimated to be; nil unless the feature is on.
+	fair   *fairReport
+	spread *histogram
+}
+
+// pulseMetrics counts emitted pulses per channel, with how late they went
+// out, how long the fan-out took and how many writes failed. Channels are
+// configured, so they make a bounded label.
+type pulseMetrics struct {
+	mu       sync.Mutex
+	channels map[string]*channelPulseStats
+}
+
+func newPulseMetrics() *pulseMetrics {
+	return &pulseMetrics{channels: make(map[string]*channelPulseStats)}
+}
+
+// stats returns channel's stats, creating them; m.mu must be held.
+func (m *pulseMetrics) stats(channel string) *channelPulseStats {
+	s := m.channels[channel]
+	if s == nil {
+		s = &channelPulseStats{drift: newHistogram(driftBuckets), broadcast: newHistogram(broadcastBuckets), slowestShard: newHistogram(broadcastBuckets)}
+		m.channels[channel] = s
+	}
+	return s
+}
+
+// observe records one pulse of channel.
+func (m *pulseMetrics) observe(channel string, drift, broadcast time.Duration, failures int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.stats(channel)
+	s.pulses++
+	s.writeFailures += uint64(failures)
+	s.lastFailures = failures
+	s.lastDelay = drift
+	s.delays.add(drift)
+	s.drift.observe(max(drift, 0).Seconds())
+	s.broadcast.observe(broadcast.Seconds())
+}
+
+// lastDelay returns how late channel's latest pulse went out, false
+// before its first.
+func (m *pulseMetrics) lastDelay(channel string) (time.Duration, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.channels[channel]
+	if s == nil || s.pulses == 0 {
+		return 0, false
+	}
+	return s.lastDelay, true
+}
+
+// jitter returns channel's rolling jitter statistics; nil before its
+// first pulse.
+func (m *pulseMetrics) jitter(channel string) *jitterStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.channels[channel]
+	if s == nil || len(s.delays.samples) == 0 {
+		return nil
+	}
+	sorted := s.delays.sorted()
+	return &jitterStats{
+		LastMS: msFloat(s.lastDelay),
+		MinMS:  msFloat(sorted[0]),
+		P50MS:  msFloat(percentile(sorted, 0.50)),
+		P99MS:  msFloat(percentile(sorted, 0.99)),
+		MaxMS:  msFloat(sorted[len(sorted)-1]),
+		Pulses: len(sorted),
+	}
+}
+
+// observeFanout records how a fan-out of channel was split into shards and
+// how long until the slowest had finished.
+func (m *pulseMetrics) observeFanout(channel string, shards int, slowest time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.stats(channel)
+	s.shards = shards
+	s.slowestShard.observe(slowest.Seconds())
+}
+
+// writeFailed counts a pulse of channel that a client's writer failed to
+// send.
+func (m *pulseMetrics) writeFailed(channel string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats(channel).writeFailures++
+}
+
+// dropped counts a pulse of channel dropped from a full write queue.
+func (m *pulseMetrics) dropped(channel string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats(channel).dropped++
+}
+
+// expired counts a pulse of channel that expired in a write queue.
+func (m *pulseMetrics) expired(channel string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats(channel).expired++
+}
+
+// skipped counts n slots of channel its loop skipped.
+func (m *pulseMetrics) skipped(channel string, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats(channel).skipped += uint64(n)
+}
+
+// observeFair records how a fair_delivery broadcast of channel went.
+func (m *pulseMetrics) observeFair(channel string, r fairReport) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.stats(channel)
+	if s.spread == nil {
+		s.spread = newHistogram(spreadBuckets)
+	}
+	s.fair = &r
+	if r.clients > 0 {
+		s.spread.observe(r.spread.Seconds())
+	}
+}
+
+// write appends the pulse metrics to b.
+func (m *pulseMetrics) write(b *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.channels))
+	for name := range m.channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	label := func(name string) string { return `channel="` + labelEscaper.Replace(name) + `"` }
+	family := func(name, typ, help string, value func(*channelPulseStats) string) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, n := range names {
+			fmt.Fprintf(b, "%s{%s} %s\n", name, label(n), value(m.channels[n]))
+		}
+	}
+	family("pulse_pulses_total", "counter", "Pulses emitted.", func(s *channelPulseStats) string {
+		return strconv.FormatUint(s.pulses, 10)
+	})
+	family("pulse_write_failures_total", "counter", "Pulse frames that could not be written; the client is dropped.", func(s *channelPulseStats) string {
+		return strconv.FormatUint(s.writeFailures, 10)
+	})
+	family("pulse_broadcast_write_failures", "gauge", "Clients dropped in the latest broadcast.", func(s *channelPulseStats) string {
+		return strconv.Itoa(s.lastFailures)
+	})
+	family("pulse_queue_dropped_total", "counter", "Pulses dropped from full client write queues.", func(s *channelPulseStats) string {
+		return strconv.FormatUint(s.dropped, 10)
+	})
+	family("pulse_fanout_shards", "gauge", "Shards the latest fan-out was split into, queued for in parallel.", func(s *channelPulseStats) string {
+		return strconv.Itoa(s.shards)
+	})
+	family("pulse_queue_expired_total", "counter", "Pulses that expired in client write queues and were not sent.", func(s *channelPulseStats) string {
+		return strconv.FormatUint(s.expired, 10)
+	})
+	family("pulse_skipped_total", "counter", "Pulses skipped because the loop fell behind by more than a period; announced with a resync message.", func(s *channelPulseStats) string {
+		return strconv.FormatUint(s.skipped, 10)
+	})
+	name := "pulse_jitter_seconds"
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", name, "How much later than scheduled each channel's recent pulses went out: minimum (quantile 0), median, 99th percentile and maximum (quantile 1) of the most recent "+strconv.Itoa(delayWindow)+".", name)
+	for _, n := range names {
+		s := m.channels[n]
+		if len(s.delays.samples) == 0 {
+			continue
+		}
+		sorted := s.delays.sorted()
+		for _, q := range []float64{0, 0.5, 0.99, 1} {
+			fmt.Fprintf(b, "%s{%s,quantile=\"%g\"} %g\n", name, label(n), q, percentile(sorted, q).Seconds())
+		}
+	}
+	histograms := []struct {
+		name, help string
+		get        func(*channelPulseStats) *histogram
+	}{
+		{"pulse_drift_seconds", "How much later than scheduled pulses went out.", func(s *channelPulseStats) *histogram { return s.drift }},
+		{"pulse_broadcast_duration_seconds", "Time to queue a pulse for all subscribers.", func(s *channelPulseStats) *histogram { return s.broadcast }},
+		{"pulse_fanout_slowest_shard_seconds", "Time from the start of a fan-out until its slowest shard had queued the pulse for its subscribers.", func(s *channelPulseStats) *histogram { return s.slowestShard }},
+	}
+	for _, hg := range histograms {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", hg.name, hg.help, hg.name)
+		for _, n := range names {
+			hg.get(m.channels[n]).write(b, hg.name, label(n))
+		}
+	}
+
+	// The fair_delivery families only list channels with the feature on.
+	var fair []string
+	for _, n := range names {
+		if m.channels[n].fair != nil {
+			fair = append(fair, n)
+		}
+	}
+	if len(fair) == 0 {
+		return
+	}
+	fairFamily := func(name, help string, value func(*fairReport) string) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, n := range fair {
+			fmt.Fprintf(b, "%s{%s} %s\n", name, label(n), value(m.channels[n].fair))
+		}
+	}
+	fairFamily("pulse_fair_clients", "Clients the latest fair_delivery pulse was equalized across.", func(r *fairReport) string {
+		return strconv.Itoa(r.clients)
+	})
+	fairFamily("pulse_fair_excluded_clients", "Clients sent the latest fair_delivery pulse at once: no RTT yet, or slower than PULSE_FAIR_MAX_MS.", func(r *fairReport) string {
+		return strconv.Itoa(r.excluded)
+	})
+	fairFamily("pulse_fair_target_seconds", "One-way latency the latest fair_delivery pulse was equalized to.", func(r *fairReport) string {
+		return strconv.FormatFloat(r.target.Seconds(), 'g', -1, 64)
+	})
+	name = "pulse_fair_arrival_spread_seconds"
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", name, "Estimated spread of a fair_delivery pulse's arrival across equalized clients.", name)
+	for _, n := range fair {
+		m.channels[n].spread.write(b, name, label(n))
+	}
+}
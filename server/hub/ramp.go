@@ -0,0 +1,64 @@
+package hub
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxRampPulses bounds how many pulses a ramp may take.
+const maxRampPulses = 10000
+
+// tempoRamp moves a channel's period to target over a number of pulses
+// instead of at once, so clients predicting pulses never see a jump. The
+// tempo (pulses per minute) changes linearly: the k-th of n ramp pulses has
+// the period 1/(1/from + (1/target - 1/from)·k/n), the last one target.
+type tempoRamp struct {
+	target time.Duration
+	pulses int
+
+	from time.Duration
+	done int // ramp pulses sent
+}
+
+// rampTarget is the target period of a ramp given in milliseconds or, if
+// bpm is set, beats per minute; milliseconds are bounded before they are
+// converted, which could overflow.
+func rampTarget(periodMS int64, bpm float64) (time.Duration, error) {
+	if bpm > 0 {
+		return bpmPeriod(bpm), nil
+	}
+	if !validPeriodMS(periodMS) {
+		return 0, fmt.Errorf("target period must be in [%s, %s]", minChannelPeriod, maxChannelPeriod)
+	}
+	return time.Duration(periodMS) * time.Millisecond, nil
+}
+
+// startRamp schedules a ramp to target over pulses, starting with the
+// pulse clients already expect. A later ramp or period change replaces it.
+func (ch *pulseChannel) startRamp(target time.Duration, pulses int) error {
+	if target < minChannelPeriod || target > maxChannelPeriod {
+		return fmt.Errorf("target period must be in [%s, %s]", minChannelPeriod, maxChannelPeriod)
+	}
+	if pulses < 1 || pulses > maxRampPulses {
+		return fmt.Errorf("pulses must be in [1, %d]", maxRampPulses)
+	}
+	ch.ramp.Store(&tempoRamp{target: target, pulses: pulses})
+	return nil
+}
+
+// step returns the period of the next ramp pulse and how many ramp pulses,
+// this one included, are left.
+func (r *tempoRamp) step() (period time.Duration, left int) {
+	r.done++
+	if r.done >= r.pulses {
+		return r.target, 1
+	}
+	f := float64(r.done) / float64(r.pulses)
+	rate := 1/float64(r.from) + (1/float64(r.target)-1/float64(r.from))*f
+	return time.Duration(1 / rate), r.pulses - r.done + 1
+}
+
+// finished reports whether the last ramp pulse has been sent.
+func (r *tempoRamp) finished() bool {
+	return r.done >= r.pulses
+}
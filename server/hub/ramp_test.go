@@ -0,0 +1,27 @@
+package hub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRampTarget(t *testing.T) {
+	for _, tc := range []struct {
+		periodMS int64
+		bpm      float64
+		want     time.Duration
+		ok       bool
+	}{
+		{periodMS: 400, want: 400 * time.Millisecond, ok: true},
+		{bpm: 120, want: 500 * time.Millisecond, ok: true},
+		{periodMS: 0},
+		{periodMS: maxChannelPeriod.Milliseconds() + 1},
+		// Multiplied by a million, this wraps around to about 99ms.
+		{periodMS: 18446744073809},
+	} {
+		got, err := rampTarget(tc.periodMS, tc.bpm)
+		if ok := err == nil; ok != tc.ok || got != tc.want {
+			t.Errorf("rampTarget(%d, %v) = %v, %v; want %v, ok %t", tc.periodMS, tc.bpm, got, err, tc.want, tc.ok)
+		}
+	}
+}
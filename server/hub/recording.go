@@ -0,0 +1,259 @@
+package hub
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"pulse/clock"
+)
+
+// Recording and replay, for reproducing client sync bugs. With
+// PULSE_RECORD set, every pulse and transport change the server emits is
+// appended to that file as a line of JSON: the backplane's message (see
+// backplane.go) plus sent_unix_nano, when it actually went out. With
+// PULSE_REPLAY set to such a file, the server runs no pulse loops and
+// sends the recorded messages instead, each as long after the first as it
+// was sent in the recording. seq, drift_ms and every other field are kept;
+// now_ms, next_ms and at_ms are moved by the time between the recording and
+// the replay, so clients sync to the replay as they did to the original.
+
+// recordBuffer is how many records wait to be written before new ones are
+// dropped; emission never waits for the disk.
+const recordBuffer = 1024
+
+// recordedMessage is one line of a recording.
+type recordedMessage struct {
+	backplaneMessage
+	SentUnixNano int64 `json:"sent_unix_nano"`
+}
+
+// recorder appends emitted messages to a recording.
+type recorder struct {
+	path string
+	out  chan recordedMessage
+	done chan struct{}
+
+	mu sync.Mutex
+	// dropped counts records lost to a full buffer since the last warning.
+	dropped int
+}
+
+func startRecorder(path string) (*recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	r := &recorder{path: path, out: make(chan recordedMessage, recordBuffer), done: make(chan struct{})}
+	go r.writeLoop(f)
+	slog.Info("recording pulses", "to", path)
+	return r, nil
+}
+
+// pulse records msg, due at scheduled and sent at sent; it does nothing on
+// a nil recorder.
+func (r *recorder) pulse(msg PulseMessage, scheduled, sent time.Time) {
+	if r == nil {
+		return
+	}
+	r.record(recordedMessage{
+		backplaneMessage: backplaneMessage{
+			Channel:           msg.Channel,
+			ScheduledUnixNano: scheduled.UnixNano(),
+			LeadNS:            int64(msg.Lead),
+			Pulse:             &msg,
+		},
+		SentUnixNano: sent.UnixNano(),
+	})
+}
+
+func (r *recorder) transport(msg transportMessage) {
+	if r == nil {
+		return
+	}
+	r.record(recordedMessage{
+		backplaneMessage: backplaneMessage{Channel: msg.Channel, Transport: &msg},
+		SentUnixNano:     time.Now().UnixNano(),
+	})
+}
+
+func (r *recorder) resync(msg resyncMessage) {
+	if r == nil {
+		return
+	}
+	r.record(recordedMessage{
+		backplaneMessage: backplaneMessage{Channel: msg.Channel, Resync: &msg},
+		SentUnixNano:     time.Now().UnixNano(),
+	})
+}
+
+func (r *recorder) preroll(msg prerollMessage) {
+	if r == nil {
+		return
+	}
+	r.record(recordedMessage{
+		backplaneMessage: backplaneMessage{Channel: msg.Channel, Preroll: &msg},
+		SentUnixNano:     time.Now().UnixNano(),
+	})
+}
+
+func (r *recorder) record(m recordedMessage) {
+	select {
+	case r.out <- m:
+	default:
+		r.mu.Lock()
+		r.dropped++
+		r.mu.Unlock()
+	}
+}
+
+func (r *recorder) writeLoop(f *os.File) {
+	defer close(r.done)
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for m := range r.out {
+		if err := enc.Encode(m); err != nil {
+			slog.Error("record", "err", err)
+		}
+		// Write out whenever the queue runs dry, so a crash loses little.
+		if len(r.out) == 0 {
+			if err := w.Flush(); err != nil {
+				slog.Error("record", "err", err)
+			}
+		}
+		r.mu.Lock()
+		if r.dropped > 0 {
+			slog.Warn("record: buffer full, messages not recorded", "dropped", r.dropped)
+			r.dropped = 0
+		}
+		r.mu.Unlock()
+	}
+	if err := w.Flush(); err != nil {
+		slog.Error("record", "err", err)
+	}
+	if err := f.Close(); err != nil {
+		slog.Error("record", "err", err)
+	}
+}
+
+// close writes out what is still queued. Nothing may be recorded after it.
+func (r *recorder) close() {
+	if r == nil {
+		return
+	}
+	close(r.out)
+	<-r.done
+}
+
+// replayer sends a recording's messages in place of the pulse loops.
+type replayer struct {
+	path string
+}
+
+// openReplay checks that path is a readable recording.
+func openReplay(path string) (*replayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &replayer{path: path}, f.Close()
+}
+
+// run replays the recording to h's clients until it ends or ctx is done.
+// Once it has ended, its channels' clients are told no more pulses come.
+func (p *replayer) run(ctx context.Context, h *Hub) {
+	defer func() {
+		if ctx.Err() == nil {
+			h.endReplay()
+		}
+	}()
+	f, err := os.Open(p.path)
+	if err != nil {
+		slog.Error("replay", "err", err)
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	var (
+		first, start time.Time
+		shift        time.Duration
+		n            int
+		unknown      = make(map[string]bool)
+	)
+	for sc.Scan() {
+		var m recordedMessage
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			slog.Error("replay: invalid record; stopping", "line", n+1, "err", err)
+			return
+		}
+		n++
+		sent := time.Unix(0, m.SentUnixNano)
+		if first.IsZero() {
+			first, start = sent, time.Now()
+			shift = start.Round(0).Sub(first)
+			slog.Info("replaying", "from", p.path, "recorded", first.Format(time.RFC3339))
+		}
+		if !clock.SleepUntilOr(ctx, start.Add(sent.Sub(first)), nil) {
+			return
+		}
+		ch := h.channel(m.Channel)
+		if ch == nil {
+			if !unknown[m.Channel] {
+				unknown[m.Channel] = true
+				slog.Warn("replay: channel not configured here; skipping it", "channel", m.Channel)
+			}
+			continue
+		}
+		m.shift(shift)
+		h.relay(ch, m.backplaneMessage)
+	}
+	if err := sc.Err(); err != nil {
+		slog.Error("replay", "err", fmt.Errorf("read %s: %w", p.path, err))
+		return
+	}
+	slog.Info("replay finished", "messages", n)
+}
+
+// shift moves the message's wall clock times by d.
+func (m *recordedMessage) shift(d time.Duration) {
+	ms := d.Milliseconds()
+	if m.ScheduledUnixNano != 0 {
+		m.ScheduledUnixNano += int64(d)
+	}
+	if p := m.Pulse; p != nil {
+		p.NowMS += ms
+		p.NextMS += ms
+		if p.AtMS != 0 {
+			p.AtMS += ms
+		}
+		if p.PeriodUS != 0 {
+			us := d.Microseconds()
+			p.NowUS += us
+			p.NextUS += us
+			if p.AtUS != 0 {
+				p.AtUS += us
+			}
+		}
+	}
+	if t := m.Transport; t != nil {
+		t.NowMS += ms
+		if t.NextMS != 0 {
+			t.NextMS += ms
+		}
+	}
+	if r := m.Resync; r != nil {
+		r.NowMS += ms
+		r.NextMS += ms
+	}
+	if p := m.Preroll; p != nil {
+		p.NowMS += ms
+		p.AtMS += ms
+		p.NextMS += ms
+	}
+}
@@ -0,0 +1,49 @@
+package hub
+
+import (
+	"log/slog"
+	"time"
+)
+
+// resyncMessage tells a channel's clients that its loop skipped pulses:
+// the process stalled, e.g. a long GC pause, a suspended VM or an
+// overloaded host, and woke up with slots already gone by, which the grid
+// skips rather than bunching them up. Seq carries on by one, so without it
+// a client sees nothing but a long gap it might take for network loss;
+// with it, it knows no pulses went missing on the way, drops whatever it
+// predicted for the skipped slots and starts over from the new anchor: the
+// next pulse is seq, due at next_ms.
+type resyncMessage struct {
+	Type     string `json:"type"`
+	Channel  string `json:"channel"`
+	Skipped  int64  `json:"skipped"`
+	Seq      uint64 `json:"seq"`
+	NowMS    int64  `json:"now_ms"`
+	NextMS   int64  `json:"next_ms"`
+	PeriodMS int64  `json:"period_ms"`
+}
+
+// announceResync tells ch's clients its loop skipped skipped slots of
+// period; seq is the next pulse's, due at next.
+func (h *Hub) announceResync(ch *pulseChannel, skipped int64, seq uint64, next time.Time, period time.Duration) {
+	now := h.clock.Now()
+	msg := resyncMessage{
+		Type:     "resync",
+		Channel:  ch.name,
+		Skipped:  skipped,
+		Seq:      seq,
+		NowMS:    now.UnixMilli(),
+		NextMS:   now.Add(next.Sub(now) + h.offset()).UnixMilli(),
+		PeriodMS: period.Milliseconds(),
+	}
+	slog.Warn("pulse loop fell behind; skipped pulses", "channel", ch.name, "skipped", skipped, "seq", seq)
+	h.pulseMetrics.skipped(ch.name, skipped)
+	h.backplane.publishResync(msg)
+	h.relayResync(ch, msg)
+}
+
+// relayResync sends msg, a resync of ch, to ch's clients and records it.
+func (h *Hub) relayResync(ch *pulseChannel, msg resyncMessage) {
+	h.recorder.resync(msg)
+	h.BroadcastIf(msg, func(c *Conn) bool { return c.receives(ch.name) })
+}
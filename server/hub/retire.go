@@ -0,0 +1,214 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"pulse/ws"
+)
+
+// Retiring a channel. POST /admin/channels/{channel}/retire ends a channel
+// gracefully rather than leaving its clients to run into write errors: the
+// server fixes the channel's final pulse, at the end of a bar for a
+// channel with a tempo, and announces it to the channel's clients with
+// channel_retiring, so they can finish what they play on the last beat.
+// Once the final pulse has gone out the channel's pulse loop stops and
+// the channel is gone: it is no longer listed, subscribed to or upgraded
+// to, and every client still on it gets an end message (see end.go). A
+// client that
+// receives other channels too then just stops receiving this one; one
+// that does not is moved to the successor, if one was named, with a fresh
+// hello, and is otherwise closed with 1001 (going away). The channel comes
+// back on restart unless it is also taken out of PULSE_CHANNELS.
+
+// retireBody is POST /admin/channels/{channel}/retire. The channel ends
+// with pulse Seq, or for a channel with a tempo with the last beat of bar
+// Bar, counted as its pulses count bars; the end of the current bar by
+// default. Successor names the channel its clients are moved to, and
+// Reason is the end message's, "retired" by default.
+type retireBody struct {
+	Channel   string `json:"channel,omitempty"`
+	Seq       uint64 `json:"seq,omitempty"`
+	Bar       uint64 `json:"bar,omitempty"`
+	Successor string `json:"successor,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// retirement is a channel's announced end.
+type retirement struct {
+	finalSeq  uint64
+	successor string
+	reason    string
+}
+
+// channelRetiringMessage announces a channel's end: pulse final_seq, due
+// around final_ms if the period holds, is its last.
+type channelRetiringMessage struct {
+	Type      string `json:"type"`
+	Channel   string `json:"channel"`
+	FinalSeq  uint64 `json:"final_seq"`
+	FinalMS   int64  `json:"final_ms"`
+	Successor string `json:"successor,omitempty"`
+}
+
+var errRetiring = errors.New("channel is being retired")
+
+// retire schedules the end of the channel body names and announces it.
+func (h *Hub) retire(body retireBody) (channelRetiringMessage, error) {
+	var msg channelRetiringMessage
+	ch := h.channel(body.Channel)
+	switch {
+	case ch == nil:
+		return msg, errNoChannel
+	case ch.name == defaultChannel:
+		return msg, fmt.Errorf("the %s channel cannot be retired", defaultChannel)
+	case ch.retiring.Load() != nil:
+		return msg, fmt.Errorf("%w: channel %q", errRetiring, ch.name)
+	case ch.transport.isPaused():
+		return msg, fmt.Errorf("channel %q is paused; resume it first", ch.name)
+	}
+	if by := h.drivenBy(ch); by != "" {
+		return msg, fmt.Errorf("%w: the %s channel's pulses come from the %s", errDriven, ch.name, by)
+	}
+	if body.Reason == "" {
+		body.Reason = endRetired
+	} else if !validName(body.Reason) {
+		return msg, fmt.Errorf("reason must be 1 to 64 letters, digits, '.', '_' or '-'")
+	}
+	if body.Successor != "" {
+		succ := h.channel(body.Successor)
+		switch {
+		case succ == nil:
+			return msg, fmt.Errorf("unknown successor %q", body.Successor)
+		case succ == ch:
+			return msg, fmt.Errorf("a channel cannot succeed itself")
+		case succ.retiring.Load() != nil:
+			return msg, fmt.Errorf("successor %q is being retired too", succ.name)
+		}
+	}
+	last := ch.last.Load()
+	if last == nil {
+		return msg, fmt.Errorf("channel %q has not pulsed yet", ch.name)
+	}
+	final := body.Seq
+	switch {
+	case body.Seq != 0 && body.Bar != 0:
+		return msg, fmt.Errorf("give seq or bar, not both")
+	case body.Bar != 0 && ch.tempo == nil:
+		return msg, fmt.Errorf("channel %q has no tempo, so no bars; give seq", ch.name)
+	case body.Bar != 0:
+		final = ch.tempo.barEnd(body.Bar)
+	case body.Seq == 0 && ch.tempo == nil:
+		return msg, fmt.Errorf("channel %q has no tempo; give the final seq", ch.name)
+	case body.Seq == 0:
+		// The end of the current bar, or of the next if this one ends
+		// with the coming pulse and clients would have no warning.
+		bar, _ := ch.tempo.position(last.seq + 1)
+		final = ch.tempo.barEnd(bar)
+		if final < last.seq+2 {
+			final = ch.tempo.barEnd(bar + 1)
+		}
+	}
+	// Clients need at least one pulse's warning.
+	if final < last.seq+2 {
+		return msg, fmt.Errorf("the final pulse must be %d or later", last.seq+2)
+	}
+	r := &retirement{finalSeq: final, successor: body.Successor, reason: body.Reason}
+	if !ch.retiring.CompareAndSwap(nil, r) {
+		return msg, fmt.Errorf("%w: channel %q", errRetiring, ch.name)
+	}
+	msg = ch.retiringMessage(r, last)
+	slog.Info("channel retiring", "channel", ch.name, "final_seq", final, "successor", r.successor)
+	h.tellChannel(ch, msg)
+	return msg, nil
+}
+
+// relayRetiring takes in the retirement of ch an upstream announced; its
+// end follows from the upstream too.
+func (h *Hub) relayRetiring(ch *pulseChannel, msg channelRetiringMessage) {
+	if h.channel(msg.Successor) == nil {
+		// Not a channel here, so nowhere to move clients to.
+		msg.Successor = ""
+	}
+	r := &retirement{finalSeq: msg.FinalSeq, successor: msg.Successor, reason: endRetired}
+	if !ch.retiring.CompareAndSwap(nil, r) {
+		return
+	}
+	msg.Channel = ch.name
+	slog.Info("channel retiring", "channel", ch.name, "final_seq", r.finalSeq, "successor", r.successor)
+	h.tellChannel(ch, msg)
+}
+
+// tellChannel sends msg to ch's clients, and to relay connections wrapped
+// in a relayEnvelope, so downstream relays tell theirs.
+func (h *Hub) tellChannel(ch *pulseChannel, msg any) {
+	h.BroadcastIf(msg, func(c *Conn) bool { return c.proto != protoRelay && c.receives(ch.name) })
+	h.BroadcastIf(relayEnvelope{Type: "relay", Channel: ch.name, Message: msg}, func(c *Conn) bool { return c.proto == protoRelay })
+}
+
+// ending is what ch's new clients are told of its end: the end message
+// once it has ended, the announcement while it is retiring, else nil.
+func (ch *pulseChannel) ending() any {
+	if m := ch.ended.Load(); m != nil {
+		return m
+	}
+	if r, last := ch.retiring.Load(), ch.last.Load(); r != nil && last != nil {
+		return ch.retiringMessage(r, last)
+	}
+	return nil
+}
+
+// retiringMessage announces r for ch, whose latest pulse is last.
+func (ch *pulseChannel) retiringMessage(r *retirement, last *channelAnchor) channelRetiringMessage {
+	at := last.at.Add(time.Duration(r.finalSeq-last.seq) * ch.Period())
+	return channelRetiringMessage{Type: "channel_retiring", Channel: ch.name, FinalSeq: r.finalSeq, FinalMS: at.UnixMilli(), Successor: r.successor}
+}
+
+// barEnd is the seq of the last beat of bar.
+func (t *tempo) barEnd(bar uint64) uint64 {
+	return t.barSeq.Load() + bar*uint64(t.beatsPerBar) - 1
+}
+
+// finishRetirement removes ch once its final pulse has gone out, and
+// moves or closes the clients still on it.
+func (h *Hub) finishRetirement(ch *pulseChannel, r *retirement) {
+	ch.retired.Store(true)
+	var conns []*Conn
+	h.mu.RLock()
+	for c := range h.conns {
+		if !c.internal && c.proto != protoRelay && c.receives(ch.name) {
+			conns = append(conns, c)
+		}
+	}
+	h.mu.RUnlock()
+	h.endChannel(ch, endMessage{FinalSeq: r.finalSeq, Reason: r.reason, Successor: r.successor})
+
+	var closing []*Conn
+	for _, c := range conns {
+		moved := false
+		switch also := c.also.Load(); {
+		case also != nil && len(*also) > 0:
+			moved = h.unsubscribe(c, ch.name) == nil
+		case r.successor != "" && c.proto != protoLegacy:
+			// Legacy clients would not be told the period changed.
+			moved = h.subscribe(c, r.successor, 1, false) == nil
+		}
+		if !moved {
+			closing = append(closing, c)
+		}
+	}
+	if len(closing) == 0 {
+		return
+	}
+	// A close frame drops the pulses still queued, and the final one may
+	// be; after a period it has gone out or expired.
+	time.AfterFunc(ch.Period(), func() {
+		for _, c := range closing {
+			c.setCause(causeServer)
+			_ = c.writeClose(ws.CloseGoingAway, "channel retired")
+			_ = c.Close()
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package hub
+
+import "fmt"
+
+// role is what a credential may do. Each role includes the ones below it:
+// an observer reads status, stats and the audit log, a controller also
+// changes tempo and transport, and an admin also acts on clients and
+// manages signing keys.
+type role int
+
+const (
+	roleNone role = iota
+	roleObserver
+	roleController
+	roleAdmin
+)
+
+func parseRole(s string) (role, error) {
+	switch s {
+	case "observer":
+		return roleObserver, nil
+	case "controller":
+		return roleController, nil
+	case "admin":
+		return roleAdmin, nil
+	}
+	return roleNone, fmt.Errorf("unknown role %q, want admin, controller or observer", s)
+}
+
+func (r role) String() string {
+	switch r {
+	case roleObserver:
+		return "observer"
+	case roleController:
+		return "controller"
+	case roleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+// MarshalText lets roles appear by name in JSON.
+func (r role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *role) UnmarshalText(b []byte) error {
+	v, err := parseRole(string(b))
+	if err != nil {
+		return err
+	}
+	*r = v
+	return nil
+}
@@ -0,0 +1,166 @@
+package hub
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxRoundLength bounds a round; longer countdowns are better served by a
+// calendar than a pulse server.
+const maxRoundLength = 24 * time.Hour
+
+// roundBody starts a round: POST /admin/round {"round":3,"length_ms":30000}.
+// round 0 means the one after the last.
+type roundBody struct {
+	Round    int   `json:"round"`
+	LengthMS int64 `json:"length_ms"`
+}
+
+// roundState describes the current or last round. Times are server time,
+// Unix milliseconds, without the output offset: a round ends at the same
+// instant for everyone.
+type roundState struct {
+	Round       int   `json:"round"`
+	Running     bool  `json:"running"`
+	StartedMS   int64 `json:"started_ms"`
+	LengthMS    int64 `json:"length_ms"`
+	EndsMS      int64 `json:"ends_ms"`
+	RemainingMS int64 `json:"remaining_ms"`
+}
+
+// roundMessage is broadcast when a round starts ("round_start") and when it
+// ends ("round_end"); Cancelled marks a round stopped or replaced before its
+// time ran out.
+type roundMessage struct {
+	Type string `json:"type"`
+	roundState
+	Cancelled bool `json:"cancelled,omitempty"`
+}
+
+// roundPulse is the per-pulse countdown attached as "round" while a round
+// is running.
+type roundPulse struct {
+	Round       int   `json:"round"`
+	EndsMS      int64 `json:"ends_ms"`
+	RemainingMS int64 `json:"remaining_ms"`
+}
+
+// rounds runs timed rounds for quiz and auction style apps: every pulse
+// during a round carries the remaining time, and a round_end event goes out
+// the moment it is over rather than with the next pulse.
+type rounds struct {
+	h *Hub
+
+	mu      sync.Mutex
+	n       int
+	start   time.Time
+	end     time.Time
+	running bool
+	timer   *time.Timer
+}
+
+func newRounds(h *Hub) *rounds {
+	return &rounds{h: h}
+}
+
+// state returns the round as seen at now. The caller holds r.mu.
+func (r *rounds) state(now time.Time) roundState {
+	st := roundState{Round: r.n, Running: r.running}
+	if r.n == 0 {
+		return st
+	}
+	st.StartedMS = r.start.UnixMilli()
+	st.LengthMS = r.end.Sub(r.start).Milliseconds()
+	st.EndsMS = r.end.UnixMilli()
+	if r.running {
+		st.RemainingMS = max(r.end.Sub(now).Milliseconds(), 0)
+	}
+	return st
+}
+
+// begin starts round n (the next one when n is 0), cancelling any round
+// still running.
+func (r *rounds) begin(n int, length time.Duration) (roundState, error) {
+	if length <= 0 || length > maxRoundLength {
+		return roundState{}, fmt.Errorf("length_ms must be in (0, %d]", maxRoundLength.Milliseconds())
+	}
+	if n < 0 {
+		return roundState{}, fmt.Errorf("round must not be negative")
+	}
+	r.mu.Lock()
+	now := r.h.clock.Now()
+	var cancelled *roundMessage
+	if r.running {
+		r.timer.Stop()
+		cancelled = &roundMessage{Type: "round_end", roundState: r.state(now), Cancelled: true}
+	}
+	if n == 0 {
+		n = r.n + 1
+	}
+	r.n, r.start, r.end, r.running = n, now, now.Add(length), true
+	r.timer = time.AfterFunc(length, func() { r.finish(n) })
+	st := r.state(now)
+	r.mu.Unlock()
+
+	if cancelled != nil {
+		cancelled.Running = false
+		r.h.Broadcast(cancelled)
+	}
+	r.h.Broadcast(roundMessage{Type: "round_start", roundState: st})
+	return st, nil
+}
+
+// cancel stops the running round. It reports false if none was running.
+func (r *rounds) cancel() (roundState, bool) {
+	r.mu.Lock()
+	if !r.running {
+		r.mu.Unlock()
+		return roundState{}, false
+	}
+	r.timer.Stop()
+	st := r.state(r.h.clock.Now())
+	r.running = false
+	r.mu.Unlock()
+
+	st.Running = false
+	r.h.Broadcast(roundMessage{Type: "round_end", roundState: st, Cancelled: true})
+	return st, true
+}
+
+// finish ends round n when its timer fires, unless it was replaced or
+// cancelled in the meantime.
+func (r *rounds) finish(n int) {
+	r.mu.Lock()
+	if !r.running || r.n != n {
+		r.mu.Unlock()
+		return
+	}
+	r.running = false
+	st := r.state(r.h.clock.Now())
+	r.mu.Unlock()
+	r.h.Broadcast(roundMessage{Type: "round_end", roundState: st})
+}
+
+// enrich is registered as a pulse enricher: pulses carry the countdown of
+// the running round as of their now_ms.
+func (r *rounds) enrich(msg PulseMessage) map[string]any {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.running {
+		return nil
+	}
+	st := r.state(time.UnixMilli(msg.NowMS))
+	return map[string]any{"round": roundPulse{Round: st.Round, EndsMS: st.EndsMS, RemainingMS: st.RemainingMS}}
+}
+
+// handler serves GET /api/round.
+func (r *rounds) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		r.mu.Lock()
+		st := r.state(r.h.clock.Now())
+		r.mu.Unlock()
+		writeJSON(w, http.StatusOK, st)
+	}
+}
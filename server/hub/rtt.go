@@ -0,0 +1,165 @@
+package hub
+
+import (
+	"encoding/binary"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"pulse/clock"
+)
+
+// maxRTT discards pongs that answer a ping older than this; they are most
+// likely from before a long stall and say nothing about the path now.
+const maxRTT = time.Minute
+
+// rttStats tracks a connection's round-trip time from keepalive pings. The
+// smoothed RTT and its variation (the jitter) are kept as in TCP's RTO
+// estimator (RFC 6298), so one slow pong moves them only by an eighth.
+type rttStats struct {
+	mu      sync.Mutex
+	samples int
+	// first is closed by the first sample; see firstSample.
+	first  chan struct{}
+	last   time.Duration
+	min    time.Duration
+	srtt   time.Duration
+	rttvar time.Duration
+}
+
+// rttSnapshot is the admin view of rttStats.
+type rttSnapshot struct {
+	Samples  int     `json:"samples"`
+	LastMS   float64 `json:"last_ms"`
+	MinMS    float64 `json:"min_ms"`
+	SmoothMS float64 `json:"smooth_ms"`
+	JitterMS float64 `json:"jitter_ms"`
+}
+
+// pingPayload stamps a keepalive ping with the monotonic time it was sent,
+// which the pong echoes back.
+func pingPayload(now time.Time) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(now.Sub(clock.Start)))
+}
+
+// observePong records the round trip of a pong answering one of our pings.
+// Pongs with other payloads (unsolicited, or from a client that does not
+// echo) are ignored.
+func (r *rttStats) observePong(payload []byte, now time.Time) {
+	if len(payload) != 8 {
+		return
+	}
+	rtt := now.Sub(clock.Start) - time.Duration(binary.BigEndian.Uint64(payload))
+	if rtt < 0 || rtt > maxRTT {
+		return
+	}
+	r.observe(rtt)
+}
+
+func (r *rttStats) observe(rtt time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.samples == 0 {
+		r.min, r.srtt, r.rttvar = rtt, rtt, rtt/2
+	} else {
+		r.min = min(r.min, rtt)
+		r.rttvar += ((r.srtt - rtt).Abs() - r.rttvar) / 4
+		r.srtt += (rtt - r.srtt) / 8
+	}
+	r.last = rtt
+	r.samples++
+	if r.samples == 1 && r.first != nil {
+		close(r.first)
+	}
+}
+
+// firstSample returns a channel closed once there is a sample.
+func (r *rttStats) firstSample() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.first == nil {
+		r.first = make(chan struct{})
+		if r.samples > 0 {
+			close(r.first)
+		}
+	}
+	return r.first
+}
+
+// smoothed returns the smoothed RTT, if there is a sample yet.
+func (r *rttStats) smoothed() (time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.srtt, r.samples > 0
+}
+
+// snapshot returns the stats, or nil before the first sample.
+func (r *rttStats) snapshot() *rttSnapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.samples == 0 {
+		return nil
+	}
+	return &rttSnapshot{
+		Samples:  r.samples,
+		LastMS:   msFloat(r.last),
+		MinMS:    msFloat(r.min),
+		SmoothMS: msFloat(r.srtt),
+		JitterMS: msFloat(r.rttvar),
+	}
+}
+
+// latencyReport is served by GET /admin/latency: RTT percentiles over all
+// measured clients and the worst of them.
+type latencyReport struct {
+	Clients  int          `json:"clients"`
+	Measured int          `json:"measured"`
+	P50MS    float64      `json:"p50_ms"`
+	P90MS    float64      `json:"p90_ms"`
+	P99MS    float64      `json:"p99_ms"`
+	MaxMS    float64      `json:"max_ms"`
+	Worst    []clientInfo `json:"worst"`
+}
+
+const (
+	defaultWorstClients = 10
+	maxWorstClients     = 100
+)
+
+// latencyHandler serves GET /admin/latency?worst=N.
+func latencyHandler(h *Hub, lagThreshold time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := defaultWorstClients
+		if s := r.URL.Query().Get("worst"); s != "" {
+			v, err := strconv.Atoi(s)
+			if err != nil || v < 0 {
+				http.Error(w, "invalid worst", http.StatusBadRequest)
+				return
+			}
+			n = min(v, maxWorstClients)
+		}
+		all := h.clients(lagThreshold)
+		rep := latencyReport{Clients: len(all), Worst: []clientInfo{}}
+		measured := all[:0:0]
+		for _, c := range all {
+			if c.RTT != nil {
+				measured = append(measured, c)
+			}
+		}
+		rep.Measured = len(measured)
+		if len(measured) > 0 {
+			sort.Slice(measured, func(i, j int) bool { return measured[i].RTT.SmoothMS > measured[j].RTT.SmoothMS })
+			pct := func(p float64) float64 {
+				i := int(math.Ceil(p*float64(len(measured)))) - 1
+				return measured[len(measured)-1-max(i, 0)].RTT.SmoothMS
+			}
+			rep.P50MS, rep.P90MS, rep.P99MS = pct(0.5), pct(0.9), pct(0.99)
+			rep.MaxMS = measured[0].RTT.SmoothMS
+			rep.Worst = measured[:min(n, len(measured))]
+		}
+		writeJSON(w, http.StatusOK, rep)
+	}
+}
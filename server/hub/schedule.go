@@ -0,0 +1,295 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Scheduled cues. A two-phase cue (cues.go) asks every client whether it
+// can act; a scheduled cue just tells them when to. POST /admin/schedule
+// names a one-shot event with an arbitrary payload for a pulse or for an
+// absolute time, and the server announces it to the channel's clients
+// lead_ms ahead as a cue message carrying its target: seq for a pulse, and
+// at_ms, when it is due, either way, so clients can fire it on the beat.
+// Clients that connect between the announcement and the target get it
+// after their hello. A cue cancelled once announced is withdrawn with
+// cue_cancel.
+const (
+	defaultCueLead = time.Second
+	maxCueLead     = time.Minute
+	// maxCueHorizon is how far ahead a cue may be scheduled for a time.
+	maxCueHorizon    = 24 * time.Hour
+	maxScheduledCues = 1000
+)
+
+// scheduleBody is POST /admin/schedule:
+// {"name":"scene","channel":"default","seq":1200,"payload":{"scene":4}} or
+// {"name":"scene","at_ms":1767225600000}. Give seq or at_ms, not both.
+// Channel defaults to the default channel, ID to a generated one and
+// LeadMS, how far ahead the cue is announced, to a second.
+type scheduleBody struct {
+	ID      string          `json:"id,omitempty"`
+	Name    string          `json:"name"`
+	Channel string          `json:"channel,omitempty"`
+	Seq     uint64          `json:"seq,omitempty"`
+	AtMS    int64           `json:"at_ms,omitempty"`
+	LeadMS  int64           `json:"lead_ms,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// cueMessage announces a scheduled cue. AtMS is when it is due, in server
+// time; for a pulse, when the pulse is due if the period holds.
+type cueMessage struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id"`
+	Name    string          `json:"name"`
+	Channel string          `json:"channel"`
+	Seq     uint64          `json:"seq,omitempty"`
+	AtMS    int64           `json:"at_ms"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// cueCancelMessage withdraws an announced cue.
+type cueCancelMessage struct {
+	Type    string `json:"type"`
+	ID      string `json:"id"`
+	Channel string `json:"channel"`
+}
+
+// scheduledCue is a cue waiting for its announcement or its target.
+type scheduledCue struct {
+	msg       cueMessage
+	lead      time.Duration
+	announced bool
+	// timer announces, then drops, a cue for a time; cues for a pulse
+	// follow their channel's pulses.
+	timer *time.Timer
+}
+
+// scheduledState is a cue in GET /admin/schedule.
+type scheduledState struct {
+	cueMessage
+	LeadMS    int64 `json:"lead_ms"`
+	Announced bool  `json:"announced"`
+}
+
+// cueSchedule keeps the scheduled cues whose target has not passed.
+type cueSchedule struct {
+	h *Hub
+
+	mu   sync.Mutex
+	cues []*scheduledCue
+}
+
+// newScheduledCue validates body, filling in its defaults.
+func (h *Hub) newScheduledCue(body scheduleBody) (*scheduledCue, *pulseChannel, error) {
+	if body.Channel == "" {
+		body.Channel = defaultChannel
+	}
+	if body.ID == "" {
+		body.ID = newRequestID()[:12]
+	}
+	ch := h.channel(body.Channel)
+	switch {
+	case ch == nil:
+		return nil, nil, fmt.Errorf("unknown channel %q", body.Channel)
+	case !validName(body.Name):
+		return nil, nil, fmt.Errorf("name must be 1 to 64 letters, digits, '.', '_' or '-'")
+	case len(body.Payload) > maxCuePayload:
+		return nil, nil, fmt.Errorf("payload must be at most %d bytes", maxCuePayload)
+	case body.LeadMS < 0 || body.LeadMS > maxCueLead.Milliseconds():
+		return nil, nil, fmt.Errorf("lead_ms must be in [0, %d]", maxCueLead.Milliseconds())
+	case body.Seq == 0 && body.AtMS == 0:
+		return nil, nil, fmt.Errorf("seq or at_ms required")
+	case body.Seq != 0 && body.AtMS != 0:
+		return nil, nil, fmt.Errorf("give seq or at_ms, not both")
+	}
+	lead := time.Duration(body.LeadMS) * time.Millisecond
+	if body.LeadMS == 0 {
+		lead = defaultCueLead
+	}
+	return &scheduledCue{msg: cueMessage{Type: "cue", ID: body.ID, Name: body.Name, Channel: ch.name, Seq: body.Seq, AtMS: body.AtMS, Payload: body.Payload}, lead: lead}, ch, nil
+}
+
+// add validates body and schedules its cue, announcing it at once if it
+// is due within its lead.
+func (s *cueSchedule) add(body scheduleBody) (scheduledState, error) {
+	sc, ch, err := s.h.newScheduledCue(body)
+	if err != nil {
+		return scheduledState{}, err
+	}
+	body.ID = sc.msg.ID
+	lead := sc.lead
+	now := s.h.clock.Now()
+	var at time.Time
+	if body.Seq != 0 {
+		last, period := ch.last.Load(), ch.Period()
+		switch {
+		case last == nil:
+			return scheduledState{}, fmt.Errorf("channel %q has not pulsed yet", ch.name)
+		case body.Seq <= last.seq:
+			return scheduledState{}, fmt.Errorf("seq must be at least %d", last.seq+1)
+		case body.Seq-last.seq > cueHorizonPulses(period):
+			return scheduledState{}, fmt.Errorf("seq must be at most %d, within %s", last.seq+cueHorizonPulses(period), maxCueHorizon)
+		}
+		at = last.at.Add(time.Duration(body.Seq-last.seq) * period)
+		sc.msg.AtMS = at.UnixMilli()
+	} else {
+		at = time.UnixMilli(body.AtMS)
+		switch {
+		case !at.After(now):
+			return scheduledState{}, fmt.Errorf("at_ms has passed")
+		case at.Sub(now) > maxCueHorizon:
+			return scheduledState{}, fmt.Errorf("at_ms must be within %s", maxCueHorizon)
+		}
+	}
+
+	s.mu.Lock()
+	switch {
+	case slices.ContainsFunc(s.cues, func(o *scheduledCue) bool { return o.msg.ID == body.ID }):
+		s.mu.Unlock()
+		return scheduledState{}, fmt.Errorf("cue %q is already scheduled", body.ID)
+	case len(s.cues) >= maxScheduledCues:
+		s.mu.Unlock()
+		return scheduledState{}, fmt.Errorf("%d cues are scheduled already", maxScheduledCues)
+	}
+	s.cues = append(s.cues, sc)
+	if body.AtMS != 0 {
+		sc.timer = time.AfterFunc(at.Add(-lead).Sub(now), func() { s.announceAt(sc) })
+	}
+	s.mu.Unlock()
+	slog.Info("cue scheduled", "id", body.ID, "name", body.Name, "channel", ch.name, "seq", body.Seq, "at_ms", sc.msg.AtMS)
+	if body.Seq != 0 && at.Sub(now) <= lead {
+		s.announce(sc, at)
+	}
+	return s.state(sc), nil
+}
+
+// cueHorizonPulses is how many pulses of period fit in maxCueHorizon; a
+// cue for a pulse further on would overflow its time.
+func cueHorizonPulses(period time.Duration) uint64 {
+	return uint64(maxCueHorizon / period)
+}
+
+// announce broadcasts sc, due at at, unless it went out already or was
+// cancelled.
+func (s *cueSchedule) announce(sc *scheduledCue, at time.Time) {
+	s.mu.Lock()
+	if sc.announced || !slices.Contains(s.cues, sc) {
+		s.mu.Unlock()
+		return
+	}
+	sc.announced = true
+	sc.msg.AtMS = at.UnixMilli()
+	msg := sc.msg
+	s.mu.Unlock()
+	s.h.BroadcastIf(msg, func(c *Conn) bool { return c.receives(msg.Channel) })
+}
+
+// announceAt announces a cue for a time and drops it once it is due.
+func (s *cueSchedule) announceAt(sc *scheduledCue) {
+	at := time.UnixMilli(sc.msg.AtMS)
+	s.announce(sc, at)
+	s.mu.Lock()
+	sc.timer = time.AfterFunc(at.Sub(s.h.clock.Now()), func() { s.drop(sc) })
+	s.mu.Unlock()
+}
+
+// pulse announces the cues of ch that the pulse after seq, which has just
+// gone out as scheduled, would announce too late, and drops those whose
+// pulse this was.
+func (s *cueSchedule) pulse(ch *pulseChannel, seq uint64, scheduled time.Time) {
+	channel, period := ch.name, ch.Period()
+	type due struct {
+		sc *scheduledCue
+		at time.Time
+	}
+	var announce []due
+	s.mu.Lock()
+	s.cues = slices.DeleteFunc(s.cues, func(sc *scheduledCue) bool {
+		if sc.msg.Channel != channel || sc.msg.Seq == 0 {
+			return false
+		}
+		if sc.msg.Seq <= seq {
+			return true
+		}
+		if n := sc.msg.Seq - seq - 1; !sc.announced && n < cueHorizonPulses(period) && time.Duration(n)*period < sc.lead {
+			_, swing := ch.swing(sc.msg.Seq, period)
+			announce = append(announce, due{sc, scheduled.Add(time.Duration(sc.msg.Seq-seq)*period + swing)})
+		}
+		return false
+	})
+	s.mu.Unlock()
+	for _, d := range announce {
+		s.announce(d.sc, d.at)
+	}
+}
+
+// drop forgets sc once its time has come.
+func (s *cueSchedule) drop(sc *scheduledCue) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cues = slices.DeleteFunc(s.cues, func(o *scheduledCue) bool { return o == sc })
+}
+
+// cancel unschedules cue id, withdrawing it if it was announced, and
+// reports whether it was scheduled.
+func (s *cueSchedule) cancel(id string) bool {
+	s.mu.Lock()
+	i := slices.IndexFunc(s.cues, func(sc *scheduledCue) bool { return sc.msg.ID == id })
+	if i < 0 {
+		s.mu.Unlock()
+		return false
+	}
+	sc := s.cues[i]
+	s.cues = slices.Delete(s.cues, i, i+1)
+	if sc.timer != nil {
+		sc.timer.Stop()
+	}
+	s.mu.Unlock()
+	slog.Info("cue unscheduled", "id", id, "channel", sc.msg.Channel, "announced", sc.announced)
+	if sc.announced {
+		msg := cueCancelMessage{Type: "cue_cancel", ID: id, Channel: sc.msg.Channel}
+		s.h.BroadcastIf(msg, func(c *Conn) bool { return c.receives(msg.Channel) })
+	}
+	return true
+}
+
+// current returns the cues announced for c's channels and not yet due,
+// for clients that connect after the announcement.
+func (s *cueSchedule) current(c *Conn, now time.Time) []cueMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []cueMessage
+	for _, sc := range s.cues {
+		if sc.announced && sc.msg.AtMS > now.UnixMilli() && c.receives(sc.msg.Channel) {
+			out = append(out, sc.msg)
+		}
+	}
+	return out
+}
+
+func (s *cueSchedule) state(sc *scheduledCue) scheduledState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return scheduledState{cueMessage: sc.msg, LeadMS: sc.lead.Milliseconds(), Announced: sc.announced}
+}
+
+// handler serves GET /admin/schedule, the cues whose target has not
+// passed.
+func (s *cueSchedule) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		s.mu.Lock()
+		out := make([]scheduledState, 0, len(s.cues))
+		for _, sc := range s.cues {
+			out = append(out, scheduledState{cueMessage: sc.msg, LeadMS: sc.lead.Milliseconds(), Announced: sc.announced})
+		}
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, out)
+	}
+}
@@ -0,0 +1,38 @@
+package hub
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleCueRange(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body scheduleBody
+		err  string
+	}{
+		{"next pulse", scheduleBody{Seq: 11}, ""},
+		{"within a day", scheduleBody{Seq: 10 + uint64(maxCueHorizon/time.Second)}, ""},
+		{"past a day", scheduleBody{Seq: 11 + uint64(maxCueHorizon/time.Second)}, "seq must be at most"},
+		{"overflow", scheduleBody{Seq: math.MaxUint64}, "seq must be at most"},
+		{"past", scheduleBody{Seq: 10}, "seq must be at least"},
+		{"no target", scheduleBody{}, "seq or at_ms required"},
+		{"both", scheduleBody{Seq: 11, AtMS: 1}, "not both"},
+		{"lead overflow", scheduleBody{Seq: 11, LeadMS: math.MaxInt64 / 1000}, "lead_ms must be"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := New(time.Second)
+			h.channel(defaultChannel).last.Store(&channelAnchor{seq: 10, at: time.Now(), period: time.Second})
+			tc.body.Name = "cue"
+			_, err := h.schedule.add(tc.body)
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatalf("add: %v", err)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Fatalf("add: err %v, want %q", err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package hub
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keySecrets holds the admin signing keys created through the secrets API,
+// sealed with the master key so a copied store does not give them away.
+const keySecrets = "secrets"
+
+// maxRotationGrace bounds how long a rotated key's previous secret keeps
+// working, long enough for automation to switch over.
+const maxRotationGrace = time.Hour
+
+// sealedSecrets is what the store holds: a secretSet encrypted with
+// AES-256-GCM. KeyID names the master key it was sealed with, so a wrong
+// key is reported as such rather than as corrupt data.
+type sealedSecrets struct {
+	KeyID string `json:"key_id"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+type secretSet struct {
+	Keys map[string]storedKey `json:"keys"`
+}
+
+// storedKey is a signing key. After a rotation the previous secret keeps
+// working until PreviousUntil, so automation can switch over. Keys stored
+// without a role are admin keys.
+type storedKey struct {
+	Secret        string     `json:"secret"`
+	Role          role       `json:"role,omitempty"`
+	Created       time.Time  `json:"created"`
+	Previous      string     `json:"previous,omitempty"`
+	PreviousUntil *time.Time `json:"previous_until,omitempty"`
+}
+
+// secretInfo describes a stored key without its secret.
+type secretInfo struct {
+	KeyID         string     `json:"key_id"`
+	Role          role       `json:"role"`
+	Created       time.Time  `json:"created"`
+	PreviousUntil *time.Time `json:"previous_until,omitempty"`
+}
+
+// secretVault keeps the stored signing keys, sealing every change with the
+// master key before it is written.
+type secretVault struct {
+	store  Store
+	master cipher.AEAD
+	keyID  string
+
+	mu  sync.Mutex
+	set secretSet
+}
+
+// masterKeysFromEnv reads the master key from PULSE_MASTER_KEY, or the
+// file PULSE_MASTER_KEY_FILE names (e.g. one a KMS or secrets manager
+// mounts), and the key it replaces from PULSE_MASTER_KEY_PREVIOUS. Keys are
+// 32 bytes, base64-encoded. No master key returns nil.
+func masterKeysFromEnv() (current, previous []byte, err error) {
+	raw := strings.TrimSpace(os.Getenv("PULSE_MASTER_KEY"))
+	if path := strings.TrimSpace(os.Getenv("PULSE_MASTER_KEY_FILE")); path != "" {
+		if raw != "" {
+			return nil, nil, fmt.Errorf("set PULSE_MASTER_KEY or PULSE_MASTER_KEY_FILE, not both")
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		raw = strings.TrimSpace(string(b))
+	}
+	if raw == "" {
+		return nil, nil, nil
+	}
+	if current, err = decodeMasterKey(raw); err != nil {
+		return nil, nil, err
+	}
+	if raw := strings.TrimSpace(os.Getenv("PULSE_MASTER_KEY_PREVIOUS")); raw != "" {
+		if previous, err = decodeMasterKey(raw); err != nil {
+			return nil, nil, fmt.Errorf("previous: %v", err)
+		}
+	}
+	return current, previous, nil
+}
+
+func decodeMasterKey(raw string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, base64-encoded")
+	}
+	return key, nil
+}
+
+// openVault loads the stored keys. Keys sealed with previous are resealed
+// with current, which is how the master key is rotated. Without a master
+// key there is no vault, and a store that holds sealed keys is an error.
+func openVault(store Store, current, previous []byte) (*secretVault, error) {
+	b, err := store.Get(keySecrets)
+	if err != nil && !errors.Is(err, errNotFound) {
+		return nil, err
+	}
+	if current == nil {
+		if b != nil {
+			return nil, fmt.Errorf("the store holds sealed secrets but no master key is set")
+		}
+		return nil, nil
+	}
+	v, err := newVault(store, current)
+	if err != nil {
+		return nil, err
+	}
+	v.set.Keys = make(map[string]storedKey)
+	if b == nil {
+		return v, nil
+	}
+	var sealed sealedSecrets
+	if err := json.Unmarshal(b, &sealed); err != nil {
+		return nil, fmt.Errorf("decode: %v", err)
+	}
+	opener := v
+	if sealed.KeyID != v.keyID {
+		if previous == nil || sealed.KeyID != masterKeyID(previous) {
+			return nil, fmt.Errorf("sealed with master key %s, not the one configured", sealed.KeyID)
+		}
+		if opener, err = newVault(store, previous); err != nil {
+			return nil, err
+		}
+	}
+	plain, err := opener.master.Open(nil, sealed.Nonce, sealed.Data, []byte(keySecrets))
+	if err != nil {
+		return nil, fmt.Errorf("unseal: %v", err)
+	}
+	if err := json.Unmarshal(plain, &v.set); err != nil {
+		return nil, fmt.Errorf("decode: %v", err)
+	}
+	if opener != v {
+		if err := v.save(); err != nil {
+			return nil, err
+		}
+		slog.Info("secrets: resealed", "keys", len(v.set.Keys), "master_key", v.keyID)
+	}
+	return v, nil
+}
+
+func newVault(store Store, key []byte) (*secretVault, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &secretVault{store: store, master: aead, keyID: masterKeyID(key)}, nil
+}
+
+// masterKeyID identifies a master key without revealing it.
+func masterKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// save seals and stores the keys; callers hold v.mu or own v.
+func (v *secretVault) save() error {
+	plain, err := json.Marshal(v.set)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, v.master.NonceSize())
+	_, _ = rand.Read(nonce)
+	b, err := json.Marshal(sealedSecrets{
+		KeyID: v.keyID,
+		Nonce: nonce,
+		Data:  v.master.Seal(nil, nonce, plain, []byte(keySecrets)),
+	})
+	if err != nil {
+		return err
+	}
+	return v.store.Put(keySecrets, b)
+}
+
+// rotate gives key id a new random secret and returns it; it is never
+// shown again. The previous secret, if any, stays valid for grace. The key
+// signs with r.
+func (v *secretVault) rotate(id string, r role, grace time.Duration, now time.Time) (string, error) {
+	if !validName(id) {
+		return "", fmt.Errorf("invalid key id %q", id)
+	}
+	var b [32]byte
+	_, _ = rand.Read(b[:])
+	k := storedKey{Secret: hex.EncodeToString(b[:]), Role: r, Created: now}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	prev, had := v.set.Keys[id]
+	if had && grace > 0 {
+		until := now.Add(grace)
+		k.Previous, k.PreviousUntil = prev.Secret, &until
+	}
+	v.set.Keys[id] = k
+	if err := v.save(); err != nil {
+		if had {
+			v.set.Keys[id] = prev
+		} else {
+			delete(v.set.Keys, id)
+		}
+		return "", err
+	}
+	return k.Secret, nil
+}
+
+// revoke removes key id, reporting whether it existed.
+func (v *secretVault) revoke(id string) (bool, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	k, ok := v.set.Keys[id]
+	if !ok {
+		return false, nil
+	}
+	delete(v.set.Keys, id)
+	if err := v.save(); err != nil {
+		v.set.Keys[id] = k
+		return false, err
+	}
+	return true, nil
+}
+
+func (v *secretVault) list() []secretInfo {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	out := make([]secretInfo, 0, len(v.set.Keys))
+	for id, k := range v.set.Keys {
+		out = append(out, secretInfo{KeyID: id, Role: k.role(), Created: k.Created, PreviousUntil: k.PreviousUntil})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].KeyID < out[j].KeyID })
+	return out
+}
+
+// secrets returns the secrets key id may sign with at now, its current one
+// and, during a rotation's grace period, the previous one, and its role.
+func (v *secretVault) secrets(id string, now time.Time) (out [][]byte, r role, ok bool) {
+	if v == nil {
+		return nil, roleNone, false
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	k, ok := v.set.Keys[id]
+	if !ok {
+		return nil, roleNone, false
+	}
+	out = append(out, []byte(k.Secret))
+	if k.PreviousUntil != nil && now.Before(*k.PreviousUntil) {
+		out = append(out, []byte(k.Previous))
+	}
+	return out, k.role(), true
+}
+
+func (k storedKey) role() role {
+	if k.Role == roleNone {
+		return roleAdmin
+	}
+	return k.Role
+}
+
+func (v *secretVault) count() int {
+	if v == nil {
+		return 0
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return len(v.set.Keys)
+}
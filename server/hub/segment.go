@@ -0,0 +1,392 @@
+package hub
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// History segments. With PULSE_HISTORY_CODEC set, the history log of a
+// file: store is closed into a segment every PULSE_HISTORY_SEGMENT_MS, and
+// the segment is written compressed: its records are cut into blocks of
+// about historyBlockSize, each compressed on its own, and an index at the
+// end of the file gives each block's place and the at_ms range of its
+// pulses. A range query reads the index and decodes only the blocks that
+// overlap it, however long the session. A segment file is
+//
+//	"PSG1", codec name length (1 byte), codec name
+//	blocks, each the codec's encoding of newline-terminated records
+//	index: block count, then per block offset, size, records,
+//	       first at_ms, last at_ms; uvarints but at_ms zigzag varints
+//	index length (4 bytes, big-endian), "PSGI"
+//
+// gzip (raw DEFLATE blocks) and snappy are built in; zstd needs a library
+// the stock binary does not link, so an embedder that wants it registers
+// it with RegisterHistoryCodec. Without a codec, segments stay plain .log
+// files, as the archiver cuts them.
+
+// HistoryCodec compresses history segment blocks. Encode and Decode append
+// their output to dst and must be safe for concurrent use.
+type HistoryCodec interface {
+	Encode(dst, src []byte) ([]byte, error)
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+var (
+	historyCodecsMu sync.Mutex
+	historyCodecs   = map[string]HistoryCodec{
+		"none":   nopCodec{},
+		"gzip":   deflateCodec{},
+		"snappy": snappyCodec{},
+	}
+)
+
+// RegisterHistoryCodec makes a codec available to PULSE_HISTORY_CODEC
+// under name, which is also written into the segments it compresses.
+// Embedders call it before Main, e.g. from an init func:
+//
+//	type zstdCodec struct {
+//		enc *zstd.Encoder
+//		dec *zstd.Decoder
+//	}
+//
+//	func (c zstdCodec) Encode(dst, src []byte) ([]byte, error) { return c.enc.EncodeAll(src, dst), nil }
+//	func (c zstdCodec) Decode(dst, src []byte) ([]byte, error) { return c.dec.DecodeAll(src, dst) }
+//
+//	func init() {
+//		enc, _ := zstd.NewWriter(nil)
+//		dec, _ := zstd.NewReader(nil)
+//		hub.RegisterHistoryCodec("zstd", zstdCodec{enc, dec})
+//	}
+func RegisterHistoryCodec(name string, c HistoryCodec) {
+	historyCodecsMu.Lock()
+	defer historyCodecsMu.Unlock()
+	historyCodecs[name] = c
+}
+
+func historyCodec(name string) (HistoryCodec, error) {
+	historyCodecsMu.Lock()
+	defer historyCodecsMu.Unlock()
+	c, ok := historyCodecs[name]
+	if !ok {
+		if name == "zstd" {
+			return nil, errors.New("zstd is not built in; register it with hub.RegisterHistoryCodec")
+		}
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+	return c, nil
+}
+
+type nopCodec struct{}
+
+func (nopCodec) Encode(dst, src []byte) ([]byte, error) { return append(dst, src...), nil }
+func (nopCodec) Decode(dst, src []byte) ([]byte, error) { return append(dst, src...), nil }
+
+// deflateCodec is gzip's compression without gzip's framing, which the
+// index makes redundant.
+type deflateCodec struct{}
+
+func (deflateCodec) Encode(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	zw, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(src); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (deflateCodec) Decode(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	zr := flate.NewReader(bytes.NewReader(src))
+	defer zr.Close()
+	if _, err := io.Copy(buf, io.LimitReader(zr, snappyMaxBlock)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+const (
+	segmentMagic      = "PSG1"
+	segmentIndexMagic = "PSGI"
+	// historyBlockSize is the raw size a block is closed at, about 600
+	// pulses; it stays under snappyMaxBlock.
+	historyBlockSize = 60 << 10
+)
+
+// segmentBlock is one index entry.
+type segmentBlock struct {
+	offset, size, records uint64
+	first, last           int64 // at_ms
+}
+
+// compressSegment writes the plain segment at src as a compressed one at
+// dst.
+func compressSegment(src, dst, codecName string, codec HistoryCodec) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	off := uint64(len(segmentMagic) + 1 + len(codecName))
+	w.WriteString(segmentMagic)
+	w.WriteByte(byte(len(codecName)))
+	w.WriteString(codecName)
+
+	var (
+		index []segmentBlock
+		raw   []byte
+		enc   []byte
+		cur   segmentBlock
+	)
+	flush := func() error {
+		if len(raw) == 0 {
+			return nil
+		}
+		enc, err = codec.Encode(enc[:0], raw)
+		if err != nil {
+			return err
+		}
+		w.Write(enc)
+		cur.offset, cur.size = off, uint64(len(enc))
+		off += cur.size
+		index = append(index, cur)
+		raw, cur = raw[:0], segmentBlock{}
+		return nil
+	}
+	sc := bufio.NewScanner(in)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(raw)+len(line)+1 > historyBlockSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		var rec historyRecord
+		if json.Unmarshal(line, &rec) == nil {
+			if cur.records == 0 || rec.AtMS < cur.first {
+				cur.first = rec.AtMS
+			}
+			if cur.records == 0 || rec.AtMS > cur.last {
+				cur.last = rec.AtMS
+			}
+		}
+		cur.records++
+		raw = append(append(raw, line...), '\n')
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	idx := binary.AppendUvarint(nil, uint64(len(index)))
+	for _, b := range index {
+		idx = binary.AppendUvarint(idx, b.offset)
+		idx = binary.AppendUvarint(idx, b.size)
+		idx = binary.AppendUvarint(idx, b.records)
+		idx = binary.AppendVarint(idx, b.first)
+		idx = binary.AppendVarint(idx, b.last)
+	}
+	w.Write(idx)
+	w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(idx))))
+	w.WriteString(segmentIndexMagic)
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// readSegment calls fn with each record of the compressed segment at path
+// in a block whose at_ms range overlaps [from, to), decoding no others.
+func readSegment(path string, from, to int64, fn func(rec []byte)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	corrupt := fmt.Errorf("%s: not a history segment", filepath.Base(path))
+	head := make([]byte, len(segmentMagic)+1)
+	if _, err := io.ReadFull(f, head); err != nil || string(head[:len(segmentMagic)]) != segmentMagic {
+		return corrupt
+	}
+	name := make([]byte, head[len(segmentMagic)])
+	if _, err := io.ReadFull(f, name); err != nil {
+		return corrupt
+	}
+	codec, err := historyCodec(string(name))
+	if err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	foot := make([]byte, 8)
+	if fi.Size() < int64(len(head)+len(name)+len(foot)) {
+		return corrupt
+	}
+	if _, err := f.ReadAt(foot, fi.Size()-8); err != nil || string(foot[4:]) != segmentIndexMagic {
+		return corrupt
+	}
+	n := int64(binary.BigEndian.Uint32(foot))
+	if n > fi.Size()-8 {
+		return corrupt
+	}
+	idx := make([]byte, n)
+	if _, err := f.ReadAt(idx, fi.Size()-8-n); err != nil {
+		return corrupt
+	}
+	r := bytes.NewReader(idx)
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return corrupt
+	}
+	var enc, raw []byte
+	for ; count > 0; count-- {
+		var b segmentBlock
+		var errs [5]error
+		b.offset, errs[0] = binary.ReadUvarint(r)
+		b.size, errs[1] = binary.ReadUvarint(r)
+		b.records, errs[2] = binary.ReadUvarint(r)
+		b.first, errs[3] = binary.ReadVarint(r)
+		b.last, errs[4] = binary.ReadVarint(r)
+		if errors.Join(errs[:]...) != nil || b.size > historyBlockSize*2 || int64(b.offset+b.size) > fi.Size() {
+			return corrupt
+		}
+		if b.last < from || b.first >= to {
+			continue
+		}
+		enc = append(enc[:0], make([]byte, b.size)...)
+		if _, err := f.ReadAt(enc, int64(b.offset)); err != nil {
+			return err
+		}
+		if raw, err = codec.Decode(raw[:0], enc); err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		for len(raw) > 0 {
+			line, rest, _ := bytes.Cut(raw, []byte("\n"))
+			fn(line)
+			raw = rest
+		}
+	}
+	return nil
+}
+
+// eachHistory calls fn with every history record kept, oldest first, that
+// might fall in [from, to): those in closed segments of a file: store, then
+// up to maxBackfillPulses of the current log. Plain segments are read
+// whole; compressed ones only where their index overlaps the range.
+func eachHistory(store Store, from, to int64, fn func(rec []byte)) error {
+	if rot, ok := store.(rotator); ok {
+		segs, err := rot.Segments(streamHistory)
+		if err != nil {
+			return err
+		}
+		for _, seg := range segs {
+			if strings.HasSuffix(seg, ".seg") {
+				err = readSegment(seg, from, to, fn)
+			} else {
+				err = readPlainSegment(seg, fn)
+			}
+			// The archiver may have uploaded and removed it meanwhile.
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	recs, err := store.Tail(streamHistory, maxBackfillPulses)
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		fn(rec)
+	}
+	return nil
+}
+
+func readPlainSegment(path string, fn func(rec []byte)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		fn(sc.Bytes())
+	}
+	return sc.Err()
+}
+
+// startHistorySegments compresses history segments with the codec
+// PULSE_HISTORY_CODEC names, closing one every PULSE_HISTORY_SEGMENT_MS
+// (default an hour). It does nothing if the codec is unset.
+func startHistorySegments(store Store) error {
+	name := strings.TrimSpace(os.Getenv("PULSE_HISTORY_CODEC"))
+	if name == "" {
+		return nil
+	}
+	codec, err := historyCodec(name)
+	if err != nil {
+		return err
+	}
+	fs, ok := store.(*fileStore)
+	if !ok {
+		return errors.New("history segments need a file: store")
+	}
+	every := envMS("PULSE_HISTORY_SEGMENT_MS", time.Hour)
+	if every <= 0 {
+		return errors.New("PULSE_HISTORY_SEGMENT_MS must be positive")
+	}
+	fs.mu.Lock()
+	fs.codecName, fs.codec = name, codec
+	fs.mu.Unlock()
+	go func() {
+		t := time.NewTicker(every)
+		defer t.Stop()
+		for range t.C {
+			if err := fs.Rotate(streamHistory); err != nil {
+				slog.Error("history: close segment", "err", err)
+			}
+		}
+	}()
+	slog.Info("history segments", "codec", name, "every", every)
+	return nil
+}
@@ -0,0 +1,189 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// A client self-test is a standard set of probes a client runs and sends in
+// one selftest message: 16 sync_req exchanges 100 ms apart, given as their
+// four timestamps, and the pulses received meanwhile, given as the server's
+// now_ms and the client's receive time. The server scores how tightly the
+// client can follow the pulse and says what would improve it.
+const (
+	minSelfTestProbes = 4
+	maxSelfTestProbes = 64
+	maxSelfTestPulses = 256
+
+	// selfTestTight is the pulse arrival jitter below which nothing needs
+	// absorbing; selfTestSmeared is the sync error that scores 0.
+	selfTestTight   = 5 * time.Millisecond
+	selfTestSmeared = 100 * time.Millisecond
+)
+
+// selfTestProbe is one sync_req exchange: t1 and t4 in the client's clock,
+// t2 and t3 as the sync_resp gave them.
+type selfTestProbe struct {
+	T1 float64 `json:"t1"`
+	T2 float64 `json:"t2"`
+	T3 float64 `json:"t3"`
+	T4 float64 `json:"t4"`
+}
+
+// selfTestPulse is a pulse as the client saw it: its now_ms and when it
+// arrived, in the client's clock.
+type selfTestPulse struct {
+	NowMS      float64 `json:"now_ms"`
+	ReceivedMS float64 `json:"received_ms"`
+}
+
+// selfTestRequest is sent by a client once it has run its probes:
+// {"type":"selftest","id":1,"probes":[...],"pulses":[...]}.
+type selfTestRequest struct {
+	Type   string          `json:"type"`
+	ID     json.RawMessage `json:"id,omitempty"`
+	Probes []selfTestProbe `json:"probes"`
+	Pulses []selfTestPulse `json:"pulses"`
+}
+
+// selfTestResult answers a selftest. ErrorMS is how far the client's beats
+// may land from the server's: the uncertainty of its clock offset plus the
+// pulse jitter send_ahead does not absorb. Score maps it onto 100 (exact)
+// down to 0 (selfTestSmeared or worse).
+type selfTestResult struct {
+	Type            string                   `json:"type"`
+	ID              json.RawMessage          `json:"id,omitempty"`
+	Score           int                      `json:"score"`
+	ErrorMS         float64                  `json:"error_ms"`
+	OffsetMS        float64                  `json:"offset_ms"`
+	RTTMS           float64                  `json:"rtt_ms"`
+	RTTJitterMS     float64                  `json:"rtt_jitter_ms"`
+	PulseJitterMS   *float64                 `json:"pulse_jitter_ms,omitempty"`
+	SendAhead       bool                     `json:"send_ahead"`
+	Recommendations []selfTestRecommendation `json:"recommendations"`
+}
+
+// selfTestRecommendation is one thing that would tighten the client's sync.
+type selfTestRecommendation struct {
+	// Action is enable_send_ahead, increase_send_ahead or
+	// increase_jitter_buffer.
+	Action string `json:"action"`
+	// ValueMS is the suggested send-ahead or jitter buffer.
+	ValueMS int64  `json:"value_ms,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// answerSelfTest scores a selftest from c and sends the result, which the
+// admin clients list keeps as the client's sync_score.
+func answerSelfTest(c *Conn, payload []byte) error {
+	var req selfTestRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return err
+	}
+	ch := c.ch.Load()
+	res, err := scoreSelfTest(req, ch.lead(ch.Period()))
+	if err != nil {
+		return err
+	}
+	c.syncScore.Store(int64(res.Score))
+	c.hasSyncScore.Store(true)
+	return c.WriteJSON(res)
+}
+
+// scoreSelfTest scores the probes of req for a channel whose pulses are
+// sent lead ahead of their beat.
+func scoreSelfTest(req selfTestRequest, lead time.Duration) (*selfTestResult, error) {
+	if len(req.Probes) < minSelfTestProbes || len(req.Probes) > maxSelfTestProbes {
+		return nil, fmt.Errorf("%d probes, want %d to %d", len(req.Probes), minSelfTestProbes, maxSelfTestProbes)
+	}
+	if len(req.Pulses) > maxSelfTestPulses {
+		return nil, fmt.Errorf("%d pulses, want at most %d", len(req.Pulses), maxSelfTestPulses)
+	}
+	// As in README's sync_req section: the offset from the exchange with
+	// the smallest round trip is the best estimate, off by at most half of
+	// that round trip.
+	rtts := make([]time.Duration, 0, len(req.Probes))
+	best := -1
+	for i, p := range req.Probes {
+		rtt := fromMS((p.T4 - p.T1) - (p.T3 - p.T2))
+		if rtt < 0 {
+			return nil, fmt.Errorf("probe %d: timestamps out of order", i)
+		}
+		rtts = append(rtts, rtt)
+		if best < 0 || rtt < rtts[best] {
+			best = i
+		}
+	}
+	p := req.Probes[best]
+	offset := ((p.T2 - p.T1) + (p.T3 - p.T4)) / 2
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	res := &selfTestResult{
+		Type:            "selftest_result",
+		ID:              req.ID,
+		OffsetMS:        msFloat(fromMS(offset)),
+		RTTMS:           msFloat(rtts[0]),
+		RTTJitterMS:     msFloat(percentile(rtts, 0.9) - rtts[0]),
+		SendAhead:       lead > 0,
+		Recommendations: []selfTestRecommendation{},
+	}
+	syncErr := rtts[0] / 2
+
+	// Pulses travel one way, so their jitter is the spread of transit
+	// times, from now_ms to arrival in server time.
+	if len(req.Pulses) >= 2 {
+		transit := make([]time.Duration, 0, len(req.Pulses))
+		for _, pl := range req.Pulses {
+			transit = append(transit, fromMS(pl.ReceivedMS+offset-pl.NowMS))
+		}
+		sort.Slice(transit, func(i, j int) bool { return transit[i] < transit[j] })
+		jitter := percentile(transit, 0.95) - transit[0]
+		jitterMS := msFloat(jitter)
+		res.PulseJitterMS = &jitterMS
+		res.recommend(jitter, percentile(transit, 0.99)-transit[0], lead)
+		syncErr += max(jitter-lead, 0)
+	}
+	res.ErrorMS = msFloat(syncErr)
+	res.Score = int(math.Round(100 * max(0, 1-float64(syncErr)/float64(selfTestSmeared))))
+	return res, nil
+}
+
+// recommend adds the recommendations for pulses arriving with jitter (p95)
+// and worst (p99) spread on a channel sending lead ahead; jitter the lead
+// covers needs nothing.
+func (res *selfTestResult) recommend(jitter, worst, lead time.Duration) {
+	if jitter <= selfTestTight || lead >= worst {
+		return
+	}
+	want := (worst * 3 / 2).Round(time.Millisecond).Milliseconds()
+	switch {
+	case lead == 0:
+		res.Recommendations = append(res.Recommendations, selfTestRecommendation{
+			Action:  "enable_send_ahead",
+			ValueMS: want,
+			Reason:  fmt.Sprintf("pulses arrive with %s jitter; sending them ahead with at_ms would absorb it", jitter.Round(100*time.Microsecond)),
+		})
+	default:
+		res.Recommendations = append(res.Recommendations, selfTestRecommendation{
+			Action:  "increase_send_ahead",
+			ValueMS: want,
+			Reason:  fmt.Sprintf("pulse jitter of up to %s exceeds the %s send-ahead", worst.Round(100*time.Microsecond), lead),
+		})
+	}
+	res.Recommendations = append(res.Recommendations, selfTestRecommendation{
+		Action:  "increase_jitter_buffer",
+		ValueMS: want,
+		Reason:  fmt.Sprintf("scheduling beats %d ms late keeps pulses with up to %s jitter in time", want, worst.Round(100*time.Microsecond)),
+	})
+}
+
+// fromMS converts fractional milliseconds, as clients send them, to a
+// duration; NaN and infinities become -1 so they fail range checks.
+func fromMS(ms float64) time.Duration {
+	if math.IsNaN(ms) || math.IsInf(ms, 0) {
+		return -1
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
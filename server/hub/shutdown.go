@@ -0,0 +1,74 @@
+package hub
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// closeAll detaches every connection from the hub and sends each a close
+// frame with code and reason in parallel, giving the writes up to timeout
+// before the connections are torn down regardless.
+func (h *Hub) closeAll(code uint16, reason string, timeout time.Duration) {
+	h.mu.Lock()
+	conns := make([]*Conn, 0, len(h.conns))
+	for c := range h.conns {
+		conns = append(conns, c)
+	}
+	h.conns = make(map[*Conn]struct{})
+	h.internal = 0
+	h.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *Conn) {
+			defer wg.Done()
+			c.setCause(causeServer)
+			_ = c.writeClose(code, reason)
+		}(c)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Warn("shutdown: close frames still pending", "after", timeout)
+	}
+	for _, c := range conns {
+		_ = c.Close()
+	}
+}
+
+// drain closes every client connection with code and reason, e.g. 1012
+// (service restart), spread evenly over window so their reconnects do not
+// all arrive at once. Clients keep receiving pulses until their turn comes.
+// It returns early, leaving the rest to the caller, if ctx is done.
+func (h *Hub) drain(ctx context.Context, window time.Duration, code uint16, reason string) {
+	h.mu.RLock()
+	conns := make([]*Conn, 0, len(h.conns))
+	for c := range h.conns {
+		if !c.internal {
+			conns = append(conns, c)
+		}
+	}
+	h.mu.RUnlock()
+
+	start := time.Now()
+	for i, c := range conns {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(start.Add(window * time.Duration(i) / time.Duration(len(conns))))):
+		}
+		c.setCause(causeServer)
+		// Off the broadcast list first, so no pulse races the close frame.
+		h.remove(c)
+		_ = c.writeClose(code, reason)
+		_ = c.Close()
+	}
+}
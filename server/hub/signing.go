@@ -0,0 +1,189 @@
+package hub
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signed admin requests carry these headers. The signature is the hex
+// HMAC-SHA256, under the key's secret, of
+//
+//	METHOD "\n" path?query "\n" timestamp "\n" body
+//
+// with the timestamp in Unix seconds, e.g. for automation that cannot hold
+// a bearer token.
+const (
+	signatureKeyHeader  = "X-Pulse-Key-Id"
+	signatureTimeHeader = "X-Pulse-Timestamp"
+	signatureHeader     = "X-Pulse-Signature"
+)
+
+// maxSignedBody bounds the admin request bodies read for verification.
+const maxSignedBody = 1 << 20
+
+// adminAuth admits admin requests carrying one of the bearer tokens or
+// signed by one of keys or of the keys in vault, which take precedence,
+// and tells which role they act with. A signature is accepted once, and
+// only while its timestamp is within skew of the server's clock, so a
+// captured request cannot be replayed.
+type adminAuth struct {
+	tokens map[role]string
+	keys   map[string]signingKey
+	vault  *secretVault
+	skew   time.Duration
+	// idempotency deduplicates retried control requests; see
+	// idempotency.go.
+	idempotency *idempotency
+
+	mu sync.Mutex
+	// seen holds the signatures accepted within the last skew, by
+	// timestamp, to reject replays.
+	seen map[string]time.Time
+}
+
+type signingKey struct {
+	secret []byte
+	role   role
+}
+
+// parseSigningKeys parses comma-separated "id=secret" or "id:role=secret"
+// entries; keys without a role are admin keys. Secrets shorter than 16
+// bytes are refused.
+func parseSigningKeys(raw string) (map[string]signingKey, error) {
+	keys := make(map[string]signingKey)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, secret, ok := strings.Cut(entry, "=")
+		id, roleName, hasRole := strings.Cut(name, ":")
+		if !ok || !validName(id) {
+			return nil, fmt.Errorf("invalid key entry %q, want id=secret or id:role=secret", entry)
+		}
+		r := roleAdmin
+		if hasRole {
+			var err error
+			if r, err = parseRole(roleName); err != nil {
+				return nil, fmt.Errorf("key %q: %v", id, err)
+			}
+		}
+		if len(secret) < 16 {
+			return nil, fmt.Errorf("key %q: secret must be at least 16 bytes", id)
+		}
+		if _, dup := keys[id]; dup {
+			return nil, fmt.Errorf("duplicate key %q", id)
+		}
+		keys[id] = signingKey{secret: []byte(secret), role: r}
+	}
+	return keys, nil
+}
+
+// newAdminAuth takes the bearer token of each role; empty ones are
+// ignored.
+func newAdminAuth(tokens map[role]string, keys map[string]signingKey, vault *secretVault, skew time.Duration) *adminAuth {
+	a := &adminAuth{
+		tokens: make(map[role]string),
+		keys:   keys,
+		vault:  vault,
+		skew:   skew,
+		seen:   make(map[string]time.Time),
+	}
+	for r, token := range tokens {
+		if token = strings.TrimSpace(token); token != "" {
+			a.tokens[r] = token
+		}
+	}
+	return a
+}
+
+// enabled reports whether any credential is configured; without one the
+// admin API stays off.
+func (a *adminAuth) enabled() bool {
+	return a != nil && (len(a.tokens) > 0 || len(a.keys) > 0 || a.vault.count() > 0)
+}
+
+// allow returns the role r acts with, or why it may not use the admin API.
+// The highest role whose token r carries wins. A signed request's body is
+// read and put back for the handler.
+func (a *adminAuth) allow(r *http.Request) (role, error) {
+	if !a.enabled() {
+		return roleNone, fmt.Errorf("unauthorized")
+	}
+	for _, rl := range []role{roleAdmin, roleController, roleObserver} {
+		if token := a.tokens[rl]; token != "" && hasToken(r, token) {
+			return rl, nil
+		}
+	}
+	id := r.Header.Get(signatureKeyHeader)
+	if id == "" {
+		return roleNone, fmt.Errorf("unauthorized")
+	}
+	now := time.Now()
+	secrets, keyRole, ok := a.vault.secrets(id, now)
+	if !ok {
+		key, ok := a.keys[id]
+		if !ok {
+			return roleNone, fmt.Errorf("unknown key %q", id)
+		}
+		secrets, keyRole = [][]byte{key.secret}, key.role
+	}
+	rawTS := r.Header.Get(signatureTimeHeader)
+	ts, err := strconv.ParseInt(rawTS, 10, 64)
+	if err != nil {
+		return roleNone, fmt.Errorf("invalid %s", signatureTimeHeader)
+	}
+	at := time.Unix(ts, 0)
+	if at.Before(now.Add(-a.skew)) || at.After(now.Add(a.skew)) {
+		return roleNone, fmt.Errorf("timestamp outside the %s window", a.skew)
+	}
+	sig, err := hex.DecodeString(r.Header.Get(signatureHeader))
+	if err != nil || len(sig) != sha256.Size {
+		return roleNone, fmt.Errorf("invalid %s", signatureHeader)
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+	if err != nil {
+		return roleNone, fmt.Errorf("read body: %v", err)
+	}
+	if len(body) > maxSignedBody {
+		return roleNone, fmt.Errorf("body too large to verify")
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, secret)
+		fmt.Fprintf(mac, "%s\n%s\n%s\n", r.Method, r.URL.RequestURI(), rawTS)
+		mac.Write(body)
+		if hmac.Equal(mac.Sum(nil), sig) {
+			if err := a.remember(id+":"+hex.EncodeToString(sig), at, now); err != nil {
+				return roleNone, err
+			}
+			return keyRole, nil
+		}
+	}
+	return roleNone, fmt.Errorf("signature mismatch")
+}
+
+// remember records an accepted signature, failing if it was seen before.
+func (a *adminAuth) remember(key string, at, now time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for k, t := range a.seen {
+		if t.Before(now.Add(-a.skew)) {
+			delete(a.seen, k)
+		}
+	}
+	if _, ok := a.seen[key]; ok {
+		return fmt.Errorf("replayed signature")
+	}
+	a.seen[key] = at
+	return nil
+}
@@ -0,0 +1,172 @@
+package hub
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSigningSecret = "0123456789abcdef"
+
+// signedRequest returns an admin request with body, signed by key id with
+// secret at ts.
+func signedRequest(id, secret string, ts time.Time, body string) *http.Request {
+	r := httptest.NewRequest("POST", "/admin/period?channel=main", strings.NewReader(body))
+	rawTS := strconv.FormatInt(ts.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", r.Method, r.URL.RequestURI(), rawTS, body)
+	r.Header.Set(signatureKeyHeader, id)
+	r.Header.Set(signatureTimeHeader, rawTS)
+	r.Header.Set(signatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+func TestAdminAuthSigned(t *testing.T) {
+	const skew = time.Minute
+	keys := map[string]signingKey{
+		"deploy": {secret: []byte(testSigningSecret), role: roleAdmin},
+		"ci":     {secret: []byte(testSigningSecret + "ci"), role: roleController},
+	}
+	const body = `{"period_ms":500}`
+	for _, tc := range []struct {
+		name string
+		req  func(now time.Time) *http.Request
+		role role
+		err  string
+	}{
+		{"valid", func(now time.Time) *http.Request {
+			return signedRequest("deploy", testSigningSecret, now, body)
+		}, roleAdmin, ""},
+		{"key role", func(now time.Time) *http.Request {
+			return signedRequest("ci", testSigningSecret+"ci", now, body)
+		}, roleController, ""},
+		{"skewed within the window", func(now time.Time) *http.Request {
+			return signedRequest("deploy", testSigningSecret, now.Add(-skew/2), body)
+		}, roleAdmin, ""},
+		{"too old", func(now time.Time) *http.Request {
+			return signedRequest("deploy", testSigningSecret, now.Add(-2*skew), body)
+		}, roleNone, "outside the"},
+		{"from the future", func(now time.Time) *http.Request {
+			return signedRequest("deploy", testSigningSecret, now.Add(2*skew), body)
+		}, roleNone, "outside the"},
+		{"unknown key", func(now time.Time) *http.Request {
+			return signedRequest("nobody", testSigningSecret, now, body)
+		}, roleNone, "unknown key"},
+		{"wrong secret", func(now time.Time) *http.Request {
+			return signedRequest("deploy", testSigningSecret+"x", now, body)
+		}, roleNone, "signature mismatch"},
+		{"another key's secret", func(now time.Time) *http.Request {
+			return signedRequest("deploy", testSigningSecret+"ci", now, body)
+		}, roleNone, "signature mismatch"},
+		{"tampered body", func(now time.Time) *http.Request {
+			r := signedRequest("deploy", testSigningSecret, now, body)
+			r.Body = io.NopCloser(strings.NewReader(`{"period_ms":50}`))
+			return r
+		}, roleNone, "signature mismatch"},
+		{"tampered timestamp", func(now time.Time) *http.Request {
+			r := signedRequest("deploy", testSigningSecret, now, body)
+			r.Header.Set(signatureTimeHeader, strconv.FormatInt(now.Unix()-1, 10))
+			return r
+		}, roleNone, "signature mismatch"},
+		{"malformed signature", func(now time.Time) *http.Request {
+			r := signedRequest("deploy", testSigningSecret, now, body)
+			r.Header.Set(signatureHeader, "zz")
+			return r
+		}, roleNone, "invalid " + signatureHeader},
+		{"malformed timestamp", func(now time.Time) *http.Request {
+			r := signedRequest("deploy", testSigningSecret, now, body)
+			r.Header.Set(signatureTimeHeader, "soon")
+			return r
+		}, roleNone, "invalid " + signatureTimeHeader},
+		{"unsigned", func(now time.Time) *http.Request {
+			return httptest.NewRequest("POST", "/admin/period", strings.NewReader(body))
+		}, roleNone, "unauthorized"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a := newAdminAuth(nil, keys, nil, skew)
+			r := tc.req(time.Now())
+			got, err := a.allow(r)
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatalf("allow: %v", err)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Fatalf("allow: role %v, err %v; want an error with %q", got, err, tc.err)
+			case got != tc.role:
+				t.Fatalf("role %v, want %v", got, tc.role)
+			}
+			if err == nil {
+				// The handler still reads the body the signature covered.
+				if b, _ := io.ReadAll(r.Body); string(b) != body {
+					t.Fatalf("body %q after allow, want %q", b, body)
+				}
+			}
+		})
+	}
+}
+
+func TestAdminAuthReplay(t *testing.T) {
+	a := newAdminAuth(nil, map[string]signingKey{"deploy": {secret: []byte(testSigningSecret), role: roleAdmin}}, nil, time.Minute)
+	now := time.Now()
+	if _, err := a.allow(signedRequest("deploy", testSigningSecret, now, "{}")); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if _, err := a.allow(signedRequest("deploy", testSigningSecret, now, "{}")); err == nil || !strings.Contains(err.Error(), "replayed") {
+		t.Fatalf("replayed request: err %v, want a replay error", err)
+	}
+	// Another request signed in the same second is not a replay.
+	if _, err := a.allow(signedRequest("deploy", testSigningSecret, now, `{"a":1}`)); err != nil {
+		t.Fatalf("second request: %v", err)
+	}
+}
+
+func TestAdminAuthRotatedSecret(t *testing.T) {
+	master := make([]byte, 32)
+	for _, tc := range []struct {
+		name string
+		// rotatedAgo is how long before now the key was rotated, with an
+		// hour's grace.
+		rotatedAgo time.Duration
+		previousOK bool
+	}{
+		{"within grace", time.Minute, true},
+		{"after grace", 2 * time.Hour, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := openVault(newMemoryStore(), master, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			at := time.Now().Add(-tc.rotatedAgo)
+			old, err := v.rotate("deploy", roleController, 0, at.Add(-time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			current, err := v.rotate("deploy", roleController, time.Hour, at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A static key of the same id yields to the vault.
+			static := map[string]signingKey{"deploy": {secret: []byte(old), role: roleAdmin}}
+			a := newAdminAuth(nil, static, v, time.Minute)
+
+			if r, err := a.allow(signedRequest("deploy", current, time.Now(), "{}")); err != nil || r != roleController {
+				t.Fatalf("current secret: role %v, err %v", r, err)
+			}
+			r, err := a.allow(signedRequest("deploy", old, time.Now(), `{"old":true}`))
+			switch {
+			case tc.previousOK && (err != nil || r != roleController):
+				t.Fatalf("previous secret: role %v, err %v; want it accepted", r, err)
+			case !tc.previousOK && (err == nil || !strings.Contains(err.Error(), "signature mismatch")):
+				t.Fatalf("previous secret: role %v, err %v; want a mismatch", r, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package hub
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"pulse/ws"
+)
+
+// Simulcast offers a channel at slower rates too: a client at rate N gets
+// every Nth pulse of the channel's own grid, those whose seq is a multiple
+// of N, so slow and fast clients count the same seq on the same clock. Rates
+// are set by PULSE_SIMULCAST as "channel:N" entries, e.g. "default:10" for a
+// 1 Hz view of a 10 Hz channel; a client picks one with ?rate=N at connect
+// or "rate" in a subscribe message. Its pulses carry "rate": N, and their
+// period_ms and next_ms are those of the view.
+
+// simulcastView is one of a channel's slower rates.
+type simulcastView struct {
+	every uint64
+	// changed is set when the period changed on a pulse the view skipped,
+	// so its next pulse says so.
+	changed atomic.Bool
+}
+
+// applySimulcast adds the rates in raw, comma-separated "channel:N"
+// entries, to chans.
+func applySimulcast(raw string, chans map[string]*pulseChannel) error {
+	for _, entry := range ws.SplitHeaderList(raw) {
+		name, n, ok := strings.Cut(entry, ":")
+		if !ok {
+			return fmt.Errorf("invalid entry %q, want channel:N", entry)
+		}
+		ch := chans[strings.TrimSpace(name)]
+		if ch == nil {
+			return fmt.Errorf("unknown channel %q", name)
+		}
+		every, err := strconv.ParseUint(strings.TrimSpace(n), 10, 64)
+		if err != nil || every < 2 {
+			return fmt.Errorf("channel %q: rate must be a whole number of pulses, at least 2", ch.name)
+		}
+		if ch.view(every) != nil {
+			return fmt.Errorf("channel %q: rate %d given twice", ch.name, every)
+		}
+		ch.simulcast = append(ch.simulcast, &simulcastView{every: every})
+		slices.SortFunc(ch.simulcast, func(a, b *simulcastView) int { return cmp.Compare(a.every, b.every) })
+	}
+	return nil
+}
+
+// parseRate parses a client's choice of rate; empty means every pulse.
+func parseRate(s string) (uint64, error) {
+	if s == "" {
+		return 1, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return n, nil
+}
+
+// view returns ch's view at rate every, or nil if it has none.
+func (ch *pulseChannel) view(every uint64) *simulcastView {
+	for _, v := range ch.simulcast {
+		if v.every == every {
+			return v
+		}
+	}
+	return nil
+}
+
+// offers reports whether ch can be received at rate every.
+func (ch *pulseChannel) offers(every uint64) bool {
+	return every == 1 || ch.view(every) != nil
+}
+
+// rates lists the rates ch is offered at, starting with 1; nil without
+// simulcast.
+func (ch *pulseChannel) rates() []uint64 {
+	if len(ch.simulcast) == 0 {
+		return nil
+	}
+	rates := []uint64{1}
+	for _, v := range ch.simulcast {
+		rates = append(rates, v.every)
+	}
+	return rates
+}
+
+// simulcastPulses returns msg as each of ch's views that gets it, by rate.
+// Views skipping msg remember a period change it announces for their next
+// pulse.
+func (ch *pulseChannel) simulcastPulses(msg PulseMessage) map[uint64]PulseMessage {
+	if len(ch.simulcast) == 0 {
+		return nil
+	}
+	out := make(map[uint64]PulseMessage, len(ch.simulcast))
+	for _, v := range ch.simulcast {
+		if msg.Seq%v.every != 0 {
+			if msg.PeriodChanged {
+				v.changed.Store(true)
+			}
+			continue
+		}
+		m := msg
+		m.PeriodChanged = v.changed.Swap(false) || msg.PeriodChanged
+		// A view's pulses are all on one step of a pattern, so its next
+		// one is moved off the straight grid as msg was, not as msg's next.
+		var shift time.Duration
+		if ch.pattern != nil {
+			_, next := ch.swing(msg.Seq+1, msg.period())
+			shift = pulseSwing(msg) - next
+		}
+		m.NextMS += int64(v.every-1)*msg.PeriodMS + shift.Round(time.Millisecond).Milliseconds()
+		m.PeriodMS *= int64(v.every)
+		if msg.PeriodUS != 0 {
+			// Whole milliseconds added up would drift off the beat.
+			m.NextUS += int64(v.every-1)*msg.PeriodUS + shift.Microseconds()
+			m.NextMS = time.UnixMicro(m.NextUS).UnixMilli()
+			m.PeriodUS *= int64(v.every)
+		}
+		m.Extra = make(map[string]json.RawMessage, len(msg.Extra)+1)
+		for k, x := range msg.Extra {
+			m.Extra[k] = x
+		}
+		m.Extra["rate"], _ = json.Marshal(v.every)
+		out[v.every] = m
+	}
+	return out
+}
@@ -0,0 +1,80 @@
+package hub
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Sink metadata. Sinks that hand pulses on outside the server carry, beside
+// the payload, attributes that let consumers route, filter and correlate
+// pulses without parsing it: as MQTT 5 user properties (see mqtt.go), and
+// as headers wherever a sink has them.
+//
+//	pulse-channel     the channel
+//	pulse-seq         the pulse's seq
+//	pulse-period-ms   its period_ms
+//	pulse-epoch-ms    when the channel's timeline began: bar 1 on a channel
+//	                  with a tempo (its epoch_ms), else seq 0, had the
+//	                  period always been this one
+//	pulse-signature   the channel's time signature, e.g. 4/4, if it has one
+//	pulse-domain      the channel's clock domain, if it is in one
+//	pulse-server      the host the server runs on
+//	traceparent       W3C Trace Context
+//
+// A timeline is a trace: its trace ID is derived from the channel and the
+// epoch, and each pulse's span ID from the trace and seq, so every server
+// on the same timeline (backplane replicas, relays, servers disciplined to
+// UTC) gives a pulse the same traceparent, and a consumer can put the
+// spans its work on a pulse starts under it. A new trace starts whenever
+// the timeline does: on a restart without a handoff, a transport reset or
+// a period change.
+const traceFlagsSampled = "01"
+
+// sinkAttr is an attribute of a pulse as a sink sends it.
+type sinkAttr struct {
+	key, value string
+}
+
+var sinkHost = sync.OnceValue(func() string {
+	host, _ := os.Hostname()
+	return host
+})
+
+// sinkMeta returns msg's attributes, in the order listed above.
+func (h *Hub) sinkMeta(msg PulseMessage) []sinkAttr {
+	attrs := []sinkAttr{
+		{"pulse-channel", msg.Channel},
+		{"pulse-seq", strconv.FormatUint(msg.Seq, 10)},
+		{"pulse-period-ms", strconv.FormatInt(msg.PeriodMS, 10)},
+	}
+	epoch := pulseEpoch(msg)
+	if epoch != 0 {
+		attrs = append(attrs, sinkAttr{"pulse-epoch-ms", strconv.FormatFloat(epoch, 'f', -1, 64)})
+	}
+	if ch := h.channel(msg.Channel); ch != nil {
+		if ch.tempo != nil {
+			attrs = append(attrs, sinkAttr{"pulse-signature", strconv.Itoa(ch.tempo.beatsPerBar) + "/" + strconv.Itoa(ch.tempo.beatUnit)})
+		}
+		if ch.domain != nil {
+			attrs = append(attrs, sinkAttr{"pulse-domain", ch.domain.name})
+		}
+	}
+	if host := sinkHost(); host != "" {
+		attrs = append(attrs, sinkAttr{"pulse-server", host})
+	}
+	return append(attrs, sinkAttr{"traceparent", traceParent(msg.Channel, epoch, msg.Seq)})
+}
+
+// traceParent is the traceparent of pulse seq of channel's timeline that
+// began at epoch, in Unix milliseconds. The epoch is taken to the
+// millisecond, so servers that compute it a little apart agree.
+func traceParent(channel string, epoch float64, seq uint64) string {
+	trace := sha256.Sum256(strconv.AppendInt([]byte("pulse-trace\x00"+channel+"\x00"), int64(math.Round(epoch)), 10))
+	span := sha256.Sum256(binary.BigEndian.AppendUint64(trace[:16:16], seq))
+	return "00-" + hex.EncodeToString(trace[:16]) + "-" + hex.EncodeToString(span[:8]) + "-" + traceFlagsSampled
+}
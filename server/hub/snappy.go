@@ -0,0 +1,171 @@
+package hub
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// snappyCodec is the Snappy block format, small enough to carry here
+// rather than link a library for: a uvarint of the decoded length, then
+// literals and back-references. The encoder is the simple greedy one; it
+// compresses less than the reference encoder but its output decodes
+// anywhere. Blocks must be under 64 KiB, which history segment blocks are,
+// so every copy fits the two-byte offset form.
+type snappyCodec struct{}
+
+const (
+	snappyLiteral = 0x00
+	snappyCopy1   = 0x01
+	snappyCopy2   = 0x02
+	snappyCopy4   = 0x03
+
+	snappyMaxBlock  = 1 << 16
+	snappyTableBits = 14
+)
+
+var errSnappyCorrupt = errors.New("snappy: corrupt block")
+
+func (snappyCodec) Encode(dst, src []byte) ([]byte, error) {
+	if len(src) >= snappyMaxBlock {
+		return nil, errors.New("snappy: block too large")
+	}
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+	if len(src) < 8 {
+		return appendSnappyLiteral(dst, src), nil
+	}
+	var table [1 << snappyTableBits]uint16
+	hash := func(u uint32) uint32 { return (u * 0x1e35a7bd) >> (32 - snappyTableBits) }
+	lit := 0
+	for i := 1; i+4 <= len(src); {
+		u := binary.LittleEndian.Uint32(src[i:])
+		hv := hash(u)
+		cand := int(table[hv])
+		table[hv] = uint16(i)
+		if cand >= i || binary.LittleEndian.Uint32(src[cand:]) != u {
+			i++
+			continue
+		}
+		dst = appendSnappyLiteral(dst, src[lit:i])
+		n := 4 + commonPrefix(src[cand+4:], src[i+4:])
+		dst = appendSnappyCopy(dst, i-cand, n)
+		i += n
+		lit = i
+	}
+	return appendSnappyLiteral(dst, src[lit:]), nil
+}
+
+func commonPrefix(a, b []byte) int {
+	n := 0
+	for len(a) >= 8 && len(b) >= 8 {
+		x := binary.LittleEndian.Uint64(a) ^ binary.LittleEndian.Uint64(b)
+		if x != 0 {
+			return n + bits.TrailingZeros64(x)/8
+		}
+		a, b, n = a[8:], b[8:], n+8
+	}
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		a, b, n = a[1:], b[1:], n+1
+	}
+	return n
+}
+
+func appendSnappyLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	switch n := len(lit) - 1; {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|snappyLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyLiteral, byte(n))
+	default:
+		dst = append(dst, 61<<2|snappyLiteral, byte(n), byte(n>>8))
+	}
+	return append(dst, lit...)
+}
+
+// appendSnappyCopy appends a back-reference of n bytes at offset, in
+// pieces of at most 64 bytes.
+func appendSnappyCopy(dst []byte, offset, n int) []byte {
+	for n > 0 {
+		// Leave at least 4 bytes for the last piece, the shortest copy
+		// the encoder finds worth making.
+		m := min(n, 64)
+		if n-m > 0 && n-m < 4 {
+			m = n - 4
+		}
+		dst = append(dst, byte(m-1)<<2|snappyCopy2, byte(offset), byte(offset>>8))
+		n -= m
+	}
+	return dst
+}
+
+func (snappyCodec) Decode(dst, src []byte) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 || n >= snappyMaxBlock {
+		return nil, errSnappyCorrupt
+	}
+	src = src[k:]
+	start := len(dst)
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 3 {
+		case snappyLiteral:
+			length = int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				w := length - 59
+				if len(src) < w {
+					return nil, errSnappyCorrupt
+				}
+				length = 0
+				for i := w - 1; i >= 0; i-- {
+					length = length<<8 | int(src[i])
+				}
+				src = src[w:]
+			}
+			length++
+			if length > len(src) || len(dst)-start+length > int(n) {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case snappyCopy1:
+			if len(src) < 2 {
+				return nil, errSnappyCorrupt
+			}
+			length = 4 + int(tag>>2)&7
+			offset = int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+		case snappyCopy2:
+			if len(src) < 3 {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case snappyCopy4:
+			if len(src) < 5 {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst)-start || len(dst)-start+length > int(n) {
+			return nil, errSnappyCorrupt
+		}
+		// Byte by byte: a copy may overlap what it is producing.
+		for from := len(dst) - offset; length > 0; length-- {
+			dst = append(dst, dst[from])
+			from++
+		}
+	}
+	if len(dst)-start != int(n) {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
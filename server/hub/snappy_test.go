@@ -0,0 +1,169 @@
+package hub
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func snappyInputs() map[string][]byte {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 4000)
+	rng.Read(random)
+	var pulses bytes.Buffer
+	for seq := 0; pulses.Len() < snappyMaxBlock-200; seq++ {
+		fmt.Fprintf(&pulses, `{"type":"pulse","seq":%d,"period_ms":500,"now_ms":%d,"next_ms":%d}`+"\n", seq, 1739700000000+seq*500, 1739700000500+seq*500)
+	}
+	// Random runs with repeats at offsets near the 64 KiB limit.
+	mixed := make([]byte, snappyMaxBlock-1)
+	rng.Read(mixed[:1000])
+	for i := 1000; i < len(mixed); i += 1000 {
+		copy(mixed[i:], mixed[rng.Intn(i-500):][:min(1000, len(mixed)-i)])
+		mixed[i] ^= 0xff
+	}
+	return map[string][]byte{
+		"empty":           {},
+		"one byte":        []byte("a"),
+		"short":           []byte("pulse"),
+		"no repeats":      []byte("0123456789abcdef"),
+		"repeated":        bytes.Repeat([]byte("abc"), 1000),
+		"zeros":           make([]byte, 10000),
+		"60 byte literal": random[:60],
+		"random":          random,
+		"pulses":          pulses.Bytes(),
+		"largest block":   mixed,
+	}
+}
+
+func TestSnappyRoundTrip(t *testing.T) {
+	for name, src := range snappyInputs() {
+		t.Run(name, func(t *testing.T) {
+			enc, err := snappyCodec{}.Encode([]byte("prefix"), src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(enc, []byte("prefix")) {
+				t.Fatal("Encode did not append to dst")
+			}
+			enc = enc[len("prefix"):]
+			dec, err := snappyCodec{}.Decode([]byte("prefix"), enc)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !bytes.Equal(dec, append([]byte("prefix"), src...)) {
+				t.Fatalf("decoded %d bytes that differ from the %d encoded", len(dec)-len("prefix"), len(src))
+			}
+		})
+	}
+}
+
+func TestSnappyCompresses(t *testing.T) {
+	src := snappyInputs()["pulses"]
+	enc, err := snappyCodec{}.Encode(nil, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enc) > len(src)/3 {
+		t.Fatalf("%d pulse bytes encoded to %d", len(src), len(enc))
+	}
+}
+
+func TestSnappyBlockTooLarge(t *testing.T) {
+	if _, err := (snappyCodec{}).Encode(nil, make([]byte, snappyMaxBlock)); err == nil {
+		t.Fatal("encoded a block of 64 KiB")
+	}
+}
+
+// TestSnappyCopyForms decodes the one- and four-byte offset copies, which
+// the encoder never writes but other encoders do.
+func TestSnappyCopyForms(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		src  []byte
+		want string
+	}{
+		{"copy1", []byte{8, 3 << 2, 'a', 'b', 'c', 'd', 0<<2 | snappyCopy1, 4}, "abcdabcd"},
+		{"copy1 overlapping", []byte{10, 1 << 2, 'a', 'b', 4<<2 | snappyCopy1, 2}, "ababababab"},
+		{"copy2", []byte{8, 3 << 2, 'a', 'b', 'c', 'd', 3<<2 | snappyCopy2, 4, 0}, "abcdabcd"},
+		{"copy4", []byte{8, 3 << 2, 'a', 'b', 'c', 'd', 3<<2 | snappyCopy4, 4, 0, 0, 0}, "abcdabcd"},
+		{"long literal", append([]byte{61, 60 << 2, 60}, bytes.Repeat([]byte("x"), 61)...), string(bytes.Repeat([]byte("x"), 61))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := snappyCodec{}.Decode(nil, tc.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Fatalf("decoded %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSnappyCorrupt(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		src  []byte
+	}{
+		{"empty", nil},
+		{"unterminated length", []byte{0x80}},
+		{"length too large", []byte{0x80, 0x80, 0x04}},
+		{"missing data", []byte{4}},
+		{"short literal", []byte{4, 3 << 2, 'a', 'b'}},
+		{"literal past length", []byte{2, 3 << 2, 'a', 'b', 'c', 'd'}},
+		{"short literal length", []byte{100, 61 << 2, 99}},
+		{"trailing data", []byte{1, 0, 'a', 0, 'b'}},
+		{"copy at offset 0", []byte{8, 3 << 2, 'a', 'b', 'c', 'd', 3<<2 | snappyCopy2, 0, 0}},
+		{"copy before the start", []byte{8, 3 << 2, 'a', 'b', 'c', 'd', 3<<2 | snappyCopy2, 5, 0}},
+		{"copy past length", []byte{7, 3 << 2, 'a', 'b', 'c', 'd', 3<<2 | snappyCopy2, 4, 0}},
+		{"copy first", []byte{4, 3<<2 | snappyCopy2, 1, 0}},
+		{"short copy1", []byte{8, 3 << 2, 'a', 'b', 'c', 'd', snappyCopy1}},
+		{"short copy2", []byte{8, 3 << 2, 'a', 'b', 'c', 'd', 3<<2 | snappyCopy2, 4}},
+		{"short copy4", []byte{8, 3 << 2, 'a', 'b', 'c', 'd', 3<<2 | snappyCopy4, 4, 0, 0}},
+		{"huge copy4 offset", []byte{8, 3 << 2, 'a', 'b', 'c', 'd', 3<<2 | snappyCopy4, 0xff, 0xff, 0xff, 0xff}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got, err := (snappyCodec{}).Decode(nil, tc.src); !errors.Is(err, errSnappyCorrupt) {
+				t.Fatalf("decoded %q, err %v; want errSnappyCorrupt", got, err)
+			}
+		})
+	}
+}
+
+func TestSnappyTruncated(t *testing.T) {
+	for name, src := range snappyInputs() {
+		enc, err := snappyCodec{}.Encode(nil, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; n < len(enc); n++ {
+			if _, err := (snappyCodec{}).Decode(nil, enc[:n]); !errors.Is(err, errSnappyCorrupt) {
+				t.Fatalf("%s: %d of %d bytes decoded with err %v", name, n, len(enc), err)
+			}
+		}
+	}
+}
+
+// TestSnappyMangled overwrites bytes of valid blocks; decoding must fail
+// or stay within the block limit, and never panic.
+func TestSnappyMangled(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for name, src := range snappyInputs() {
+		enc, err := snappyCodec{}.Encode(nil, src)
+		if err != nil || len(enc) == 0 {
+			t.Fatal(err)
+		}
+		for i := 0; i < 200; i++ {
+			b := bytes.Clone(enc)
+			for j := rng.Intn(3); j >= 0; j-- {
+				b[rng.Intn(len(b))] = byte(rng.Intn(256))
+			}
+			dec, err := snappyCodec{}.Decode(nil, b)
+			if err == nil && len(dec) >= snappyMaxBlock {
+				t.Fatalf("%s: mangled block decoded to %d bytes", name, len(dec))
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Live migration to another node: GET /admin/snapshot answers the same
+// state an upgrade hands over (offset, uptime, every channel's period,
+// latest pulse, transport and bars), and a server started with
+// PULSE_RESTORE_FROM pointing at it resumes from there before its pulse
+// loops start. Grids are anchored in wall clock time, so with both nodes'
+// clocks synchronized the new one pulses in step with the old, and clients
+// redirected or drained over to it carry on with the same seq, phase and
+// tempo. Connections are not part of it; they reconnect.
+
+// snapshotTimeout bounds fetching a snapshot from another node.
+const snapshotTimeout = 10 * time.Second
+
+func snapshotHandler(h *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, h.handoffState())
+	}
+}
+
+// loadSnapshot reads a snapshot from src: an http(s) URL, fetched with
+// token as its bearer token if set, or a file.
+func loadSnapshot(src, token string) (handoffState, error) {
+	var st handoffState
+	var body io.Reader
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		req, err := http.NewRequest(http.MethodGet, src, nil)
+		if err != nil {
+			return st, err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := (&http.Client{Timeout: snapshotTimeout}).Do(req)
+		if err != nil {
+			return st, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return st, fmt.Errorf("%s: %s: %s", src, resp.Status, strings.TrimSpace(string(msg)))
+		}
+		body = resp.Body
+	} else {
+		f, err := os.Open(src)
+		if err != nil {
+			return st, err
+		}
+		defer f.Close()
+		body = f
+	}
+	if err := json.NewDecoder(body).Decode(&st); err != nil {
+		return st, fmt.Errorf("%s: %w", src, err)
+	}
+	return st, nil
+}
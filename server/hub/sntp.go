@@ -0,0 +1,129 @@
+package hub
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"pulse/clock"
+)
+
+// SNTP (RFC 4330) for devices that cannot run the sync_req handshake: with
+// PULSE_SNTP_ADDR set, client requests are answered from the same clock
+// now_ms and next_ms come from. The server answers as stratum 1 with the
+// reference "PULS", so the pulse server is the time source such devices
+// follow, whatever the host itself is synchronised to.
+const (
+	sntpPacketSize = 48
+	sntpModeClient = 3
+	sntpModeServer = 4
+	sntpStratum    = 1
+	// sntpPrecision is -20 as a signed byte: 2^-20 s, about a microsecond.
+	sntpPrecision = 0xec
+)
+
+var sntpRefID = [4]byte{'P', 'U', 'L', 'S'}
+
+// sntpServer answers SNTP requests on addr. After an upgrade the old
+// process holds the port until the new one is ready, so the new one keeps
+// trying to bind it for a while; requests in between go unanswered and
+// clients retry.
+type sntpServer struct {
+	addr string
+	// utc is the disciplined clock, if PULSE_TIME_SOURCE is set.
+	utc *clock.Disciplined
+
+	mu     sync.Mutex
+	pc     net.PacketConn
+	closed bool
+}
+
+func (s *sntpServer) start() error {
+	pc, err := net.ListenPacket("udp", s.addr)
+	if err == nil {
+		s.serve(pc)
+		return nil
+	}
+	if !handedOver() {
+		return err
+	}
+	go func() {
+		for deadline := time.Now().Add(handoffTimeout); time.Now().Before(deadline); {
+			time.Sleep(50 * time.Millisecond)
+			if pc, err = net.ListenPacket("udp", s.addr); err == nil {
+				s.serve(pc)
+				return
+			}
+		}
+		slog.Error("sntp", "err", err)
+	}()
+	return nil
+}
+
+func (s *sntpServer) serve(pc net.PacketConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		pc.Close()
+		return
+	}
+	s.pc = pc
+	slog.Info("sntp: listening", "addr", pc.LocalAddr().String())
+	go s.loop(pc)
+}
+
+func (s *sntpServer) loop(pc net.PacketConn) {
+	buf := make([]byte, 512)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		received := s.utc.At(time.Now())
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("sntp", "err", err)
+			}
+			return
+		}
+		reply := sntpReply(buf[:n], received)
+		if reply == nil {
+			continue
+		}
+		binary.BigEndian.PutUint64(reply[40:], clock.NTPTime(s.utc.At(time.Now())))
+		_, _ = pc.WriteTo(reply, from)
+	}
+}
+
+// close stops answering, for good.
+func (s *sntpServer) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.pc != nil {
+		s.pc.Close()
+	}
+}
+
+// sntpReply builds the answer to a client request received at received,
+// leaving the transmit timestamp to be set right before sending. It is nil
+// for anything but a client request of NTP version 1 to 4.
+func sntpReply(req []byte, received time.Time) []byte {
+	if len(req) < sntpPacketSize {
+		return nil
+	}
+	version, mode := req[0]>>3&7, req[0]&7
+	if mode != sntpModeClient || version < 1 || version > 4 {
+		return nil
+	}
+	b := make([]byte, sntpPacketSize)
+	b[0] = version<<3 | sntpModeServer // leap indicator 0: no warning
+	b[1] = sntpStratum
+	b[2] = req[2] // poll interval, echoed
+	b[3] = sntpPrecision
+	copy(b[12:16], sntpRefID[:])
+	binary.BigEndian.PutUint64(b[16:], clock.NTPTime(received)) // reference
+	copy(b[24:32], req[40:48])                                  // originate: the client's transmit
+	binary.BigEndian.PutUint64(b[32:], clock.NTPTime(received))
+	return b
+}
@@ -0,0 +1,57 @@
+package hub
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// socketTuning is applied to every WebSocket and SSE connection once it is
+// hijacked from the HTTP server, since the right trade-offs depend on where
+// the clients are. On a LAN syncing audio, every pulse should leave the
+// moment it is written: TCP_NODELAY, Go's default, does that, and a small send
+// buffer keeps a stalled client from queueing pulses that would arrive
+// stale. A WAN dashboard may rather batch small writes into fewer packets
+// and ride out slow links with a larger buffer. TCP keepalive probes find
+// dead peers under the WebSocket pings, e.g. for clients that never answer
+// them. Unix socket connections have none of these and are left alone.
+type socketTuning struct {
+	noDelay bool
+	// sendBuffer is SO_SNDBUF in bytes; 0 leaves the kernel's.
+	sendBuffer int
+	// keepAlive is the idle time before TCP keepalive probes, and the
+	// interval between them; 0 turns them off.
+	keepAlive time.Duration
+}
+
+// defaultKeepAlive is Go's own for accepted connections.
+const defaultKeepAlive = 15 * time.Second
+
+// sockets is the tuning set by PULSE_TCP_NODELAY, PULSE_SEND_BUFFER_BYTES
+// and PULSE_TCP_KEEPALIVE_MS.
+var sockets = socketTuning{noDelay: true, keepAlive: defaultKeepAlive}
+
+// tune applies t to conn if it is a TCP connection, or TLS over one.
+func (t socketTuning) tune(conn net.Conn) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	err := tcp.SetNoDelay(t.noDelay)
+	if err == nil && t.sendBuffer > 0 {
+		err = tcp.SetWriteBuffer(t.sendBuffer)
+	}
+	if err == nil {
+		err = tcp.SetKeepAlive(t.keepAlive > 0)
+	}
+	if err == nil && t.keepAlive > 0 {
+		err = tcp.SetKeepAlivePeriod(t.keepAlive)
+	}
+	if err != nil {
+		slog.Debug("tune socket", "remote", tcp.RemoteAddr(), "err", err)
+	}
+}
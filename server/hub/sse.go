@@ -0,0 +1,153 @@
+package hub
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"pulse/ws"
+)
+
+// sseEvent encodes a frame for a Server-Sent Events subscriber: text
+// messages become data events and pings become comments, which also keep
+// idle proxies from timing out the stream. Other frames have no SSE
+// equivalent and return nil.
+func sseEvent(opcode byte, payload []byte) []byte {
+	switch opcode {
+	case ws.OpText:
+		event := make([]byte, 0, len(payload)+8)
+		event = append(event, "data: "...)
+		event = append(event, payload...)
+		return append(event, "\n\n"...)
+	case ws.OpPing:
+		return []byte(": ping\n\n")
+	}
+	return nil
+}
+
+// serveSSE streams the same messages a pulse.v2+json WebSocket client gets
+// as text/event-stream, for networks that block WebSocket upgrades. The
+// subscriber joins the hub like any other connection, so fan-out, quotas
+// and lag handling apply unchanged.
+func serveSSE(h *Hub, gate *handshakeGate) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := h.limits.allowUpgrade(r.RemoteAddr); !ok {
+			h.limits.rejectRate(w, r, wait)
+			return
+		}
+		ch := h.channel(defaultChannel)
+		if name := r.PathValue("channel"); name != "" {
+			if ch = h.channel(name); ch == nil {
+				http.Error(w, fmt.Sprintf("unknown channel %q", name), http.StatusNotFound)
+				return
+			}
+		}
+		rate, err := parseRate(r.URL.Query().Get("rate"))
+		if err == nil && !ch.offers(rate) {
+			err = fmt.Errorf("channel %q has no rate %d", ch.name, rate)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		every, err := parseEvery(r.URL.Query().Get("every"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		micros, err := parsePrecision(r.URL.Query().Get("precision"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		subject, err := h.subscribers.authenticate(r, h.auth)
+		if err != nil {
+			rejectUnauthenticated(w, r, err)
+			return
+		}
+		ident, err := h.identity.fromRequest(r)
+		if err != nil {
+			connLog.log(churnLevel(), "connection rejected", "request_id", requestIDFrom(r.Context()), "remote", r.RemoteAddr, "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		leave, ok := h.limits.acquire()
+		if !ok {
+			h.limits.rejectFull(w, r)
+			return
+		}
+		defer leave()
+		release, err := gate.acquire(r.Context())
+		if err != nil {
+			gate.reject(w, err)
+			return
+		}
+		// The stream outlives setup; only setup holds a gate slot.
+		defer func() {
+			if release != nil {
+				release()
+			}
+		}()
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		// As in ws.Hijack: the stream outlives the server's timeouts.
+		_ = conn.SetDeadline(time.Time{})
+		sockets.tune(conn)
+
+		var extra strings.Builder
+		for name, values := range w.Header() {
+			for _, v := range values {
+				extra.WriteString(name + ": " + v + "\r\n")
+			}
+		}
+		if _, err := rw.WriteString(
+			"HTTP/1.1 200 OK\r\n" +
+				"Content-Type: text/event-stream\r\n" +
+				"Cache-Control: no-cache\r\n" +
+				"Connection: close\r\n" +
+				extra.String() + "\r\n",
+		); err != nil || rw.Flush() != nil {
+			_ = conn.Close()
+			return
+		}
+
+		c := &Conn{
+			conn:        conn,
+			id:          requestIDFrom(r.Context()),
+			remote:      r.RemoteAddr,
+			connectedAt: time.Now(),
+			proto:       protoJSON,
+			tenant:      tenantFromRequest(r),
+			br:          rw.Reader,
+			identity:    ident,
+			subject:     subject,
+			sse:         true,
+			clientID:    r.URL.Query().Get("client_id"),
+		}
+		c.ch.Store(ch)
+		c.caps.Store(capsFromRequest(r))
+		c.rate.Store(rate)
+		c.every.Store(every)
+		c.micros.Store(micros)
+		if err := h.greet(c); err != nil {
+			_ = c.Close()
+			return
+		}
+		h.add(c)
+		release()
+		release = nil
+		connLog.log(churnLevel(), "client connected", "request_id", c.id, "remote", c.remote, "subject", c.subject, "proto", "sse", "tenant", c.tenant, "channel", c.Channel(), "clients", h.Count())
+		defer func() {
+			h.remove(c)
+			connLog.log(churnLevel(), "client disconnected", "request_id", c.id, "remote", c.remote, "clients", h.Count())
+		}()
+		// Clients never send anything; reading only notices when they go.
+		_, err = io.Copy(io.Discard, c.br)
+		c.setCause(netCause(err))
+	}
+}
@@ -0,0 +1,221 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+type statusResponse struct {
+	Seq         uint64        `json:"seq"`
+	PeriodMS    int64         `json:"period_ms"`
+	Paused      bool          `json:"paused,omitempty"`
+	Subscribers int           `json:"subscribers"`
+	JitterMS    float64       `json:"jitter_ms"`
+	Jitter      *jitterStats  `json:"jitter,omitempty"`
+	BroadcastMS float64       `json:"broadcast_ms"`
+	BytesSent   uint64        `json:"bytes_sent"`
+	Canary      *canaryStatus `json:"canary,omitempty"`
+	Alerting    bool          `json:"alerting"`
+	Alerts      []activeAlert `json:"alerts"`
+	// Storm is the running disconnect storm, or else the last one.
+	Storm *stormReport `json:"storm,omitempty"`
+}
+
+// statusTracker keeps the most recent pulse observation for /api/status.
+// period is reported until the first pulse announces its own.
+type statusTracker struct {
+	period  time.Duration
+	started time.Time
+
+	mu   sync.Mutex
+	last PulseObservation
+}
+
+func newStatusTracker(period time.Duration) *statusTracker {
+	return &statusTracker{period: period, started: time.Now()}
+}
+
+func (s *statusTracker) record(o PulseObservation) {
+	s.mu.Lock()
+	s.last = o
+	s.mu.Unlock()
+}
+
+// response is the status as of the latest pulse.
+func (s *statusTracker) response(h *Hub, a *alerter, c *canarySubscriber) statusResponse {
+	s.mu.Lock()
+	last := s.last
+	s.mu.Unlock()
+
+	period := s.period
+	if last.Period > 0 {
+		period = last.Period
+	}
+	active := a.active()
+	return statusResponse{
+		Seq:         last.Seq,
+		PeriodMS:    period.Milliseconds(),
+		Paused:      h.channel(defaultChannel).transport.isPaused(),
+		Subscribers: last.Subscribers,
+		JitterMS:    msFloat(last.Jitter),
+		Jitter:      h.pulseMetrics.jitter(defaultChannel),
+		BroadcastMS: msFloat(last.Broadcast),
+		BytesSent:   h.acct.total(),
+		Canary:      c.status(),
+		Alerting:    len(active) > 0,
+		Alerts:      active,
+		Storm:       h.storms.status(),
+	}
+}
+
+func (s *statusTracker) handler(h *Hub, a *alerter, c *canarySubscriber) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := s.response(h, a, c)
+		body, err := json.Marshal(resp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeCached(w, r, "application/json", body, statusETag(resp))
+	}
+}
+
+// statusETagBucket is the coarse time granularity of /api/status ETags.
+// Within a bucket the ETag only changes when the subscriber count, period or
+// alert state does, so polling dashboards mostly get 304s.
+const statusETagBucket = 5 * time.Second
+
+func statusETag(resp statusResponse) string {
+	key := fmt.Sprintf("%d|%d|%t|%d", time.Now().UnixNano()/int64(statusETagBucket), resp.PeriodMS, resp.Alerting, resp.Subscribers)
+	if resp.Storm != nil {
+		key += fmt.Sprintf("|storm:%d:%t", resp.Storm.StartedAt.UnixNano(), resp.Storm.Active)
+	}
+	for _, al := range resp.Alerts {
+		key += "|" + al.Name
+	}
+	return "W/" + etagOf([]byte(key))
+}
+
+// runtimeStatus is served by GET /status: what a dashboard or script wants
+// to know about the running process, where /api/status is about delivery.
+type runtimeStatus struct {
+	Version     versionResponse `json:"version"`
+	StartedAtMS int64           `json:"started_at_ms"`
+	UptimeS     float64         `json:"uptime_s"`
+	// Seq and PeriodMS are the default channel's latest pulse;
+	// ConfiguredPeriodMS is its period as configured at startup.
+	Seq                uint64          `json:"seq"`
+	PeriodMS           int64           `json:"period_ms"`
+	ConfiguredPeriodMS int64           `json:"configured_period_ms"`
+	Clients            int             `json:"clients"`
+	Channels           []channelStatus `json:"channels"`
+	// Domains are the clock domains; see clockdomain.go.
+	Domains []domainStatus `json:"domains,omitempty"`
+	// Upstream is the server this one relays, in relay mode; see
+	// upstream.go.
+	Upstream *upstreamStatus `json:"upstream,omitempty"`
+	// TimeSource is what disciplines the server's clock; see
+	// timesource.go.
+	TimeSource *timeSourceStatus `json:"time_source,omitempty"`
+	// BroadcastMS and DriftMS are of the default channel's latest pulse:
+	// how long fan-out took, and how late it went out.
+	BroadcastMS float64 `json:"broadcast_ms"`
+	DriftMS     float64 `json:"drift_ms"`
+	Goroutines  int     `json:"goroutines"`
+	HeapBytes   uint64  `json:"heap_bytes"`
+}
+
+type channelStatus struct {
+	Name     string `json:"name"`
+	Seq      uint64 `json:"seq"`
+	PeriodMS int64  `json:"period_ms"`
+	Clients  int    `json:"clients"`
+	Paused   bool   `json:"paused,omitempty"`
+	DrivenBy string `json:"driven_by,omitempty"`
+	// FinalSeq is the last pulse of a channel being retired.
+	FinalSeq uint64 `json:"final_seq,omitempty"`
+	// Domain is the clock domain the channel is bound to.
+	Domain string `json:"domain,omitempty"`
+	// Jitter is how late the channel's recent pulses went out.
+	Jitter *jitterStats `json:"jitter,omitempty"`
+}
+
+// runtimeHandler serves GET /status.
+func (s *statusTracker) runtimeHandler(h *Hub) http.HandlerFunc {
+	version := buildVersion()
+	return func(w http.ResponseWriter, _ *http.Request) {
+		s.mu.Lock()
+		last := s.last
+		s.mu.Unlock()
+
+		clients := make(map[string]int)
+		total := 0
+		h.mu.RLock()
+		for c := range h.conns {
+			if !c.internal {
+				clients[c.Channel()]++
+				total++
+			}
+		}
+		h.mu.RUnlock()
+		// runtime/metrics, unlike ReadMemStats, does not stop the world
+		// under the pulse loop.
+		heap := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+		metrics.Read(heap)
+
+		resp := runtimeStatus{
+			Version:            version,
+			StartedAtMS:        s.started.UnixMilli(),
+			UptimeS:            time.Since(s.started).Seconds(),
+			Seq:                last.Seq,
+			PeriodMS:           h.channel(defaultChannel).Period().Milliseconds(),
+			ConfiguredPeriodMS: s.period.Milliseconds(),
+			Clients:            total,
+			Channels:           make([]channelStatus, 0, len(h.channels)),
+			BroadcastMS:        msFloat(last.Broadcast),
+			DriftMS:            msFloat(last.Jitter),
+			Goroutines:         runtime.NumGoroutine(),
+		}
+		if heap[0].Value.Kind() == metrics.KindUint64 {
+			resp.HeapBytes = heap[0].Value.Uint64()
+		}
+		for _, name := range h.channelNames() {
+			ch := h.channel(name)
+			st := channelStatus{
+				Name:     name,
+				PeriodMS: ch.Period().Milliseconds(),
+				Clients:  clients[name],
+				Paused:   ch.transport.isPaused(),
+				DrivenBy: h.drivenBy(ch),
+				Jitter:   h.pulseMetrics.jitter(name),
+			}
+			if a := ch.last.Load(); a != nil {
+				st.Seq = a.seq
+			}
+			if r := ch.retiring.Load(); r != nil {
+				st.FinalSeq = r.finalSeq
+			}
+			if ch.domain != nil {
+				st.Domain = ch.domain.name
+			}
+			resp.Channels = append(resp.Channels, st)
+		}
+		now := time.Now()
+		for _, d := range h.domains {
+			resp.Domains = append(resp.Domains, d.status(now))
+		}
+		resp.Upstream = h.upstream.status()
+		resp.TimeSource = h.timeSource.status()
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+func msFloat(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,361 @@
+package hub
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Store persists server state, history, stats and the audit log. Keys hold
+// single values that are overwritten; streams are append-only record logs.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Get returns the value stored under key, or errNotFound.
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+	// Append adds record to the end of stream.
+	Append(stream string, record []byte) error
+	// Tail returns up to n of the most recent records of stream, oldest
+	// first.
+	Tail(stream string, n int) ([][]byte, error)
+	Close() error
+}
+
+var errNotFound = errors.New("not found")
+
+// Well-known keys and streams.
+const (
+	keyState    = "state"
+	streamAudit = "audit"
+)
+
+// serverState is the live-adjustable configuration that survives restarts,
+// stored under keyState.
+type serverState struct {
+	OffsetMS int64 `json:"offset_ms"`
+}
+
+func loadState(s Store) (serverState, bool, error) {
+	var st serverState
+	b, err := s.Get(keyState)
+	if errors.Is(err, errNotFound) {
+		return st, false, nil
+	}
+	if err != nil {
+		return st, false, err
+	}
+	return st, true, json.Unmarshal(b, &st)
+}
+
+func saveState(s Store, st serverState) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return s.Put(keyState, b)
+}
+
+// openStore opens the store described by spec:
+//
+//	memory               in-process only (default)
+//	file:DIR             one file per key and a JSON-lines log per stream
+//	redis://HOST:PORT/DB Redis strings and lists under the "pulse:" prefix
+//	sqlite:PATH          SQLite via a database/sql driver linked into the binary
+func openStore(spec string) (Store, error) {
+	spec = strings.TrimSpace(spec)
+	switch {
+	case spec == "" || spec == "memory":
+		return newMemoryStore(), nil
+	case strings.HasPrefix(spec, "file:"):
+		return openFileStore(strings.TrimPrefix(spec, "file:"))
+	case strings.HasPrefix(spec, "redis://"):
+		return openRedisStore(spec)
+	case strings.HasPrefix(spec, "sqlite:"):
+		return openSQLStore(strings.TrimPrefix(spec, "sqlite:"))
+	}
+	return nil, fmt.Errorf("unknown store %q", spec)
+}
+
+// validStoreName keeps keys and stream names usable as file names and
+// Redis key suffixes.
+func validStoreName(name string) error {
+	if !validName(name) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid store name %q", name)
+	}
+	return nil
+}
+
+// memoryStreamCap bounds each in-memory stream.
+const memoryStreamCap = 10000
+
+type memoryStore struct {
+	mu      sync.Mutex
+	values  map[string][]byte
+	streams map[string][][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		values:  make(map[string][]byte),
+		streams: make(map[string][][]byte),
+	}
+}
+
+func (s *memoryStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	if !ok {
+		return nil, errNotFound
+	}
+	return bytes.Clone(v), nil
+}
+
+func (s *memoryStore) Put(key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = bytes.Clone(value)
+	return nil
+}
+
+func (s *memoryStore) Append(stream string, record []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recs := s.streams[stream]
+	if len(recs) == memoryStreamCap {
+		recs = recs[1:]
+	}
+	s.streams[stream] = append(recs, bytes.Clone(record))
+	return nil
+}
+
+func (s *memoryStore) Tail(stream string, n int) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return tail(s.streams[stream], n), nil
+}
+
+func (s *memoryStore) Close() error { return nil }
+
+func tail(recs [][]byte, n int) [][]byte {
+	if n > 0 && len(recs) > n {
+		recs = recs[len(recs)-n:]
+	}
+	out := make([][]byte, len(recs))
+	for i, r := range recs {
+		out[i] = bytes.Clone(r)
+	}
+	return out
+}
+
+// fileStore keeps each key in DIR/<key>.json, replaced atomically, and each
+// stream in DIR/<stream>.log with one record per line. With a codec, closed
+// history segments are compressed (see segment.go).
+type fileStore struct {
+	dir string
+	mu  sync.Mutex
+
+	codecName string
+	codec     HistoryCodec
+}
+
+func openFileStore(dir string) (*fileStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("file store needs a directory")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+func (s *fileStore) Get(key string) ([]byte, error) {
+	if err := validStoreName(key); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(filepath.Join(s.dir, key+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNotFound
+	}
+	return b, err
+}
+
+func (s *fileStore) Put(key string, value []byte) error {
+	if err := validStoreName(key); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmp, err := os.CreateTemp(s.dir, "."+key+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, key+".json"))
+}
+
+func (s *fileStore) Append(stream string, record []byte) error {
+	if err := validStoreName(stream); err != nil {
+		return err
+	}
+	if bytes.ContainsAny(record, "\r\n") {
+		return fmt.Errorf("file store records must be single-line")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(filepath.Join(s.dir, stream+".log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(bytes.Clone(record), '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *fileStore) Tail(stream string, n int) ([][]byte, error) {
+	if err := validStoreName(stream); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.Open(filepath.Join(s.dir, stream+".log"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var recs [][]byte
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		recs = append(recs, bytes.Clone(sc.Bytes()))
+		if n > 0 && len(recs) > 2*n {
+			recs = append(recs[:0], recs[len(recs)-n:]...)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return tail(recs, n), nil
+}
+
+func (s *fileStore) Close() error { return nil }
+
+// segmentTime names rotated segments so they sort chronologically.
+const segmentTime = "20060102T150405.000000000Z"
+
+// Rotate renames the current log of stream to a timestamped segment. A
+// history segment is compressed, if there is a codec, before it is listed.
+func (s *fileStore) Rotate(stream string) error {
+	if err := validStoreName(stream); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	cur := filepath.Join(s.dir, stream+".log")
+	fi, err := os.Stat(cur)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && fi.Size() == 0) {
+		s.mu.Unlock()
+		return nil
+	}
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	name := stream + "-" + time.Now().UTC().Format(segmentTime)
+	seg := filepath.Join(s.dir, name+".log")
+	codecName, codec := s.codecName, s.codec
+	if stream != streamHistory || codec == nil {
+		defer s.mu.Unlock()
+		return os.Rename(cur, seg)
+	}
+	// Compress under a hidden name, which Segments does not list, so
+	// neither the archiver nor a query sees the segment twice.
+	hidden := filepath.Join(s.dir, "."+name+".log")
+	err = os.Rename(cur, hidden)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := compressSegment(hidden, filepath.Join(s.dir, name+".seg"), codecName, codec); err != nil {
+		return errors.Join(err, os.Rename(hidden, seg))
+	}
+	return os.Remove(hidden)
+}
+
+// Segments lists the closed segments of stream, plain (.log) and
+// compressed (.seg), oldest first.
+func (s *fileStore) Segments(stream string) ([]string, error) {
+	if err := validStoreName(stream); err != nil {
+		return nil, err
+	}
+	plain, err := filepath.Glob(filepath.Join(s.dir, stream+"-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := filepath.Glob(filepath.Join(s.dir, stream+"-*.seg"))
+	segs := append(plain, compressed...)
+	sort.Strings(segs)
+	return segs, err
+}
+
+// appender writes records to a store from its own goroutine so hot paths
+// such as the pulse loop never wait on storage. Records are dropped, and
+// counted, when the store cannot keep up.
+type appender struct {
+	store   Store
+	queue   chan appendRecord
+	dropped atomic.Uint64
+}
+
+type appendRecord struct {
+	stream string
+	rec    []byte
+}
+
+func newAppender(store Store, size int) *appender {
+	a := &appender{store: store, queue: make(chan appendRecord, size)}
+	go func() {
+		for r := range a.queue {
+			if err := store.Append(r.stream, r.rec); err != nil {
+				slog.Error("store: append", "stream", r.stream, "err", err)
+			}
+		}
+	}()
+	return a
+}
+
+func (a *appender) append(stream string, rec []byte) {
+	select {
+	case a.queue <- appendRecord{stream, rec}:
+	default:
+		if n := a.dropped.Add(1); n&(n-1) == 0 {
+			slog.Warn("store: falling behind, records dropped", "dropped", n)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package hub
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	redisPrefix = "pulse:"
+	// redisStreamCap bounds each stream list via LTRIM.
+	redisStreamCap = 100000
+	redisTimeout   = 2 * time.Second
+)
+
+// redisStore stores keys as Redis strings and streams as lists. It speaks
+// just enough RESP for that over a single connection, redialling after
+// errors.
+type redisStore struct {
+	addr     string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func openRedisStore(raw string) (*redisStore, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	s := &redisStore{addr: u.Host}
+	if !strings.Contains(s.addr, ":") {
+		s.addr += ":6379"
+	}
+	if pw, ok := u.User.Password(); ok {
+		s.password = pw
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis db %q", db)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.dial(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *redisStore) dial() error {
+	conn, err := net.DialTimeout("tcp", s.addr, redisTimeout)
+	if err != nil {
+		return err
+	}
+	s.conn, s.br = conn, bufio.NewReader(conn)
+	if s.password != "" {
+		if _, err := s.roundTrip("AUTH", s.password); err != nil {
+			s.reset()
+			return err
+		}
+	}
+	if s.db != 0 {
+		if _, err := s.roundTrip("SELECT", strconv.Itoa(s.db)); err != nil {
+			s.reset()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *redisStore) reset() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
+	s.conn, s.br = nil, nil
+}
+
+// do runs one command, redialling first if the previous one failed.
+func (s *redisStore) do(args ...string) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if err := s.dial(); err != nil {
+			return nil, err
+		}
+	}
+	v, err := s.roundTrip(args...)
+	if _, isReply := err.(redisError); err != nil && !isReply {
+		s.reset()
+	}
+	return v, err
+}
+
+func (s *redisStore) roundTrip(args ...string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	_ = s.conn.SetDeadline(time.Now().Add(redisTimeout))
+	if _, err := io.WriteString(s.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRESP(s.br)
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// readRESP reads one reply. Bulk strings are returned as []byte (nil for
+// a null bulk), arrays as []any.
+func readRESP(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		out := make([]any, n)
+		for i := range out {
+			if out[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// publish sends msg to the pub/sub channel topic.
+func (s *redisStore) publish(topic string, msg []byte) error {
+	_, err := s.do("PUBLISH", topic, string(msg))
+	return err
+}
+
+// subscribe calls fn with every message published to topic until the
+// subscription fails or Close is called. It takes the store's connection
+// over; the store is of no other use afterwards.
+func (s *redisStore) subscribe(topic string, fn func([]byte)) error {
+	s.mu.Lock()
+	if s.conn == nil {
+		if err := s.dial(); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	if _, err := s.roundTrip("SUBSCRIBE", topic); err != nil {
+		s.reset()
+		s.mu.Unlock()
+		return err
+	}
+	conn, br := s.conn, s.br
+	_ = conn.SetDeadline(time.Time{})
+	s.mu.Unlock()
+	for {
+		v, err := readRESP(br)
+		if err != nil {
+			s.mu.Lock()
+			if s.conn == conn {
+				s.reset()
+			}
+			s.mu.Unlock()
+			return err
+		}
+		// Pushes are ["message", topic, payload].
+		if msg, ok := v.([]any); ok && len(msg) == 3 {
+			if kind, _ := msg[0].([]byte); string(kind) == "message" {
+				payload, _ := msg[2].([]byte)
+				fn(payload)
+			}
+		}
+	}
+}
+
+// Lease scripts: extend or release key only while it still holds our id.
+const (
+	redisRenewScript   = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) end return 0`
+	redisReleaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`
+)
+
+// acquireLease sets key to id for ttl unless it is set already, and
+// reports whether it did.
+func (s *redisStore) acquireLease(key, id string, ttl time.Duration) (bool, error) {
+	v, err := s.do("SET", key, id, "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return v == "OK", err
+}
+
+// renewLease extends key by ttl and reports whether it still held id.
+func (s *redisStore) renewLease(key, id string, ttl time.Duration) (bool, error) {
+	v, err := s.do("EVAL", redisRenewScript, "1", key, id, strconv.FormatInt(ttl.Milliseconds(), 10))
+	return v == int64(1), err
+}
+
+// releaseLease deletes key if it still holds id.
+func (s *redisStore) releaseLease(key, id string) error {
+	_, err := s.do("EVAL", redisReleaseScript, "1", key, id)
+	return err
+}
+
+func (s *redisStore) Get(key string) ([]byte, error) {
+	v, err := s.do("GET", redisPrefix+key)
+	if err != nil {
+		return nil, err
+	}
+	b, _ := v.([]byte)
+	if b == nil {
+		return nil, errNotFound
+	}
+	return b, nil
+}
+
+func (s *redisStore) Put(key string, value []byte) error {
+	_, err := s.do("SET", redisPrefix+key, string(value))
+	return err
+}
+
+func (s *redisStore) Append(stream string, record []byte) error {
+	key := redisPrefix + "stream:" + stream
+	if _, err := s.do("RPUSH", key, string(record)); err != nil {
+		return err
+	}
+	_, err := s.do("LTRIM", key, strconv.Itoa(-redisStreamCap), "-1")
+	return err
+}
+
+func (s *redisStore) Tail(stream string, n int) ([][]byte, error) {
+	start := "0"
+	if n > 0 {
+		start = strconv.Itoa(-n)
+	}
+	v, err := s.do("LRANGE", redisPrefix+"stream:"+stream, start, "-1")
+	if err != nil {
+		return nil, err
+	}
+	items, _ := v.([]any)
+	out := make([][]byte, 0, len(items))
+	for _, it := range items {
+		if b, ok := it.([]byte); ok {
+			out = append(out, b)
+		}
+	}
+	return out, nil
+}
+
+func (s *redisStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reset()
+	return nil
+}
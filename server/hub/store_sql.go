@@ -0,0 +1,100 @@
+package hub
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// sqlDrivers are the database/sql driver names tried for sqlite: stores.
+// The server does not link a driver itself; an embedder that wants SQLite
+// adds a blank import of one (e.g. modernc.org/sqlite or
+// github.com/mattn/go-sqlite3) to the build.
+var sqlDrivers = []string{"sqlite", "sqlite3"}
+
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS pulse_kv (
+	key   TEXT PRIMARY KEY,
+	value BLOB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS pulse_stream (
+	id     INTEGER PRIMARY KEY AUTOINCREMENT,
+	stream TEXT NOT NULL,
+	record BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS pulse_stream_by_name ON pulse_stream (stream, id);
+`
+
+type sqlStore struct {
+	db *sql.DB
+}
+
+func openSQLStore(path string) (*sqlStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("sqlite store needs a path")
+	}
+	available := sql.Drivers()
+	for _, name := range sqlDrivers {
+		if !slices.Contains(available, name) {
+			continue
+		}
+		db, err := sql.Open(name, path)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := db.Exec(sqlSchema); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("sqlite schema: %w", err)
+		}
+		return &sqlStore{db: db}, nil
+	}
+	return nil, fmt.Errorf("no SQLite database/sql driver is linked into this binary")
+}
+
+func (s *sqlStore) Get(key string) ([]byte, error) {
+	var v []byte
+	err := s.db.QueryRow(`SELECT value FROM pulse_kv WHERE key = ?`, key).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNotFound
+	}
+	return v, err
+}
+
+func (s *sqlStore) Put(key string, value []byte) error {
+	_, err := s.db.Exec(`INSERT INTO pulse_kv (key, value) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value`, key, value)
+	return err
+}
+
+func (s *sqlStore) Append(stream string, record []byte) error {
+	_, err := s.db.Exec(`INSERT INTO pulse_stream (stream, record) VALUES (?, ?)`, stream, record)
+	return err
+}
+
+func (s *sqlStore) Tail(stream string, n int) ([][]byte, error) {
+	limit := -1 // SQLite: no limit
+	if n > 0 {
+		limit = n
+	}
+	rows, err := s.db.Query(`SELECT record FROM (
+		SELECT id, record FROM pulse_stream WHERE stream = ? ORDER BY id DESC LIMIT ?
+	) ORDER BY id`, stream, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out [][]byte
+	for rows.Next() {
+		var rec []byte
+		if err := rows.Scan(&rec); err != nil {
+			return nil, err
+		}
+		out = append(out, rec)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,240 @@
+package hub
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Disconnect causes, recorded per connection by whoever notices first.
+const (
+	causeClientClose = "client_close"   // client sent a close frame
+	causeReset       = "reset"          // TCP reset or FIN without a close frame
+	causeTimeout     = "timeout"        // write timeout or no pong in time
+	causeSlow        = "slow"           // dropped for lagging
+	causeProtocol    = "protocol_error" // client broke the WebSocket protocol
+	causeServer      = "server"         // kicked, redirected or shut down
+	causeUnknown     = "unknown"
+)
+
+// setCause records why c is going away unless a cause is already known.
+func (c *Conn) setCause(cause string) {
+	c.cause.CompareAndSwap(nil, &cause)
+}
+
+func (c *Conn) disconnectCause() string {
+	if p := c.cause.Load(); p != nil {
+		return *p
+	}
+	return causeUnknown
+}
+
+// netCause classifies a read or write error.
+func netCause(err error) string {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return causeTimeout
+	}
+	return causeReset
+}
+
+type stormConfig struct {
+	Fraction   float64       // share of clients that must drop within Window; 0 disables
+	Window     time.Duration // how close together the disconnects must be
+	MinClients int           // disconnects needed before anything counts as a storm
+}
+
+func stormConfigFromEnv() stormConfig {
+	return stormConfig{
+		Fraction:   float64(envInt("PULSE_STORM_PERCENT", 20)) / 100,
+		Window:     envMS("PULSE_STORM_WINDOW_MS", 5*time.Second),
+		MinClients: envInt("PULSE_STORM_MIN_CLIENTS", 10),
+	}
+}
+
+// stormReport describes a disconnect storm: ongoing in /api/status, and
+// final in the single disconnect_storm event sent when it is over.
+type stormReport struct {
+	Event       string         `json:"event,omitempty"`
+	Active      bool           `json:"active"`
+	StartedAt   time.Time      `json:"started_at"`
+	EndedAt     *time.Time     `json:"ended_at,omitempty"`
+	Disconnects int            `json:"disconnects"`
+	Before      int            `json:"clients_before"`
+	Fraction    float64        `json:"fraction"`
+	Cause       string         `json:"cause"`
+	Causes      map[string]int `json:"causes"`
+	// TopRemotes counts disconnects per peer IP for the busiest few.
+	TopRemotes []remoteCount `json:"top_remotes"`
+}
+
+type remoteCount struct {
+	IP    string `json:"ip"`
+	Count int    `json:"count"`
+}
+
+type stormDisconnect struct {
+	at     time.Time
+	cause  string
+	remote string
+}
+
+// stormDetector watches client disconnects for mass events, e.g. a load
+// balancer restart or a network partition dropping a large share of
+// clients at once. Rather than one alert per client, a storm becomes one
+// aggregated report with a probable cause, shown in /api/status while it
+// lasts and posted to the alert webhook once no client has dropped for a
+// full window.
+type stormDetector struct {
+	cfg    stormConfig
+	alerts *alerter
+
+	mu     sync.Mutex
+	recent []stormDisconnect // within cfg.Window, outside a storm
+	storm  *stormState
+	last   *stormReport
+}
+
+type stormState struct {
+	start  time.Time
+	before int
+	drops  []stormDisconnect
+	timer  *time.Timer
+}
+
+func newStormDetector(cfg stormConfig, alerts *alerter) *stormDetector {
+	if cfg.Fraction <= 0 {
+		return nil
+	}
+	return &stormDetector{cfg: cfg, alerts: alerts}
+}
+
+// disconnect records that a client went away for cause, leaving remaining
+// clients connected. Server-initiated disconnects are deliberate and never
+// count. A nil detector ignores it.
+func (s *stormDetector) disconnect(cause, remote string, remaining int, now time.Time) {
+	if s == nil || cause == causeServer {
+		return
+	}
+	d := stormDisconnect{at: now, cause: cause, remote: remoteIP(remote)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.storm != nil {
+		s.storm.drops = append(s.storm.drops, d)
+		s.storm.timer.Reset(s.cfg.Window)
+		return
+	}
+
+	s.recent = append(s.recent, d)
+	cut := 0
+	for cut < len(s.recent) && now.Sub(s.recent[cut].at) > s.cfg.Window {
+		cut++
+	}
+	s.recent = s.recent[cut:]
+	before := remaining + len(s.recent)
+	if len(s.recent) < s.cfg.MinClients || float64(len(s.recent)) < s.cfg.Fraction*float64(before) {
+		return
+	}
+	s.storm = &stormState{
+		start:  s.recent[0].at,
+		before: before,
+		drops:  s.recent,
+		timer:  time.AfterFunc(s.cfg.Window, s.end),
+	}
+	s.recent = nil
+	slog.Warn("disconnect storm", "dropped", len(s.storm.drops), "clients", before, "within", s.cfg.Window)
+}
+
+// end closes the running storm, once it has been quiet for a window.
+func (s *stormDetector) end() {
+	s.mu.Lock()
+	st := s.storm
+	if st == nil {
+		s.mu.Unlock()
+		return
+	}
+	s.storm = nil
+	rep := st.report()
+	ended := st.drops[len(st.drops)-1].at
+	rep.Event, rep.Active, rep.EndedAt = "disconnect_storm", false, &ended
+	s.last = &rep
+	s.mu.Unlock()
+
+	slog.Warn("disconnect storm over", "dropped", rep.Disconnects, "clients", rep.Before, "cause", rep.Cause)
+	s.alerts.post(rep.Event, rep)
+}
+
+// status returns the running storm, or else the last one; nil if there
+// has not been any.
+func (s *stormDetector) status() *stormReport {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.storm != nil {
+		rep := s.storm.report()
+		return &rep
+	}
+	return s.last
+}
+
+func (st *stormState) report() stormReport {
+	rep := stormReport{
+		Active:      true,
+		StartedAt:   st.start,
+		Disconnects: len(st.drops),
+		Before:      st.before,
+		Causes:      make(map[string]int),
+	}
+	rep.Fraction = float64(rep.Disconnects) / float64(max(rep.Before, 1))
+	remotes := make(map[string]int)
+	for _, d := range st.drops {
+		rep.Causes[d.cause]++
+		remotes[d.remote]++
+	}
+	for ip, n := range remotes {
+		rep.TopRemotes = append(rep.TopRemotes, remoteCount{IP: ip, Count: n})
+	}
+	sort.Slice(rep.TopRemotes, func(i, j int) bool {
+		a, b := rep.TopRemotes[i], rep.TopRemotes[j]
+		return a.Count > b.Count || a.Count == b.Count && a.IP < b.IP
+	})
+	rep.TopRemotes = rep.TopRemotes[:min(len(rep.TopRemotes), 5)]
+	rep.Cause = classifyStorm(rep)
+	return rep
+}
+
+// classifyStorm guesses what caused a storm from how clients went away:
+//
+//   - lb_restart: connections reset, nearly all from a handful of peer
+//     addresses, i.e. the proxies in front of the server
+//   - network_partition: clients stopped answering or writes timed out
+//   - connection_reset: connections reset from many addresses, e.g. an
+//     upstream router or NAT dropping state
+//   - client_rollout: clients closed cleanly, e.g. an app release
+//     reloading every page
+//   - unknown: no cause accounts for most disconnects
+func classifyStorm(rep stormReport) string {
+	most := func(cause string) bool {
+		return float64(rep.Causes[cause]) >= 0.6*float64(rep.Disconnects)
+	}
+	top := 0
+	for _, r := range rep.TopRemotes[:min(len(rep.TopRemotes), 3)] {
+		top += r.Count
+	}
+	switch {
+	case most(causeReset) && float64(top) >= 0.8*float64(rep.Disconnects):
+		return "lb_restart"
+	case most(causeTimeout):
+		return "network_partition"
+	case most(causeReset):
+		return "connection_reset"
+	case most(causeClientClose):
+		return "client_rollout"
+	}
+	return causeUnknown
+}
@@ -0,0 +1,92 @@
+package hub
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// systemd integration, without linking against libsystemd. With socket
+// activation (a .socket unit), systemd opens the listening sockets and
+// passes them on as descriptors 3 and up, announced in LISTEN_PID and
+// LISTEN_FDS (sd_listen_fds(3)); the server serves those instead of
+// PULSE_ADDR, so connections made while it starts or restarts wait in the
+// socket's backlog rather than being refused. With Type=notify, it tells
+// systemd when it is serving and when it stops (sd_notify(3)); after a
+// SIGUSR2 upgrade the new process names itself the service's main process,
+// which takes NotifyAccess=all.
+
+// listenFDsStart is the first descriptor systemd passes.
+const listenFDsStart = 3
+
+// activatedListeners returns the listening sockets systemd passed to this
+// process, or none without socket activation. The LISTEN_* variables are
+// cleared so that no child process takes the sockets for its own.
+func activatedListeners() ([]net.Listener, error) {
+	pid, n := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	names := os.Getenv("LISTEN_FDNAMES")
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(name)
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(n)
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+	fdNames := strings.Split(names, ":")
+	var lns []net.Listener
+	for i := range count {
+		name := "activated"
+		if i < len(fdNames) && fdNames[i] != "" {
+			name = fdNames[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			return nil, fmt.Errorf("socket %s (descriptor %d) from systemd: %w", name, listenFDsStart+i, err)
+		}
+		lns = append(lns, ln)
+	}
+	slog.Info("systemd: serving the sockets it passed instead of PULSE_ADDR", "sockets", count)
+	return lns, nil
+}
+
+// sdNotify sends state, e.g. "READY=1", to systemd; it does nothing unless
+// systemd asked for notifications.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:] // an abstract socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("systemd: notify", "err", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		slog.Warn("systemd: notify", "err", err)
+	}
+}
+
+// sdReady tells systemd that this process is serving, and after an
+// upgrade that it is the service's main process now.
+func sdReady() {
+	if handedOver() {
+		sdNotify("MAINPID=" + strconv.Itoa(os.Getpid()) + "\nREADY=1")
+		return
+	}
+	sdNotify("READY=1")
+}
@@ -0,0 +1,157 @@
+package hub
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// tempo gives a channel musical structure: its pulses are beats, grouped
+// into bars by a time signature. The tempo itself is the channel's period,
+// so retuning the period changes the BPM.
+type tempo struct {
+	beatsPerBar int
+	beatUnit    int
+	// barSeq is the seq of a downbeat (bar 1, beat 1); bars count from it.
+	barSeq atomic.Uint64
+}
+
+// tempoInfo describes a channel's tempo in its hello.
+type tempoInfo struct {
+	BPM         float64 `json:"bpm"`
+	BeatsPerBar int     `json:"beats_per_bar"`
+	BeatUnit    int     `json:"beat_unit"`
+}
+
+// bpmPeriod converts beats per minute to a period.
+func bpmPeriod(bpm float64) time.Duration {
+	return time.Duration(float64(time.Minute) / bpm)
+}
+
+// periodBPM converts a period to beats per minute, rounded to 1/1000.
+func periodBPM(period time.Duration) float64 {
+	return math.Round(float64(time.Minute)/float64(period)*1000) / 1000
+}
+
+// parseBPM parses a tempo such as "128", "128bpm" or "7/8@96bpm" and
+// returns its period and time signature (4/4 unless given).
+func parseBPM(raw string) (time.Duration, *tempo, error) {
+	sig, bpmRaw, hasSig := strings.Cut(strings.TrimSpace(raw), "@")
+	if !hasSig {
+		sig, bpmRaw = "4/4", sig
+	}
+	bpm, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(bpmRaw), "bpm"), 64)
+	if err != nil || bpm <= 0 || bpmPeriod(bpm) < minChannelPeriod {
+		return 0, nil, fmt.Errorf("invalid tempo %q: bpm must be positive and at most %.0f", raw, float64(time.Minute)/float64(minChannelPeriod))
+	}
+	t, err := parseTimeSignature(sig)
+	if err != nil {
+		return 0, nil, err
+	}
+	return bpmPeriod(bpm), t, nil
+}
+
+// parseTimeSignature parses e.g. "3/4" or "7/8".
+func parseTimeSignature(raw string) (*tempo, error) {
+	beats, unit, ok := strings.Cut(strings.TrimSpace(raw), "/")
+	n, err1 := strconv.Atoi(beats)
+	u, err2 := strconv.Atoi(unit)
+	if !ok || err1 != nil || err2 != nil || n < 1 || n > 64 || u < 1 || u > 64 || u&(u-1) != 0 {
+		return nil, fmt.Errorf("invalid time signature %q (want e.g. 4/4 or 7/8)", raw)
+	}
+	return &tempo{beatsPerBar: n, beatUnit: u}, nil
+}
+
+// defaultTempo reads PULSE_BPM and PULSE_TIME_SIGNATURE; the tempo is nil
+// if the default channel has none.
+func defaultTempo() (time.Duration, *tempo, error) {
+	bpm := strings.TrimSpace(os.Getenv("PULSE_BPM"))
+	if bpm == "" {
+		return 0, nil, nil
+	}
+	if sig := strings.TrimSpace(os.Getenv("PULSE_TIME_SIGNATURE")); sig != "" {
+		bpm = sig + "@" + bpm
+	}
+	return parseBPM(bpm)
+}
+
+// maxTaps bounds the taps POST /admin/tap takes at once.
+const maxTaps = 64
+
+// tapPeriod derives a period from tap times in milliseconds, as their
+// average interval. Taps must be increasing, and no interval may be under
+// half or over twice the average, which catches double and missed taps.
+func tapPeriod(tapsMS []int64) (time.Duration, error) {
+	if len(tapsMS) < 2 || len(tapsMS) > maxTaps {
+		return 0, fmt.Errorf("taps_ms must have 2 to %d taps", maxTaps)
+	}
+	for i := 1; i < len(tapsMS); i++ {
+		if tapsMS[i] <= tapsMS[i-1] {
+			return 0, fmt.Errorf("taps_ms must be increasing")
+		}
+	}
+	n := int64(len(tapsMS) - 1)
+	avg := time.Duration(tapsMS[n]-tapsMS[0]) * time.Millisecond / time.Duration(n)
+	for i := 1; i < len(tapsMS); i++ {
+		if d := time.Duration(tapsMS[i]-tapsMS[i-1]) * time.Millisecond; d < avg/2 || d > 2*avg {
+			return 0, fmt.Errorf("taps_ms too uneven: tap %d is %s after the one before, the average is %s", i, d, avg)
+		}
+	}
+	return avg, nil
+}
+
+// position places seq in the bar structure; bar and beat count from 1.
+func (t *tempo) position(seq uint64) (bar uint64, beat int) {
+	n := seq - t.barSeq.Load()
+	return n/uint64(t.beatsPerBar) + 1, int(n%uint64(t.beatsPerBar)) + 1
+}
+
+// restartBars makes seq the first beat of bar 1, e.g. when the transport
+// is reset.
+func (t *tempo) restartBars(seq uint64) {
+	if t != nil {
+		t.barSeq.Store(seq)
+	}
+}
+
+// info describes t at period for a hello; nil without a tempo.
+func (t *tempo) info(period time.Duration) *tempoInfo {
+	if t == nil {
+		return nil
+	}
+	return &tempoInfo{BPM: periodBPM(period), BeatsPerBar: t.beatsPerBar, BeatUnit: t.beatUnit}
+}
+
+// tempoEnricher adds bpm, bar, beat and is_downbeat to the pulses of
+// channels with a tempo, with the pulse's phase within its bar and, unless
+// the pulse was driven, epoch_ms: when bar 1 began, or would have at the
+// current tempo, so one pulse is enough to place any instant in the bars.
+func (h *Hub) tempoEnricher(msg PulseMessage) map[string]any {
+	ch := h.channel(msg.Channel)
+	if ch == nil || ch.tempo == nil {
+		return nil
+	}
+	bar, beat := ch.tempo.position(msg.Seq)
+	fields := map[string]any{
+		"bpm":         periodBPM(ch.Period()),
+		"bar":         bar,
+		"beat":        beat,
+		"is_downbeat": beat == 1,
+		"phase":       float64(beat-1) / float64(ch.tempo.beatsPerBar),
+	}
+	if !msg.Beat.IsZero() {
+		fields["epoch_ms"] = ch.tempo.epochMS(msg.Seq, msg.Beat.Add(-pulseSwing(msg)), ch.Period(), msg.OffsetMS)
+	}
+	return fields
+}
+
+// epochMS is when bar 1 began on a grid of period whose beat seq falls at
+// beat, in Unix milliseconds to the microsecond with offsetMS applied.
+func (t *tempo) epochMS(seq uint64, beat time.Time, period time.Duration, offsetMS int64) float64 {
+	epoch := beat.Add(-time.Duration(seq-t.barSeq.Load()) * period)
+	return float64(epoch.UnixMicro())/1000 + float64(offsetMS)
+}
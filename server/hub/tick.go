@@ -0,0 +1,136 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"pulse/clock"
+)
+
+// tickSource, when set, replaces the internal scheduler: Start hands it a
+// TickDriver and the embedder's simulation calls Tick once per frame.
+var tickSource func(d *TickDriver)
+
+// RegisterTickSource installs an external simulation as the pulse source.
+// Embedders call it before Start, e.g. from an init func:
+//
+//	func init() {
+//		hub.RegisterTickSource(func(d *hub.TickDriver) {
+//			for range time.Tick(16 * time.Millisecond) {
+//				r, _ := d.Tick(world.Step())
+//				if r.OverBudget {
+//					// shed load, e.g. d.SetPeriod(33 * time.Millisecond)
+//				}
+//			}
+//		})
+//	}
+func RegisterTickSource(fn func(d *TickDriver)) {
+	tickSource = fn
+}
+
+// TickDriver turns ticks of an authoritative simulation into pulses. The hub
+// still owns fan-out, seq numbering and the timing fields clients sync to;
+// the simulation only decides when a tick happens and what state it
+// carries.
+type TickDriver struct {
+	h       *Hub
+	observe func(PulseObservation)
+
+	mu      sync.Mutex
+	period  time.Duration
+	budget  time.Duration // 0 means one period
+	changed bool          // period changed since the last tick
+	seq     uint64
+	next    time.Time // when the next tick is expected
+}
+
+func newTickDriver(h *Hub, period, budget time.Duration, observe func(PulseObservation)) *TickDriver {
+	if period <= 0 {
+		period = time.Second
+	}
+	d := &TickDriver{h: h, period: period, budget: budget, observe: observe}
+	// After an upgrade seq carries on; timing is up to the simulation.
+	if a := h.channel(defaultChannel).resume; a != nil {
+		d.seq = a.seq + 1
+	}
+	return d
+}
+
+// TickReport is what Tick returns to the simulation: how the broadcast went
+// and whether fan-out fit in the frame budget. Late in the embedded
+// observation lists the clients whose frame was queued after the budget
+// ran out or behind frames still waiting, so a game loop can tell one slow
+// peer from a server that cannot keep up.
+type TickReport struct {
+	PulseObservation
+	Budget     time.Duration
+	OverBudget bool
+}
+
+// SetPeriod changes the nominal tick rate, e.g. to shed load after repeated
+// budget overruns. Clients pick it up from the next pulse's period_ms.
+func (d *TickDriver) SetPeriod(period time.Duration) {
+	if period <= 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if period != d.period {
+		d.period, d.changed = period, true
+		d.h.channel(defaultChannel).setPeriod(period)
+	}
+}
+
+// Tick broadcasts one pulse carrying state (as the "state" field; nil sends
+// none) and reports how the broadcast went. Clients predict the next tick
+// one nominal period ahead, so jitter reports how late the simulation is
+// against its own nominal rate.
+func (d *TickDriver) Tick(state any) (TickReport, error) {
+	var extra map[string]json.RawMessage
+	if state != nil {
+		b, err := json.Marshal(state)
+		if err != nil {
+			return TickReport{}, fmt.Errorf("encode tick state: %w", err)
+		}
+		extra = map[string]json.RawMessage{"state": b}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.h.clock.Now()
+	// An early tick counts as on time, as with the internal scheduler.
+	scheduled := d.next
+	if scheduled.IsZero() || scheduled.After(now) {
+		scheduled = now
+	}
+	d.next = now.Add(d.period)
+	offset := d.h.offset()
+	msg := PulseMessage{
+		Type:     "pulse",
+		Seq:      d.seq,
+		PeriodMS: d.period.Milliseconds(),
+		NowMS:    now.UnixMilli(),
+		NextMS:   d.next.Add(offset).UnixMilli(),
+		OffsetMS: offset.Milliseconds(),
+		MonoMS:   clock.MonoMS(now),
+
+		PeriodChanged: d.changed,
+		pulseContext:  pulseContext{Channel: defaultChannel, Extra: extra},
+	}
+	msg.setMicros(now, d.next.Add(offset), time.Time{}, d.period)
+	d.seq++
+	d.changed = false
+	budget := d.budget
+	if budget <= 0 {
+		budget = d.period
+	}
+	o := d.h.emit(msg, scheduled, budget, d.observe)
+	d.h.channel(defaultChannel).last.Store(&channelAnchor{seq: msg.Seq, at: scheduled, period: d.period})
+	return TickReport{
+		PulseObservation: o,
+		Budget:           budget,
+		OverBudget:       o.Broadcast > budget,
+	}, nil
+}
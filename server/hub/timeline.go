@@ -0,0 +1,66 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// With PULSE_PERSIST_TIMELINE on, every channel's period, latest seq and
+// grid are saved to the store every timelineSaveEvery and on shutdown, in
+// the form an upgrade hands over, and resumed at the next start. A restart
+// then looks to clients like a brief gap: seq carries on, counting the
+// slots missed while the server was down, and mono_ms as if it had kept
+// running.
+
+// keyTimeline holds the saved handoffState.
+const keyTimeline = "timeline"
+
+const timelineSaveEvery = time.Second
+
+// loadTimeline returns the timeline saved in s, if there is one.
+func loadTimeline(s Store) (handoffState, bool, error) {
+	var st handoffState
+	b, err := s.Get(keyTimeline)
+	if errors.Is(err, errNotFound) {
+		return st, false, nil
+	}
+	if err != nil {
+		return st, false, err
+	}
+	return st, true, json.Unmarshal(b, &st)
+}
+
+func (h *Hub) saveTimeline(s Store) error {
+	b, err := json.Marshal(h.handoffState())
+	if err != nil {
+		return err
+	}
+	return s.Put(keyTimeline, b)
+}
+
+// persistTimeline saves the timeline to s until ctx is done.
+func (h *Hub) persistTimeline(ctx context.Context, s Store) {
+	t := time.NewTicker(timelineSaveEvery)
+	defer t.Stop()
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		err := h.saveTimeline(s)
+		// Log when saving starts or stops failing, not every second.
+		if (err != nil) != failing {
+			failing = err != nil
+			if failing {
+				slog.Warn("save timeline", "err", err)
+			} else {
+				slog.Info("saving timeline again")
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package hub
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tsPoint aggregates all pulses within one bucket of a series.
+type tsPoint struct {
+	T              int64   `json:"t"` // bucket start, Unix milliseconds
+	Pulses         int     `json:"pulses"`
+	JitterAvgMS    float64 `json:"jitter_avg_ms"`
+	JitterMaxMS    float64 `json:"jitter_max_ms"`
+	BroadcastAvgMS float64 `json:"broadcast_avg_ms"`
+	BroadcastMaxMS float64 `json:"broadcast_max_ms"`
+	SubscribersAvg float64 `json:"subscribers_avg"`
+	SubscribersMax int     `json:"subscribers_max"`
+}
+
+func (p *tsPoint) add(o PulseObservation) {
+	n := float64(p.Pulses)
+	p.Pulses++
+	jitter, broadcast := msFloat(o.Jitter), msFloat(o.Broadcast)
+	p.JitterAvgMS = (p.JitterAvgMS*n + jitter) / (n + 1)
+	p.BroadcastAvgMS = (p.BroadcastAvgMS*n + broadcast) / (n + 1)
+	p.SubscribersAvg = (p.SubscribersAvg*n + float64(o.Subscribers)) / (n + 1)
+	p.JitterMaxMS = max(p.JitterMaxMS, jitter)
+	p.BroadcastMaxMS = max(p.BroadcastMaxMS, broadcast)
+	p.SubscribersMax = max(p.SubscribersMax, o.Subscribers)
+}
+
+// tsSeries is one resolution: the bucket being filled plus the most recent
+// closed buckets.
+type tsSeries struct {
+	name   string
+	res    time.Duration
+	keep   int
+	cur    tsPoint
+	points []tsPoint
+}
+
+// timeseries downsamples pulse observations into 1s, 1m and 1h series.
+// Closed buckets are appended to the store (stream "ts_<name>") and the
+// recent ones are kept in memory for /api/timeseries.
+type timeseries struct {
+	out *appender
+
+	mu     sync.Mutex
+	series []*tsSeries
+}
+
+func newTimeseries(store Store, out *appender) *timeseries {
+	t := &timeseries{
+		out: out,
+		series: []*tsSeries{
+			{name: "1s", res: time.Second, keep: 3600},
+			{name: "1m", res: time.Minute, keep: 1440},
+			{name: "1h", res: time.Hour, keep: 720},
+		},
+	}
+	for _, s := range t.series {
+		recs, err := store.Tail(s.stream(), s.keep)
+		if err != nil {
+			slog.Error("timeseries: load", "series", s.name, "err", err)
+			continue
+		}
+		for _, rec := range recs {
+			var p tsPoint
+			if json.Unmarshal(rec, &p) == nil {
+				s.points = append(s.points, p)
+			}
+		}
+	}
+	return t
+}
+
+func (s *tsSeries) stream() string {
+	return "ts_" + s.name
+}
+
+func (t *timeseries) observe(o PulseObservation) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.series {
+		start := o.At.Truncate(s.res).UnixMilli()
+		if s.cur.Pulses > 0 && s.cur.T != start {
+			t.close(s)
+		}
+		if s.cur.Pulses == 0 {
+			s.cur.T = start
+		}
+		s.cur.add(o)
+	}
+}
+
+func (t *timeseries) close(s *tsSeries) {
+	if len(s.points) == s.keep {
+		copy(s.points, s.points[1:])
+		s.points = s.points[:s.keep-1]
+	}
+	s.points = append(s.points, s.cur)
+	b, _ := json.Marshal(s.cur)
+	t.out.append(s.stream(), b)
+	s.cur = tsPoint{}
+}
+
+// points returns a copy of the last limit closed buckets of the named
+// series, or all of them when limit is 0.
+func (t *timeseries) points(name string, limit int) ([]tsPoint, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.series {
+		if s.name != name {
+			continue
+		}
+		pts := s.points
+		if limit > 0 && len(pts) > limit {
+			pts = pts[len(pts)-limit:]
+		}
+		return append([]tsPoint{}, pts...), true
+	}
+	return nil, false
+}
+
+type timeseriesResponse struct {
+	Resolution string    `json:"resolution"`
+	Points     []tsPoint `json:"points"`
+}
+
+// handler serves GET /api/timeseries?resolution=1m&limit=60. Points are
+// closed buckets, oldest first; the bucket still being filled is omitted.
+func (t *timeseries) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		name := q.Get("resolution")
+		if name == "" {
+			name = "1m"
+		}
+		limit := 0
+		if s := q.Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		pts, ok := t.points(name, limit)
+		if !ok {
+			http.Error(w, "resolution must be 1s, 1m or 1h", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, timeseriesResponse{Resolution: name, Points: pts})
+	}
+}
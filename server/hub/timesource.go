@@ -0,0 +1,387 @@
+package hub
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pulse/clock"
+	"pulse/ws"
+)
+
+// External time references. Pulses are stamped with the host's wall clock,
+// which is only as good as whatever keeps it. PULSE_TIME_SOURCE instead
+// disciplines the server's clock itself against a reference, so that
+// now_ms, next_ms and every other time the server hands out are true UTC
+// within a bound it reports, and independent servers agree without a relay:
+//
+//   - ntp://host[:port] queries an NTP server: a burst of four on start,
+//     then every PULSE_TIME_POLL_MS, taking the offset from the exchange
+//     with the shortest round trip of the last eight.
+//   - pps:/dev/ppsN follows a pulse-per-second device, e.g. a GPS
+//     receiver's, through the kernel's timestamps of its edges in
+//     /sys/class/pps. An edge marks a whole second; which one comes from
+//     the NTP server if one is given too, otherwise from the host clock,
+//     which must then be within half a second.
+//
+// Both may be given, comma-separated: PPS disciplines while its edges come
+// in, NTP when they stop. The server's clock is the host's plus the
+// offset, stepped to it at first and slewed after (see clock.Disciplined),
+// so beats never jump. The pulse loops wait on it, so with an ntp clock
+// domain beats fall on whole periods of true UTC on every such server.
+const (
+	timeBurst         = 4
+	timeBurstInterval = 2 * time.Second
+	timeWindow        = 8
+	timeQueryTimeout  = 2 * time.Second
+	// timeStartWait is how long startup waits for a first measurement, so
+	// that the first pulses are already on UTC.
+	timeStartWait = 5 * time.Second
+	// ppsPoll is how often the PPS device's last edge is read; ppsTimeout
+	// is how long after its last edge it stops disciplining.
+	ppsPoll    = 100 * time.Millisecond
+	ppsTimeout = 3 * time.Second
+	// timeDrift is what an undisciplined crystal may wander, 15 ppm; the
+	// bound grows by it as a measurement ages.
+	timeDrift = 15e-6
+	// ppsResolution is the least a PPS edge's timestamp is trusted to.
+	ppsResolution = time.Microsecond
+)
+
+// timeSample is an NTP exchange: the server's offset from the host clock,
+// the round trip and the server's own distance from its reference.
+type timeSample struct {
+	offset, delay, root time.Duration
+}
+
+// timeSource disciplines utc against its references.
+type timeSource struct {
+	utc  *clock.Disciplined
+	spec string
+	// ntp is the NTP server's address; pps the sysfs file of the PPS
+	// device's edges. Either may be empty.
+	ntp  string
+	pps  string
+	poll time.Duration
+
+	mu sync.Mutex
+	// The NTP exchanges and the best one's offset, bound and stratum as
+	// of ntpAt; ntpErr is the latest failure, cleared by success.
+	samples []timeSample
+	ntpAt   time.Time
+	ntpBest timeSample
+	stratum int
+	ntpErr  string
+	// The latest PPS edges' offsets, and when the last edge came.
+	ppsSeq     uint64
+	ppsAt      time.Time
+	ppsOffsets []time.Duration
+	// ref is the reference that last disciplined utc, and at when.
+	ref string
+	at  time.Time
+}
+
+// timeSourceStatus reports the time source in GET /status. State is locked
+// while the reference that disciplines the clock is being heard from;
+// BoundMS is how far from UTC the clock may be, counting the measurement,
+// what is still being slewed in and drift since.
+type timeSourceStatus struct {
+	Source    string  `json:"source"`
+	State     string  `json:"state"`
+	Reference string  `json:"reference,omitempty"`
+	OffsetMS  float64 `json:"offset_ms"`
+	SlewingMS float64 `json:"slewing_ms,omitempty"`
+	BoundMS   float64 `json:"bound_ms,omitempty"`
+	Stratum   int     `json:"stratum,omitempty"`
+	SyncedMS  int64   `json:"synced_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// parseTimeSource parses PULSE_TIME_SOURCE, polling an NTP server every
+// poll.
+func parseTimeSource(raw string, poll time.Duration) (*timeSource, error) {
+	ts := &timeSource{spec: strings.TrimSpace(raw), poll: poll}
+	if poll < 16*time.Second {
+		return nil, fmt.Errorf("poll interval must be at least 16s, not %s", poll)
+	}
+	for _, entry := range ws.SplitHeaderList(raw) {
+		switch {
+		case strings.HasPrefix(entry, "ntp://"):
+			u, err := url.Parse(entry)
+			if err != nil || u.Host == "" {
+				return nil, fmt.Errorf("invalid NTP server %q", entry)
+			}
+			if ts.ntp != "" {
+				return nil, errors.New("give at most one NTP server")
+			}
+			ts.ntp = u.Host
+			if u.Port() == "" {
+				ts.ntp = net.JoinHostPort(u.Hostname(), "123")
+			}
+		case strings.HasPrefix(entry, "pps:"):
+			name := filepath.Base(strings.TrimPrefix(entry, "pps:"))
+			if !strings.HasPrefix(name, "pps") {
+				return nil, fmt.Errorf("want a PPS device such as pps:/dev/pps0, not %q", entry)
+			}
+			if ts.pps != "" {
+				return nil, errors.New("give at most one PPS device")
+			}
+			ts.pps = filepath.Join("/sys/class/pps", name, "assert")
+		default:
+			return nil, fmt.Errorf("unknown time source %q (want ntp://host or pps:/dev/ppsN)", entry)
+		}
+	}
+	if ts.ntp == "" && ts.pps == "" {
+		return nil, errors.New("no time source given")
+	}
+	return ts, nil
+}
+
+// start disciplines utc until ctx is done, waiting up to timeStartWait for
+// the first measurement.
+func (ts *timeSource) start(ctx context.Context, utc *clock.Disciplined) error {
+	ts.utc = utc
+	if ts.pps != "" {
+		if _, _, err := readPPS(ts.pps); err != nil {
+			return err
+		}
+	}
+	first := make(chan struct{})
+	var once sync.Once
+	synced := func() { once.Do(func() { close(first) }) }
+	if ts.ntp != "" {
+		go ts.runNTP(ctx, synced)
+	}
+	if ts.pps != "" {
+		go ts.runPPS(ctx, synced)
+	}
+	select {
+	case <-first:
+		st := ts.status()
+		slog.Info("time source: synced", "source", ts.spec, "reference", st.Reference, "offset_ms", st.OffsetMS, "bound_ms", st.BoundMS)
+	case <-time.After(timeStartWait):
+		slog.Warn("time source: no measurement yet; starting on the host clock", "source", ts.spec)
+	}
+	return nil
+}
+
+// runNTP queries the NTP server, calling synced after each success.
+func (ts *timeSource) runNTP(ctx context.Context, synced func()) {
+	for i := 0; ; i++ {
+		s, stratum, err := queryNTP(ts.ntp)
+		var offset time.Duration
+		ts.mu.Lock()
+		if err != nil {
+			if ts.ntpErr == "" {
+				slog.Warn("time source: NTP query failed", "server", ts.ntp, "err", err)
+			}
+			ts.ntpErr = err.Error()
+		} else {
+			ts.ntpErr = ""
+			if ts.samples = append(ts.samples, s); len(ts.samples) > timeWindow {
+				ts.samples = ts.samples[1:]
+			}
+			best := ts.samples[0]
+			for _, o := range ts.samples[1:] {
+				if o.delay < best.delay {
+					best = o
+				}
+			}
+			ts.ntpBest, ts.ntpAt, ts.stratum = best, time.Now(), stratum
+			offset = best.offset
+		}
+		ts.mu.Unlock()
+		if err == nil {
+			if !ts.ppsLocked() {
+				ts.correct("ntp", offset)
+			}
+			synced()
+		}
+		wait := ts.poll
+		if i < timeBurst-1 {
+			wait = timeBurstInterval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// runPPS follows the PPS device's edges, calling synced after each.
+func (ts *timeSource) runPPS(ctx context.Context, synced func()) {
+	t := time.NewTicker(ppsPoll)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		edge, seq, err := readPPS(ts.pps)
+		if err != nil {
+			slog.Warn("time source: PPS", "device", ts.pps, "err", err)
+			continue
+		}
+		ts.mu.Lock()
+		if seq == ts.ppsSeq || edge.IsZero() {
+			ts.mu.Unlock()
+			continue
+		}
+		// Which second the edge starts: by NTP if it is heard from, else
+		// by the clock as it is.
+		coarse := ts.utc.Offset()
+		if !ts.ntpAt.IsZero() {
+			coarse = ts.ntpBest.offset
+		}
+		offset := edge.Add(coarse).Round(time.Second).Sub(edge)
+		ts.ppsSeq, ts.ppsAt = seq, time.Now()
+		if ts.ppsOffsets = append(ts.ppsOffsets, offset); len(ts.ppsOffsets) > timeWindow {
+			ts.ppsOffsets = ts.ppsOffsets[1:]
+		}
+		// The median, so that a missed or doubled edge does not move it.
+		sorted := append([]time.Duration(nil), ts.ppsOffsets...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		offset = sorted[len(sorted)/2]
+		ts.mu.Unlock()
+		ts.correct("pps", offset)
+		synced()
+	}
+}
+
+// correct disciplines the clock by ref's offset.
+func (ts *timeSource) correct(ref string, offset time.Duration) {
+	before := ts.utc.Offset()
+	ts.mu.Lock()
+	changed := ts.ref != ref
+	ts.ref, ts.at = ref, time.Now()
+	ts.mu.Unlock()
+	if ts.utc.Correct(offset) {
+		slog.Info("time source: clock stepped", "reference", ref, "step", (offset - before).Round(time.Microsecond))
+	} else if changed {
+		slog.Info("time source: reference", "reference", ref)
+	}
+}
+
+func (ts *timeSource) ppsLocked() bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return !ts.ppsAt.IsZero() && time.Since(ts.ppsAt) < ppsTimeout
+}
+
+// status reports the time source; nil when there is none.
+func (ts *timeSource) status() *timeSourceStatus {
+	if ts == nil {
+		return nil
+	}
+	slewing := ts.utc.Slewing()
+	ppsLocked := ts.ppsLocked()
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	st := &timeSourceStatus{Source: ts.spec, State: "unlocked", Reference: ts.ref, OffsetMS: roundMS(ts.utc.Offset()), SlewingMS: roundMS(slewing), Stratum: ts.stratum, Error: ts.ntpErr}
+	if ts.at.IsZero() {
+		return st
+	}
+	st.SyncedMS = ts.at.UnixMilli()
+	var bound time.Duration
+	switch {
+	case ppsLocked:
+		st.State = "locked"
+		lo, hi := ts.ppsOffsets[0], ts.ppsOffsets[0]
+		for _, o := range ts.ppsOffsets {
+			lo, hi = min(lo, o), max(hi, o)
+		}
+		bound = (hi-lo)/2 + ppsResolution
+	case !ts.ntpAt.IsZero():
+		if time.Since(ts.ntpAt) < 4*ts.poll {
+			st.State = "locked"
+		}
+		bound = ts.ntpBest.delay/2 + ts.ntpBest.root
+	}
+	age := time.Since(ts.at)
+	bound += slewing.Abs() + time.Duration(float64(age)*timeDrift)
+	st.BoundMS = roundMS(bound)
+	return st
+}
+
+func roundMS(d time.Duration) float64 {
+	return math.Round(msFloat(d)*1000) / 1000
+}
+
+// queryNTP asks the NTP server at addr for the time.
+func queryNTP(addr string) (timeSample, int, error) {
+	conn, err := net.DialTimeout("udp", addr, timeQueryTimeout)
+	if err != nil {
+		return timeSample{}, 0, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeQueryTimeout))
+	req := make([]byte, sntpPacketSize)
+	req[0] = 4<<3 | sntpModeClient
+	t1 := time.Now()
+	binary.BigEndian.PutUint64(req[40:], clock.NTPTime(t1))
+	if _, err := conn.Write(req); err != nil {
+		return timeSample{}, 0, err
+	}
+	b := make([]byte, 512)
+	for {
+		n, err := conn.Read(b)
+		t4 := time.Now()
+		if err != nil {
+			return timeSample{}, 0, err
+		}
+		if n < sntpPacketSize || b[0]&7 != sntpModeServer || string(b[24:32]) != string(req[40:48]) {
+			continue // not the answer to this request
+		}
+		stratum := int(b[1])
+		switch {
+		case b[0]>>6 == 3:
+			return timeSample{}, 0, errors.New("server is not synchronized")
+		case stratum == 0 || stratum > 15:
+			return timeSample{}, 0, fmt.Errorf("server refused with %q", b[12:16])
+		}
+		t2 := clock.FromNTPTime(binary.BigEndian.Uint64(b[32:]))
+		t3 := clock.FromNTPTime(binary.BigEndian.Uint64(b[40:]))
+		fixed := func(v uint32) time.Duration { return time.Duration(uint64(v) * uint64(time.Second) >> 16) }
+		return timeSample{
+			offset: (t2.Sub(t1) + t3.Sub(t4)) / 2,
+			delay:  max(t4.Sub(t1)-t3.Sub(t2), 0),
+			root:   fixed(binary.BigEndian.Uint32(b[4:]))/2 + fixed(binary.BigEndian.Uint32(b[8:])),
+		}, stratum, nil
+	}
+}
+
+// readPPS reads the last edge from a PPS device's assert file, e.g.
+// "1767225600.000001234#4711": when the kernel saw it, on the host clock,
+// and its sequence number. Before the first edge the time is zero.
+func readPPS(path string) (time.Time, uint64, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	stamp, seqRaw, ok := strings.Cut(strings.TrimSpace(string(raw)), "#")
+	secs, nanos, _ := strings.Cut(stamp, ".")
+	s, err1 := strconv.ParseInt(secs, 10, 64)
+	ns, err2 := strconv.ParseInt((nanos + "000000000")[:9], 10, 64)
+	seq, err3 := strconv.ParseUint(seqRaw, 10, 64)
+	if !ok || err1 != nil || err2 != nil || err3 != nil {
+		return time.Time{}, 0, fmt.Errorf("unexpected PPS edge %q in %s", raw, path)
+	}
+	if s == 0 && ns == 0 {
+		return time.Time{}, seq, nil
+	}
+	return time.Unix(s, ns), seq, nil
+}
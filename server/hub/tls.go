@@ -0,0 +1,89 @@
+package hub
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the certificate in certFile/keyFile and reloads it
+// when either file changes, so renewals (certbot, cert-manager) take effect
+// without a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate. If a reload fails,
+// the previous certificate keeps being served.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	mod, err := latestModTime(r.certFile, r.keyFile)
+	if err != nil && r.cert == nil {
+		return nil, err
+	}
+	if err == nil && (r.cert == nil || mod.After(r.modTime)) {
+		cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			if r.cert == nil {
+				return nil, fmt.Errorf("load TLS certificate: %w", err)
+			}
+			slog.Error("tls: reload certificate", "err", err)
+			return r.cert, nil
+		}
+		if r.cert != nil {
+			slog.Info("tls: reloaded certificate", "file", r.certFile)
+		}
+		r.cert, r.modTime = &cert, mod
+	}
+	return r.cert, nil
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// tlsConfigFromEnv returns the TLS config for PULSE_TLS_CERT and
+// PULSE_TLS_KEY, or nil to serve plain HTTP when neither is set.
+func tlsConfigFromEnv() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("PULSE_TLS_CERT"), os.Getenv("PULSE_TLS_KEY")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("PULSE_TLS_CERT and PULSE_TLS_KEY must be set together")
+	}
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}, nil
+}
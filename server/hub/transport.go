@@ -0,0 +1,153 @@
+package hub
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Transport actions, as sent to POST /admin/transport or in a controller
+// client's transport_control message.
+const (
+	transportPause  = "pause"  // stop emitting pulses
+	transportResume = "resume" // carry on, on the grid the channel had
+	transportReset  = "reset"  // (re)start with a fresh grid, first pulse now
+)
+
+// transport is the run state of a channel's pulse loop. Changes take effect
+// at once: the loop is woken, applies them and announces them with a
+// transportMessage before the next pulse.
+type transport struct {
+	mu      sync.Mutex
+	paused  bool
+	reset   bool   // start a fresh grid on the next wake
+	by      string // request ID of whoever made the last change
+	changed chan struct{}
+}
+
+// transportView is a snapshot of a transport; changed is closed on the
+// next change.
+type transportView struct {
+	paused  bool
+	reset   bool
+	by      string
+	changed <-chan struct{}
+}
+
+func (t *transport) view() transportView {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.changed == nil {
+		t.changed = make(chan struct{})
+	}
+	return transportView{paused: t.paused, reset: t.reset, by: t.by, changed: t.changed}
+}
+
+// control applies action on behalf of by.
+func (t *transport) control(action, by string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch action {
+	case transportPause:
+		if t.paused {
+			return nil
+		}
+		t.paused = true
+	case transportResume:
+		if !t.paused {
+			return nil
+		}
+		t.paused = false
+	case transportReset:
+		t.paused, t.reset = false, true
+	default:
+		return fmt.Errorf("action must be pause, resume or reset")
+	}
+	t.by = by
+	if t.changed != nil {
+		close(t.changed)
+	}
+	t.changed = make(chan struct{})
+	return nil
+}
+
+// takeReset clears a pending reset once the loop has applied it.
+func (t *transport) takeReset() {
+	t.mu.Lock()
+	t.reset = false
+	t.mu.Unlock()
+}
+
+func (t *transport) isPaused() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.paused
+}
+
+// transportMessage announces a channel being paused or started to its
+// clients, so they stop or start predicting pulses together. While paused,
+// seq is the seq the next pulse will carry; once running, the next pulse
+// is due at next_ms, after preroll counts if the channel is counted in.
+type transportMessage struct {
+	Type    string `json:"type"`
+	Channel string `json:"channel"`
+	State   string `json:"state"`           // paused or running
+	Phase   string `json:"phase,omitempty"` // when running: preserved or reset
+	Seq     uint64 `json:"seq"`
+	NowMS   int64  `json:"now_ms"`
+	NextMS  int64  `json:"next_ms,omitempty"`
+	Preroll int    `json:"preroll,omitempty"`
+	By      string `json:"by,omitempty"`
+}
+
+// transportControlMessage is sent by clients that presented controller or
+// admin credentials on the upgrade:
+// {"type":"transport_control","action":"pause","channel":"default"}.
+// channel defaults to the client's own.
+type transportControlMessage struct {
+	Type    string `json:"type"`
+	Action  string `json:"action"`
+	Channel string `json:"channel,omitempty"`
+}
+
+// controlTransport applies action to the channel called name.
+func (h *Hub) controlTransport(name, action, by string) error {
+	ch := h.channel(name)
+	if ch == nil {
+		return fmt.Errorf("unknown channel %q", name)
+	}
+	if by := h.drivenBy(ch); by != "" {
+		return fmt.Errorf("the %s channel is driven by the %s", ch.name, by)
+	}
+	if ch.retiring.Load() != nil {
+		// Paused, it would never reach its final pulse.
+		return fmt.Errorf("%w: channel %q", errRetiring, ch.name)
+	}
+	return ch.transport.control(action, by)
+}
+
+// announceTransport tells ch's clients it was paused or started; when
+// running, next is when the next pulse is due, after preroll counts.
+func (h *Hub) announceTransport(ch *pulseChannel, paused bool, phase string, seq uint64, next time.Time, preroll int, by string) {
+	now := h.clock.Now()
+	msg := transportMessage{Type: "transport", Channel: ch.name, State: "running", Phase: phase, Seq: seq, NowMS: now.UnixMilli(), Preroll: preroll, By: by}
+	if paused {
+		msg.State, msg.Phase = "paused", ""
+	} else {
+		msg.NextMS = now.Add(next.Sub(now) + h.offset()).UnixMilli()
+	}
+	slog.Info("transport", "channel", ch.name, "state", msg.State, "seq", seq)
+	h.backplane.publishTransport(msg)
+	h.relayTransport(ch, msg)
+}
+
+// relayTransport sends msg, a change of ch's transport, to ch's clients
+// and the MIDI clock, and records it.
+func (h *Hub) relayTransport(ch *pulseChannel, msg transportMessage) {
+	h.recorder.transport(msg)
+	if ch.name == defaultChannel {
+		h.midi.transport(msg.State == "paused", msg.Phase)
+	}
+	h.BroadcastIf(msg, func(c *Conn) bool { return c.receives(ch.name) })
+}
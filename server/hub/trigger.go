@@ -0,0 +1,151 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"pulse/clock"
+)
+
+// triggerOutput is a hardware line fired once per pulse.
+type triggerOutput interface {
+	fire(seq uint64) error
+}
+
+// trigger fires a GPIO pin or serial port at the instant clients are told
+// the next pulse happens (next_ms, offset applied), so cameras and lab
+// sensors line up with the broadcast clock. It runs on its own goroutine
+// so the pulse loop never waits on hardware.
+type trigger struct {
+	out  triggerOutput
+	next chan triggerAt
+}
+
+type triggerAt struct {
+	seq uint64
+	at  time.Time
+}
+
+// startTrigger opens the output named by spec, "gpio:<pin>" (Linux sysfs)
+// or "serial:<device>". An empty spec disables triggering.
+func startTrigger(spec string, width time.Duration) (*trigger, error) {
+	kind, arg, _ := strings.Cut(strings.TrimSpace(spec), ":")
+	var (
+		out triggerOutput
+		err error
+	)
+	switch kind {
+	case "":
+		return nil, nil
+	case "gpio":
+		out, err = openGPIOTrigger(arg, width)
+	case "serial":
+		out, err = openSerialTrigger(arg)
+	default:
+		return nil, fmt.Errorf("unknown trigger %q (want gpio:<pin> or serial:<device>)", spec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := &trigger{out: out, next: make(chan triggerAt, 1)}
+	go t.run()
+	return t, nil
+}
+
+// schedule arms the trigger for pulse seq at at, replacing a time that has
+// not fired yet. A nil trigger ignores it.
+func (t *trigger) schedule(seq uint64, at time.Time) {
+	if t == nil {
+		return
+	}
+	select {
+	case <-t.next:
+	default:
+	}
+	t.next <- triggerAt{seq, at}
+}
+
+func (t *trigger) run() {
+	var late int
+	for at := range t.next {
+		clock.SleepUntil(context.Background(), at.at)
+		err := t.out.fire(at.seq)
+		if err != nil {
+			slog.Error("trigger", "err", err)
+			continue
+		}
+		// Log occasionally rather than on every miss: a box that cannot
+		// keep sub-millisecond alignment will miss on every pulse.
+		if time.Since(at.at) > time.Millisecond {
+			late++
+			if late&(late-1) == 0 {
+				slog.Warn("trigger: fired late", "late_by", time.Since(at.at).Round(time.Microsecond), "late_triggers", late)
+			}
+		}
+	}
+}
+
+// gpioTrigger raises a sysfs GPIO pin for width on every pulse.
+type gpioTrigger struct {
+	value *os.File
+	width time.Duration
+}
+
+func openGPIOTrigger(pin string, width time.Duration) (*gpioTrigger, error) {
+	if _, err := strconv.Atoi(pin); err != nil {
+		return nil, fmt.Errorf("gpio pin %q is not a number", pin)
+	}
+	dir := filepath.Join("/sys/class/gpio", "gpio"+pin)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.WriteFile("/sys/class/gpio/export", []byte(pin), 0); err != nil {
+			return nil, fmt.Errorf("export gpio %s: %w", pin, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "direction"), []byte("low"), 0); err != nil {
+		return nil, fmt.Errorf("set gpio %s as output: %w", pin, err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "value"), os.O_WRONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open gpio %s: %w", pin, err)
+	}
+	return &gpioTrigger{value: f, width: width}, nil
+}
+
+func (g *gpioTrigger) fire(uint64) error {
+	if _, err := g.value.WriteAt([]byte("1"), 0); err != nil {
+		return err
+	}
+	for end := time.Now().Add(g.width); time.Now().Before(end); {
+	}
+	_, err := g.value.WriteAt([]byte("0"), 0)
+	return err
+}
+
+// serialTrigger writes the low byte of the pulse seq to a serial port, so
+// a recorder can tell consecutive triggers apart. Line settings (baud rate
+// and so on) are left to stty.
+type serialTrigger struct {
+	port *os.File
+}
+
+func openSerialTrigger(device string) (*serialTrigger, error) {
+	if device == "" {
+		return nil, fmt.Errorf("serial trigger needs a device, e.g. serial:/dev/ttyUSB0")
+	}
+	f, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open serial trigger: %w", err)
+	}
+	return &serialTrigger{port: f}, nil
+}
+
+func (s *serialTrigger) fire(seq uint64) error {
+	_, err := s.port.Write([]byte{byte(seq)})
+	return err
+}
@@ -0,0 +1,365 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"pulse/clock"
+	"pulse/ws"
+)
+
+// Relay mode. With PULSE_UPSTREAM set to another pulse server's WebSocket
+// URL, this server runs no pulse loops: it connects to the upstream as a
+// relay client (pulse.relay.v1+json) and sends the upstream's pulses,
+// transport changes, resyncs, count-ins, channel retirements and ends on
+// to its own clients, so regional relays, and relays of relays, share one
+// timeline. Seq, period and extra fields are the upstream's; the times are
+// moved onto this server's clock: the relay
+// measures its offset from the upstream with sync_req, the way clients do,
+// and converts next_ms and at_ms with it, while now_ms and mono_ms are its
+// own, as of when it sends the pulse on. Pulses stop while the upstream is
+// unreachable and seq carries on from the upstream's once it is back.
+const (
+	upstreamRetry = time.Second
+	// upstreamSyncEvery is how often the offset is measured again once
+	// the first upstreamSyncBurst exchanges, 100 ms apart, settled it.
+	upstreamSyncEvery = 5 * time.Second
+	upstreamSyncBurst = 5
+	// upstreamSyncWindow is how many exchanges the offset is taken from:
+	// the one with the shortest round trip.
+	upstreamSyncWindow = 16
+)
+
+// upstream follows another pulse server.
+type upstream struct {
+	url    string
+	header http.Header
+
+	mu        sync.Mutex
+	connected bool
+	// The sync exchanges, and the best one's offset (upstream minus local
+	// clock) and round trip, in milliseconds; synced is false until the
+	// first exchange, when the offset is taken from pulses instead.
+	samples []syncSample
+	offset  float64
+	rtt     float64
+	synced  bool
+	// latency is the latest pulse's one-way delay from the upstream.
+	latency float64
+	// unknown are upstream channels not configured here, each logged once.
+	unknown map[string]bool
+}
+
+type syncSample struct {
+	offset, rtt float64
+}
+
+// upstreamStatus reports relay mode in GET /status.
+type upstreamStatus struct {
+	URL       string  `json:"url"`
+	Connected bool    `json:"connected"`
+	OffsetMS  float64 `json:"offset_ms"`
+	RTTMS     float64 `json:"rtt_ms,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+// newUpstream checks raw, the upstream's URL; token, if set, is sent as a
+// bearer token.
+func newUpstream(raw, token string) (*upstream, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("want a ws:// or wss:// URL, not %q", raw)
+	}
+	up := &upstream{url: raw, header: http.Header{}, unknown: make(map[string]bool)}
+	if token != "" {
+		up.header.Set("Authorization", "Bearer "+token)
+	}
+	return up, nil
+}
+
+// follow relays the upstream's pulses to h's clients until ctx is done,
+// reconnecting after errors.
+func (up *upstream) follow(ctx context.Context, h *Hub) {
+	for ctx.Err() == nil {
+		err := up.session(ctx, h)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("upstream: connection lost; reconnecting", "url", up.url, "err", err, "in", upstreamRetry)
+		select {
+		case <-ctx.Done():
+		case <-time.After(upstreamRetry):
+		}
+	}
+}
+
+// session relays one connection until it fails.
+func (up *upstream) session(ctx context.Context, h *Hub) error {
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	conn, br, resp, err := ws.Dial(dialCtx, up.url, up.header, protoRelay)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if p := resp.Header.Get("Sec-WebSocket-Protocol"); p != protoRelay {
+		return fmt.Errorf("upstream chose subprotocol %q", p)
+	}
+	var wmu sync.Mutex
+	write := func(opcode byte, payload []byte) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		_ = conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+		_, err := conn.Write(ws.AppendMaskedFrame(nil, opcode, payload))
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = write(ws.OpClose, ws.ClosePayload(ws.CloseGoingAway, ""))
+		_ = conn.Close()
+	})
+	defer stop()
+	up.setConnected(true)
+	defer up.setConnected(false)
+	slog.Info("upstream: connected", "url", up.url)
+
+	done := make(chan struct{})
+	defer close(done)
+	go up.sync(conn, write, done)
+	for {
+		f, err := ws.ReadFrame(br, false, 0)
+		if err != nil {
+			return err
+		}
+		at := time.Now()
+		switch f.Opcode {
+		case ws.OpPing:
+			if err := write(ws.OpPong, f.Payload); err != nil {
+				return err
+			}
+		case ws.OpClose:
+			_ = write(ws.OpClose, f.Payload)
+			code, reason, _ := ws.ParseClose(f.Payload)
+			return fmt.Errorf("upstream closed the connection: %d %s", code, reason)
+		case ws.OpText:
+			up.handle(h, f.Payload, at)
+		}
+	}
+}
+
+// sync sends sync_req: a burst after connecting, then one every
+// upstreamSyncEvery.
+func (up *upstream) sync(conn net.Conn, write func(byte, []byte) error, done <-chan struct{}) {
+	for i := 0; ; i++ {
+		wait := 100 * time.Millisecond
+		if i >= upstreamSyncBurst {
+			wait = upstreamSyncEvery
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(wait):
+		}
+		req, _ := json.Marshal(syncRequest{Type: "sync_req", T1: json.RawMessage(fmt.Sprint(unixMSFloat(time.Now())))})
+		if write(ws.OpText, req) != nil {
+			_ = conn.Close()
+			return
+		}
+	}
+}
+
+// handle takes in a message from the upstream that arrived at at.
+func (up *upstream) handle(h *Hub, payload []byte, at time.Time) {
+	var head struct {
+		Type    string          `json:"type"`
+		Channel string          `json:"channel"`
+		Msg     json.RawMessage `json:"msg"`
+	}
+	if json.Unmarshal(payload, &head) != nil {
+		return
+	}
+	switch head.Type {
+	case "sync_resp":
+		var m struct {
+			T1 float64 `json:"t1"`
+			T2 float64 `json:"t2"`
+			T3 float64 `json:"t3"`
+		}
+		if json.Unmarshal(payload, &m) == nil {
+			up.observeSync(m.T1, m.T2, m.T3, unixMSFloat(at))
+		}
+	case "relay":
+		var kind struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(head.Msg, &kind) != nil {
+			return
+		}
+		switch kind.Type {
+		case "pulse":
+			var msg PulseMessage
+			if json.Unmarshal(head.Msg, &msg) != nil {
+				return
+			}
+			if ch := up.channel(h, head.Channel); ch != nil {
+				h.relay(ch, up.localize(msg, at))
+			}
+		case "channel_retiring":
+			var msg channelRetiringMessage
+			if json.Unmarshal(head.Msg, &msg) != nil {
+				return
+			}
+			msg.FinalMS -= up.shift().Milliseconds()
+			if ch := up.channel(h, head.Channel); ch != nil {
+				h.relayRetiring(ch, msg)
+			}
+		case "end":
+			var msg endMessage
+			if json.Unmarshal(head.Msg, &msg) != nil {
+				return
+			}
+			if ch := up.channel(h, head.Channel); ch != nil {
+				h.relayEnd(ch, msg)
+			}
+		}
+	case "transport":
+		var msg transportMessage
+		if json.Unmarshal(payload, &msg) != nil {
+			return
+		}
+		if ch := up.channel(h, msg.Channel); ch != nil {
+			h.relay(ch, backplaneMessage{Channel: ch.name, Transport: &msg})
+		}
+	case "resync":
+		var msg resyncMessage
+		if json.Unmarshal(payload, &msg) != nil {
+			return
+		}
+		// The new anchor is what clients start over from, so it goes onto
+		// this server's clock like a pulse's next_ms.
+		shift := up.shift()
+		msg.NowMS = time.Now().UnixMilli()
+		msg.NextMS -= shift.Milliseconds()
+		if ch := up.channel(h, msg.Channel); ch != nil {
+			h.relay(ch, backplaneMessage{Channel: ch.name, Resync: &msg})
+		}
+	case "preroll":
+		var msg prerollMessage
+		if json.Unmarshal(payload, &msg) != nil {
+			return
+		}
+		shift := up.shift()
+		msg.NowMS = time.Now().UnixMilli()
+		msg.AtMS -= shift.Milliseconds()
+		msg.NextMS -= shift.Milliseconds()
+		if ch := up.channel(h, msg.Channel); ch != nil {
+			h.relay(ch, backplaneMessage{Channel: ch.name, Preroll: &msg})
+		}
+	}
+}
+
+// shift is how far the upstream's clock is ahead of this server's.
+func (up *upstream) shift() time.Duration {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return time.Duration(up.offset * float64(time.Millisecond))
+}
+
+// channel is h's channel name, nil if it has none.
+func (up *upstream) channel(h *Hub, name string) *pulseChannel {
+	ch := h.channel(name)
+	if ch == nil {
+		up.mu.Lock()
+		if !up.unknown[name] {
+			up.unknown[name] = true
+			slog.Warn("upstream: channel not configured here; ignoring it", "channel", name)
+		}
+		up.mu.Unlock()
+	}
+	return ch
+}
+
+// localize moves msg, which arrived at at, onto the local clock, as a
+// backplane message for relay.
+func (up *upstream) localize(msg PulseMessage, at time.Time) backplaneMessage {
+	upstreamNow := unixTime(msg.NowMS, msg.NowUS)
+	up.mu.Lock()
+	if !up.synced {
+		// Until the first exchange, as if the pulse took no time.
+		up.offset = unixMSFloat(upstreamNow) - unixMSFloat(at)
+	}
+	offset := up.offset
+	up.latency = unixMSFloat(at) - (unixMSFloat(upstreamNow) - offset)
+	up.mu.Unlock()
+
+	shift := time.Duration(offset * float64(time.Millisecond))
+	// The pulse went out drift_ms after it was due, lead before its beat.
+	sent := upstreamNow.Add(-shift)
+	scheduled := sent.Add(-time.Duration(msg.DriftMS * float64(time.Millisecond)))
+	var beat time.Time
+	var lead time.Duration
+	if msg.AtMS != 0 {
+		beat = unixTime(msg.AtMS, msg.AtUS).Add(-shift)
+		msg.AtMS = beat.UnixMilli()
+		lead = beat.Sub(scheduled)
+	}
+	next := unixTime(msg.NextMS, msg.NextUS).Add(-shift)
+	msg.NextMS = next.UnixMilli()
+	now := time.Now()
+	msg.NowMS, msg.MonoMS = now.UnixMilli(), clock.MonoMS(now)
+	if msg.PeriodUS != 0 {
+		msg.setMicros(now, next, beat, msg.period())
+	}
+	return backplaneMessage{Channel: msg.Channel, ScheduledUnixNano: scheduled.UnixNano(), LeadNS: int64(lead), Pulse: &msg}
+}
+
+// observeSync adds an exchange: t1 and t4 local, t2 and t3 upstream time.
+func (up *upstream) observeSync(t1, t2, t3, t4 float64) {
+	rtt := (t4 - t1) - (t3 - t2)
+	if rtt < 0 {
+		return
+	}
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.samples = append(up.samples, syncSample{offset: ((t2 - t1) + (t3 - t4)) / 2, rtt: rtt}); len(up.samples) > upstreamSyncWindow {
+		up.samples = up.samples[1:]
+	}
+	best := up.samples[0]
+	for _, s := range up.samples[1:] {
+		if s.rtt < best.rtt {
+			best = s
+		}
+	}
+	up.offset, up.rtt, up.synced = best.offset, best.rtt, true
+}
+
+func (up *upstream) setConnected(v bool) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.connected = v
+	if !v {
+		// The next connection may take another route.
+		up.samples, up.synced = nil, false
+	}
+}
+
+// status reports the upstream; nil outside relay mode.
+func (up *upstream) status() *upstreamStatus {
+	if up == nil {
+		return nil
+	}
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	round := func(v float64) float64 { return math.Round(v*1000) / 1000 }
+	return &upstreamStatus{URL: redactURL(up.url), Connected: up.connected, OffsetMS: round(up.offset), RTTMS: round(up.rtt), LatencyMS: round(up.latency)}
+}
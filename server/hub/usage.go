@@ -0,0 +1,301 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Usage reporting, for billing and chargeback. Every tenant's usage is
+// counted as it happens (connections opened, connection time, bytes sent,
+// pulses delivered, API calls) and rolled up into one record per calendar
+// month (UTC), which is written to the store under usage-YYYY-MM every
+// PULSE_USAGE_FLUSH_MS and at shutdown, so months survive restarts. GET
+// /admin/usage?month=YYYY-MM reads a month back; the current one includes
+// what has not been written yet.
+
+// usageTotals is one tenant's usage over a month.
+type usageTotals struct {
+	Connects          uint64  `json:"connects"`
+	ConnectionSeconds float64 `json:"connection_seconds"`
+	PeakConnections   int64   `json:"peak_connections"`
+	BytesSent         uint64  `json:"bytes_sent"`
+	PulsesDelivered   uint64  `json:"pulses_delivered"`
+	APICalls          uint64  `json:"api_calls"`
+}
+
+func (t *usageTotals) add(d usageTotals) {
+	t.Connects += d.Connects
+	t.ConnectionSeconds += d.ConnectionSeconds
+	t.PeakConnections = max(t.PeakConnections, d.PeakConnections)
+	t.BytesSent += d.BytesSent
+	t.PulsesDelivered += d.PulsesDelivered
+	t.APICalls += d.APICalls
+}
+
+// usageMonth is the record stored for a month.
+type usageMonth struct {
+	Month     string                  `json:"month"`
+	UpdatedMS int64                   `json:"updated_ms"`
+	Tenants   map[string]*usageTotals `json:"tenants"`
+}
+
+// usageCounters are a tenant's running counts, kept on its tenantUsage.
+type usageCounters struct {
+	connects atomic.Uint64
+	pulses   atomic.Uint64
+	apiCalls atomic.Uint64
+	// conns is how many connections the tenant has now, and peak the most
+	// it had since the last flush.
+	conns atomic.Int64
+	peak  atomic.Int64
+	// closedNanos is the time since the last flush of connections that
+	// have closed since.
+	closedNanos atomic.Int64
+}
+
+func (u *usageCounters) connected() {
+	u.connects.Add(1)
+	n := u.conns.Add(1)
+	for p := u.peak.Load(); n > p && !u.peak.CompareAndSwap(p, n); p = u.peak.Load() {
+	}
+}
+
+// usageLedger rolls the counters up into months.
+type usageLedger struct {
+	h     *Hub
+	store Store
+
+	mu sync.Mutex
+	// flushed holds each tenant's counts as of the last flush, at
+	// flushedAt (Unix nanoseconds, read without mu by disconnect).
+	flushed   map[string]usageTotals
+	flushedAt atomic.Int64
+	// unsaved is usage taken from the counters that a failed write did
+	// not store; the next flush stores it.
+	unsaved map[string]usageTotals
+}
+
+func usageKey(month string) string { return "usage-" + month }
+
+// startUsageLedger rolls usage up into the store every interval.
+func startUsageLedger(h *Hub, store Store, every time.Duration) *usageLedger {
+	l := &usageLedger{h: h, store: store, flushed: make(map[string]usageTotals)}
+	l.flushedAt.Store(time.Now().UnixNano())
+	h.acct.ledger = l
+	if every > 0 {
+		go func() {
+			t := time.NewTicker(every)
+			defer t.Stop()
+			for now := range t.C {
+				l.flush(now)
+			}
+		}()
+	}
+	return l
+}
+
+// disconnected counts the time c was connected since the last flush. A
+// nil ledger ignores it.
+func (l *usageLedger) disconnected(c *Conn, now time.Time) {
+	if l == nil || c.connectedAt.IsZero() {
+		return
+	}
+	since := max(c.connectedAt.UnixNano(), l.flushedAt.Load())
+	c.usage.closedNanos.Add(max(now.UnixNano()-since, 0))
+}
+
+// pending returns each tenant's usage since the last flush; commit also
+// resets the counters it has taken. l.mu must be held.
+func (l *usageLedger) pending(now time.Time, commit bool) map[string]usageTotals {
+	since := l.flushedAt.Load()
+	live := make(map[string]int64)
+	l.h.mu.RLock()
+	for c := range l.h.conns {
+		if !c.internal && !c.connectedAt.IsZero() {
+			live[c.usage.name] += max(now.UnixNano()-max(c.connectedAt.UnixNano(), since), 0)
+		}
+	}
+	l.h.mu.RUnlock()
+
+	l.h.acct.mu.Lock()
+	tenants := make([]*tenantUsage, 0, len(l.h.acct.tenants))
+	for _, u := range l.h.acct.tenants {
+		tenants = append(tenants, u)
+	}
+	l.h.acct.mu.Unlock()
+
+	out := make(map[string]usageTotals, len(tenants))
+	for _, u := range tenants {
+		cur := usageTotals{
+			Connects:        u.connects.Load(),
+			BytesSent:       u.bytes.Load(),
+			PulsesDelivered: u.pulses.Load(),
+			APICalls:        u.apiCalls.Load(),
+		}
+		prev := l.flushed[u.name]
+		closed, peak := u.closedNanos.Load(), u.peak.Load()
+		if commit {
+			closed = u.closedNanos.Swap(0)
+			peak = u.peak.Swap(u.conns.Load())
+			l.flushed[u.name] = cur
+		}
+		d := usageTotals{
+			Connects:          cur.Connects - prev.Connects,
+			ConnectionSeconds: time.Duration(closed + live[u.name]).Seconds(),
+			PeakConnections:   peak,
+			BytesSent:         cur.BytesSent - prev.BytesSent,
+			PulsesDelivered:   cur.PulsesDelivered - prev.PulsesDelivered,
+			APICalls:          cur.APICalls - prev.APICalls,
+		}
+		if d != (usageTotals{}) {
+			out[u.name] = d
+		}
+	}
+	for name, d := range l.unsaved {
+		t := out[name]
+		t.add(d)
+		out[name] = t
+	}
+	if commit {
+		l.flushedAt.Store(now.UnixNano())
+		l.unsaved = nil
+	}
+	return out
+}
+
+func (l *usageLedger) load(month string) (usageMonth, error) {
+	m := usageMonth{Month: month, Tenants: make(map[string]*usageTotals)}
+	raw, err := l.store.Get(usageKey(month))
+	if errors.Is(err, errNotFound) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return m, err
+	}
+	if m.Tenants == nil {
+		m.Tenants = make(map[string]*usageTotals)
+	}
+	return m, nil
+}
+
+// flush adds the usage since the last flush to the month of now. A nil
+// ledger ignores it.
+func (l *usageLedger) flush(now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	month := now.UTC().Format("2006-01")
+	m, err := l.load(month)
+	if err != nil {
+		// Nothing is taken from the counters; the next flush stores it.
+		slog.Error("usage: read month", "month", month, "err", err)
+		return
+	}
+	pending := l.pending(now, true)
+	for name, d := range pending {
+		t := m.Tenants[name]
+		if t == nil {
+			t = &usageTotals{}
+			m.Tenants[name] = t
+		}
+		t.add(d)
+	}
+	m.UpdatedMS = now.UnixMilli()
+	b, _ := json.Marshal(m)
+	if err := l.store.Put(usageKey(month), b); err != nil {
+		slog.Error("usage: write month", "month", month, "err", err)
+		l.unsaved = pending
+	}
+}
+
+// usageReport is the answer to GET /admin/usage.
+type usageReport struct {
+	Month     string     `json:"month"`
+	UpdatedMS int64      `json:"updated_ms,omitempty"`
+	Rows      []usageRow `json:"tenants"`
+}
+
+type usageRow struct {
+	Tenant string `json:"tenant"`
+	usageTotals
+	// Connections and QuotaBPS are as of now, in the current month only.
+	Connections int64  `json:"connections,omitempty"`
+	QuotaBPS    uint64 `json:"quota_bps,omitempty"`
+}
+
+// handler serves GET /admin/usage?month=YYYY-MM, the current month by
+// default.
+func (l *usageLedger) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		current := now.UTC().Format("2006-01")
+		month := r.URL.Query().Get("month")
+		if month == "" {
+			month = current
+		}
+		if _, err := time.Parse("2006-01", month); err != nil {
+			http.Error(w, "month must be YYYY-MM", http.StatusBadRequest)
+			return
+		}
+		l.mu.Lock()
+		m, err := l.load(month)
+		var pending map[string]usageTotals
+		if err == nil && month == current {
+			pending = l.pending(now, false)
+		}
+		l.mu.Unlock()
+		if err != nil {
+			slog.Error("usage: read month", "month", month, "err", err)
+			http.Error(w, "usage unavailable", http.StatusInternalServerError)
+			return
+		}
+		for name, d := range pending {
+			t := m.Tenants[name]
+			if t == nil {
+				t = &usageTotals{}
+				m.Tenants[name] = t
+			}
+			t.add(d)
+		}
+		rep := usageReport{Month: month, UpdatedMS: m.UpdatedMS, Rows: []usageRow{}}
+		for name, t := range m.Tenants {
+			row := usageRow{Tenant: name, usageTotals: *t}
+			if month == current {
+				if u := l.h.acct.lookup(name); u != nil {
+					row.Connections, row.QuotaBPS = u.conns.Load(), u.quota
+				}
+			}
+			rep.Rows = append(rep.Rows, row)
+		}
+		sort.Slice(rep.Rows, func(i, j int) bool { return rep.Rows[i].Tenant < rep.Rows[j].Tenant })
+		writeJSON(w, http.StatusOK, rep)
+	}
+}
+
+// withAPIUsage counts API calls against the tenant they name, for tenants
+// the server already knows, so a made-up tenant cannot grow the ledger;
+// other calls count against the default tenant.
+func withAPIUsage(a *accounting, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := r.URL.Path; strings.HasPrefix(p, "/api/") || strings.HasPrefix(p, "/admin/") || p == "/poll" || p == "/status" {
+			u := a.lookup(tenantFromRequest(r))
+			if u == nil {
+				u = a.usage(defaultTenant)
+			}
+			u.apiCalls.Add(1)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,380 @@
+package hub
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"pulse/ws"
+)
+
+// Webhooks post lifecycle and threshold events as JSON to URLs outside the
+// server, so other systems can react without polling /status:
+//
+//	client.connected     a client connected; clients is the count after
+//	client.disconnected  a client left, with its cause
+//	clients.above        the client count reached a PULSE_WEBHOOK_CLIENTS
+//	                     threshold
+//	clients.below        and fell back under 90% of it
+//	tempo.changed        a channel's period changed, once a ramp arrives
+//	alert.firing         an alert rule held for PULSE_ALERT_FOR_MS, e.g.
+//	alert.resolved       jitter, the drift from the schedule (see alerts.go)
+//	disconnect_storm     a disconnect storm ended (see storm.go)
+//	feature.incompatible a feature toggle would break clients
+//
+// Each URL has a queue and a goroutine of its own that posts the events in
+// order, retrying a failed post (no answer, 5xx or 429) with backoff from
+// a second, doubled to at most webhookMaxBackoff; an event still failing
+// after PULSE_WEBHOOK_RETRIES retries is dropped, as are events that find
+// the queue full, so a URL that is down never holds up the server. A retry
+// has the same X-Pulse-Delivery ID, for receivers to see it twice. With
+// PULSE_WEBHOOK_SECRET each post is signed as admin requests are (see
+// signing.go): X-Pulse-Signature is the hex HMAC-SHA256 of
+//
+//	timestamp "\n" body
+//
+// under the secret, with the timestamp in X-Pulse-Timestamp.
+const (
+	webhookQueue      = 256
+	webhookTimeout    = 5 * time.Second
+	webhookMinBackoff = time.Second
+	webhookMaxBackoff = time.Minute
+
+	webhookEventHeader    = "X-Pulse-Event"
+	webhookDeliveryHeader = "X-Pulse-Delivery"
+
+	// webhookClientsHysteresis is how far under a threshold the client
+	// count must fall before clients.below, so a count hovering around it
+	// does not post every connection.
+	webhookClientsHysteresis = 0.9
+)
+
+// alertEvents are what PULSE_ALERT_WEBHOOK receives.
+var alertEvents = []string{"alert.firing", "alert.resolved", "disconnect_storm", "feature.incompatible"}
+
+// webhooks posts events to every URL subscribed to them. A nil webhooks
+// posts nothing.
+type webhooks struct {
+	targets []*webhookTarget
+	client  *http.Client
+	secret  []byte
+	retries int
+
+	// thresholds are the client counts that post clients.above and
+	// clients.below, ascending; above marks those the count is over.
+	mu         sync.Mutex
+	thresholds []int
+	above      []bool
+}
+
+// webhookTarget is a URL and the events it receives, all if events is
+// empty; a name ending in * subscribes to every event it prefixes.
+type webhookTarget struct {
+	url string
+	// index and host name the URL in logs and metrics, where its path or
+	// query, which may hold a secret, would give it away.
+	index  int
+	host   string
+	events []string
+	queue  chan webhookDelivery
+
+	sent, failed, dropped atomic.Uint64
+}
+
+type webhookDelivery struct {
+	id, event string
+	body      []byte
+}
+
+// webhooksFromEnv reads PULSE_WEBHOOKS, comma-separated URLs each
+// optionally followed by ;events=NAME+NAME…, and PULSE_ALERT_WEBHOOK, which
+// receives the alert events. It returns nil when neither is set.
+func webhooksFromEnv() (*webhooks, error) {
+	w := &webhooks{
+		client:  &http.Client{Timeout: webhookTimeout},
+		secret:  []byte(os.Getenv("PULSE_WEBHOOK_SECRET")),
+		retries: envInt("PULSE_WEBHOOK_RETRIES", 5),
+	}
+	for _, entry := range ws.SplitHeaderList(os.Getenv("PULSE_WEBHOOKS")) {
+		t, err := parseWebhookTarget(entry)
+		if err != nil {
+			return nil, err
+		}
+		w.targets = append(w.targets, t)
+	}
+	if raw := strings.TrimSpace(os.Getenv("PULSE_ALERT_WEBHOOK")); raw != "" {
+		t, err := parseWebhookTarget(raw)
+		if err != nil {
+			return nil, fmt.Errorf("PULSE_ALERT_WEBHOOK: %w", err)
+		}
+		t.events = alertEvents
+		w.targets = append(w.targets, t)
+	}
+	var err error
+	if w.thresholds, err = parseThresholds(os.Getenv("PULSE_WEBHOOK_CLIENTS")); err != nil {
+		return nil, fmt.Errorf("PULSE_WEBHOOK_CLIENTS: %w", err)
+	}
+	w.above = make([]bool, len(w.thresholds))
+	if len(w.targets) == 0 {
+		return nil, nil
+	}
+	for i, t := range w.targets {
+		t.index = i
+		t.queue = make(chan webhookDelivery, webhookQueue)
+		go w.deliver(t)
+	}
+	return w, nil
+}
+
+// parseWebhookTarget parses a PULSE_WEBHOOKS entry.
+func parseWebhookTarget(entry string) (*webhookTarget, error) {
+	raw, params, _ := strings.Cut(entry, ";")
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		// Not quoting the URL, which may hold a secret.
+		return nil, errors.New("invalid webhook, want an http:// or https:// URL")
+	}
+	t := &webhookTarget{url: u.String(), host: u.Host}
+	for _, param := range strings.Split(params, ";") {
+		if param = strings.TrimSpace(param); param == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(param, "=")
+		if strings.TrimSpace(key) != "events" {
+			return nil, fmt.Errorf("webhook on %s: unknown parameter %q, want events", u.Host, key)
+		}
+		for _, name := range strings.Split(value, "+") {
+			if name = strings.TrimSpace(name); name == "" {
+				return nil, fmt.Errorf("webhook on %s: empty event name", u.Host)
+			}
+			t.events = append(t.events, name)
+		}
+	}
+	return t, nil
+}
+
+// parseThresholds parses comma-separated client counts.
+func parseThresholds(raw string) ([]int, error) {
+	var out []int
+	for _, entry := range ws.SplitHeaderList(raw) {
+		n, err := strconv.Atoi(strings.TrimSpace(entry))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid threshold %q, want a client count", entry)
+		}
+		out = append(out, n)
+	}
+	slices.Sort(out)
+	return slices.Compact(out), nil
+}
+
+// wants reports whether t receives event.
+func (t *webhookTarget) wants(event string) bool {
+	if len(t.events) == 0 {
+		return true
+	}
+	for _, name := range t.events {
+		if prefix, ok := strings.CutSuffix(name, "*"); ok && strings.HasPrefix(event, prefix) || name == event {
+			return true
+		}
+	}
+	return false
+}
+
+// send queues v, the JSON of event, for every URL that wants it.
+func (w *webhooks) send(event string, v any) {
+	if w == nil {
+		return
+	}
+	var body []byte
+	var id string
+	for _, t := range w.targets {
+		if !t.wants(event) {
+			continue
+		}
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(v); err != nil {
+				slog.Error("webhook: encode", "event", event, "err", err)
+				return
+			}
+			var b [8]byte
+			_, _ = rand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+		}
+		select {
+		case t.queue <- webhookDelivery{id: id, event: event, body: body}:
+		default:
+			t.dropped.Add(1)
+		}
+	}
+}
+
+// deliver posts t's events in order, for good.
+func (w *webhooks) deliver(t *webhookTarget) {
+	for d := range t.queue {
+		backoff := webhookMinBackoff
+		for attempt := 0; ; attempt++ {
+			retry, err := w.post(t.url, d)
+			if err == nil {
+				t.sent.Add(1)
+				break
+			}
+			if !retry || attempt >= w.retries {
+				t.failed.Add(1)
+				slog.Warn("webhook: giving up", "webhook", t.index, "host", t.host, "event", d.event, "delivery", d.id, "attempts", attempt+1, "err", err)
+				break
+			}
+			time.Sleep(backoff)
+			backoff = min(2*backoff, webhookMaxBackoff)
+		}
+	}
+}
+
+// post makes one attempt at delivering d to target, reporting whether a
+// failure is worth retrying.
+func (w *webhooks) post(target string, d webhookDelivery) (retry bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(d.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, d.event)
+	req.Header.Set(webhookDeliveryHeader, d.id)
+	if len(w.secret) > 0 {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write([]byte(ts + "\n"))
+		mac.Write(d.body)
+		req.Header.Set(signatureTimeHeader, ts)
+		req.Header.Set(signatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := w.client.Do(req)
+	if ue, ok := err.(*url.Error); ok {
+		// Without the URL, which may hold a secret.
+		return true, ue.Err
+	} else if err != nil {
+		return true, err
+	}
+	_ = resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("%s", resp.Status)
+	}
+	return false, fmt.Errorf("%s", resp.Status)
+}
+
+// clientEvent is client.connected and client.disconnected.
+type clientEvent struct {
+	Event   string    `json:"event"`
+	At      time.Time `json:"at"`
+	ID      string    `json:"request_id"`
+	Remote  string    `json:"remote"`
+	Channel string    `json:"channel"`
+	Tenant  string    `json:"tenant"`
+	Subject string    `json:"subject,omitempty"`
+	Cause   string    `json:"cause,omitempty"`
+	Clients int       `json:"clients"`
+}
+
+// clientsEvent is clients.above and clients.below.
+type clientsEvent struct {
+	Event     string    `json:"event"`
+	At        time.Time `json:"at"`
+	Threshold int       `json:"threshold"`
+	Clients   int       `json:"clients"`
+}
+
+// tempoEvent is tempo.changed.
+type tempoEvent struct {
+	Event    string    `json:"event"`
+	At       time.Time `json:"at"`
+	Channel  string    `json:"channel"`
+	Seq      uint64    `json:"seq"`
+	PeriodMS float64   `json:"period_ms"`
+	BPM      float64   `json:"bpm,omitempty"`
+}
+
+// connection posts that c connected or left, leaving n clients, and any
+// threshold n crossed.
+func (w *webhooks) connection(c *Conn, connected bool, n int) {
+	if w == nil {
+		return
+	}
+	ev := clientEvent{Event: "client.connected", At: time.Now(), ID: c.id, Remote: c.remote, Channel: c.Channel(), Tenant: c.tenant, Subject: c.subject, Clients: n}
+	if !connected {
+		ev.Event, ev.Cause = "client.disconnected", c.disconnectCause()
+	}
+	w.send(ev.Event, ev)
+
+	w.mu.Lock()
+	var crossed []clientsEvent
+	for i, t := range w.thresholds {
+		switch {
+		case !w.above[i] && n >= t:
+			w.above[i] = true
+			crossed = append(crossed, clientsEvent{Event: "clients.above", At: ev.At, Threshold: t, Clients: n})
+		case w.above[i] && float64(n) < webhookClientsHysteresis*float64(t):
+			w.above[i] = false
+			crossed = append(crossed, clientsEvent{Event: "clients.below", At: ev.At, Threshold: t, Clients: n})
+		}
+	}
+	w.mu.Unlock()
+	for _, ev := range crossed {
+		slog.Info("webhook: client threshold crossed", "event", ev.Event, "threshold", ev.Threshold, "clients", ev.Clients)
+		w.send(ev.Event, ev)
+	}
+}
+
+// pulse posts tempo.changed for a pulse with a new period, though not
+// for each step of a ramp.
+func (w *webhooks) pulse(h *Hub, msg PulseMessage) {
+	if w == nil || !msg.PeriodChanged || msg.RampPulses > 0 {
+		return
+	}
+	ev := tempoEvent{Event: "tempo.changed", At: time.Now(), Channel: msg.Channel, Seq: msg.Seq, PeriodMS: float64(msg.PeriodMS)}
+	if msg.PeriodUS != 0 {
+		ev.PeriodMS = float64(msg.PeriodUS) / 1000
+	}
+	if ch := h.channel(msg.Channel); ch != nil && ch.tempo != nil && ev.PeriodMS > 0 {
+		ev.BPM = math.Round(60000/ev.PeriodMS*1000) / 1000
+	}
+	w.send(ev.Event, ev)
+}
+
+// write appends the webhook metrics to b.
+func (w *webhooks) write(b *strings.Builder) {
+	if w == nil {
+		return
+	}
+	b.WriteString("# HELP pulse_webhook_events_total Webhook events by webhook (its place in PULSE_WEBHOOKS, PULSE_ALERT_WEBHOOK last) and outcome: sent, failed after the retries, or dropped with the queue full.\n")
+	b.WriteString("# TYPE pulse_webhook_events_total counter\n")
+	for _, t := range w.targets {
+		for _, r := range []struct {
+			result string
+			n      *atomic.Uint64
+		}{{"sent", &t.sent}, {"failed", &t.failed}, {"dropped", &t.dropped}} {
+			fmt.Fprintf(b, "pulse_webhook_events_total{webhook=\"%d\",host=%q,result=%q} %d\n", t.index, t.host, r.result, r.n.Load())
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Backfill limits: how many windows one request may span and how many
+// history records are scanned for it.
+const (
+	maxBackfillWindows = 10000
+	maxBackfillPulses  = 1000000
+)
+
+// windowMessage announces a sampling window: sensors sample from
+// window_start_ms up to (not including) window_end_ms, and upstream
+// aggregation joins their readings by window_id. Windows are aligned to the
+// Unix epoch, so ids are stable across restarts and every node agrees on
+// them without coordination.
+type windowMessage struct {
+	Type          string `json:"type"`
+	WindowID      int64  `json:"window_id"`
+	WindowStartMS int64  `json:"window_start_ms"`
+	WindowEndMS   int64  `json:"window_end_ms"`
+}
+
+// windowAt returns the window of the given length containing t.
+func windowAt(t time.Time, length time.Duration) windowMessage {
+	ms := length.Milliseconds()
+	id := t.UnixMilli() / ms
+	return windowMessage{
+		Type:          "window",
+		WindowID:      id,
+		WindowStartMS: id * ms,
+		WindowEndMS:   (id + 1) * ms,
+	}
+}
+
+// runWindows broadcasts a window message at the start of every window.
+func (h *Hub) runWindows(length time.Duration) {
+	for {
+		next := time.UnixMilli(windowAt(h.clock.Now(), length).WindowEndMS)
+		time.Sleep(next.Sub(h.clock.Now()))
+		h.Broadcast(windowAt(next, length))
+	}
+}
+
+// backfillWindow is one window as reconstructed for a client that slept
+// through it. Pulses is how many pulses went out during the window, with
+// the seq range they covered; 0 means the server emitted none (it was down
+// or the records were archived).
+type backfillWindow struct {
+	WindowID      int64   `json:"window_id"`
+	WindowStartMS int64   `json:"window_start_ms"`
+	WindowEndMS   int64   `json:"window_end_ms"`
+	Pulses        int     `json:"pulses"`
+	FirstSeq      *uint64 `json:"first_seq,omitempty"`
+	LastSeq       *uint64 `json:"last_seq,omitempty"`
+}
+
+type windowsResponse struct {
+	WindowMS int64 `json:"window_ms"`
+	// History reports whether pulse history is recorded; without it the
+	// seq ranges cannot be reconstructed and pulses is always 0.
+	History bool             `json:"history"`
+	Windows []backfillWindow `json:"windows"`
+}
+
+// windowsHandler serves GET /api/windows?from=<ms>&to=<ms>: the windows
+// between from and to (default now) with the pulses that fell into each,
+// read back from the history stream.
+func (h *Hub) windowsHandler(store Store, history bool) http.HandlerFunc {
+	length := h.window
+	return func(w http.ResponseWriter, r *http.Request) {
+		if length <= 0 {
+			http.Error(w, "sampling windows are off (PULSE_WINDOW_MS)", http.StatusNotFound)
+			return
+		}
+		from, to, err := parseWindowRange(r, length, h.clock.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		resp := windowsResponse{WindowMS: length.Milliseconds(), History: history}
+		for t := from; t.Before(to); t = t.Add(length) {
+			win := windowAt(t, length)
+			resp.Windows = append(resp.Windows, backfillWindow{
+				WindowID:      win.WindowID,
+				WindowStartMS: win.WindowStartMS,
+				WindowEndMS:   win.WindowEndMS,
+			})
+		}
+		if history && len(resp.Windows) > 0 {
+			if err := fillWindowSeqs(store, resp.Windows); err != nil {
+				slog.Error("windows: read history", "err", err)
+				http.Error(w, "history unavailable", http.StatusInternalServerError)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// parseWindowRange reads from and to, aligns from down to its window start
+// and bounds the span.
+func parseWindowRange(r *http.Request, length time.Duration, now time.Time) (from, to time.Time, err error) {
+	q := r.URL.Query()
+	fromMS, err := strconv.ParseInt(q.Get("from"), 10, 64)
+	if err != nil {
+		return from, to, fmt.Errorf("from must be Unix milliseconds")
+	}
+	to = now
+	if s := q.Get("to"); s != "" {
+		toMS, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return from, to, fmt.Errorf("to must be Unix milliseconds")
+		}
+		to = time.UnixMilli(toMS)
+	}
+	from = time.UnixMilli(windowAt(time.UnixMilli(fromMS), length).WindowStartMS)
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("from must be before to")
+	}
+	if to.Sub(from) > maxBackfillWindows*length {
+		return from, to, fmt.Errorf("range spans more than %d windows", maxBackfillWindows)
+	}
+	return from, to, nil
+}
+
+// fillWindowSeqs counts the history records falling into each of wins,
+// which are consecutive and in order.
+func fillWindowSeqs(store Store, wins []backfillWindow) error {
+	recs, err := store.Tail(streamHistory, maxBackfillPulses)
+	if err != nil {
+		return err
+	}
+	first, last := wins[0].WindowStartMS, wins[len(wins)-1].WindowEndMS
+	length := wins[0].WindowEndMS - wins[0].WindowStartMS
+	for _, rec := range recs {
+		var h historyRecord
+		if json.Unmarshal(rec, &h) != nil || h.AtMS < first || h.AtMS >= last {
+			continue
+		}
+		win := &wins[(h.AtMS-first)/length]
+		seq := h.Seq
+		if win.Pulses == 0 || seq < *win.FirstSeq {
+			win.FirstSeq = &seq
+		}
+		if win.Pulses == 0 || seq > *win.LastSeq {
+			win.LastSeq = &seq
+		}
+		win.Pulses++
+	}
+	return nil
+}
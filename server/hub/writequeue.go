@@ -0,0 +1,288 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"pulse/ws"
+)
+
+// Every connection in the hub has a bounded write queue drained by its own
+// writer goroutine, so a slow client backs up its own queue instead of
+// stalling the fan-out to everyone after it. Before the hub starts the
+// writer (see Hub.add), writes are synchronous; that is how the greeting
+// goes out.
+//
+// Frames go out in order, except that messages of a high-priority type
+// (transport and redirect unless PULSE_HIGH_PRIORITY or Hub.Prioritize say
+// otherwise) jump ahead of queued pulses, so a stop is never stuck behind
+// stale pulses, and a close frame discards the pulses still queued. A pulse
+// still queued a period after it was broadcast has expired and is dropped
+// rather than sent: a late pulse misleads a client's sync more than a
+// missing one.
+
+// Slow-consumer policies for a full write queue, set by PULSE_SLOW_CONSUMER.
+const (
+	// slowDropOldest makes room by dropping the oldest queued pulse: a
+	// client that cannot keep up skips pulses but stays connected.
+	slowDropOldest = "drop_oldest"
+	// slowEvict disconnects the client.
+	slowEvict = "evict"
+)
+
+const defaultWriteQueue = 64
+
+// defaultHighPriority are the message types that jump ahead of queued
+// pulses unless configured otherwise.
+var defaultHighPriority = []string{"transport", "redirect"}
+
+// errQueueFull is returned by writes to a client whose queue is full and
+// holds nothing the policy may drop.
+var errQueueFull = errors.New("write queue full")
+
+// queuePolicy sizes write queues, says what happens when one overflows and
+// which message types jump ahead of pulses.
+type queuePolicy struct {
+	size  int
+	evict bool
+	high  map[string]bool
+}
+
+func priorityTypes(types []string) map[string]bool {
+	high := make(map[string]bool, len(types))
+	for _, t := range types {
+		high[t] = true
+	}
+	return high
+}
+
+// parseHighPriority parses PULSE_HIGH_PRIORITY: comma-separated message
+// types, or none.
+func parseHighPriority(s string) ([]string, error) {
+	if s == "" {
+		return defaultHighPriority, nil
+	}
+	if s == "none" {
+		return nil, nil
+	}
+	var types []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t == "" || t == "pulse" {
+			return nil, fmt.Errorf("invalid message type %q", t)
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// messageType returns the type of a JSON message.
+func messageType(payload []byte) string {
+	var head struct {
+		Type string `json:"type"`
+	}
+	_ = json.Unmarshal(payload, &head)
+	return head.Type
+}
+
+func parseSlowConsumer(s string) (evict bool, err error) {
+	switch s {
+	case "", slowDropOldest:
+		return false, nil
+	case slowEvict:
+		return true, nil
+	}
+	return false, fmt.Errorf("want %s or %s", slowDropOldest, slowEvict)
+}
+
+// outFrame is a frame waiting in a write queue.
+type outFrame struct {
+	opcode  byte
+	payload []byte
+	// frame, if set, is the frame already encoded for the connection;
+	// broadcasts share one buffer between all connections.
+	frame  []byte
+	queued time.Time
+	// channel is set for pulses, which the drop policy may discard.
+	channel string
+	// expires, if set, is when a pulse becomes too stale to send.
+	expires time.Time
+	// priority frames are queued ahead of pulses.
+	priority bool
+	// done, if set, is sent the outcome of the write.
+	done chan error
+}
+
+// writeQueue holds a connection's frames until its writer sends them.
+type writeQueue struct {
+	policy queuePolicy
+	// onDrop is told the channel of every pulse dropped to make room, and
+	// onExpire of every pulse that expired in the queue.
+	onDrop, onExpire func(channel string)
+
+	mu     sync.Mutex
+	frames []outFrame
+	wake   chan struct{}
+	// closing is set once a close frame is queued; nothing may follow it,
+	// so later frames are discarded. closed stops the writer.
+	closing, closed bool
+
+	dropped, expired atomic.Uint64
+}
+
+func newWriteQueue(p queuePolicy, onDrop, onExpire func(string)) *writeQueue {
+	return &writeQueue{policy: p, onDrop: onDrop, onExpire: onExpire, wake: make(chan struct{}, 1)}
+}
+
+// push queues f. A full queue drops its oldest pulse for it, unless the
+// policy evicts or there is no pulse to drop; then push fails with
+// errQueueFull. A priority frame goes before the first queued pulse; a
+// close frame removes the queued pulses and goes last.
+func (q *writeQueue) push(f outFrame) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || (q.closing && f.done != nil) {
+		return net.ErrClosed
+	}
+	if q.closing {
+		return nil
+	}
+	isPulse := func(o outFrame) bool { return o.channel != "" }
+	if f.opcode == ws.OpClose {
+		q.frames = slices.DeleteFunc(q.frames, isPulse)
+	}
+	if len(q.frames) >= q.policy.size {
+		i := -1
+		if !q.policy.evict {
+			i = slices.IndexFunc(q.frames, isPulse)
+		}
+		if i < 0 {
+			return errQueueFull
+		}
+		if q.onDrop != nil {
+			q.onDrop(q.frames[i].channel)
+		}
+		q.frames = slices.Delete(q.frames, i, i+1)
+		q.dropped.Add(1)
+	}
+	if i := slices.IndexFunc(q.frames, isPulse); f.priority && i >= 0 {
+		q.frames = slices.Insert(q.frames, i, f)
+	} else {
+		q.frames = append(q.frames, f)
+	}
+	q.closing = f.opcode == ws.OpClose
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// pop waits for the next frame, dropping expired pulses on the way; it
+// returns false once the queue is closed.
+func (q *writeQueue) pop() (outFrame, bool) {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return outFrame{}, false
+		}
+		for len(q.frames) > 0 {
+			f := q.frames[0]
+			q.frames[0] = outFrame{}
+			q.frames = q.frames[1:]
+			if !f.expires.IsZero() && time.Now().After(f.expires) {
+				q.expired.Add(1)
+				if q.onExpire != nil {
+					q.onExpire(f.channel)
+				}
+				continue
+			}
+			q.mu.Unlock()
+			return f, true
+		}
+		q.mu.Unlock()
+		<-q.wake
+	}
+}
+
+// close stops the writer and fails the frames still waiting.
+func (q *writeQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	for _, f := range q.frames {
+		if f.done != nil {
+			f.done <- net.ErrClosed
+		}
+	}
+	q.frames = nil
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *writeQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.frames)
+}
+
+// Prioritize sets the message types that jump ahead of pulses waiting in a
+// client's write queue, replacing the default transport and redirect; no
+// types keeps every frame in order. Call it before Start.
+func (h *Hub) Prioritize(types ...string) {
+	h.queue.high = priorityTypes(types)
+}
+
+// writeLoop sends c's queued frames until the connection closes. A failed
+// write drops the client, as does the lag policy after a slow pulse.
+func (h *Hub) writeLoop(c *Conn, q *writeQueue) {
+	for {
+		f, ok := q.pop()
+		if !ok {
+			return
+		}
+		err := c.writeNow(f)
+		if f.done != nil {
+			f.done <- err
+		}
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return // closed under us; whoever did it removed c
+			}
+			if f.channel != "" {
+				h.pulseMetrics.writeFailed(f.channel)
+			}
+			h.writeFailed(c, err)
+			return
+		}
+		if f.channel != "" && !h.checkLag(c, time.Now()) {
+			h.remove(c)
+			return
+		}
+	}
+}
+
+// writeFailed drops c after a write to it failed or its queue overflowed.
+func (h *Hub) writeFailed(c *Conn, err error) {
+	if errors.Is(err, errQueueFull) {
+		connLog.log(slog.LevelWarn, "dropping slow client", "request_id", c.id, "remote", c.remote, "queue", h.queue.size)
+		c.setCause(causeSlow)
+	} else {
+		connLog.log(slog.LevelWarn, "write failed", "request_id", c.id, "remote", c.remote, "err", err)
+		c.setCause(netCause(err))
+	}
+	h.remove(c)
+}
@@ -0,0 +1,148 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+	"unicode/utf8"
+
+	"pulse/ws"
+)
+
+// defaultMaxMessage bounds reassembled client messages unless
+// PULSE_MAX_MESSAGE_BYTES says otherwise; clients only ever send small
+// control and input messages.
+const defaultMaxMessage = 64 << 10
+
+// minMaxMessage is the least PULSE_MAX_MESSAGE_BYTES may be: a control
+// frame's payload, and the messages clients send, fit.
+const minMaxMessage = 1 << 10
+
+// messageHandler receives a complete client message; opcode is opText or
+// opBinary. Text payloads are valid UTF-8.
+type messageHandler func(c *Conn, opcode byte, payload []byte)
+
+// readLoop consumes client frames until the connection fails or the client
+// closes it. Fragmented messages are reassembled, up to maxMessage bytes,
+// and passed to onMessage; control frames may come between the fragments.
+// Pings are answered with pongs and a close frame is echoed before
+// returning. Protocol violations are answered with a close frame carrying
+// the matching code: 1002 for a malformed frame or a continuation out of
+// place, 1009 for a frame or message over maxMessage, 1007 for text that
+// is not UTF-8, which in strict mode is noticed in the fragment it is in
+// and otherwise once the message is complete.
+func (c *Conn) readLoop(strict bool, maxMessage int, onMessage messageHandler) {
+	claimed := ws.ClaimedRSV(c.exts)
+	var (
+		msgOp byte // opcode of the message being reassembled, 0 if none
+		msg   []byte
+		// valid is how much of a text message is known to be UTF-8.
+		valid int
+	)
+	fail := func(ce *ws.CloseError) {
+		c.setCause(causeProtocol)
+		connLog.log(slog.LevelWarn, "protocol error", "request_id", c.id, "remote", c.remote, "err", ce)
+		_ = c.writeClose(ce.Code, ce.Reason)
+	}
+	for {
+		f, err := ws.ReadFrameLimit(c.br, strict, claimed, uint64(maxMessage))
+		if err == nil {
+			err = ws.ApplyExtensions(c.exts, &f)
+		}
+		if err != nil {
+			var ce *ws.CloseError
+			if errors.As(err, &ce) {
+				fail(ce)
+			}
+			c.setCause(netCause(err))
+			return
+		}
+		c.lastRead.Store(time.Now().UnixNano())
+		if c.trace.Load() {
+			slog.Info("trace", "request_id", c.id, "dir", "in", "opcode", f.Opcode, "fin", f.Fin, "bytes", len(f.Payload))
+		}
+
+		switch f.Opcode {
+		case ws.OpPing:
+			if err := c.writeFrame(ws.OpPong, f.Payload); err != nil {
+				return
+			}
+			continue
+		case ws.OpPong:
+			c.rtt.observePong(f.Payload, time.Now())
+			continue
+		case ws.OpClose:
+			code, reason, ce := ws.ParseClose(f.Payload)
+			if ce != nil {
+				fail(ce)
+				return
+			}
+			c.setCause(causeClientClose)
+			connLog.log(churnLevel(), "client sent close", "request_id", c.id, "remote", c.remote, "code", code, "reason", reason)
+			if code == ws.CloseNoStatus {
+				_ = c.writeFrame(ws.OpClose, nil)
+			} else {
+				_ = c.writeClose(code, "")
+			}
+			return
+		case ws.OpContinuation:
+			if msgOp == 0 {
+				fail(&ws.CloseError{Code: ws.CloseProtocolError, Reason: "continuation frame without a message to continue"})
+				return
+			}
+		default: // opText, opBinary
+			if msgOp != 0 {
+				fail(&ws.CloseError{Code: ws.CloseProtocolError, Reason: "new message before the previous one was finished"})
+				return
+			}
+			msgOp = f.Opcode
+		}
+
+		if len(msg)+len(f.Payload) > maxMessage {
+			fail(&ws.CloseError{Code: ws.CloseTooBig, Reason: fmt.Sprintf("message exceeds %d bytes", maxMessage)})
+			return
+		}
+		msg = append(msg, f.Payload...)
+		// Strict mode checks text fragment by fragment; lenient mode
+		// only checks the whole message, once it is complete.
+		if msgOp == ws.OpText && (strict || f.Fin) {
+			var ok bool
+			if valid, ok = validUTF8(msg, valid, f.Fin); !ok {
+				fail(&ws.CloseError{Code: ws.CloseInvalidPayload, Reason: "text message is not valid UTF-8"})
+				return
+			}
+		}
+		if !f.Fin {
+			continue
+		}
+		if onMessage != nil {
+			onMessage(c, msgOp, msg)
+		}
+		msgOp, msg, valid = 0, nil, 0
+	}
+}
+
+// validUTF8 checks msg from from on, which is as far as it was checked
+// before, and returns how far it is now known to be valid. Unless msg is
+// complete, a rune cut off at its end may be finished by the next fragment.
+func validUTF8(msg []byte, from int, complete bool) (int, bool) {
+	end := len(msg)
+	if !complete {
+		// Back up to the start of the last rune, if it is unfinished.
+		for i := end - 1; i >= from && i >= end-utf8.UTFMax+1; i-- {
+			if utf8.RuneStart(msg[i]) {
+				if !utf8.FullRune(msg[i:]) {
+					end = i
+				}
+				break
+			}
+		}
+	}
+	return end, utf8.Valid(msg[from:end])
+}
+
+// writeClose sends a close frame; the caller closes the connection.
+func (c *Conn) writeClose(code uint16, reason string) error {
+	return c.writeFrame(ws.OpClose, ws.ClosePayload(code, reason))
+}
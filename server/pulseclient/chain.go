@@ -0,0 +1,70 @@
+package pulseclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// ErrNoHash is returned by ChainVerifier.Check for pulses without a hash,
+// e.g. from a channel without the server's hash_chain feature.
+var ErrNoHash = errors.New("pulse has no hash; is hash_chain on for the channel?")
+
+// ChainVerifier checks that pulses from a channel with the hash_chain
+// feature form an unbroken chain: every pulse's hash matches its fields
+// and its prev_hash is the previous pulse's hash. Feed it the pulses of a
+// recording, or Pulse.Raw as they arrive, in order.
+type ChainVerifier struct {
+	last    string
+	lastSeq uint64
+	// Checked counts the pulses that passed.
+	Checked int
+}
+
+// Check verifies one pulse message, given as its JSON.
+func (v *ChainVerifier) Check(raw []byte) error {
+	var m struct {
+		Type     string `json:"type"`
+		Seq      uint64 `json:"seq"`
+		PeriodMS int64  `json:"period_ms"`
+		NowMS    int64  `json:"now_ms"`
+		MonoMS   int64  `json:"mono_ms"`
+		Hash     string `json:"hash"`
+		PrevHash string `json:"prev_hash"`
+	}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return err
+	}
+	if m.Type != "pulse" {
+		return fmt.Errorf("not a pulse: type %q", m.Type)
+	}
+	if m.Hash == "" {
+		return ErrNoHash
+	}
+	if want := chainHash(m.PrevHash, m.Seq, m.PeriodMS, m.NowMS, m.MonoMS); m.Hash != want {
+		return fmt.Errorf("seq %d: hash does not match the pulse's fields", m.Seq)
+	}
+	if v.last != "" && m.PrevHash != v.last {
+		return fmt.Errorf("seq %d: prev_hash does not follow seq %d; pulses are missing or out of order", m.Seq, v.lastSeq)
+	}
+	v.last, v.lastSeq = m.Hash, m.Seq
+	v.Checked++
+	return nil
+}
+
+// chainHash matches the server's: hex SHA-256 of prev, period_ms, now_ms,
+// mono_ms and seq, separated by newlines.
+func chainHash(prev string, seq uint64, periodMS, nowMS, monoMS int64) string {
+	b := []byte(prev)
+	for _, n := range []int64{periodMS, nowMS, monoMS} {
+		b = append(b, '\n')
+		b = strconv.AppendInt(b, n, 10)
+	}
+	b = append(b, '\n')
+	b = strconv.AppendUint(b, seq, 10)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
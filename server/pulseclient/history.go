@@ -0,0 +1,79 @@
+package pulseclient
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// HistoryRecord is one pulse of the server's history, as GET /api/history
+// exports it.
+type HistoryRecord struct {
+	Seq         uint64  `json:"seq"`
+	AtMS        int64   `json:"at_ms"`
+	JitterMS    float64 `json:"jitter_ms"`
+	BroadcastMS float64 `json:"broadcast_ms"`
+	Subscribers int     `json:"subscribers"`
+}
+
+// HistoryDecoder reads history in the server's delta format
+// (GET /api/history?format=delta; see the server's history.go). Jitter and
+// broadcast times come back in whole microseconds.
+type HistoryDecoder struct {
+	r    *bufio.Reader
+	prev HistoryRecord
+	read bool
+}
+
+// NewHistoryDecoder reads delta-encoded history from r.
+func NewHistoryDecoder(r io.Reader) *HistoryDecoder {
+	return &HistoryDecoder{r: bufio.NewReader(r)}
+}
+
+// Next returns the next record, or io.EOF after the last.
+func (d *HistoryDecoder) Next() (HistoryRecord, error) {
+	if !d.read {
+		d.read = true
+		magic := make([]byte, 4)
+		if _, err := io.ReadFull(d.r, magic); err != nil || string(magic) != "PHD1" {
+			return HistoryRecord{}, errors.New("not delta-encoded history")
+		}
+		base, err := binary.ReadUvarint(d.r)
+		if err != nil {
+			return HistoryRecord{}, fmt.Errorf("history header: %w", err)
+		}
+		d.prev = HistoryRecord{AtMS: int64(base)}
+	}
+	seq, err := binary.ReadVarint(d.r)
+	if err == io.EOF {
+		return HistoryRecord{}, io.EOF
+	}
+	var at, jitter, subs int64
+	var broadcast uint64
+	if err == nil {
+		at, err = binary.ReadVarint(d.r)
+	}
+	if err == nil {
+		jitter, err = binary.ReadVarint(d.r)
+	}
+	if err == nil {
+		broadcast, err = binary.ReadUvarint(d.r)
+	}
+	if err == nil {
+		subs, err = binary.ReadVarint(d.r)
+	}
+	if err != nil {
+		return HistoryRecord{}, fmt.Errorf("truncated history record: %w", err)
+	}
+	rec := HistoryRecord{
+		Seq:         d.prev.Seq + uint64(seq),
+		AtMS:        d.prev.AtMS + at,
+		JitterMS:    float64(jitter) / 1000,
+		BroadcastMS: float64(broadcast) / 1000,
+		Subscribers: d.prev.Subscribers + int(subs),
+	}
+	d.prev = rec
+	return rec, nil
+}
@@ -0,0 +1,626 @@
+// Package pulseclient follows a pulse server from Go. A Client dials the
+// server, parses its pulses, keeps an estimate of the server's clock and
+// beat grid, and delivers a tick on every predicted beat, between pulses
+// and while it reconnects, so consumers run on the grid rather than on
+// message arrivals.
+//
+//	c := pulseclient.New(pulseclient.Options{URL: "ws://pulse.local:8080/ws"})
+//	go c.Run(ctx)
+//	for t := range c.Ticks() {
+//		flash(t.Seq)
+//	}
+package pulseclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"pulse/ws"
+)
+
+// Protocol is the subprotocol the client speaks.
+const Protocol = "pulse.v2+json"
+
+// Options configures a Client. Zero fields take the defaults given.
+type Options struct {
+	// URL is the server's WebSocket URL, e.g. ws://localhost:8080/ws.
+	URL string
+	// Header is sent with every upgrade request, e.g. an Authorization
+	// or X-Tenant header.
+	Header http.Header
+	// MinBackoff and MaxBackoff bound the wait between reconnects, which
+	// doubles (with jitter) after every failed attempt; 250ms and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// SyncInterval is how often the clock offset is re-measured with
+	// sync_req once the first burst settled it; 10s.
+	SyncInterval time.Duration
+}
+
+// Pulse is a pulse as the server sent it.
+type Pulse struct {
+	Seq    uint64
+	Period time.Duration
+	// Now and Next are now_ms and next_ms, in the server's clock.
+	Now, Next time.Time
+	// Received is when the pulse arrived, in the local clock.
+	Received time.Time
+	// Raw is the message, for fields added by enrichers or features.
+	Raw json.RawMessage
+}
+
+// Tick is a predicted beat.
+type Tick struct {
+	Seq    uint64
+	Period time.Duration
+	// At is when the beat falls, in the local clock.
+	At time.Time
+	// Connected is false for beats predicted while reconnecting.
+	Connected bool
+}
+
+// Announcement is a maintenance notice from the server's operators, to
+// be shown to users until Expires. A withdrawn announcement arrives again
+// with Withdrawn set and only ID filled in.
+type Announcement struct {
+	ID       string
+	Text     string
+	Severity string // info, warning or critical
+	// DowntimeStart and DowntimeEnd are the scheduled downtime, in the
+	// server's clock; zero when none was announced.
+	DowntimeStart, DowntimeEnd time.Time
+	Expires                    time.Time
+	Withdrawn                  bool
+}
+
+// EndedError is what Run returns when the server ended the stream: pulse
+// FinalSeq of Channel was the last, and no ticks come after it.
+type EndedError struct {
+	Channel  string
+	FinalSeq uint64
+	Reason   string
+}
+
+func (e *EndedError) Error() string {
+	return fmt.Sprintf("pulse stream %q ended after pulse %d: %s", e.Channel, e.FinalSeq, e.Reason)
+}
+
+// Client follows one server. Its methods are safe for concurrent use.
+type Client struct {
+	opts   Options
+	ticks  chan Tick
+	pulses chan Pulse
+	notes  chan Announcement
+	// base anchors local times sent as t1 and compared with server
+	// timestamps; it carries a monotonic reading, so stepping the local
+	// wall clock does not disturb the estimate.
+	base time.Time
+
+	mu        sync.Mutex
+	connected bool
+	// offset is server time minus local time (ms since base), from the
+	// sync sample with the smallest round trip; hasSync is false while it
+	// only comes from pulse arrivals.
+	offset  float64
+	hasSync bool
+	samples []syncSample
+	// gridSeq, gridMS and period describe the beat grid: beat gridSeq
+	// falls at gridMS in server time, and beats are period apart.
+	gridSeq uint64
+	gridMS  float64
+	period  time.Duration
+	hasGrid bool
+	// paused is set while the server has the channel paused, and floor
+	// is the seq the latest transport change named: pulses before it were
+	// queued before the change and no longer move the grid, and no tick
+	// comes before it, e.g. while a count-in runs.
+	paused bool
+	floor  uint64
+	// carryOn is set once a resync moved the grid within the stream
+	// ticked so far: seqs already ticked through the server's stall are
+	// not ticked again, however far behind the new grid starts.
+	carryOn bool
+	// channel is the channel followed and epochMS when its timeline began,
+	// for Stamp.
+	channel string
+	epochMS float64
+	// ended is set once the server has ended the stream.
+	ended   *EndedError
+	changed chan struct{}
+}
+
+type syncSample struct {
+	offset, rtt float64
+}
+
+// syncWindow is how many sync samples the offset is chosen from;
+// syncBurst of them are taken 100 ms apart after every connect.
+const (
+	syncWindow = 8
+	syncBurst  = 8
+)
+
+// tickGrace is how far in the past a beat may be and still be ticked: the
+// pulse for a beat arrives about when its tick is due, and must not move
+// the grid past it before the tick timer fires.
+const tickGrace = 10 * time.Millisecond
+
+// New returns a client for opts; call Run to connect.
+func New(opts Options) *Client {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 250 * time.Millisecond
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(30*time.Second, opts.MinBackoff)
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = 10 * time.Second
+	}
+	return &Client{
+		opts:    opts,
+		ticks:   make(chan Tick, 16),
+		pulses:  make(chan Pulse, 16),
+		notes:   make(chan Announcement, 16),
+		base:    time.Now(),
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// Ticks delivers a tick on every predicted beat. A tick the consumer is
+// not ready for is dropped rather than delivered late.
+func (c *Client) Ticks() <-chan Tick { return c.ticks }
+
+// Pulses delivers every pulse received, dropping those the consumer is not
+// ready for.
+func (c *Client) Pulses() <-chan Pulse { return c.pulses }
+
+// Announcements delivers maintenance announcements and their withdrawals.
+// The server repeats the current ones after every reconnect, so the same
+// ID may arrive more than once.
+func (c *Client) Announcements() <-chan Announcement { return c.notes }
+
+// Connected reports whether the client is connected right now.
+func (c *Client) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+// ServerNow estimates the server's clock right now; false before the first
+// pulse or sync response.
+func (c *Client) ServerNow() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.hasGrid && !c.hasSync {
+		return time.Time{}, false
+	}
+	return fromMS(c.localMS(time.Now()) + c.offset), true
+}
+
+// Run connects and follows the server until ctx is done, reconnecting with
+// backoff whenever the connection fails. The clock offset and beat grid
+// survive reconnects, so ticks keep coming meanwhile. It returns ctx's
+// error, or an *EndedError once the server has ended the stream.
+func (c *Client) Run(ctx context.Context) error {
+	go c.tick(ctx)
+	backoff := c.opts.MinBackoff
+	for {
+		greeted, _ := c.session(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := c.endedErr(); err != nil {
+			return err
+		}
+		if greeted {
+			backoff = c.opts.MinBackoff
+		}
+		wait := backoff/2 + rand.N(backoff/2+1)
+		backoff = min(backoff*2, c.opts.MaxBackoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// session runs one connection until it fails, reporting whether the
+// server greeted it.
+func (c *Client) session(ctx context.Context) (greeted bool, err error) {
+	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	conn, br, resp, err := ws.Dial(dialCtx, c.opts.URL, c.opts.Header, Protocol)
+	cancel()
+	if err != nil {
+		return false, err
+	}
+	if p := resp.Header.Get("Sec-WebSocket-Protocol"); p != Protocol {
+		_ = conn.Close()
+		return false, fmt.Errorf("server chose subprotocol %q", p)
+	}
+	s := &session{c: c, conn: conn}
+	stop := context.AfterFunc(ctx, func() {
+		_ = s.write(ws.OpClose, ws.ClosePayload(ws.CloseGoingAway, ""))
+		_ = conn.Close()
+	})
+	defer stop()
+	defer conn.Close()
+	c.setConnected(true)
+	defer c.setConnected(false)
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.sync(done)
+	return s.read(br)
+}
+
+type session struct {
+	c       *Client
+	conn    net.Conn
+	mu      sync.Mutex
+	greeted bool
+}
+
+func (s *session) write(opcode byte, payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	_, err := s.conn.Write(ws.AppendMaskedFrame(nil, opcode, payload))
+	return err
+}
+
+// sync measures the clock offset: a burst after connecting, then one
+// exchange every SyncInterval.
+func (s *session) sync(done <-chan struct{}) {
+	for i := 0; ; i++ {
+		wait := 100 * time.Millisecond
+		if i >= syncBurst {
+			wait = s.c.opts.SyncInterval
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(wait):
+		}
+		// The id is a string, as announcement ids are, so both decode
+		// into handle's message.
+		req, _ := json.Marshal(map[string]any{"type": "sync_req", "id": strconv.Itoa(i), "t1": s.c.localMS(time.Now())})
+		if s.write(ws.OpText, req) != nil {
+			return
+		}
+	}
+}
+
+// read handles frames until the connection fails. Server frames are
+// never masked, so they are read leniently.
+func (s *session) read(br *bufio.Reader) (bool, error) {
+	for {
+		f, err := ws.ReadFrame(br, false, 0)
+		if err != nil {
+			return s.greeted, err
+		}
+		at := time.Now()
+		switch f.Opcode {
+		case ws.OpPing:
+			if err := s.write(ws.OpPong, f.Payload); err != nil {
+				return s.greeted, err
+			}
+		case ws.OpClose:
+			_ = s.write(ws.OpClose, f.Payload)
+			return s.greeted, errors.New("server closed the connection")
+		case ws.OpText:
+			s.handle(f.Payload, at)
+		}
+	}
+}
+
+func (s *session) handle(payload []byte, at time.Time) {
+	var m struct {
+		Type     string   `json:"type"`
+		Seq      uint64   `json:"seq"`
+		PeriodMS int64    `json:"period_ms"`
+		NowMS    float64  `json:"now_ms"`
+		NextMS   float64  `json:"next_ms"`
+		T1       *float64 `json:"t1"`
+		T2       float64  `json:"t2"`
+		T3       float64  `json:"t3"`
+		ID       string   `json:"id"`
+		Text     string   `json:"text"`
+		Severity string   `json:"severity"`
+		Downtime *struct {
+			StartMS float64 `json:"start_ms"`
+			EndMS   float64 `json:"end_ms"`
+		} `json:"downtime"`
+		ExpiresMS float64  `json:"expires_ms"`
+		EpochMS   *float64 `json:"epoch_ms"`
+		Channel   string   `json:"channel"`
+		FinalSeq  uint64   `json:"final_seq"`
+		Reason    string   `json:"reason"`
+		Successor string   `json:"successor"`
+		State     string   `json:"state"`
+		Paused    bool     `json:"paused"`
+	}
+	if json.Unmarshal(payload, &m) != nil {
+		return
+	}
+	switch m.Type {
+	case "hello":
+		s.greeted = true
+		s.c.setChannel(m.Channel)
+		s.c.greet(m.Paused)
+	case "transport":
+		s.c.transport(m.State == "paused", m.Seq, m.NextMS)
+	case "resync":
+		if m.PeriodMS > 0 {
+			s.c.resync(m.Seq, m.NextMS, time.Duration(m.PeriodMS)*time.Millisecond)
+		}
+	case "sync_resp":
+		if m.T1 != nil {
+			s.c.observeSync(*m.T1, m.T2, m.T3, s.c.localMS(at))
+		}
+	case "announcement", "announcement_withdrawn":
+		a := Announcement{ID: m.ID, Withdrawn: m.Type == "announcement_withdrawn"}
+		if !a.Withdrawn {
+			a.Text, a.Severity, a.Expires = m.Text, m.Severity, fromMS(m.ExpiresMS)
+			if m.Downtime != nil {
+				a.DowntimeStart, a.DowntimeEnd = fromMS(m.Downtime.StartMS), fromMS(m.Downtime.EndMS)
+			}
+		}
+		select {
+		case s.c.notes <- a:
+		default:
+		}
+	case "end":
+		if m.Successor != "" {
+			// The server moves the connection on; the successor's pulses
+			// start a grid of their own.
+			s.c.resetGrid()
+			return
+		}
+		s.c.end(&EndedError{Channel: m.Channel, FinalSeq: m.FinalSeq, Reason: m.Reason})
+		_ = s.write(ws.OpClose, ws.ClosePayload(ws.CloseNormal, ""))
+		_ = s.conn.Close()
+	case "pulse":
+		if m.PeriodMS <= 0 {
+			return
+		}
+		p := Pulse{
+			Seq:      m.Seq,
+			Period:   time.Duration(m.PeriodMS) * time.Millisecond,
+			Now:      fromMS(m.NowMS),
+			Next:     fromMS(m.NextMS),
+			Received: at,
+			Raw:      json.RawMessage(payload),
+		}
+		if m.Channel != "" {
+			s.c.setChannel(m.Channel)
+		}
+		epoch := m.NextMS - float64(p.Seq+1)*float64(m.PeriodMS)
+		if m.EpochMS != nil {
+			epoch = *m.EpochMS
+		}
+		s.c.observePulse(p, m.NowMS, m.NextMS, epoch)
+		select {
+		case s.c.pulses <- p:
+		default:
+		}
+	}
+}
+
+func (c *Client) end(e *EndedError) {
+	c.mu.Lock()
+	c.ended = e
+	c.mu.Unlock()
+	c.notify()
+}
+
+func (c *Client) endedErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ended == nil {
+		return nil
+	}
+	return c.ended
+}
+
+func (c *Client) resetGrid() {
+	c.mu.Lock()
+	c.hasGrid, c.paused, c.floor, c.carryOn = false, false, 0, false
+	c.mu.Unlock()
+	c.notify()
+}
+
+// greet starts a session's grid over with the server's transport state:
+// it may have been paused, resumed or restarted while the client was
+// away.
+func (c *Client) greet(paused bool) {
+	c.mu.Lock()
+	c.paused, c.floor, c.carryOn = paused, 0, false
+	if paused {
+		c.hasGrid = false
+	}
+	c.mu.Unlock()
+	c.notify()
+}
+
+// transport stops the ticks while the server has the channel paused, and
+// once it runs again re-anchors the grid: pulse seq falls at nextMS in
+// server time.
+func (c *Client) transport(paused bool, seq uint64, nextMS float64) {
+	c.mu.Lock()
+	c.paused, c.floor = paused, seq
+	if paused {
+		c.hasGrid = false
+	} else if c.period > 0 {
+		c.gridSeq, c.gridMS, c.hasGrid = seq, nextMS, true
+	}
+	c.mu.Unlock()
+	c.notify()
+}
+
+// resync re-anchors the grid after the server skipped pulses: pulse seq
+// falls at nextMS in server time. The ticks predicted for the skipped
+// slots have gone out already, numbered as if nothing was skipped, so the
+// ones the new grid would give the same seqs are left out.
+func (c *Client) resync(seq uint64, nextMS float64, period time.Duration) {
+	c.mu.Lock()
+	c.gridSeq, c.gridMS, c.period, c.hasGrid = seq, nextMS, period, true
+	c.floor, c.carryOn = seq, true
+	c.mu.Unlock()
+	c.notify()
+}
+
+func (c *Client) setConnected(v bool) {
+	c.mu.Lock()
+	c.connected = v
+	c.mu.Unlock()
+	c.notify()
+}
+
+// observeSync adds an NTP-style exchange: t1 and t4 local, t2 and t3
+// server time.
+func (c *Client) observeSync(t1, t2, t3, t4 float64) {
+	rtt := (t4 - t1) - (t3 - t2)
+	if rtt < 0 {
+		return
+	}
+	c.mu.Lock()
+	c.samples = append(c.samples, syncSample{offset: ((t2 - t1) + (t3 - t4)) / 2, rtt: rtt})
+	if len(c.samples) > syncWindow {
+		c.samples = c.samples[1:]
+	}
+	best := c.samples[0]
+	for _, s := range c.samples[1:] {
+		if s.rtt < best.rtt {
+			best = s
+		}
+	}
+	c.offset, c.hasSync = best.offset, true
+	c.mu.Unlock()
+	c.notify()
+}
+
+func (c *Client) setChannel(name string) {
+	c.mu.Lock()
+	c.channel = name
+	c.mu.Unlock()
+}
+
+// observePulse moves the beat grid to the pulse's next beat, on the
+// timeline that began at epochMS. Until a sync response arrives, the
+// offset is taken from the pulse itself, which places beats late by the
+// one-way latency. A pulse sent before the latest transport change, which
+// overtook it in the server's write queue, leaves the grid alone.
+func (c *Client) observePulse(p Pulse, nowMS, nextMS, epochMS float64) {
+	c.mu.Lock()
+	if c.paused || p.Seq < c.floor {
+		c.mu.Unlock()
+		return
+	}
+	if !c.hasSync {
+		c.offset = nowMS - c.localMS(p.Received)
+	}
+	c.gridSeq, c.gridMS, c.period, c.hasGrid = p.Seq+1, nextMS, p.Period, true
+	c.epochMS = epochMS
+	c.mu.Unlock()
+	c.notify()
+}
+
+func (c *Client) notify() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// tick delivers a tick on every beat of the current grid estimate,
+// recomputing the next beat whenever the estimate changes and never
+// repeating or going back on a beat already delivered.
+func (c *Client) tick(ctx context.Context) {
+	var last uint64
+	var delivered bool
+	for {
+		t, ok := c.nextTick(last, delivered)
+		var due <-chan time.Time
+		var timer *time.Timer
+		if ok {
+			timer = time.NewTimer(time.Until(t.At))
+			due = timer.C
+		}
+		fired := false
+		select {
+		case <-ctx.Done():
+		case <-c.changed:
+		case <-due:
+			fired = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if !fired {
+			continue
+		}
+		select {
+		case c.ticks <- t:
+		default:
+		}
+		last, delivered = t.Seq, true
+	}
+}
+
+// nextTick returns the first beat that is not in the past (give or take
+// tickGrace), not before the floor and, when delivered is set, after beat
+// last. A grid that starts over far behind last, as after a server
+// restart, is taken as it is, unless a resync moved it.
+func (c *Client) nextTick(last uint64, delivered bool) (Tick, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.hasGrid {
+		return Tick{}, false
+	}
+	periodMS := float64(c.period) / float64(time.Millisecond)
+	// The beat at or after now, in server time, or just before.
+	graceMS := float64(min(tickGrace, c.period/2)) / float64(time.Millisecond)
+	nowMS := c.localMS(time.Now()) + c.offset
+	k := math.Ceil((nowMS - graceMS - c.gridMS) / periodMS)
+	seq := int64(c.gridSeq) + int64(k)
+	if delivered && seq <= int64(last) && (int64(last)-seq <= 1 || c.carryOn) {
+		seq = int64(last) + 1
+	}
+	if seq < int64(c.floor) {
+		seq = int64(c.floor)
+	}
+	if c.ended != nil && uint64(seq) > c.ended.FinalSeq {
+		return Tick{}, false
+	}
+	beatMS := c.gridMS + float64(seq-int64(c.gridSeq))*periodMS
+	return Tick{
+		Seq:       uint64(seq),
+		Period:    c.period,
+		At:        c.base.Add(time.Duration((beatMS - c.offset) * float64(time.Millisecond))),
+		Connected: c.connected,
+	}, true
+}
+
+// localMS is t in milliseconds since c.base, on the monotonic clock.
+func (c *Client) localMS(t time.Time) float64 {
+	return float64(t.Sub(c.base)) / float64(time.Millisecond)
+}
+
+// fromMS converts Unix milliseconds to a time.
+func fromMS(ms float64) time.Time {
+	return time.UnixMicro(int64(math.Round(ms * 1000)))
+}
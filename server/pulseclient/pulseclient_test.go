@@ -0,0 +1,109 @@
+package pulseclient
+
+import (
+	"testing"
+	"time"
+)
+
+const period = 500 * time.Millisecond
+
+// syncedClient returns a client whose offset to the server is settled.
+func syncedClient() *Client {
+	c := New(Options{})
+	c.offset, c.hasSync = 1.7e12, true
+	return c
+}
+
+// serverMS is the server's time d from now.
+func (c *Client) serverMS(d time.Duration) float64 {
+	return c.localMS(time.Now().Add(d)) + c.offset
+}
+
+// pulse feeds c pulse seq, its next beat d from now.
+func (c *Client) pulse(seq uint64, d time.Duration) {
+	now := time.Now()
+	c.observePulse(Pulse{Seq: seq, Period: period, Received: now}, c.serverMS(0), c.serverMS(d), 0)
+}
+
+func wantTick(t *testing.T, c *Client, last uint64, delivered bool, seq uint64, in time.Duration) {
+	t.Helper()
+	tick, ok := c.nextTick(last, delivered)
+	if !ok {
+		t.Fatalf("no tick, want seq %d", seq)
+	}
+	if tick.Seq != seq {
+		t.Fatalf("tick seq %d, want %d", tick.Seq, seq)
+	}
+	if d := time.Until(tick.At) - in; d.Abs() > 5*time.Millisecond {
+		t.Fatalf("tick %d due in %v, want %v", seq, time.Until(tick.At), in)
+	}
+}
+
+func wantNoTick(t *testing.T, c *Client, last uint64) {
+	t.Helper()
+	if tick, ok := c.nextTick(last, true); ok {
+		t.Fatalf("tick %d, want none", tick.Seq)
+	}
+}
+
+func TestTickFollowsPulses(t *testing.T) {
+	c := syncedClient()
+	// The first pulse's own beat is now.
+	c.pulse(4, period)
+	wantTick(t, c, 0, false, 4, 0)
+	wantTick(t, c, 4, true, 5, period)
+	// Pulse 5 arrived a moment after its beat, before tick 5 went out:
+	// the tick is still due, at once.
+	c.pulse(5, period-2*time.Millisecond)
+	wantTick(t, c, 4, true, 5, -2*time.Millisecond)
+	wantTick(t, c, 5, true, 6, period-2*time.Millisecond)
+}
+
+func TestTransportPausesTicks(t *testing.T) {
+	c := syncedClient()
+	c.pulse(5, period)
+	c.transport(true, 6, 0)
+	wantNoTick(t, c, 5)
+	// A pulse queued before the pause still arrives after it.
+	c.pulse(5, period)
+	wantNoTick(t, c, 5)
+
+	// Resumed with a count-in of three: the grid is anchored on pulse 6,
+	// and the count-in slots before it tick nothing.
+	c.transport(false, 6, c.serverMS(4*period))
+	wantTick(t, c, 5, true, 6, 4*period)
+	c.pulse(6, period)
+	wantTick(t, c, 6, true, 7, period)
+}
+
+func TestTransportReset(t *testing.T) {
+	c := syncedClient()
+	c.pulse(9, period)
+	// A reset starts a fresh grid, with pulse 10 a third of a period
+	// from now rather than a whole one.
+	c.transport(false, 10, c.serverMS(period/3))
+	wantTick(t, c, 9, true, 10, period/3)
+}
+
+func TestGreetPaused(t *testing.T) {
+	c := syncedClient()
+	c.pulse(3, period)
+	// Reconnected to a channel paused meanwhile.
+	c.greet(true)
+	wantNoTick(t, c, 3)
+	c.transport(false, 4, c.serverMS(period))
+	wantTick(t, c, 3, true, 4, period)
+}
+
+func TestResyncDoesNotRepeatTicks(t *testing.T) {
+	c := syncedClient()
+	c.pulse(5, period)
+	// The server stalled after pulse 5 while the client ticked on up to
+	// 9; then it sent the late pulse 6 and a resync: pulse 7 is due a
+	// period from now. Ticks carry on in the new phase after 9.
+	c.pulse(6, -3*period)
+	c.resync(7, c.serverMS(period), period)
+	wantTick(t, c, 9, true, 10, 4*period)
+	c.pulse(7, period)
+	wantTick(t, c, 9, true, 10, 3*period)
+}
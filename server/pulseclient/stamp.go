@@ -0,0 +1,94 @@
+package pulseclient
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// Stamp is where on the server's beat grid a moment fell: beat Seq of
+// Channel's timeline that began at EpochMS, and Phase, from 0 to 1, of the
+// way to the next beat. The server's GET /api/beat turns it back into
+// wall-clock time, so logs stamped with it can be lined up with the beats
+// later.
+type Stamp struct {
+	Channel string
+	EpochMS float64
+	Seq     uint64
+	Phase   float64
+}
+
+// LogValue groups the stamp's fields for slog.
+func (s Stamp) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("channel", s.Channel),
+		slog.Float64("epoch_ms", s.EpochMS),
+		slog.Uint64("seq", s.Seq),
+		slog.Float64("phase", math.Round(s.Phase*1e4)/1e4),
+	)
+}
+
+// Stamp is the stamp of now; false before the first pulse.
+func (c *Client) Stamp() (Stamp, bool) {
+	return c.StampAt(time.Now())
+}
+
+// StampAt is the stamp of t, on the local clock, from the current grid
+// estimate; false before the first pulse.
+func (c *Client) StampAt(t time.Time) (Stamp, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.hasGrid || c.period <= 0 {
+		return Stamp{}, false
+	}
+	periodMS := float64(c.period) / float64(time.Millisecond)
+	beats := (c.localMS(t) + c.offset - c.gridMS) / periodMS
+	k := math.Floor(beats)
+	seq := int64(c.gridSeq) + int64(k)
+	if seq < 0 {
+		return Stamp{}, false
+	}
+	return Stamp{Channel: c.channel, EpochMS: c.epochMS, Seq: uint64(seq), Phase: beats - k}, true
+}
+
+// LogHandler wraps next so that every record logged through it carries
+// the client's stamp of the record's time as the group "beat":
+//
+//	log := slog.New(c.LogHandler(slog.NewJSONHandler(os.Stderr, nil)))
+//	log.Error("cue missed")
+//	// {"msg":"cue missed","beat":{"channel":"default","epoch_ms":1767225600000,"seq":4711,"phase":0.25}}
+//
+// Records logged before the first pulse go out unstamped.
+func (c *Client) LogHandler(next slog.Handler) slog.Handler {
+	return &stampHandler{c: c, next: next}
+}
+
+type stampHandler struct {
+	c    *Client
+	next slog.Handler
+}
+
+func (h *stampHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *stampHandler) Handle(ctx context.Context, r slog.Record) error {
+	at := r.Time
+	if at.IsZero() {
+		at = time.Now()
+	}
+	if s, ok := h.c.StampAt(at); ok {
+		r = r.Clone()
+		r.AddAttrs(slog.Any("beat", s))
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *stampHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &stampHandler{c: h.c, next: h.next.WithAttrs(attrs)}
+}
+
+func (h *stampHandler) WithGroup(name string) slog.Handler {
+	return &stampHandler{c: h.c, next: h.next.WithGroup(name)}
+}
@@ -7,7 +7,7 @@ PULSE_ADDR="${PULSE_ADDR:-:8080}"
 PULSE_PERIOD_MS="${PULSE_PERIOD_MS:-1000}"
 
 echo "Building..."
-go build -o pulse .
+go build -o pulse ./cmd/pulse-server
 
 echo "Starting pulse server on ${PULSE_ADDR} (period=${PULSE_PERIOD_MS}ms)"
 PULSE_ADDR="$PULSE_ADDR" PULSE_PERIOD_MS="$PULSE_PERIOD_MS" exec ./pulse
@@ -0,0 +1,112 @@
+package ws
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Dial opens a client connection to a ws:// or wss:// URL, offering the
+// subprotocols in protocols. The handshake is bounded by ctx; the returned
+// response carries the negotiated Sec-WebSocket-Protocol.
+func Dial(ctx context.Context, rawURL string, header http.Header, protocols ...string) (net.Conn, *bufio.Reader, *http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	var d net.Dialer
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = d.DialContext(ctx, "tcp", host)
+	case "wss":
+		td := tls.Dialer{NetDialer: &d, Config: &tls.Config{ServerName: u.Hostname()}}
+		conn, err = td.DialContext(ctx, "tcp", host)
+	default:
+		return nil, nil, nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var nonce [16]byte
+	_, _ = rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req, err := http.NewRequest(http.MethodGet, (&url.URL{Scheme: "http", Host: u.Host, Path: u.Path, RawQuery: u.RawQuery}).String(), nil)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, nil, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	if len(protocols) > 0 {
+		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(protocols, ", "))
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, nil, nil, fmt.Errorf("write handshake: %w", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, nil, fmt.Errorf("read handshake: %w", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		_ = conn.Close()
+		return nil, nil, resp, fmt.Errorf("handshake: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != Accept(key) {
+		_ = conn.Close()
+		return nil, nil, resp, fmt.Errorf("handshake: wrong Sec-WebSocket-Accept")
+	}
+	if !stop() {
+		_ = conn.Close()
+		return nil, nil, resp, ctx.Err()
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, br, resp, nil
+}
+
+// AppendMaskedFrame appends a final frame masked with a random key, as
+// clients must send them.
+func AppendMaskedFrame(frame []byte, opcode byte, payload []byte) []byte {
+	start := len(frame)
+	frame = AppendFrame(frame, opcode, payload)
+	body := len(frame) - len(payload)
+	frame[start+1] |= 0x80
+	var mask [4]byte
+	_, _ = rand.Read(mask[:])
+	frame = append(frame[:body], append(mask[:], payload...)...)
+	for i := range payload {
+		frame[body+4+i] ^= mask[i%4]
+	}
+	return frame
+}
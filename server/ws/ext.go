@@ -0,0 +1,104 @@
+package ws
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// RSV bit masks as stored in Frame.RSV.
+const (
+	RSV1 = 0x4
+	RSV2 = 0x2
+	RSV3 = 0x1
+)
+
+// Extension is a negotiated WebSocket extension (RFC 6455 section 9).
+// Extensions legitimately claim RSV bits; frames using bits that no
+// negotiated extension claims are protocol errors.
+type Extension interface {
+	// Name is the extension token, e.g. "permessage-deflate".
+	Name() string
+	// RSV returns the reserved bits this extension uses.
+	RSV() byte
+	// Response is the Sec-WebSocket-Extensions entry echoed to the client.
+	Response() string
+	// Decode transforms an inbound frame whose RSV bits include ours.
+	Decode(f *Frame) error
+}
+
+// ExtensionFactory builds an extension from the parameters a client
+// offered, or returns an error to decline it.
+type ExtensionFactory func(params map[string]string) (Extension, error)
+
+// extensions holds the extensions this server is willing to negotiate.
+// It is empty for now; future extensions (compression, multiplexing)
+// register themselves here.
+var (
+	extensionsMu sync.RWMutex
+	extensions   = map[string]ExtensionFactory{}
+)
+
+// RegisterExtension makes the extension name negotiable.
+func RegisterExtension(name string, factory ExtensionFactory) {
+	extensionsMu.Lock()
+	defer extensionsMu.Unlock()
+	extensions[name] = factory
+}
+
+// NegotiateExtensions accepts the offered extensions the server supports,
+// in offer order, skipping any whose RSV bits collide with an earlier one.
+// It returns them with the Sec-WebSocket-Extensions response header.
+func NegotiateExtensions(offered string) ([]Extension, string) {
+	extensionsMu.RLock()
+	defer extensionsMu.RUnlock()
+	var (
+		accepted []Extension
+		claimed  byte
+		resp     []string
+	)
+	for _, offer := range SplitHeaderList(offered) {
+		parts := strings.Split(offer, ";")
+		name := strings.TrimSpace(parts[0])
+		factory, ok := extensions[name]
+		if !ok {
+			continue
+		}
+		params := make(map[string]string, len(parts)-1)
+		for _, p := range parts[1:] {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			params[strings.TrimSpace(k)] = strings.Trim(strings.TrimSpace(v), `"`)
+		}
+		ext, err := factory(params)
+		if err != nil || ext.RSV()&claimed != 0 {
+			continue
+		}
+		claimed |= ext.RSV()
+		accepted = append(accepted, ext)
+		resp = append(resp, ext.Response())
+	}
+	return accepted, strings.Join(resp, ", ")
+}
+
+// ClaimedRSV returns the reserved bits exts use between them.
+func ClaimedRSV(exts []Extension) byte {
+	var bits byte
+	for _, e := range exts {
+		bits |= e.RSV()
+	}
+	return bits
+}
+
+// ApplyExtensions runs the inbound transforms of every extension whose bits
+// are set on f.
+func ApplyExtensions(exts []Extension, f *Frame) error {
+	for _, e := range exts {
+		if f.RSV&e.RSV() == 0 {
+			continue
+		}
+		if err := e.Decode(f); err != nil {
+			return &CloseError{Code: CloseProtocolError, Reason: fmt.Sprintf("%s: %v", e.Name(), err)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package ws
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// MaxFramePayload bounds inbound frames read with ReadFrame; clients only
+// ever send small control and input messages.
+const MaxFramePayload = 64 << 10
+
+// Frame is a frame read from a client.
+type Frame struct {
+	Fin     bool
+	RSV     byte // RSV1-3 in the low three bits
+	Opcode  byte
+	Masked  bool
+	Payload []byte
+}
+
+// CloseError is a protocol violation that should fail the connection with
+// the given close code.
+type CloseError struct {
+	Code   uint16
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("%s (close %d)", e.Reason, e.Code)
+}
+
+// KnownOpcode reports whether op is defined by RFC 6455.
+func KnownOpcode(op byte) bool {
+	switch op {
+	case OpContinuation, OpText, OpBinary, OpClose, OpPing, OpPong:
+		return true
+	}
+	return false
+}
+
+// ReadFrame reads and unmasks one frame from a client. Unknown opcodes and
+// malformed control frames are always protocol errors. In strict mode,
+// unmasked frames and reserved bits not claimed by a negotiated extension
+// are too, as RFC 6455 requires; lenient mode tolerates them for broken
+// embedded clients.
+func ReadFrame(r *bufio.Reader, strict bool, claimed byte) (Frame, error) {
+	return ReadFrameLimit(r, strict, claimed, MaxFramePayload)
+}
+
+// ReadFrameLimit is ReadFrame with frames of more than limit bytes
+// failing with CloseTooBig before their payload is read.
+func ReadFrameLimit(r *bufio.Reader, strict bool, claimed byte, limit uint64) (Frame, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return Frame{}, err
+	}
+	f := Frame{
+		Fin:    hdr[0]&0x80 != 0,
+		RSV:    (hdr[0] >> 4) & 0x7,
+		Opcode: hdr[0] & 0x0f,
+		Masked: hdr[1]&0x80 != 0,
+	}
+	if !KnownOpcode(f.Opcode) {
+		return f, &CloseError{Code: CloseProtocolError, Reason: fmt.Sprintf("unknown opcode %#x", f.Opcode)}
+	}
+	if strict && f.RSV&^claimed != 0 {
+		return f, &CloseError{Code: CloseProtocolError, Reason: "reserved bits set without a negotiated extension"}
+	}
+	if strict && !f.Masked {
+		return f, &CloseError{Code: CloseProtocolError, Reason: "client frame is not masked"}
+	}
+
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return f, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return f, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if f.Opcode >= OpClose && (!f.Fin || n > 125) {
+		return f, &CloseError{Code: CloseProtocolError, Reason: "control frames must be unfragmented and at most 125 bytes"}
+	}
+	if n > limit {
+		return f, &CloseError{Code: CloseTooBig, Reason: fmt.Sprintf("frame of %d bytes exceeds limit", n)}
+	}
+
+	var mask [4]byte
+	if f.Masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return f, err
+		}
+	}
+	f.Payload = make([]byte, n)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return f, err
+	}
+	if f.Masked {
+		for i := range f.Payload {
+			f.Payload[i] ^= mask[i%4]
+		}
+	}
+	return f, nil
+}
+
+// ParseClose decodes a close frame payload. An empty payload reports
+// CloseNoStatus.
+func ParseClose(payload []byte) (uint16, string, *CloseError) {
+	if len(payload) == 0 {
+		return CloseNoStatus, "", nil
+	}
+	if len(payload) == 1 {
+		return 0, "", &CloseError{Code: CloseProtocolError, Reason: "close payload of 1 byte"}
+	}
+	code := binary.BigEndian.Uint16(payload)
+	if !ValidCloseCode(code) {
+		return 0, "", &CloseError{Code: CloseProtocolError, Reason: fmt.Sprintf("invalid close code %d", code)}
+	}
+	if !utf8.Valid(payload[2:]) {
+		return 0, "", &CloseError{Code: CloseInvalidPayload, Reason: "close reason is not valid UTF-8"}
+	}
+	return code, string(payload[2:]), nil
+}
+
+// ValidCloseCode reports whether a peer may send code (RFC 6455 section
+// 7.4): the defined codes except those reserved for local use, plus the
+// registered and private ranges.
+func ValidCloseCode(code uint16) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+// Package ws implements the WebSocket protocol (RFC 6455) for the pulse
+// server and its clients: the opening handshake, frame encoding and
+// decoding, close codes and extension negotiation. Connection handling,
+// fan-out and accounting live in package hub.
+package ws
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// GUID is appended to a client's key to compute Sec-WebSocket-Accept.
+const GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Opcodes (RFC 6455 section 5.2).
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xA
+)
+
+// Close status codes (RFC 6455 section 7.4.1).
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseNoStatus        = 1005 // never sent; an empty close payload
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseTooBig          = 1009
+	CloseServiceRestart  = 1012 // IANA registry; clients should reconnect
+	CloseTryAgainLater   = 1013 // IANA registry; the server is unavailable for now
+)
+
+// ContainsToken reports whether the comma-separated header value lists
+// want, ignoring case.
+func ContainsToken(headerVal, want string) bool {
+	for _, part := range strings.Split(headerVal, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), want) {
+			return true
+		}
+	}
+	return false
+}
+
+// SplitHeaderList splits a comma-separated list, dropping empty entries.
+func SplitHeaderList(v string) []string {
+	var out []string
+	for _, part := range strings.Split(v, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// Accept returns the Sec-WebSocket-Accept value for a client's key.
+func Accept(key string) string {
+	sum := sha1.Sum([]byte(key + GUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// CheckUpgrade reports whether r is a WebSocket opening handshake this
+// server can accept and returns its Sec-WebSocket-Key.
+func CheckUpgrade(r *http.Request) (key string, err error) {
+	if !ContainsToken(r.Header.Get("Connection"), "Upgrade") {
+		return "", fmt.Errorf("missing connection upgrade")
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return "", fmt.Errorf("missing websocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return "", fmt.Errorf("unsupported websocket version")
+	}
+	key = strings.TrimSpace(r.Header.Get("Sec-WebSocket-Key"))
+	if key == "" {
+		return "", fmt.Errorf("missing websocket key")
+	}
+	return key, nil
+}
+
+// Hijack takes the connection over from w and completes the handshake for
+// key. Headers already set on w (the subprotocol, extensions, X-Request-Id)
+// are carried over into the handshake response.
+func Hijack(w http.ResponseWriter, key string) (net.Conn, *bufio.Reader, error) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, fmt.Errorf("hijack connection: %w", err)
+	}
+	// The server's read and write timeouts were for the request; the
+	// connection now lives as long as the client does.
+	_ = conn.SetDeadline(time.Time{})
+
+	var extra strings.Builder
+	for name, values := range w.Header() {
+		for _, v := range values {
+			extra.WriteString(name + ": " + v + "\r\n")
+		}
+	}
+
+	if _, err := rw.WriteString(
+		"HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + Accept(key) + "\r\n" +
+			extra.String() + "\r\n",
+	); err != nil {
+		_ = conn.Close()
+		return nil, nil, fmt.Errorf("write handshake: %w", err)
+	}
+	if err := rw.Flush(); err != nil {
+		_ = conn.Close()
+		return nil, nil, fmt.Errorf("flush handshake: %w", err)
+	}
+	return conn, rw.Reader, nil
+}
+
+// AppendFrame appends a final, unmasked frame, as servers send them.
+// TODO: Consider not doing bit-fiddling unless it's really worth it
+func AppendFrame(frame []byte, opcode byte, payload []byte) []byte {
+	const (
+		fin = 0x80
+	)
+	frame = append(frame, fin|opcode)
+	n := len(payload)
+	switch {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 65535:
+		frame = append(frame, 126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, 127,
+			byte(uint64(n)>>56),
+			byte(uint64(n)>>48),
+			byte(uint64(n)>>40),
+			byte(uint64(n)>>32),
+			byte(uint64(n)>>24),
+			byte(uint64(n)>>16),
+			byte(uint64(n)>>8),
+			byte(uint64(n)),
+		)
+	}
+	return append(frame, payload...)
+}
+
+// ClosePayload is the payload of a close frame with code and reason, the
+// reason cut to fit a control frame.
+func ClosePayload(code uint16, reason string) []byte {
+	if len(reason) > 123 {
+		reason = reason[:123] // control frame payloads are limited to 125 bytes
+	}
+	payload := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(reason)), code)
+	return append(payload, reason...)
+}
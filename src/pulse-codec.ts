@@ -0,0 +1,257 @@
+// Code generated by pulse-gen from server/hub/schema.json; DO NOT EDIT.
+
+/**
+ * Reference decoders for the binary pulse subprotocols, generated from the
+ * same spec the server serves at /api/schema. Each returns the pulse as its
+ * pulse.v2+json message would be, and throws on a malformed frame. Integers
+ * are exact up to 2^53.
+ */
+
+export const BINARY_PROTOCOL = "pulse.v2+binary";
+export const TAGGED_PROTOCOL = "pulse.v2+tagged";
+
+/** A decoded pulse; fields beyond the required ones depend on the server. */
+export interface DecodedPulse {
+  type: "pulse";
+  seq: number;
+  period_ms: number;
+  now_ms: number;
+  next_ms: number;
+  [field: string]: unknown;
+}
+
+function u64(view: DataView, at: number): number {
+  return view.getUint32(at) * 2 ** 32 + view.getUint32(at + 4);
+}
+
+function i64(view: DataView, at: number): number {
+  return view.getInt32(at) * 2 ** 32 + view.getUint32(at + 4);
+}
+
+function utf8(bytes: Uint8Array): string {
+  return new TextDecoder().decode(bytes);
+}
+
+/** Decodes a pulse.v2+binary frame. */
+export function decodeBinaryPulse(data: ArrayBuffer): DecodedPulse {
+  const view = new DataView(data);
+  if (view.byteLength < 30) {
+    throw new Error(`binary pulse of ${view.byteLength} bytes, want at least 30`);
+  }
+  if (view.getUint8(0) !== 0x01) {
+    throw new Error("binary message is not a pulse");
+  }
+  const flags = view.getUint8(1);
+  const m: DecodedPulse = {
+    type: "pulse",
+    seq: u64(view, 2),
+    period_ms: view.getUint32(10),
+    now_ms: i64(view, 14),
+    next_ms: i64(view, 22),
+  };
+  let at = 30;
+  const need = (n: number, what: string): void => {
+    if (at + n > view.byteLength) {
+      throw new Error(`binary pulse truncated in ${what}`);
+    }
+  };
+  if (flags & 0x01) {
+    need(4, "offset_ms");
+    m.offset_ms = view.getInt32(at);
+    at += 4;
+  }
+  if (flags & 0x04) {
+    need(4, "drift_ms");
+    m.drift_ms = view.getInt32(at) / 1000;
+    at += 4;
+  }
+  if (flags & 0x08) {
+    need(8, "mono_ms");
+    m.mono_ms = i64(view, at);
+    at += 8;
+  }
+  if (flags & 0x10) {
+    m.period_changed = true;
+  }
+  if (flags & 0x20) {
+    need(8, "at_ms");
+    m.at_ms = i64(view, at);
+    at += 8;
+  }
+  if (flags & 0x40) {
+    need(6, "ramp_target_ms");
+    m.ramp_target_ms = view.getUint32(at);
+    m.ramp_pulses = view.getUint16(at + 4);
+    at += 6;
+  }
+  if (flags & 0x80) {
+    need(32, "period_us");
+    m.period_us = u64(view, at);
+    m.now_us = i64(view, at + 8);
+    m.next_us = i64(view, at + 16);
+    m.at_us = i64(view, at + 24);
+    at += 32;
+  }
+  if (flags & 0x02) {
+    need(2, "extra fields");
+    const n = view.getUint16(at);
+    at += 2;
+    need(n, "extra fields");
+    Object.assign(m, JSON.parse(utf8(new Uint8Array(data, at, n))));
+    at += n;
+  }
+  if (at !== view.byteLength) {
+    throw new Error(`binary pulse has ${view.byteLength - at} trailing bytes`);
+  }
+  return m;
+}
+
+/**
+ * Decodes a pulse.v2+tagged frame. Tags it does not know are skipped by
+ * their length, so newer servers can add fields.
+ */
+export function decodeTaggedPulse(data: ArrayBuffer): DecodedPulse {
+  const bytes = new Uint8Array(data);
+  if (bytes[0] !== 0x01) {
+    throw new Error("tagged message is not a pulse");
+  }
+  let at = 1;
+  const uvarint = (end: number): number => {
+    let v = 0;
+    for (let shift = 0; at < end && shift < 64; shift += 7) {
+      const b = bytes[at++] ?? 0;
+      v += (b & 0x7f) * 2 ** shift;
+      if (b < 0x80) {
+        return v;
+      }
+    }
+    throw new Error("tagged pulse: bad varint");
+  };
+  const m: Record<string, unknown> = { type: "pulse" };
+  while (at < bytes.length) {
+    const tag = uvarint(bytes.length);
+    const size = uvarint(bytes.length);
+    const end = at + size;
+    if (end > bytes.length) {
+      throw new Error(`tagged pulse truncated in tag ${tag}`);
+    }
+    const value = (): number => {
+      const v = uvarint(end);
+      if (at !== end) {
+        throw new Error(`tagged pulse: tag ${tag} is not a single varint`);
+      }
+      return v;
+    };
+    const signed = (): number => {
+      const v = value();
+      return v % 2 === 1 ? -(v + 1) / 2 : v / 2;
+    };
+    const need = (n: number, what: string): void => {
+      if (size !== n) {
+        throw new Error(`tagged pulse: ${what} is ${size} bytes, want ${n}`);
+      }
+    };
+    const v = bytes.subarray(at, end);
+    switch (tag) {
+      case 1:
+        m.seq = value();
+        break;
+      case 2:
+        m.period_ms = value();
+        break;
+      case 3:
+        m.now_ms = signed();
+        break;
+      case 4:
+        m.next_ms = signed();
+        break;
+      case 5:
+        m.offset_ms = signed();
+        break;
+      case 6:
+        m.drift_ms = signed() / 1000;
+        break;
+      case 7:
+        m.mono_ms = signed();
+        break;
+      case 8:
+        m.period_changed = true;
+        break;
+      case 9:
+        m.at_ms = signed();
+        break;
+      case 10:
+        m.ramp_target_ms = value();
+        break;
+      case 11:
+        m.ramp_pulses = value();
+        break;
+      case 13:
+        need(8, "bpm");
+        m.bpm = new DataView(data, at, 8).getFloat64(0);
+        break;
+      case 14:
+        m.bar = value();
+        break;
+      case 15:
+        m.beat = value();
+        break;
+      case 16:
+        m.is_downbeat = true;
+        break;
+      case 17:
+        need(32, "hash");
+        m.hash = Array.from(v, (b) => b.toString(16).padStart(2, "0")).join("");
+        break;
+      case 18:
+        need(32, "prev_hash");
+        m.prev_hash = Array.from(v, (b) => b.toString(16).padStart(2, "0")).join("");
+        break;
+      case 19:
+        m.rate = value();
+        break;
+      case 20:
+        need(8, "phase");
+        m.phase = new DataView(data, at, 8).getFloat64(0);
+        break;
+      case 21:
+        need(8, "epoch_ms");
+        m.epoch_ms = new DataView(data, at, 8).getFloat64(0);
+        break;
+      case 22:
+        m.period_us = value();
+        break;
+      case 23:
+        m.now_us = signed();
+        break;
+      case 24:
+        m.next_us = signed();
+        break;
+      case 25:
+        m.at_us = signed();
+        break;
+      case 26:
+        need(8, "last_delay_ms");
+        m.last_delay_ms = new DataView(data, at, 8).getFloat64(0);
+        break;
+      case 27:
+        m.step = value();
+        break;
+      case 28:
+        m.steps = value();
+        break;
+      case 29:
+        need(8, "swing_ms");
+        m.swing_ms = new DataView(data, at, 8).getFloat64(0);
+        break;
+      case 12:
+        Object.assign(m, JSON.parse(utf8(v)));
+        break;
+    }
+    at = end;
+  }
+  if (m.seq === undefined || m.period_ms === undefined || m.now_ms === undefined || m.next_ms === undefined) {
+    throw new Error("tagged pulse is missing required fields");
+  }
+  return m as DecodedPulse;
+}
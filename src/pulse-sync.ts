@@ -14,6 +14,10 @@ export interface PulseMessage {
   period_ms: number;
   now_ms: number;
   next_ms: number;
+  /** Channels with a tempo: when bar 1 began, Unix milliseconds. */
+  epoch_ms?: number;
+  /** The channel, on connections that receive several. */
+  channel?: string;
 }
 
 // ---------------------------------------------------------------------------
@@ -61,6 +65,19 @@ export interface PulseSyncOptions {
   stickyLock?: boolean;
 }
 
+/**
+ * Where on the server's beat grid a moment fell: beat `seq` of `channel`'s
+ * timeline that began at `epochMs`, and `phase`, from 0 to 1, of the way to
+ * the next beat. The server's `GET /api/beat` turns it back into wall-clock
+ * time, so log entries stamped with it can be lined up with the beats.
+ */
+export interface BeatStamp {
+  channel: string;
+  epochMs: number;
+  seq: number;
+  phase: number;
+}
+
 /** Snapshot kept for each successfully processed pulse. */
 export interface LastPulse {
   seq: number;
@@ -93,6 +110,49 @@ export interface PulseEventDetail {
   elapsedSinceLockMs: number | null;
 }
 
+/** One thing the server suggests to tighten sync, from a self-test. */
+export interface SelfTestRecommendation {
+  action: "enable_send_ahead" | "increase_send_ahead" | "increase_jitter_buffer";
+  /** Suggested send-ahead or jitter buffer, in ms. */
+  value_ms?: number;
+  reason: string;
+}
+
+/** The server's verdict on a self-test (`selftest_result`). */
+export interface SelfTestResult {
+  type: "selftest_result";
+  /** 100 for exact sync down to 0 for beats smeared over 100 ms or more. */
+  score: number;
+  /** How far beats may land from the server's. */
+  error_ms: number;
+  offset_ms: number;
+  rtt_ms: number;
+  rtt_jitter_ms: number;
+  pulse_jitter_ms?: number;
+  send_ahead: boolean;
+  recommendations: SelfTestRecommendation[];
+}
+
+/** A maintenance announcement from the server's operators. */
+export interface Announcement {
+  id: string;
+  text: string;
+  severity: "info" | "warning" | "critical";
+  /** Scheduled downtime, server time in Unix ms. */
+  downtime?: { start_ms: number; end_ms: number };
+  sent_ms: number;
+  /** Stop showing it after this, server time in Unix ms. */
+  expires_ms: number;
+}
+
+/**
+ * Detail carried by the `"announcement"` CustomEvent. `withdrawn` events
+ * only carry the id of the announcement to stop showing.
+ */
+export type AnnouncementEventDetail =
+  | (Announcement & { withdrawn: false })
+  | { id: string; withdrawn: true };
+
 /** Detail carried by the `"status"` CustomEvent. */
 export interface StatusEventDetail {
   connected: boolean;
@@ -112,6 +172,7 @@ export interface PulseSyncEventMap {
   pulse: CustomEvent<PulseEventDetail>;
   status: CustomEvent<StatusEventDetail>;
   lock: CustomEvent<LockEventDetail>;
+  announcement: CustomEvent<AnnouncementEventDetail>;
 }
 
 
@@ -139,6 +200,9 @@ export class PulseSyncClient extends EventTarget {
   private lockOriginServerMs: number | null = null;
   locked: boolean = false;
   estimatedServerNowMs: number | null = null;
+  /** The channel followed, as the server's hello named it. */
+  channel: string = "default";
+  private epochMs: number | null = null;
 
   constructor(opts: PulseSyncOptions = {}) {
     super();
@@ -153,7 +217,7 @@ export class PulseSyncClient extends EventTarget {
 
   connect(): void {
     if (this.ws) return;
-    const ws = new WebSocket(this.url);
+    const ws = new WebSocket(this.url, PROTO_JSON);
     this.ws = ws;
 
     ws.addEventListener("open", () => {
@@ -182,6 +246,18 @@ export class PulseSyncClient extends EventTarget {
       } catch {
         return;
       }
+      if (isAnnouncement(msg)) {
+        this.dispatch("announcement", { ...msg, withdrawn: false });
+        return;
+      }
+      if (isMessage(msg, "hello")) {
+        if (typeof msg["channel"] === "string") this.channel = msg["channel"];
+        return;
+      }
+      if (isMessage(msg, "announcement_withdrawn")) {
+        this.dispatch("announcement", { id: String(msg["id"]), withdrawn: true });
+        return;
+      }
       if (!isPulseMessage(msg)) return;
       this.handlePulse(msg);
     });
@@ -219,6 +295,90 @@ export class PulseSyncClient extends EventTarget {
     return Math.max(0, performance.now() - this.lockOriginMonoMs);
   }
 
+  /**
+   * Stamp for log entries: the beat and phase at local monotonic time
+   * `atMonoMs` (default now), from the last pulse. Returns `null` before
+   * the first pulse.
+   *
+   * ```ts
+   * console.error("cue missed", client.beatStamp());
+   * ```
+   */
+  beatStamp(atMonoMs: number = performance.now()): BeatStamp | null {
+    const last = this.lastPulse;
+    if (!last || this.epochMs === null || last.periodMs <= 0) return null;
+    const serverMs = last.serverNowMs + (atMonoMs - last.arrivalMonoMs);
+    const beats = (serverMs - last.serverNextMs) / last.periodMs;
+    const k = Math.floor(beats);
+    const seq = last.seq + 1 + k;
+    if (seq < 0) return null;
+    return { channel: this.channel, epochMs: this.epochMs, seq, phase: beats - k };
+  }
+
+  /**
+   * Runs the standard self-test on a separate connection: 16 clock sync
+   * probes 100 ms apart while pulses keep arriving, scored by the server.
+   * Works whether or not this client is connected or locked.
+   */
+  selfTest(timeoutMs: number = 10_000): Promise<SelfTestResult> {
+    return new Promise((resolve, reject) => {
+      const ws = new WebSocket(this.url, PROTO_JSON);
+      const probes: { t1: number; t2: number; t3: number; t4: number }[] = [];
+      const pulses: { now_ms: number; received_ms: number }[] = [];
+      let timer: ReturnType<typeof setInterval> | undefined;
+      const done = setTimeout(() => finish(new Error("self-test timed out")), timeoutMs);
+      const finish = (err: Error | null, result?: SelfTestResult) => {
+        clearTimeout(done);
+        clearInterval(timer);
+        ws.close();
+        if (err) reject(err);
+        else resolve(result!);
+      };
+      // The wall clock, as sync_req's t1 and t4 are.
+      const clientNowMs = () => performance.timeOrigin + performance.now();
+
+      ws.addEventListener("open", () => {
+        let sent = 0;
+        timer = setInterval(() => {
+          if (sent === SELF_TEST_PROBES) {
+            clearInterval(timer);
+            return;
+          }
+          ws.send(JSON.stringify({ type: "sync_req", id: sent++, t1: clientNowMs() }));
+        }, SELF_TEST_SPACING_MS);
+      });
+      ws.addEventListener("error", () => finish(new Error("self-test connection failed")));
+      ws.addEventListener("message", (ev: MessageEvent<string>) => {
+        const t4 = clientNowMs();
+        let msg: Record<string, unknown>;
+        try {
+          msg = JSON.parse(ev.data);
+        } catch {
+          return;
+        }
+        switch (msg["type"]) {
+          case "pulse":
+            pulses.push({ now_ms: finiteOr(msg["now_ms"], 0), received_ms: t4 });
+            break;
+          case "sync_resp":
+            probes.push({
+              t1: finiteOr(msg["t1"], 0),
+              t2: finiteOr(msg["t2"], 0),
+              t3: finiteOr(msg["t3"], 0),
+              t4,
+            });
+            if (probes.length === SELF_TEST_PROBES) {
+              ws.send(JSON.stringify({ type: "selftest", probes, pulses }));
+            }
+            break;
+          case "selftest_result":
+            finish(null, msg as unknown as SelfTestResult);
+            break;
+        }
+      });
+    });
+  }
+
   /**
    * Predicted monotonic timestamp (`performance.now()` basis) of the next
    * pulse arrival. Returns `null` when no pulse has been received yet.
@@ -248,6 +408,10 @@ export class PulseSyncClient extends EventTarget {
     }
 
     const periodMs = finiteOr(pulse.period_ms, 1000);
+    if (typeof pulse.channel === "string") this.channel = pulse.channel;
+    // Unless the pulse says, its timeline began where seq 0 would have
+    // fallen at this period, as the server reckons it.
+    this.epochMs = finiteOr(pulse.epoch_ms, finiteOr(pulse.next_ms, 0) - (pulse.seq + 1) * periodMs);
     this.lastPulse = {
       seq: pulse.seq,
       serverNowMs: finiteOr(pulse.now_ms, 0),
@@ -343,6 +507,12 @@ export class PulseSyncClient extends EventTarget {
   }
 }
 
+// The subprotocol connections use: legacy v1 connections only receive
+// pulses, not announcements or self-test answers.
+const PROTO_JSON = "pulse.v2+json";
+const SELF_TEST_PROBES = 16;
+const SELF_TEST_SPACING_MS = 100;
+
 //TODO: Move somewhere else maybe?
 function defaultWSURL(): string {
   if (location.protocol === "file:") return "ws://localhost:8080/ws";
@@ -359,6 +529,14 @@ function clamp(v: number, lo: number, hi: number): number {
   return Math.min(hi, Math.max(lo, v));
 }
 
+function isMessage(v: unknown, type: string): v is Record<string, unknown> {
+  return typeof v === "object" && v !== null && (v as Record<string, unknown>)["type"] === type;
+}
+
+function isAnnouncement(v: unknown): v is Announcement & { type: "announcement" } {
+  return isMessage(v, "announcement") && typeof v["id"] === "string" && typeof v["text"] === "string";
+}
+
 function isPulseMessage(v: unknown): v is PulseMessage {
   return (
     typeof v === "object" &&
@@ -366,3 +544,11 @@ function isPulseMessage(v: unknown): v is PulseMessage {
     (v as Record<string, unknown>)["type"] === "pulse"
   );
 }
+
+export {
+  BINARY_PROTOCOL,
+  TAGGED_PROTOCOL,
+  decodeBinaryPulse,
+  decodeTaggedPulse,
+} from "./pulse-codec";
+export type { DecodedPulse } from "./pulse-codec";